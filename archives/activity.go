@@ -0,0 +1,238 @@
+package archives
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// the S3 prefix we write activity logs under
+const activityLogPrefix = "/activity/"
+
+const (
+	// ActivityUploaded is when an archive was uploaded to S3
+	ActivityUploaded = "archive_uploaded"
+
+	// ActivityCreated is when a new archive was recorded in the database
+	ActivityCreated = "archive_created"
+
+	// ActivityUpdated is when an existing archive was rebuilt and its row updated
+	ActivityUpdated = "archive_updated"
+
+	// ActivityDeleted is when the records of an archive were deleted, or marked deleted with its monthly
+	ActivityDeleted = "records_deleted"
+
+	// ActivityFailed is when archiving the org failed, what happened before it is still logged
+	ActivityFailed = "failed"
+)
+
+// ActivityEvent is a single line of an org's activity log
+type ActivityEvent struct {
+	Event       string        `json:"event"`
+	Time        time.Time     `json:"time"`
+	OrgID       int           `json:"org_id"`
+	ArchiveType ArchiveType   `json:"archive_type"`
+	ArchiveID   int           `json:"archive_id,omitempty"`
+	StartDate   string        `json:"start_date,omitempty"`
+	Period      ArchivePeriod `json:"period,omitempty"`
+	Partial     bool          `json:"partial,omitempty"`
+	RecordCount int           `json:"record_count"`
+	Size        int64         `json:"size,omitempty"`
+	Hash        string        `json:"hash,omitempty"`
+	URL         string        `json:"url,omitempty"`
+	Error       string        `json:"error,omitempty"`
+}
+
+// ActivityLog is the log of what was archived and deleted for an org in a run, delivered to orgs which are owed one.
+// Events are buffered while we archive the org and written together when it is flushed.
+type ActivityLog struct {
+	org       Org
+	startedOn time.Time
+
+	mutex  sync.Mutex
+	events []*ActivityEvent
+}
+
+// the activity logs of the orgs we are archiving, by org id, which events are recorded to as they happen
+var activityLogs = struct {
+	sync.Mutex
+	orgs map[int]*ActivityLog
+}{orgs: make(map[int]*ActivityLog)}
+
+// StartActivityLog starts recording the activity of the passed in org for the run started at the passed in time, if
+// we write activity logs and the org is owed one, either because we log all orgs or archive_activity_log is set in its
+// config. Returns nil if the org doesn't get an activity log.
+func StartActivityLog(ctx context.Context, config *Config, db *sqlx.DB, org Org, startedOn time.Time) (*ActivityLog, error) {
+	if config.ActivityLogPath == "" {
+		return nil, nil
+	}
+
+	if !config.ActivityLogAllOrgs {
+		enabled, err := orgWantsActivityLog(ctx, db, org)
+		if err != nil || !enabled {
+			return nil, err
+		}
+	}
+
+	log := &ActivityLog{org: org, startedOn: startedOn.In(time.UTC), events: make([]*ActivityEvent, 0)}
+
+	activityLogs.Lock()
+	activityLogs.orgs[org.ID] = log
+	activityLogs.Unlock()
+
+	return log, nil
+}
+
+// orgWantsActivityLog returns whether archive_activity_log is set in the config of the passed in org
+func orgWantsActivityLog(ctx context.Context, db *sqlx.DB, org Org) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	var config sql.NullString
+	err := db.GetContext(ctx, &config, lookupOrgConfig, org.ID)
+	if err != nil {
+		return false, errors.Wrapf(err, "error reading config for org: %d", org.ID)
+	}
+	if !config.Valid || config.String == "" {
+		return false, nil
+	}
+
+	parsed := struct {
+		ArchiveActivityLog bool `json:"archive_activity_log"`
+	}{}
+	err = json.Unmarshal([]byte(config.String), &parsed)
+	if err != nil {
+		return false, errors.Wrapf(err, "error parsing config for org: %d", org.ID)
+	}
+	return parsed.ArchiveActivityLog, nil
+}
+
+// recordActivity adds an event for the passed in archive to the activity log of its org, if it has one
+func recordActivity(event string, archive *Archive) {
+	// archives read back from the database only have their org id
+	orgID := archive.OrgID
+	if orgID == 0 {
+		orgID = archive.Org.ID
+	}
+
+	activityLogs.Lock()
+	log := activityLogs.orgs[orgID]
+	activityLogs.Unlock()
+
+	if log == nil {
+		return
+	}
+
+	log.add(&ActivityEvent{
+		Event:       event,
+		Time:        time.Now().In(time.UTC),
+		OrgID:       orgID,
+		ArchiveType: archive.ArchiveType,
+		ArchiveID:   archive.ID,
+		StartDate:   archive.StartDate.Format("2006-01-02"),
+		Period:      archive.Period,
+		Partial:     archive.Partial,
+		RecordCount: archive.RecordCount,
+		Size:        archive.Size,
+		Hash:        archive.Hash,
+		URL:         archive.URL,
+	})
+}
+
+func (l *ActivityLog) add(event *ActivityEvent) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.events = append(l.events, event)
+}
+
+// Failed records that archiving the passed in type failed, it is safe to call on a nil log
+func (l *ActivityLog) Failed(archiveType ArchiveType, err error) {
+	if l == nil {
+		return
+	}
+
+	l.add(&ActivityEvent{
+		Event:       ActivityFailed,
+		Time:        time.Now().In(time.UTC),
+		OrgID:       l.org.ID,
+		ArchiveType: archiveType,
+		Error:       err.Error(),
+	})
+}
+
+// Events returns the events recorded so far
+func (l *ActivityLog) Events() []*ActivityEvent {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return append([]*ActivityEvent(nil), l.events...)
+}
+
+// Flush stops recording the activity of our org and writes what we recorded as NDJSON, under /activity/<org_id>/ in
+// our bucket if our activity log path is "s3", otherwise to the <org_id> directory of the local directory it names.
+// Nothing is written if nothing happened. Returns where the log was written, it is safe to call on a nil log.
+func (l *ActivityLog) Flush(ctx context.Context, config *Config, s3Client StorageClient) (string, error) {
+	if l == nil {
+		return "", nil
+	}
+
+	activityLogs.Lock()
+	if activityLogs.orgs[l.org.ID] == l {
+		delete(activityLogs.orgs, l.org.ID)
+	}
+	activityLogs.Unlock()
+
+	events := l.Events()
+	if len(events) == 0 {
+		return "", nil
+	}
+
+	encoded := &bytes.Buffer{}
+	encoder := json.NewEncoder(encoded)
+	for _, event := range events {
+		err := encoder.Encode(event)
+		if err != nil {
+			return "", errors.Wrapf(err, "error encoding activity event")
+		}
+	}
+
+	name := fmt.Sprintf("activity_%s.jsonl", l.startedOn.Format("20060102T150405Z"))
+
+	if config.ActivityLogPath == "s3" {
+		if s3Client == nil {
+			return "", fmt.Errorf("unable to write activity log to s3, no s3 client")
+		}
+
+		key := activityLogPrefix + strconv.Itoa(l.org.ID) + "/" + name
+		url, err := s3Client.PutObject(ctx, config.StorageBucket(), key, bytes.NewReader(encoded.Bytes()), int64(encoded.Len()), "application/x-ndjson", "")
+		if err != nil {
+			return "", errors.Wrapf(err, "error uploading activity log for org: %d", l.org.ID)
+		}
+		return url, nil
+	}
+
+	dir := filepath.Join(config.ActivityLogPath, strconv.Itoa(l.org.ID))
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", errors.Wrapf(err, "error creating activity log directory: %s", dir)
+	}
+
+	filename := filepath.Join(dir, name)
+	err = ioutil.WriteFile(filename, encoded.Bytes(), 0600)
+	if err != nil {
+		return "", errors.Wrapf(err, "error writing activity log: %s", filename)
+	}
+	return filename, nil
+}
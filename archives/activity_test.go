@@ -0,0 +1,129 @@
+package archives
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestActivityLog(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+
+	dir, err := ioutil.TempDir("", "activity")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := NewConfig()
+	config.Delete = true
+	config.RetentionPeriod = 1
+	config.ActivityLogPath = dir
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+
+	_, err = db.Exec(`UPDATE orgs_org SET config = $1 WHERE id = 2`, `{"archive_activity_log": true}`)
+	assert.NoError(t, err)
+
+	startedOn := time.Date(2017, 8, 13, 1, 0, 0, 0, time.UTC)
+
+	// orgs which haven't asked for one don't get an activity log
+	activity, err := StartActivityLog(ctx, config, db, orgs[0], startedOn)
+	assert.NoError(t, err)
+	assert.Nil(t, activity)
+
+	activity, err = StartActivityLog(ctx, config, db, orgs[1], startedOn)
+	assert.NoError(t, err)
+	assert.NotNil(t, activity)
+
+	// we archive three days and delete the records of the two past our retention period
+	now := time.Date(2017, 8, 13, 1, 0, 0, 0, time.UTC)
+	created, deleted, err := ArchiveOrg(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(created))
+	assert.Equal(t, 2, len(deleted))
+
+	// other orgs aren't logged to ours
+	_, _, err = ArchiveOrg(ctx, now, config, db, s3Client, orgs[2], MessageType)
+	assert.NoError(t, err)
+
+	activity.Failed(RunType, fmt.Errorf("error archiving runs"))
+
+	filename, err := activity.Flush(ctx, config, s3Client)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "2", "activity_20170813T010000Z.jsonl"), filename)
+
+	file, err := os.Open(filename)
+	assert.NoError(t, err)
+	defer file.Close()
+
+	events := make([]*ActivityEvent, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		event := &ActivityEvent{}
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), event))
+		events = append(events, event)
+	}
+
+	type summary struct {
+		event     string
+		startDate string
+		archiveID int
+	}
+	summaries := make([]summary, 0, len(events))
+	for _, e := range events {
+		assert.Equal(t, 2, e.OrgID)
+		assert.False(t, e.Time.IsZero())
+		summaries = append(summaries, summary{e.Event, e.StartDate, e.ArchiveID})
+	}
+
+	assert.Equal(t, []summary{
+		{ActivityUploaded, "2017-08-10", 0},
+		{ActivityCreated, "2017-08-10", created[0].ID},
+		{ActivityUploaded, "2017-08-11", 0},
+		{ActivityCreated, "2017-08-11", created[1].ID},
+		{ActivityUploaded, "2017-08-12", 0},
+		{ActivityCreated, "2017-08-12", created[2].ID},
+		{ActivityDeleted, "2017-08-10", created[0].ID},
+		{ActivityDeleted, "2017-08-11", created[1].ID},
+		{ActivityFailed, "", 0},
+	}, summaries)
+
+	assert.Equal(t, created[2].Hash, events[5].Hash)
+	assert.Equal(t, created[2].URL, events[5].URL)
+	assert.Equal(t, 3, events[5].RecordCount)
+	assert.Equal(t, MessageType, events[5].ArchiveType)
+	assert.Equal(t, RunType, events[8].ArchiveType)
+	assert.Equal(t, "error archiving runs", events[8].Error)
+
+	// once flushed nothing more is recorded
+	_, _, err = ArchiveOrg(ctx, now.AddDate(0, 0, 1), config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 9, len(activity.Events()))
+
+	// and writing to s3 puts logs under their org
+	config.ActivityLogPath = "s3"
+	activity, err = StartActivityLog(ctx, config, db, orgs[1], startedOn)
+	assert.NoError(t, err)
+	activity.Failed(MessageType, fmt.Errorf("boom"))
+
+	url, err := activity.Flush(ctx, config, s3Client)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://dl-archiver-test.s3.amazonaws.com/activity/2/activity_20170813T010000Z.jsonl", url)
+	assert.Contains(t, s3Client.objects, "dl-archiver-test:/activity/2/activity_20170813T010000Z.jsonl")
+
+	// nil logs are safe to use for orgs without one
+	var none *ActivityLog
+	none.Failed(MessageType, fmt.Errorf("boom"))
+	filename, err = none.Flush(ctx, config, s3Client)
+	assert.NoError(t, err)
+	assert.Equal(t, "", filename)
+}
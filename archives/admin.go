@@ -0,0 +1,228 @@
+package archives
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// the longest line we'll read from an archive, runs with long paths can be big
+const maxRecordSize = 16 * 1024 * 1024
+
+// NewAdminServer returns a server for our admin endpoints, which all require our admin token
+func NewAdminServer(config *Config, db *sqlx.DB, s3Client Storage) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/preview", requireAdminToken(config, &previewHandler{config: config, db: db, s3Client: s3Client}))
+	mux.Handle("/status", requireAdminToken(config, http.HandlerFunc(statusHandler)))
+
+	return &http.Server{
+		Addr:         config.AdminAddress,
+		Handler:      mux,
+		ReadTimeout:  time.Second * 30,
+		WriteTimeout: time.Minute * 5,
+	}
+}
+
+// requireAdminToken only lets through requests with our admin token in their Authorization header
+func requireAdminToken(config *Config, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expected := "Token " + config.AdminToken
+		if config.AdminToken == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) != 1 {
+			writeAdminError(w, http.StatusUnauthorized, "missing or invalid token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// statusHandler returns the progress of the uploads we are currently making
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"uploads": CurrentUploads()})
+}
+
+// previewHandler returns the first records of an archive as a JSON array, taking org_id, type, date (YYYY-MM-DD for a
+// daily or YYYY-MM for a monthly) and limit parameters
+type previewHandler struct {
+	config   *Config
+	db       *sqlx.DB
+	s3Client Storage
+}
+
+func (h *previewHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Minute*5)
+	defer cancel()
+
+	query := r.URL.Query()
+	orgID, err := strconv.Atoi(query.Get("org_id"))
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, "invalid org_id")
+		return
+	}
+	archiveType := ArchiveType(query.Get("type"))
+	if !ValidArchiveType(query.Get("type")) {
+		writeAdminError(w, http.StatusBadRequest, "invalid type, must be message, run, contact, session, broadcast or channel_event")
+		return
+	}
+
+	date, err := ParseDateInput(query.Get("date"))
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// we never return more than our max, however many are asked for
+	limit := h.config.PreviewMaxRecords
+	if query.Get("limit") != "" {
+		requested, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || requested < 1 {
+			writeAdminError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		if requested < limit {
+			limit = requested
+		}
+	}
+
+	org, err := GetOrg(ctx, h.db, h.config, orgID)
+	if err != nil {
+		logrus.WithError(err).WithField("org_id", orgID).Error("error looking up org for preview")
+		writeAdminError(w, http.StatusInternalServerError, "error looking up org")
+		return
+	}
+	if org == nil {
+		writeAdminError(w, http.StatusNotFound, "no such org")
+		return
+	}
+
+	archive, err := findArchive(ctx, h.db, *org, archiveType, date.Period, date.Start)
+	if err != nil {
+		logrus.WithError(err).WithField("org_id", orgID).Error("error looking up archive for preview")
+		writeAdminError(w, http.StatusInternalServerError, "error looking up archive")
+		return
+	}
+	if archive == nil || archive.URL == "" {
+		writeAdminError(w, http.StatusNotFound, "no such archive")
+		return
+	}
+
+	records, err := PreviewArchive(ctx, h.s3Client, archive, org.IsAnon, limit)
+	if err != nil {
+		logrus.WithError(err).WithField("archive_id", archive.ID).Error("error previewing archive")
+		writeAdminError(w, http.StatusInternalServerError, "error reading archive")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(records)
+}
+
+// findArchive returns the archive of the passed in org, type and period which starts on the passed in date, if any
+func findArchive(ctx context.Context, db *sqlx.DB, org Org, archiveType ArchiveType, period ArchivePeriod, date time.Time) (*Archive, error) {
+	if period == MonthPeriod {
+		return getMonthlyArchive(ctx, db, org, archiveType, date)
+	}
+
+	dailies, err := GetDailyArchivesForDateRange(ctx, db, org, archiveType, date, date)
+	if err != nil || len(dailies) == 0 {
+		return nil, err
+	}
+	dailies[0].Org = org
+	return dailies[0], nil
+}
+
+// PreviewArchive downloads the passed in archive and returns up to limit of its records, masking anything an anon org
+// shouldn't show in case the org became anon after it was archived
+func PreviewArchive(ctx context.Context, s3Client Storage, archive *Archive, anon bool, limit int) ([]map[string]interface{}, error) {
+	reader, err := OpenArchive(ctx, s3Client, archive)
+	if isCold(err) {
+		return nil, fmt.Errorf("archive: %d is in cold storage and must be restored to preview", archive.ID)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error downloading archive: %s", archive.URL)
+	}
+	defer reader.Close()
+
+	records := make([]map[string]interface{}, 0, limit)
+	for len(records) < limit {
+		raw, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading archive")
+		}
+
+		record := make(map[string]interface{})
+		err = json.Unmarshal(raw, &record)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error decoding record %d", len(records)+1)
+		}
+		if anon {
+			maskRecord(archive.ArchiveType, record)
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// maskRecord removes the same things from the passed in record as we do when archiving for an anon org
+func maskRecord(archiveType ArchiveType, record map[string]interface{}) {
+	switch archiveType {
+	case MessageType:
+		record["urn"] = nil
+		if contact, ok := record["contact"].(map[string]interface{}); ok {
+			delete(contact, "name")
+		}
+	case RunType:
+		record["events"] = []interface{}{}
+		if contact, ok := record["contact"].(map[string]interface{}); ok {
+			delete(contact, "fields")
+		}
+	case ContactType:
+		record["name"] = nil
+		record["fields"] = map[string]interface{}{}
+		if urns, ok := record["urns"].([]interface{}); ok {
+			for i, u := range urns {
+				if urn, ok := u.(map[string]interface{}); ok {
+					hash := sha256.Sum256([]byte(fmt.Sprintf("%v:%v", urn["scheme"], urn["path"])))
+					urns[i] = map[string]interface{}{"scheme": urn["scheme"], "hash": hex.EncodeToString(hash[:])}
+				}
+			}
+		}
+	case SessionType:
+		redactSession(record)
+	case ChannelEventType:
+		record["urn"] = nil
+		if contact, ok := record["contact"].(map[string]interface{}); ok {
+			delete(contact, "name")
+		}
+	case BroadcastType:
+		record["urns"] = []interface{}{}
+		if contacts, ok := record["contacts"].([]interface{}); ok {
+			for _, c := range contacts {
+				if contact, ok := c.(map[string]interface{}); ok {
+					delete(contact, "name")
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package archives
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPreviewEndpoint(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+
+	config := NewConfig()
+	config.AdminToken = "sesame"
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	created, err := GetMissingDailyArchives(ctx, db, now, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.NoError(t, createArchives(ctx, db, config, s3Client, orgs[1], created))
+	assert.Equal(t, 3, created[2].RecordCount)
+
+	server := httptest.NewServer(NewAdminServer(config, db, s3Client).Handler)
+	defer server.Close()
+
+	preview := func(query string, token string) (int, []map[string]interface{}) {
+		req, _ := http.NewRequest("GET", server.URL+"/preview?"+query, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Token "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		records := make([]map[string]interface{}, 0)
+		if resp.StatusCode == http.StatusOK {
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&records))
+		}
+		return resp.StatusCode, records
+	}
+
+	// our token is required
+	status, _ := preview("org_id=2&type=message&date=2017-08-12", "")
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status, _ = preview("org_id=2&type=message&date=2017-08-12", "open")
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	status, _ = preview("org_id=2&type=flow&date=2017-08-12", "sesame")
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _ = preview("org_id=2&type=message&date=2017-12-01", "sesame")
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = preview("org_id=99&type=message&date=2017-08-12", "sesame")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	status, records := preview("org_id=2&type=message&date=2017-08-12", "sesame")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 3, len(records))
+	assert.Equal(t, float64(1), records[0]["id"])
+	assert.NotNil(t, records[0]["urn"])
+
+	status, records = preview("org_id=2&type=message&date=2017-08-12&limit=2", "sesame")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 2, len(records))
+
+	// we never return more than our max
+	config.PreviewMaxRecords = 1
+	status, records = preview("org_id=2&type=message&date=2017-08-12&limit=2", "sesame")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 1, len(records))
+
+	// orgs which became anon after being archived are masked
+	_, err = db.Exec(`UPDATE orgs_org SET is_anon = TRUE WHERE id = 2`)
+	assert.NoError(t, err)
+	status, records = preview("org_id=2&type=message&date=2017-08-12", "sesame")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 1, len(records))
+	assert.Nil(t, records[0]["urn"])
+	assert.Contains(t, records[0]["contact"], "uuid")
+	assert.NotContains(t, records[0]["contact"], "name")
+}
@@ -8,13 +8,17 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
 	"github.com/pkg/errors"
@@ -33,8 +37,30 @@ const (
 
 	// SessionType for session archives
 	SessionType = ArchiveType("session")
+
+	// ContactType for contact archives, snapshots of the contacts created each day
+	ContactType = ArchiveType("contact")
+
+	// BroadcastType for broadcast archives
+	BroadcastType = ArchiveType("broadcast")
+
+	// ChannelEventType for channel event archives, such as missed calls and referrals
+	ChannelEventType = ArchiveType("channel_event")
 )
 
+// ArchiveTypes are all the types of archives we build
+var ArchiveTypes = []ArchiveType{MessageType, RunType, ContactType, SessionType, BroadcastType, ChannelEventType}
+
+// ValidArchiveType returns whether the passed in string is one of our archive types
+func ValidArchiveType(archiveType string) bool {
+	for _, t := range ArchiveTypes {
+		if ArchiveType(archiveType) == t {
+			return true
+		}
+	}
+	return false
+}
+
 // ArchivePeriod is the period of data in the archive
 type ArchivePeriod string
 
@@ -52,7 +78,19 @@ type Org struct {
 	Name            string    `db:"name"`
 	CreatedOn       time.Time `db:"created_on"`
 	IsAnon          bool      `db:"is_anon"`
+	IsActive        bool      `db:"is_active"`
 	RetentionPeriod int
+	ArchiveLag      int
+	ArchiveFrom     *time.Time
+}
+
+// startDate returns the time we archive the records of this org from, which is when it was created unless it has
+// older records which we've been configured to archive
+func (o *Org) startDate() time.Time {
+	if o.ArchiveFrom != nil && o.ArchiveFrom.Before(o.CreatedOn) {
+		return *o.ArchiveFrom
+	}
+	return o.CreatedOn
 }
 
 // Archive represents the model for an archive
@@ -70,17 +108,34 @@ type Archive struct {
 	Hash        string `db:"hash"`
 	URL         string `db:"url"`
 	BuildTime   int    `db:"build_time"`
+	Version     int    `db:"version"`
 
 	NeedsDeletion bool       `db:"needs_deletion"`
 	DeletedOn     *time.Time `db:"deleted_date"`
 	Rollup        *int       `db:"rollup_id"`
 
-	Org         Org
-	ArchiveFile string
-	Dailies     []*Archive
+	// partial archives are of the current day so far, they aren't written with our other archives
+	Partial bool
+
+	Org            Org
+	ArchiveFile    string
+	Dailies        []*Archive
+	Summary        *ArchiveSummary
+	ContactCount   *int
+	ContactSketch  []byte
+	StorageClass   string
+	ContactGroupID int
+	Timings        ArchiveTimings
+	Format         string
+	DailyFormats   map[string]int
+	Orphans        []string
+
+	// Err is why our last attempt to build, roll up or delete the records of this archive failed, if it did
+	Err error
 }
 
-func (a *Archive) endDate() time.Time {
+// EndDate returns the end of the window of records in our archive, which is [StartDate, EndDate) in UTC
+func (a *Archive) EndDate() time.Time {
 	endDate := a.StartDate
 	if a.Period == DayPeriod {
 		endDate = endDate.AddDate(0, 0, 1)
@@ -90,34 +145,149 @@ func (a *Archive) endDate() time.Time {
 	return endDate
 }
 
-const lookupActiveOrgs = `
-SELECT o.id, o.name, o.created_on, o.is_anon 
+// archiveEndDate returns the day our org's records may be archived up to, which is our archive lag after they close or
+// once they are past our retention period if we have no lag
+func (o *Org) archiveEndDate(now time.Time) time.Time {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if o.ArchiveLag > 0 {
+		return today.AddDate(0, 0, -o.ArchiveLag)
+	}
+	return today.AddDate(0, 0, -o.RetentionPeriod)
+}
+
+// deleteEndDate returns the day our org's records may be deleted up to, which is always once they are past our
+// retention period
+func (o *Org) deleteEndDate(now time.Time) time.Time {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	return today.AddDate(0, 0, -o.RetentionPeriod)
+}
+
+const selectOrgs = `
+SELECT o.id, o.name, o.created_on, o.is_anon, o.is_active 
 FROM orgs_org o 
-WHERE o.is_active = TRUE order by o.id
 `
 
+const lookupActiveOrgs = selectOrgs + `WHERE o.is_active = TRUE order by o.id`
+
+const lookupDeactivatedOrgs = selectOrgs + `WHERE o.is_active = FALSE order by o.id`
+
+const lookupIdleOrgs = selectOrgs + `
+WHERE NOT EXISTS (SELECT 1 FROM msgs_msg m WHERE m.org_id = o.id AND m.created_on >= $1)
+AND NOT EXISTS (SELECT 1 FROM flows_flowrun r WHERE r.org_id = o.id AND r.created_on >= $1)
+order by o.id`
+
+const lookupOrg = selectOrgs + `WHERE o.id = $1`
+
 // GetActiveOrgs returns the active organizations sorted by id
 func GetActiveOrgs(ctx context.Context, db *sqlx.DB, conf *Config) ([]Org, error) {
+	orgs, err := loadOrgs(ctx, db, conf, lookupActiveOrgs)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error fetching active orgs")
+	}
+	return orgs, nil
+}
+
+// GetInactiveOrgs returns the inactive organizations sorted by id. If we have inactive days those are the orgs without
+// any messages or runs created in that many days before now, otherwise they are the orgs which have been deactivated.
+func GetInactiveOrgs(ctx context.Context, db *sqlx.DB, conf *Config, now time.Time) ([]Org, error) {
+	var orgs []Org
+	var err error
+	criteria := "deactivated"
+
+	if conf.InactiveDays > 0 {
+		criteria = fmt.Sprintf("no messages or runs in %d days", conf.InactiveDays)
+		orgs, err = loadOrgs(ctx, db, conf, lookupIdleOrgs, now.AddDate(0, 0, -conf.InactiveDays))
+	} else {
+		orgs, err = loadOrgs(ctx, db, conf, lookupDeactivatedOrgs)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error fetching inactive orgs")
+	}
+
+	logrus.WithField("criteria", criteria).WithField("org_count", len(orgs)).Info("found inactive orgs")
+	return orgs, nil
+}
+
+// AddInactiveOrgs returns the passed in orgs along with any inactive orgs which aren't among them, sorted by id
+func AddInactiveOrgs(ctx context.Context, db *sqlx.DB, conf *Config, now time.Time, orgs []Org) ([]Org, error) {
+	inactive, err := GetInactiveOrgs(ctx, db, conf, now)
+	if err != nil {
+		return nil, err
+	}
+
+	listed := make(map[int]bool, len(orgs))
+	for _, org := range orgs {
+		listed[org.ID] = true
+	}
+	for _, org := range inactive {
+		if !listed[org.ID] {
+			orgs = append(orgs, org)
+		}
+	}
+
+	sort.SliceStable(orgs, func(i, j int) bool { return orgs[i].ID < orgs[j].ID })
+	return orgs, nil
+}
+
+// GetOrg returns the current state of the org with the passed in id, or nil if it no longer exists
+func GetOrg(ctx context.Context, db *sqlx.DB, conf *Config, orgID int) (*Org, error) {
+	orgs, err := loadOrgs(ctx, db, conf, lookupOrg, orgID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error fetching org: %d", orgID)
+	}
+	if len(orgs) == 0 {
+		return nil, nil
+	}
+	return &orgs[0], nil
+}
+
+// loadOrgs loads the orgs returned by the passed in query, which must select the columns of selectOrgs. Every org we
+// archive is loaded here so always has the retention period and archive lag of our config.
+func loadOrgs(ctx context.Context, db *sqlx.DB, conf *Config, query string, args ...interface{}) ([]Org, error) {
 	ctx, cancel := context.WithTimeout(ctx, time.Minute)
 	defer cancel()
 
-	rows, err := db.QueryxContext(ctx, lookupActiveOrgs)
+	rows, err := db.QueryxContext(ctx, query, args...)
 	if err != nil {
-		return nil, errors.Wrapf(err, "error fetching active orgs")
+		return nil, err
 	}
 	defer rows.Close()
 
 	orgs := make([]Org, 0, 10)
 	for rows.Next() {
-		org := Org{RetentionPeriod: conf.RetentionPeriod}
+		org := Org{RetentionPeriod: conf.RetentionPeriod, ArchiveLag: conf.ArchiveLagDays}
 		err = rows.StructScan(&org)
 		if err != nil {
-			return nil, errors.Wrapf(err, "error scanning active org")
+			return nil, errors.Wrapf(err, "error scanning org")
 		}
 		orgs = append(orgs, org)
 	}
+	return orgs, rows.Err()
+}
 
-	return orgs, nil
+// checkOrgRetention checks that the passed in org has a retention period, without one we would archive and delete the
+// records of today, so we refuse to rather than trusting every caller built the org properly
+func checkOrgRetention(org Org) error {
+	if org.RetentionPeriod <= 0 {
+		return fmt.Errorf("org: %d has a retention period of %d days, refusing to archive current records", org.ID, org.RetentionPeriod)
+	}
+	return nil
+}
+
+// orgGone returns whether the passed in org has been deactivated or deleted since we listed it, in which case we skip
+// it, any archives already written for it remain valid. Orgs we listed as inactive are only skipped once deleted.
+func orgGone(ctx context.Context, db *sqlx.DB, conf *Config, org Org) bool {
+	current, err := GetOrg(ctx, db, conf, org.ID)
+	if err != nil {
+		logrus.WithError(err).WithField("org_id", org.ID).Error("error checking whether org is still active")
+		return false
+	}
+	if current != nil && (current.IsActive || !org.IsActive) {
+		return false
+	}
+
+	logrus.WithField("org_id", org.ID).WithField("deleted", current == nil).Info("org no longer active, skipping")
+	return true
 }
 
 const lookupOrgArchives = `
@@ -126,7 +296,9 @@ FROM archives_archive WHERE org_id = $1 AND archive_type = $2
 ORDER BY start_date asc, period desc
 `
 
-// GetCurrentArchives returns all the current archives for the passed in org and record type
+// GetCurrentArchives returns all the current archives for the passed in org and record type. Every archive is held in
+// memory at once, which for orgs with years of dailies is thousands of them, so callers which don't need them all
+// together should use ForEachCurrentArchive or a query of just the archives they need instead.
 func GetCurrentArchives(ctx context.Context, db *sqlx.DB, org Org, archiveType ArchiveType) ([]*Archive, error) {
 	ctx, cancel := context.WithTimeout(ctx, time.Minute)
 	defer cancel()
@@ -140,8 +312,107 @@ func GetCurrentArchives(ctx context.Context, db *sqlx.DB, org Org, archiveType A
 	return archives, nil
 }
 
+// the number of archives we read at once when going through all the archives of an org
+var currentArchivesPageSize = 1000
+
+// pages through the archives of an org in the same order as lookupOrgArchives, starting after the passed in archive
+const lookupOrgArchivesPage = `
+SELECT id, org_id, start_date::timestamp with time zone as start_date, period, archive_type, hash, size, record_count, url, rollup_id, needs_deletion
+FROM archives_archive WHERE org_id = $1 AND archive_type = $2 AND (
+	start_date > $3 OR (start_date = $3 AND period < $4) OR (start_date = $3 AND period = $4 AND id > $5)
+)
+ORDER BY start_date asc, period desc, id asc
+LIMIT $6
+`
+
+// ForEachCurrentArchive calls the passed in function with each of the current archives of the passed in org and record
+// type, in the same order as GetCurrentArchives, reading them a page at a time so only a page is ever held in memory.
+// Returning an error from the function stops us and is returned as is.
+func ForEachCurrentArchive(ctx context.Context, db *sqlx.DB, org Org, archiveType ArchiveType, fn func(*Archive) error) error {
+	// every archive starts after the zero time
+	after := &Archive{}
+
+	for {
+		page, err := lookupCurrentArchivesPage(ctx, db, org, archiveType, after)
+		if err != nil {
+			return err
+		}
+
+		for _, a := range page {
+			err = fn(a)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(page) < currentArchivesPageSize {
+			return nil
+		}
+		after = page[len(page)-1]
+	}
+}
+
+// lookupCurrentArchivesPage returns the next page of the current archives of the passed in org after the passed in one
+func lookupCurrentArchivesPage(ctx context.Context, db *sqlx.DB, org Org, archiveType ArchiveType, after *Archive) ([]*Archive, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	page := make([]*Archive, 0, currentArchivesPageSize)
+	err := db.SelectContext(ctx, &page, lookupOrgArchivesPage, org.ID, archiveType, after.StartDate, after.Period, after.ID, currentArchivesPageSize)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, errors.Wrapf(err, "error selecting current archives for org: %d and type: %s", org.ID, archiveType)
+	}
+	return page, nil
+}
+
+const lookupArchivesByID = `
+SELECT id, org_id, start_date::timestamp with time zone as start_date, period, archive_type, hash, size, record_count, url, rollup_id, needs_deletion
+FROM archives_archive WHERE id = ANY($1)
+ORDER BY start_date asc, period desc
+`
+
+// getArchivesByID returns the archives with the passed in ids
+func getArchivesByID(ctx context.Context, db *sqlx.DB, ids []int) ([]*Archive, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	archives := make([]*Archive, 0, len(ids))
+	if len(ids) == 0 {
+		return archives, nil
+	}
+
+	err := db.SelectContext(ctx, &archives, lookupArchivesByID, pq.Array(ids))
+	if err != nil && err != sql.ErrNoRows {
+		return nil, errors.Wrapf(err, "error selecting archives by id")
+	}
+	return archives, nil
+}
+
+// archives overlap our window when they start before it ends and end after it starts
+const lookupOrgArchivesOverlapping = `
+SELECT id, org_id, start_date::timestamp with time zone as start_date, period, archive_type, hash, size, record_count, url, rollup_id, needs_deletion
+FROM archives_archive WHERE org_id = $1 AND archive_type = $2 AND start_date < $4 AND (
+	(period = 'D' AND start_date >= $3) OR (period = 'M' AND start_date > $3::date - '1 month'::interval)
+)
+ORDER BY start_date asc, period desc
+`
+
+// getArchivesOverlapping returns the current archives for the passed in org and record type which cover any records in
+// the window [startDate, endDate)
+func getArchivesOverlapping(ctx context.Context, db *sqlx.DB, org Org, archiveType ArchiveType, startDate time.Time, endDate time.Time) ([]*Archive, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	archives := make([]*Archive, 0, 1)
+	err := db.SelectContext(ctx, &archives, lookupOrgArchivesOverlapping, org.ID, archiveType, startDate, endDate)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, errors.Wrapf(err, "error selecting archives for org: %d and type: %s", org.ID, archiveType)
+	}
+	return archives, nil
+}
+
 const lookupArchivesNeedingDeletion = `
-SELECT id, org_id, start_date::timestamp with time zone as start_date, period, archive_type, hash, size, record_count, url, rollup_id, needs_deletion 
+SELECT id, org_id, created_on, start_date::timestamp with time zone as start_date, period, archive_type, hash, size, record_count, url, rollup_id, needs_deletion 
 FROM archives_archive WHERE org_id = $1 AND archive_type = $2 AND needs_deletion = TRUE
 ORDER BY start_date asc, period desc
 `
@@ -183,10 +454,10 @@ func GetCurrentArchiveCount(ctx context.Context, db *sqlx.DB, org Org, archiveTy
 
 // between is inclusive on both sides
 const lookupOrgDailyArchivesForDateRange = `
-SELECT id, start_date::timestamp with time zone as start_date, period, archive_type, hash, size, record_count, url, rollup_id
-FROM archives_archive
-WHERE org_id = $1 AND archive_type = $2 AND period = $3 AND start_date BETWEEN $4 AND $5
-ORDER BY start_date asc
+SELECT a.id, a.start_date::timestamp with time zone as start_date, a.period, a.archive_type, a.hash, a.size, a.record_count, a.url, a.rollup_id, a.needs_deletion, COALESCE(v.version, 1) as version
+FROM archives_archive a LEFT JOIN archiver_archive_versions v ON v.archive_id = a.id
+WHERE a.org_id = $1 AND a.archive_type = $2 AND a.period = $3 AND a.start_date BETWEEN $4 AND $5
+ORDER BY a.start_date asc
 `
 
 // GetDailyArchivesForDateRange returns all the current archives for the passed in org and record type and date range
@@ -204,14 +475,193 @@ func GetDailyArchivesForDateRange(ctx context.Context, db *sqlx.DB, org Org, arc
 	return existingArchives, nil
 }
 
+// the value of an org start setting when the org has no records from before it was created
+const orgStartNone = "none"
+
+// CheckOrgStart looks for records of the passed in org from before it was created, such as imported history, which
+// we would otherwise never archive. If ExtendBeforeOrgCreation is set, the returned org is archived from the earliest
+// of these, otherwise we warn about the gap. What we find is cached in our settings, so we only look, and warn, the
+// first time we check an org, delete its org_start setting to look again. Dry runs never write our cache.
+func CheckOrgStart(ctx context.Context, db *sqlx.DB, config *Config, org Org, archiveType ArchiveType) (Org, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	var query string
+	setting := fmt.Sprintf("org_start_%d_%s", org.ID, archiveType)
+	switch archiveType {
+	case MessageType:
+		query = lookupEarliestMsg
+	case RunType:
+		field, err := runPartitionField(config)
+		if err != nil {
+			return org, err
+		}
+		query = fmt.Sprintf(lookupEarliestRun, field)
+		setting = fmt.Sprintf("%s_%s", setting, field)
+	case ContactType:
+		query = lookupEarliestContact
+	case SessionType:
+		query = lookupEarliestSession
+	case BroadcastType:
+		query = lookupEarliestBroadcast
+	case ChannelEventType:
+		query = lookupEarliestChannelEvent
+	default:
+		return org, fmt.Errorf("unknown archive type: %s", archiveType)
+	}
+
+	cached, err := GetSetting(ctx, db, setting)
+	if err != nil {
+		return org, err
+	}
+
+	var earliest *time.Time
+	if cached != "" {
+		if cached != orgStartNone {
+			parsed, err := time.Parse(time.RFC3339Nano, cached)
+			if err != nil {
+				return org, errors.Wrapf(err, "invalid setting: %s", setting)
+			}
+			earliest = &parsed
+		}
+	} else {
+		err = db.GetContext(ctx, &earliest, query, org.ID, org.CreatedOn)
+		if err != nil {
+			return org, errors.Wrapf(err, "error looking up earliest record for org: %d and type: %s", org.ID, archiveType)
+		}
+
+		if !config.DryRun {
+			value := orgStartNone
+			if earliest != nil {
+				value = earliest.UTC().Format(time.RFC3339Nano)
+			}
+			err = SetSetting(ctx, db, setting, value)
+			if err != nil {
+				return org, err
+			}
+		}
+	}
+	if earliest == nil {
+		return org, nil
+	}
+
+	log := logrus.WithFields(logrus.Fields{
+		"org":          org.Name,
+		"org_id":       org.ID,
+		"archive_type": archiveType,
+		"created_on":   org.CreatedOn,
+		"earliest":     *earliest,
+		"gap_days":     int(org.CreatedOn.Sub(*earliest).Hours() / 24),
+	})
+
+	if config.ExtendBeforeOrgCreation {
+		org.ArchiveFrom = earliest
+		if cached == "" {
+			log.Info("archiving records from before org was created")
+		}
+	} else if cached == "" {
+		log.Warn("org has records from before it was created which will never be archived, see extend-before-org-creation")
+	}
+
+	return org, nil
+}
+
+// appendDaily downloads the passed in daily and appends its records to the passed in writer, noting the format its
+// object was in. Each download has its own timeout and is retried once, so a single hung download doesn't use up the
+// time we have for the whole rollup.
+func appendDaily(ctx context.Context, conf *Config, s3Client Storage, daily *Archive, writer io.Writer) error {
+	var file *os.File
+	var err error
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		file, err = downloadDaily(ctx, conf, s3Client, daily)
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+		logrus.WithError(err).WithField("archive_id", daily.ID).WithField("attempt", attempt).Warn("error downloading daily archive")
+	}
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	reader, format, err := dailyRecordsReader(conf, daily, file)
+	daily.Format = format
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	// copy this daily file (uncompressed) to our new monthly file, transcoded dailies may not end their last record
+	lines := &lineEndingWriter{writer: writer}
+	_, err = io.Copy(lines, reader)
+	if err != nil {
+		return errors.Wrapf(err, "error copying daily to monthly for URL: %s", daily.URL)
+	}
+	return lines.endLine()
+}
+
+// downloadDaily downloads the passed in daily to a temporary file, checking its hash, and returns the file ready to read
+func downloadDaily(ctx context.Context, conf *Config, s3Client Storage, daily *Archive) (*os.File, error) {
+	if conf.RollupDownloadTimeoutSec > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Second*time.Duration(conf.RollupDownloadTimeoutSec))
+		defer cancel()
+	}
+
+	file, err := ioutil.TempFile(conf.TempDir, fmt.Sprintf("daily_%d_", daily.ID))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating temp file for daily")
+	}
+
+	fail := func(err error) (*os.File, error) {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	reader, err := getWrittenS3File(ctx, conf, s3Client, daily.URL)
+	if err != nil {
+		return fail(errors.Wrapf(err, "error reading S3 URL: %s", daily.URL))
+	}
+	defer reader.Close()
+
+	// calculate our hash along the way
+	readerHash := md5.New()
+	_, err = io.Copy(io.MultiWriter(file, readerHash), reader)
+	if err != nil {
+		return fail(errors.Wrapf(err, "error copying from s3 to disk for URL: %s", daily.URL))
+	}
+
+	// check our hash that everything was written out
+	hash := hex.EncodeToString(readerHash.Sum(nil))
+	if hash != daily.Hash {
+		return fail(fmt.Errorf("daily hash mismatch. expected: %s, got %s", daily.Hash, hash))
+	}
+
+	// we've just read the whole object, no need to verify it again before deleting
+	markVerified(daily)
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return fail(errors.Wrapf(err, "error seeking daily file"))
+	}
+	return file, nil
+}
+
 // GetMissingDailyArchives calculates what archives need to be generated for the passed in org this is calculated per day
 func GetMissingDailyArchives(ctx context.Context, db *sqlx.DB, now time.Time, org Org, archiveType ArchiveType) ([]*Archive, error) {
+	if err := checkOrgRetention(org); err != nil {
+		return nil, err
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, time.Minute)
 	defer cancel()
 
 	// our first archive would be active days from today
-	endDate := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, -org.RetentionPeriod)
-	orgUTC := org.CreatedOn.In(time.UTC)
+	endDate := org.archiveEndDate(now)
+	orgUTC := org.startDate().In(time.UTC)
 	startDate := time.Date(orgUTC.Year(), orgUTC.Month(), orgUTC.Day(), 0, 0, 0, 0, time.UTC)
 
 	return GetMissingDailyArchivesForDateRange(ctx, db, startDate, endDate, org, archiveType)
@@ -279,13 +729,22 @@ WHERE curr_archives.start_date IS NULL
 
 // GetMissingMonthlyArchives gets which montly archives are currently missing for this org
 func GetMissingMonthlyArchives(ctx context.Context, db *sqlx.DB, now time.Time, org Org, archiveType ArchiveType) ([]*Archive, error) {
+	return getMissingMonthlyArchivesBefore(ctx, db, org.archiveEndDate(now), org, archiveType)
+}
+
+// getMissingMonthlyArchivesBefore gets which monthly archives are missing for this org for the months which end before
+// the passed in time
+func getMissingMonthlyArchivesBefore(ctx context.Context, db *sqlx.DB, before time.Time, org Org, archiveType ArchiveType) ([]*Archive, error) {
+	if err := checkOrgRetention(org); err != nil {
+		return nil, err
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, time.Minute*5)
 	defer cancel()
 
-	lastActive := now.AddDate(0, 0, -org.RetentionPeriod)
-	endDate := time.Date(lastActive.Year(), lastActive.Month(), 1, 0, 0, 0, 0, time.UTC)
+	endDate := time.Date(before.Year(), before.Month(), 1, 0, 0, 0, 0, time.UTC)
 
-	orgUTC := org.CreatedOn.In(time.UTC)
+	orgUTC := org.startDate().In(time.UTC)
 	startDate := time.Date(orgUTC.Year(), orgUTC.Month(), 1, 0, 0, 0, 0, time.UTC)
 
 	missing := make([]*Archive, 0, 1)
@@ -318,7 +777,7 @@ func GetMissingMonthlyArchives(ctx context.Context, db *sqlx.DB, now time.Time,
 }
 
 // BuildRollupArchive builds a monthly archive from the files present on S3
-func BuildRollupArchive(ctx context.Context, db *sqlx.DB, conf *Config, s3Client s3iface.S3API, monthlyArchive *Archive, now time.Time, org Org, archiveType ArchiveType) error {
+func BuildRollupArchive(ctx context.Context, db *sqlx.DB, conf *Config, s3Client Storage, monthlyArchive *Archive, now time.Time, org Org, archiveType ArchiveType) error {
 	ctx, cancel := context.WithTimeout(ctx, time.Hour*time.Duration(conf.BuildRollupArchiveTimeout))
 	defer cancel()
 
@@ -327,8 +786,8 @@ func BuildRollupArchive(ctx context.Context, db *sqlx.DB, conf *Config, s3Client
 	// figure out the first day in the monthlyArchive we'll archive
 	startDate := monthlyArchive.StartDate
 	endDate := startDate.AddDate(0, 1, 0).Add(time.Nanosecond * -1)
-	if monthlyArchive.StartDate.Before(org.CreatedOn) {
-		orgUTC := org.CreatedOn.In(time.UTC)
+	if monthlyArchive.StartDate.Before(org.startDate()) {
+		orgUTC := org.startDate().In(time.UTC)
 		startDate = time.Date(orgUTC.Year(), orgUTC.Month(), orgUTC.Day(), 0, 0, 0, 0, time.UTC)
 	}
 
@@ -350,7 +809,8 @@ func BuildRollupArchive(ctx context.Context, db *sqlx.DB, conf *Config, s3Client
 	}
 	writerHash := md5.New()
 	gzWriter := gzip.NewWriter(io.MultiWriter(file, writerHash))
-	writer := bufio.NewWriter(gzWriter)
+	timed := &timedWriter{writer: gzWriter}
+	writer := bufio.NewWriter(timed)
 	defer file.Close()
 
 	recordCount := 0
@@ -360,50 +820,73 @@ func BuildRollupArchive(ctx context.Context, db *sqlx.DB, conf *Config, s3Client
 		return err
 	}
 
-	// calculate total expected size
+	// rolling up more than one daily for a day would count its records more than once
+	err = checkDuplicateDailies(dailies)
+	if err != nil {
+		return err
+	}
+
+	// calculate total expected size, our records are only as recent as our oldest daily
 	estimatedSize := int64(0)
+	version := ArchiveSchemaVersion
 	for _, d := range dailies {
 		estimatedSize += d.Size
+		if d.Version < version {
+			version = d.Version
+		}
 	}
 
-	// for each daily
-	for _, daily := range dailies {
-		// if there are no records in this daily, just move on
-		if daily.RecordCount == 0 {
-			continue
+	// dailies in cold storage can't be downloaded, we take their records from our database or current monthly instead
+	cold := findColdDailies(ctx, s3Client, dailies)
+	deleted := make([]*Archive, 0)
+	for daily := range cold {
+		if !daily.NeedsDeletion {
+			deleted = append(deleted, daily)
 		}
+	}
 
-		reader, err := GetS3File(ctx, s3Client, daily.URL)
+	var previous *monthlyDays
+	if len(deleted) > 0 {
+		var previousArchive *Archive
+		previous, previousArchive, err = coldRollupSource(ctx, db, conf, s3Client, monthlyArchive, deleted)
 		if err != nil {
-			return errors.Wrapf(err, "error reading S3 URL: %s", daily.URL)
+			return err
 		}
+		defer previous.Close()
 
-		// set up our reader to calculate our hash along the way
-		readerHash := md5.New()
-		teeReader := io.TeeReader(reader, readerHash)
-		gzipReader, err := gzip.NewReader(teeReader)
-		if err != nil {
-			return errors.Wrapf(err, "error creating gzip reader")
+		if previousArchive.Version < version {
+			version = previousArchive.Version
 		}
+	}
 
-		// copy this daily file (uncompressed) to our new monthly file
-		_, err = io.Copy(writer, gzipReader)
-		if err != nil {
-			return errors.Wrapf(err, "error copying from s3 to disk for URL: %s", daily.URL)
+	// for each daily
+	writeStart := time.Now()
+	formats := make(map[string]int)
+	for _, daily := range dailies {
+		// if there are no records in this daily, just move on
+		if daily.RecordCount == 0 {
+			continue
 		}
 
-		reader.Close()
-		gzipReader.Close()
-
-		// check our hash that everything was written out
-		hash := hex.EncodeToString(readerHash.Sum(nil))
-		if hash != daily.Hash {
-			return fmt.Errorf("daily hash mismatch. expected: %s, got %s", daily.Hash, hash)
+		if cold[daily] {
+			err = appendColdDaily(ctx, db, conf, org, daily, previous, writer)
+		} else {
+			err = appendDaily(ctx, conf, s3Client, daily, writer)
+			formats[daily.Format]++
+		}
+		if err != nil {
+			return err
 		}
 
 		recordCount += daily.RecordCount
 	}
 
+	err = writeEmptyHeader(conf, monthlyArchive, version, recordCount, writer)
+	if err != nil {
+		return err
+	}
+	extracted := time.Now()
+
 	monthlyArchive.ArchiveFile = file.Name()
 	err = writer.Flush()
 	if err != nil {
@@ -415,6 +898,9 @@ func BuildRollupArchive(ctx context.Context, db *sqlx.DB, conf *Config, s3Client
 		return err
 	}
 
+	monthlyArchive.Timings.Extraction = extracted.Sub(writeStart) - timed.elapsed
+	monthlyArchive.Timings.Compression = time.Since(writeStart) - monthlyArchive.Timings.Extraction
+
 	// calculate our size and hash
 	monthlyArchive.Hash = hex.EncodeToString(writerHash.Sum(nil))
 	stat, err := file.Stat()
@@ -426,31 +912,118 @@ func BuildRollupArchive(ctx context.Context, db *sqlx.DB, conf *Config, s3Client
 	monthlyArchive.BuildTime = int(time.Since(start) / time.Millisecond)
 	monthlyArchive.Dailies = dailies
 	monthlyArchive.NeedsDeletion = false
+	monthlyArchive.Version = version
+	monthlyArchive.DailyFormats = formats
+
+	if conf.ComputeContactCounts && archiveType == MessageType {
+		err = rollupContactCount(ctx, db, monthlyArchive, dailies)
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
-// EnsureTempArchiveDirectory checks that we can write to our archive directory, creating it first if needbe
-func EnsureTempArchiveDirectory(path string) error {
-	if len(path) == 0 {
-		return fmt.Errorf("path argument cannot be empty")
+// RefreshStaleDailies checks the record count of each daily in the passed in monthly archive against our database,
+// rebuilding any which no longer match, such as when records were added after the daily was built. Dailies whose
+// records have already been deleted can't be checked.
+func RefreshStaleDailies(ctx context.Context, db *sqlx.DB, config *Config, s3Client Storage, org Org, monthlyArchive *Archive) error {
+	dailies, err := GetDailyArchivesForDateRange(ctx, db, org, monthlyArchive.ArchiveType, monthlyArchive.StartDate, monthlyArchive.EndDate().Add(time.Nanosecond*-1))
+	if err != nil {
+		return err
 	}
 
-	// check if path is a directory we can write to
-	fileInfo, err := os.Stat(path)
-	if os.IsNotExist(err) {
-		return os.MkdirAll(path, 0700)
-	} else if err != nil {
-		return errors.Wrapf(err, "error statting temp dir: %s", path)
-	}
+	for _, daily := range dailies {
+		if !daily.NeedsDeletion {
+			continue
+		}
+		daily.Org = org
 
-	// is path a directory
-	if !fileInfo.IsDir() {
-		return fmt.Errorf("path '%s' is not a directory", path)
+		count, err := countArchiveRecords(ctx, db, config, daily)
+		if err != nil {
+			return err
+		}
+		if count == daily.RecordCount {
+			continue
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"org_id":       org.ID,
+			"archive_id":   daily.ID,
+			"archive_type": daily.ArchiveType,
+			"start_date":   daily.StartDate,
+			"record_count": daily.RecordCount,
+			"db_count":     count,
+		}).Warn("daily archive is stale, rebuilding before rollup")
+
+		_, _, err = reArchive(ctx, db, config, s3Client, daily, func(rebuilt *Archive) error {
+			return CreateArchiveFile(ctx, db, config, rebuilt, config.TempDir)
+		})
+		if err != nil {
+			return errors.Wrapf(err, "error rebuilding stale daily archive: %d", daily.ID)
+		}
 	}
 
-	testFilePath := filepath.Join(path, ".test_file")
-	testFile, err := os.Create(testFilePath)
+	return nil
+}
+
+// countArchiveRecords counts the records currently in our database which belong in the passed in archive
+func countArchiveRecords(ctx context.Context, db *sqlx.DB, config *Config, archive *Archive) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute*5)
+	defer cancel()
+
+	var query string
+	switch archive.ArchiveType {
+	case MessageType:
+		query = fmt.Sprintf(countMsgsInRange, extraFilterClause(config, MessageType))
+	case RunType:
+		field, err := runPartitionField(config)
+		if err != nil {
+			return 0, err
+		}
+		query = fmt.Sprintf(countRunsInRange, field, extraFilterClause(config, RunType))
+	case ContactType:
+		query = countContactsInRange
+	case SessionType:
+		query = countSessionsInRange
+	case BroadcastType:
+		query = countBroadcastsInRange
+	case ChannelEventType:
+		query = countChannelEventsInRange
+	default:
+		return 0, fmt.Errorf("unknown archive type: %s", archive.ArchiveType)
+	}
+
+	var count int
+	err := db.GetContext(ctx, &count, query, archive.Org.ID, archive.StartDate, archive.EndDate())
+	if err != nil {
+		return 0, errors.Wrapf(err, "error counting records for org: %d and type: %s", archive.Org.ID, archive.ArchiveType)
+	}
+	return count, nil
+}
+
+// EnsureTempArchiveDirectory checks that we can write to our archive directory, creating it first if needbe
+func EnsureTempArchiveDirectory(path string) error {
+	if len(path) == 0 {
+		return fmt.Errorf("path argument cannot be empty")
+	}
+
+	// check if path is a directory we can write to
+	fileInfo, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return os.MkdirAll(path, 0700)
+	} else if err != nil {
+		return errors.Wrapf(err, "error statting temp dir: %s", path)
+	}
+
+	// is path a directory
+	if !fileInfo.IsDir() {
+		return fmt.Errorf("path '%s' is not a directory", path)
+	}
+
+	testFilePath := filepath.Join(path, ".test_file")
+	testFile, err := os.Create(testFilePath)
 	if err != nil {
 		return fmt.Errorf("directory '%s' is not writable", path)
 	}
@@ -462,7 +1035,7 @@ func EnsureTempArchiveDirectory(path string) error {
 }
 
 // CreateArchiveFile is responsible for writing an archive file for the passed in archive from our database
-func CreateArchiveFile(ctx context.Context, db *sqlx.DB, archive *Archive, archivePath string) error {
+func CreateArchiveFile(ctx context.Context, db *sqlx.DB, config *Config, archive *Archive, archivePath string) error {
 	ctx, cancel := context.WithTimeout(ctx, time.Hour*3)
 	defer cancel()
 
@@ -472,7 +1045,7 @@ func CreateArchiveFile(ctx context.Context, db *sqlx.DB, archive *Archive, archi
 		"org_id":       archive.Org.ID,
 		"archive_type": archive.ArchiveType,
 		"start_date":   archive.StartDate,
-		"end_date":     archive.endDate(),
+		"end_date":     archive.EndDate(),
 		"period":       archive.Period,
 	})
 
@@ -493,36 +1066,60 @@ func CreateArchiveFile(ctx context.Context, db *sqlx.DB, archive *Archive, archi
 	}()
 
 	hash := md5.New()
-	gzWriter := gzip.NewWriter(io.MultiWriter(file, hash))
-	writer := bufio.NewWriter(gzWriter)
 	defer file.Close()
 
 	log.WithFields(logrus.Fields{
 		"filename": file.Name(),
 	}).Debug("creating new archive file")
 
+	// log our progress periodically in case we take a long time
+	progress := startBuildProgress(log, time.Duration(config.HeartbeatInterval)*time.Second)
+	defer progress.finish()
+
+	// write our records, if our connection is dropped midway we start again from an empty file
 	recordCount := 0
-	switch archive.ArchiveType {
-	case MessageType:
-		recordCount, err = writeMessageRecords(ctx, db, archive, writer)
-	case RunType:
-		recordCount, err = writeRunRecords(ctx, db, archive, writer)
-	default:
-		err = fmt.Errorf("unknown archive type: %s", archive.ArchiveType)
-	}
+	err = withConnectionRetry(ctx, db, func() error {
+		if err := file.Truncate(0); err != nil {
+			return errors.Wrapf(err, "error truncating archive file")
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return errors.Wrapf(err, "error seeking archive file")
+		}
+		hash.Reset()
+		progress.reset()
+
+		gzWriter := gzip.NewWriter(io.MultiWriter(file, hash))
+		timed := &timedWriter{writer: gzWriter}
+		writer := bufio.NewWriter(progress.counter(timed))
+		writeStart := time.Now()
+
+		var err error
+		recordCount, err = writeArchiveRecords(ctx, db, config, archive, writer)
+		if err == nil {
+			err = writeEmptyHeader(config, archive, ArchiveSchemaVersion, recordCount, writer)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "error writing archive")
+		}
+		extracted := time.Now()
 
-	if err != nil {
-		return errors.Wrapf(err, "error writing archive")
-	}
+		err = writer.Flush()
+		if err != nil {
+			return errors.Wrapf(err, "error flushing archive file")
+		}
 
-	err = writer.Flush()
-	if err != nil {
-		return errors.Wrapf(err, "error flushing archive file")
-	}
+		err = gzWriter.Close()
+		if err != nil {
+			return errors.Wrapf(err, "error closing archive gzip writer")
+		}
 
-	err = gzWriter.Close()
+		// whatever time we didn't spend compressing while writing records went to reading them
+		archive.Timings.Extraction = extracted.Sub(writeStart) - timed.elapsed
+		archive.Timings.Compression = time.Since(writeStart) - archive.Timings.Extraction
+		return nil
+	})
 	if err != nil {
-		return errors.Wrapf(err, "error closing archive gzip writer")
+		return err
 	}
 
 	// calculate our size and hash
@@ -540,6 +1137,14 @@ func CreateArchiveFile(ctx context.Context, db *sqlx.DB, archive *Archive, archi
 	archive.Size = stat.Size()
 	archive.RecordCount = recordCount
 	archive.BuildTime = int(time.Since(start) / time.Millisecond)
+	archive.Version = ArchiveSchemaVersion
+	archive.ContactGroupID = config.ContactGroupID
+
+	// an archive much smaller than its records should be has probably lost some of them
+	err = checkPlausibility(ctx, db, config, archive)
+	if err != nil {
+		return err
+	}
 
 	log.WithFields(logrus.Fields{
 		"record_count": recordCount,
@@ -549,35 +1154,173 @@ func CreateArchiveFile(ctx context.Context, db *sqlx.DB, archive *Archive, archi
 		"elapsed":      time.Since(start),
 	}).Debug("completed writing archive file")
 
+	logArchiveSummary(log, archive)
 	return nil
 }
 
-// UploadArchive uploads the passed archive file to S3
-func UploadArchive(ctx context.Context, s3Client s3iface.S3API, bucket string, archive *Archive) error {
-	ctx, cancel := context.WithTimeout(ctx, time.Minute*15)
-	defer cancel()
+// writeArchiveRecords writes the records of the passed in archive to the passed in writer, returning how many
+func writeArchiveRecords(ctx context.Context, db *sqlx.DB, config *Config, archive *Archive, writer *bufio.Writer) (int, error) {
+	switch archive.ArchiveType {
+	case MessageType:
+		return writeMessageRecords(ctx, db, config, archive, writer)
+	case RunType:
+		return writeRunRecords(ctx, db, config, archive, writer)
+	case ContactType:
+		return writeContactRecords(ctx, db, config, archive, writer)
+	case SessionType:
+		return writeSessionRecords(ctx, db, config, archive, writer)
+	case BroadcastType:
+		return writeBroadcastRecords(ctx, db, config, archive, writer)
+	case ChannelEventType:
+		return writeChannelEventRecords(ctx, db, config, archive, writer)
+	default:
+		return 0, fmt.Errorf("unknown archive type: %s", archive.ArchiveType)
+	}
+}
+
+// logArchiveSummary logs the summary of the passed in archive if we computed one
+func logArchiveSummary(log *logrus.Entry, archive *Archive) {
+	if archive.Summary != nil {
+		log.WithFields(logrus.Fields{
+			"record_count": archive.RecordCount,
+			"contacts":     archive.Summary.Contacts,
+			"flows":        archive.Summary.Flows,
+			"channels":     archive.Summary.Channels,
+		}).Info("archive summary")
+	}
+}
+
+// archiveS3Key returns the key the passed in archive is uploaded to, which includes its hash, its date is laid out
+// as configured by KeyLayout and it starts with the key prefix configured for its type, if any
+func archiveS3Key(archive *Archive) string {
+	prefix := ""
+	if keyPrefixes[archive.ArchiveType] != "" {
+		prefix = "/" + keyPrefixes[archive.ArchiveType]
+	}
+
+	// archives scoped to a contact group live under their own prefix so they never collide with our normal archives
+	if archive.ContactGroupID != 0 {
+		prefix += fmt.Sprintf("/groups/%d", archive.ContactGroupID)
+	}
+
+	// partial archives are overwritten by each refresh so their keys don't include their hash
+	hash := "_" + archive.Hash
+	if archive.Partial {
+		prefix = partialArchivePrefix
+		hash = ""
+	}
+
+	// dates as path segments, e.g. /2/message/2017/08/12/message_D_<hash>.jsonl.gz, for tools which partition by them
+	if keyLayout == KeyLayoutPath {
+		datePath := fmt.Sprintf("%d/%02d", archive.StartDate.Year(), archive.StartDate.Month())
+		if archive.Period == DayPeriod {
+			datePath += fmt.Sprintf("/%02d", archive.StartDate.Day())
+		}
+		return fmt.Sprintf("%s/%d/%s/%s/%s_%s%s.jsonl.gz", prefix, archive.Org.ID, archive.ArchiveType, datePath, archive.ArchiveType, archive.Period, hash)
+	}
 
 	archivePath := ""
 	if archive.Period == DayPeriod {
 		archivePath = fmt.Sprintf(
-			"/%d/%s_%s%d%02d%02d_%s.jsonl.gz",
+			"%s/%d/%s_%s%d%02d%02d%s.jsonl.gz", prefix,
 			archive.Org.ID, archive.ArchiveType, archive.Period,
 			archive.StartDate.Year(), archive.StartDate.Month(), archive.StartDate.Day(),
-			archive.Hash)
+			hash)
 	} else {
 		archivePath = fmt.Sprintf(
-			"/%d/%s_%s%d%02d_%s.jsonl.gz",
+			"%s/%d/%s_%s%d%02d%s.jsonl.gz", prefix,
 			archive.Org.ID, archive.ArchiveType, archive.Period,
 			archive.StartDate.Year(), archive.StartDate.Month(),
-			archive.Hash)
+			hash)
+	}
+	return archivePath
+}
+
+const (
+	// KeyLayoutCompact puts the date of an archive in its filename, e.g. /2/message_D20170812_<hash>.jsonl.gz
+	KeyLayoutCompact = "compact"
+
+	// KeyLayoutPath puts the date of an archive in path segments, e.g. /2/message/2017/08/12/message_D_<hash>.jsonl.gz
+	KeyLayoutPath = "path"
+)
+
+// the layout of the keys we upload archives to, compact until configured
+var keyLayout = KeyLayoutCompact
+
+// the prefixes of the keys we upload each type of archive to, none unless configured
+var keyPrefixes = map[ArchiveType]string{}
+
+// ConfigureKeyLayout sets the layout and per type prefixes of the keys we upload archives to from the passed in
+// config. Existing archives keep their keys, they are always read by the URL we recorded for them.
+func ConfigureKeyLayout(config *Config) error {
+	if config.KeyLayout != KeyLayoutCompact && config.KeyLayout != KeyLayoutPath {
+		return fmt.Errorf("invalid key layout: %s, must be one of %s or %s", config.KeyLayout, KeyLayoutCompact, KeyLayoutPath)
+	}
+
+	prefixes := map[ArchiveType]string{}
+	for archiveType, prefix := range map[ArchiveType]string{MessageType: config.MessageKeyPrefix, RunType: config.RunKeyPrefix, ContactType: config.ContactKeyPrefix, SessionType: config.SessionKeyPrefix, BroadcastType: config.BroadcastKeyPrefix, ChannelEventType: config.ChannelEventKeyPrefix} {
+		prefix = strings.Trim(prefix, "/")
+		if prefix == "" {
+			continue
+		}
+		if err := checkKeyPrefix(prefix); err != nil {
+			return fmt.Errorf("invalid key prefix for %s archives: %s, %s", archiveType, prefix, err)
+		}
+		prefixes[archiveType] = prefix
+	}
+
+	keyLayout = config.KeyLayout
+	keyPrefixes = prefixes
+	return nil
+}
+
+// orgKeyPrefix returns the prefix of the keys of the passed in org's archives of the passed in type, which is the org's
+// own prefix within the key prefix of the type if it has one
+func orgKeyPrefix(org Org, archiveType ArchiveType) string {
+	if keyPrefixes[archiveType] != "" {
+		return fmt.Sprintf("/%s/%d/", keyPrefixes[archiveType], org.ID)
+	}
+	return fmt.Sprintf("/%d/", org.ID)
+}
+
+// checkKeyPrefix checks that the passed in key prefix can't be mistaken for the prefix of an org or collide with the
+// prefixes we keep other objects under
+func checkKeyPrefix(prefix string) error {
+	for _, segment := range strings.Split(prefix, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf("must not have empty or relative segments")
+		}
+		if _, err := strconv.Atoi(segment); err == nil {
+			return fmt.Errorf("must not have numeric segments which could be mistaken for an org")
+		}
+	}
+
+	first := strings.Split(prefix, "/")[0]
+	for _, reserved := range []string{partialArchivePrefix, emptyArchivePrefix, "/groups"} {
+		if "/"+first == strings.TrimSuffix(reserved, "/") {
+			return fmt.Errorf("must not start with %s which is used for other objects", strings.Trim(reserved, "/"))
+		}
 	}
+	return nil
+}
+
+// UploadArchive uploads the passed archive file to S3
+func UploadArchive(ctx context.Context, config *Config, s3Client Storage, bucket string, archive *Archive) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute*15)
+	defer cancel()
+
+	start := time.Now()
 
-	err := UploadToS3(ctx, s3Client, bucket, archivePath, archive)
+	// uploads are throttled and retried while S3 asks us to slow down
+	err := uploadThrottler.do(ctx, func() error {
+		return UploadToS3(ctx, s3Client, bucket, archiveS3Key(archive), archive)
+	})
 	if err != nil {
 		return errors.Wrapf(err, "error uploading archive to S3")
 	}
 
-	archive.NeedsDeletion = true
+	archive.NeedsDeletion = recordsDeletable(config, archive.ArchiveType)
+	archive.Timings.Upload = time.Since(start)
 
 	logrus.WithFields(logrus.Fields{
 		"org_id":       archive.Org.ID,
@@ -598,38 +1341,165 @@ VALUES(:archive_type, :org_id, :created_on, :start_date, :period, :record_count,
 RETURNING id
 `
 
+const updateArchive = `
+UPDATE archives_archive
+SET record_count = :record_count, size = :size, hash = :hash, url = :url, needs_deletion = :needs_deletion, build_time = :build_time
+WHERE id = :id
+`
+
+const upsertArchiveVersion = `
+INSERT INTO archiver_archive_versions(archive_id, version) VALUES($1, $2)
+ON CONFLICT (archive_id) DO UPDATE SET version = EXCLUDED.version
+`
+
+const lockArchiveKey = `
+SELECT pg_advisory_xact_lock($1)
+`
+
+const lookupArchiveByKey = `
+SELECT id, needs_deletion, deleted_on, COUNT(*) OVER () AS duplicates FROM archives_archive
+WHERE org_id = $1 AND archive_type = $2 AND start_date = $3 AND period = $4
+ORDER BY id DESC LIMIT 1
+`
+
+// archiveLockKey returns the key of the advisory lock held while writing the passed in archive, the same for every
+// write of the same org, type, start date and period
+func archiveLockKey(archive *Archive) int64 {
+	hash := fnv.New64a()
+	fmt.Fprintf(hash, "archive:%d:%s:%s:%s", archive.Org.ID, archive.ArchiveType, archive.StartDate.Format("2006-01-02"), archive.Period)
+	return int64(hash.Sum64())
+}
+
 const updateRollups = `
 UPDATE archives_archive 
 SET rollup_id = $1 
 WHERE ARRAY[id] <@ $2
 `
 
-// WriteArchiveToDB write an archive to the Database
+// WriteArchiveToDB write an archive to the Database, archives which already have an id are rebuilds and update
+// their existing row in place. Writes of the same archive are serialized, so when a tool run by hand races us to write
+// an archive the last write wins, new archives overwriting the row of the first rather than adding a duplicate.
 func WriteArchiveToDB(ctx context.Context, db *sqlx.DB, archive *Archive) error {
 	ctx, cancel := context.WithTimeout(ctx, time.Minute)
 	defer cancel()
 
+	// scoped archives are exports, they never stand in for the records of the org
+	if archive.ContactGroupID != 0 {
+		return fmt.Errorf("archives scoped to contact group: %d can't be written to the db", archive.ContactGroupID)
+	}
+
 	archive.OrgID = archive.Org.ID
-	archive.CreatedOn = time.Now()
+	if archive.Version == 0 {
+		archive.Version = ArchiveSchemaVersion
+	}
+
+	start := time.Now()
 
 	tx, err := db.BeginTxx(ctx, nil)
 	if err != nil {
 		return errors.Wrapf(err, "error starting transaction")
 	}
 
-	rows, err := tx.NamedQuery(insertArchive, archive)
+	_, err = tx.ExecContext(ctx, lockArchiveKey, archiveLockKey(archive))
+	if err != nil {
+		tx.Rollback()
+		return errors.Wrapf(err, "error locking archive")
+	}
+
+	// someone may have written our archive since we found it missing, if so we overwrite their row
+	if archive.ID == 0 {
+		var existing struct {
+			ID            int        `db:"id"`
+			NeedsDeletion bool       `db:"needs_deletion"`
+			DeletedOn     *time.Time `db:"deleted_on"`
+			Duplicates    int        `db:"duplicates"`
+		}
+		err = tx.GetContext(ctx, &existing, lookupArchiveByKey, archive.OrgID, archive.ArchiveType, archive.StartDate, archive.Period)
+		if err != nil && err != sql.ErrNoRows {
+			tx.Rollback()
+			return errors.Wrapf(err, "error looking up existing archive")
+		}
+
+		if err == nil {
+			// once the records of an archive are deleted, its object is all that's left of them
+			if !existing.NeedsDeletion && existing.DeletedOn != nil {
+				tx.Rollback()
+				return fmt.Errorf("archive: %d was written first and its records deleted, refusing to overwrite it", existing.ID)
+			}
+
+			logrus.WithFields(logrus.Fields{
+				"archive_id":   existing.ID,
+				"org_id":       archive.OrgID,
+				"archive_type": archive.ArchiveType,
+				"start_date":   archive.StartDate,
+				"period":       archive.Period,
+			}).Warn("archive was written while we built it, overwriting")
+			archive.ID = existing.ID
+
+			if existing.Duplicates > 1 {
+				logrus.WithFields(logrus.Fields{
+					"archive_id":   existing.ID,
+					"org_id":       archive.OrgID,
+					"archive_type": archive.ArchiveType,
+					"start_date":   archive.StartDate,
+					"period":       archive.Period,
+					"duplicates":   existing.Duplicates,
+				}).Error("archive already has duplicates, overwriting the latest, resolve them with resolve-duplicates")
+			}
+		}
+	}
+
+	event := ActivityUpdated
+	if archive.ID == 0 {
+		event = ActivityCreated
+		archive.CreatedOn = time.Now()
+
+		rows, err := tx.NamedQuery(insertArchive, archive)
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "error inserting archive")
+		}
+
+		rows.Next()
+		err = rows.Scan(&archive.ID)
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "error reading new archive id")
+		}
+		rows.Close()
+	} else {
+		_, err = tx.NamedExecContext(ctx, updateArchive, archive)
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "error updating archive: %d", archive.ID)
+		}
+
+		// a rebuilt archive has a new object, which has never been verified
+		_, err = tx.ExecContext(ctx, deleteArchiveVerifications, archive.ID)
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "error resetting verifications of archive: %d", archive.ID)
+		}
+
+		// as do the renditions of its old object, until they're published again
+		_, err = tx.ExecContext(ctx, deleteArchiveRenditions, archive.ID)
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "error resetting renditions of archive: %d", archive.ID)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, upsertArchiveVersion, archive.ID, archive.Version)
 	if err != nil {
 		tx.Rollback()
-		return errors.Wrapf(err, "error inserting archive")
+		return errors.Wrapf(err, "error writing archive version")
 	}
 
-	rows.Next()
-	err = rows.Scan(&archive.ID)
+	err = writeArchiveContacts(ctx, tx, archive)
 	if err != nil {
 		tx.Rollback()
-		return errors.Wrapf(err, "error reading new archive id")
+		return err
 	}
-	rows.Close()
 
 	// if we have children to update do so
 	if len(archive.Dailies) > 0 {
@@ -660,6 +1530,9 @@ func WriteArchiveToDB(ctx context.Context, db *sqlx.DB, archive *Archive) error
 		tx.Rollback()
 		return errors.Wrapf(err, "error committing new archive transaction")
 	}
+
+	archive.Timings.DBWrite = time.Since(start)
+	recordActivity(event, archive)
 	return nil
 }
 
@@ -686,41 +1559,140 @@ func DeleteArchiveFile(archive *Archive) error {
 	return nil
 }
 
-// CreateOrgArchives builds all the missing archives for the passed in org
-func CreateOrgArchives(ctx context.Context, now time.Time, config *Config, db *sqlx.DB, s3Client s3iface.S3API, org Org, archiveType ArchiveType) ([]*Archive, error) {
-	log := logrus.WithFields(logrus.Fields{
-		"org":    org.Name,
-		"org_id": org.ID,
-	})
-	records := 0
-	start := time.Now()
+var missingArchivesExceeded = newCounter("archiver_missing_archives_exceeded_total", "Number of times an org was missing more archives than we expect.", "archive_type")
+
+// checkMissingArchives warns when the passed in org is missing more archives of one period than we expect, which is
+// usually a sign of a misconfiguration such as a wrong retention period, refusing to build them if we are strict
+func checkMissingArchives(config *Config, org Org, archiveType ArchiveType, period ArchivePeriod, missing []*Archive) error {
+	if config.MaxMissingArchivesWarn <= 0 || len(missing) <= config.MaxMissingArchivesWarn {
+		return nil
+	}
+
+	missingArchivesExceeded.add(1, string(archiveType))
+
+	logrus.WithFields(logrus.Fields{
+		"org_id":       org.ID,
+		"archive_type": archiveType,
+		"period":       period,
+		"missing":      len(missing),
+		"max_missing":  config.MaxMissingArchivesWarn,
+		"first_date":   missing[0].StartDate,
+		"strict":       config.MaxMissingArchivesStrict,
+	}).Warn("org is missing more archives than expected, check our configuration")
+
+	if config.MaxMissingArchivesStrict {
+		return fmt.Errorf("refusing to build %d missing archives of period %s, more than %d", len(missing), period, config.MaxMissingArchivesWarn)
+	}
+	return nil
+}
+
+// ArchiveWork is the missing archives of an org and type we would build
+type ArchiveWork struct {
+	Monthlies []*Archive
+	Dailies   []*Archive
 
+	// the missing dailies left out as they're in the months of our monthlies, by month, built if their monthly fails
+	covered map[time.Time][]*Archive
+}
+
+// FindArchiveWork looks up which archives of the passed in type the passed in org is missing and works out which we
+// would build, without building any of them
+func FindArchiveWork(ctx context.Context, now time.Time, config *Config, db *sqlx.DB, org Org, archiveType ArchiveType) (*ArchiveWork, error) {
 	archiveCount, err := GetCurrentArchiveCount(ctx, db, org, archiveType)
 	if err != nil {
 		return nil, errors.Wrapf(err, "error getting current archive count")
 	}
 
-	archives := make([]*Archive, 0)
-
-	// no existing archives means this might be a backfill, figure out if there are full months we can build first
+	// no existing archives means this might be a backfill, figure out if there are full months we can build first, only
+	// using dailies for the most recent DailyGranularityDays
+	monthlies := make([]*Archive, 0)
 	if archiveCount == 0 {
-		archives, err = GetMissingMonthlyArchives(ctx, db, now, org, archiveType)
+		before := org.archiveEndDate(now).AddDate(0, 0, -config.DailyGranularityDays)
+		monthlies, err = getMissingMonthlyArchivesBefore(ctx, db, before, org, archiveType)
 		if err != nil {
 			return nil, errors.Wrapf(err, "error getting missing monthly archives")
 		}
+	}
 
-		// we first create monthly archives
-		err = createArchives(ctx, db, config, s3Client, org, archives)
-		if err != nil {
-			return nil, errors.Wrapf(err, "error creating new monthly archives")
+	dailies, err := GetMissingDailyArchives(ctx, db, now, org, archiveType)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting missing daily archives")
+	}
+
+	return planArchiveWork(monthlies, dailies), nil
+}
+
+// planArchiveWork returns the work of building the passed in missing monthlies and the passed in missing dailies which
+// aren't in the months of those monthlies, as the monthlies are built first and cover them
+func planArchiveWork(monthlies []*Archive, dailies []*Archive) *ArchiveWork {
+	work := &ArchiveWork{Monthlies: monthlies, Dailies: make([]*Archive, 0, len(dailies)), covered: make(map[time.Time][]*Archive)}
+	for _, m := range monthlies {
+		work.covered[m.StartDate.UTC()] = make([]*Archive, 0)
+	}
+
+	for _, d := range dailies {
+		day := d.StartDate.UTC()
+		month := time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, time.UTC)
+		if covered, found := work.covered[month]; found {
+			work.covered[month] = append(covered, d)
+		} else {
+			work.Dailies = append(work.Dailies, d)
 		}
 	}
+	return work
+}
+
+// CreateOrgArchives builds all the missing archives for the passed in org
+func CreateOrgArchives(ctx context.Context, now time.Time, config *Config, db *sqlx.DB, s3Client Storage, org Org, archiveType ArchiveType) ([]*Archive, error) {
+	work, err := FindArchiveWork(ctx, now, config, db, org, archiveType)
+	if err != nil {
+		return nil, err
+	}
+
+	return createOrgArchiveWork(ctx, config, db, s3Client, org, archiveType, work)
+}
+
+// createOrgArchiveWork builds the monthlies and then the dailies of the passed in work for the passed in org
+func createOrgArchiveWork(ctx context.Context, config *Config, db *sqlx.DB, s3Client Storage, org Org, archiveType ArchiveType, work *ArchiveWork) ([]*Archive, error) {
+	// a dry run only reports what we would build, however we got here
+	if config.DryRun {
+		archives := make([]*Archive, 0, len(work.Monthlies)+len(work.Dailies))
+		archives = append(append(archives, work.Monthlies...), work.Dailies...)
+		return nil, logDryRun(ctx, db, config, org, archiveType, dryRunBuild, archives)
+	}
+
+	log := logrus.WithFields(logrus.Fields{
+		"org":    org.Name,
+		"org_id": org.ID,
+	})
+	records := 0
+	start := time.Now()
+
+	archives := work.Monthlies
+	err := checkMissingArchives(config, org, archiveType, MonthPeriod, archives)
+	if err != nil {
+		return nil, err
+	}
+
+	// we first create monthly archives, all of which are done before we move on to dailies
+	err = createArchivesConcurrently(ctx, db, config, s3Client, org, archives, config.BackfillConcurrency)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating new monthly archives")
+	}
 
 	// then add in daily archives taking into account the monthly that have been built
-	daily, err := GetMissingDailyArchives(ctx, db, now, org, archiveType)
+	daily := work.Dailies
+	for _, monthly := range archives {
+		if monthly.ID == 0 {
+			daily = append(daily, work.covered[monthly.StartDate.UTC()]...)
+		}
+	}
+	sort.SliceStable(daily, func(i, j int) bool { return daily[i].StartDate.Before(daily[j].StartDate) })
+	err = checkMissingArchives(config, org, archiveType, DayPeriod, daily)
 	if err != nil {
-		return nil, errors.Wrapf(err, "error getting missing daily archives")
+		return nil, err
 	}
+
 	// we then create missing daily archives
 	err = createArchives(ctx, db, config, s3Client, org, daily)
 	if err != nil {
@@ -748,8 +1720,32 @@ func CreateOrgArchives(ctx context.Context, now time.Time, config *Config, db *s
 	return archives, nil
 }
 
-func createArchive(ctx context.Context, db *sqlx.DB, config *Config, s3Client s3iface.S3API, archive *Archive) error {
-	err := CreateArchiveFile(ctx, db, archive, config.TempDir)
+func createArchive(ctx context.Context, db *sqlx.DB, config *Config, s3Client Storage, archive *Archive) error {
+	err := runHook(ctx, HookBeforeArchiveBuild, hooks.BeforeArchiveBuild, archive.Org, archive)
+	if err != nil {
+		return err
+	}
+
+	// if we don't need a local file, we can compress straight to S3
+	if config.StreamUploads && config.UploadToS3 && !config.KeepFiles {
+		err := StreamArchive(ctx, db, config, s3Client, archive)
+		if err != nil {
+			return errors.Wrap(err, "error streaming archive to s3")
+		}
+
+		err = runHook(ctx, HookAfterUpload, hooks.AfterUpload, archive.Org, archive)
+		if err != nil {
+			return err
+		}
+
+		err = WriteArchiveToDB(ctx, db, archive)
+		if err != nil {
+			return errors.Wrap(err, "error writing record to db")
+		}
+		return nil
+	}
+
+	err = CreateArchiveFile(ctx, db, config, archive, config.TempDir)
 	if err != nil {
 		return errors.Wrap(err, "error writing archive file")
 	}
@@ -764,9 +1760,25 @@ func createArchive(ctx context.Context, db *sqlx.DB, config *Config, s3Client s3
 	}()
 
 	if config.UploadToS3 {
-		err = UploadArchive(ctx, s3Client, config.S3Bucket, archive)
-		if err != nil {
-			return errors.Wrap(err, "error writing archive to s3")
+		// a crash between uploading a daily and recording it leaves an object we can record instead of duplicating
+		uploaded := false
+		if config.ProbeUnrecordedDailies && archive.Period == DayPeriod {
+			uploaded, err = findUploadedArchive(ctx, config, s3Client, archive)
+			if err != nil {
+				logrus.WithError(err).Warn("error looking for unrecorded upload of archive")
+			}
+		}
+
+		if !uploaded {
+			err = UploadArchive(ctx, config, s3Client, config.S3Bucket, archive)
+			if err != nil {
+				return errors.Wrap(err, "error writing archive to s3")
+			}
+		}
+
+		err = runHook(ctx, HookAfterUpload, hooks.AfterUpload, archive.Org, archive)
+		if err != nil {
+			return err
 		}
 	}
 
@@ -775,10 +1787,49 @@ func createArchive(ctx context.Context, db *sqlx.DB, config *Config, s3Client s3
 		return errors.Wrap(err, "error writing record to db")
 	}
 
+	publishRenditions(ctx, config, db, s3Client, archive)
+	return nil
+}
+
+// createArchivesConcurrently creates the passed in archives like createArchives but with up to the passed in number
+// being built at once, returning once they are all done
+func createArchivesConcurrently(ctx context.Context, db *sqlx.DB, config *Config, s3Client Storage, org Org, archives []*Archive, concurrency int) error {
+	if concurrency <= 1 {
+		return createArchives(ctx, db, config, s3Client, org, archives)
+	}
+
+	sem := make(chan struct{}, concurrency)
+	wg := sync.WaitGroup{}
+
+	for _, a := range archives {
+		sem <- struct{}{}
+		wg.Add(1)
+
+		go func(archive *Archive) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			// failures are logged and leave the archive without an id, the same as when built one at a time, a panic
+			// here can't be recovered by our caller so we recover it ourselves if configured to
+			build := func() error { return createArchives(ctx, db, config, s3Client, org, []*Archive{archive}) }
+			if config.RecoverOrgPanics {
+				if err := recoverOrgPanic(org, archive.ArchiveType, build); err != nil {
+					archiveErrors.add(1, string(PhaseCreate))
+					archive.Err = err
+				}
+			} else {
+				build()
+			}
+		}(a)
+	}
+	wg.Wait()
+
 	return nil
 }
 
-func createArchives(ctx context.Context, db *sqlx.DB, config *Config, s3Client s3iface.S3API, org Org, archives []*Archive) error {
+func createArchives(ctx context.Context, db *sqlx.DB, config *Config, s3Client Storage, org Org, archives []*Archive) error {
 	log := logrus.WithFields(logrus.Fields{
 		"org":    org.Name,
 		"org_id": org.ID,
@@ -787,7 +1838,7 @@ func createArchives(ctx context.Context, db *sqlx.DB, config *Config, s3Client s
 	for _, archive := range archives {
 		log.WithFields(logrus.Fields{
 			"start_date":   archive.StartDate,
-			"end_date":     archive.endDate(),
+			"end_date":     archive.EndDate(),
 			"period":       archive.Period,
 			"archive_type": archive.ArchiveType,
 		}).Info("starting archive")
@@ -795,13 +1846,22 @@ func createArchives(ctx context.Context, db *sqlx.DB, config *Config, s3Client s
 		start := time.Now()
 
 		err := createArchive(ctx, db, config, s3Client, archive)
+		archive.Err = err
 		if err != nil {
+			archiveErrors.add(1, string(PhaseCreate))
 			log.WithError(err).Error("error creating archive")
 			continue
 		}
+		observeCreated(archive, true)
+
+		err = QueueRapidProNotification(ctx, db, config, archive)
+		if err != nil {
+			log.WithError(err).Error("error queuing rapidpro notification")
+		}
 
 		elapsed := time.Since(start)
-		log.WithFields(logrus.Fields{
+		archive.Timings.observe()
+		log.WithFields(archive.Timings.fields()).WithFields(logrus.Fields{
 			"id":           archive.ID,
 			"record_count": archive.RecordCount,
 			"elapsed":      elapsed,
@@ -812,7 +1872,24 @@ func createArchives(ctx context.Context, db *sqlx.DB, config *Config, s3Client s
 }
 
 // RollupOrgArchives rolls up monthly archives from our daily archives
-func RollupOrgArchives(ctx context.Context, now time.Time, config *Config, db *sqlx.DB, s3Client s3iface.S3API, org Org, archiveType ArchiveType) ([]*Archive, error) {
+func RollupOrgArchives(ctx context.Context, now time.Time, config *Config, db *sqlx.DB, s3Client Storage, org Org, archiveType ArchiveType) ([]*Archive, error) {
+	// get our missing monthly archives
+	archives, err := GetMissingMonthlyArchives(ctx, db, now, org, archiveType)
+	if err != nil {
+		return nil, err
+	}
+
+	return rollupArchives(ctx, now, config, db, s3Client, org, archiveType, archives)
+}
+
+// rollupArchives builds the passed in monthly archives from their dailies, returning those built. Those which fail
+// have the reason set as their Err, the returned error is only for failing to report a dry run.
+func rollupArchives(ctx context.Context, now time.Time, config *Config, db *sqlx.DB, s3Client Storage, org Org, archiveType ArchiveType, archives []*Archive) ([]*Archive, error) {
+	// a dry run only reports what we would roll up, however we got here
+	if config.DryRun {
+		return nil, logDryRun(ctx, db, config, org, archiveType, dryRunRollup, archives)
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, time.Hour*time.Duration(config.RollupOrgTimeout))
 	defer cancel()
 
@@ -822,58 +1899,95 @@ func RollupOrgArchives(ctx context.Context, now time.Time, config *Config, db *s
 	})
 	created := make([]*Archive, 0, 1)
 
-	// get our missing monthly archives
-	archives, err := GetMissingMonthlyArchives(ctx, db, now, org, archiveType)
-	if err != nil {
-		return nil, err
-	}
-
 	// build them from rollups
 	for _, archive := range archives {
 		log.WithFields(logrus.Fields{
 			"start_date":   archive.StartDate,
 			"archive_type": archive.ArchiveType,
 		})
-		start := time.Now()
 		log.Info("starting rollup")
 
-		err = BuildRollupArchive(ctx, db, config, s3Client, archive, now, org, archiveType)
-		if err != nil {
-			log.WithError(err).Error("error building monthly archive")
+		archive.Err = rollupArchive(ctx, now, config, db, s3Client, org, archiveType, archive)
+		if archive.Err != nil {
+			archiveErrors.add(1, string(PhaseRollup))
+			log.WithError(archive.Err).Error("error rolling up monthly archive")
 			continue
 		}
+		created = append(created, archive)
+	}
 
-		if config.UploadToS3 {
-			err = UploadArchive(ctx, s3Client, config.S3Bucket, archive)
-			if err != nil {
-				log.WithError(err).Error("error writing archive to s3")
-				continue
-			}
+	NotifyOrg(ctx, now, config, db, s3Client, org, created)
+	NotifyRapidPro(ctx, config, db, org)
+
+	return created, nil
+}
+
+// rollupArchive builds, uploads and records the passed in monthly archive from its dailies
+func rollupArchive(ctx context.Context, now time.Time, config *Config, db *sqlx.DB, s3Client Storage, org Org, archiveType ArchiveType, archive *Archive) error {
+	log := logrus.WithFields(logrus.Fields{
+		"org":    org.Name,
+		"org_id": org.ID,
+	})
+	start := time.Now()
+
+	if config.VerifyRollupCounts {
+		err := RefreshStaleDailies(ctx, db, config, s3Client, org, archive)
+		if err != nil {
+			return errors.Wrap(err, "error refreshing stale daily archives")
 		}
+	}
 
-		err = WriteArchiveToDB(ctx, db, archive)
+	err := runHook(ctx, HookBeforeArchiveBuild, hooks.BeforeArchiveBuild, org, archive)
+	if err != nil {
+		return err
+	}
+
+	err = BuildRollupArchive(ctx, db, config, s3Client, archive, now, org, archiveType)
+	if err != nil {
+		return errors.Wrap(err, "error building monthly archive")
+	}
+
+	if config.UploadToS3 {
+		err = UploadArchive(ctx, config, s3Client, config.S3Bucket, archive)
 		if err != nil {
-			log.WithError(err).Error("error writing record to db")
-			continue
+			return errors.Wrap(err, "error writing archive to s3")
 		}
 
-		if !config.KeepFiles {
-			err := DeleteArchiveFile(archive)
-			if err != nil {
-				log.WithError(err).Error("error deleting temporary file")
-				continue
-			}
+		err = runHook(ctx, HookAfterUpload, hooks.AfterUpload, org, archive)
+		if err != nil {
+			return err
 		}
+	}
 
-		log.WithFields(logrus.Fields{
-			"id":           archive.ID,
-			"record_count": archive.RecordCount,
-			"elapsed":      time.Since(start),
-		}).Info("rollup complete")
-		created = append(created, archive)
+	err = WriteArchiveToDB(ctx, db, archive)
+	if err != nil {
+		return errors.Wrap(err, "error writing record to db")
 	}
 
-	return created, nil
+	publishRenditions(ctx, config, db, s3Client, archive)
+
+	err = QueueRapidProNotification(ctx, db, config, archive)
+	if err != nil {
+		log.WithError(err).Error("error queuing rapidpro notification")
+	}
+
+	if !config.KeepFiles {
+		err := DeleteArchiveFile(archive)
+		if err != nil {
+			return errors.Wrap(err, "error deleting temporary file")
+		}
+	}
+
+	archive.Timings.observe()
+	observeCreated(archive, false)
+	log.WithFields(archive.Timings.fields()).WithFields(logrus.Fields{
+		"id":            archive.ID,
+		"record_count":  archive.RecordCount,
+		"elapsed":       time.Since(start),
+		"daily_formats": archive.DailyFormats,
+	}).Info("rollup complete")
+
+	return runHook(ctx, HookAfterRollup, hooks.AfterRollup, org, archive)
 }
 
 const setArchiveDeleted = `
@@ -900,16 +2014,126 @@ func executeInQuery(ctx context.Context, tx *sqlx.Tx, query string, ids []int64)
 var deleteTransactionSize = 100
 
 // DeleteArchivedOrgRecords deletes all the records for the passeg in org based on archives already created
-func DeleteArchivedOrgRecords(ctx context.Context, now time.Time, config *Config, db *sqlx.DB, s3Client s3iface.S3API, org Org, archiveType ArchiveType) ([]*Archive, error) {
+func DeleteArchivedOrgRecords(ctx context.Context, now time.Time, config *Config, db *sqlx.DB, s3Client Storage, org Org, archiveType ArchiveType) ([]*Archive, error) {
+	deleted, _, err := deleteArchivedOrgRecords(ctx, now, config, db, s3Client, org, archiveType, nil)
+	return deleted, err
+}
+
+// deleteArchivedOrgRecords deletes the records of the archives of the passed in org, only of those with the passed in
+// ids if any are passed in
+func deleteArchivedOrgRecords(ctx context.Context, now time.Time, config *Config, db *sqlx.DB, s3Client Storage, org Org, archiveType ArchiveType, only map[int]bool) ([]*Archive, []*Archive, error) {
+	if config.ContactGroupID != 0 {
+		return nil, nil, fmt.Errorf("deletion is disabled when archiving a contact group")
+	}
+
+	// contacts live on after we snapshot them unless we're configured to delete them
+	if !recordsDeletable(config, archiveType) {
+		return nil, nil, nil
+	}
+
 	// get all the archives that haven't yet been deleted
 	archives, err := GetArchivesNeedingDeletion(ctx, db, org, archiveType)
 	if err != nil {
-		return nil, fmt.Errorf("error finding archives needing deletion '%s'", archiveType)
+		return nil, nil, fmt.Errorf("error finding archives needing deletion '%s'", archiveType)
+	}
+
+	// archives built before our retention period ends wait until it does
+	archives = retainedArchives(now, org, archives)
+
+	if only != nil {
+		filtered := make([]*Archive, 0, len(archives))
+		for _, a := range archives {
+			if only[a.ID] {
+				filtered = append(filtered, a)
+			}
+		}
+		archives = filtered
+	}
+
+	// archives may need verifying on several days first
+	archives, err = sufficientlyVerifiedArchives(ctx, db, config, archives)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error checking verifications")
+	}
+
+	// a dry run only reports what we would delete, the checks which follow may need S3 or write to our database
+	if config.DryRun {
+		return nil, nil, logDryRun(ctx, db, config, org, archiveType, dryRunDelete, archives)
+	}
+
+	// archives migrated without their record counts would never pass our checks of them
+	if config.MaxCountReconciles > 0 {
+		_, err = reconcileRecordCounts(ctx, db, s3Client, archives)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "error reconciling record counts")
+		}
+	}
+
+	// dailies may need to wait until they're safely rolled up
+	if config.DeleteAfterRollup {
+		archives, err = rolledUpArchives(ctx, db, s3Client, org, archiveType, archives)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "error checking rollups")
+		}
+	}
+
+	// messages and runs may need to be deleted together for the same days
+	archives, err = coordinateDeletion(ctx, db, config, org, archiveType, archives)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error coordinating deletion")
+	}
+
+	// monthlies whose dailies also need deletion are deleted via those dailies instead, otherwise we delete the records
+	// of each period once, via its monthly unless some of its dailies were already deleted
+	var covered []*Archive
+	if config.DeleteViaDailies {
+		archives, covered = splitCoveredRollups(archives)
+	} else {
+		archives, covered, err = splitRollupDeletion(ctx, db, archives)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "error checking rollups")
+		}
+	}
+
+	// verify all our archives up front, reporting any failures for this org together
+	failures := VerifyS3Archives(ctx, config, s3Client, archives)
+	if len(failures) > 0 {
+		logrus.WithFields(logrus.Fields{
+			"org_id":       org.ID,
+			"archive_type": archiveType,
+			"failed":       len(failures),
+			"archives":     len(archives),
+			"errors":       describeFailures(failures),
+		}).Error("archives failed verification, not deleting their records")
+	}
+
+	// the dailies of a monthly which failed can still be deleted themselves
+	fallback := make([]*Archive, 0)
+	for _, a := range archives {
+		if failures[a] != nil && len(a.Dailies) > 0 {
+			fallback = append(fallback, a.Dailies...)
+			a.Dailies = nil
+		}
+	}
+	if len(fallback) > 0 {
+		for a, err := range VerifyS3Archives(ctx, config, s3Client, fallback) {
+			failures[a] = err
+		}
+		archives = append(archives, fallback...)
 	}
 
 	// for each archive
 	deleted := make([]*Archive, 0, len(archives))
+	failed := make([]*Archive, 0)
+	var hookErr error
 	for _, a := range archives {
+		a.Err = failures[a]
+		if a.Err != nil {
+			archiveErrors.add(1, string(PhaseDelete))
+			failed = append(failed, a)
+			continue
+		}
+
 		log := logrus.WithFields(logrus.Fields{
 			"archive_id": a.ID,
 			"org_id":     a.OrgID,
@@ -924,18 +2148,25 @@ func DeleteArchivedOrgRecords(ctx context.Context, now time.Time, config *Config
 		switch a.ArchiveType {
 		case MessageType:
 			err = DeleteArchivedMessages(ctx, config, db, s3Client, a)
-			if err == nil {
-				err = DeleteBroadcasts(ctx, now, config, db, org)
-			}
-
 		case RunType:
 			err = DeleteArchivedRuns(ctx, config, db, s3Client, a)
+		case ContactType:
+			err = DeleteArchivedContacts(ctx, config, db, s3Client, a)
+		case SessionType:
+			err = DeleteArchivedSessions(ctx, config, db, s3Client, a)
+		case BroadcastType:
+			err = DeleteArchivedBroadcasts(ctx, config, db, s3Client, a)
+		case ChannelEventType:
+			err = DeleteArchivedChannelEvents(ctx, config, db, s3Client, a)
 		default:
 			err = fmt.Errorf("unknown archive type: %s", a.ArchiveType)
 		}
 
 		if err != nil {
+			archiveErrors.add(1, string(PhaseDelete))
 			log.WithError(err).Error("error deleting archive")
+			a.Err = err
+			failed = append(failed, a)
 			continue
 		}
 
@@ -943,33 +2174,375 @@ func DeleteArchivedOrgRecords(ctx context.Context, now time.Time, config *Config
 		log.WithFields(logrus.Fields{
 			"elapsed": time.Since(start),
 		}).Info("deleted archive records")
+
+		// the records of the dailies of a monthly were deleted with it
+		if len(a.Dailies) > 0 {
+			err = setRolledUpDailiesDeletedOn(ctx, db, a, *a.DeletedOn)
+			if err != nil {
+				log.WithError(err).Error("error marking rolled up dailies as deleted")
+				continue
+			}
+			deleted = append(deleted, a.Dailies...)
+		}
+
+		// a fatal hook stops us deleting any more, what we've deleted is still marked as such
+		err = runHook(ctx, HookAfterDelete, hooks.AfterDelete, org, a)
+		if err != nil {
+			hookErr = err
+			break
+		}
+	}
+
+	// our covered monthlies have nothing left to delete once all their dailies are done, otherwise they wait for next time
+	for _, monthly := range covered {
+		done := true
+		for _, daily := range monthly.Dailies {
+			done = done && !daily.NeedsDeletion
+		}
+		if !done {
+			continue
+		}
+
+		err := setArchiveDeletedOn(ctx, db, monthly, time.Now())
+		if err != nil {
+			logrus.WithError(err).WithField("archive_id", monthly.ID).Error("error marking rollup as deleted")
+			continue
+		}
+		deleted = append(deleted, monthly)
+	}
+
+	for _, a := range deleted {
+		recordActivity(ActivityDeleted, a)
+	}
+
+	// broadcasts are deleted once we're done with the messages which may be on them, up to the last we deleted, unless
+	// we archive them in which case they are deleted with their own archives
+	if archiveType == MessageType && len(deleted) > 0 && !config.ArchiveBroadcasts {
+		_, err = DeleteBroadcasts(ctx, broadcastCutoff(now, org, deleted), config, db, org)
+		if err != nil {
+			logrus.WithError(err).WithField("org_id", org.ID).Error("error deleting broadcasts")
+		}
 	}
 
-	return deleted, nil
+	return deleted, failed, hookErr
 }
 
-// ArchiveOrg looks for any missing archives for the passed in org, creating and uploading them as necessary, returning the created archives
-func ArchiveOrg(ctx context.Context, now time.Time, config *Config, db *sqlx.DB, s3Client s3iface.S3API, org Org, archiveType ArchiveType) ([]*Archive, []*Archive, error) {
-	created, err := CreateOrgArchives(ctx, now, config, db, s3Client, org, archiveType)
+// retainedArchives returns which of the passed in archives only cover records past our retention period
+func retainedArchives(now time.Time, org Org, archives []*Archive) []*Archive {
+	deleteEnd := org.deleteEndDate(now)
+
+	retained := make([]*Archive, 0, len(archives))
+	for _, a := range archives {
+		if !a.EndDate().After(deleteEnd) {
+			retained = append(retained, a)
+		}
+	}
+	return retained
+}
+
+// rolledUpArchives returns which of the passed in archives are monthlies or dailies which have been rolled up into a
+// monthly we can verify, so that we never delete records only backed by a daily whose rollup failed
+func rolledUpArchives(ctx context.Context, db *sqlx.DB, s3Client Storage, org Org, archiveType ArchiveType, archives []*Archive) ([]*Archive, error) {
+	// we only need the monthlies our dailies were rolled up into
+	rollupIDs := make([]int, 0)
+	for _, a := range archives {
+		if a.Period == DayPeriod && a.Rollup != nil {
+			rollupIDs = append(rollupIDs, *a.Rollup)
+		}
+	}
+	rollups, err := getArchivesByID(ctx, db, rollupIDs)
+	if err != nil {
+		return nil, err
+	}
+	monthlies := make(map[int]*Archive)
+	for _, a := range rollups {
+		if a.Period == MonthPeriod {
+			monthlies[a.ID] = a
+		}
+	}
+
+	verified := make(map[int]bool)
+	rolledUp := make([]*Archive, 0, len(archives))
+	for _, a := range archives {
+		if a.Period == MonthPeriod {
+			rolledUp = append(rolledUp, a)
+			continue
+		}
+
+		var monthly *Archive
+		if a.Rollup != nil {
+			monthly = monthlies[*a.Rollup]
+		}
+		if monthly == nil {
+			continue
+		}
+
+		ok, checked := verified[monthly.ID]
+		if !checked {
+			err := VerifyS3Archive(ctx, s3Client, monthly)
+			if err != nil {
+				logrus.WithError(err).WithField("org_id", org.ID).WithField("archive_id", monthly.ID).Error("rollup failed verification, not deleting the records of its dailies")
+			}
+			ok = err == nil
+			verified[monthly.ID] = ok
+		}
+		if ok {
+			rolledUp = append(rolledUp, a)
+		}
+	}
+	return rolledUp, nil
+}
+
+// splitCoveredRollups splits out the monthlies from the passed in archives which have dailies rolled up into them that
+// also need deletion, returning the remaining archives and those monthlies with those dailies set as their dailies
+func splitCoveredRollups(archives []*Archive) ([]*Archive, []*Archive) {
+	dailies := make(map[int][]*Archive)
+	for _, a := range archives {
+		if a.Period == DayPeriod && a.Rollup != nil {
+			dailies[*a.Rollup] = append(dailies[*a.Rollup], a)
+		}
+	}
+
+	finest := make([]*Archive, 0, len(archives))
+	covered := make([]*Archive, 0)
+	for _, a := range archives {
+		if a.Period == MonthPeriod && len(dailies[a.ID]) > 0 {
+			a.Dailies = dailies[a.ID]
+			covered = append(covered, a)
+		} else {
+			finest = append(finest, a)
+		}
+	}
+	return finest, covered
+}
+
+const lookupRollupDeletion = `
+SELECT rollup_id, COUNT(*) FILTER (WHERE needs_deletion) AS pending, COUNT(*) FILTER (WHERE NOT needs_deletion) AS deleted
+FROM archives_archive WHERE rollup_id = ANY($1) AND period = 'D'
+GROUP BY rollup_id
+`
+
+// splitRollupDeletion decides how the records covered by each of the passed in monthlies are deleted. A monthly whose
+// dailies all still need deletion is deleted itself and its dailies are skipped, being marked deleted along with it. If
+// some were already deleted individually, such as before the monthly existed, the rest are deleted individually too
+// rather than deleting days again, the monthly being marked deleted once all are. Returns the archives to delete,
+// monthlies having the dailies deleted along with them set as their dailies, and the monthlies covered by dailies.
+func splitRollupDeletion(ctx context.Context, db *sqlx.DB, archives []*Archive) ([]*Archive, []*Archive, error) {
+	monthlyIDs := make([]int, 0)
+	dailies := make(map[int][]*Archive)
+	for _, a := range archives {
+		if a.Period == MonthPeriod {
+			monthlyIDs = append(monthlyIDs, a.ID)
+		} else if a.Rollup != nil {
+			dailies[*a.Rollup] = append(dailies[*a.Rollup], a)
+		}
+	}
+	if len(monthlyIDs) == 0 {
+		return archives, nil, nil
+	}
+
+	counts := make([]struct {
+		RollupID int `db:"rollup_id"`
+		Pending  int `db:"pending"`
+		Deleted  int `db:"deleted"`
+	}, 0, len(monthlyIDs))
+	err := db.SelectContext(ctx, &counts, lookupRollupDeletion, pq.Array(monthlyIDs))
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error counting dailies needing deletion")
+	}
+
+	// monthlies deleted themselves, and those deleted via their dailies once all are in this deletion
+	whole := make(map[int]bool, len(monthlyIDs))
+	viaDailies := make(map[int]bool)
+	for _, id := range monthlyIDs {
+		whole[id] = true
+	}
+	for _, c := range counts {
+		if c.Deleted > 0 {
+			whole[c.RollupID] = false
+			viaDailies[c.RollupID] = c.Pending == len(dailies[c.RollupID])
+		}
+	}
+
+	remaining := make([]*Archive, 0, len(archives))
+	covered := make([]*Archive, 0)
+	for _, a := range archives {
+		if a.Period == MonthPeriod {
+			if whole[a.ID] {
+				a.Dailies = dailies[a.ID]
+				remaining = append(remaining, a)
+			} else if viaDailies[a.ID] {
+				a.Dailies = dailies[a.ID]
+				covered = append(covered, a)
+			}
+		} else if a.Rollup == nil || !whole[*a.Rollup] {
+			remaining = append(remaining, a)
+		}
+	}
+	return remaining, covered, nil
+}
+
+const setRolledUpDailiesDeleted = `
+UPDATE archives_archive
+SET needs_deletion = FALSE, deleted_on = $2
+WHERE rollup_id = $1 AND period = 'D' AND needs_deletion = TRUE
+`
+
+// setRolledUpDailiesDeletedOn marks the dailies rolled up into the passed in monthly as no longer needing deletion
+func setRolledUpDailiesDeletedOn(ctx context.Context, db *sqlx.DB, monthly *Archive, deletedOn time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, setRolledUpDailiesDeleted, monthly.ID, deletedOn)
 	if err != nil {
-		return nil, nil, errors.Wrapf(err, "error creating archives")
+		return errors.Wrap(err, "error setting rolled up dailies as deleted")
+	}
+	for _, daily := range monthly.Dailies {
+		daily.NeedsDeletion = false
+		daily.DeletedOn = &deletedOn
 	}
+	return nil
+}
 
-	monthlies, err := RollupOrgArchives(ctx, now, config, db, s3Client, org, archiveType)
+// setArchiveDeletedOn marks the passed in archive as no longer needing deletion
+func setArchiveDeletedOn(ctx context.Context, db *sqlx.DB, archive *Archive, deletedOn time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, setArchiveDeleted, archive.ID, deletedOn)
 	if err != nil {
-		return nil, nil, errors.Wrapf(err, "error rolling up archives")
+		return errors.Wrap(err, "error setting archive as deleted")
+	}
+	archive.NeedsDeletion = false
+	archive.DeletedOn = &deletedOn
+	return nil
+}
+
+// ArchiveOrg looks for any missing archives for the passed in org, creating and uploading them as necessary, returning the created archives
+func ArchiveOrg(ctx context.Context, now time.Time, config *Config, db *sqlx.DB, s3Client Storage, org Org, archiveType ArchiveType) ([]*Archive, []*Archive, error) {
+	return ArchiveOrgPhases(ctx, now, config, db, s3Client, org, archiveType, AllPhases)
+}
+
+// ArchiveOrgPhases runs only the passed in phases of archiving the passed in org, returning the archives created and
+// deleted. Compacting empty archives is a cleanup so is done along with deletion.
+func ArchiveOrgPhases(ctx context.Context, now time.Time, config *Config, db *sqlx.DB, s3Client Storage, org Org, archiveType ArchiveType, phases []Phase) ([]*Archive, []*Archive, error) {
+	result, err := ArchiveOrgPhasesWithResult(ctx, now, config, db, s3Client, org, archiveType, phases)
+	if pe, ok := err.(*PhaseError); ok && pe.Phase != PhaseDelete {
+		return nil, nil, err
+	}
+	return result.Created, result.Deleted, err
+}
+
+// ArchiveOrgPhasesWithResult runs the passed in phases of archiving the passed in org like ArchiveOrgPhases, returning
+// the outcome of each phase and of each archive attempted in them. Archives which fail are recorded in the result and
+// we carry on with the rest, the returned error is only for failures which stop a phase.
+func ArchiveOrgPhasesWithResult(ctx context.Context, now time.Time, config *Config, db *sqlx.DB, s3Client Storage, org Org, archiveType ArchiveType, phases []Phase) (*ArchiveOrgResult, error) {
+	result := newArchiveOrgResult(org, archiveType)
+
+	// orgs can be deactivated or deleted after we list them
+	if orgGone(ctx, db, config, org) {
+		return result, nil
 	}
 
-	created = append(created, monthlies...)
+	// our day boundaries are only right in UTC, which databases not opened with OpenDB may not be
+	if err := CheckDBTimezone(ctx, db); err != nil {
+		return result, result.fatal(result.startPhase(phases[0]), err)
+	}
+
+	org, err := CheckOrgStart(ctx, db, config, org, archiveType)
+	if err != nil {
+		return result, result.fatal(result.startPhase(phases[0]), errors.Wrapf(err, "error checking org start"))
+	}
+
+	// a dry run only reports what each phase would do, without writing to our database or storage
+	if config.DryRun {
+		return result, dryRunPhases(ctx, now, config, db, org, archiveType, phases)
+	}
+
+	// archiving a contact group is an export, nothing is recorded or deleted
+	if config.ContactGroupID != 0 {
+		if !HasPhase(phases, PhaseCreate) {
+			return result, nil
+		}
+		phase := result.startPhase(PhaseCreate)
+		created, err := CreateGroupArchives(ctx, now, config, db, s3Client, org, archiveType)
+		if err != nil {
+			return result, result.fatal(phase, errors.Wrapf(err, "error creating group archives"))
+		}
+		for _, a := range created {
+			result.attempted(phase, a, a.Err)
+		}
+		return result, nil
+	}
+
+	if HasPhase(phases, PhaseCreate) {
+		phase := result.startPhase(PhaseCreate)
+		attempted, err := CreateOrgArchives(ctx, now, config, db, s3Client, org, archiveType)
+		if err != nil {
+			// failing because our org was removed while we archived it isn't an error
+			if orgGone(ctx, db, config, org) {
+				return result, nil
+			}
+			return result, result.fatal(phase, errors.Wrapf(err, "error creating archives"))
+		}
+		for _, a := range attempted {
+			result.attempted(phase, a, a.Err)
+		}
+
+		// partial archives are only a convenience, failing to refresh them doesn't fail our archiving
+		if config.ArchivePartialCurrent {
+			refreshPartialArchives(ctx, now, config, db, s3Client, org, archiveType)
+		}
+	}
+
+	if HasPhase(phases, PhaseRollup) {
+		phase := result.startPhase(PhaseRollup)
+		monthlies, err := GetMissingMonthlyArchives(ctx, db, now, org, archiveType)
+		if err != nil {
+			return result, result.fatal(phase, errors.Wrapf(err, "error rolling up archives"))
+		}
+		_, err = rollupArchives(ctx, now, config, db, s3Client, org, archiveType, monthlies)
+		if err != nil {
+			return result, result.fatal(phase, errors.Wrapf(err, "error rolling up archives"))
+		}
+		for _, a := range monthlies {
+			result.attempted(phase, a, a.Err)
+		}
+	}
+
+	if !HasPhase(phases, PhaseDelete) {
+		return result, nil
+	}
 
 	// finally delete any archives not yet actually archived
-	deleted := make([]*Archive, 0, 1)
 	if config.Delete {
-		deleted, err = DeleteArchivedOrgRecords(ctx, now, config, db, s3Client, org, archiveType)
+		phase := result.startPhase(PhaseDelete)
+		if config.MinVerificationsBeforeDelete > 0 {
+			_, err = VerifyArchives(ctx, now, config, db, s3Client, org, archiveType)
+			if err != nil {
+				return result, result.fatal(phase, errors.Wrapf(err, "error verifying archives"))
+			}
+		}
+
+		deleted, failed, err := deleteArchivedOrgRecords(ctx, now, config, db, s3Client, org, archiveType, nil)
+		for _, a := range deleted {
+			result.attempted(phase, a, nil)
+		}
+		for _, a := range failed {
+			result.attempted(phase, a, a.Err)
+		}
+		if err != nil {
+			return result, result.fatal(phase, errors.Wrapf(err, "error deleting archived records"))
+		}
+	}
+
+	// compacting is only a cleanup, failing to do so doesn't fail our archiving
+	if config.CompactEmptyArchives && config.UploadToS3 {
+		_, err = CompactEmptyArchives(ctx, config, db, s3Client, org, archiveType)
 		if err != nil {
-			return created, deleted, errors.Wrapf(err, "error deleting archived records")
+			logrus.WithError(err).WithField("org_id", org.ID).WithField("archive_type", archiveType).Error("error compacting empty archives")
 		}
 	}
 
-	return created, deleted, nil
+	return result, nil
 }
@@ -0,0 +1,438 @@
+package archives
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// the size of the blocks we upload blobs in, each being read into memory before it's uploaded
+var azureBlockSize int64 = 16 * 1024 * 1024
+
+// the S3 storage classes of the access tiers of blobs, blobs in the archive tier being unreadable until rehydrated
+var azureStorageClasses = map[string]string{
+	"Hot":     "STANDARD",
+	"Cool":    "STANDARD_IA",
+	"Cold":    "STANDARD_IA",
+	"Archive": "GLACIER",
+}
+
+// the codes of the storage errors we return for the codes of failed Azure requests, so we handle them the same way as
+// those of S3
+var azureErrorCodes = map[string]string{
+	"BlobNotFound":         errCodeNotFound,
+	"ContainerNotFound":    errCodeNotFound,
+	"BlobArchived":         errCodeInvalidObjectState,
+	"ServerBusy":           errCodeSlowDown,
+	"AuthenticationFailed": "AccessDenied",
+	"Md5Mismatch":          "BadDigest",
+}
+
+// AzureBlobClient is the Storage of archives in Azure Blob Storage, using the Azure SDK.
+//
+// The URLs of blobs are our blob endpoint followed by their container and name, so the buckets of our requests are
+// our container, and keys are blob names with a leading slash.
+type AzureBlobClient struct {
+	client   *azblob.Client
+	endpoint string
+}
+
+// NewAzureBlobClient creates a new Azure Blob Storage client from the passed in config, authenticating with our
+// connection string if we have one or otherwise our account name and key, and tests that our container is reachable
+func NewAzureBlobClient(config *Config) (Storage, error) {
+	// we only stream archives as multipart uploads, which we don't implement for Azure
+	if config.StreamUploads {
+		return nil, fmt.Errorf("streamed uploads aren't supported when storing archives in Azure")
+	}
+	if config.AzureContainerName == "" {
+		return nil, fmt.Errorf("no azure container name configured")
+	}
+
+	client, err := newAzureBlobClient(config.AzureConnectionString, config.AzureAccountName, config.AzureAccountKey, azureHTTPClient())
+	if err != nil {
+		return nil, err
+	}
+
+	// test out our Azure credentials
+	err = client.testContainer(context.Background(), config.AzureContainerName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "azure container: %s not reachable", config.AzureContainerName)
+	}
+
+	logrus.Info("azure container ok")
+	return client, nil
+}
+
+// azureHTTPClient returns the http client we make requests to Azure with. It leaves the encoding of the blobs we
+// download alone, so gzip encoded archives are read exactly as they were uploaded.
+func azureHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DisableCompression = true
+	return &http.Client{Transport: transport}
+}
+
+// newAzureBlobClient creates a client which authenticates with the passed in connection string, or if that's empty,
+// the passed in account name and key, making requests with the passed in http client
+func newAzureBlobClient(connection string, account string, key string, httpClient *http.Client) (*AzureBlobClient, error) {
+	options := &azblob.ClientOptions{}
+	options.Transport = httpClient
+
+	var client *azblob.Client
+	var err error
+	if connection != "" {
+		client, err = azblob.NewClientFromConnectionString(connection, options)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid azure connection string")
+		}
+	} else {
+		if account == "" || key == "" {
+			return nil, fmt.Errorf("azure account name and key are required")
+		}
+		credential, err := azblob.NewSharedKeyCredential(account, key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid azure account key, not base64 encoded")
+		}
+		client, err = azblob.NewClientWithSharedKeyCredential(fmt.Sprintf("https://%s.blob.core.windows.net/", account), credential, options)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &AzureBlobClient{client: client, endpoint: strings.TrimSuffix(client.URL(), "/")}, nil
+}
+
+// UploadToAzure writes the passed in archive to the passed in container, the same as UploadToS3 does to a bucket
+func UploadToAzure(ctx context.Context, client *AzureBlobClient, container string, path string, archive *Archive) error {
+	return UploadToS3(ctx, client, container, path, archive)
+}
+
+// GetAzureFile returns an io.ReadCloser of the blob at the passed in URL, the same as GetS3File does for S3 objects
+func GetAzureFile(ctx context.Context, client *AzureBlobClient, fileURL string) (io.ReadCloser, error) {
+	return GetS3File(ctx, client, fileURL)
+}
+
+// azureError returns the storage error for the passed in error of a failed Azure request, or the error itself if
+// Azure didn't respond to it
+func azureError(err error) error {
+	respErr, isResponse := errors.Cause(err).(*azcore.ResponseError)
+	if !isResponse {
+		return err
+	}
+
+	code := respErr.ErrorCode
+	message := fmt.Sprintf("%d %s", respErr.StatusCode, http.StatusText(respErr.StatusCode))
+	if code != "" {
+		message = fmt.Sprintf("%s, %s", message, code)
+	}
+
+	if mapped, found := azureErrorCodes[code]; found {
+		code = mapped
+	} else if code == "" && respErr.StatusCode == http.StatusNotFound {
+		code = errCodeNotFound
+	} else if code == "" {
+		code = strings.Replace(http.StatusText(respErr.StatusCode), " ", "", -1)
+	}
+	return &StorageError{Code: code, Message: message}
+}
+
+// azureMD5 returns the hex encoded MD5 of a blob from its Content-MD5, or for blobs copied from ones which didn't have
+// one, from the base64 encoded hash we stored in their metadata
+func azureMD5(contentMD5 []byte, metadata map[string]*string) string {
+	if len(contentMD5) == 0 {
+		for k, v := range metadata {
+			if strings.ToLower(k) == "md5chksum" && v != nil {
+				contentMD5, _ = base64.StdEncoding.DecodeString(*v)
+			}
+		}
+	}
+	return hex.EncodeToString(contentMD5)
+}
+
+// azureString returns a pointer to the passed in string, as the Azure SDK takes optional values
+func azureString(s string) *string {
+	return &s
+}
+
+// container returns the client of the passed in container
+func (c *AzureBlobClient) container(name string) *container.Client {
+	return c.client.ServiceClient().NewContainerClient(name)
+}
+
+// blob returns the client of the block blob with the passed in key. Our keys start with a slash, which S3 drops and
+// Azure would keep.
+func (c *AzureBlobClient) blob(container string, key string) *blockblob.Client {
+	return c.container(container).NewBlockBlobClient(strings.TrimPrefix(key, "/"))
+}
+
+// testContainer checks the passed in container exists and that we can access it
+func (c *AzureBlobClient) testContainer(ctx context.Context, container string) error {
+	_, err := c.container(container).GetProperties(ctx, nil)
+	return azureError(err)
+}
+
+// URL returns the URL of the blob with the passed in key in the passed in container
+func (c *AzureBlobClient) URL(container string, key string) string {
+	return c.endpoint + "/" + container + key
+}
+
+// SplitURL returns the container and key of the blob at the passed in URL
+func (c *AzureBlobClient) SplitURL(fileURL string) (string, string, error) {
+	path := strings.TrimPrefix(fileURL, c.endpoint+"/")
+	if path == fileURL {
+		return "", "", fmt.Errorf("invalid azure blob url: %s", fileURL)
+	}
+	path, err := url.PathUnescape(path)
+	if err != nil {
+		return "", "", err
+	}
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("invalid azure blob url: %s", fileURL)
+	}
+	return parts[0], "/" + parts[1], nil
+}
+
+// put uploads the passed in body in blocks, which are committed with the passed in headers and metadata
+func (c *AzureBlobClient) put(ctx context.Context, container string, key string, body io.Reader, headers *blob.HTTPHeaders, metadata map[string]*string) error {
+	_, err := c.blob(container, key).UploadStream(ctx, body, &blockblob.UploadStreamOptions{
+		BlockSize:   azureBlockSize,
+		HTTPHeaders: headers,
+		Metadata:    metadata,
+	})
+	return azureError(err)
+}
+
+// PutObject writes the passed in body to the passed in key, returning its URL
+func (c *AzureBlobClient) PutObject(ctx context.Context, container string, key string, body io.Reader, size int64, contentType string, contentEncoding string) (string, error) {
+	headers := &blob.HTTPHeaders{BlobContentType: azureString(contentType)}
+	if contentEncoding != "" {
+		headers.BlobContentEncoding = azureString(contentEncoding)
+	}
+
+	err := c.put(ctx, container, key, body, headers, nil)
+	if err != nil {
+		return "", err
+	}
+	return c.URL(container, key), nil
+}
+
+// Upload writes an archive to the passed in key. Azure doesn't check the MD5 of blobs uploaded in blocks against their
+// contents, so we do, deleting the blob if they don't match.
+func (c *AzureBlobClient) Upload(ctx context.Context, container string, key string, body io.Reader, size int64, contentEncoding string, md5Hex string) (string, error) {
+	hashBytes, err := hex.DecodeString(md5Hex)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid md5: %s", md5Hex)
+	}
+
+	headers := &blob.HTTPHeaders{
+		BlobContentType:     azureString("application/json"),
+		BlobContentEncoding: azureString(contentEncoding),
+		BlobContentMD5:      hashBytes,
+	}
+	metadata := map[string]*string{"md5chksum": azureString(base64.StdEncoding.EncodeToString(hashBytes))}
+
+	hasher := md5.New()
+	err = c.put(ctx, container, key, io.TeeReader(body, hasher), headers, metadata)
+	if err != nil {
+		return "", err
+	}
+
+	if hex.EncodeToString(hasher.Sum(nil)) != md5Hex {
+		_, err = c.blob(container, key).Delete(ctx, nil)
+		if err != nil {
+			logrus.WithError(err).WithField("key", key).Error("error deleting blob not matching its md5")
+		}
+		return "", &StorageError{Code: "BadDigest", Message: fmt.Sprintf("uploaded contents of %s don't match md5: %s", key, md5Hex)}
+	}
+	return c.URL(container, key), nil
+}
+
+// UploadStream fails, as we only stream archives as multipart uploads
+func (c *AzureBlobClient) UploadStream(ctx context.Context, container string, key string, body io.Reader) (string, error) {
+	return "", fmt.Errorf("streamed uploads aren't supported for archives stored in Azure")
+}
+
+// GetObject returns the contents of the blob at the passed in URL, exactly as they were uploaded
+func (c *AzureBlobClient) GetObject(ctx context.Context, fileURL string) (io.ReadCloser, error) {
+	container, key, err := c.SplitURL(fileURL)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.blob(container, key).DownloadStream(ctx, nil)
+	if err != nil {
+		return nil, azureError(err)
+	}
+	return resp.Body, nil
+}
+
+// Download returns the contents of the archive at the passed in URL
+func (c *AzureBlobClient) Download(ctx context.Context, fileURL string) (io.ReadCloser, error) {
+	return c.GetObject(ctx, fileURL)
+}
+
+// Stat returns the size, hash and storage class of the blob at the passed in URL. Blobs in the archive tier being
+// rehydrated aren't restored yet, as S3 would say of objects being restored from Glacier.
+func (c *AzureBlobClient) Stat(ctx context.Context, fileURL string) (*ObjectInfo, error) {
+	container, key, err := c.SplitURL(fileURL)
+	if err != nil {
+		return nil, err
+	}
+
+	props, err := c.blob(container, key).GetProperties(ctx, nil)
+	if err != nil {
+		return nil, azureError(err)
+	}
+
+	info := &ObjectInfo{Key: key, MD5: azureMD5(props.ContentMD5, props.Metadata)}
+	if props.ContentLength != nil {
+		info.Size = *props.ContentLength
+	}
+	if props.AccessTier != nil {
+		info.StorageClass = azureStorageClasses[*props.AccessTier]
+	}
+	return info, nil
+}
+
+// how often we check on a copy Azure is making in the background, and the longest we wait for it to finish
+var azureCopyPollInterval = time.Second
+var azureCopyTimeout = time.Hour
+
+// Copy copies a blob within its container, replacing its metadata with that of an archive if we have a hash for it.
+// Copies Azure can't make straight away are made in the background, which we wait for.
+func (c *AzureBlobClient) Copy(ctx context.Context, fileURL string, key string, md5 string) (string, error) {
+	container, source, err := c.SplitURL(fileURL)
+	if err != nil {
+		return "", err
+	}
+
+	// without metadata the copy keeps the metadata of its source
+	options := &blob.StartCopyFromURLOptions{}
+	if md5 != "" {
+		hashBytes, err := hex.DecodeString(md5)
+		if err != nil {
+			return "", errors.Wrapf(err, "invalid md5: %s", md5)
+		}
+		options.Metadata = map[string]*string{"md5chksum": azureString(base64.StdEncoding.EncodeToString(hashBytes))}
+	}
+
+	copied := c.blob(container, key).BlobClient()
+	resp, err := copied.StartCopyFromURL(ctx, c.blob(container, source).URL(), options)
+	if err != nil {
+		return "", azureError(err)
+	}
+
+	deadline := time.Now().Add(azureCopyTimeout)
+	status, description := blob.CopyStatusType(""), ""
+	if resp.CopyStatus != nil {
+		status = *resp.CopyStatus
+	}
+	for status == blob.CopyStatusTypePending {
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("timed out waiting for copy to: %s", key)
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(azureCopyPollInterval):
+		}
+
+		props, err := copied.GetProperties(ctx, nil)
+		if err != nil {
+			return "", azureError(err)
+		}
+		status, description = "", ""
+		if props.CopyStatus != nil {
+			status = *props.CopyStatus
+		}
+		if props.CopyStatusDescription != nil {
+			description = *props.CopyStatusDescription
+		}
+	}
+	if status != blob.CopyStatusTypeSuccess {
+		return "", fmt.Errorf("copy to: %s failed with status: %s, %s", key, status, description)
+	}
+	return c.URL(container, key), nil
+}
+
+// Delete deletes each of the passed in blobs in turn. Blobs which don't exist are deleted as far as we are concerned.
+func (c *AzureBlobClient) Delete(ctx context.Context, container string, keys []string) map[string]error {
+	results := make(map[string]error, len(keys))
+	for _, key := range keys {
+		_, err := c.blob(container, key).Delete(ctx, nil)
+		err = azureError(err)
+		if isNotFound(err) {
+			err = nil
+		}
+		results[key] = err
+	}
+	return results
+}
+
+// List returns the blobs with the passed in prefix, a page at a time. Their keys start with a slash if our prefix did,
+// like our keys always do.
+func (c *AzureBlobClient) List(ctx context.Context, container string, prefix string) ([]*ObjectInfo, error) {
+	slash := ""
+	if strings.HasPrefix(prefix, "/") {
+		slash = "/"
+	}
+
+	objects := make([]*ObjectInfo, 0)
+	pager := c.client.NewListBlobsFlatPager(container, &azblob.ListBlobsFlatOptions{Prefix: azureString(strings.TrimPrefix(prefix, "/"))})
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, azureError(err)
+		}
+
+		for _, b := range page.Segment.BlobItems {
+			if b.Name == nil {
+				continue
+			}
+			object := &ObjectInfo{Key: slash + *b.Name}
+			if b.Properties != nil {
+				if b.Properties.ContentLength != nil {
+					object.Size = *b.Properties.ContentLength
+				}
+				object.MD5 = azureMD5(b.Properties.ContentMD5, nil)
+				if b.Properties.AccessTier != nil {
+					object.StorageClass = azureStorageClasses[string(*b.Properties.AccessTier)]
+				}
+			}
+			objects = append(objects, object)
+		}
+	}
+	return objects, nil
+}
+
+// Restore requests a blob in the archive tier be rehydrated to the hot tier. Unlike S3 this isn't a temporary copy,
+// the blob stays in the hot tier until it's moved again.
+func (c *AzureBlobClient) Restore(ctx context.Context, fileURL string, days int) error {
+	container, key, err := c.SplitURL(fileURL)
+	if err != nil {
+		return err
+	}
+
+	priority := blob.RehydratePriorityStandard
+	_, err = c.blob(container, key).SetTier(ctx, blob.AccessTierHot, &blob.SetTierOptions{RehydratePriority: &priority})
+	return azureError(err)
+}
+
+// SignURL fails, as Azure shared access signatures are signed differently
+func (c *AzureBlobClient) SignURL(fileURL string, expires time.Duration) (string, error) {
+	return "", fmt.Errorf("presigning urls isn't supported for archives stored in Azure")
+}
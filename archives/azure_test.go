@@ -0,0 +1,395 @@
+package archives
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testAzureKey = "dGVzdC1rZXk="
+
+type mockAzureBlob struct {
+	body            []byte
+	contentMD5      string
+	contentType     string
+	contentEncoding string
+	metadata        map[string]string
+	tier            string
+	rehydrating     bool
+	copyPending     bool
+}
+
+// mockAzureServer is an in memory Azure blob container served over the parts of the Blob Storage REST API our
+// client uses, checking each request is signed with the key of our account
+type mockAzureServer struct {
+	*httptest.Server
+
+	mutex     sync.Mutex
+	container string
+	blobs     map[string]*mockAzureBlob
+	blocks    map[string][]byte
+
+	// how many blobs are listed per page
+	pageSize int
+}
+
+func newMockAzureServer(container string) *mockAzureServer {
+	s := &mockAzureServer{container: container, blobs: make(map[string]*mockAzureBlob), blocks: make(map[string][]byte), pageSize: 2}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+func (s *mockAzureServer) client(account string) *AzureBlobClient {
+	connection := fmt.Sprintf("AccountName=%s;AccountKey=%s;BlobEndpoint=%s", account, testAzureKey, s.URL)
+	client, _ := newAzureBlobClient(connection, "", "", azureHTTPClient())
+	return client
+}
+
+func (s *mockAzureServer) writeError(w http.ResponseWriter, r *http.Request, status int, code string) {
+	w.Header().Set("x-ms-error-code", code)
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?><Error><Code>%s</Code><Message>%s failed</Message></Error>`, code, code)
+	}
+}
+
+func (s *mockAzureServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "SharedKey testaccount:") || r.Header.Get("x-ms-version") == "" {
+		s.writeError(w, r, http.StatusForbidden, "AuthenticationFailed")
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if parts[0] != s.container {
+		s.writeError(w, r, http.StatusNotFound, "ContainerNotFound")
+		return
+	}
+
+	query := r.URL.Query()
+	if len(parts) == 1 {
+		switch {
+		case r.Method == http.MethodGet && query.Get("restype") == "container" && query.Get("comp") == "":
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodGet && query.Get("comp") == "list":
+			s.list(w, r)
+		default:
+			s.writeError(w, r, http.StatusBadRequest, "UnsupportedHttpVerb")
+		}
+		return
+	}
+
+	name := parts[1]
+	switch {
+	case r.Method == http.MethodPut && query.Get("comp") == "block":
+		s.blocks[name+":"+query.Get("blockid")], _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && query.Get("comp") == "blocklist":
+		list := &struct {
+			Latest []string `xml:"Latest"`
+		}{}
+		xml.NewDecoder(r.Body).Decode(list)
+		body := make([]byte, 0)
+		for _, blockID := range list.Latest {
+			body = append(body, s.blocks[name+":"+blockID]...)
+		}
+		s.put(w, r, name, body, r.Header.Get("x-ms-blob-content-md5"), r.Header.Get("x-ms-blob-content-type"), r.Header.Get("x-ms-blob-content-encoding"))
+	case r.Method == http.MethodPut && query.Get("comp") == "tier":
+		blob, found := s.blobs[name]
+		if !found {
+			s.writeError(w, r, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		blob.rehydrating = blob.tier == "Archive"
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodPut && r.Header.Get("x-ms-copy-source") != "":
+		s.copy(w, r, name)
+	case r.Method == http.MethodPut:
+		body, _ := ioutil.ReadAll(r.Body)
+		contentMD5 := r.Header.Get("x-ms-blob-content-md5")
+		if contentMD5 == "" {
+			hash := md5.Sum(body)
+			contentMD5 = base64.StdEncoding.EncodeToString(hash[:])
+		}
+		s.put(w, r, name, body, contentMD5, r.Header.Get("x-ms-blob-content-type"), r.Header.Get("x-ms-blob-content-encoding"))
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		blob, found := s.blobs[name]
+		if !found {
+			s.writeError(w, r, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		if blob.tier == "Archive" && r.Method == http.MethodGet {
+			s.writeError(w, r, http.StatusConflict, "BlobArchived")
+			return
+		}
+		s.writeHeaders(w, blob)
+		if r.Method == http.MethodGet {
+			w.Write(blob.body)
+		}
+	case r.Method == http.MethodDelete:
+		if _, found := s.blobs[name]; !found {
+			s.writeError(w, r, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		delete(s.blobs, name)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		s.writeError(w, r, http.StatusBadRequest, "UnsupportedHttpVerb")
+	}
+}
+
+func (s *mockAzureServer) put(w http.ResponseWriter, r *http.Request, name string, body []byte, contentMD5 string, contentType string, contentEncoding string) {
+	blob := &mockAzureBlob{body: body, contentMD5: contentMD5, contentType: contentType, contentEncoding: contentEncoding, metadata: make(map[string]string), tier: "Hot"}
+	for k := range r.Header {
+		if strings.HasPrefix(strings.ToLower(k), "x-ms-meta-") {
+			blob.metadata[strings.ToLower(k[len("x-ms-meta-"):])] = r.Header.Get(k)
+		}
+	}
+	s.blobs[name] = blob
+	w.Header().Set("Content-MD5", contentMD5)
+	w.Header().Set("ETag", `"0x8D4BCC2E4835CD0"`)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// copy makes copies in the background, so they are pending until the blob is next looked at
+func (s *mockAzureServer) copy(w http.ResponseWriter, r *http.Request, name string) {
+	source, _ := url.Parse(r.Header.Get("x-ms-copy-source"))
+	from, found := s.blobs[strings.TrimPrefix(source.Path, "/"+s.container+"/")]
+	if !found {
+		s.writeError(w, r, http.StatusNotFound, "CannotVerifyCopySource")
+		return
+	}
+
+	// metadata headers replace all the metadata of the source
+	copied := *from
+	copied.copyPending = true
+	metadata := make(map[string]string)
+	for k := range r.Header {
+		if strings.HasPrefix(strings.ToLower(k), "x-ms-meta-") {
+			metadata[strings.ToLower(k[len("x-ms-meta-"):])] = r.Header.Get(k)
+		}
+	}
+	if len(metadata) > 0 {
+		copied.metadata = metadata
+	}
+	s.blobs[name] = &copied
+	w.Header().Set("x-ms-copy-status", "pending")
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *mockAzureServer) writeHeaders(w http.ResponseWriter, blob *mockAzureBlob) {
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(blob.body)))
+	w.Header().Set("Content-MD5", blob.contentMD5)
+	w.Header().Set("Content-Type", blob.contentType)
+	w.Header().Set("Content-Encoding", blob.contentEncoding)
+	w.Header().Set("ETag", `"0x8D4BCC2E4835CD0"`)
+	w.Header().Set("Last-Modified", "Mon, 08 Jan 2018 12:00:00 GMT")
+	w.Header().Set("x-ms-access-tier", blob.tier)
+	for k, v := range blob.metadata {
+		w.Header().Set("x-ms-meta-"+k, v)
+	}
+	if blob.rehydrating {
+		w.Header().Set("x-ms-archive-status", "rehydrate-pending-to-hot")
+	}
+	if blob.copyPending {
+		blob.copyPending = false
+		w.Header().Set("x-ms-copy-status", "pending")
+	} else {
+		w.Header().Set("x-ms-copy-status", "success")
+	}
+}
+
+func (s *mockAzureServer) list(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0)
+	for name := range s.blobs {
+		if strings.HasPrefix(name, r.URL.Query().Get("prefix")) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	start := 0
+	fmt.Sscanf(r.URL.Query().Get("marker"), "%d", &start)
+	end := start + s.pageSize
+	next := fmt.Sprintf("%d", end)
+	if end >= len(names) {
+		end = len(names)
+		next = ""
+	}
+
+	fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?><EnumerationResults><Blobs>`)
+	for _, name := range names[start:end] {
+		blob := s.blobs[name]
+		fmt.Fprintf(w, `<Blob><Name>%s</Name><Properties><Content-Length>%d</Content-Length><Content-MD5>%s</Content-MD5><AccessTier>%s</AccessTier></Properties></Blob>`, name, len(blob.body), blob.contentMD5, blob.tier)
+	}
+	fmt.Fprintf(w, `</Blobs><NextMarker>%s</NextMarker></EnumerationResults>`, next)
+}
+
+func TestAzureClient(t *testing.T) {
+	ctx := context.Background()
+	server := newMockAzureServer("archives")
+	defer server.Close()
+	client := server.client("testaccount")
+
+	assert.NoError(t, client.testContainer(ctx, "archives"))
+	assert.Error(t, client.testContainer(ctx, "other"))
+
+	// archives are uploaded, verified and read back as they are on S3
+	archive := writeTestArchive(t, 400)
+	defer os.Remove(archive.ArchiveFile)
+	assert.NoError(t, UploadToAzure(ctx, client, "archives", "/1/message_D20170812_hash.jsonl.gz", archive))
+	assert.Equal(t, server.URL+"/archives/1/message_D20170812_hash.jsonl.gz", archive.URL)
+
+	blob := server.blobs["1/message_D20170812_hash.jsonl.gz"]
+	assert.Equal(t, "gzip", blob.contentEncoding)
+	assert.Equal(t, "application/json", blob.contentType)
+	assert.Equal(t, 400, len(blob.body))
+	assert.NotEqual(t, "", blob.metadata["md5chksum"])
+
+	assert.NoError(t, VerifyS3Archive(ctx, client, archive))
+	assert.Equal(t, "STANDARD", archive.StorageClass)
+
+	etag, err := GetS3FileETAG(ctx, client, archive.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, archive.Hash, etag)
+
+	reader, err := GetAzureFile(ctx, client, archive.URL)
+	assert.NoError(t, err)
+	contents, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	reader.Close()
+	assert.Equal(t, blob.body, contents)
+
+	// a body which doesn't match its hash is refused, and the blob deleted
+	mismatched := writeTestArchive(t, 10)
+	defer os.Remove(mismatched.ArchiveFile)
+	mismatched.Hash = archive.Hash
+	err = UploadToAzure(ctx, client, "archives", "/1/mismatched.jsonl.gz", mismatched)
+	assert.Error(t, err)
+	assert.Equal(t, "BadDigest", storageErrorCode(err))
+	assert.Nil(t, server.blobs["1/mismatched.jsonl.gz"])
+
+	// larger blobs are uploaded in several blocks, which still have the hash of their contents
+	defer func(block int64) { azureBlockSize = block }(azureBlockSize)
+	azureBlockSize = 1024 * 1024
+	large := writeTestArchive(t, 2500*1024)
+	defer os.Remove(large.ArchiveFile)
+	assert.NoError(t, UploadToAzure(ctx, client, "archives", "/1/large.jsonl.gz", large))
+	assert.Equal(t, 2500*1024, len(server.blobs["1/large.jsonl.gz"].body))
+	largeBlocks := 0
+	for id := range server.blocks {
+		if strings.HasPrefix(id, "1/large.jsonl.gz:") {
+			largeBlocks++
+		}
+	}
+	assert.Equal(t, 3, largeBlocks)
+	assert.NoError(t, VerifyS3Archive(ctx, client, large))
+
+	// missing blobs are not found the same way they are on S3
+	_, err = GetS3File(ctx, client, server.URL+"/archives/1/missing.jsonl.gz")
+	assert.True(t, isNotFound(err))
+	missing := *archive
+	missing.URL = server.URL + "/archives/1/missing.jsonl.gz"
+	assert.EqualError(t, VerifyS3Archive(ctx, client, &missing), "archive object missing from s3: "+missing.URL)
+
+	// copies made in the background are waited for, replacing their metadata
+	defer func(i time.Duration) { azureCopyPollInterval = i }(azureCopyPollInterval)
+	azureCopyPollInterval = time.Millisecond
+	copied, err := client.Copy(ctx, archive.URL, "/1/copied.jsonl.gz", large.Hash)
+	assert.NoError(t, err)
+	assert.Equal(t, server.URL+"/archives/1/copied.jsonl.gz", copied)
+	assert.Equal(t, blob.body, server.blobs["1/copied.jsonl.gz"].body)
+	assert.Equal(t, server.blobs["1/large.jsonl.gz"].metadata["md5chksum"], server.blobs["1/copied.jsonl.gz"].metadata["md5chksum"])
+	assert.NotEqual(t, blob.metadata["md5chksum"], server.blobs["1/copied.jsonl.gz"].metadata["md5chksum"])
+
+	// listing pages through our blobs, with keys like ours
+	objects, err := client.List(ctx, "archives", "/1/")
+	assert.NoError(t, err)
+	keys := make([]string, 0)
+	for _, o := range objects {
+		keys = append(keys, o.Key)
+	}
+	assert.Equal(t, []string{"/1/copied.jsonl.gz", "/1/large.jsonl.gz", "/1/message_D20170812_hash.jsonl.gz"}, keys)
+	assert.Equal(t, archive.Hash, objects[2].MD5)
+
+	// deleting blobs which don't exist succeeds, as it does on S3
+	results := client.Delete(ctx, "archives", []string{"/1/copied.jsonl.gz", "/1/missing.jsonl.gz"})
+	assert.Equal(t, map[string]error{"/1/copied.jsonl.gz": nil, "/1/missing.jsonl.gz": nil}, results)
+	assert.Equal(t, 2, len(server.blobs))
+
+	// blobs in the archive tier are in glacier until rehydrated
+	blob.tier = "Archive"
+	_, err = GetS3File(ctx, client, archive.URL)
+	assert.True(t, isCold(err))
+	cold, err := HeadStorageClass(ctx, client, archive)
+	assert.NoError(t, err)
+	assert.True(t, cold)
+	assert.Equal(t, "GLACIER", archive.StorageClass)
+
+	// and stay there until rehydrated
+	assert.NoError(t, client.Restore(ctx, archive.URL, 3))
+	assert.True(t, blob.rehydrating)
+	cold, err = HeadStorageClass(ctx, client, archive)
+	assert.NoError(t, err)
+	assert.True(t, cold)
+
+	// which can't be presigned
+	_, err = client.SignURL(archive.URL, time.Hour)
+	assert.Error(t, err)
+
+	// requests signed for the wrong account fail with Azure's reason
+	err = server.client("otheraccount").testContainer(ctx, "archives")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "AccessDenied")
+}
+
+func TestNewAzureBlobClient(t *testing.T) {
+	tcs := []struct {
+		connection string
+		account    string
+		key        string
+		endpoint   string
+		err        string
+	}{
+		{"DefaultEndpointsProtocol=https;AccountName=archiver;AccountKey=a2V5;EndpointSuffix=core.windows.net", "", "", "https://archiver.blob.core.windows.net", ""},
+		{"AccountName=devstoreaccount1;AccountKey=a2V5;BlobEndpoint=http://127.0.0.1:10000/devstoreaccount1", "", "", "http://127.0.0.1:10000/devstoreaccount1", ""},
+		{"", "archiver", "a2V5", "https://archiver.blob.core.windows.net", ""},
+		{"", "archiver", "", "", "azure account name and key are required"},
+		{"", "archiver", "not base64!", "", "invalid azure account key, not base64 encoded"},
+	}
+
+	for _, tc := range tcs {
+		client, err := newAzureBlobClient(tc.connection, tc.account, tc.key, nil)
+		if tc.err != "" {
+			assert.EqualError(t, err, tc.err, "error mismatch for %s", tc.connection)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, tc.endpoint, client.endpoint, "endpoint mismatch for %s", tc.connection)
+	}
+
+	// blob URLs are split by what follows our endpoint
+	client, _ := newAzureBlobClient("AccountName=devstoreaccount1;AccountKey=a2V5;BlobEndpoint=http://127.0.0.1:10000/devstoreaccount1", "", "", nil)
+	container, key, err := client.SplitURL("http://127.0.0.1:10000/devstoreaccount1/archives/1/message_D20170812_hash.jsonl.gz")
+	assert.NoError(t, err)
+	assert.Equal(t, "archives", container)
+	assert.Equal(t, "/1/message_D20170812_hash.jsonl.gz", key)
+	_, _, err = client.SplitURL("https://archiver.blob.core.windows.net/archives/1/message_D20170812_hash.jsonl.gz")
+	assert.Error(t, err)
+}
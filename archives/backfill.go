@@ -0,0 +1,495 @@
+package archives
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	backfillArchives  = newCounter("archiver_backfill_archives_total", "Number of archives built by backfills.", "archive_type")
+	backfillThrottles = newCounter("archiver_backfill_throttles_total", "Number of times a backfill waited for the load on our database to drop.")
+)
+
+// the queries other than ours running on our database, our measure of its load
+const countActiveQueries = `
+SELECT count(*) FROM pg_stat_activity WHERE state = 'active' AND datname = current_database() AND pid <> pg_backend_pid()
+`
+
+const lookupDailyStartDates = `
+SELECT start_date FROM archives_archive WHERE org_id = $1 AND archive_type = $2 AND period = 'D'
+`
+
+// BackfillOrgProgress is how far backfilling one type of archive of an org has got
+type BackfillOrgProgress struct {
+	OrgID       int         `json:"org_id"`
+	ArchiveType ArchiveType `json:"archive_type"`
+	Done        bool        `json:"done"`
+	Built       int         `json:"built"`
+	Failed      int         `json:"failed"`
+	Records     int         `json:"records"`
+	Size        int64       `json:"size"`
+
+	// the last month we built archives of, and how many archives were left when we last looked
+	LastMonth string `json:"last_month,omitempty"`
+	Remaining int    `json:"remaining"`
+}
+
+// BackfillProgress is the progress of a backfill across all the times we've run it, kept in a file so that each run
+// continues where the last stopped
+type BackfillProgress struct {
+	StartedOn   time.Time              `json:"started_on"`
+	UpdatedOn   time.Time              `json:"updated_on"`
+	Invocations int                    `json:"invocations"`
+	Orgs        []*BackfillOrgProgress `json:"orgs"`
+}
+
+// ReadBackfillProgress reads the backfill progress at the passed in path, returning new progress if there is none yet
+func ReadBackfillProgress(path string) (*BackfillProgress, error) {
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &BackfillProgress{Orgs: make([]*BackfillOrgProgress, 0)}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading backfill progress")
+	}
+
+	progress := &BackfillProgress{}
+	err = json.Unmarshal(contents, progress)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing backfill progress")
+	}
+	return progress, nil
+}
+
+// WriteBackfillProgress writes the passed in backfill progress to the passed in path, replacing it in one step so that
+// being stopped while writing never loses it
+func WriteBackfillProgress(path string, progress *BackfillProgress) error {
+	contents, err := json.MarshalIndent(progress, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "error encoding backfill progress")
+	}
+
+	err = ioutil.WriteFile(path+".tmp", contents, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "error writing backfill progress")
+	}
+	return errors.Wrapf(os.Rename(path+".tmp", path), "error replacing backfill progress")
+}
+
+// org returns the progress of the passed in org and type, adding it if we have none
+func (p *BackfillProgress) org(orgID int, archiveType ArchiveType) *BackfillOrgProgress {
+	for _, o := range p.Orgs {
+		if o.OrgID == orgID && o.ArchiveType == archiveType {
+			return o
+		}
+	}
+	o := &BackfillOrgProgress{OrgID: orgID, ArchiveType: archiveType}
+	p.Orgs = append(p.Orgs, o)
+	return o
+}
+
+// BackfillReport is what a run of a backfill did and the work it left for the next
+type BackfillReport struct {
+	Elapsed time.Duration
+
+	// whether we stopped because we reached our time limit
+	Stopped bool
+
+	Built   int
+	Failed  int
+	Records int
+
+	// the number of orgs and types we have finished, and the progress of those we haven't
+	Done              int
+	Remaining         []*BackfillOrgProgress
+	RemainingArchives int
+}
+
+// backfillBatch is the archives of one or more months which we build together, before checking our limits again
+type backfillBatch struct {
+	month time.Time
+	work  *ArchiveWork
+}
+
+func (b *backfillBatch) size() int {
+	return len(b.work.Monthlies) + len(b.work.Dailies)
+}
+
+// backfillBatches splits the passed in work into batches by month, oldest first. Consecutive monthlies are built
+// together up to the passed in concurrency, each month of dailies is a batch of its own.
+func backfillBatches(work *ArchiveWork, concurrency int) []*backfillBatch {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	dailies := make(map[time.Time][]*Archive)
+	months := make([]time.Time, 0)
+	for _, d := range work.Dailies {
+		day := d.StartDate.UTC()
+		month := time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, time.UTC)
+		if _, found := dailies[month]; !found {
+			months = append(months, month)
+		}
+		dailies[month] = append(dailies[month], d)
+	}
+
+	monthlies := make(map[time.Time]*Archive)
+	for _, m := range work.Monthlies {
+		month := m.StartDate.UTC()
+		monthlies[month] = m
+		months = append(months, month)
+	}
+	sort.Slice(months, func(i, j int) bool { return months[i].Before(months[j]) })
+
+	batches := make([]*backfillBatch, 0, len(months))
+	var last *backfillBatch
+	for _, month := range months {
+		monthly := monthlies[month]
+		if monthly == nil {
+			last = nil
+			batches = append(batches, &backfillBatch{month: month, work: &ArchiveWork{Monthlies: make([]*Archive, 0), Dailies: dailies[month]}})
+			continue
+		}
+
+		if last == nil || len(last.work.Monthlies) >= concurrency {
+			last = &backfillBatch{work: &ArchiveWork{Monthlies: make([]*Archive, 0), Dailies: make([]*Archive, 0), covered: make(map[time.Time][]*Archive)}}
+			batches = append(batches, last)
+		}
+		last.month = month
+		last.work.Monthlies = append(last.work.Monthlies, monthly)
+		last.work.covered[month] = work.covered[month]
+	}
+	return batches
+}
+
+// findBackfillWork works out which archives backfilling the passed in org and type would build. Unlike FindArchiveWork
+// we keep building complete months as monthlies after the first, so that a backfill which was stopped continues the
+// same way, but only for months without any dailies as their records may have been deleted since.
+func findBackfillWork(ctx context.Context, now time.Time, config *Config, db *sqlx.DB, org Org, archiveType ArchiveType) (*ArchiveWork, error) {
+	before := org.archiveEndDate(now).AddDate(0, 0, -config.DailyGranularityDays)
+	missing, err := getMissingMonthlyArchivesBefore(ctx, db, before, org, archiveType)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting missing monthly archives")
+	}
+
+	days := make([]time.Time, 0)
+	err = db.SelectContext(ctx, &days, lookupDailyStartDates, org.ID, archiveType)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up existing daily archives")
+	}
+	started := make(map[time.Time]bool, len(days))
+	for _, day := range days {
+		day = day.UTC()
+		started[time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, time.UTC)] = true
+	}
+
+	monthlies := make([]*Archive, 0, len(missing))
+	for _, m := range missing {
+		if !started[m.StartDate.UTC()] {
+			monthlies = append(monthlies, m)
+		}
+	}
+
+	dailies, err := GetMissingDailyArchives(ctx, db, now, org, archiveType)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting missing daily archives")
+	}
+
+	return planArchiveWork(monthlies, dailies), nil
+}
+
+// backfiller builds the missing archives of orgs a batch at a time, within our time and load limits
+type backfiller struct {
+	config   *Config
+	db       *sqlx.DB
+	s3Client Storage
+
+	clock         func() time.Time
+	sleep         func(context.Context, time.Duration)
+	activeQueries func(context.Context) (int, error)
+
+	deadline time.Time
+
+	mutex    sync.Mutex
+	progress *BackfillProgress
+	report   *BackfillReport
+}
+
+func newBackfiller(config *Config, db *sqlx.DB, s3Client Storage) *backfiller {
+	return &backfiller{
+		config:   config,
+		db:       db,
+		s3Client: s3Client,
+		clock:    time.Now,
+		sleep: func(ctx context.Context, d time.Duration) {
+			select {
+			case <-time.After(d):
+			case <-ctx.Done():
+			}
+		},
+		activeQueries: func(ctx context.Context) (int, error) {
+			count := 0
+			err := db.GetContext(ctx, &count, countActiveQueries)
+			return count, err
+		},
+	}
+}
+
+// RunBackfill builds the missing archives of the passed in orgs, oldest months first, continuing from the progress of
+// previous runs. Records are never deleted, whatever our config. We stop starting new batches once we've run for
+// BackfillMaxHours, leaving the rest for the next run, and wait while our database is busier than we allow.
+func RunBackfill(ctx context.Context, config *Config, db *sqlx.DB, s3Client Storage, orgs []Org) (*BackfillReport, error) {
+	return newBackfiller(config, db, s3Client).run(ctx, orgs)
+}
+
+func (b *backfiller) run(ctx context.Context, orgs []Org) (*BackfillReport, error) {
+	// a backfill only ever builds archives, deleting is left to our regular runs
+	if b.config.Delete {
+		logrus.Warn("backfills never delete records, ignoring delete")
+	}
+	config := *b.config
+	config.Delete = false
+	b.config = &config
+
+	progress, err := ReadBackfillProgress(config.BackfillProgress)
+	if err != nil {
+		return nil, err
+	}
+	start := b.clock()
+	if progress.StartedOn.IsZero() {
+		progress.StartedOn = start.UTC()
+	}
+	progress.Invocations++
+	b.progress = progress
+	b.report = &BackfillReport{Remaining: make([]*BackfillOrgProgress, 0)}
+
+	if config.BackfillMaxHours > 0 {
+		b.deadline = start.Add(time.Hour * time.Duration(config.BackfillMaxHours))
+	}
+
+	// we share our bandwidth with production traffic, so may be limited to less of it than our regular runs
+	if config.BackfillMaxUploadBytesPerSec > 0 {
+		uploadLimiter.setRate(config.BackfillMaxUploadBytesPerSec)
+		defer uploadLimiter.setRate(config.MaxUploadBytesPerSec)
+	}
+
+	// our retention window stays where it was when we started, however long we run for
+	now := start
+	visited := make(map[*BackfillOrgProgress]bool)
+
+	concurrency := config.BackfillOrgConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	queue := make(chan Org, len(orgs))
+	for _, org := range orgs {
+		queue <- org
+	}
+	close(queue)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for org := range queue {
+				for _, archiveType := range plannedTypes(&config) {
+					b.mutex.Lock()
+					p := b.progress.org(org.ID, archiveType)
+					b.mutex.Unlock()
+
+					if p.Done {
+						continue
+					}
+					if !b.proceed(ctx) {
+						return
+					}
+
+					b.mutex.Lock()
+					visited[p] = true
+					b.mutex.Unlock()
+
+					err := b.backfillOrg(ctx, now, org, archiveType, p)
+					if err != nil {
+						logrus.WithError(err).WithField("org_id", org.ID).WithField("archive_type", archiveType).Error("error backfilling org")
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the orgs we never got to this time still have all their work to do
+	for _, org := range orgs {
+		for _, archiveType := range plannedTypes(&config) {
+			p := b.progress.org(org.ID, archiveType)
+			if visited[p] || p.Done {
+				continue
+			}
+			err := b.countRemaining(ctx, now, org, archiveType, p)
+			if err != nil {
+				logrus.WithError(err).WithField("org_id", org.ID).WithField("archive_type", archiveType).Error("error counting remaining backfill work")
+			}
+		}
+	}
+
+	for _, p := range b.progress.Orgs {
+		if p.Done {
+			b.report.Done++
+		} else {
+			b.report.Remaining = append(b.report.Remaining, p)
+			b.report.RemainingArchives += p.Remaining
+		}
+	}
+	b.report.Elapsed = b.clock().Sub(start)
+
+	return b.report, b.saveProgress()
+}
+
+// proceed returns whether we may start another batch, waiting while our database is too busy
+func (b *backfiller) proceed(ctx context.Context) bool {
+	for {
+		if ctx.Err() != nil || b.stop() {
+			return false
+		}
+		if b.config.BackfillMaxActiveQueries <= 0 {
+			return true
+		}
+
+		active, err := b.activeQueries(ctx)
+		if err != nil {
+			logrus.WithError(err).Warn("error checking the load on our database, continuing backfill")
+			return true
+		}
+		if active <= b.config.BackfillMaxActiveQueries {
+			return true
+		}
+
+		backfillThrottles.add(1)
+		wait := time.Second * time.Duration(b.config.BackfillThrottleWaitSecs)
+		logrus.WithFields(logrus.Fields{
+			"active_queries":     active,
+			"max_active_queries": b.config.BackfillMaxActiveQueries,
+			"wait":               wait,
+		}).Info("database is busy, waiting before continuing backfill")
+		b.sleep(ctx, wait)
+	}
+}
+
+// stop returns whether we have reached our time limit
+func (b *backfiller) stop() bool {
+	if b.deadline.IsZero() || b.clock().Before(b.deadline) {
+		return false
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.report.Stopped = true
+	return true
+}
+
+// backfillOrg builds the missing archives of the passed in org and type a batch at a time, recording our progress
+// after each
+func (b *backfiller) backfillOrg(ctx context.Context, now time.Time, org Org, archiveType ArchiveType, p *BackfillOrgProgress) error {
+	org, err := CheckOrgStart(ctx, b.db, b.config, org, archiveType)
+	if err != nil {
+		return errors.Wrapf(err, "error checking org start")
+	}
+	work, err := findBackfillWork(ctx, now, b.config, b.db, org, archiveType)
+	if err != nil {
+		return err
+	}
+
+	batches := backfillBatches(work, b.config.BackfillConcurrency)
+	remaining := len(work.Monthlies) + len(work.Dailies)
+	failed := 0
+	b.updateProgress(p, func() { p.Remaining = remaining })
+
+	for i, batch := range batches {
+		// the first batch was checked for before we started the org
+		if i > 0 && !b.proceed(ctx) {
+			return nil
+		}
+
+		archives, err := createOrgArchiveWork(ctx, b.config, b.db, b.s3Client, org, archiveType, batch.work)
+		if err != nil {
+			return errors.Wrapf(err, "error backfilling archives of %s", batch.month.Format("2006-01"))
+		}
+
+		remaining -= batch.size()
+		b.updateProgress(p, func() {
+			for _, a := range archives {
+				if a.Err != nil {
+					failed++
+					p.Failed++
+					b.report.Failed++
+					continue
+				}
+				p.Built++
+				p.Records += a.RecordCount
+				p.Size += a.Size
+				b.report.Built++
+				b.report.Records += a.RecordCount
+				backfillArchives.add(1, string(archiveType))
+			}
+			p.LastMonth = batch.month.Format("2006-01")
+			p.Remaining = remaining
+		})
+
+		logrus.WithFields(logrus.Fields{
+			"org_id":       org.ID,
+			"archive_type": archiveType,
+			"month":        p.LastMonth,
+			"archives":     len(archives),
+			"remaining":    remaining,
+		}).Info("backfilled month")
+	}
+
+	// archives which failed are missing still, so are tried again next time
+	b.updateProgress(p, func() { p.Done = failed == 0 })
+	return nil
+}
+
+// countRemaining records how many archives backfilling the passed in org and type has left to build
+func (b *backfiller) countRemaining(ctx context.Context, now time.Time, org Org, archiveType ArchiveType, p *BackfillOrgProgress) error {
+	org, err := CheckOrgStart(ctx, b.db, b.config, org, archiveType)
+	if err != nil {
+		return errors.Wrapf(err, "error checking org start")
+	}
+	work, err := findBackfillWork(ctx, now, b.config, b.db, org, archiveType)
+	if err != nil {
+		return err
+	}
+	p.Remaining = len(work.Monthlies) + len(work.Dailies)
+	return nil
+}
+
+// updateProgress applies the passed in update to our progress and saves it
+func (b *backfiller) updateProgress(p *BackfillOrgProgress, update func()) {
+	b.mutex.Lock()
+	update()
+	b.mutex.Unlock()
+
+	err := b.saveProgress()
+	if err != nil {
+		logrus.WithError(err).Error("error saving backfill progress")
+	}
+}
+
+// saveProgress writes our progress to our progress file
+func (b *backfiller) saveProgress() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.progress.UpdatedOn = time.Now().UTC()
+	return WriteBackfillProgress(b.config.BackfillProgress, b.progress)
+}
@@ -0,0 +1,184 @@
+package archives
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/rp-archiver/testgen"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackfillBatches(t *testing.T) {
+	month := func(m time.Month) *Archive {
+		return &Archive{Period: MonthPeriod, StartDate: time.Date(2017, m, 1, 0, 0, 0, 0, time.UTC)}
+	}
+	day := func(m time.Month, d int) *Archive {
+		return &Archive{Period: DayPeriod, StartDate: time.Date(2017, m, d, 0, 0, 0, 0, time.UTC)}
+	}
+
+	// august already has dailies so is built as dailies, in between our monthlies
+	work := planArchiveWork(
+		[]*Archive{month(6), month(7), month(9)},
+		[]*Archive{day(6, 1), day(8, 30), day(8, 31), day(9, 1), day(10, 1), day(10, 2)},
+	)
+
+	batches := backfillBatches(work, 2)
+	assert.Equal(t, 4, len(batches))
+
+	assert.Equal(t, []*Archive{work.Monthlies[0], work.Monthlies[1]}, batches[0].work.Monthlies)
+	assert.Equal(t, time.Date(2017, 7, 1, 0, 0, 0, 0, time.UTC), batches[0].month)
+	assert.Equal(t, []*Archive{work.covered[time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)][0]}, batches[0].work.covered[time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)])
+	assert.Equal(t, 2, batches[0].size())
+
+	assert.Equal(t, 0, len(batches[1].work.Monthlies))
+	assert.Equal(t, 2, len(batches[1].work.Dailies))
+	assert.Equal(t, time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC), batches[1].month)
+
+	assert.Equal(t, []*Archive{work.Monthlies[2]}, batches[2].work.Monthlies)
+	assert.Equal(t, 1, len(batches[2].work.covered[time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC)]))
+
+	assert.Equal(t, 2, len(batches[3].work.Dailies))
+	assert.Equal(t, time.Date(2017, 10, 1, 0, 0, 0, 0, time.UTC), batches[3].month)
+
+	// one at a time each monthly is a batch of its own
+	assert.Equal(t, 5, len(backfillBatches(work, 0)))
+	assert.Equal(t, 0, len(backfillBatches(planArchiveWork(nil, nil), 1)))
+}
+
+func TestBackfillProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backfill")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "backfill.json")
+
+	// no progress yet is a new backfill
+	progress, err := ReadBackfillProgress(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(progress.Orgs))
+
+	p := progress.org(2, MessageType)
+	p.Built = 3
+	p.LastMonth = "2017-08"
+	assert.Equal(t, p, progress.org(2, MessageType))
+	assert.NotEqual(t, p, progress.org(2, RunType))
+	assert.NoError(t, WriteBackfillProgress(path, progress))
+
+	read, err := ReadBackfillProgress(path)
+	assert.NoError(t, err)
+	assert.Equal(t, progress, read)
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("{"), 0644))
+	_, err = ReadBackfillProgress(path)
+	assert.EqualError(t, err, "error parsing backfill progress: unexpected end of JSON input")
+}
+
+func TestBackfillProceed(t *testing.T) {
+	config := NewConfig()
+	config.BackfillMaxActiveQueries = 5
+
+	loads := []int{10, 8, 2}
+	sleeps := make([]time.Duration, 0)
+	now := time.Date(2018, 1, 8, 12, 0, 0, 0, time.UTC)
+
+	b := newBackfiller(config, nil, nil)
+	b.report = &BackfillReport{}
+	b.clock = func() time.Time { return now }
+	b.sleep = func(ctx context.Context, d time.Duration) { sleeps = append(sleeps, d) }
+	b.activeQueries = func(ctx context.Context) (int, error) {
+		load := loads[0]
+		loads = loads[1:]
+		return load, nil
+	}
+
+	// we wait while our database is busy
+	assert.True(t, b.proceed(context.Background()))
+	assert.Equal(t, []time.Duration{time.Second * 30, time.Second * 30}, sleeps)
+
+	// we carry on if we can't tell how busy it is
+	b.activeQueries = func(ctx context.Context) (int, error) { return 0, fmt.Errorf("permission denied") }
+	assert.True(t, b.proceed(context.Background()))
+
+	// but never once we are out of time
+	b.deadline = now
+	assert.False(t, b.proceed(context.Background()))
+	assert.True(t, b.report.Stopped)
+}
+
+func TestRunBackfill(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+
+	// an org with four months of history
+	spec := &testgen.Spec{OrgID: 100, StartDate: time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC), Days: 120, MessagesPerDay: 4, RunsPerDay: 2, Contacts: 5, PathLength: 3, Seed: 1}
+	_, err := testgen.Populate(ctx, db, spec)
+	assert.NoError(t, err)
+
+	var messages, runs int
+	assert.NoError(t, db.Get(&messages, `SELECT count(*) FROM msgs_msg WHERE org_id = 100`))
+	assert.NoError(t, db.Get(&runs, `SELECT count(*) FROM flows_flowrun WHERE org_id = 100`))
+
+	dir, err := ioutil.TempDir("", "backfill")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := NewConfig()
+	config.Delete = true
+	config.BackfillProgress = filepath.Join(dir, "backfill.json")
+	config.BackfillMaxHours = 3
+	org, err := GetOrg(ctx, db, config, spec.OrgID)
+	assert.NoError(t, err)
+
+	// each check of our clock is an hour later, so we get through two batches before we're out of time
+	clock := &testClock{now: time.Date(2018, 1, 8, 12, 0, 0, 0, time.UTC)}
+	b := newBackfiller(config, db, s3Client)
+	b.clock = func() time.Time { return clock.advance(time.Hour) }
+
+	report, err := b.run(ctx, []Org{*org})
+	assert.NoError(t, err)
+	assert.True(t, report.Stopped)
+	assert.Equal(t, 2, report.Built)
+	assert.Equal(t, 0, report.Failed)
+	assert.Equal(t, 0, report.Done)
+	assertCount(t, db, 2, `SELECT count(*) FROM archives_archive WHERE org_id = 100 AND archive_type = 'message' AND period = 'M'`)
+
+	// what's left is our august and september monthlies and the dailies of october, for both messages and runs
+	assert.Equal(t, 2, len(report.Remaining))
+	assert.Equal(t, "2017-07", report.Remaining[0].LastMonth)
+	assert.Equal(t, 11, report.Remaining[0].Remaining)
+	assert.Equal(t, 13, report.Remaining[1].Remaining)
+	assert.Equal(t, 24, report.RemainingArchives)
+
+	// running again continues with monthlies, even though our org now has archives
+	b = newBackfiller(config, db, s3Client)
+	report, err = b.run(ctx, []Org{*org})
+	assert.NoError(t, err)
+	assert.False(t, report.Stopped)
+	assert.Equal(t, 24, report.Built)
+	assert.Equal(t, 2, report.Done)
+	assert.Equal(t, 0, report.RemainingArchives)
+	assertCount(t, db, 4, `SELECT count(*) FROM archives_archive WHERE org_id = 100 AND archive_type = 'message' AND period = 'M'`)
+	assertCount(t, db, 4, `SELECT count(*) FROM archives_archive WHERE org_id = 100 AND archive_type = 'run' AND period = 'M'`)
+	assertCount(t, db, 0, `SELECT count(*) FROM archives_archive WHERE org_id = 100 AND period = 'D' AND start_date < '2017-10-01'`)
+
+	progress, err := ReadBackfillProgress(config.BackfillProgress)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, progress.Invocations)
+	assert.Equal(t, 13, progress.org(100, MessageType).Built)
+	assert.True(t, progress.org(100, MessageType).Records > 0)
+
+	// nothing was deleted despite our config
+	assertCount(t, db, messages, `SELECT count(*) FROM msgs_msg WHERE org_id = 100`)
+	assertCount(t, db, runs, `SELECT count(*) FROM flows_flowrun WHERE org_id = 100`)
+
+	// and a finished backfill has nothing left to do
+	report, err = newBackfiller(config, db, s3Client).run(ctx, []Org{*org})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, report.Built)
+	assert.Equal(t, 2, report.Done)
+}
@@ -0,0 +1,161 @@
+package archives
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	bandwidthLimit      = newGauge("archiver_s3_bandwidth_limit_bytes_per_second", "The configured cap on S3 transfers, 0 if unlimited.", "direction")
+	bandwidthThroughput = newGauge("archiver_s3_throughput_bytes_per_second", "The throughput of S3 transfers over the last second they were active.", "direction")
+	bandwidthBytes      = newCounter("archiver_s3_transferred_bytes_total", "Number of bytes transferred to or from S3.", "direction")
+)
+
+// the largest read we let through at once, so that a single read never holds a big share of our tokens
+const maxLimitedRead = 32 * 1024
+
+// rateLimiter is a token bucket limiting the rate of bytes transferred in one direction, it is shared by all transfers
+// in that direction so that together they respect our cap
+type rateLimiter struct {
+	direction string
+
+	mutex  sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+
+	windowStart time.Time
+	windowBytes int
+}
+
+func newRateLimiter(direction string) *rateLimiter {
+	return &rateLimiter{direction: direction}
+}
+
+// our limiters for uploads and downloads, unlimited until configured
+var (
+	uploadLimiter   = newRateLimiter("upload")
+	downloadLimiter = newRateLimiter("download")
+)
+
+// ConfigureBandwidth sets our upload and download limits from the passed in config
+func ConfigureBandwidth(config *Config) {
+	uploadLimiter.setRate(config.MaxUploadBytesPerSec)
+	downloadLimiter.setRate(config.MaxDownloadBytesPerSec)
+}
+
+// setRate sets the number of bytes per second we allow, 0 for unlimited, a full second's worth is available at once
+func (l *rateLimiter) setRate(bytesPerSec int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.rate = float64(bytesPerSec)
+	l.tokens = l.rate
+	l.last = time.Now()
+	bandwidthLimit.set(l.rate, l.direction)
+}
+
+// wait blocks until the passed in number of bytes may be transferred or our context is done
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mutex.Lock()
+	l.record(n)
+
+	if l.rate <= 0 {
+		l.mutex.Unlock()
+		return nil
+	}
+
+	// refill our bucket for the time that has passed, up to a second's worth
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+
+	// take our tokens, going into debt if there aren't enough which we wait out
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mutex.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// record counts the passed in bytes in our metrics, updating our throughput once a second, must be called with our
+// lock held
+func (l *rateLimiter) record(n int) {
+	bandwidthBytes.add(float64(n), l.direction)
+
+	now := time.Now()
+	if now.Sub(l.windowStart) > time.Second*5 {
+		// we've been idle, start a new window
+		l.windowStart = now
+		l.windowBytes = 0
+	}
+
+	l.windowBytes += n
+	if elapsed := now.Sub(l.windowStart); elapsed >= time.Second {
+		bandwidthThroughput.set(float64(l.windowBytes)/elapsed.Seconds(), l.direction)
+		l.windowStart = now
+		l.windowBytes = 0
+	}
+}
+
+// limitedReader limits the rate reads are made from a reader, seeking through to it if it can seek
+type limitedReader struct {
+	ctx     context.Context
+	reader  io.Reader
+	limiter *rateLimiter
+}
+
+// limitReader returns a reader which reads from the passed in reader no faster than the passed in limiter allows
+func limitReader(ctx context.Context, reader io.Reader, limiter *rateLimiter) *limitedReader {
+	return &limitedReader{ctx: ctx, reader: reader, limiter: limiter}
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > maxLimitedRead {
+		p = p[:maxLimitedRead]
+	}
+
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.wait(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+func (r *limitedReader) Seek(offset int64, whence int) (int64, error) {
+	seeker, ok := r.reader.(io.Seeker)
+	if !ok {
+		return 0, fmt.Errorf("limited reader can't seek")
+	}
+	return seeker.Seek(offset, whence)
+}
+
+// limitedReadCloser is a limited reader which closes the reader it wraps
+type limitedReadCloser struct {
+	*limitedReader
+	closer io.Closer
+}
+
+func (r *limitedReadCloser) Close() error {
+	return r.closer.Close()
+}
@@ -0,0 +1,58 @@
+package archives
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("a"), 150*1024)
+
+	// unlimited reads aren't delayed
+	limiter := newRateLimiter("test")
+	start := time.Now()
+	read, err := ioutil.ReadAll(limitReader(ctx, bytes.NewReader(data), limiter))
+	assert.NoError(t, err)
+	assert.Equal(t, data, read)
+	assert.True(t, time.Since(start) < time.Millisecond*100)
+
+	// with a cap of 100KB/s, our first second's worth is read at once and the rest waited for
+	limiter.setRate(100 * 1024)
+	start = time.Now()
+	read, err = ioutil.ReadAll(limitReader(ctx, bytes.NewReader(data), limiter))
+	assert.NoError(t, err)
+	assert.Equal(t, data, read)
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= time.Millisecond*450, "read too fast: %s", elapsed)
+	assert.True(t, elapsed < time.Millisecond*900, "read too slow: %s", elapsed)
+
+	// our bucket is now empty, cancelling our context stops us waiting for tokens
+	ctx, cancel := context.WithTimeout(ctx, time.Millisecond*50)
+	defer cancel()
+	start = time.Now()
+	_, err = ioutil.ReadAll(limitReader(ctx, bytes.NewReader(data), limiter))
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < time.Millisecond*300)
+
+	// limited readers can seek if what they wrap can
+	reader := limitReader(context.Background(), bytes.NewReader([]byte("hello world")), newRateLimiter("test"))
+	_, err = reader.Seek(6, io.SeekStart)
+	assert.NoError(t, err)
+	read, err = ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "world", string(read))
+
+	_, err = limitReader(ctx, &bytes.Buffer{}, limiter).Seek(0, io.SeekStart)
+	assert.EqualError(t, err, "limited reader can't seek")
+
+	output := &bytes.Buffer{}
+	assert.NoError(t, WriteMetrics(output))
+	assert.Contains(t, output.String(), `archiver_s3_bandwidth_limit_bytes_per_second{direction="test"} 102400`)
+}
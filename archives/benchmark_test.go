@@ -0,0 +1,112 @@
+//go:build benchmark
+// +build benchmark
+
+package archives
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/nyaruka/rp-archiver/testgen"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// run with: go test -tags benchmark -run XXX -bench . ./archives
+
+func benchmarkArchiveOrg(b *testing.B, archiveType ArchiveType) {
+	ctx := context.Background()
+	now := time.Date(2017, 10, 15, 0, 0, 0, 0, time.UTC)
+	spec := testgen.DefaultSpec()
+
+	config := NewConfig()
+	config.Delete = true
+
+	records := 0
+	var elapsed time.Duration
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		db := setup(b)
+		logrus.SetLevel(logrus.WarnLevel)
+
+		_, err := testgen.Populate(ctx, db, spec)
+		assert.NoError(b, err)
+
+		orgs, err := GetActiveOrgs(ctx, db, config)
+		assert.NoError(b, err)
+		org := orgs[len(orgs)-1]
+		assert.Equal(b, spec.OrgID, org.ID)
+
+		b.StartTimer()
+		start := time.Now()
+
+		created, deleted, err := ArchiveOrg(ctx, now, config, db, newMockS3Client(), org, archiveType)
+		assert.NoError(b, err)
+		assert.Equal(b, len(created), len(deleted))
+
+		elapsed += time.Since(start)
+		for _, a := range created {
+			records += a.RecordCount
+		}
+	}
+
+	b.ReportMetric(float64(records)/elapsed.Seconds(), "rows/sec")
+}
+
+func BenchmarkArchiveMessages(b *testing.B) {
+	benchmarkArchiveOrg(b, MessageType)
+}
+
+func BenchmarkArchiveRuns(b *testing.B) {
+	benchmarkArchiveOrg(b, RunType)
+}
+
+// an org with fifteen years of dailies and monthlies
+func setupLargeArchives(b *testing.B) (*sqlx.DB, Org) {
+	ctx := context.Background()
+	db := setup(b)
+	logrus.SetLevel(logrus.WarnLevel)
+
+	org := Org{ID: testgen.DefaultSpec().OrgID}
+	_, err := testgen.PopulateArchives(ctx, db, org.ID, string(MessageType), time.Date(2003, 1, 1, 0, 0, 0, 0, time.UTC), 365*15)
+	assert.NoError(b, err)
+	return db, org
+}
+
+func BenchmarkGetCurrentArchives(b *testing.B) {
+	ctx := context.Background()
+	db, org := setupLargeArchives(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		archives, err := GetCurrentArchives(ctx, db, org, MessageType)
+		assert.NoError(b, err)
+
+		records := 0
+		for _, a := range archives {
+			records += a.RecordCount
+		}
+		assert.NotZero(b, records)
+	}
+}
+
+func BenchmarkForEachCurrentArchive(b *testing.B) {
+	ctx := context.Background()
+	db, org := setupLargeArchives(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		records := 0
+		err := ForEachCurrentArchive(ctx, db, org, MessageType, func(a *Archive) error {
+			records += a.RecordCount
+			return nil
+		})
+		assert.NoError(b, err)
+		assert.NotZero(b, records)
+	}
+}
@@ -0,0 +1,297 @@
+package archives
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// broadcasts are written in order of created_on, ties broken by id, with the contacts, groups and URNs they were sent
+// to. Contacts of anon orgs have no names and their URNs are left out.
+const lookupBroadcasts = `
+SELECT rec.id, row_to_json(rec) FROM (
+	SELECT
+	  mb.id,
+	  hstore_to_json(mb.text) as translations,
+	  mb.schedule_id IS NOT NULL as scheduled,
+	  (
+		SELECT coalesce(jsonb_agg(CASE WHEN $1 THEN jsonb_build_object('uuid', cc.uuid) ELSE jsonb_build_object('uuid', cc.uuid, 'name', cc.name) END ORDER BY cc.id), '[]'::jsonb)
+		FROM msgs_broadcast_contacts bc JOIN contacts_contact cc ON cc.id = bc.contact_id
+		WHERE bc.broadcast_id = mb.id
+	  ) as contacts,
+	  (
+		SELECT coalesce(jsonb_agg(jsonb_build_object('uuid', cg.uuid, 'name', cg.name) ORDER BY cg.id), '[]'::jsonb)
+		FROM msgs_broadcast_groups bg JOIN contacts_contactgroup cg ON cg.id = bg.group_id
+		WHERE bg.broadcast_id = mb.id
+	  ) as groups,
+	  (
+		SELECT coalesce(jsonb_agg(cu.identity ORDER BY cu.id), '[]'::jsonb)
+		FROM msgs_broadcast_urns bu JOIN contacts_contacturn cu ON cu.id = bu.contacturn_id
+		WHERE bu.broadcast_id = mb.id AND NOT $1
+	  ) as urns,
+	  mb.created_on
+	FROM msgs_broadcast mb
+	WHERE mb.org_id = $2 AND mb.created_on >= $3 AND mb.created_on < $4 AND ($5 = 0 OR mb.id IN (
+		SELECT bc.broadcast_id FROM msgs_broadcast_contacts bc JOIN contacts_contactgroup_contacts gc ON gc.contact_id = bc.contact_id WHERE gc.contactgroup_id = $5
+	))
+	) rec
+ORDER BY rec.created_on ASC, rec.id ASC;
+`
+
+const lookupEarliestBroadcast = `
+SELECT MIN(created_on) FROM msgs_broadcast WHERE org_id = $1 AND created_on < $2
+`
+
+const countBroadcastsInRange = `
+SELECT count(*) FROM msgs_broadcast mb WHERE mb.org_id = $1 AND mb.created_on >= $2 AND mb.created_on < $3
+`
+
+// scheduled broadcasts are never deleted so aren't left behind
+const countBroadcastsLeftBehind = `
+SELECT count(*) FROM msgs_broadcast mb WHERE mb.org_id = $1 AND mb.created_on >= $2 AND mb.created_on < $3 AND mb.schedule_id IS NULL
+`
+
+// writeBroadcastRecords writes the broadcasts created in the archive's date range to the passed in writer
+func writeBroadcastRecords(ctx context.Context, db *sqlx.DB, config *Config, archive *Archive, writer *bufio.Writer) (int, error) {
+	rows, err := db.QueryxContext(ctx, lookupBroadcasts, archive.Org.IsAnon, archive.Org.ID, archive.StartDate, archive.EndDate(), config.ContactGroupID)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error querying broadcasts for org: %d", archive.Org.ID)
+	}
+	defer rows.Close()
+
+	recordCount := 0
+	var record string
+	var broadcastID int64
+	for rows.Next() {
+		err = rows.Scan(&broadcastID, &record)
+		if err != nil {
+			return 0, errors.Wrapf(err, "error scanning broadcast row for org: %d", archive.Org.ID)
+		}
+
+		if config.CanonicalJSON {
+			record, err = canonicalizeRecord(record)
+			if err != nil {
+				return 0, errors.Wrapf(err, "error canonicalizing broadcast: %d", broadcastID)
+			}
+		}
+
+		writer.WriteString(record)
+		writer.WriteString("\n")
+		recordCount++
+	}
+
+	// a dropped connection ends our iteration early, make sure we never treat that as a complete archive
+	err = rows.Err()
+	if err != nil {
+		return 0, errors.Wrapf(err, "error reading broadcast rows for org: %d", archive.Org.ID)
+	}
+
+	logrus.WithField("record_count", recordCount).Debug("Done Writing")
+	return recordCount, nil
+}
+
+const selectOrgBroadcastsInRange = `
+SELECT mb.id, mb.schedule_id IS NOT NULL AS scheduled, EXISTS(SELECT 1 FROM msgs_msg mm WHERE mm.broadcast_id = mb.id) AS has_msgs
+FROM msgs_broadcast mb
+WHERE mb.org_id = $1 AND mb.created_on >= $2 AND mb.created_on < $3
+ORDER BY mb.created_on ASC, mb.id ASC
+`
+
+const selectDeletableBroadcasts = `
+SELECT mb.id, mb.schedule_id IS NOT NULL AS scheduled, EXISTS(SELECT 1 FROM msgs_msg mm WHERE mm.broadcast_id = mb.id) AS has_msgs
+FROM msgs_broadcast mb
+WHERE mb.id IN(?)
+`
+
+// DeleteArchivedBroadcasts takes the passed in archive, verifies the S3 file is still present (and correct), then
+// selects all the broadcasts in the archive date range, and if equal or fewer than the number archived, deletes those
+// which aren't scheduled and whose messages have all been archived and deleted. Until the messages of a broadcast
+// are gone, the archive is left needing deletion so that we try again next time.
+//
+// Upon completion it updates the needs_deletion flag on the archive
+func DeleteArchivedBroadcasts(ctx context.Context, config *Config, db *sqlx.DB, s3Client Storage, archive *Archive) error {
+	outer, cancel := context.WithTimeout(ctx, time.Hour*3)
+	defer cancel()
+
+	start := time.Now()
+	log := logrus.WithFields(logrus.Fields{
+		"id":           archive.ID,
+		"org_id":       archive.OrgID,
+		"start_date":   archive.StartDate,
+		"end_date":     archive.EndDate(),
+		"archive_type": archive.ArchiveType,
+		"total_count":  archive.RecordCount,
+	})
+	log.Info("deleting broadcasts")
+
+	// first things first, make sure our file is present on S3 and matches what we archived, we never delete
+	// records that aren't backed by a valid archive
+	err := verifyArchive(outer, s3Client, archive)
+	if err != nil {
+		return errors.Wrap(err, "refusing to delete, archive not verified")
+	}
+
+	// ok, archive file looks good, in strict mode we delete exactly the broadcasts in it, otherwise those in its period
+	waiting := 0
+	if config.DeleteByArchiveContents {
+		err = deleteArchiveContents(outer, config, db, s3Client, archive, func(ctx context.Context, db *sqlx.DB, idBatch []int64) error {
+			deletable, _, withMsgs, err := deletableBroadcasts(ctx, db, idBatch)
+			if err != nil {
+				return err
+			}
+			waiting += withMsgs
+			return deleteBroadcastBatch(ctx, db, deletable)
+		})
+	} else {
+		waiting, err = deleteBroadcastsInPeriod(outer, db, archive, log)
+	}
+	if err != nil {
+		return err
+	}
+
+	if waiting > 0 {
+		return fmt.Errorf("%d broadcasts in archive still have messages, waiting for them to be archived", waiting)
+	}
+
+	outer, cancel = context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	deletedOn := time.Now()
+
+	// all went well! mark our archive as no longer needing deletion
+	_, err = db.ExecContext(outer, setArchiveDeleted, archive.ID, deletedOn)
+	if err != nil {
+		return errors.Wrap(err, "error setting archive as deleted")
+	}
+	archive.NeedsDeletion = false
+	archive.DeletedOn = &deletedOn
+
+	logrus.WithField("elapsed", time.Since(start)).Info("completed deleting broadcasts")
+
+	return nil
+}
+
+// deleteBroadcastsInPeriod deletes the broadcasts in the period of the passed in archive which can be deleted, if there
+// are no more of them than the archive has, returning how many are still waiting on their messages
+func deleteBroadcastsInPeriod(ctx context.Context, db *sqlx.DB, archive *Archive, log *logrus.Entry) (int, error) {
+	rows, err := db.QueryxContext(ctx, selectOrgBroadcastsInRange, archive.OrgID, archive.StartDate, archive.EndDate())
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	broadcastIDs, found, waiting, err := scanDeletableBroadcasts(rows)
+	if err != nil {
+		return 0, err
+	}
+	rows.Close()
+
+	log.WithField("broadcast_count", found).WithField("deletable_count", len(broadcastIDs)).Debug("found broadcasts")
+
+	// verify we don't see more broadcasts than there are in our archive (fewer is ok)
+	if found > archive.RecordCount {
+		return 0, fmt.Errorf("more broadcasts in the database: %d than in archive: %d", found, archive.RecordCount)
+	}
+
+	// ok, delete our broadcasts in batches
+	for _, idBatch := range chunkIDs(broadcastIDs, deleteTransactionSize) {
+		err = deleteBroadcastBatch(ctx, db, idBatch)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return waiting, nil
+}
+
+// deletableBroadcasts returns which of the passed in broadcasts can be deleted, how many we found, and how many can't
+// be deleted yet as they still have messages
+func deletableBroadcasts(ctx context.Context, db *sqlx.DB, ids []int64) ([]int64, int, int, error) {
+	q, vs, err := sqlx.In(selectDeletableBroadcasts, ids)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	rows, err := db.QueryxContext(ctx, db.Rebind(q), vs...)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer rows.Close()
+
+	return scanDeletableBroadcasts(rows)
+}
+
+// scanDeletableBroadcasts reads the ids of the broadcasts which can be deleted from the passed in rows, along with how
+// many rows there were. Scheduled broadcasts are still in use so are never deleted, and those with messages are
+// counted as waiting.
+func scanDeletableBroadcasts(rows *sqlx.Rows) ([]int64, int, int, error) {
+	var broadcastID int64
+	var scheduled, hasMsgs bool
+	deletable := make([]int64, 0)
+	found, waiting := 0, 0
+	for rows.Next() {
+		err := rows.Scan(&broadcastID, &scheduled, &hasMsgs)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		found++
+
+		if scheduled {
+			continue
+		}
+		if hasMsgs {
+			logrus.WithField("broadcast_id", broadcastID).Warn("unable to delete broadcast, has messages still")
+			waiting++
+			continue
+		}
+		deletable = append(deletable, broadcastID)
+	}
+	return deletable, found, waiting, rows.Err()
+}
+
+// the tables which refer to broadcasts, rows in these are deleted along with them
+var broadcastRelatedTables = []string{"msgs_broadcast_contacts", "msgs_broadcast_groups", "msgs_broadcast_urns", "msgs_broadcastmsgcount"}
+
+// deleteBroadcastBatch deletes the passed in broadcasts along with their contacts, groups, URNs and counts
+func deleteBroadcastBatch(ctx context.Context, db *sqlx.DB, idBatch []int64) error {
+	if len(idBatch) == 0 {
+		return nil
+	}
+
+	// no single batch should take more than a few minutes
+	ctx, cancel := context.WithTimeout(ctx, time.Minute*15)
+	defer cancel()
+
+	start := time.Now()
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range broadcastRelatedTables {
+		if !tableExists(table) {
+			continue
+		}
+		err = executeInQuery(ctx, tx, fmt.Sprintf(`DELETE FROM %s WHERE broadcast_id IN(?)`, table), idBatch)
+		if err != nil {
+			return errors.Wrapf(err, "error deleting from %s", table)
+		}
+	}
+
+	err = executeInQuery(ctx, tx, `DELETE FROM msgs_broadcast WHERE id IN(?)`, idBatch)
+	if err != nil {
+		return errors.Wrap(err, "error deleting broadcasts")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "error committing broadcast delete transaction")
+	}
+
+	logrus.WithField("elapsed", time.Since(start)).WithField("count", len(idBatch)).Debug("deleted batch of broadcasts")
+	return nil
+}
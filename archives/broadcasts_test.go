@@ -0,0 +1,94 @@
+package archives
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchiveBroadcasts(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+
+	config := NewConfig()
+	config.TempDir = t.TempDir()
+	config.ArchiveBroadcasts = true
+	config.KeepFiles = true
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	created, err := GetMissingDailyArchives(ctx, db, now, orgs[1], BroadcastType)
+	assert.NoError(t, err)
+	assert.Equal(t, 62, len(created))
+	assert.NoError(t, createArchives(ctx, db, config, s3Client, orgs[1], created))
+
+	// broadcasts are archived by the day they were created, with who they were sent to
+	aug12 := created[2]
+	assert.Equal(t, time.Date(2017, 8, 12, 0, 0, 0, 0, time.UTC), aug12.StartDate)
+	assert.Equal(t, 3, aug12.RecordCount)
+
+	file, err := os.Open(aug12.ArchiveFile)
+	assert.NoError(t, err)
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	assert.NoError(t, err)
+
+	broadcasts := make([]map[string]interface{}, 0)
+	decoder := json.NewDecoder(reader)
+	for decoder.More() {
+		broadcast := make(map[string]interface{})
+		assert.NoError(t, decoder.Decode(&broadcast))
+		delete(broadcast, "created_on")
+		broadcasts = append(broadcasts, broadcast)
+	}
+	assert.Equal(t, 3, len(broadcasts))
+	assert.Equal(t, float64(3), broadcasts[0]["id"])
+	assert.Equal(t, true, broadcasts[1]["scheduled"])
+	assert.Equal(t, map[string]interface{}{
+		"id":           float64(2),
+		"translations": map[string]interface{}{"base": "hola"},
+		"scheduled":    false,
+		"contacts": []interface{}{
+			map[string]interface{}{"uuid": "3e814add-e614-41f7-8b5d-a07f670a698f", "name": "Ajodinabiff Dane"},
+			map[string]interface{}{"uuid": "b46f6e18-95b4-4984-9926-dded047f4eb3", "name": nil},
+		},
+		"groups": []interface{}{map[string]interface{}{"uuid": "4c016340-468d-4675-a974-15cb7a45a5ab", "name": "Group 2"}},
+		"urns":   []interface{}{"tel:+12067797777"},
+	}, broadcasts[2])
+
+	// a broadcast whose messages haven't been archived yet holds up its archive, the rest are deleted
+	err = DeleteArchivedBroadcasts(ctx, config, db, s3Client, aug12)
+	assert.EqualError(t, err, "1 broadcasts in archive still have messages, waiting for them to be archived")
+	assertCount(t, db, 2, `SELECT count(*) FROM msgs_broadcast WHERE id IN (1, 2)`)
+	assertCount(t, db, 0, `SELECT count(*) FROM msgs_broadcast WHERE id = 3`)
+	assertCount(t, db, 1, `SELECT count(*) FROM archives_archive WHERE id = $1 AND needs_deletion = TRUE`, aug12.ID)
+
+	// once they have been, it is deleted along with who it was sent to, scheduled broadcasts are never deleted
+	_, err = db.Exec(`UPDATE msgs_msg SET broadcast_id = NULL WHERE broadcast_id = 2`)
+	assert.NoError(t, err)
+
+	err = DeleteArchivedBroadcasts(ctx, config, db, s3Client, aug12)
+	assert.NoError(t, err)
+	assertCount(t, db, 1, `SELECT count(*) FROM msgs_broadcast WHERE org_id = 2 AND created_on < '2018-01-01'`)
+	assertCount(t, db, 0, `SELECT count(*) FROM msgs_broadcast_contacts WHERE broadcast_id = 2`)
+	assertCount(t, db, 0, `SELECT count(*) FROM msgs_broadcast_groups WHERE broadcast_id = 2`)
+	assertCount(t, db, 0, `SELECT count(*) FROM msgs_broadcast_urns WHERE broadcast_id = 2`)
+	assertCount(t, db, 1, `SELECT count(*) FROM archives_archive WHERE id = $1 AND needs_deletion = FALSE AND deleted_on IS NOT NULL`, aug12.ID)
+	assert.False(t, aug12.NeedsDeletion)
+}
+
+func TestScrubBroadcastRecord(t *testing.T) {
+	raw := `{"id":2,"contacts":[{"uuid":"3e814add","name":"Dane"}],"groups":[{"uuid":"4c016340","name":"Group 2"}],"urns":["tel:+1"]}`
+
+	scrubbed, changed, err := scrubRecord(BroadcastType, json.RawMessage(raw))
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, `{"contacts":[{"uuid":"3e814add"}],"groups":[{"name":"Group 2","uuid":"4c016340"}],"id":2,"urns":[]}`, string(scrubbed))
+}
@@ -0,0 +1,159 @@
+package archives
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// RenditionBrotli is the format of the brotli compressed copies of archives we publish for web delivery
+const RenditionBrotli = "brotli"
+
+// Rendition is a copy of an archive in another format, published alongside it. The archive itself is always what we
+// record in archives_archive, verify and delete records against.
+type Rendition struct {
+	ArchiveID int    `db:"archive_id"`
+	Format    string `db:"format"`
+	Size      int64  `db:"size"`
+	Hash      string `db:"hash"`
+	URL       string `db:"url"`
+}
+
+const upsertArchiveRendition = `
+INSERT INTO archiver_archive_renditions(archive_id, format, size, hash, url)
+VALUES(:archive_id, :format, :size, :hash, :url)
+ON CONFLICT (archive_id, format) DO UPDATE
+SET size = EXCLUDED.size, hash = EXCLUDED.hash, url = EXCLUDED.url
+`
+
+const deleteArchiveRenditions = `
+DELETE FROM archiver_archive_renditions WHERE archive_id = $1
+`
+
+// brotliS3Key returns the key the brotli rendition of the passed in archive is uploaded to, next to the archive itself
+func brotliS3Key(archive *Archive) string {
+	return strings.TrimSuffix(archiveS3Key(archive), ".jsonl.gz") + ".jsonl.br"
+}
+
+// UploadBrotliRendition transcodes the local file of the passed in archive to brotli and uploads it next to the
+// archive, returning the rendition uploaded. The archive must still have its local file.
+func UploadBrotliRendition(ctx context.Context, s3Client Storage, bucket string, archive *Archive) (*Rendition, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute*15)
+	defer cancel()
+
+	if archive.ArchiveFile == "" {
+		return nil, fmt.Errorf("archive has no local file to transcode")
+	}
+
+	filename := archive.ArchiveFile + ".br"
+	size, hash, err := transcodeToBrotli(archive.ArchiveFile, filename)
+	defer os.Remove(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error transcoding archive to brotli")
+	}
+
+	// we only ever need a single part for a copy of an archive meant for browsers
+	if size > 5e9 {
+		return nil, fmt.Errorf("brotli rendition of %d bytes too big to upload", size)
+	}
+
+	key := brotliS3Key(archive)
+
+	var url string
+	err = uploadThrottler.do(ctx, func() error {
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		url, err = s3Client.Upload(ctx, bucket, key, f, size, "br", hash)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error uploading brotli rendition to S3")
+	}
+
+	markWritten(url)
+
+	return &Rendition{ArchiveID: archive.ID, Format: RenditionBrotli, Size: size, Hash: hash, URL: url}, nil
+}
+
+// transcodeToBrotli decompresses the passed in gzipped file and writes it brotli compressed to the passed in path,
+// returning its size and hex encoded MD5 hash
+func transcodeToBrotli(gzipped string, path string) (int64, string, error) {
+	in, err := os.Open(gzipped)
+	if err != nil {
+		return 0, "", err
+	}
+	defer in.Close()
+
+	reader, err := gzip.NewReader(in)
+	if err != nil {
+		return 0, "", err
+	}
+	defer reader.Close()
+
+	out, err := os.Create(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer out.Close()
+
+	hash := md5.New()
+	writer := brotli.NewWriterLevel(io.MultiWriter(out, hash), brotli.DefaultCompression)
+
+	_, err = io.Copy(writer, reader)
+	if err != nil {
+		return 0, "", err
+	}
+	err = writer.Close()
+	if err != nil {
+		return 0, "", err
+	}
+
+	stat, err := out.Stat()
+	if err != nil {
+		return 0, "", err
+	}
+	return stat.Size(), hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// publishRenditions uploads the renditions of the passed in archive we publish and records them, logging rather than
+// returning any errors as our archive is complete without them. Must be called once the archive is written to the
+// database and before its local file is deleted.
+func publishRenditions(ctx context.Context, config *Config, db *sqlx.DB, s3Client Storage, archive *Archive) {
+	if !config.PublishBrotli || !config.UploadToS3 {
+		return
+	}
+
+	log := logrus.WithField("archive_id", archive.ID).WithField("format", RenditionBrotli)
+
+	rendition, err := UploadBrotliRendition(ctx, s3Client, config.StorageBucket(), archive)
+	if err != nil {
+		log.WithError(err).Error("error publishing archive rendition")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	_, err = db.NamedExecContext(ctx, upsertArchiveRendition, rendition)
+	if err != nil {
+		log.WithError(err).Error("error recording archive rendition")
+		return
+	}
+
+	log.WithField("url", rendition.URL).WithField("size", rendition.Size).Debug("published archive rendition")
+}
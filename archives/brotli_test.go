@@ -0,0 +1,117 @@
+package archives
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadBrotliRendition(t *testing.T) {
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+
+	dir, err := ioutil.TempDir("", "brotli")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	records := []byte("{\"id\":1,\"text\":\"hello\"}\n{\"id\":2,\"text\":\"world\"}\n")
+	gzipped := &bytes.Buffer{}
+	writer := gzip.NewWriter(gzipped)
+	writer.Write(records)
+	writer.Close()
+
+	filename := filepath.Join(dir, "message_D20170812.jsonl.gz")
+	assert.NoError(t, ioutil.WriteFile(filename, gzipped.Bytes(), 0600))
+	hash := md5.Sum(gzipped.Bytes())
+
+	archive := &Archive{
+		ID:          5,
+		Org:         Org{ID: 2},
+		ArchiveType: MessageType,
+		Period:      DayPeriod,
+		StartDate:   time.Date(2017, 8, 12, 0, 0, 0, 0, time.UTC),
+		ArchiveFile: filename,
+		Size:        int64(gzipped.Len()),
+		Hash:        hex.EncodeToString(hash[:]),
+	}
+
+	assert.NoError(t, UploadArchive(ctx, NewConfig(), s3Client, "dl-archiver-test", archive))
+
+	rendition, err := UploadBrotliRendition(ctx, s3Client, "dl-archiver-test", archive)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, rendition.ArchiveID)
+	assert.Equal(t, RenditionBrotli, rendition.Format)
+	assert.Equal(t, "https://dl-archiver-test.s3.amazonaws.com/2/message_D20170812_"+archive.Hash+".jsonl.br", rendition.URL)
+
+	// both objects are uploaded with their encodings
+	canonical := s3Client.objects["dl-archiver-test:/2/message_D20170812_"+archive.Hash+".jsonl.gz"]
+	assert.Equal(t, "application/json", canonical.contentType)
+	assert.Equal(t, "gzip", canonical.contentEncoding)
+
+	copied := s3Client.objects["dl-archiver-test:/2/message_D20170812_"+archive.Hash+".jsonl.br"]
+	assert.Equal(t, "application/json", copied.contentType)
+	assert.Equal(t, "br", copied.contentEncoding)
+	assert.Equal(t, rendition.Size, int64(len(copied.body)))
+	copiedHash := md5.Sum(copied.body)
+	assert.Equal(t, rendition.Hash, hex.EncodeToString(copiedHash[:]))
+
+	decoded, err := ioutil.ReadAll(brotli.NewReader(bytes.NewReader(copied.body)))
+	assert.NoError(t, err)
+	assert.Equal(t, records, decoded)
+
+	// the archive itself is untouched and our transcoded file is cleaned up
+	assert.Equal(t, "https://dl-archiver-test.s3.amazonaws.com/2/message_D20170812_"+archive.Hash+".jsonl.gz", archive.URL)
+	_, err = os.Stat(filename + ".br")
+	assert.True(t, os.IsNotExist(err))
+
+	// a file which isn't gzipped can't be transcoded
+	assert.NoError(t, ioutil.WriteFile(filename, records, 0600))
+	_, err = UploadBrotliRendition(ctx, s3Client, "dl-archiver-test", archive)
+	assert.Error(t, err)
+
+	archive.ArchiveFile = ""
+	_, err = UploadBrotliRendition(ctx, s3Client, "dl-archiver-test", archive)
+	assert.EqualError(t, err, "archive has no local file to transcode")
+}
+
+func TestPublishBrotli(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+
+	config := NewConfig()
+	config.UploadToS3 = true
+	config.PublishBrotli = true
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	created, err := CreateOrgArchives(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 61, len(created))
+	assertCount(t, db, 61, `SELECT count(*) FROM archiver_archive_renditions WHERE format = 'brotli' AND url LIKE '%.jsonl.br'`)
+
+	// renditions are recorded apart from their archives
+	assertCount(t, db, 0, `SELECT count(*) FROM archives_archive WHERE url LIKE '%.jsonl.br'`)
+	assert.NotNil(t, s3Client.objects["dl-archiver-test:"+brotliS3Key(created[0])])
+
+	// monthlies get them too
+	monthlies, err := RollupOrgArchives(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(monthlies))
+	assertCount(t, db, 63, `SELECT count(*) FROM archiver_archive_renditions WHERE format = 'brotli'`)
+
+	// an archive we can't transcode is still complete without its rendition
+	publishRenditions(ctx, config, db, s3Client, &Archive{ID: created[0].ID, Org: orgs[1]})
+	assertCount(t, db, 1, `SELECT count(*) FROM archiver_archive_renditions WHERE archive_id = $1`, created[0].ID)
+}
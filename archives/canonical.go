@@ -0,0 +1,39 @@
+package archives
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// canonicalizeRecord re-encodes the passed in JSON record in our canonical form: no whitespace, the keys of every
+// object sorted by their UTF-8 bytes, numbers exactly as written and strings escaped as Go does but without escaping
+// HTML. Another tool following the same rules reproduces the exact bytes of our archives, and so their hashes, without
+// needing to match the key order of postgres.
+func canonicalizeRecord(record string) (string, error) {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(record)))
+	decoder.UseNumber()
+
+	var value interface{}
+	err := decoder.Decode(&value)
+	if err != nil {
+		return "", errors.Wrap(err, "error decoding record")
+	}
+	if decoder.More() {
+		return "", errors.New("error decoding record: unexpected data after record")
+	}
+
+	// maps are always encoded with their keys sorted
+	canonical := &bytes.Buffer{}
+	encoder := json.NewEncoder(canonical)
+	encoder.SetEscapeHTML(false)
+	err = encoder.Encode(value)
+	if err != nil {
+		return "", errors.Wrap(err, "error encoding record")
+	}
+
+	// our encoder ends what it writes with a newline which we don't want
+	canonical.Truncate(canonical.Len() - 1)
+	return canonical.String(), nil
+}
@@ -0,0 +1,48 @@
+package archives
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanonicalizeRecord(t *testing.T) {
+	tcs := []struct {
+		Record    string
+		Canonical string
+	}{
+		{
+			`{"id":1}`,
+			`{"id":1}`,
+		},
+		{
+			`{"id": 2, "contact": {"uuid": "3e814add", "name": "Ajodinabiff"}, "broadcast": null, "attachments": [], "labels": [{"uuid": "1d9e3188", "name": "Spam"}]}`,
+			`{"attachments":[],"broadcast":null,"contact":{"name":"Ajodinabiff","uuid":"3e814add"},"id":2,"labels":[{"name":"Spam","uuid":"1d9e3188"}]}`,
+		},
+		{
+			`{"size":12345678901234567890,"ratio":1.50,"small":1e-7}`,
+			`{"ratio":1.50,"size":12345678901234567890,"small":1e-7}`,
+		},
+		{
+			`{"text":"<b>hi</b> & é\n","b":"é","a<b":true}`,
+			`{"a<b":true,"b":"é","text":"<b>hi</b> & é\n"}`,
+		},
+	}
+
+	for _, tc := range tcs {
+		canonical, err := canonicalizeRecord(tc.Record)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.Canonical, canonical)
+
+		// canonicalizing is idempotent
+		again, err := canonicalizeRecord(canonical)
+		assert.NoError(t, err)
+		assert.Equal(t, canonical, again)
+	}
+
+	_, err := canonicalizeRecord(`{"id":1,`)
+	assert.Error(t, err)
+
+	_, err = canonicalizeRecord(`{"id":1}{"id":2}`)
+	assert.EqualError(t, err, "error decoding record: unexpected data after record")
+}
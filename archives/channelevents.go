@@ -0,0 +1,213 @@
+package archives
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// channel events are written in order of created_on, ties broken by id, with the channel, contact and URN they were
+// for. Contacts of anon orgs have no names and their URNs are left out.
+const lookupChannelEvents = `
+SELECT rec.id, row_to_json(rec) FROM (
+	SELECT
+	  ce.id,
+	  ce.event_type as type,
+	  row_to_json(channel) as channel,
+	  CASE WHEN $1 THEN row_to_json(anon_contact) ELSE row_to_json(contact) END as contact,
+	  CASE WHEN $1 THEN NULL ELSE ccu.identity END as urn,
+	  coalesce(ce.extra::jsonb, '{}'::jsonb) as extra,
+	  ce.occurred_on,
+	  ce.created_on
+	FROM channels_channelevent ce
+	  JOIN LATERAL (SELECT uuid, name FROM channels_channel ch WHERE ch.id = ce.channel_id) AS channel ON True
+	  JOIN LATERAL (SELECT uuid, name FROM contacts_contact cc WHERE cc.id = ce.contact_id) AS contact ON True
+	  JOIN LATERAL (SELECT uuid FROM contacts_contact cc WHERE cc.id = ce.contact_id) AS anon_contact ON True
+	  LEFT JOIN contacts_contacturn ccu ON ccu.id = ce.contact_urn_id
+	WHERE ce.org_id = $2 AND ce.created_on >= $3 AND ce.created_on < $4 AND ($5 = 0 OR ce.contact_id IN (SELECT contact_id FROM contacts_contactgroup_contacts WHERE contactgroup_id = $5))
+	) rec
+ORDER BY rec.created_on ASC, rec.id ASC;
+`
+
+const lookupEarliestChannelEvent = `
+SELECT MIN(created_on) FROM channels_channelevent WHERE org_id = $1 AND created_on < $2
+`
+
+const countChannelEventsInRange = `
+SELECT count(*) FROM channels_channelevent ce WHERE ce.org_id = $1 AND ce.created_on >= $2 AND ce.created_on < $3
+`
+
+// writeChannelEventRecords writes the channel events created in the archive's date range to the passed in writer
+func writeChannelEventRecords(ctx context.Context, db *sqlx.DB, config *Config, archive *Archive, writer *bufio.Writer) (int, error) {
+	rows, err := db.QueryxContext(ctx, lookupChannelEvents, archive.Org.IsAnon, archive.Org.ID, archive.StartDate, archive.EndDate(), config.ContactGroupID)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error querying channel events for org: %d", archive.Org.ID)
+	}
+	defer rows.Close()
+
+	recordCount := 0
+	var record string
+	var eventID int64
+	for rows.Next() {
+		err = rows.Scan(&eventID, &record)
+		if err != nil {
+			return 0, errors.Wrapf(err, "error scanning channel event row for org: %d", archive.Org.ID)
+		}
+
+		if config.CanonicalJSON {
+			record, err = canonicalizeRecord(record)
+			if err != nil {
+				return 0, errors.Wrapf(err, "error canonicalizing channel event: %d", eventID)
+			}
+		}
+
+		writer.WriteString(record)
+		writer.WriteString("\n")
+		recordCount++
+	}
+
+	// a dropped connection ends our iteration early, make sure we never treat that as a complete archive
+	err = rows.Err()
+	if err != nil {
+		return 0, errors.Wrapf(err, "error reading channel event rows for org: %d", archive.Org.ID)
+	}
+
+	logrus.WithField("record_count", recordCount).Debug("Done Writing")
+	return recordCount, nil
+}
+
+const selectOrgChannelEventsInRange = `
+SELECT ce.id
+FROM channels_channelevent ce
+WHERE ce.org_id = $1 AND ce.created_on >= $2 AND ce.created_on < $3
+ORDER BY ce.created_on ASC, ce.id ASC
+`
+
+const deleteChannelEvents = `
+DELETE FROM channels_channelevent
+WHERE id IN(?)
+`
+
+// DeleteArchivedChannelEvents takes the passed in archive, verifies the S3 file is still present (and correct), then
+// selects all the channel events in the archive date range, and if equal or fewer than the number archived, deletes
+// them
+//
+// Upon completion it updates the needs_deletion flag on the archive
+func DeleteArchivedChannelEvents(ctx context.Context, config *Config, db *sqlx.DB, s3Client Storage, archive *Archive) error {
+	outer, cancel := context.WithTimeout(ctx, time.Hour*3)
+	defer cancel()
+
+	start := time.Now()
+	log := logrus.WithFields(logrus.Fields{
+		"id":           archive.ID,
+		"org_id":       archive.OrgID,
+		"start_date":   archive.StartDate,
+		"end_date":     archive.EndDate(),
+		"archive_type": archive.ArchiveType,
+		"total_count":  archive.RecordCount,
+	})
+	log.Info("deleting channel events")
+
+	// first things first, make sure our file is present on S3 and matches what we archived, we never delete
+	// records that aren't backed by a valid archive
+	err := verifyArchive(outer, s3Client, archive)
+	if err != nil {
+		return errors.Wrap(err, "refusing to delete, archive not verified")
+	}
+
+	// ok, archive file looks good, in strict mode we delete exactly the events in it, otherwise those in its period
+	if config.DeleteByArchiveContents {
+		err = deleteArchiveContents(outer, config, db, s3Client, archive, deleteChannelEventBatch)
+	} else {
+		err = deleteChannelEventsInPeriod(outer, db, archive, log)
+	}
+	if err != nil {
+		return err
+	}
+
+	outer, cancel = context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	deletedOn := time.Now()
+
+	// all went well! mark our archive as no longer needing deletion
+	_, err = db.ExecContext(outer, setArchiveDeleted, archive.ID, deletedOn)
+	if err != nil {
+		return errors.Wrap(err, "error setting archive as deleted")
+	}
+	archive.NeedsDeletion = false
+	archive.DeletedOn = &deletedOn
+
+	logrus.WithField("elapsed", time.Since(start)).Info("completed deleting channel events")
+
+	return nil
+}
+
+// deleteChannelEventsInPeriod deletes the channel events in the period of the passed in archive, if there are no more
+// of them than the archive has
+func deleteChannelEventsInPeriod(ctx context.Context, db *sqlx.DB, archive *Archive, log *logrus.Entry) error {
+	rows, err := db.QueryxContext(ctx, selectOrgChannelEventsInRange, archive.OrgID, archive.StartDate, archive.EndDate())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var eventID int64
+	eventIDs := make([]int64, 0, archive.RecordCount)
+	for rows.Next() {
+		err = rows.Scan(&eventID)
+		if err != nil {
+			return err
+		}
+		eventIDs = append(eventIDs, eventID)
+	}
+	rows.Close()
+
+	log.WithField("event_count", len(eventIDs)).Debug("found channel events")
+
+	// verify we don't see more events than there are in our archive (fewer is ok)
+	if len(eventIDs) > archive.RecordCount {
+		return fmt.Errorf("more channel events in the database: %d than in archive: %d", len(eventIDs), archive.RecordCount)
+	}
+
+	// ok, delete our events in batches
+	for _, idBatch := range chunkIDs(eventIDs, deleteTransactionSize) {
+		err = deleteChannelEventBatch(ctx, db, idBatch)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteChannelEventBatch deletes the passed in channel events
+func deleteChannelEventBatch(ctx context.Context, db *sqlx.DB, idBatch []int64) error {
+	// no single batch should take more than a few minutes
+	ctx, cancel := context.WithTimeout(ctx, time.Minute*15)
+	defer cancel()
+
+	start := time.Now()
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = executeInQuery(ctx, tx, deleteChannelEvents, idBatch)
+	if err != nil {
+		return errors.Wrap(err, "error deleting channel events")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "error committing channel event delete transaction")
+	}
+
+	logrus.WithField("elapsed", time.Since(start)).WithField("count", len(idBatch)).Debug("deleted batch of channel events")
+	return nil
+}
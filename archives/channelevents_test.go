@@ -0,0 +1,95 @@
+package archives
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchiveChannelEvents(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+
+	config := NewConfig()
+	config.ArchiveChannelEvents = true
+	config.Delete = true
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	readEvents := func(archive *Archive) []map[string]interface{} {
+		err := CreateArchiveFile(ctx, db, config, archive, "/tmp")
+		assert.NoError(t, err)
+		defer DeleteArchiveFile(archive)
+
+		file, err := os.Open(archive.ArchiveFile)
+		assert.NoError(t, err)
+		defer file.Close()
+		reader, err := gzip.NewReader(file)
+		assert.NoError(t, err)
+
+		events := make([]map[string]interface{}, 0)
+		decoder := json.NewDecoder(reader)
+		for decoder.More() {
+			event := make(map[string]interface{})
+			assert.NoError(t, decoder.Decode(&event))
+			delete(event, "created_on")
+			delete(event, "occurred_on")
+			events = append(events, event)
+		}
+		assert.Equal(t, len(events), archive.RecordCount)
+		return events
+	}
+
+	// events are archived by the day they were created, with their channel, contact and URN
+	aug12 := time.Date(2017, 8, 12, 0, 0, 0, 0, time.UTC)
+	events := readEvents(&Archive{Org: orgs[1], OrgID: orgs[1].ID, ArchiveType: ChannelEventType, Period: DayPeriod, StartDate: aug12})
+	assert.Equal(t, []map[string]interface{}{{
+		"id":      float64(1),
+		"type":    "mo_miss",
+		"channel": map[string]interface{}{"uuid": "60f2ed5b-05f2-4156-9ff0-e44e90da1b85", "name": "Channel 2"},
+		"contact": map[string]interface{}{"uuid": "3e814add-e614-41f7-8b5d-a07f670a698f", "name": "Ajodinabiff Dane"},
+		"urn":     "tel:+12067797777",
+		"extra":   map[string]interface{}{},
+	}, {
+		"id":      float64(2),
+		"type":    "referral",
+		"channel": map[string]interface{}{"uuid": "60f2ed5b-05f2-4156-9ff0-e44e90da1b85", "name": "Channel 2"},
+		"contact": map[string]interface{}{"uuid": "b46f6e18-95b4-4984-9926-dded047f4eb3", "name": nil},
+		"urn":     "viber:viberpath==",
+		"extra":   map[string]interface{}{"referrer_id": "ad-1", "source": "ADS"},
+	}}, events)
+
+	// anon orgs never have names or URNs written
+	events = readEvents(&Archive{Org: orgs[2], OrgID: orgs[2].ID, ArchiveType: ChannelEventType, Period: DayPeriod, StartDate: aug12})
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, map[string]interface{}{"uuid": "7051dff0-0a27-49d7-af1f-4494239139e6"}, events[0]["contact"])
+	assert.Nil(t, events[0]["urn"])
+
+	tasks, err := GetMissingDailyArchives(ctx, db, now, orgs[1], ChannelEventType)
+	assert.NoError(t, err)
+	assert.Equal(t, 62, len(tasks))
+
+	// once archived, events are deleted, those still within our retention period are left
+	result, err := ArchiveOrgPhasesWithResult(ctx, now, config, db, s3Client, orgs[1], ChannelEventType, AllPhases)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(result.Failed()))
+	assertCount(t, db, 0, `SELECT count(*) FROM channels_channelevent WHERE id IN (1, 2)`)
+	assertCount(t, db, 1, `SELECT count(*) FROM channels_channelevent WHERE id = 3`)
+	assertCount(t, db, 1, `SELECT count(*) FROM channels_channelevent WHERE org_id = 3`)
+}
+
+func TestScrubChannelEventRecord(t *testing.T) {
+	raw := `{"id":1,"type":"mo_miss","contact":{"uuid":"3e814add","name":"Dane"},"urn":"tel:+1","extra":{}}`
+
+	scrubbed, changed, err := scrubRecord(ChannelEventType, json.RawMessage(raw))
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, `{"contact":{"uuid":"3e814add"},"extra":{},"id":1,"type":"mo_miss","urn":null}`, string(scrubbed))
+}
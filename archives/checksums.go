@@ -0,0 +1,86 @@
+package archives
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// the name of the manifest of the checksums of an org's archives, written under the org's prefix
+const checksumsManifestName = "CHECKSUMS.md5"
+
+// checksumsManifestKey returns the key of the checksums manifest of the passed in org
+func checksumsManifestKey(org Org) string {
+	return fmt.Sprintf("/%d/%s", org.ID, checksumsManifestName)
+}
+
+// BuildChecksumsManifest returns the checksums manifest of the current archives of the passed in org, a line for each
+// archive object in the format of md5sum, its hash and its key relative to the org's prefix, so that a download of
+// the org's archives can be checked with md5sum -c. Archives under the key prefix of their type are listed relative to
+// the org's prefix within it. Archives without objects, and those whose objects are shared outside of the org's
+// prefix, such as compacted empty archives, aren't listed.
+func BuildChecksumsManifest(ctx context.Context, db *sqlx.DB, s3Client Storage, org Org) ([]byte, error) {
+	manifest := &bytes.Buffer{}
+	listed := make(map[string]bool)
+
+	for _, archiveType := range ArchiveTypes {
+		prefix := fmt.Sprintf("/%d/", org.ID)
+		err := ForEachCurrentArchive(ctx, db, org, archiveType, func(archive *Archive) error {
+			if archive.URL == "" || archive.Hash == "" {
+				return nil
+			}
+
+			_, key, err := s3Client.SplitURL(archive.URL)
+			if err != nil {
+				return errors.Wrapf(err, "invalid url for archive: %d", archive.ID)
+			}
+			filename := strings.TrimPrefix(key, prefix)
+			if filename == key {
+				filename = strings.TrimPrefix(key, orgKeyPrefix(org, archiveType))
+				if filename == key {
+					return nil
+				}
+			}
+			if listed[filename] {
+				return nil
+			}
+			listed[filename] = true
+
+			fmt.Fprintf(manifest, "%s  %s\n", archive.Hash, filename)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return manifest.Bytes(), nil
+}
+
+// WriteChecksumsManifest rebuilds the checksums manifest of the passed in org and uploads it as CHECKSUMS.md5 under
+// the org's prefix in our bucket, replacing the last one, returning its URL
+func WriteChecksumsManifest(ctx context.Context, config *Config, db *sqlx.DB, s3Client Storage, org Org) (string, error) {
+	manifest, err := BuildChecksumsManifest(ctx, db, s3Client, org)
+	if err != nil {
+		return "", errors.Wrapf(err, "error building checksums manifest for org: %d", org.ID)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute*5)
+	defer cancel()
+
+	var url string
+	err = uploadThrottler.do(ctx, func() error {
+		url, err = s3Client.PutObject(ctx, config.StorageBucket(), checksumsManifestKey(org), bytes.NewReader(manifest), int64(len(manifest)), "text/plain", "")
+		return err
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "error uploading checksums manifest for org: %d", org.ID)
+	}
+
+	return url, nil
+}
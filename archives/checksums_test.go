@@ -0,0 +1,62 @@
+package archives
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteChecksumsManifest(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+
+	config := NewConfig()
+	config.UploadToS3 = true
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	// only our daily without an object to begin with, which isn't listed
+	url, err := WriteChecksumsManifest(ctx, config, db, s3Client, orgs[1])
+	assert.NoError(t, err)
+	assert.Equal(t, "https://dl-archiver-test.s3.amazonaws.com/2/CHECKSUMS.md5", url)
+	assert.Equal(t, "", string(s3Client.objects["dl-archiver-test:/2/CHECKSUMS.md5"].body))
+
+	created, err := CreateOrgArchives(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 61, len(created))
+
+	monthlies, err := RollupOrgArchives(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(monthlies))
+
+	// the manifest is rebuilt each time
+	_, err = WriteChecksumsManifest(ctx, config, db, s3Client, orgs[1])
+	assert.NoError(t, err)
+
+	manifest := s3Client.objects["dl-archiver-test:/2/CHECKSUMS.md5"]
+	assert.Equal(t, "text/plain", manifest.contentType)
+
+	lines := strings.Split(strings.TrimSuffix(string(manifest.body), "\n"), "\n")
+	assert.Equal(t, 63, len(lines))
+	assert.Equal(t, monthlies[0].Hash+"  message_M201708_"+monthlies[0].Hash+".jsonl.gz", lines[0])
+	assert.Equal(t, created[0].Hash+"  message_D20170810_"+created[0].Hash+".jsonl.gz", lines[1])
+
+	// each line checks out against the object it names
+	for _, line := range lines {
+		parts := strings.SplitN(line, "  ", 2)
+		assert.Equal(t, 2, len(parts))
+
+		object := s3Client.objects["dl-archiver-test:/2/"+parts[1]]
+		if assert.NotNil(t, object, "missing object: %s", parts[1]) {
+			hash := md5.Sum(object.body)
+			assert.Equal(t, parts[0], hex.EncodeToString(hash[:]))
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package archives
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var clockSkew = newGauge("archiver_clock_skew_seconds", "How far the clock of our database is ahead of ours, negative if behind.")
+
+const selectDBNow = `
+SELECT now()
+`
+
+// lookupDBTime returns the current time of our database, a variable so tests can skew it
+var lookupDBTime = func(ctx context.Context, db *sqlx.DB) (time.Time, error) {
+	var now time.Time
+	err := db.GetContext(ctx, &now, selectDBNow)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "error selecting database time")
+	}
+	return now, nil
+}
+
+// CheckClockSkew compares our clock against that of our database, as days are evaluated against database timestamps
+// but the retention window from our time. A skew above ClockSkewWarnSecs is logged, and above ClockSkewMaxSecs we
+// return an error as we shouldn't archive at all. It returns how far the database is ahead of us.
+func CheckClockSkew(ctx context.Context, db *sqlx.DB, config *Config) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	// compare against the middle of our round trip to not count its time as skew
+	before := time.Now()
+	dbNow, err := lookupDBTime(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	after := time.Now()
+	skew := dbNow.Sub(before.Add(after.Sub(before) / 2))
+	clockSkew.set(skew.Seconds())
+
+	abs := skew
+	if abs < 0 {
+		abs = -abs
+	}
+
+	if config.ClockSkewMaxSecs > 0 && abs > time.Duration(config.ClockSkewMaxSecs)*time.Second {
+		return skew, fmt.Errorf("clock skew with database of %s is above limit of %ds, refusing to archive", skew.Round(time.Millisecond), config.ClockSkewMaxSecs)
+	}
+	if config.ClockSkewWarnSecs > 0 && abs > time.Duration(config.ClockSkewWarnSecs)*time.Second {
+		logrus.WithField("skew", skew.Round(time.Millisecond)).Warn("clock skew with database, days at the edge of the retention window may flap between runs, consider use-db-time")
+	}
+	return skew, nil
+}
+
+// Now returns the time retention is evaluated from, that of our database with UseDBTime set, otherwise ours
+func Now(ctx context.Context, db *sqlx.DB, config *Config) (time.Time, error) {
+	if !config.UseDBTime {
+		return time.Now(), nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	return lookupDBTime(ctx, db)
+}
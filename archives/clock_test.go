@@ -0,0 +1,60 @@
+package archives
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckClockSkew(t *testing.T) {
+	ctx := context.Background()
+	defer func(original func(context.Context, *sqlx.DB) (time.Time, error)) { lookupDBTime = original }(lookupDBTime)
+
+	// our database's clock is 6 minutes ahead of ours
+	dbSkew := time.Minute * 6
+	lookupDBTime = func(context.Context, *sqlx.DB) (time.Time, error) { return time.Now().Add(dbSkew), nil }
+
+	config := NewConfig()
+	skew, err := CheckClockSkew(ctx, nil, config)
+	assert.NoError(t, err)
+	assert.InDelta(t, dbSkew.Seconds(), skew.Seconds(), 1)
+
+	// above our hard limit we refuse to archive
+	config.ClockSkewMaxSecs = 300
+	_, err = CheckClockSkew(ctx, nil, config)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "is above limit of 300s, refusing to archive")
+
+	// behind counts the same as ahead
+	dbSkew = -time.Minute * 6
+	skew, err = CheckClockSkew(ctx, nil, config)
+	assert.Error(t, err)
+	assert.InDelta(t, dbSkew.Seconds(), skew.Seconds(), 1)
+
+	dbSkew = time.Second * 10
+	_, err = CheckClockSkew(ctx, nil, config)
+	assert.NoError(t, err)
+
+	// retention is evaluated from our time unless configured to use our database's
+	now, err := Now(ctx, nil, config)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), now, time.Second)
+
+	config.UseDBTime = true
+	dbSkew = time.Hour
+	now, err = Now(ctx, nil, config)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), now, time.Second)
+
+	lookupDBTime = func(context.Context, *sqlx.DB) (time.Time, error) {
+		return time.Time{}, errors.New("connection refused")
+	}
+	_, err = Now(ctx, nil, config)
+	assert.EqualError(t, err, "connection refused")
+	_, err = CheckClockSkew(ctx, nil, config)
+	assert.EqualError(t, err, "connection refused")
+}
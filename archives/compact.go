@@ -0,0 +1,116 @@
+package archives
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// the prefix of the objects which empty dailies share once compacted, these are shared across orgs so must never be
+// deleted along with an archive
+const emptyArchivePrefix = "/empty/"
+
+const lookupEmptyDailies = `
+SELECT id, org_id, start_date::timestamp with time zone as start_date, period, archive_type, hash, size, record_count, url, needs_deletion
+FROM archives_archive
+WHERE org_id = $1 AND archive_type = $2 AND period = 'D' AND record_count = 0 AND url != '' AND url NOT LIKE '%' || $3 || '%'
+ORDER BY start_date ASC
+`
+
+const updateArchiveURL = `
+UPDATE archives_archive SET url = $2 WHERE id = $1
+`
+
+// CompactEmptyArchives points the empty dailies of the passed in org at a single object shared by all empty dailies
+// with the same contents, deleting their own objects. Their rows are kept so those days are still archived. Returns the
+// number of dailies compacted.
+func CompactEmptyArchives(ctx context.Context, config *Config, db *sqlx.DB, s3Client Storage, org Org, archiveType ArchiveType) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Hour)
+	defer cancel()
+
+	dailies := make([]*Archive, 0)
+	err := db.SelectContext(ctx, &dailies, lookupEmptyDailies, org.ID, archiveType, emptyArchivePrefix)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error selecting empty dailies for org: %d and type: %s", org.ID, archiveType)
+	}
+
+	compacted := 0
+	markers := make(map[string]string)
+
+	// the keys of the objects no longer pointed at by any archive, by bucket, deleted together once we're done
+	deletes := make(map[string][]string)
+	archiveIDs := make(map[string]int)
+
+	for _, daily := range dailies {
+		bucket, key, err := s3Client.SplitURL(daily.URL)
+		if err != nil {
+			return compacted, errors.Wrapf(err, "invalid url for archive: %d", daily.ID)
+		}
+
+		// empty archives are identical unless built by a different gzip, so we share objects by hash
+		markerKey := fmt.Sprintf("%s%s.jsonl.gz", emptyArchivePrefix, daily.Hash)
+		markerURL, found := markers[markerKey]
+		if !found {
+			markerURL, err = ensureEmptyMarker(ctx, s3Client, bucket, markerKey, daily)
+			if err != nil {
+				return compacted, err
+			}
+			markers[markerKey] = markerURL
+		}
+
+		// point our row at our marker before deleting our object so it never points at nothing
+		_, err = db.ExecContext(ctx, updateArchiveURL, daily.ID, markerURL)
+		if err != nil {
+			return compacted, errors.Wrapf(err, "error updating url of archive: %d", daily.ID)
+		}
+
+		deletes[bucket] = append(deletes[bucket], key)
+		archiveIDs[key] = daily.ID
+		compacted++
+	}
+
+	for bucket, keys := range deletes {
+		for key, err := range s3Client.Delete(ctx, bucket, keys) {
+			if err != nil {
+				logrus.WithError(err).WithField("archive_id", archiveIDs[key]).WithField("bucket", bucket).WithField("key", key).Error("error deleting compacted archive object")
+			}
+		}
+	}
+
+	if compacted > 0 {
+		logrus.WithFields(logrus.Fields{
+			"org_id":       org.ID,
+			"archive_type": archiveType,
+			"compacted":    compacted,
+		}).Info("compacted empty daily archives")
+	}
+
+	return compacted, nil
+}
+
+// ensureEmptyMarker makes sure the shared object for empty archives like the passed in daily exists, copying the
+// daily's object to create it if necessary, and returns its URL
+func ensureEmptyMarker(ctx context.Context, s3Client Storage, bucket string, markerKey string, daily *Archive) (string, error) {
+	marker := &Archive{ID: daily.ID, Size: daily.Size, Hash: daily.Hash, URL: s3Client.URL(bucket, markerKey)}
+
+	err := VerifyS3Archive(ctx, s3Client, marker)
+	if err == nil {
+		return marker.URL, nil
+	}
+
+	_, err = s3Client.Copy(ctx, daily.URL, markerKey, "")
+	if err != nil {
+		return "", errors.Wrapf(err, "error creating empty archive marker: %s", markerKey)
+	}
+
+	// make sure our copy is identical before anything points at it
+	err = VerifyS3Archive(ctx, s3Client, marker)
+	if err != nil {
+		return "", errors.Wrapf(err, "error verifying empty archive marker: %s", markerKey)
+	}
+	return marker.URL, nil
+}
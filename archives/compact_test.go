@@ -0,0 +1,62 @@
+package archives
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompactEmptyArchives(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+
+	config := NewConfig()
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	dailies, err := GetMissingDailyArchives(ctx, db, now, orgs[1], RunType)
+	assert.NoError(t, err)
+	assert.NoError(t, createArchives(ctx, db, config, s3Client, orgs[1], dailies))
+	assert.Equal(t, 62, len(s3Client.objects))
+
+	// only the dailies for the 12th and 14th of august have runs
+	compacted, err := CompactEmptyArchives(ctx, config, db, s3Client, orgs[1], RunType)
+	assert.NoError(t, err)
+	assert.Equal(t, 60, compacted)
+	assert.Equal(t, 3, len(s3Client.objects))
+
+	emptyURL := "https://dl-archiver-test.s3.amazonaws.com/empty/" + dailies[0].Hash + ".jsonl.gz"
+	assertCount(t, db, 60, `SELECT count(*) FROM archives_archive WHERE org_id = 2 AND archive_type = 'run' AND url = $1`, emptyURL)
+
+	// nothing left to compact
+	compacted, err = CompactEmptyArchives(ctx, config, db, s3Client, orgs[1], RunType)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, compacted)
+
+	// those days are still archived and can still be rolled up
+	missing, err := GetMissingDailyArchives(ctx, db, now, orgs[1], RunType)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(missing))
+
+	monthlies, err := RollupOrgArchives(ctx, now, config, db, s3Client, orgs[1], RunType)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(monthlies))
+	assert.Equal(t, 3, monthlies[0].RecordCount)
+
+	// and verified before deleting
+	config.Delete = true
+	config.CompactEmptyArchives = true
+	_, deleted, err := ArchiveOrg(ctx, now, config, db, s3Client, orgs[1], RunType)
+	assert.NoError(t, err)
+	assert.Equal(t, 64, len(deleted))
+	assertCount(t, db, 0, `SELECT count(*) FROM flows_flowrun WHERE org_id = 2`)
+
+	// our monthlies aren't empty dailies so are never compacted
+	assert.True(t, strings.HasPrefix(monthlies[1].URL, "https://dl-archiver-test.s3.amazonaws.com/2/run_M201709_"))
+	assertCount(t, db, 1, `SELECT count(*) FROM archives_archive WHERE id = $1 AND url = $2`, monthlies[1].ID, monthlies[1].URL)
+}
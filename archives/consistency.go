@@ -0,0 +1,124 @@
+package archives
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+)
+
+// how we keep the deletion of messages and runs consistent with each other
+const (
+	// DeletionConsistencyOff deletes the records of each type as soon as they are archived
+	DeletionConsistencyOff = ""
+
+	// DeletionConsistencyWarn deletes as normal but warns when the other type isn't archived for the same days
+	DeletionConsistencyWarn = "warn"
+
+	// DeletionConsistencyCoordinate only deletes the records of days which both types have been archived for
+	DeletionConsistencyCoordinate = "coordinate"
+)
+
+// CheckDeletionConsistency checks that the passed in deletion consistency is one we support
+func CheckDeletionConsistency(consistency string) error {
+	switch consistency {
+	case DeletionConsistencyOff, DeletionConsistencyWarn, DeletionConsistencyCoordinate:
+		return nil
+	}
+	return fmt.Errorf("invalid deletion consistency: %s, must be one of warn or coordinate", consistency)
+}
+
+// otherArchiveType returns the type whose deletion must be consistent with the passed in type
+func otherArchiveType(archiveType ArchiveType) ArchiveType {
+	if archiveType == MessageType {
+		return RunType
+	}
+	return MessageType
+}
+
+// uncoordinatedArchives returns which of the passed in archives cover days the other type hasn't been archived for, as
+// deleting their records would leave runs pointing at deleted messages or the other way around
+func uncoordinatedArchives(ctx context.Context, db *sqlx.DB, org Org, archiveType ArchiveType, archives []*Archive) ([]*Archive, error) {
+	if len(archives) == 0 {
+		return archives, nil
+	}
+
+	// we only need the archives of the other type which cover the days of ours
+	start, end := archives[0].StartDate, archives[0].EndDate()
+	for _, a := range archives[1:] {
+		if a.StartDate.Before(start) {
+			start = a.StartDate
+		}
+		if a.EndDate().After(end) {
+			end = a.EndDate()
+		}
+	}
+
+	others, err := getArchivesOverlapping(ctx, db, org, otherArchiveType(archiveType), start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	archived := make(map[time.Time]bool)
+	for _, o := range others {
+		for day := o.StartDate.In(time.UTC); day.Before(o.EndDate()); day = day.AddDate(0, 0, 1) {
+			archived[day] = true
+		}
+	}
+
+	uncoordinated := make([]*Archive, 0)
+	for _, a := range archives {
+		for day := a.StartDate.In(time.UTC); day.Before(a.EndDate()); day = day.AddDate(0, 0, 1) {
+			if !archived[day] {
+				uncoordinated = append(uncoordinated, a)
+				break
+			}
+		}
+	}
+	return uncoordinated, nil
+}
+
+// coordinateDeletion applies our deletion consistency to the passed in archives needing deletion, returning those whose
+// records we should delete now. Consistency only matters when we archive both types.
+func coordinateDeletion(ctx context.Context, db *sqlx.DB, config *Config, org Org, archiveType ArchiveType, archives []*Archive) ([]*Archive, error) {
+	if config.DeletionConsistency == DeletionConsistencyOff || !config.ArchiveMessages || !config.ArchiveRuns {
+		return archives, nil
+	}
+
+	uncoordinated, err := uncoordinatedArchives(ctx, db, org, archiveType, archives)
+	if err != nil {
+		return nil, err
+	}
+	if len(uncoordinated) == 0 {
+		return archives, nil
+	}
+
+	log := logrus.WithFields(logrus.Fields{
+		"org_id":       org.ID,
+		"archive_type": archiveType,
+		"other_type":   otherArchiveType(archiveType),
+		"archives":     len(uncoordinated),
+		"first_start":  uncoordinated[0].StartDate,
+	})
+
+	if config.DeletionConsistency == DeletionConsistencyWarn {
+		log.Warn("deleting records of days the other type isn't archived for")
+		return archives, nil
+	}
+
+	log.Info("not deleting records of days the other type isn't archived for yet")
+
+	held := make(map[*Archive]bool, len(uncoordinated))
+	for _, a := range uncoordinated {
+		held[a] = true
+	}
+	coordinated := make([]*Archive, 0, len(archives)-len(uncoordinated))
+	for _, a := range archives {
+		if !held[a] {
+			coordinated = append(coordinated, a)
+		}
+	}
+	return coordinated, nil
+}
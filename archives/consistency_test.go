@@ -0,0 +1,66 @@
+package archives
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckDeletionConsistency(t *testing.T) {
+	assert.NoError(t, CheckDeletionConsistency(""))
+	assert.NoError(t, CheckDeletionConsistency("warn"))
+	assert.NoError(t, CheckDeletionConsistency("coordinate"))
+	assert.EqualError(t, CheckDeletionConsistency("strict"), "invalid deletion consistency: strict, must be one of warn or coordinate")
+}
+
+func TestCoordinateDeletion(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+
+	config := NewConfig()
+	config.Delete = true
+	config.DeletionConsistency = DeletionConsistencyCoordinate
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	created, err := CreateOrgArchives(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 61, len(created))
+	assert.Equal(t, time.Date(2017, 8, 12, 0, 0, 0, 0, time.UTC), created[2].StartDate)
+
+	// without any run archives we don't delete any messages
+	deleted, err := DeleteArchivedOrgRecords(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(deleted))
+
+	// archive our runs, except for one day
+	_, err = CreateOrgArchives(ctx, now, config, db, s3Client, orgs[1], RunType)
+	assert.NoError(t, err)
+	_, err = db.Exec(`DELETE FROM archives_archive WHERE org_id = 2 AND archive_type = 'run' AND start_date = '2017-08-12'`)
+	assert.NoError(t, err)
+
+	deleted, err = DeleteArchivedOrgRecords(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 60, len(deleted))
+	assertCount(t, db, 1, `SELECT count(*) FROM archives_archive WHERE id = $1 AND needs_deletion = TRUE`, created[2].ID)
+	assertCount(t, db, 1, `SELECT count(*) FROM msgs_msg WHERE id = 1`)
+
+	// when we're only archiving messages there's nothing to coordinate with
+	config.ArchiveRuns = false
+	deleted, err = coordinateDeletion(ctx, db, config, orgs[1], MessageType, []*Archive{created[2]})
+	assert.NoError(t, err)
+	assert.Equal(t, []*Archive{created[2]}, deleted)
+	config.ArchiveRuns = true
+
+	// warning still deletes
+	config.DeletionConsistency = DeletionConsistencyWarn
+	deleted, err = DeleteArchivedOrgRecords(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(deleted))
+	assert.Equal(t, created[2].ID, deleted[0].ID)
+	assertCount(t, db, 0, `SELECT count(*) FROM msgs_msg WHERE id = 1`)
+}
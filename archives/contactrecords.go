@@ -0,0 +1,383 @@
+package archives
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// contacts are archived by the day they were created, as they are when we build their archive, so a contact archive
+// is a snapshot which later changes to its contacts never make it into. Contacts are written in order of created_on,
+// ties broken by id. For anon orgs we leave out names and fields and replace each URN with a hash of it.
+const lookupContacts = `
+SELECT row_to_json(rec) FROM (
+	SELECT
+	  cc.id,
+	  cc.uuid,
+	  CASE WHEN $1 THEN NULL ELSE cc.name END as name,
+	  cc.language,
+	  CASE WHEN cc.is_stopped THEN 'stopped'
+		WHEN cc.is_blocked THEN 'blocked'
+		ELSE 'active'
+	  END as status,
+	  CASE WHEN $1 THEN '{}'::jsonb ELSE coalesce(cc.fields, '{}'::jsonb) END as fields,
+	  (SELECT coalesce(jsonb_agg(urn_row.urn ORDER BY urn_row.priority DESC, urn_row.id), '[]'::jsonb) FROM (
+		SELECT ccu.id, ccu.priority, CASE
+		  WHEN $1 THEN jsonb_build_object('scheme', ccu.scheme, 'hash', encode(sha256(ccu.identity::bytea), 'hex'))
+		  ELSE jsonb_build_object('scheme', ccu.scheme, 'path', ccu.path, 'display', ccu.display)
+		END as urn
+		FROM contacts_contacturn ccu WHERE ccu.contact_id = cc.id) as urn_row) as urns,
+	  (SELECT coalesce(jsonb_agg(group_row ORDER BY group_row.name), '[]'::jsonb) FROM (
+		SELECT cg.uuid, cg.name FROM contacts_contactgroup cg
+		JOIN contacts_contactgroup_contacts cgc ON cgc.contactgroup_id = cg.id WHERE cgc.contact_id = cc.id) as group_row) as groups,
+	  cc.created_on,
+	  cc.modified_on
+	FROM contacts_contact cc
+	WHERE cc.org_id = $2 AND cc.created_on >= $3 AND cc.created_on < $4 AND cc.is_active = TRUE
+	  AND ($5 = 0 OR cc.id IN (SELECT contact_id FROM contacts_contactgroup_contacts WHERE contactgroup_id = $5))
+	) rec
+ORDER BY rec.created_on ASC, rec.id ASC;
+`
+
+const lookupEarliestContact = `
+SELECT MIN(created_on) FROM contacts_contact WHERE org_id = $1 AND created_on < $2 AND is_active = TRUE
+`
+
+// deactivated contacts are never written to archives so aren't counted
+const countContactsInRange = `
+SELECT count(*) FROM contacts_contact cc WHERE cc.org_id = $1 AND cc.created_on >= $2 AND cc.created_on < $3 AND cc.is_active = TRUE
+`
+
+// recordsDeletable returns whether the records of archives of the passed in type are deleted once archived, contacts
+// live on after we snapshot them unless we're configured to delete them
+func recordsDeletable(config *Config, archiveType ArchiveType) bool {
+	return archiveType != ContactType || config.DeleteContacts
+}
+
+// writeContactRecords writes the contacts created in the archive's date range, as they are now, to the passed in writer
+func writeContactRecords(ctx context.Context, db *sqlx.DB, config *Config, archive *Archive, writer *bufio.Writer) (int, error) {
+	rows, err := db.QueryxContext(ctx, lookupContacts, archive.Org.IsAnon, archive.Org.ID, archive.StartDate, archive.EndDate(), config.ContactGroupID)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error querying contacts for org: %d", archive.Org.ID)
+	}
+	defer rows.Close()
+
+	recordCount := 0
+	var record string
+	for rows.Next() {
+		err = rows.Scan(&record)
+		if err != nil {
+			return 0, errors.Wrapf(err, "error scanning contact row for org: %d", archive.Org.ID)
+		}
+
+		if config.CanonicalJSON {
+			record, err = canonicalizeRecord(record)
+			if err != nil {
+				return 0, errors.Wrapf(err, "error canonicalizing contact record for org: %d", archive.Org.ID)
+			}
+		}
+
+		writer.WriteString(record)
+		writer.WriteString("\n")
+		recordCount++
+	}
+
+	// a dropped connection ends our iteration early, make sure we never treat that as a complete archive
+	err = rows.Err()
+	if err != nil {
+		return 0, errors.Wrapf(err, "error reading contact rows for org: %d", archive.Org.ID)
+	}
+
+	logrus.WithField("record_count", recordCount).Debug("Done Writing")
+	return recordCount, nil
+}
+
+const selectOrgContactsInRange = `
+SELECT cc.id
+FROM contacts_contact cc
+WHERE cc.org_id = $1 AND cc.created_on >= $2 AND cc.created_on < $3 AND cc.is_active = TRUE
+ORDER BY cc.created_on ASC, cc.id ASC
+`
+
+// contactReference is a column of a table whose records reference contacts
+type contactReference struct {
+	Table  string `db:"table"`
+	Column string `db:"column"`
+}
+
+// the tables whose records keep a contact from being deleted, those are archived and deleted on their own
+var contactReferences = []contactReference{
+	{"msgs_msg", "contact_id"},
+	{"flows_flowrun", "contact_id"},
+	{"flows_flowsession", "contact_id"},
+	{"channels_channelevent", "contact_id"},
+}
+
+// the tables we remove contacts from ourselves when deleting them
+var contactReleasedTables = map[string]bool{
+	"contacts_contactgroup_contacts": true,
+	"msgs_broadcast_contacts":        true,
+	"contacts_contacturn":            true,
+}
+
+// selects the foreign keys to contacts which would stop a contact being deleted, rather than being deleted with it
+const selectContactForeignKeys = `
+SELECT c.conrelid::regclass::text AS "table", a.attname AS "column"
+FROM pg_constraint c
+JOIN pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = c.conkey[1]
+WHERE c.contype = 'f' AND c.confrelid = 'contacts_contact'::regclass AND c.confdeltype IN ('a', 'r')
+ORDER BY 1, 2
+`
+
+const selectDeletableContacts = `
+SELECT cc.id
+FROM contacts_contact cc
+WHERE cc.id IN(?) AND cc.modified_on < ?%s
+FOR UPDATE
+`
+
+const deleteContactGroupContacts = `
+DELETE FROM contacts_contactgroup_contacts
+WHERE contact_id IN(?)
+`
+
+const deleteContactBroadcasts = `
+DELETE FROM msgs_broadcast_contacts
+WHERE contact_id IN(?)
+`
+
+const releaseContactURNs = `
+UPDATE contacts_contacturn
+SET contact_id = NULL
+WHERE contact_id IN(?)
+`
+
+const deleteContacts = `
+DELETE FROM contacts_contact
+WHERE id IN(?)
+`
+
+// DeleteArchivedContacts takes the passed in archive, verifies the S3 file is still present (and correct), then
+// selects all the contacts in the archive date range, and if equal or fewer than the number archived, deletes those
+// which are safe to delete
+//
+// Contacts which are still referenced, such as by messages, runs, sessions, channel events or tickets, are kept, as are
+// contacts modified since our archive took its snapshot of them, as it no longer matches them. Only once every contact
+// in the archive is deleted does it update the needs_deletion flag on the archive
+func DeleteArchivedContacts(ctx context.Context, config *Config, db *sqlx.DB, s3Client Storage, archive *Archive) error {
+	outer, cancel := context.WithTimeout(ctx, time.Hour*3)
+	defer cancel()
+
+	start := time.Now()
+	log := logrus.WithFields(logrus.Fields{
+		"id":           archive.ID,
+		"org_id":       archive.OrgID,
+		"start_date":   archive.StartDate,
+		"end_date":     archive.EndDate(),
+		"archive_type": archive.ArchiveType,
+		"total_count":  archive.RecordCount,
+	})
+	log.Info("deleting contacts")
+
+	// first things first, make sure our file is present on S3 and matches what we archived, we never delete
+	// records that aren't backed by a valid archive
+	err := verifyArchive(outer, s3Client, archive)
+	if err != nil {
+		return errors.Wrap(err, "refusing to delete, archive not verified")
+	}
+
+	refs, err := loadContactReferences(outer, db)
+	if err != nil {
+		return err
+	}
+	query := deletableContactsQuery(refs)
+
+	kept := 0
+	deleteBatch := func(ctx context.Context, db *sqlx.DB, idBatch []int64) error {
+		deleted, err := deleteContactBatch(ctx, db, archive, query, idBatch)
+		kept += len(idBatch) - deleted
+		return err
+	}
+
+	// ok, archive file looks good, in strict mode we delete exactly the contacts in it, otherwise those in its period
+	if config.DeleteByArchiveContents {
+		err = deleteArchiveContents(outer, config, db, s3Client, archive, deleteBatch)
+	} else {
+		err = deleteContactsInPeriod(outer, db, archive, deleteBatch, log)
+	}
+	if err != nil {
+		return err
+	}
+
+	// our archive waits for the contacts we kept, until whatever references them is deleted in turn
+	if kept > 0 {
+		return fmt.Errorf("%d contacts in archive are still referenced or were modified since, waiting for them to be deleted", kept)
+	}
+
+	outer, cancel = context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	deletedOn := time.Now()
+
+	// all went well! mark our archive as no longer needing deletion
+	_, err = db.ExecContext(outer, setArchiveDeleted, archive.ID, deletedOn)
+	if err != nil {
+		return errors.Wrap(err, "error setting archive as deleted")
+	}
+	archive.NeedsDeletion = false
+	archive.DeletedOn = &deletedOn
+
+	logrus.WithField("elapsed", time.Since(start)).Info("completed deleting contacts")
+
+	return nil
+}
+
+// deleteContactsInPeriod deletes the contacts in the period of the passed in archive, if there are no more of them than
+// the archive has
+func deleteContactsInPeriod(ctx context.Context, db *sqlx.DB, archive *Archive, deleteBatch func(context.Context, *sqlx.DB, []int64) error, log *logrus.Entry) error {
+	contactIDs := make([]int64, 0, archive.RecordCount)
+	err := db.SelectContext(ctx, &contactIDs, selectOrgContactsInRange, archive.OrgID, archive.StartDate, archive.EndDate())
+	if err != nil {
+		return err
+	}
+
+	log.WithField("contact_count", len(contactIDs)).Debug("found contacts")
+
+	// verify we don't see more contacts than there are in our archive (fewer is ok)
+	if len(contactIDs) > archive.RecordCount {
+		return fmt.Errorf("more contacts in the database: %d than in archive: %d", len(contactIDs), archive.RecordCount)
+	}
+
+	// ok, delete our contacts in batches
+	for _, idBatch := range chunkIDs(contactIDs, deleteTransactionSize) {
+		err = deleteBatch(ctx, db, idBatch)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadContactReferences returns the columns whose records keep a contact from being deleted, our own along with every
+// foreign key to contacts which doesn't cascade, as RapidPro has many of those, such as tickets and flow starts, and
+// deleting a contact one of them references would fail
+func loadContactReferences(ctx context.Context, db *sqlx.DB) ([]contactReference, error) {
+	foreignKeys := make([]contactReference, 0)
+	err := db.SelectContext(ctx, &foreignKeys, selectContactForeignKeys)
+	if err != nil {
+		return nil, errors.Wrap(err, "error selecting foreign keys to contacts")
+	}
+
+	refs := make([]contactReference, 0, len(contactReferences)+len(foreignKeys))
+	refs = append(refs, contactReferences...)
+	for _, fk := range foreignKeys {
+		if contactReleasedTables[fk.Table] || containsContactReference(refs, fk) {
+			continue
+		}
+		refs = append(refs, fk)
+	}
+	return refs, nil
+}
+
+// containsContactReference returns whether the passed in reference is one of the passed in references
+func containsContactReference(refs []contactReference, ref contactReference) bool {
+	for _, r := range refs {
+		if r == ref {
+			return true
+		}
+	}
+	return false
+}
+
+// deletableContactsQuery returns the query which selects which of a batch of contacts can be deleted, leaving out
+// those still referenced by any of the passed in references
+func deletableContactsQuery(refs []contactReference) string {
+	clauses := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		clauses = append(clauses, fmt.Sprintf("\n  AND NOT EXISTS (SELECT 1 FROM %s WHERE %s = cc.id)", ref.Table, ref.Column))
+	}
+	return fmt.Sprintf(selectDeletableContacts, strings.Join(clauses, ""))
+}
+
+// contactSnapshotTime returns when the passed in archive took its snapshot of its contacts, that of the earliest of its
+// dailies for a monthly deleted along with them, as a monthly is rolled up from those
+func contactSnapshotTime(archive *Archive) time.Time {
+	snapshot := archive.CreatedOn
+	for _, d := range archive.Dailies {
+		if d.CreatedOn.Before(snapshot) {
+			snapshot = d.CreatedOn
+		}
+	}
+	return snapshot
+}
+
+// deleteContactBatch deletes those of the passed in contacts which the passed in deletable query finds nothing references
+// and which haven't changed since the passed in archive was built, first removing them from groups and broadcasts and
+// releasing their URNs. It returns how many were deleted.
+func deleteContactBatch(ctx context.Context, db *sqlx.DB, archive *Archive, query string, idBatch []int64) (int, error) {
+	// no single batch should take more than a few minutes
+	ctx, cancel := context.WithTimeout(ctx, time.Minute*15)
+	defer cancel()
+
+	start := time.Now()
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	// a failed batch must never keep holding the locks on its contacts
+	defer tx.Rollback()
+
+	q, vs, err := sqlx.In(query, idBatch, contactSnapshotTime(archive))
+	if err != nil {
+		return 0, err
+	}
+	deletable := make([]int64, 0, len(idBatch))
+	err = tx.SelectContext(ctx, &deletable, tx.Rebind(q), vs...)
+	if err != nil {
+		return 0, errors.Wrap(err, "error selecting deletable contacts")
+	}
+
+	if len(deletable) > 0 {
+		err = executeInQuery(ctx, tx, deleteContactGroupContacts, deletable)
+		if err != nil {
+			return 0, errors.Wrap(err, "error removing contacts from groups")
+		}
+
+		if tableExists("msgs_broadcast_contacts") {
+			err = executeInQuery(ctx, tx, deleteContactBroadcasts, deletable)
+			if err != nil {
+				return 0, errors.Wrap(err, "error removing contacts from broadcasts")
+			}
+		}
+
+		err = executeInQuery(ctx, tx, releaseContactURNs, deletable)
+		if err != nil {
+			return 0, errors.Wrap(err, "error releasing contact urns")
+		}
+
+		err = executeInQuery(ctx, tx, deleteContacts, deletable)
+		if err != nil {
+			return 0, errors.Wrap(err, "error deleting contacts")
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, errors.Wrap(err, "error committing contact delete transaction")
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"elapsed": time.Since(start),
+		"count":   len(deletable),
+		"kept":    len(idBatch) - len(deletable),
+	}).Debug("deleted batch of contacts")
+	return len(deletable), nil
+}
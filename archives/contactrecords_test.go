@@ -0,0 +1,174 @@
+package archives
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchiveContacts(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+
+	config := NewConfig()
+	config.ArchiveContacts = true
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	readContacts := func(archive *Archive) []map[string]interface{} {
+		err := CreateArchiveFile(ctx, db, config, archive, "/tmp")
+		assert.NoError(t, err)
+		defer DeleteArchiveFile(archive)
+
+		file, err := os.Open(archive.ArchiveFile)
+		assert.NoError(t, err)
+		defer file.Close()
+		reader, err := gzip.NewReader(file)
+		assert.NoError(t, err)
+
+		contacts := make([]map[string]interface{}, 0)
+		decoder := json.NewDecoder(reader)
+		for decoder.More() {
+			contact := make(map[string]interface{})
+			assert.NoError(t, decoder.Decode(&contact))
+			delete(contact, "created_on")
+			delete(contact, "modified_on")
+			contacts = append(contacts, contact)
+		}
+		assert.Equal(t, len(contacts), archive.RecordCount)
+		return contacts
+	}
+
+	nov10 := time.Date(2017, 11, 10, 0, 0, 0, 0, time.UTC)
+	contacts := readContacts(&Archive{Org: orgs[0], OrgID: orgs[0].ID, ArchiveType: ContactType, Period: DayPeriod, StartDate: nov10})
+	assert.Equal(t, []map[string]interface{}{{
+		"id":       float64(1),
+		"uuid":     "c7a2dd87-a80e-420b-8431-ca48d422e924",
+		"name":     nil,
+		"language": "eng",
+		"status":   "active",
+		"fields":   map[string]interface{}{},
+		"urns": []interface{}{
+			map[string]interface{}{"scheme": "tel", "path": "+12067791111", "display": nil},
+			map[string]interface{}{"scheme": "tel", "path": "+12067792222", "display": nil},
+		},
+		"groups": []interface{}{
+			map[string]interface{}{"uuid": "4ea0f313-2f62-4e57-bdf0-232b5191dd57", "name": "Group 1"},
+			map[string]interface{}{"uuid": "529bac39-550a-4d6f-817c-1833f3449007", "name": "Group 4"},
+		},
+	}}, contacts)
+
+	// archives are snapshots of contacts as they are when built
+	_, err = db.Exec(`UPDATE contacts_contact SET name = 'Eric Newcomer', is_blocked = TRUE WHERE id = 1`)
+	assert.NoError(t, err)
+	contacts = readContacts(&Archive{Org: orgs[0], OrgID: orgs[0].ID, ArchiveType: ContactType, Period: DayPeriod, StartDate: nov10})
+	assert.Equal(t, 1, len(contacts))
+	assert.Equal(t, "Eric Newcomer", contacts[0]["name"])
+	assert.Equal(t, "blocked", contacts[0]["status"])
+
+	// and leave out contacts which have been deactivated
+	_, err = db.Exec(`UPDATE contacts_contact SET is_active = FALSE WHERE id = 1`)
+	assert.NoError(t, err)
+	contacts = readContacts(&Archive{Org: orgs[0], OrgID: orgs[0].ID, ArchiveType: ContactType, Period: DayPeriod, StartDate: nov10})
+	assert.Equal(t, 0, len(contacts))
+
+	// anon orgs never have names, fields or URNs written
+	_, err = db.Exec(`UPDATE contacts_contact SET fields = '{"1b8e4f3a-8c6d-4f5e-9a2b-3c4d5e6f7a8b": {"text": "23"}}' WHERE id = 7`)
+	assert.NoError(t, err)
+	contacts = readContacts(&Archive{Org: orgs[2], OrgID: orgs[2].ID, ArchiveType: ContactType, Period: DayPeriod, StartDate: nov10})
+	assert.Equal(t, 1, len(contacts))
+	assert.Equal(t, "7051dff0-0a27-49d7-af1f-4494239139e6", contacts[0]["uuid"])
+	assert.Nil(t, contacts[0]["name"])
+	assert.Equal(t, map[string]interface{}{}, contacts[0]["fields"])
+	hash := sha256.Sum256([]byte("tel:+12067798888"))
+	assert.Equal(t, []interface{}{map[string]interface{}{"scheme": "tel", "hash": hex.EncodeToString(hash[:])}}, contacts[0]["urns"])
+
+	// contacts are archived every day like other types
+	tasks, err := GetMissingDailyArchives(ctx, db, now, orgs[1], ContactType)
+	assert.NoError(t, err)
+	assert.Equal(t, 62, len(tasks))
+
+	// but their records are never deleted
+	archive := tasks[0]
+	assert.NoError(t, CreateArchiveFile(ctx, db, config, archive, "/tmp"))
+	defer DeleteArchiveFile(archive)
+	assert.NoError(t, UploadArchive(ctx, config, s3Client, "dl-archiver-test", archive))
+	assert.False(t, archive.NeedsDeletion)
+
+	deleted, err := DeleteArchivedOrgRecords(ctx, now, config, db, s3Client, orgs[1], ContactType)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(deleted))
+	assertCount(t, db, 4, `SELECT count(*) FROM contacts_contact WHERE org_id = 2`)
+}
+
+func TestDeleteArchivedContacts(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+
+	config := NewConfig()
+	config.ArchiveContacts = true
+	config.Delete = true
+	config.DeleteContacts = true
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	// contacts nothing references any more, one in a group and a broadcast, one modified after we archive it and one
+	// with a ticket
+	_, err = db.Exec(`
+		INSERT INTO contacts_contact(id, is_active, created_by_id, created_on, modified_by_id, modified_on, org_id, is_blocked, name, language, uuid, is_stopped) VALUES
+		(11, TRUE, -1, '2017-08-15 10:00:00+00', -1, '2017-08-15 10:00:00+00', 2, FALSE, 'Ann Other', NULL, 'f4b2e8a6-2c3d-4e5f-9a8b-7c6d5e4f3a2b', FALSE),
+		(12, TRUE, -1, '2017-08-15 11:00:00+00', -1, '2099-01-01 00:00:00+00', 2, FALSE, 'Bob Later', NULL, '0d9c8b7a-6f5e-4d3c-2b1a-0f9e8d7c6b5a', FALSE),
+		(13, TRUE, -1, '2017-09-15 10:00:00+00', -1, '2017-09-15 10:00:00+00', 2, FALSE, 'Cat Ticket', NULL, '5e1f3a7b-9c2d-4e6f-8a0b-1c2d3e4f5a6b', FALSE),
+		(14, TRUE, -1, '2017-09-16 10:00:00+00', -1, '2017-09-16 10:00:00+00', 2, FALSE, 'Dan Gone', NULL, '8a7b6c5d-4e3f-4a1b-9c8d-7e6f5a4b3c2d', FALSE);
+		INSERT INTO contacts_contacturn(id, contact_id, scheme, org_id, priority, path, display, identity) VALUES
+		(20, 11, 'tel', 2, 50, '+12067790011', NULL, 'tel:+12067790011');
+		INSERT INTO contacts_contactgroup_contacts(id, contact_id, contactgroup_id) VALUES (10, 11, 2);
+		INSERT INTO msgs_broadcast_contacts(id, broadcast_id, contact_id) VALUES (10, 2, 11);
+		INSERT INTO tickets_ticket(id, uuid, status, opened_on, contact_id, org_id) VALUES
+		(1, '2c4e6a8b-0d1f-4a3c-8e5b-7d9f1a3c5e7b', 'O', '2017-09-20 10:00:00+00', 13, 2);`)
+	assert.NoError(t, err)
+
+	result, err := ArchiveOrgPhasesWithResult(ctx, now, config, db, s3Client, orgs[1], ContactType, AllPhases)
+	assert.NoError(t, err)
+
+	// our unreferenced contacts are deleted, removed from their group and broadcast, and their URNs freed
+	assertCount(t, db, 0, `SELECT count(*) FROM contacts_contact WHERE id IN (11, 14)`)
+	assertCount(t, db, 0, `SELECT count(*) FROM contacts_contactgroup_contacts WHERE contact_id = 11`)
+	assertCount(t, db, 0, `SELECT count(*) FROM msgs_broadcast_contacts WHERE contact_id = 11`)
+	assertCount(t, db, 1, `SELECT count(*) FROM contacts_contacturn WHERE id = 20 AND contact_id IS NULL`)
+
+	// contacts with a ticket, or which changed since their archive was built, are kept and their archives wait for them
+	assertCount(t, db, 2, `SELECT count(*) FROM contacts_contact WHERE id IN (12, 13)`)
+	if assert.Equal(t, 2, len(result.Failed())) {
+		assert.EqualError(t, result.Failed()[0].Err, "1 contacts in archive are still referenced or were modified since, waiting for them to be deleted")
+	}
+	assertCount(t, db, 2, `SELECT count(*) FROM archives_archive WHERE org_id = 2 AND archive_type = 'contact' AND period = 'M' AND needs_deletion = TRUE`)
+
+	// once its ticket is gone so is our contact, and september's archives are deleted
+	_, err = db.Exec(`DELETE FROM tickets_ticket WHERE contact_id = 13`)
+	assert.NoError(t, err)
+
+	deleted, err := DeleteArchivedOrgRecords(ctx, now, config, db, s3Client, orgs[1], ContactType)
+	assert.NoError(t, err)
+	assert.NotEqual(t, 0, len(deleted))
+	assertCount(t, db, 0, `SELECT count(*) FROM contacts_contact WHERE id = 13`)
+	assertCount(t, db, 0, `SELECT count(*) FROM archives_archive WHERE org_id = 2 AND archive_type = 'contact' AND start_date >= '2017-09-01' AND start_date < '2017-10-01' AND needs_deletion = TRUE`)
+
+	// august still waits on the contact modified since
+	assertCount(t, db, 1, `SELECT count(*) FROM contacts_contact WHERE id = 12`)
+	assertCount(t, db, 1, `SELECT count(*) FROM archives_archive WHERE org_id = 2 AND archive_type = 'contact' AND period = 'M' AND needs_deletion = TRUE`)
+
+	// the contacts of other orgs are never touched
+	assertCount(t, db, 4, `SELECT count(*) FROM contacts_contact WHERE org_id = 1`)
+}
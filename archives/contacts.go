@@ -0,0 +1,138 @@
+package archives
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// contactCounter counts the distinct contacts of the records written to an archive, keeping a sketch of them too so
+// monthlies can estimate theirs from their dailies
+type contactCounter struct {
+	contacts map[string]bool
+	sketch   *hyperLogLog
+}
+
+// newContactCounter returns a contact counter if contact counts are enabled, nil otherwise
+func newContactCounter(config *Config) *contactCounter {
+	if !config.ComputeContactCounts {
+		return nil
+	}
+	return &contactCounter{contacts: make(map[string]bool), sketch: newHyperLogLog()}
+}
+
+// add adds the contact of the passed in JSON record, it is safe to call on a nil counter
+func (c *contactCounter) add(record string) {
+	if c == nil {
+		return
+	}
+
+	parsed := &struct {
+		Contact *struct {
+			UUID string `json:"uuid"`
+		} `json:"contact"`
+	}{}
+	if err := json.Unmarshal([]byte(record), parsed); err != nil || parsed.Contact == nil {
+		return
+	}
+
+	if !c.contacts[parsed.Contact.UUID] {
+		c.contacts[parsed.Contact.UUID] = true
+		c.sketch.add(parsed.Contact.UUID)
+	}
+}
+
+// record sets the exact contact count and sketch of the passed in archive, it does nothing on a nil counter
+func (c *contactCounter) record(archive *Archive) {
+	if c == nil {
+		return
+	}
+
+	count := len(c.contacts)
+	archive.ContactCount = &count
+	archive.ContactSketch = c.sketch.bytes()
+}
+
+const selectContactSketches = `
+SELECT archive_id, sketch FROM archiver_archive_contacts WHERE archive_id = ANY($1)
+`
+
+// rollupContactCount estimates the distinct contacts of the passed in monthly by merging the sketches of its dailies.
+// Dailies built before we counted contacts have no sketch, in which case the monthly has no count either.
+func rollupContactCount(ctx context.Context, db *sqlx.DB, monthly *Archive, dailies []*Archive) error {
+	ids := make([]int, 0, len(dailies))
+	for _, daily := range dailies {
+		if daily.RecordCount > 0 {
+			ids = append(ids, daily.ID)
+		}
+	}
+
+	rows, err := db.QueryxContext(ctx, selectContactSketches, pq.Array(ids))
+	if err != nil {
+		return errors.Wrapf(err, "error selecting contact sketches")
+	}
+	defer rows.Close()
+
+	sketch := newHyperLogLog()
+	found := 0
+	for rows.Next() {
+		var id int
+		var b []byte
+		err = rows.Scan(&id, &b)
+		if err != nil {
+			return errors.Wrapf(err, "error scanning contact sketch")
+		}
+
+		daily, err := hyperLogLogFromBytes(b)
+		if err != nil {
+			return errors.Wrapf(err, "error reading contact sketch of archive: %d", id)
+		}
+		sketch.merge(daily)
+		found++
+	}
+	if err = rows.Err(); err != nil {
+		return errors.Wrapf(err, "error reading contact sketches")
+	}
+
+	if found < len(ids) {
+		logrus.WithFields(logrus.Fields{
+			"org_id":     monthly.Org.ID,
+			"start_date": monthly.StartDate,
+			"missing":    len(ids) - found,
+		}).Warn("dailies without contact counts, not counting contacts of monthly")
+		return nil
+	}
+
+	count := sketch.count()
+	monthly.ContactCount = &count
+	monthly.ContactSketch = sketch.bytes()
+	return nil
+}
+
+const upsertArchiveContacts = `
+INSERT INTO archiver_archive_contacts(archive_id, contact_count, sketch) VALUES($1, $2, $3)
+ON CONFLICT (archive_id) DO UPDATE SET contact_count = EXCLUDED.contact_count, sketch = EXCLUDED.sketch
+`
+
+const deleteArchiveContacts = `
+DELETE FROM archiver_archive_contacts WHERE archive_id = $1
+`
+
+// writeArchiveContacts stores the contact count of the passed in archive, removing any count it had from before it
+// was rebuilt if we didn't count its contacts this time
+func writeArchiveContacts(ctx context.Context, tx *sqlx.Tx, archive *Archive) error {
+	var err error
+	if archive.ContactCount == nil {
+		_, err = tx.ExecContext(ctx, deleteArchiveContacts, archive.ID)
+	} else {
+		_, err = tx.ExecContext(ctx, upsertArchiveContacts, archive.ID, *archive.ContactCount, archive.ContactSketch)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error writing archive contact count")
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package archives
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var leftBehindRecords = newCounter("archiver_records_left_behind_total", "Number of records left in the period of an archive deleted by its contents because they weren't in it.", "archive_type")
+
+// archiveIDs are the ids of the records of an archive, spooled to a temp file as they are read from S3 so that the
+// ids of even the largest archives are never held in memory
+type archiveIDs struct {
+	file  *os.File
+	count int
+}
+
+// spoolArchiveIDs streams the object of the passed in archive from S3 and writes the id of each of its records to a
+// temp file, checking the object matches its archive
+func spoolArchiveIDs(ctx context.Context, config *Config, s3Client Storage, archive *Archive) (*archiveIDs, error) {
+	reader, err := OpenArchive(ctx, s3Client, archive)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading S3 URL: %s", archive.URL)
+	}
+	defer reader.Close()
+
+	file, err := ioutil.TempFile(config.TempDir, fmt.Sprintf("ids_%d_", archive.ID))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating ids file")
+	}
+	ids := &archiveIDs{file: file}
+
+	writer := bufio.NewWriter(file)
+	record := &struct {
+		ID *int64 `json:"id"`
+	}{}
+	buf := make([]byte, 8)
+	for {
+		raw, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			record.ID = nil
+			err = json.Unmarshal(raw, record)
+		}
+		if err == nil && record.ID == nil {
+			err = fmt.Errorf("record %d has no id", ids.count+1)
+		}
+		if err != nil {
+			ids.Close()
+			return nil, errors.Wrapf(err, "error reading id of record in archive: %d", archive.ID)
+		}
+
+		binary.BigEndian.PutUint64(buf, uint64(*record.ID))
+		writer.Write(buf)
+		ids.count++
+	}
+
+	err = writer.Flush()
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		ids.Close()
+		return nil, errors.Wrapf(err, "error writing ids file")
+	}
+	return ids, nil
+}
+
+// forEachBatch calls the passed in function with our ids in batches of the passed in size, in the order of our archive
+func (a *archiveIDs) forEachBatch(size int, fn func([]int64) error) error {
+	reader := bufio.NewReader(a.file)
+	buf := make([]byte, 8)
+	batch := make([]int64, 0, size)
+
+	for read := 0; read < a.count; read++ {
+		_, err := io.ReadFull(reader, buf)
+		if err != nil {
+			return errors.Wrapf(err, "error reading ids file")
+		}
+		batch = append(batch, int64(binary.BigEndian.Uint64(buf)))
+
+		if len(batch) == size {
+			err = fn(batch)
+			if err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+
+	if len(batch) > 0 {
+		return fn(batch)
+	}
+	return nil
+}
+
+// Close closes and removes our temp file
+func (a *archiveIDs) Close() error {
+	a.file.Close()
+	return os.Remove(a.file.Name())
+}
+
+const countMsgsLeftBehind = `
+SELECT count(*) FROM msgs_msg WHERE org_id = $1 AND created_on >= $2 AND created_on < $3
+`
+
+const countRunsLeftBehind = `
+SELECT count(*) FROM flows_flowrun WHERE org_id = $1 AND %s >= $2 AND %[1]s < $3
+`
+
+// deleteArchiveContents deletes exactly the records in the object of the passed in archive, in batches using the
+// passed in function, rather than those in its period. Records in its period which aren't in it, such as those left
+// out by an extra filter, are left behind and reported. This is slower as we read our archive back from S3, but we
+// only ever delete records we know are in it.
+func deleteArchiveContents(ctx context.Context, config *Config, db *sqlx.DB, s3Client Storage, archive *Archive, deleteBatch func(context.Context, *sqlx.DB, []int64) error) error {
+	ids, err := spoolArchiveIDs(ctx, config, s3Client, archive)
+	if err != nil {
+		return errors.Wrap(err, "refusing to delete, unable to read ids of archive")
+	}
+	defer ids.Close()
+
+	if ids.count != archive.RecordCount {
+		return fmt.Errorf("refusing to delete, archive: %d has %d records but its object has %d", archive.ID, archive.RecordCount, ids.count)
+	}
+
+	err = ids.forEachBatch(deleteTransactionSize, func(batch []int64) error {
+		return deleteBatch(ctx, db, batch)
+	})
+	if err != nil {
+		return err
+	}
+
+	query := countMsgsLeftBehind
+	switch archive.ArchiveType {
+	case RunType:
+		field, err := runPartitionField(config)
+		if err != nil {
+			return err
+		}
+		query = fmt.Sprintf(countRunsLeftBehind, field)
+	case ContactType:
+		query = countContactsInRange
+	case SessionType:
+		query = countSessionsInRange
+	case BroadcastType:
+		query = countBroadcastsLeftBehind
+	case ChannelEventType:
+		query = countChannelEventsInRange
+	}
+
+	var leftBehind int
+	err = db.GetContext(ctx, &leftBehind, query, archive.OrgID, archive.StartDate, archive.EndDate())
+	if err != nil {
+		return errors.Wrapf(err, "error counting records left behind")
+	}
+
+	log := logrus.WithFields(logrus.Fields{"id": archive.ID, "deleted": ids.count})
+	if leftBehind > 0 {
+		leftBehindRecords.add(float64(leftBehind), string(archive.ArchiveType))
+		log.WithField("left_behind", leftBehind).Info("deleted records of archive, leaving those in its period not in it")
+	} else {
+		log.Debug("deleted records of archive")
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package archives
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpoolArchiveIDs(t *testing.T) {
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+	config := NewConfig()
+	config.TempDir = t.TempDir()
+
+	gzipped := func(body string) []byte {
+		b := &bytes.Buffer{}
+		w := gzip.NewWriter(b)
+		w.Write([]byte(body))
+		w.Close()
+		return b.Bytes()
+	}
+
+	archive := &Archive{ID: 12, URL: s3Client.putObject("dl-archiver-test", "/2/ids.jsonl.gz", gzipped(`{"id":5,"text":"a"}
+{"id":3}
+{"id":9000000000}
+`))}
+
+	ids, err := spoolArchiveIDs(ctx, config, s3Client, archive)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, ids.count)
+
+	batches := make([][]int64, 0)
+	err = ids.forEachBatch(2, func(batch []int64) error {
+		batches = append(batches, append([]int64(nil), batch...))
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]int64{{5, 3}, {9000000000}}, batches)
+
+	// our temp file is removed once closed
+	name := ids.file.Name()
+	assert.NoError(t, ids.Close())
+	_, err = os.Stat(name)
+	assert.True(t, os.IsNotExist(err))
+
+	// records without ids can't be deleted by their contents
+	archive.URL = s3Client.putObject("dl-archiver-test", "/2/noids.jsonl.gz", gzipped(`{"id":5}
+{"uuid":"abc"}
+`))
+	_, err = spoolArchiveIDs(ctx, config, s3Client, archive)
+	assert.EqualError(t, err, "error reading id of record in archive: 12: record 2 has no id")
+
+	files, _ := ioutil.ReadDir(config.TempDir)
+	assert.Equal(t, 0, len(files))
+}
+
+func TestDeleteByArchiveContents(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+
+	config := NewConfig()
+	config.TempDir = t.TempDir()
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	// our dailies are built leaving out the messages of channel 2
+	config.MessageExtraFilter = "mm.channel_id IS DISTINCT FROM 2"
+	created, err := GetMissingDailyArchives(ctx, db, now, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.NoError(t, createArchives(ctx, db, config, s3Client, orgs[1], created))
+	assert.Equal(t, time.Date(2017, 8, 12, 0, 0, 0, 0, time.UTC), created[2].StartDate)
+	assert.Equal(t, 2, created[2].RecordCount)
+
+	// but by the time we delete, the period of the 12th no longer matches what we archived
+	config.MessageExtraFilter = ""
+
+	err = DeleteArchivedMessages(ctx, config, db, s3Client, created[2])
+	assert.EqualError(t, err, "more messages in the database: 3 than in archive: 2")
+	assertCount(t, db, 4, `SELECT count(*) FROM msgs_msg WHERE id IN (1, 2, 3, 9)`)
+
+	// deleting by contents deletes exactly the messages in our archive, leaving those of channel 2 behind
+	config.DeleteByArchiveContents = true
+	err = DeleteArchivedMessages(ctx, config, db, s3Client, created[2])
+	assert.NoError(t, err)
+	assertCount(t, db, 0, `SELECT count(*) FROM msgs_msg WHERE id IN (3, 9)`)
+	assertCount(t, db, 2, `SELECT count(*) FROM msgs_msg WHERE id IN (1, 2)`)
+	assertCount(t, db, 1, `SELECT count(*) FROM archives_archive WHERE id = $1 AND needs_deletion = FALSE AND deleted_on IS NOT NULL`, created[2].ID)
+
+	// an archive whose object doesn't have all its records isn't deleted at all
+	created[1].RecordCount = 1
+	err = DeleteArchivedMessages(ctx, config, db, s3Client, created[1])
+	assert.EqualError(t, err, fmt.Sprintf("refusing to delete, archive: %d has 1 records but its object has 0", created[1].ID))
+	assertCount(t, db, 1, `SELECT count(*) FROM archives_archive WHERE id = $1 AND needs_deletion = TRUE`, created[1].ID)
+
+	// runs are deleted by their contents too
+	runs, err := GetMissingDailyArchives(ctx, db, now, orgs[1], RunType)
+	assert.NoError(t, err)
+	assert.NoError(t, createArchives(ctx, db, config, s3Client, orgs[1], runs))
+	assert.Equal(t, time.Date(2017, 8, 12, 0, 0, 0, 0, time.UTC), runs[2].StartDate)
+
+	err = DeleteArchivedRuns(ctx, config, db, s3Client, runs[2])
+	assert.NoError(t, err)
+	assertCount(t, db, 0, `SELECT count(*) FROM flows_flowrun WHERE id IN (1, 2)`)
+}
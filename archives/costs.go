@@ -0,0 +1,94 @@
+package archives
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+var (
+	orgStorageBytes = newGauge("archiver_org_storage_bytes", "Size of the archives of an org.", "org_id")
+	orgStorageCost  = newGauge("archiver_org_storage_cost_monthly", "Estimated monthly cost of storing the archives of an org.", "org_id", "storage_class")
+)
+
+// OrgStorageCost is the estimated monthly cost of storing the archives of an org
+type OrgStorageCost struct {
+	OrgID        int    `db:"org_id"`
+	OrgName      string `db:"org_name"`
+	ArchiveCount int    `db:"archive_count"`
+	Size         int64  `db:"size"`
+	StorageClass string
+	MonthlyCost  float64
+}
+
+// dailies which have been rolled up are still stored so we count every archive
+const lookupOrgStorage = `
+SELECT o.id as org_id, o.name as org_name, count(a.id) as archive_count, COALESCE(SUM(a.size), 0) as size
+FROM orgs_org o JOIN archives_archive a ON a.org_id = o.id
+GROUP BY o.id, o.name
+ORDER BY o.id
+`
+
+// EstimateStorageCosts estimates the monthly cost of storing the archives of each org with archives, using the sizes
+// we recorded for them and our configured price per GB-month of our storage class
+func EstimateStorageCosts(ctx context.Context, db *sqlx.DB, config *Config) ([]*OrgStorageCost, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute*5)
+	defer cancel()
+
+	costs := make([]*OrgStorageCost, 0)
+	err := db.SelectContext(ctx, &costs, lookupOrgStorage)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error calculating org storage")
+	}
+
+	for _, c := range costs {
+		c.StorageClass = config.StorageClass
+		c.MonthlyCost = float64(c.Size) / (1 << 30) * config.StorageCostPerGB
+	}
+
+	return costs, nil
+}
+
+// RecordStorageCosts records the passed in storage costs in our metrics
+func RecordStorageCosts(costs []*OrgStorageCost) {
+	for _, c := range costs {
+		orgID := strconv.Itoa(c.OrgID)
+		orgStorageBytes.set(float64(c.Size), orgID)
+		orgStorageCost.set(c.MonthlyCost, orgID, c.StorageClass)
+	}
+}
+
+// WriteStorageCostReport writes the passed in storage costs to the passed in path as CSV
+func WriteStorageCostReport(path string, costs []*OrgStorageCost) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return errors.Wrapf(err, "error creating storage cost report")
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	writer.Write([]string{"org_id", "org_name", "archive_count", "size_bytes", "storage_class", "monthly_cost"})
+	for _, c := range costs {
+		writer.Write([]string{
+			strconv.Itoa(c.OrgID),
+			c.OrgName,
+			strconv.Itoa(c.ArchiveCount),
+			strconv.FormatInt(c.Size, 10),
+			c.StorageClass,
+			fmt.Sprintf("%.4f", c.MonthlyCost),
+		})
+	}
+	writer.Flush()
+
+	err = writer.Error()
+	if err != nil {
+		return errors.Wrapf(err, "error writing storage cost report")
+	}
+	return file.Close()
+}
@@ -0,0 +1,58 @@
+package archives
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEstimateStorageCosts(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+
+	config := NewConfig()
+	config.StorageCostPerGB = 0.01
+
+	// org 3 has three archives, org 2 has one
+	_, err := db.Exec(`UPDATE archives_archive SET size = 1073741824 WHERE org_id = 3`)
+	assert.NoError(t, err)
+	_, err = db.Exec(`UPDATE archives_archive SET size = 536870912 WHERE org_id = 2`)
+	assert.NoError(t, err)
+
+	costs, err := EstimateStorageCosts(ctx, db, config)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(costs))
+
+	assert.Equal(t, 2, costs[0].OrgID)
+	assert.Equal(t, 1, costs[0].ArchiveCount)
+	assert.Equal(t, int64(536870912), costs[0].Size)
+	assert.InDelta(t, 0.005, costs[0].MonthlyCost, 0.00001)
+
+	assert.Equal(t, 3, costs[1].OrgID)
+	assert.Equal(t, "Org 3", costs[1].OrgName)
+	assert.Equal(t, 3, costs[1].ArchiveCount)
+	assert.Equal(t, "STANDARD", costs[1].StorageClass)
+	assert.InDelta(t, 0.03, costs[1].MonthlyCost, 0.00001)
+
+	RecordStorageCosts(costs)
+	output := &bytes.Buffer{}
+	assert.NoError(t, WriteMetrics(output))
+	assert.Contains(t, output.String(), `archiver_org_storage_bytes{org_id="3"} 3221225472`)
+	assert.Contains(t, output.String(), `archiver_org_storage_cost_monthly{org_id="2",storage_class="STANDARD"} 0.005`)
+
+	dir, err := ioutil.TempDir("", "costs")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "costs.csv")
+	assert.NoError(t, WriteStorageCostReport(path, costs))
+
+	contents, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "org_id,org_name,archive_count,size_bytes,storage_class,monthly_cost\n2,Org 2,1,536870912,STANDARD,0.0050\n3,Org 3,3,3221225472,STANDARD,0.0300\n", string(contents))
+}
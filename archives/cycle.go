@@ -0,0 +1,422 @@
+package archives
+
+import (
+	"context"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+)
+
+// CycleDeps are what our archiving cycles depend on beyond our config, our clock and sleeping can be replaced so that
+// cycles can be run in tests without waiting for them
+type CycleDeps struct {
+	DB       *sqlx.DB
+	S3Client Storage
+
+	// ReopenDB opens a new connection to our database, used when we fail to list our orgs or our credentials are refused
+	ReopenDB func() (*sqlx.DB, error)
+
+	// ActiveOrgs lists the orgs we archive, GetActiveOrgs unless set
+	ActiveOrgs func(ctx context.Context, db *sqlx.DB, config *Config) ([]Org, error)
+
+	// Clock returns our time, time.Now unless set
+	Clock func() time.Time
+
+	// Sleep waits for the passed in duration or until our context is done, whichever is first, unless set
+	Sleep func(ctx context.Context, d time.Duration)
+}
+
+func (d *CycleDeps) now() time.Time {
+	if d.Clock != nil {
+		return d.Clock()
+	}
+	return time.Now()
+}
+
+func (d *CycleDeps) sleep(ctx context.Context, duration time.Duration) {
+	if d.Sleep != nil {
+		d.Sleep(ctx, duration)
+		return
+	}
+
+	select {
+	case <-time.After(duration):
+	case <-ctx.Done():
+	}
+}
+
+// reopenDB replaces our database with a new connection to it if we can open one, logging if we can't
+func (d *CycleDeps) reopenDB() {
+	if d.ReopenDB == nil {
+		return
+	}
+	reopened, err := d.ReopenDB()
+	if err != nil {
+		logrus.WithError(err).Error("error reopening database")
+		return
+	}
+	d.DB = reopened
+}
+
+func (d *CycleDeps) activeOrgs(ctx context.Context, config *Config) ([]Org, error) {
+	var orgs []Org
+	var err error
+	if d.ActiveOrgs != nil {
+		orgs, err = d.ActiveOrgs(ctx, d.DB, config)
+	} else {
+		orgs, err = GetActiveOrgs(ctx, d.DB, config)
+	}
+	if err != nil || !config.ArchiveInactive {
+		return orgs, err
+	}
+
+	// inactive orgs are archived too if configured
+	return AddInactiveOrgs(ctx, d.DB, config, d.now(), orgs)
+}
+
+// retentionNow returns the time retention is evaluated from, our time or our database's if configured
+func (d *CycleDeps) retentionNow(ctx context.Context, config *Config) (time.Time, error) {
+	if config.UseDBTime {
+		return Now(ctx, d.DB, config)
+	}
+	return d.now(), nil
+}
+
+// how long we wait before trying again when we can't list our orgs or our clock is too far from our database's
+var cycleRetryWait = time.Minute * 5
+
+// OrgRun is when we archived an org during a cycle
+type OrgRun struct {
+	OrgID      int
+	StartedOn  time.Time
+	FinishedOn time.Time
+}
+
+// CycleResult is the outcome of a single archiving cycle
+type CycleResult struct {
+	StartedOn time.Time
+	Orgs      []Org
+	OrgRuns   []*OrgRun
+	Failures  []*Failure
+	Overran   bool
+}
+
+// RunCycle runs the passed in phases for each of our active orgs, one org at a time, returning an error only if we
+// couldn't start archiving at all
+func RunCycle(ctx context.Context, config *Config, deps *CycleDeps, phases []Phase) (*CycleResult, error) {
+	result := &CycleResult{StartedOn: deps.now().In(time.UTC), OrgRuns: make([]*OrgRun, 0), Failures: make([]*Failure, 0)}
+
+	// get our active orgs
+	listCtx, cancel := context.WithTimeout(ctx, time.Minute)
+	orgs, err := deps.activeOrgs(listCtx, config)
+	cancel()
+	if err != nil {
+		return nil, &cycleStartError{reopen: true, err: err, msg: "error getting active orgs"}
+	}
+
+	// clocks drift, check ours is still close enough to our database's before each run
+	_, err = CheckClockSkew(ctx, deps.DB, config)
+	if err != nil {
+		return nil, &cycleStartError{err: err, msg: "clock skew with database, skipping run"}
+	}
+
+	orgs = scheduleOrgs(ctx, config, deps, orgs)
+	result.Orgs = orgs
+
+	// each run may count the records of only so many archives migrated without record counts
+	ResetCountReconciles(config)
+
+	// let tools run by hand know we're archiving
+	stopHeartbeat := StartHeartbeat(deps.DB)
+	defer stopHeartbeat()
+
+	// for each org, run the phases which are due, one org at a time whichever phases they are
+	logrus.WithField("phases", phases).Info("starting archiving")
+	for i, org := range orgs {
+		WaitUntilEnabled(ctx, deps.DB, time.Minute)
+
+		// once we've run too long the rest of our orgs wait for our next run
+		if cycleOverrun(config, deps, result.StartedOn) {
+			skipOrgs(config, orgs[i:])
+			result.Overran = true
+			break
+		}
+
+		run := &OrgRun{OrgID: org.ID, StartedOn: deps.now()}
+		result.Failures = append(result.Failures, archiveCycleOrg(ctx, config, deps, org, phases, result.StartedOn)...)
+		run.FinishedOn = deps.now()
+		result.OrgRuns = append(result.OrgRuns, run)
+	}
+
+	// spend any remaining budget upgrading archives built with an older record format
+	if config.ReArchiveBudgetMinutes > 0 && config.ContactGroupID == 0 && !result.Overran && HasPhase(phases, PhaseCreate) {
+		reArchiveOrgs(config, deps, orgs)
+	}
+
+	return result, nil
+}
+
+// cycleStartError is why a cycle couldn't start archiving
+type cycleStartError struct {
+	reopen bool
+	err    error
+	msg    string
+}
+
+func (e *cycleStartError) Error() string {
+	return e.msg + ": " + e.err.Error()
+}
+
+// archiveCycleOrg runs the passed in phases for each type of archive of the passed in org, returning any failures
+func archiveCycleOrg(ctx context.Context, config *Config, deps *CycleDeps, org Org, phases []Phase, startedOn time.Time) []*Failure {
+	// no single org should take more than 12 hours
+	ctx, cancel := context.WithTimeout(ctx, time.Hour*12)
+	defer cancel()
+
+	log := logrus.WithField("org", org.Name).WithField("org_id", org.ID)
+	failures := make([]*Failure, 0)
+
+	// retention is evaluated from our time, or our database's if configured
+	now, err := deps.retentionNow(ctx, config)
+	if err != nil {
+		log.WithError(err).Error("error getting current time, skipping org")
+		return failures
+	}
+
+	// some orgs are owed a log of what we archived and deleted for them
+	activity, err := StartActivityLog(ctx, config, deps.DB, org, startedOn)
+	if err != nil {
+		log.WithError(err).Error("error starting activity log")
+	}
+
+	for _, archiveType := range plannedTypes(config) {
+		result, err := ArchiveOrgPhasesRecovering(ctx, now, config, deps.DB, deps.S3Client, org, archiveType, phases)
+
+		// archives which failed don't stop us archiving the org, but do fail our run
+		failed := result.Failures()
+		if len(failed) > 0 {
+			log.WithFields(result.Fields()).WithField("archive_type", archiveType).Errorf("failed to archive %d %s archives", len(failed), archiveType)
+			failures = append(failures, failed...)
+		}
+
+		if err != nil {
+			log.WithError(err).WithField("archive_type", archiveType).Errorf("error archiving org %ss", archiveType)
+			failures = append(failures, NewFailure(org, archiveType, err))
+			activity.Failed(archiveType, err)
+
+			// credentials can be rotated under us, reconnect with fresh ones rather than failing every org after this
+			if isAuthError(err) {
+				deps.reopenDB()
+			}
+		}
+	}
+
+	// the checksums of whatever archives the org now has, for checking downloads of them
+	if config.ChecksumsManifest && config.UploadToS3 && config.ContactGroupID == 0 {
+		_, err = WriteChecksumsManifest(ctx, config, deps.DB, deps.S3Client, org)
+		if err != nil {
+			log.WithError(err).Error("error writing checksums manifest")
+		}
+	}
+
+	// whatever happened, the org gets a log of it
+	_, err = activity.Flush(ctx, config, deps.S3Client)
+	if err != nil {
+		log.WithError(err).Error("error writing activity log")
+	}
+
+	return failures
+}
+
+// RunCycles runs archiving cycles on our schedule until our context is done, or after a single cycle if we exit on
+// completion, returning the code we should exit with
+func RunCycles(ctx context.Context, config *Config, deps *CycleDeps, schedule []*PhaseRun) int {
+	// when we first start we run all our phases
+	phases := AllPhases
+
+	for ctx.Err() == nil {
+		// ops can pause us during incidents, wait until we're enabled before starting
+		WaitUntilEnabled(ctx, deps.DB, time.Minute)
+
+		result, err := RunCycle(ctx, config, deps, phases)
+		if err != nil {
+			logrus.WithError(err).Error("error starting archiving cycle")
+			deps.sleep(ctx, cycleRetryWait)
+
+			// after this, reopen db connection to prevent using the same in case of connection problem that we have faced sometimes with broken pipe error
+			if startErr, ok := err.(*cycleStartError); ok && startErr.reopen {
+				deps.reopenDB()
+			}
+			continue
+		}
+
+		if config.StorageCostReport != "" || config.MetricsPort != 0 {
+			reportStorageCosts(ctx, config, deps)
+		}
+
+		if config.ReportVolumeTrends || config.VolumeTrendsReport != "" {
+			reportVolumeTrends(ctx, config, deps)
+		}
+
+		// ok, we did all our work for our orgs, quit if so configured or sleep until the next day
+		if config.ExitOnCompletion {
+			return finishRun(config, deps, result.StartedOn, result.Failures)
+		}
+
+		// build up our next start, phases which were due while we were running start right away
+		run, nextStart := NextPhaseRun(schedule, result.StartedOn)
+		phases = run.Phases
+
+		napTime := nextStart.Sub(deps.now().In(time.UTC))
+
+		if napTime > time.Duration(0) {
+			logrus.WithField("time", napTime).WithField("next_start", nextStart).WithField("phases", phases).Info("Sleeping until next start")
+			deps.sleep(ctx, napTime)
+		} else {
+			logrus.WithField("next_start", nextStart).WithField("phases", phases).Info("Rebuilding immediately without sleep")
+		}
+	}
+	return 0
+}
+
+// scheduleOrgs returns the passed in orgs in the order we should archive them, in id order if we can't estimate them
+func scheduleOrgs(ctx context.Context, config *Config, deps *CycleDeps, orgs []Org) []Org {
+	if config.OrgSchedule == ScheduleByID {
+		return orgs
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	estimates, err := EstimateOrgWork(ctx, deps.DB, deps.now(), orgs)
+	if err != nil {
+		logrus.WithError(err).Error("error estimating org work, archiving orgs in id order")
+		return orgs
+	}
+
+	scheduled, err := ScheduleOrgs(estimates, config.OrgSchedule, config.SmallOrgThreshold)
+	if err != nil {
+		logrus.WithError(err).Error("error scheduling orgs, archiving orgs in id order")
+		return orgs
+	}
+	return scheduled
+}
+
+// cycleOverrun returns whether the run started at the passed in time has run longer than we allow
+func cycleOverrun(config *Config, deps *CycleDeps, start time.Time) bool {
+	return config.MaxCycleMinutes > 0 && deps.now().Sub(start) > time.Minute*time.Duration(config.MaxCycleMinutes)
+}
+
+// skipOrgs logs the orgs we didn't get to because our run went on too long
+func skipOrgs(config *Config, orgs []Org) {
+	orgIDs := make([]int, len(orgs))
+	for i, org := range orgs {
+		orgIDs[i] = org.ID
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"max_minutes": config.MaxCycleMinutes,
+		"skipped":     len(orgs),
+		"org_ids":     orgIDs,
+	}).Warn("run took too long, skipping remaining orgs until next run")
+}
+
+// reArchiveOrgs rebuilds outdated archives across our orgs until our re-archive budget is spent
+func reArchiveOrgs(config *Config, deps *CycleDeps, orgs []Org) {
+	deadline := time.Now().Add(time.Minute * time.Duration(config.ReArchiveBudgetMinutes))
+	rebuilt, skipped, remaining, superseded := 0, 0, 0, 0
+
+	for _, org := range orgs {
+		for _, archiveType := range plannedTypes(config) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Hour*12)
+			result, err := ReArchiveOrg(ctx, deadline, config, deps.DB, deps.S3Client, org, archiveType)
+			cancel()
+
+			if err != nil {
+				logrus.WithError(err).WithField("org_id", org.ID).WithField("archive_type", archiveType).Error("error re-archiving org")
+				continue
+			}
+
+			rebuilt += len(result.Rebuilt)
+			skipped += len(result.Skipped)
+			remaining += result.Remaining
+			superseded += len(result.Superseded)
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"rebuilt":    rebuilt,
+		"skipped":    skipped,
+		"remaining":  remaining,
+		"superseded": superseded,
+		"version":    ArchiveSchemaVersion,
+	}).Info("re-archive complete")
+}
+
+// reportStorageCosts estimates the storage cost of each org, recording them in our metrics and report if configured
+func reportStorageCosts(ctx context.Context, config *Config, deps *CycleDeps) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute*5)
+	defer cancel()
+
+	costs, err := EstimateStorageCosts(ctx, deps.DB, config)
+	if err != nil {
+		logrus.WithError(err).Error("error estimating storage costs")
+		return
+	}
+
+	RecordStorageCosts(costs)
+
+	if config.StorageCostReport != "" {
+		err = WriteStorageCostReport(config.StorageCostReport, costs)
+		if err != nil {
+			logrus.WithError(err).Error("error writing storage cost report")
+			return
+		}
+		logrus.WithField("orgs", len(costs)).WithField("path", config.StorageCostReport).Info("wrote storage cost report")
+	}
+}
+
+// reportVolumeTrends logs and records the volume trends of our orgs, writing them to our report if we have one
+func reportVolumeTrends(ctx context.Context, config *Config, deps *CycleDeps) {
+	trends, err := GetVolumeTrends(ctx, deps.DB)
+	if err != nil {
+		logrus.WithError(err).Error("error calculating volume trends")
+		return
+	}
+
+	RecordVolumeTrends(trends)
+
+	if config.VolumeTrendsReport != "" {
+		err = WriteVolumeTrendsReport(config.VolumeTrendsReport, trends)
+		if err != nil {
+			logrus.WithError(err).Error("error writing volume trends report")
+			return
+		}
+		logrus.WithField("trends", len(trends)).WithField("path", config.VolumeTrendsReport).Info("wrote volume trends report")
+	}
+}
+
+// finishRun writes the report for an exit-on-completion run if so configured, returning our exit code
+func finishRun(config *Config, deps *CycleDeps, startedOn time.Time, failures []*Failure) int {
+	report := NewRunReport(config, startedOn, failures)
+
+	if config.ReportPath != "" && (report.Status == RunFailed || config.WriteSuccessMarker) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		location, err := WriteRunReport(ctx, config, deps.S3Client, report)
+		cancel()
+
+		// failing to write our report is logged but never masks the failures we are reporting on
+		if err != nil {
+			logrus.WithError(err).Error("error writing run report")
+		} else {
+			logrus.WithField("location", location).WithField("status", report.Status).Info("wrote run report")
+		}
+	}
+
+	if report.Status == RunFailed {
+		logrus.WithField("failures", len(failures)).Error("archiver run completed with failures")
+		return 1
+	}
+	return 0
+}
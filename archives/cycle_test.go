@@ -0,0 +1,133 @@
+package archives
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+// testClock is a clock for our cycles which moves on a second each time it's read and by however long we sleep
+type testClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.now = c.now.Add(time.Second)
+	return c.now
+}
+
+func (c *testClock) advance(d time.Duration) time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.now = c.now.Add(d)
+	return c.now
+}
+
+func TestRunCycle(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+
+	config := NewConfig()
+	clock := &testClock{now: time.Date(2018, 1, 8, 23, 58, 0, 0, time.UTC)}
+	deps := &CycleDeps{DB: db, S3Client: newMockS3Client(), Clock: clock.Now}
+
+	result, err := RunCycle(ctx, config, deps, AllPhases)
+	assert.NoError(t, err)
+	assert.False(t, result.Overran)
+	assert.Equal(t, 0, len(result.Failures))
+	assert.Equal(t, time.Date(2018, 1, 8, 23, 58, 1, 0, time.UTC), result.StartedOn)
+
+	// each org is archived once, one at a time, in id order
+	assert.Equal(t, 3, len(result.OrgRuns))
+	for i, run := range result.OrgRuns {
+		assert.Equal(t, result.Orgs[i].ID, run.OrgID)
+		assert.False(t, run.FinishedOn.Before(run.StartedOn))
+		if i > 0 {
+			assert.True(t, run.StartedOn.After(result.OrgRuns[i-1].FinishedOn), "org %d started before org %d finished", run.OrgID, result.OrgRuns[i-1].OrgID)
+		}
+	}
+	assertCount(t, db, 61, `SELECT count(*) FROM archives_archive WHERE org_id = 2 AND archive_type = 'message' AND period = 'D' AND url != ''`)
+
+	// orgs we don't get to before our cycle runs too long wait for our next
+	config.MaxCycleMinutes = 1
+	deps.Clock = func() time.Time { return clock.advance(time.Minute) }
+	result, err = RunCycle(ctx, config, deps, AllPhases)
+	assert.NoError(t, err)
+	assert.True(t, result.Overran)
+	assert.Equal(t, 1, len(result.OrgRuns))
+}
+
+func TestRunCycles(t *testing.T) {
+	db := setup(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// our first cycle starts just before midnight on the day clocks change in Europe, which UTC knows nothing of
+	config := NewConfig()
+	clock := &testClock{now: time.Date(2018, 3, 24, 23, 58, 0, 0, time.UTC)}
+	schedule, err := SchedulePhases(config)
+	assert.NoError(t, err)
+
+	sleeps := make([]time.Duration, 0)
+	wakes := make([]time.Time, 0)
+	listed, reopened, failOn := 0, 0, 2
+
+	deps := &CycleDeps{
+		DB:       db,
+		S3Client: newMockS3Client(),
+		Clock:    clock.Now,
+		Sleep: func(ctx context.Context, d time.Duration) {
+			sleeps = append(sleeps, d)
+			wakes = append(wakes, clock.advance(d))
+			if len(sleeps) == 3 {
+				cancel()
+			}
+		},
+		ReopenDB: func() (*sqlx.DB, error) {
+			reopened++
+			return db, nil
+		},
+		ActiveOrgs: func(ctx context.Context, db *sqlx.DB, config *Config) ([]Org, error) {
+			listed++
+			if listed == failOn {
+				return nil, fmt.Errorf("broken pipe")
+			}
+			return GetActiveOrgs(ctx, db, config)
+		},
+	}
+
+	assert.Equal(t, 0, RunCycles(ctx, config, deps, schedule))
+
+	// we slept until after midnight, failed to list our orgs so waited and reconnected, then slept until the next day
+	assert.Equal(t, 3, len(sleeps))
+	assert.Equal(t, 3, listed)
+	assert.Equal(t, 1, reopened)
+	assert.Equal(t, time.Date(2018, 3, 25, 0, 1, 0, 0, time.UTC), wakes[0])
+	assert.Equal(t, cycleRetryWait, sleeps[1])
+	assert.Equal(t, time.Date(2018, 3, 26, 0, 1, 0, 0, time.UTC), wakes[2])
+
+	// exiting on completion we run a single cycle, exiting with an error if any org failed
+	config.ExitOnCompletion = true
+	config.RetentionPeriod = 1
+	config.MaxMissingArchivesWarn = 1
+	config.MaxMissingArchivesStrict = true
+
+	listed, failOn = 0, 0
+	assert.Equal(t, 1, RunCycles(context.Background(), config, deps, schedule))
+	assert.Equal(t, 1, listed)
+	assert.Equal(t, 3, len(sleeps))
+
+	config.MaxMissingArchivesStrict = false
+	assert.Equal(t, 0, RunCycles(context.Background(), config, deps, schedule))
+	assert.Equal(t, 2, listed)
+}
@@ -0,0 +1,76 @@
+package archives
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DateInput is a day or month given to us by hand, such as the day to rebuild, along with the window of records
+// [Start, End) it covers, always in UTC so it compares as expected against our timestamp columns
+type DateInput struct {
+	Period ArchivePeriod
+	Start  time.Time
+	End    time.Time
+}
+
+// String returns our date as YYYY-MM-DD for a day or YYYY-MM for a month
+func (d DateInput) String() string {
+	if d.Period == MonthPeriod {
+		return d.Start.Format("2006-01")
+	}
+	return d.Start.Format("2006-01-02")
+}
+
+// ParseDateInput parses a day as YYYY-MM-DD or a month as YYYY-MM, with or without its month and day zero padded, so
+// 2017-9-1 is the same day as 2017-09-01. Dates which aren't on the calendar, such as 2023-02-30, are errors.
+func ParseDateInput(value string) (DateInput, error) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) != 2 && len(parts) != 3 {
+		return DateInput{}, fmt.Errorf("invalid date '%s', format: YYYY-MM-DD or YYYY-MM", value)
+	}
+
+	numbers := make([]int, len(parts))
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || p == "" || p[0] == '+' || len(p) > 4 || (i > 0 && len(p) > 2) {
+			return DateInput{}, fmt.Errorf("invalid date '%s', format: YYYY-MM-DD or YYYY-MM", value)
+		}
+		numbers[i] = n
+	}
+
+	year, month := numbers[0], numbers[1]
+	if len(parts[0]) != 4 {
+		return DateInput{}, fmt.Errorf("invalid date '%s': year %d must have four digits", value, year)
+	}
+	if month < 1 || month > 12 {
+		return DateInput{}, fmt.Errorf("invalid date '%s': month %d isn't between 1 and 12", value, month)
+	}
+
+	start := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+	if len(numbers) == 2 {
+		return DateInput{Period: MonthPeriod, Start: start, End: start.AddDate(0, 1, 0)}, nil
+	}
+
+	day := numbers[2]
+	days := start.AddDate(0, 1, -1).Day()
+	if day < 1 || day > days {
+		return DateInput{}, fmt.Errorf("invalid date '%s': %s %d has %d days, not %d", value, start.Month(), year, days, day)
+	}
+
+	start = start.AddDate(0, 0, day-1)
+	return DateInput{Period: DayPeriod, Start: start, End: start.AddDate(0, 0, 1)}, nil
+}
+
+// ParseDayInput parses a day as ParseDateInput does, months aren't accepted
+func ParseDayInput(value string) (DateInput, error) {
+	date, err := ParseDateInput(value)
+	if err != nil {
+		return date, err
+	}
+	if date.Period != DayPeriod {
+		return DateInput{}, fmt.Errorf("invalid date '%s': read as the month %s but need a day, format: YYYY-MM-DD", value, date)
+	}
+	return date, nil
+}
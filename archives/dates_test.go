@@ -0,0 +1,69 @@
+package archives
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDateInput(t *testing.T) {
+	day := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, time.UTC) }
+
+	tcs := []struct {
+		value  string
+		period ArchivePeriod
+		start  time.Time
+		end    time.Time
+		err    string
+	}{
+		{value: "2017-09-01", period: DayPeriod, start: day(2017, 9, 1), end: day(2017, 9, 2)},
+		{value: "2017-9-1", period: DayPeriod, start: day(2017, 9, 1), end: day(2017, 9, 2)},
+		{value: "2017-09-1", period: DayPeriod, start: day(2017, 9, 1), end: day(2017, 9, 2)},
+		{value: " 2017-12-31 ", period: DayPeriod, start: day(2017, 12, 31), end: day(2018, 1, 1)},
+		{value: "2017-09", period: MonthPeriod, start: day(2017, 9, 1), end: day(2017, 10, 1)},
+		{value: "2017-9", period: MonthPeriod, start: day(2017, 9, 1), end: day(2017, 10, 1)},
+		{value: "2017-12", period: MonthPeriod, start: day(2017, 12, 1), end: day(2018, 1, 1)},
+
+		// leap years
+		{value: "2024-02-29", period: DayPeriod, start: day(2024, 2, 29), end: day(2024, 3, 1)},
+		{value: "2000-2-29", period: DayPeriod, start: day(2000, 2, 29), end: day(2000, 3, 1)},
+		{value: "2023-02-29", err: "invalid date '2023-02-29': February 2023 has 28 days, not 29"},
+		{value: "1900-02-29", err: "invalid date '1900-02-29': February 1900 has 28 days, not 29"},
+		{value: "2024-02", period: MonthPeriod, start: day(2024, 2, 1), end: day(2024, 3, 1)},
+
+		{value: "2023-02-30", err: "invalid date '2023-02-30': February 2023 has 28 days, not 30"},
+		{value: "2017-04-31", err: "invalid date '2017-04-31': April 2017 has 30 days, not 31"},
+		{value: "2017-09-00", err: "invalid date '2017-09-00': September 2017 has 30 days, not 0"},
+		{value: "2017-13-01", err: "invalid date '2017-13-01': month 13 isn't between 1 and 12"},
+		{value: "2017-0", err: "invalid date '2017-0': month 0 isn't between 1 and 12"},
+		{value: "17-09-01", err: "invalid date '17-09-01': year 17 must have four digits"},
+		{value: "2017-009-01", err: "invalid date '2017-009-01', format: YYYY-MM-DD or YYYY-MM"},
+		{value: "2017-+9-01", err: "invalid date '2017-+9-01', format: YYYY-MM-DD or YYYY-MM"},
+		{value: "2017/09/01", err: "invalid date '2017/09/01', format: YYYY-MM-DD or YYYY-MM"},
+		{value: "2017-09-01T00:00:00Z", err: "invalid date '2017-09-01T00:00:00Z', format: YYYY-MM-DD or YYYY-MM"},
+		{value: "2017--01", err: "invalid date '2017--01', format: YYYY-MM-DD or YYYY-MM"},
+		{value: "", err: "invalid date '', format: YYYY-MM-DD or YYYY-MM"},
+	}
+
+	for _, tc := range tcs {
+		date, err := ParseDateInput(tc.value)
+		if tc.err != "" {
+			assert.EqualError(t, err, tc.err, "unexpected error for %s", tc.value)
+			continue
+		}
+		assert.NoError(t, err, "unexpected error for %s", tc.value)
+		assert.Equal(t, tc.period, date.Period, "unexpected period for %s", tc.value)
+		assert.Equal(t, tc.start, date.Start, "unexpected start for %s", tc.value)
+		assert.Equal(t, tc.end, date.End, "unexpected end for %s", tc.value)
+		assert.Equal(t, time.UTC, date.Start.Location())
+	}
+
+	// days only accept days
+	date, err := ParseDayInput("2017-9-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "2017-09-01", date.String())
+
+	_, err = ParseDayInput("2017-9")
+	assert.EqualError(t, err, "invalid date '2017-9': read as the month 2017-09 but need a day, format: YYYY-MM-DD")
+}
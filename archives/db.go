@@ -0,0 +1,190 @@
+package archives
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// isConnectionError returns whether the passed in error was caused by our database connection being dropped, such as
+// the broken pipe errors we sometimes see on long running archives
+func isConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	cause := errors.Cause(err)
+	if cause == driver.ErrBadConn || cause == io.EOF || cause == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	// connection exceptions (08) and the server terminating our connection (57P)
+	if pqErr, ok := cause.(*pq.Error); ok {
+		code := string(pqErr.Code)
+		return strings.HasPrefix(code, "08") || strings.HasPrefix(code, "57P")
+	}
+
+	msg := cause.Error()
+	return strings.Contains(msg, "broken pipe") || strings.Contains(msg, "connection reset by peer")
+}
+
+// isAuthError returns whether the passed in error was caused by our database refusing our credentials, such as once
+// they've been rotated
+func isAuthError(err error) bool {
+	if pe, ok := err.(*PhaseError); ok {
+		err = pe.Err
+	}
+
+	// invalid authorization specification (28), such as a wrong password
+	if pqErr, ok := errors.Cause(err).(*pq.Error); ok {
+		return strings.HasPrefix(string(pqErr.Code), "28")
+	}
+	return false
+}
+
+// pinger is anything which can check our database connection, such as *sqlx.DB
+type pinger interface {
+	PingContext(ctx context.Context) error
+}
+
+// withConnectionRetry calls the passed in function, calling it a second time if it fails because our database
+// connection was dropped. We ping first only to check our database can be reached again, that doesn't discard the
+// dropped connection, which may well still be in our pool. It's the driver which marks a dropped connection as bad,
+// failing any later use of it with driver.ErrBadConn, which database/sql then discards and retries on another.
+func withConnectionRetry(ctx context.Context, db pinger, fn func() error) error {
+	err := fn()
+	if !isConnectionError(err) {
+		return err
+	}
+
+	logrus.WithError(err).Warn("lost database connection, retrying")
+
+	if pingErr := db.PingContext(ctx); pingErr != nil {
+		return errors.Wrapf(err, "unable to reconnect to database: %s", pingErr)
+	}
+
+	return fn()
+}
+
+// OpenDB opens a pool of connections to the passed in database. Our day boundaries are only right if every session is
+// in UTC, so we force it in our connection string, refusing any other timezone, and check it on every new connection.
+func OpenDB(dsn string) (*sqlx.DB, error) {
+	dsn, err := utcDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	var connector driver.Connector
+	connector, err = pq.NewConnector(dsn)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid db connection string")
+	}
+
+	db := sqlx.NewDb(sql.OpenDB(&utcConnector{connector}), "postgres")
+	db.SetMaxOpenConns(2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	err = db.PingContext(ctx)
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "unable to connect to db")
+	}
+	return db, nil
+}
+
+// utcDSN returns the passed in connection string with its timezone set to UTC, erroring if it sets any other
+func utcDSN(dsn string) (string, error) {
+	if strings.Contains(dsn, "://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return "", errors.Wrap(err, "invalid db connection string")
+		}
+		query := u.Query()
+		for key, values := range query {
+			if strings.EqualFold(key, "timezone") && (len(values) != 1 || values[0] != "UTC") {
+				return "", fmt.Errorf("invalid db connection string, archiver always uses UTC, not timezone: %s", strings.Join(values, ","))
+			}
+		}
+		query.Set("TimeZone", "UTC")
+		u.RawQuery = query.Encode()
+		return u.String(), nil
+	}
+
+	// otherwise this is a list of key=value settings
+	for _, setting := range strings.Fields(dsn) {
+		parts := strings.SplitN(setting, "=", 2)
+		if strings.EqualFold(parts[0], "timezone") {
+			if len(parts) != 2 || parts[1] != "UTC" {
+				return "", fmt.Errorf("invalid db connection string, archiver always uses UTC, not: %s", setting)
+			}
+			return dsn, nil
+		}
+	}
+	return dsn + " TimeZone=UTC", nil
+}
+
+// utcConnector checks the timezone of each connection it makes is UTC
+type utcConnector struct {
+	driver.Connector
+}
+
+func (c *utcConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	queryer, ok := conn.(driver.QueryerContext)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("db connection can't be queried for its timezone")
+	}
+
+	rows, err := queryer.QueryContext(ctx, "SHOW TIMEZONE", nil)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "error checking db session timezone")
+	}
+	defer rows.Close()
+
+	values := make([]driver.Value, 1)
+	if err := rows.Next(values); err != nil && err != io.EOF {
+		conn.Close()
+		return nil, errors.Wrap(err, "error checking db session timezone")
+	}
+
+	timezone := fmt.Sprintf("%s", values[0])
+	if timezone != "UTC" {
+		conn.Close()
+		return nil, fmt.Errorf("db session timezone must be UTC, not: %s", timezone)
+	}
+	return conn, nil
+}
+
+// CheckDBTimezone errors if a session of the passed in database isn't in UTC, for databases not opened with OpenDB
+func CheckDBTimezone(ctx context.Context, db *sqlx.DB) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	var timezone string
+	err := db.GetContext(ctx, &timezone, "SHOW TIMEZONE")
+	if err != nil {
+		return errors.Wrap(err, "error checking db session timezone")
+	}
+	if timezone != "UTC" {
+		return fmt.Errorf("db session timezone must be UTC, not: %s", timezone)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package archives
+
+import (
+	"context"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// what a dry run reports we would do with each archive
+const (
+	dryRunBuild  = "build"
+	dryRunRollup = "rollup"
+	dryRunDelete = "delete"
+)
+
+// logDryRun logs each of the passed in archives we would build, roll up or delete the records of with how many of
+// their records are in our database, then a summary for the org, without doing anything else. Records are counted
+// rather than written so this is cheap enough to run against production.
+func logDryRun(ctx context.Context, db *sqlx.DB, config *Config, org Org, archiveType ArchiveType, action string, archives []*Archive) error {
+	log := logrus.WithFields(logrus.Fields{
+		"org":          org.Name,
+		"org_id":       org.ID,
+		"archive_type": archiveType,
+		"action":       action,
+	})
+
+	records := 0
+	for _, a := range archives {
+		a.Org = org
+
+		count, err := countArchiveRecords(ctx, db, config, a)
+		if err != nil {
+			return errors.Wrapf(err, "error counting records of %s archive for %s", a.Period, a.StartDate.Format("2006-01-02"))
+		}
+		records += count
+
+		log.WithFields(logrus.Fields{
+			"archive_id":   a.ID,
+			"period":       a.Period,
+			"start_date":   a.StartDate,
+			"record_count": count,
+		}).Info("dry run archive")
+	}
+
+	log.WithField("archive_count", len(archives)).WithField("record_count", records).Info("dry run summary")
+	return nil
+}
+
+// dryRunPhases reports the archives the passed in phases would build, roll up and delete the records of for the passed
+// in org. Deletions are reported whether or not deletion is enabled, so they can be reviewed before it is.
+func dryRunPhases(ctx context.Context, now time.Time, config *Config, db *sqlx.DB, org Org, archiveType ArchiveType, phases []Phase) error {
+	if config.ContactGroupID != 0 {
+		return errors.New("dry runs aren't supported when archiving a contact group")
+	}
+
+	if HasPhase(phases, PhaseCreate) {
+		_, err := CreateOrgArchives(ctx, now, config, db, nil, org, archiveType)
+		if err != nil {
+			return errors.Wrapf(err, "error finding archives to build")
+		}
+	}
+	if HasPhase(phases, PhaseRollup) {
+		_, err := RollupOrgArchives(ctx, now, config, db, nil, org, archiveType)
+		if err != nil {
+			return errors.Wrapf(err, "error finding archives to roll up")
+		}
+	}
+	if HasPhase(phases, PhaseDelete) {
+		_, err := DeleteArchivedOrgRecords(ctx, now, config, db, nil, org, archiveType)
+		if err != nil {
+			return errors.Wrapf(err, "error finding archives to delete")
+		}
+	}
+	return nil
+}
+
+// DryRun reports the archives we would build, roll up and delete the records of for the passed in orgs as of the
+// passed in time, and how many records each has, without writing to our database or storage. It takes the same path
+// as archiving each org, which only reports what it would do when DryRun is set.
+func DryRun(ctx context.Context, now time.Time, config *Config, db *sqlx.DB, orgs []Org) error {
+	if !config.DryRun {
+		return errors.New("dry run called without dry run enabled")
+	}
+
+	// we read our own tables, which only exist once our migrations have been applied
+	err := CheckSettingsTables(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	for _, org := range orgs {
+		for _, archiveType := range plannedTypes(config) {
+			_, err := ArchiveOrgPhasesWithResult(ctx, now, config, db, nil, org, archiveType, AllPhases)
+			if err != nil {
+				return errors.Wrapf(err, "error during dry run for org: %d and type: %s", org.ID, archiveType)
+			}
+		}
+	}
+	return nil
+}
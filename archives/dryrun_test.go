@@ -0,0 +1,103 @@
+package archives
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDryRun(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	hook := test.NewGlobal()
+
+	config := NewConfig()
+	config.ArchiveRuns = false
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	assert.EqualError(t, DryRun(ctx, now, config, db, orgs[1:2]), "dry run called without dry run enabled")
+
+	// we report what we would do with each archive, and a summary of each step
+	config.DryRun = true
+	assert.NoError(t, DryRun(ctx, now, config, db, orgs[1:2]))
+
+	summaries := make(map[string]int)
+	var first map[string]interface{}
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "dry run summary" {
+			assert.Equal(t, 2, entry.Data["org_id"])
+			summaries[entry.Data["action"].(string)] = entry.Data["archive_count"].(int)
+		}
+		if entry.Message == "dry run archive" && first == nil {
+			first = entry.Data
+		}
+	}
+	assert.Equal(t, map[string]int{"build": 61, "rollup": 2, "delete": 0}, summaries)
+	assert.Equal(t, DayPeriod, first["period"])
+	assert.Equal(t, time.Date(2017, 8, 10, 0, 0, 0, 0, time.UTC), first["start_date"].(time.Time).UTC())
+
+	// but nothing is built or deleted
+	assertCount(t, db, 3, `SELECT count(*) FROM archives_archive`)
+	assertCount(t, db, 0, `SELECT count(*) FROM archives_archive WHERE org_id = 2`)
+
+	// without our tables, which only our migrations create, we refuse
+	_, err = db.Exec(`ALTER TABLE archiver_archive_verifications RENAME TO archiver_archive_verifications_old`)
+	assert.NoError(t, err)
+	assert.EqualError(t, DryRun(ctx, now, config, db, orgs[1:2]), "archiver tables missing from our database: archiver_archive_verifications, apply the migrations in migrations/ to create them")
+	_, err = db.Exec(`ALTER TABLE archiver_archive_verifications_old RENAME TO archiver_archive_verifications`)
+	assert.NoError(t, err)
+}
+
+func TestDryRunWritesNothing(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+
+	config := NewConfig()
+	config.DryRun = true
+	config.Delete = true
+	config.MinVerificationsBeforeDelete = 1
+	config.CompactEmptyArchives = true
+	config.ArchivePartialCurrent = true
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	tables := []string{
+		"archives_archive", "msgs_msg", "flows_flowrun", "archiver_settings", "archiver_archive_versions",
+		"archiver_archive_contacts", "archiver_rapidpro_notifications", "archiver_partial_archives",
+		"archiver_archive_verifications", "archiver_archive_renditions",
+	}
+	counts := func() map[string]int {
+		counts := make(map[string]int, len(tables))
+		for _, table := range tables {
+			var count int
+			assert.NoError(t, db.Get(&count, `SELECT count(*) FROM `+table))
+			counts[table] = count
+		}
+		return counts
+	}
+	before := counts()
+
+	// archiving every org in a dry run only reports, whichever way we archive
+	s3Client := newMockS3Client()
+	for _, org := range orgs {
+		for _, archiveType := range []ArchiveType{MessageType, RunType} {
+			_, err := ArchiveOrgPhasesWithResult(ctx, now, config, db, s3Client, org, archiveType, AllPhases)
+			assert.NoError(t, err)
+		}
+	}
+
+	plan, err := BuildPlan(ctx, now, config, db, orgs)
+	assert.NoError(t, err)
+	_, _, err = ExecutePlan(ctx, config, db, s3Client, plan)
+	assert.NoError(t, err)
+
+	// nothing was written to our database or storage
+	assert.Equal(t, before, counts())
+	assert.Equal(t, 0, len(s3Client.objects))
+}
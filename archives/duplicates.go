@@ -0,0 +1,180 @@
+package archives
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// checkDuplicateDailies returns an error listing the conflicting archives if the passed in dailies have more than one
+// archive for any day, as rolling them up would count the records of that day more than once
+func checkDuplicateDailies(dailies []*Archive) error {
+	byDay := make(map[string][]int)
+	days := make([]string, 0)
+	for _, daily := range dailies {
+		day := daily.StartDate.In(time.UTC).Format("2006-01-02")
+		if len(byDay[day]) == 1 {
+			days = append(days, day)
+		}
+		byDay[day] = append(byDay[day], daily.ID)
+	}
+	if len(days) == 0 {
+		return nil
+	}
+
+	sort.Strings(days)
+	conflicts := make([]string, 0, len(days))
+	for _, day := range days {
+		ids := make([]string, 0, len(byDay[day]))
+		for _, id := range byDay[day] {
+			ids = append(ids, fmt.Sprint(id))
+		}
+		conflicts = append(conflicts, fmt.Sprintf("%s: %s", day, strings.Join(ids, ", ")))
+	}
+	return fmt.Errorf("duplicate daily archives, %s", strings.Join(conflicts, "; "))
+}
+
+// DuplicateDailies is a day of an org with more than one daily archive of a type, the archive we keep and the others
+type DuplicateDailies struct {
+	Keep   *Archive
+	Remove []*Archive
+
+	// why we couldn't pick an archive to keep, if we couldn't
+	Unresolved string
+}
+
+const lookupDuplicateDailies = `
+SELECT a.id, a.org_id, a.start_date::timestamp with time zone as start_date, a.period, a.archive_type, a.hash, a.size, a.record_count, a.url, a.rollup_id, a.needs_deletion, COALESCE(v.version, 1) as version
+FROM archives_archive a LEFT JOIN archiver_archive_versions v ON v.archive_id = a.id
+WHERE a.period = 'D' AND (a.org_id, a.archive_type, a.start_date) IN (
+	SELECT org_id, archive_type, start_date FROM archives_archive WHERE period = 'D'
+	GROUP BY org_id, archive_type, start_date HAVING COUNT(*) > 1
+)
+ORDER BY a.org_id, a.archive_type, a.start_date, a.id
+`
+
+const updateDuplicateRollup = `
+UPDATE archives_archive SET rollup_id = $2 WHERE id = $1 AND rollup_id IS NULL
+`
+
+// the statements which delete an archive and what we store about it, in order
+var deleteDuplicateArchive = []string{
+	`DELETE FROM archiver_archive_versions WHERE archive_id = $1`,
+	`DELETE FROM archiver_archive_contacts WHERE archive_id = $1`,
+	`DELETE FROM archives_archive WHERE id = $1`,
+}
+
+// ResolveDuplicateDailies finds every day with more than one daily archive and picks the one to keep, the one whose
+// object exists and matches its hash, preferring one that was rolled up and then the latest. Unless this is a dry run
+// the rows of the others are deleted, their objects are left in place.
+func ResolveDuplicateDailies(ctx context.Context, db *sqlx.DB, s3Client Storage, dryRun bool) ([]*DuplicateDailies, error) {
+	dailies := make([]*Archive, 0)
+	err := db.SelectContext(ctx, &dailies, lookupDuplicateDailies)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error selecting duplicate daily archives")
+	}
+
+	duplicates := make([]*DuplicateDailies, 0)
+	for start := 0; start < len(dailies); {
+		end := start + 1
+		for end < len(dailies) && dailies[end].OrgID == dailies[start].OrgID && dailies[end].ArchiveType == dailies[start].ArchiveType && dailies[end].StartDate.Equal(dailies[start].StartDate) {
+			end++
+		}
+
+		duplicate := pickDuplicateDaily(ctx, s3Client, dailies[start:end])
+		duplicates = append(duplicates, duplicate)
+		start = end
+
+		if duplicate.Unresolved != "" || dryRun {
+			continue
+		}
+
+		err = removeDuplicateDailies(ctx, db, duplicate)
+		if err != nil {
+			return duplicates, err
+		}
+	}
+
+	return duplicates, nil
+}
+
+// pickDuplicateDaily picks which of the passed in archives of the same day we keep
+func pickDuplicateDaily(ctx context.Context, s3Client Storage, dailies []*Archive) *DuplicateDailies {
+	duplicate := &DuplicateDailies{Remove: make([]*Archive, 0, len(dailies))}
+
+	rolledUp := 0
+	for _, daily := range dailies {
+		if daily.Rollup != nil {
+			rolledUp++
+		}
+
+		err := VerifyS3Archive(ctx, s3Client, daily)
+		if err != nil {
+			logrus.WithError(err).WithField("archive_id", daily.ID).Warn("duplicate daily archive doesn't match its object")
+		}
+
+		// dailies are in order of id, so a later valid one is kept unless only an earlier one was rolled up
+		keep := err == nil && (duplicate.Keep == nil || daily.Rollup != nil || duplicate.Keep.Rollup == nil)
+		if keep {
+			if duplicate.Keep != nil {
+				duplicate.Remove = append(duplicate.Remove, duplicate.Keep)
+			}
+			duplicate.Keep = daily
+		} else {
+			duplicate.Remove = append(duplicate.Remove, daily)
+		}
+	}
+
+	// a monthly which rolled up more than one of these counts the records of this day more than once
+	if rolledUp > 1 {
+		logrus.WithField("org_id", dailies[0].OrgID).WithField("archive_type", dailies[0].ArchiveType).WithField("start_date", dailies[0].StartDate).Error("more than one duplicate daily archive was rolled up, its monthly must be rebuilt")
+	}
+
+	if duplicate.Keep == nil {
+		ids := make([]string, 0, len(dailies))
+		for _, daily := range dailies {
+			ids = append(ids, fmt.Sprint(daily.ID))
+		}
+		duplicate.Unresolved = fmt.Sprintf("none of archives: %s match their objects", strings.Join(ids, ", "))
+	}
+	return duplicate
+}
+
+// removeDuplicateDailies deletes the rows of the archives of the passed in day we aren't keeping, moving their rollup
+// to the archive we keep if it wasn't rolled up itself
+func removeDuplicateDailies(ctx context.Context, db *sqlx.DB, duplicate *DuplicateDailies) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrapf(err, "error starting transaction")
+	}
+
+	for _, daily := range duplicate.Remove {
+		if daily.Rollup != nil {
+			_, err = tx.ExecContext(ctx, updateDuplicateRollup, duplicate.Keep.ID, *daily.Rollup)
+			if err != nil {
+				tx.Rollback()
+				return errors.Wrapf(err, "error moving rollup of archive: %d", daily.ID)
+			}
+		}
+
+		for _, stmt := range deleteDuplicateArchive {
+			_, err = tx.ExecContext(ctx, stmt, daily.ID)
+			if err != nil {
+				tx.Rollback()
+				return errors.Wrapf(err, "error deleting duplicate archive: %d", daily.ID)
+			}
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrapf(err, "error committing removal of duplicates of archive: %d", duplicate.Keep.ID)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package archives
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckDuplicateDailies(t *testing.T) {
+	day := func(id int, d int) *Archive {
+		return &Archive{ID: id, StartDate: time.Date(2017, 8, d, 0, 0, 0, 0, time.UTC), Period: DayPeriod}
+	}
+
+	assert.NoError(t, checkDuplicateDailies(nil))
+	assert.NoError(t, checkDuplicateDailies([]*Archive{day(1, 10), day(2, 11), day(3, 12)}))
+
+	err := checkDuplicateDailies([]*Archive{day(1, 10), day(2, 11), day(5, 11), day(3, 12), day(4, 10), day(6, 10)})
+	assert.EqualError(t, err, "duplicate daily archives, 2017-08-10: 1, 4, 6; 2017-08-11: 2, 5")
+}
+
+func TestResolveDuplicateDailies(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+
+	config := NewConfig()
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	dailies, err := GetMissingDailyArchives(ctx, db, now, orgs[1], RunType)
+	assert.NoError(t, err)
+	assert.NoError(t, createArchives(ctx, db, config, s3Client, orgs[1], dailies))
+	assert.Equal(t, "2017-08-12", dailies[2].StartDate.Format("2006-01-02"))
+
+	// a duplicate of the 12th of august which doesn't match its object
+	var duplicateID int
+	err = db.Get(&duplicateID, `INSERT INTO archives_archive(archive_type, created_on, start_date, period, record_count, size, hash, url, needs_deletion, build_time, org_id) 
+	VALUES('run', NOW(), '2017-08-12', 'D', $1, $2, 'f0d79988b7772c003d04a28bd7417a62', $3, TRUE, 0, 2) RETURNING id`, dailies[2].RecordCount, dailies[2].Size, dailies[2].URL)
+	assert.NoError(t, err)
+
+	// which we refuse to roll up
+	monthlies, err := RollupOrgArchives(ctx, now, config, db, s3Client, orgs[1], RunType)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(monthlies))
+	assert.Equal(t, "2017-09-01", monthlies[0].StartDate.Format("2006-01-02"))
+
+	augustDailies, err := GetDailyArchivesForDateRange(ctx, db, orgs[1], RunType, time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC), time.Date(2017, 8, 31, 0, 0, 0, 0, time.UTC))
+	assert.NoError(t, err)
+	assert.EqualError(t, checkDuplicateDailies(augustDailies), fmt.Sprintf("duplicate daily archives, 2017-08-12: %d, %d", dailies[2].ID, duplicateID))
+
+	// a dry run only reports which we would keep
+	duplicates, err := ResolveDuplicateDailies(ctx, db, s3Client, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(duplicates))
+	assert.Equal(t, "", duplicates[0].Unresolved)
+	assert.Equal(t, dailies[2].ID, duplicates[0].Keep.ID)
+	assert.Equal(t, 1, len(duplicates[0].Remove))
+	assert.Equal(t, duplicateID, duplicates[0].Remove[0].ID)
+	assertCount(t, db, 2, `SELECT count(*) FROM archives_archive WHERE org_id = 2 AND archive_type = 'run' AND start_date = '2017-08-12' AND period = 'D'`)
+
+	// otherwise we remove the others
+	duplicates, err = ResolveDuplicateDailies(ctx, db, s3Client, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(duplicates))
+	assertCount(t, db, 1, `SELECT count(*) FROM archives_archive WHERE org_id = 2 AND archive_type = 'run' AND start_date = '2017-08-12' AND period = 'D'`)
+	assertCount(t, db, 0, `SELECT count(*) FROM archives_archive WHERE id = $1`, duplicateID)
+
+	// leaving the object of the one we kept alone, so august can now be rolled up
+	assert.NoError(t, VerifyS3Archive(ctx, s3Client, dailies[2]))
+	monthlies, err = RollupOrgArchives(ctx, now, config, db, s3Client, orgs[1], RunType)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(monthlies))
+	assert.Equal(t, 3, monthlies[0].RecordCount)
+
+	// nothing left to resolve
+	duplicates, err = ResolveDuplicateDailies(ctx, db, s3Client, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(duplicates))
+
+	// duplicates where none match their objects can't be resolved
+	_, err = db.Exec(`INSERT INTO archives_archive(archive_type, created_on, start_date, period, record_count, size, hash, url, needs_deletion, build_time, org_id) 
+	VALUES('run', NOW(), '2017-08-13', 'D', 0, 0, '', '', TRUE, 0, 2)`)
+	assert.NoError(t, err)
+	_, err = db.Exec(`UPDATE archives_archive SET hash = 'f0d79988b7772c003d04a28bd7417a62' WHERE id = $1`, dailies[3].ID)
+	assert.NoError(t, err)
+
+	duplicates, err = ResolveDuplicateDailies(ctx, db, s3Client, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(duplicates))
+	assert.Nil(t, duplicates[0].Keep)
+	assert.Contains(t, duplicates[0].Unresolved, "match their objects")
+	assertCount(t, db, 2, `SELECT count(*) FROM archives_archive WHERE org_id = 2 AND archive_type = 'run' AND start_date = '2017-08-13' AND period = 'D'`)
+}
@@ -0,0 +1,73 @@
+package archives
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// EmptyGzipSize is the size of an archive with no records and no header, an empty gzip stream. It depends on the
+// compressor of the Go we are built with, 23 bytes with older versions and 20 with newer.
+var EmptyGzipSize = gzippedSize(nil)
+
+// the key of the header record we write to archives with no records when configured, no record has it
+const emptyHeaderKey = "_archive"
+
+// emptyHeader is the minimal record written to an empty archive so that consumers can always read its schema version
+type emptyHeader struct {
+	ArchiveType ArchiveType `json:"archive_type"`
+	Version     int         `json:"version"`
+}
+
+// writeEmptyHeader writes our header record to the passed in archive's writer if it has no records and we are
+// configured to, so it can be called after writing the records of any archive
+func writeEmptyHeader(config *Config, archive *Archive, version int, recordCount int, writer *bufio.Writer) error {
+	if recordCount > 0 || !config.EmptyArchiveHeader {
+		return nil
+	}
+
+	header, err := json.Marshal(map[string]emptyHeader{emptyHeaderKey: {ArchiveType: archive.ArchiveType, Version: version}})
+	if err != nil {
+		return errors.Wrapf(err, "error encoding empty archive header")
+	}
+	writer.Write(header)
+	writer.WriteString("\n")
+	return nil
+}
+
+// isEmptyHeader returns whether the passed in line of an archive is the header of an empty archive rather than a record
+func isEmptyHeader(line []byte) bool {
+	return bytes.HasPrefix(line, []byte(`{"`+emptyHeaderKey+`":`))
+}
+
+// gzippedSize returns the size of the passed in body once gzipped as we gzip archives
+func gzippedSize(body []byte) int64 {
+	var gzipped bytes.Buffer
+	gzWriter := gzip.NewWriter(&gzipped)
+	gzWriter.Write(body)
+	gzWriter.Close()
+	return int64(gzipped.Len())
+}
+
+// EmptyArchive returns the contents of an archive of the passed in type with no records as we would write it with the
+// passed in config
+func EmptyArchive(config *Config, archiveType ArchiveType) ([]byte, error) {
+	var body bytes.Buffer
+	gzWriter := gzip.NewWriter(&body)
+	writer := bufio.NewWriter(gzWriter)
+
+	err := writeEmptyHeader(config, &Archive{ArchiveType: archiveType}, ArchiveSchemaVersion, 0, writer)
+	if err != nil {
+		return nil, err
+	}
+	if err = writer.Flush(); err != nil {
+		return nil, errors.Wrapf(err, "error flushing empty archive")
+	}
+	if err = gzWriter.Close(); err != nil {
+		return nil, errors.Wrapf(err, "error closing empty archive gzip writer")
+	}
+	return body.Bytes(), nil
+}
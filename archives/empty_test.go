@@ -0,0 +1,61 @@
+package archives
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmptyArchive(t *testing.T) {
+	ctx := context.Background()
+	config := NewConfig()
+	config.TempDir = t.TempDir()
+
+	// by default an empty archive is just an empty gzip stream
+	body, err := EmptyArchive(config, MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, EmptyGzipSize, int64(len(body)))
+
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	assert.NoError(t, err)
+	contents, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "", string(contents))
+
+	// but can carry a header with its type and schema version
+	config.EmptyArchiveHeader = true
+	body, err = EmptyArchive(config, RunType)
+	assert.NoError(t, err)
+	assert.True(t, int64(len(body)) > EmptyGzipSize)
+
+	reader, err = gzip.NewReader(bytes.NewReader(body))
+	assert.NoError(t, err)
+	contents, err = ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"_archive\":{\"archive_type\":\"run\",\"version\":2}}\n", string(contents))
+	assert.True(t, isEmptyHeader(bytes.TrimSpace(contents)))
+	assert.False(t, isEmptyHeader([]byte(`{"id":1,"_archive":{}}`)))
+
+	// which isn't taken for a record by anything reading archives
+	s3Client := newMockS3Client()
+	archive := &Archive{ID: 12, ArchiveType: RunType, URL: s3Client.putObject("dl-archiver-test", "/2/empty.jsonl.gz", body)}
+
+	ids, err := spoolArchiveIDs(ctx, config, s3Client, archive)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, ids.count)
+	ids.Close()
+
+	records, err := PreviewArchive(ctx, s3Client, archive, false, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(records))
+
+	// and is only written to archives without records
+	writer := bufio.NewWriter(&bytes.Buffer{})
+	assert.NoError(t, writeEmptyHeader(config, archive, ArchiveSchemaVersion, 3, writer))
+	assert.Equal(t, 0, writer.Buffered())
+}
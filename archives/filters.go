@@ -0,0 +1,82 @@
+package archives
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// extraFilterClause returns the configured extra filter for records of the passed in type as a condition to AND with
+// the conditions of a query, or an empty string if there is none. Messages are aliased as mm and runs as fr in every
+// query these are added to, extraction, counting and deletion alike, so they always agree on which records we own.
+func extraFilterClause(config *Config, archiveType ArchiveType) string {
+	var filter string
+	switch archiveType {
+	case MessageType:
+		filter = config.MessageExtraFilter
+	case RunType:
+		filter = config.RunExtraFilter
+	}
+
+	if filter == "" {
+		return ""
+	}
+	return fmt.Sprintf("AND (%s)", filter)
+}
+
+// CheckExtraFilters validates any extra filters we are configured with by explaining each query they are added to,
+// refusing to start with a filter which would break our archiving or deletion halfway through. As filters change which
+// records are archived and deleted, the active ones are logged.
+func CheckExtraFilters(ctx context.Context, db *sqlx.DB, config *Config) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	start := time.Now()
+	end := start.AddDate(0, 0, 1)
+
+	if config.MessageExtraFilter != "" && config.ArchiveMessages {
+		clause := extraFilterClause(config, MessageType)
+		queries := []string{fmt.Sprintf(lookupMsgs, clause), fmt.Sprintf(countMsgsInRange, clause), fmt.Sprintf(selectOrgMessagesInRange, clause)}
+		args := [][]interface{}{{0, start, end, 0}, {0, start, end}, {0, start, end}}
+
+		err := explainQueries(ctx, db, queries, args)
+		if err != nil {
+			return errors.Wrapf(err, "invalid message extra filter: %s", config.MessageExtraFilter)
+		}
+		logrus.WithField("filter", config.MessageExtraFilter).Warn("only archiving and deleting messages matching extra filter")
+	}
+
+	if config.RunExtraFilter != "" && config.ArchiveRuns {
+		field, err := runPartitionField(config)
+		if err != nil {
+			return err
+		}
+
+		clause := extraFilterClause(config, RunType)
+		queries := []string{fmt.Sprintf(lookupFlowRuns, field, clause), fmt.Sprintf(countRunsInRange, field, clause), fmt.Sprintf(selectOrgRunsInRange, field, clause)}
+		args := [][]interface{}{{false, 0, start, end, 0, false}, {0, start, end}, {0, start, end}}
+
+		err = explainQueries(ctx, db, queries, args)
+		if err != nil {
+			return errors.Wrapf(err, "invalid run extra filter: %s", config.RunExtraFilter)
+		}
+		logrus.WithField("filter", config.RunExtraFilter).Warn("only archiving and deleting runs matching extra filter")
+	}
+
+	return nil
+}
+
+// explainQueries explains each of the passed in queries with their args, returning the first error
+func explainQueries(ctx context.Context, db *sqlx.DB, queries []string, args [][]interface{}) error {
+	for i, query := range queries {
+		_, err := db.ExecContext(ctx, "EXPLAIN "+query, args[i]...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package archives
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// the prefix of the top level keys run results are flattened into
+const flattenedResultPrefix = "result_"
+
+// flattenRunResults replaces the values of the passed in run record with a top level key for each field of each
+// result, e.g. result_color_value and result_color_category. Every other key is left as is and in the same order, so
+// records are only changed where their values were.
+func flattenRunResults(record string) (string, error) {
+	keys, raws, err := decodeOrderedObject([]byte(record))
+	if err != nil {
+		return "", errors.Wrap(err, "error decoding run record")
+	}
+
+	flattened := &bytes.Buffer{}
+	flattened.WriteString("{")
+
+	// keys are written as postgres would, without escaping HTML
+	encodeKey := json.NewEncoder(flattened)
+	encodeKey.SetEscapeHTML(false)
+
+	written := 0
+	writeField := func(key string, raw json.RawMessage) {
+		if written > 0 {
+			flattened.WriteString(",")
+		}
+		// our encoder ends what it writes with a newline which we don't want
+		encodeKey.Encode(key)
+		flattened.Truncate(flattened.Len() - 1)
+		flattened.WriteString(":")
+		flattened.Write(raw)
+		written++
+	}
+
+	for i, key := range keys {
+		if key != "values" {
+			writeField(key, raws[i])
+			continue
+		}
+
+		resultKeys, results, err := decodeOrderedObject(raws[i])
+		if err != nil {
+			return "", errors.Wrap(err, "error decoding run values")
+		}
+
+		for r, resultKey := range resultKeys {
+			fields, fieldRaws, err := decodeOrderedObject(results[r])
+			if err != nil {
+				return "", errors.Wrapf(err, "error decoding run result: %s", resultKey)
+			}
+			for f, field := range fields {
+				writeField(fmt.Sprintf("%s%s_%s", flattenedResultPrefix, resultKey, field), fieldRaws[f])
+			}
+		}
+	}
+
+	flattened.WriteString("}")
+	return flattened.String(), nil
+}
+
+// decodeOrderedObject decodes the passed in JSON object into its keys and their raw values, in the order they appear
+func decodeOrderedObject(data []byte) ([]string, []json.RawMessage, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, nil, err
+	}
+	if delim, isDelim := token.(json.Delim); !isDelim || delim != '{' {
+		return nil, nil, fmt.Errorf("expected JSON object, found: %v", token)
+	}
+
+	keys := make([]string, 0)
+	raws := make([]json.RawMessage, 0)
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var raw json.RawMessage
+		err = decoder.Decode(&raw)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		keys = append(keys, token.(string))
+		raws = append(raws, raw)
+	}
+
+	return keys, raws, nil
+}
@@ -0,0 +1,39 @@
+package archives
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlattenRunResults(t *testing.T) {
+	tcs := []struct {
+		Record    string
+		Flattened string
+	}{
+		{
+			`{"id":1,"values":{},"events":[]}`,
+			`{"id":1,"events":[]}`,
+		},
+		{
+			`{"id":2,"responded":true,"values":{"agree": {"name": "Do you agree?", "value": "A", "category": "Strongly agree"}, "color": {"name": "Color", "value": null}},"exited_on":"2017-08-12T19:11:59.890662+00:00"}`,
+			`{"id":2,"responded":true,"result_agree_name":"Do you agree?","result_agree_value":"A","result_agree_category":"Strongly agree","result_color_name":"Color","result_color_value":null,"exited_on":"2017-08-12T19:11:59.890662+00:00"}`,
+		},
+		{
+			`{"id":3,"values":{"a<b": {"value": "<3"}}}`,
+			`{"id":3,"result_a<b_value":"<3"}`,
+		},
+	}
+
+	for _, tc := range tcs {
+		flattened, err := flattenRunResults(tc.Record)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.Flattened, flattened)
+	}
+
+	_, err := flattenRunResults(`{"id":1,"values":[]}`)
+	assert.EqualError(t, err, "error decoding run values: expected JSON object, found: [")
+
+	_, err = flattenRunResults(`{"id":1,`)
+	assert.Error(t, err)
+}
@@ -0,0 +1,104 @@
+package archives
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/pkg/errors"
+)
+
+// the formats we may find the objects of dailies in, monthlies are always rolled up as gzip
+const (
+	FormatGzip    = "gzip"
+	FormatBrotli  = "brotli"
+	FormatZstd    = "zstd"
+	FormatJSONL   = "jsonl"
+	FormatUnknown = "unknown"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// detectFormat returns the format of an object from its first bytes, falling back to the extension of its URL for
+// brotli, which has no magic bytes. Objects replaced by hand may not match their extensions, so their bytes win.
+func detectFormat(objectURL string, head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		return FormatGzip
+	case bytes.HasPrefix(head, zstdMagic):
+		return FormatZstd
+	}
+
+	path := objectURL
+	if u, err := url.Parse(objectURL); err == nil {
+		path = u.Path
+	}
+	switch {
+	case strings.HasSuffix(path, ".br"):
+		return FormatBrotli
+	case strings.HasSuffix(path, ".jsonl"):
+		return FormatJSONL
+	case len(bytes.TrimSpace(head)) > 0 && bytes.TrimSpace(head)[0] == '{':
+		return FormatJSONL
+	}
+	return FormatUnknown
+}
+
+// dailyRecordsReader returns a reader of the uncompressed records of the passed in daily's object, whatever format
+// it's in, along with that format. Dailies which aren't gzipped are only read if we transcode them, otherwise they'd
+// make for a monthly we can't read, and those in formats we have no decoder for are never read.
+func dailyRecordsReader(config *Config, daily *Archive, object io.Reader) (io.ReadCloser, string, error) {
+	buffered := bufio.NewReader(object)
+	head, _ := buffered.Peek(len(zstdMagic))
+	format := detectFormat(daily.URL, head)
+
+	if format != FormatGzip && !config.RollupTranscode {
+		return nil, format, fmt.Errorf("daily archive: %d is %s, not gzip, can't roll it up without transcoding", daily.ID, format)
+	}
+
+	switch format {
+	case FormatGzip:
+		reader, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, format, errors.Wrapf(err, "error creating gzip reader")
+		}
+		return reader, format, nil
+	case FormatBrotli:
+		return ioutil.NopCloser(brotli.NewReader(buffered)), format, nil
+	case FormatJSONL:
+		return ioutil.NopCloser(buffered), format, nil
+	}
+	return nil, format, fmt.Errorf("daily archive: %d is %s, which we can't transcode", daily.ID, format)
+}
+
+// lineEndingWriter is a writer which can end the last line written to it if it wasn't ended, so that the records of
+// one daily never run into those of the next
+type lineEndingWriter struct {
+	writer io.Writer
+	last   byte
+}
+
+func (w *lineEndingWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		w.last = p[len(p)-1]
+	}
+	return w.writer.Write(p)
+}
+
+// endLine writes a newline if anything was written without one at its end
+func (w *lineEndingWriter) endLine() error {
+	if w.last == 0 || w.last == '\n' {
+		return nil
+	}
+	_, err := w.writer.Write([]byte("\n"))
+	return err
+}
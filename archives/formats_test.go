@@ -0,0 +1,144 @@
+package archives
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectFormat(t *testing.T) {
+	tcs := []struct {
+		url    string
+		head   []byte
+		format string
+	}{
+		{"https://foo.s3.amazonaws.com/1/message_D20170812_abc.jsonl.gz", []byte{0x1f, 0x8b, 0x08, 0x00}, FormatGzip},
+		{"https://foo.s3.amazonaws.com/1/message_D20170812_abc.jsonl.zst", []byte{0x28, 0xb5, 0x2f, 0xfd}, FormatZstd},
+		{"https://foo.s3.amazonaws.com/1/message_D20170812_abc.jsonl.gz", []byte{0x28, 0xb5, 0x2f, 0xfd}, FormatZstd},
+		{"https://foo.s3.amazonaws.com/1/message_D20170812_abc.jsonl.br", []byte{0x0b, 0x05, 0x80, 0x7b}, FormatBrotli},
+		{"https://foo.s3.amazonaws.com/1/message_D20170812_abc.jsonl", []byte{}, FormatJSONL},
+		{"https://foo.s3.amazonaws.com/1/message_D20170812_abc.jsonl.gz", []byte(`{"id`), FormatJSONL},
+		{"https://foo.s3.amazonaws.com/1/message_D20170812_abc.jsonl.gz", []byte{0x0b, 0x05, 0x80, 0x7b}, FormatUnknown},
+	}
+
+	for _, tc := range tcs {
+		assert.Equal(t, tc.format, detectFormat(tc.url, tc.head), "unexpected format for %s", tc.url)
+	}
+}
+
+func TestAppendDailyFormats(t *testing.T) {
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+	config := NewConfig()
+
+	records := []byte("{\"id\":1}\n{\"id\":2}")
+
+	gzipped := &bytes.Buffer{}
+	gzWriter := gzip.NewWriter(gzipped)
+	gzWriter.Write(records)
+	gzWriter.Close()
+
+	brotlied := &bytes.Buffer{}
+	brWriter := brotli.NewWriter(brotlied)
+	brWriter.Write(records)
+	brWriter.Close()
+
+	newDaily := func(id int, key string, body []byte) *Archive {
+		hash := md5.Sum(body)
+		return &Archive{ID: id, RecordCount: 2, Size: int64(len(body)), Hash: hex.EncodeToString(hash[:]), URL: s3Client.putObject("test-bucket", key, body)}
+	}
+	gzipDaily := newDaily(1, "/1/message_D20170812_abc.jsonl.gz", gzipped.Bytes())
+	zstdDaily := newDaily(2, "/1/message_D20170813_abc.jsonl.gz", []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 0x58, 0x01, 0x00})
+	brotliDaily := newDaily(3, "/1/message_D20170814_abc.jsonl.br", brotlied.Bytes())
+	plainDaily := newDaily(4, "/1/message_D20170815_abc.jsonl", records)
+
+	// without transcoding, only gzipped dailies can be rolled up
+	output := &bytes.Buffer{}
+	assert.NoError(t, appendDaily(ctx, config, s3Client, gzipDaily, output))
+	assert.Equal(t, FormatGzip, gzipDaily.Format)
+	assert.EqualError(t, appendDaily(ctx, config, s3Client, zstdDaily, output), "daily archive: 2 is zstd, not gzip, can't roll it up without transcoding")
+	assert.EqualError(t, appendDaily(ctx, config, s3Client, brotliDaily, output), "daily archive: 3 is brotli, not gzip, can't roll it up without transcoding")
+	assert.Equal(t, "{\"id\":1}\n{\"id\":2}\n", output.String())
+
+	// transcoding, each daily's records end up as lines of our monthly
+	config.RollupTranscode = true
+	output.Reset()
+	for _, daily := range []*Archive{gzipDaily, brotliDaily, plainDaily} {
+		assert.NoError(t, appendDaily(ctx, config, s3Client, daily, output))
+	}
+	assert.Equal(t, strings.Repeat("{\"id\":1}\n{\"id\":2}\n", 3), output.String())
+	assert.Equal(t, FormatBrotli, brotliDaily.Format)
+	assert.Equal(t, FormatJSONL, plainDaily.Format)
+
+	// but there's nothing we can transcode zstd with
+	output.Reset()
+	assert.EqualError(t, appendDaily(ctx, config, s3Client, zstdDaily, output), "daily archive: 2 is zstd, which we can't transcode")
+	assert.Equal(t, "", output.String())
+}
+
+func TestRollupMixedFormats(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+
+	config := NewConfig()
+	config.UploadToS3 = true
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	_, err = CreateOrgArchives(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+
+	// replace one of our dailies by hand
+	var dailyURL string
+	assert.NoError(t, db.Get(&dailyURL, `SELECT url FROM archives_archive WHERE org_id = 2 AND archive_type = 'message' AND period = 'D' AND start_date = '2017-08-12'`))
+	u, _ := url.Parse(dailyURL)
+	object := s3Client.objects["dl-archiver-test:"+u.Path]
+	reader, err := gzip.NewReader(bytes.NewReader(object.body))
+	assert.NoError(t, err)
+	records, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+
+	replace := func(body []byte) {
+		object.body = body
+		hash := md5.Sum(body)
+		_, err := db.Exec(`UPDATE archives_archive SET hash = $2, size = $3 WHERE url = $1`, dailyURL, hex.EncodeToString(hash[:]), len(body))
+		assert.NoError(t, err)
+	}
+
+	// a zstd daily fails its monthly rather than leaving it unreadable
+	replace([]byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 0x58, 0x01, 0x00})
+	config.RollupTranscode = true
+	monthlies, err := RollupOrgArchives(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(monthlies))
+	assert.Equal(t, time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC), monthlies[0].StartDate.UTC())
+
+	// plain JSON lines can be transcoded
+	replace(records)
+	monthlies, err = RollupOrgArchives(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(monthlies))
+	assert.Equal(t, 1, monthlies[0].DailyFormats[FormatJSONL])
+	assert.True(t, monthlies[0].DailyFormats[FormatGzip] > 0)
+
+	// and make a monthly with all of the month's records
+	u, _ = url.Parse(monthlies[0].URL)
+	reader, err = gzip.NewReader(bytes.NewReader(s3Client.objects["dl-archiver-test:"+u.Path].body))
+	assert.NoError(t, err)
+	contents, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, monthlies[0].RecordCount, strings.Count(string(contents), "\n"))
+	assert.Contains(t, string(contents), string(records))
+}
@@ -0,0 +1,463 @@
+package archives
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const defaultGCSEndpoint = "https://storage.googleapis.com"
+
+// the scope of the access tokens we request, which lets us read, write and delete objects
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// the format of the URLs of objects in GCS buckets, which like those of S3 have their bucket as the first part of
+// their host
+const gcsBucketURL = "https://%s.storage.googleapis.com%s"
+
+// the codes of the storage errors we return for the statuses of failed GCS requests, so we handle them the same way
+// as those of S3
+var gcsErrorCodes = map[int]string{
+	http.StatusForbidden:           "AccessDenied",
+	http.StatusNotFound:            errCodeNotFound,
+	http.StatusPreconditionFailed:  "PreconditionFailed",
+	http.StatusTooManyRequests:     errCodeSlowDown,
+	http.StatusInternalServerError: "InternalError",
+	http.StatusServiceUnavailable:  "ServiceUnavailable",
+}
+
+// GCSClient is the Storage of archives in Google Cloud Storage, over the GCS JSON API
+type GCSClient struct {
+	endpoint  string
+	bucketURL string
+	projectID string
+	client    *http.Client
+	tokens    oauth2.TokenSource
+}
+
+// NewGCSClient creates a new GCS client from the passed in config, authenticating with our credentials file or with
+// application default credentials if we don't have one, and tests that our bucket is reachable
+func NewGCSClient(config *Config) (Storage, error) {
+	// the GCS JSON API has no multipart uploads to stream archives with
+	if config.StreamUploads {
+		return nil, fmt.Errorf("streamed uploads aren't supported when storing archives in GCS")
+	}
+
+	ctx := context.Background()
+	tokens, err := newGCSTokenSource(ctx, config.GCSCredentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	client := newGCSClient(defaultGCSEndpoint, gcsBucketURL, config.GCSProjectID, tokens, http.DefaultClient)
+
+	// test out our GCS credentials
+	err = client.testBucket(ctx, config.GCSBucket)
+	if err != nil {
+		return nil, errors.Wrapf(err, "gcs bucket: %s not reachable", config.GCSBucket)
+	}
+
+	logrus.Info("gcs bucket ok")
+	return client, nil
+}
+
+func newGCSClient(endpoint string, bucketURL string, projectID string, tokens oauth2.TokenSource, client *http.Client) *GCSClient {
+	return &GCSClient{endpoint: endpoint, bucketURL: bucketURL, projectID: projectID, tokens: tokens, client: client}
+}
+
+// newGCSTokenSource returns the source of the access tokens we authenticate to GCS with, from the passed in service
+// account key or user credentials file, or if we don't have one, from application default credentials. Tokens are
+// reused until they are about to expire.
+func newGCSTokenSource(ctx context.Context, credentialsFile string) (oauth2.TokenSource, error) {
+	if credentialsFile == "" {
+		creds, err := google.FindDefaultCredentials(ctx, gcsScope)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error finding gcs application default credentials")
+		}
+		return creds.TokenSource, nil
+	}
+
+	contents, err := ioutil.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading gcs credentials file: %s", credentialsFile)
+	}
+	creds, err := google.CredentialsFromJSON(ctx, contents, gcsScope)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing gcs credentials file: %s", credentialsFile)
+	}
+	return creds.TokenSource, nil
+}
+
+// gcsObject is the metadata of a GCS object, with the fields we read and write
+type gcsObject struct {
+	Name            string            `json:"name,omitempty"`
+	Size            int64             `json:"size,string,omitempty"`
+	MD5Hash         string            `json:"md5Hash,omitempty"`
+	ETag            string            `json:"etag,omitempty"`
+	ContentType     string            `json:"contentType,omitempty"`
+	ContentEncoding string            `json:"contentEncoding,omitempty"`
+	StorageClass    string            `json:"storageClass,omitempty"`
+	Updated         *time.Time        `json:"updated,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+}
+
+// info returns what we know of this object with the passed in key. Composite objects don't have an MD5, so for those
+// we use the hash we stored in their metadata, if any.
+func (o *gcsObject) info(key string) *ObjectInfo {
+	encoded := o.MD5Hash
+	if encoded == "" {
+		encoded = o.Metadata["md5chksum"]
+	}
+	hash, _ := base64.StdEncoding.DecodeString(encoded)
+
+	return &ObjectInfo{Key: key, Size: o.Size, MD5: hex.EncodeToString(hash), StorageClass: o.StorageClass}
+}
+
+// newArchiveGCSObject returns the metadata of an archive with the passed in name, encoding and hex encoded MD5
+func newArchiveGCSObject(name string, contentEncoding string, md5 string) (*gcsObject, error) {
+	hashBytes, err := hex.DecodeString(md5)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid md5: %s", md5)
+	}
+	encoded := base64.StdEncoding.EncodeToString(hashBytes)
+
+	return &gcsObject{
+		Name:            name,
+		ContentType:     "application/json",
+		ContentEncoding: contentEncoding,
+		MD5Hash:         encoded,
+		Metadata:        map[string]string{"md5chksum": encoded},
+	}, nil
+}
+
+// gcsObjectName returns the name of the GCS object for the passed in key. Our keys start with a slash, which S3 drops
+// and GCS would keep.
+func gcsObjectName(key string) string {
+	return strings.TrimPrefix(key, "/")
+}
+
+func gcsObjectPath(bucket string, key string) string {
+	return "/storage/v1/b/" + url.PathEscape(bucket) + "/o/" + url.PathEscape(gcsObjectName(key))
+}
+
+// do makes an authenticated request to the GCS JSON API, returning a storage error if it fails
+func (c *GCSClient) do(ctx context.Context, method string, path string, query url.Values, contentType string, body io.Reader) (*http.Response, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	if c.projectID != "" {
+		query.Set("userProject", c.projectID)
+	}
+
+	req, err := http.NewRequest(method, c.endpoint+path+"?"+query.Encode(), body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	token, err := c.tokens.Token()
+	if err != nil {
+		return nil, errors.Wrapf(err, "error authenticating to gcs")
+	}
+	token.SetAuthHeader(req)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	// objects are read as they were written, otherwise GCS decompresses our archives for us
+	if query.Get("alt") == "media" {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		return nil, gcsError(resp)
+	}
+	return resp, nil
+}
+
+// doJSON makes a request to the GCS JSON API with the passed in JSON body, if any, and reads its response into the
+// passed in value
+func (c *GCSClient) doJSON(ctx context.Context, method string, path string, query url.Values, body interface{}, response interface{}) error {
+	var reader io.Reader
+	contentType := ""
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+		contentType = "application/json"
+	}
+
+	resp, err := c.do(ctx, method, path, query, contentType, reader)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if response == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+// gcsError returns the storage error for the passed in failed GCS response
+func gcsError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	message := strings.TrimSpace(string(body))
+	parsed := &struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}{}
+	if json.Unmarshal(body, parsed) == nil && parsed.Error.Message != "" {
+		message = parsed.Error.Message
+	}
+
+	code := gcsErrorCodes[resp.StatusCode]
+	if code == "" {
+		code = strings.Replace(http.StatusText(resp.StatusCode), " ", "", -1)
+	}
+	return &StorageError{Code: code, Message: message}
+}
+
+// testBucket checks the passed in bucket exists and that we can access it
+func (c *GCSClient) testBucket(ctx context.Context, bucket string) error {
+	return c.doJSON(ctx, http.MethodGet, "/storage/v1/b/"+url.PathEscape(bucket), nil, nil, nil)
+}
+
+// URL returns the URL of the object with the passed in key in the passed in bucket
+func (c *GCSClient) URL(bucket string, key string) string {
+	return fmt.Sprintf(c.bucketURL, bucket, key)
+}
+
+// SplitURL returns the bucket and key of the object at the passed in URL
+func (c *GCSClient) SplitURL(fileURL string) (string, string, error) {
+	u, err := url.Parse(fileURL)
+	if err != nil {
+		return "", "", err
+	}
+	return strings.Split(u.Host, ".")[0], u.Path, nil
+}
+
+// upload writes the passed in body to a new object with the passed in metadata, in a single request which GCS checks
+// against the MD5 of the object if it has one
+func (c *GCSClient) upload(ctx context.Context, bucket string, object *gcsObject, body io.Reader) error {
+	// our metadata and contents are the two parts of a multipart upload, which we write as we send it
+	reader, writer := io.Pipe()
+	parts := multipart.NewWriter(writer)
+	go func() {
+		writer.CloseWithError(writeGCSUpload(parts, object, body))
+	}()
+
+	query := url.Values{"uploadType": []string{"multipart"}}
+	path := "/upload/storage/v1/b/" + url.PathEscape(bucket) + "/o"
+	resp, err := c.do(ctx, http.MethodPost, path, query, "multipart/related; boundary="+parts.Boundary(), reader)
+	if err != nil {
+		reader.Close()
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func writeGCSUpload(parts *multipart.Writer, object *gcsObject, body io.Reader) error {
+	part, err := parts.CreatePart(textproto.MIMEHeader{"Content-Type": []string{"application/json; charset=UTF-8"}})
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(part).Encode(object)
+	if err != nil {
+		return err
+	}
+
+	contentType := object.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	part, err = parts.CreatePart(textproto.MIMEHeader{"Content-Type": []string{contentType}})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(part, body)
+	if err != nil {
+		return err
+	}
+	return parts.Close()
+}
+
+// PutObject writes the passed in body to the passed in key, returning its URL
+func (c *GCSClient) PutObject(ctx context.Context, bucket string, key string, body io.Reader, size int64, contentType string, contentEncoding string) (string, error) {
+	object := &gcsObject{Name: gcsObjectName(key), ContentType: contentType, ContentEncoding: contentEncoding}
+	err := c.upload(ctx, bucket, object, body)
+	if err != nil {
+		return "", err
+	}
+	return c.URL(bucket, key), nil
+}
+
+// Upload writes an archive to the passed in key, which GCS checks against its MD5
+func (c *GCSClient) Upload(ctx context.Context, bucket string, key string, body io.Reader, size int64, contentEncoding string, md5 string) (string, error) {
+	object, err := newArchiveGCSObject(gcsObjectName(key), contentEncoding, md5)
+	if err != nil {
+		return "", err
+	}
+	err = c.upload(ctx, bucket, object, body)
+	if err != nil {
+		return "", err
+	}
+	return c.URL(bucket, key), nil
+}
+
+// UploadStream fails, as we only stream archives as multipart uploads
+func (c *GCSClient) UploadStream(ctx context.Context, bucket string, key string, body io.Reader) (string, error) {
+	return "", fmt.Errorf("streamed uploads aren't supported for archives stored in GCS")
+}
+
+// GetObject returns the contents of the object at the passed in URL, exactly as they were uploaded
+func (c *GCSClient) GetObject(ctx context.Context, fileURL string) (io.ReadCloser, error) {
+	bucket, key, err := c.SplitURL(fileURL)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{"alt": []string{"media"}}
+	resp, err := c.do(ctx, http.MethodGet, gcsObjectPath(bucket, key), query, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Download returns the contents of the archive at the passed in URL
+func (c *GCSClient) Download(ctx context.Context, fileURL string) (io.ReadCloser, error) {
+	return c.GetObject(ctx, fileURL)
+}
+
+// Stat returns the size, hash and storage class of the object at the passed in URL
+func (c *GCSClient) Stat(ctx context.Context, fileURL string) (*ObjectInfo, error) {
+	bucket, key, err := c.SplitURL(fileURL)
+	if err != nil {
+		return nil, err
+	}
+
+	object := &gcsObject{}
+	err = c.doJSON(ctx, http.MethodGet, gcsObjectPath(bucket, key), nil, nil, object)
+	if err != nil {
+		return nil, err
+	}
+	return object.info(key), nil
+}
+
+// Copy copies an object within its bucket, replacing its metadata with that of an archive if we have a hash for it.
+// Large objects, or those copied between locations or storage classes, take more than one request to copy.
+func (c *GCSClient) Copy(ctx context.Context, fileURL string, key string, md5 string) (string, error) {
+	bucket, source, err := c.SplitURL(fileURL)
+	if err != nil {
+		return "", err
+	}
+
+	// without a body the copy keeps the metadata of its source
+	var body interface{}
+	if md5 != "" {
+		object, err := newArchiveGCSObject("", "gzip", md5)
+		if err != nil {
+			return "", err
+		}
+		object.MD5Hash = ""
+		body = object
+	}
+
+	path := gcsObjectPath(bucket, source) + "/rewriteTo/b/" + url.PathEscape(bucket) + "/o/" + url.PathEscape(gcsObjectName(key))
+	query := url.Values{}
+	for {
+		rewrite := &struct {
+			Done         bool   `json:"done"`
+			RewriteToken string `json:"rewriteToken"`
+		}{}
+		err := c.doJSON(ctx, http.MethodPost, path, query, body, rewrite)
+		if err != nil {
+			return "", err
+		}
+		if rewrite.Done {
+			return c.URL(bucket, key), nil
+		}
+		query.Set("rewriteToken", rewrite.RewriteToken)
+	}
+}
+
+// Delete deletes each of the passed in keys in turn, as GCS has no request to delete many objects. Keys which don't
+// exist are deleted as far as we are concerned.
+func (c *GCSClient) Delete(ctx context.Context, bucket string, keys []string) map[string]error {
+	results := make(map[string]error, len(keys))
+	for _, key := range keys {
+		err := c.doJSON(ctx, http.MethodDelete, gcsObjectPath(bucket, key), nil, nil, nil)
+		if isNotFound(err) {
+			err = nil
+		}
+		results[key] = err
+	}
+	return results
+}
+
+// List returns the objects with the passed in prefix, a page at a time. Their keys start with a slash if our prefix
+// did, like our keys always do.
+func (c *GCSClient) List(ctx context.Context, bucket string, prefix string) ([]*ObjectInfo, error) {
+	slash := ""
+	if strings.HasPrefix(prefix, "/") {
+		slash = "/"
+	}
+
+	objects := make([]*ObjectInfo, 0)
+	query := url.Values{"prefix": []string{gcsObjectName(prefix)}}
+	for {
+		list := &struct {
+			Items         []*gcsObject `json:"items"`
+			NextPageToken string       `json:"nextPageToken"`
+		}{}
+		err := c.doJSON(ctx, http.MethodGet, "/storage/v1/b/"+url.PathEscape(bucket)+"/o", query, nil, list)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, o := range list.Items {
+			objects = append(objects, o.info(slash+o.Name))
+		}
+
+		if list.NextPageToken == "" {
+			return objects, nil
+		}
+		query.Set("pageToken", list.NextPageToken)
+	}
+}
+
+// Restore fails, as objects in every GCS storage class can be read without restoring them first
+func (c *GCSClient) Restore(ctx context.Context, fileURL string, days int) error {
+	return fmt.Errorf("objects stored in GCS don't need restoring: %s", fileURL)
+}
+
+// SignURL fails, as GCS signed URLs need a private key we may not have
+func (c *GCSClient) SignURL(fileURL string, expires time.Duration) (string, error) {
+	return "", fmt.Errorf("presigning urls isn't supported for archives stored in GCS")
+}
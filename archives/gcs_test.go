@@ -0,0 +1,356 @@
+package archives
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+type mockGCSObject struct {
+	gcsObject
+	body []byte
+}
+
+// mockGCSServer is an in memory GCS bucket served over the parts of the GCS JSON API our client uses
+type mockGCSServer struct {
+	*httptest.Server
+
+	mutex   sync.Mutex
+	bucket  string
+	objects map[string]*mockGCSObject
+
+	// how many requests each rewrite takes, how many objects are listed per page
+	rewriteSteps int
+	pageSize     int
+}
+
+func newMockGCSServer(bucket string) *mockGCSServer {
+	s := &mockGCSServer{bucket: bucket, objects: make(map[string]*mockGCSObject), rewriteSteps: 2, pageSize: 2}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+func (s *mockGCSServer) client() *GCSClient {
+	return newGCSClient(s.URL, gcsBucketURL, "", oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "test-token"}), s.Client())
+}
+
+func (s *mockGCSServer) writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func (s *mockGCSServer) writeError(w http.ResponseWriter, status int, message string) {
+	s.writeJSON(w, status, map[string]interface{}{"error": map[string]interface{}{"code": status, "message": message}})
+}
+
+func (s *mockGCSServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer test-token" {
+		s.writeError(w, http.StatusUnauthorized, "Invalid Credentials")
+		return
+	}
+
+	// split our path into its unescaped parts, object names being escaped as a single part
+	parts := strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/")
+	for i := range parts {
+		parts[i], _ = url.PathUnescape(parts[i])
+	}
+	path := strings.Join(parts, " ")
+
+	switch {
+	case r.Method == http.MethodPost && len(parts) == 6 && strings.HasPrefix(path, "upload storage v1 b"):
+		s.upload(w, r, parts[4])
+	case len(parts) == 4 && r.Method == http.MethodGet:
+		if parts[3] != s.bucket {
+			s.writeError(w, http.StatusNotFound, "Not Found")
+			return
+		}
+		s.writeJSON(w, http.StatusOK, map[string]string{"name": s.bucket})
+	case len(parts) == 5 && r.Method == http.MethodGet:
+		s.list(w, r)
+	case len(parts) == 6 && r.Method == http.MethodGet:
+		s.get(w, r, parts[3]+":"+parts[5])
+	case len(parts) == 6 && r.Method == http.MethodDelete:
+		if _, found := s.objects[parts[3]+":"+parts[5]]; !found {
+			s.writeError(w, http.StatusNotFound, "No such object")
+			return
+		}
+		delete(s.objects, parts[3]+":"+parts[5])
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 11 && r.Method == http.MethodPost && parts[6] == "rewriteTo":
+		s.rewrite(w, r, parts[3]+":"+parts[5], parts[8]+":"+parts[10])
+	default:
+		s.writeError(w, http.StatusBadRequest, "unexpected request: "+r.Method+" "+r.URL.Path)
+	}
+}
+
+func (s *mockGCSServer) upload(w http.ResponseWriter, r *http.Request, bucket string) {
+	_, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	reader := multipart.NewReader(r.Body, params["boundary"])
+
+	object := &mockGCSObject{}
+	part, _ := reader.NextPart()
+	json.NewDecoder(part).Decode(&object.gcsObject)
+	part, _ = reader.NextPart()
+	object.body, _ = ioutil.ReadAll(part)
+
+	hash := md5.Sum(object.body)
+	md5Hash := base64.StdEncoding.EncodeToString(hash[:])
+	if object.MD5Hash != "" && object.MD5Hash != md5Hash {
+		s.writeError(w, http.StatusBadRequest, "Provided MD5 hash doesn't match calculated MD5 hash")
+		return
+	}
+
+	updated := time.Date(2018, 1, 8, 12, 0, 0, 0, time.UTC)
+	object.MD5Hash = md5Hash
+	object.Size = int64(len(object.body))
+	object.StorageClass = "STANDARD"
+	object.Updated = &updated
+	object.ETag = "CKih16GjycICEAE="
+	s.objects[bucket+":"+object.Name] = object
+	s.writeJSON(w, http.StatusOK, object.gcsObject)
+}
+
+func (s *mockGCSServer) get(w http.ResponseWriter, r *http.Request, key string) {
+	object, found := s.objects[key]
+	if !found {
+		s.writeError(w, http.StatusNotFound, "No such object: "+key)
+		return
+	}
+
+	if r.URL.Query().Get("alt") != "media" {
+		s.writeJSON(w, http.StatusOK, object.gcsObject)
+		return
+	}
+
+	// without accepting gzip, GCS would decompress gzip encoded objects
+	if object.ContentEncoding == "gzip" && r.Header.Get("Accept-Encoding") != "gzip" {
+		s.writeError(w, http.StatusBadRequest, "mock can't decompress objects")
+		return
+	}
+	w.Header().Set("Content-Type", object.ContentType)
+	w.Header().Set("Content-Encoding", object.ContentEncoding)
+	w.Write(object.body)
+}
+
+func (s *mockGCSServer) rewrite(w http.ResponseWriter, r *http.Request, from string, to string) {
+	object, found := s.objects[from]
+	if !found {
+		s.writeError(w, http.StatusNotFound, "No such object: "+from)
+		return
+	}
+
+	step := 1
+	fmt.Sscanf(r.URL.Query().Get("rewriteToken"), "step-%d", &step)
+	if step < s.rewriteSteps {
+		s.writeJSON(w, http.StatusOK, map[string]interface{}{"done": false, "rewriteToken": fmt.Sprintf("step-%d", step+1)})
+		return
+	}
+
+	copied := *object
+	copied.Name = strings.SplitN(to, ":", 2)[1]
+	replaced := &gcsObject{}
+	if json.NewDecoder(r.Body).Decode(replaced) == nil {
+		copied.ContentType = replaced.ContentType
+		copied.ContentEncoding = replaced.ContentEncoding
+		copied.Metadata = replaced.Metadata
+	}
+	s.objects[to] = &copied
+	s.writeJSON(w, http.StatusOK, map[string]interface{}{"done": true, "resource": copied.gcsObject})
+}
+
+func (s *mockGCSServer) list(w http.ResponseWriter, r *http.Request) {
+	prefix := s.bucket + ":" + r.URL.Query().Get("prefix")
+	keys := make([]string, 0)
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	start := 0
+	fmt.Sscanf(r.URL.Query().Get("pageToken"), "%d", &start)
+	end := start + s.pageSize
+	next := fmt.Sprintf("%d", end)
+	if end >= len(keys) {
+		end = len(keys)
+		next = ""
+	}
+
+	items := make([]gcsObject, 0)
+	for _, key := range keys[start:end] {
+		items = append(items, s.objects[key].gcsObject)
+	}
+	s.writeJSON(w, http.StatusOK, map[string]interface{}{"items": items, "nextPageToken": next})
+}
+
+func TestGCSClient(t *testing.T) {
+	ctx := context.Background()
+	server := newMockGCSServer("test-bucket")
+	defer server.Close()
+	client := server.client()
+
+	assert.NoError(t, client.testBucket(ctx, "test-bucket"))
+	assert.Error(t, client.testBucket(ctx, "other-bucket"))
+
+	// archives are uploaded, verified and read back as they are on S3
+	archive := writeTestArchive(t, 400)
+	defer os.Remove(archive.ArchiveFile)
+	assert.NoError(t, UploadToS3(ctx, client, "test-bucket", "/1/message_D20170812_hash.jsonl.gz", archive))
+	assert.Equal(t, "https://test-bucket.storage.googleapis.com/1/message_D20170812_hash.jsonl.gz", archive.URL)
+
+	object := server.objects["test-bucket:1/message_D20170812_hash.jsonl.gz"]
+	assert.Equal(t, "gzip", object.ContentEncoding)
+	assert.Equal(t, "application/json", object.ContentType)
+	assert.Equal(t, 400, len(object.body))
+	assert.NotEqual(t, "", object.Metadata["md5chksum"])
+
+	assert.NoError(t, VerifyS3Archive(ctx, client, archive))
+	assert.Equal(t, "STANDARD", archive.StorageClass)
+
+	etag, err := GetS3FileETAG(ctx, client, archive.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, archive.Hash, etag)
+
+	reader, err := GetS3File(ctx, client, archive.URL)
+	assert.NoError(t, err)
+	contents, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	reader.Close()
+	assert.Equal(t, object.body, contents)
+
+	// a body which doesn't match its hash is refused
+	mismatched := writeTestArchive(t, 10)
+	defer os.Remove(mismatched.ArchiveFile)
+	mismatched.Hash = archive.Hash
+	assert.Error(t, UploadToS3(ctx, client, "test-bucket", "/1/mismatched.jsonl.gz", mismatched))
+
+	// missing objects are not found the same way they are on S3
+	_, err = GetS3File(ctx, client, "https://test-bucket.storage.googleapis.com/1/missing.jsonl.gz")
+	assert.True(t, isNotFound(err))
+	missing := *archive
+	missing.URL = "https://test-bucket.storage.googleapis.com/1/missing.jsonl.gz"
+	assert.EqualError(t, VerifyS3Archive(ctx, client, &missing), "archive object missing from s3: https://test-bucket.storage.googleapis.com/1/missing.jsonl.gz")
+
+	// copies which take more than one request, replacing their metadata
+	copied, err := client.Copy(ctx, archive.URL, "/1/copied.jsonl.gz", archive.Hash)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://test-bucket.storage.googleapis.com/1/copied.jsonl.gz", copied)
+	assert.Equal(t, object.body, server.objects["test-bucket:1/copied.jsonl.gz"].body)
+	assert.Equal(t, object.Metadata["md5chksum"], server.objects["test-bucket:1/copied.jsonl.gz"].Metadata["md5chksum"])
+
+	// listing pages through our objects, with keys like ours
+	server.pageSize = 1
+	objects, err := client.List(ctx, "test-bucket", "/1/")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(objects))
+	assert.Equal(t, "/1/copied.jsonl.gz", objects[0].Key)
+	assert.Equal(t, "/1/message_D20170812_hash.jsonl.gz", objects[1].Key)
+	assert.Equal(t, int64(400), objects[1].Size)
+	assert.Equal(t, archive.Hash, objects[1].MD5)
+
+	objects, err = client.List(ctx, "test-bucket", "1/")
+	assert.NoError(t, err)
+	assert.Equal(t, "1/copied.jsonl.gz", objects[0].Key)
+
+	// deleting objects which don't exist succeeds, as it does on S3
+	results := client.Delete(ctx, "test-bucket", []string{"/1/copied.jsonl.gz", "/1/missing.jsonl.gz"})
+	assert.Equal(t, map[string]error{"/1/copied.jsonl.gz": nil, "/1/missing.jsonl.gz": nil}, results)
+	assert.Equal(t, 1, len(server.objects))
+
+	// which can't be restored or presigned
+	assert.Error(t, client.Restore(ctx, archive.URL, 3))
+	_, err = client.SignURL(archive.URL, time.Hour)
+	assert.Error(t, err)
+
+	// requests we can't authenticate fail with GCS's reason
+	client.tokens = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "expired"})
+	err = client.testBucket(ctx, "test-bucket")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Unauthorized: Invalid Credentials")
+}
+
+func TestGCSTokenSource(t *testing.T) {
+	ctx := context.Background()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	encoded, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+	privateKey := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: encoded}))
+
+	// our token server checks service accounts asked for our scope
+	grants := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		grants = append(grants, r.Form.Get("grant_type"))
+
+		parts := strings.Split(r.Form.Get("assertion"), ".")
+		claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		if !strings.Contains(string(claims), gcsScope) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token": "token-%d", "expires_in": 3600, "token_type": "Bearer"}`, len(grants))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "gcs")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	contents, _ := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "archiver@rapidpro.iam.gserviceaccount.com",
+		"private_key_id": "1",
+		"private_key":    privateKey,
+		"token_uri":      server.URL,
+	})
+	credentialsFile := filepath.Join(dir, "credentials.json")
+	assert.NoError(t, ioutil.WriteFile(credentialsFile, contents, 0600))
+
+	// tokens are reused until they are about to expire
+	source, err := newGCSTokenSource(ctx, credentialsFile)
+	assert.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		token, err := source.Token()
+		assert.NoError(t, err)
+		assert.Equal(t, "token-1", token.AccessToken)
+	}
+	assert.Equal(t, []string{"urn:ietf:params:oauth:grant-type:jwt-bearer"}, grants)
+
+	// credentials files we can't read or use are refused up front
+	_, err = newGCSTokenSource(ctx, filepath.Join(dir, "missing.json"))
+	assert.Error(t, err)
+
+	assert.NoError(t, ioutil.WriteFile(credentialsFile, []byte("not json"), 0600))
+	_, err = newGCSTokenSource(ctx, credentialsFile)
+	assert.Error(t, err)
+}
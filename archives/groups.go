@@ -0,0 +1,154 @@
+package archives
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// GetGroupArchives returns the archives which cover all the archivable records of the passed in org, as full months
+// up to the month we can archive up to and as days for the rest
+func GetGroupArchives(now time.Time, org Org, archiveType ArchiveType) []*Archive {
+	endDate := org.archiveEndDate(now)
+	firstDaily := time.Date(endDate.Year(), endDate.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	orgUTC := org.startDate().In(time.UTC)
+	start := time.Date(orgUTC.Year(), orgUTC.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	archives := make([]*Archive, 0)
+	for month := start; month.Before(firstDaily); month = month.AddDate(0, 1, 0) {
+		archives = append(archives, &Archive{Org: org, OrgID: org.ID, StartDate: month, ArchiveType: archiveType, Period: MonthPeriod})
+	}
+
+	// our dailies never start before the org does
+	day := firstDaily
+	if orgStart := time.Date(orgUTC.Year(), orgUTC.Month(), orgUTC.Day(), 0, 0, 0, 0, time.UTC); day.Before(orgStart) {
+		day = orgStart
+	}
+	for ; !day.After(endDate); day = day.AddDate(0, 0, 1) {
+		archives = append(archives, &Archive{Org: org, OrgID: org.ID, StartDate: day, ArchiveType: archiveType, Period: DayPeriod})
+	}
+
+	return archives
+}
+
+const lookupGroupOrg = `
+SELECT org_id FROM contacts_contactgroup WHERE id = $1
+`
+
+const selectGroupExports = `
+SELECT start_date::timestamp with time zone as start_date, period
+FROM archiver_group_exports
+WHERE contact_group_id = $1 AND org_id = $2 AND archive_type = $3
+`
+
+const insertGroupExport = `
+INSERT INTO archiver_group_exports(contact_group_id, org_id, archive_type, start_date, period, record_count, size, hash, url, exported_on)
+VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+ON CONFLICT (contact_group_id, org_id, archive_type, start_date, period) DO UPDATE
+SET record_count = EXCLUDED.record_count, size = EXCLUDED.size, hash = EXCLUDED.hash, url = EXCLUDED.url, exported_on = EXCLUDED.exported_on
+`
+
+// CreateGroupArchives builds and uploads archives of the records of the passed in org which belong to contacts in our
+// configured contact group. These are exports for research, they are written under their own prefix rather than
+// recorded as archives and no records are ever deleted. Only the org the group belongs to has anything exported. Each
+// export uploaded is recorded in archiver_group_exports, so later runs only export the periods not exported yet.
+func CreateGroupArchives(ctx context.Context, now time.Time, config *Config, db *sqlx.DB, s3Client Storage, org Org, archiveType ArchiveType) ([]*Archive, error) {
+	if config.ContactGroupID == 0 {
+		return nil, fmt.Errorf("no contact group configured")
+	}
+
+	log := logrus.WithFields(logrus.Fields{
+		"org":              org.Name,
+		"org_id":           org.ID,
+		"archive_type":     archiveType,
+		"contact_group_id": config.ContactGroupID,
+	})
+
+	var groupOrgID int
+	err := db.GetContext(ctx, &groupOrgID, lookupGroupOrg, config.ContactGroupID)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("no contact group with id: %d", config.ContactGroupID)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up org of contact group: %d", config.ContactGroupID)
+	}
+	if groupOrgID != org.ID {
+		log.Debug("contact group belongs to another org, nothing to export")
+		return []*Archive{}, nil
+	}
+
+	exports := make([]*Archive, 0)
+	err = db.SelectContext(ctx, &exports, selectGroupExports, config.ContactGroupID, org.ID, archiveType)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error selecting group exports")
+	}
+	exported := make(map[string]bool, len(exports))
+	for _, e := range exports {
+		exported[groupExportKey(e)] = true
+	}
+
+	created := make([]*Archive, 0)
+	for _, archive := range GetGroupArchives(now, org, archiveType) {
+		if exported[groupExportKey(archive)] {
+			continue
+		}
+
+		err := createGroupArchive(ctx, db, config, s3Client, archive)
+		if err != nil {
+			return created, errors.Wrapf(err, "error creating group archive for %s", archive.StartDate.Format("2006-01-02"))
+		}
+
+		log.WithFields(logrus.Fields{
+			"start_date":   archive.StartDate,
+			"period":       archive.Period,
+			"record_count": archive.RecordCount,
+			"url":          archive.URL,
+		}).Debug("group archive complete")
+
+		created = append(created, archive)
+	}
+
+	return created, nil
+}
+
+// groupExportKey returns the period and start date of the passed in group archive, which identify it among the exports
+// of its org and type
+func groupExportKey(archive *Archive) string {
+	return fmt.Sprintf("%s%s", archive.Period, archive.StartDate.UTC().Format("20060102"))
+}
+
+func createGroupArchive(ctx context.Context, db *sqlx.DB, config *Config, s3Client Storage, archive *Archive) error {
+	err := CreateArchiveFile(ctx, db, config, archive, config.TempDir)
+	if err != nil {
+		return errors.Wrap(err, "error writing archive file")
+	}
+
+	defer func() {
+		if !config.KeepFiles {
+			err := DeleteArchiveFile(archive)
+			if err != nil {
+				logrus.WithError(err).Error("error deleting temporary archive file")
+			}
+		}
+	}()
+
+	if config.UploadToS3 {
+		err = UploadArchive(ctx, config, s3Client, config.S3Bucket, archive)
+		if err != nil {
+			return errors.Wrap(err, "error writing archive to s3")
+		}
+
+		_, err = db.ExecContext(ctx, insertGroupExport, archive.ContactGroupID, archive.OrgID, archive.ArchiveType, archive.StartDate, archive.Period, archive.RecordCount, archive.Size, archive.Hash, archive.URL, time.Now())
+		if err != nil {
+			return errors.Wrap(err, "error recording group export")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+package archives
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetGroupArchives(t *testing.T) {
+	org := Org{ID: 2, CreatedOn: time.Date(2017, 8, 10, 21, 11, 59, 0, time.UTC), RetentionPeriod: 90}
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	// august and september as months, then october up to the end of our retention period as days
+	archives := GetGroupArchives(now, org, MessageType)
+	assert.Equal(t, 12, len(archives))
+	assert.Equal(t, time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC), archives[0].StartDate)
+	assert.Equal(t, MonthPeriod, archives[0].Period)
+	assert.Equal(t, time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC), archives[1].StartDate)
+	assert.Equal(t, MonthPeriod, archives[1].Period)
+	assert.Equal(t, time.Date(2017, 10, 1, 0, 0, 0, 0, time.UTC), archives[2].StartDate)
+	assert.Equal(t, DayPeriod, archives[2].Period)
+	assert.Equal(t, time.Date(2017, 10, 10, 0, 0, 0, 0, time.UTC), archives[11].StartDate)
+	assert.Equal(t, DayPeriod, archives[11].Period)
+
+	// an org created this month only has dailies from when it was created
+	org.CreatedOn = time.Date(2017, 10, 4, 9, 0, 0, 0, time.UTC)
+	archives = GetGroupArchives(now, org, RunType)
+	assert.Equal(t, 7, len(archives))
+	assert.Equal(t, time.Date(2017, 10, 4, 0, 0, 0, 0, time.UTC), archives[0].StartDate)
+	assert.Equal(t, RunType, archives[0].ArchiveType)
+}
+
+func TestCreateGroupArchives(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+
+	config := NewConfig()
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	_, err = CreateGroupArchives(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.EqualError(t, err, "no contact group configured")
+
+	config.ContactGroupID = 99
+	_, err = CreateGroupArchives(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.EqualError(t, err, "no contact group with id: 99")
+
+	// add the contact all our messages and runs are from to our group
+	config.ContactGroupID = 2
+	_, err = db.Exec(`INSERT INTO contacts_contactgroup_contacts(id, contact_id, contactgroup_id) VALUES(5, 6, 2)`)
+	assert.NoError(t, err)
+
+	// deletion is never done for a group, even if configured
+	config.Delete = true
+	created, deleted, err := ArchiveOrg(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(deleted))
+	assert.Equal(t, 12, len(created))
+
+	assert.Equal(t, 4, created[0].RecordCount)
+	assert.Equal(t, 2, created[0].ContactGroupID)
+	assert.True(t, strings.HasPrefix(created[0].URL, "https://dl-archiver-test.s3.amazonaws.com/groups/2/2/message_M201708_"))
+	assert.Equal(t, 1, created[9].RecordCount)
+	assert.True(t, strings.HasPrefix(created[9].URL, "https://dl-archiver-test.s3.amazonaws.com/groups/2/2/message_D20171008_"))
+
+	// our exports are recorded, so later runs only export new periods
+	assertCount(t, db, 12, `SELECT count(*) FROM archiver_group_exports WHERE contact_group_id = 2 AND org_id = 2 AND archive_type = 'message'`)
+	created, _, err = ArchiveOrg(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(created))
+
+	created, _, err = ArchiveOrg(ctx, now.AddDate(0, 0, 1), config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(created))
+	assert.Equal(t, time.Date(2017, 10, 11, 0, 0, 0, 0, time.UTC), created[0].StartDate)
+
+	runs, _, err := ArchiveOrg(ctx, now, config, db, s3Client, orgs[1], RunType)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, runs[0].RecordCount)
+
+	_, err = DeleteArchivedOrgRecords(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.EqualError(t, err, "deletion is disabled when archiving a contact group")
+
+	// our group belongs to org 2, nothing is exported for any other org
+	for _, archiveType := range []ArchiveType{MessageType, RunType} {
+		created, err = CreateGroupArchives(ctx, now, config, db, s3Client, orgs[2], archiveType)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(created))
+	}
+	assertCount(t, db, 0, `SELECT count(*) FROM archiver_group_exports WHERE org_id != 2`)
+	for key := range s3Client.objects {
+		assert.False(t, strings.HasPrefix(key, "dl-archiver-test:/groups/2/3/"), "unexpected export: %s", key)
+	}
+
+	// nothing recorded as archives in the db and nothing deleted
+	assert.EqualError(t, WriteArchiveToDB(ctx, db, runs[0]), "archives scoped to contact group: 2 can't be written to the db")
+	assertCount(t, db, 4, `SELECT count(*) FROM archives_archive`)
+	assertCount(t, db, 9, `SELECT count(*) FROM msgs_msg`)
+}
@@ -0,0 +1,76 @@
+package archives
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+)
+
+// the setting our daemon writes its heartbeat to while it is archiving, empty when it isn't
+const heartbeatSetting = "daemon_heartbeat"
+
+// how often our daemon writes its heartbeat, a heartbeat older than a few of these means our daemon isn't archiving
+var heartbeatInterval = time.Minute
+
+// the number of heartbeat intervals after which a heartbeat is stale
+const staleHeartbeats = 5
+
+// StartHeartbeat writes our heartbeat every heartbeat interval until the returned function is called, which clears it.
+// This lets tools run by hand know whether our daemon is archiving.
+func StartHeartbeat(db *sqlx.DB) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+
+	writeHeartbeat(ctx, db, time.Now().Format(time.RFC3339Nano))
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				writeHeartbeat(ctx, db, time.Now().Format(time.RFC3339Nano))
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+		writeHeartbeat(context.Background(), db, "")
+	}
+}
+
+// writeHeartbeat writes the passed in heartbeat, failing to do so only means tools can't see we're running
+func writeHeartbeat(ctx context.Context, db *sqlx.DB, heartbeat string) {
+	err := SetSetting(ctx, db, heartbeatSetting, heartbeat)
+	if err != nil && ctx.Err() == nil {
+		logrus.WithError(err).Error("error writing heartbeat")
+	}
+}
+
+// CheckDaemonIdle returns an error if our daemon has written a heartbeat recently, ie, it is archiving right now
+func CheckDaemonIdle(ctx context.Context, db *sqlx.DB, now time.Time) error {
+	value, err := GetSetting(ctx, db, heartbeatSetting)
+	if err != nil || value == "" {
+		return err
+	}
+
+	heartbeat, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return fmt.Errorf("invalid heartbeat: %s", value)
+	}
+
+	if now.Sub(heartbeat) < heartbeatInterval*staleHeartbeats {
+		return fmt.Errorf("archiver is running, last heartbeat at %s", heartbeat.In(time.UTC).Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package archives
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeartbeat(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	defer func() { heartbeatInterval = time.Minute }()
+	heartbeatInterval = time.Millisecond * 50
+
+	// no heartbeat means no archiver is running
+	assert.NoError(t, CheckDaemonIdle(ctx, db, time.Now()))
+
+	stop := StartHeartbeat(db)
+	err := CheckDaemonIdle(ctx, db, time.Now())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "archiver is running, last heartbeat at")
+
+	// our heartbeat keeps being written while we run
+	time.Sleep(time.Millisecond * 300)
+	assert.Error(t, CheckDaemonIdle(ctx, db, time.Now()))
+
+	// but an archiver which died without clearing its heartbeat is only running until its heartbeat is stale
+	assert.NoError(t, CheckDaemonIdle(ctx, db, time.Now().Add(time.Second)))
+
+	// stopping clears our heartbeat
+	stop()
+	assert.NoError(t, CheckDaemonIdle(ctx, db, time.Now()))
+	value, err := GetSetting(ctx, db, heartbeatSetting)
+	assert.NoError(t, err)
+	assert.Equal(t, "", value)
+}
@@ -0,0 +1,92 @@
+package archives
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// the number of bits of each hash which pick its register, 4096 registers estimate within about 2%
+const hllPrecision = 12
+
+// hyperLogLog estimates the number of distinct values added to it in a fixed amount of space. Sketches of different
+// archives can be merged, which lets monthlies estimate their distinct values from their dailies alone.
+type hyperLogLog struct {
+	registers []uint8
+}
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{registers: make([]uint8, 1<<hllPrecision)}
+}
+
+// hyperLogLogFromBytes returns the sketch serialized by bytes
+func hyperLogLogFromBytes(b []byte) (*hyperLogLog, error) {
+	if len(b) != 1<<hllPrecision {
+		return nil, fmt.Errorf("invalid sketch, expected %d bytes, got %d", 1<<hllPrecision, len(b))
+	}
+	registers := make([]uint8, len(b))
+	copy(registers, b)
+	return &hyperLogLog{registers: registers}, nil
+}
+
+// add adds the passed in value to our sketch
+func (h *hyperLogLog) add(value string) {
+	hash := fnv.New64a()
+	hash.Write([]byte(value))
+	x := mix64(hash.Sum64())
+
+	register := x >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	if rank > h.registers[register] {
+		h.registers[register] = rank
+	}
+}
+
+// merge adds the values of the passed in sketch to ours
+func (h *hyperLogLog) merge(other *hyperLogLog) {
+	for i, rank := range other.registers {
+		if rank > h.registers[i] {
+			h.registers[i] = rank
+		}
+	}
+}
+
+// count returns the estimated number of distinct values added to our sketch
+func (h *hyperLogLog) count() int {
+	m := float64(len(h.registers))
+
+	sum := 0.0
+	zeros := 0
+	for _, rank := range h.registers {
+		sum += 1 / float64(uint64(1)<<rank)
+		if rank == 0 {
+			zeros++
+		}
+	}
+
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+
+	// small counts are estimated much better by how many registers are still empty
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int(math.Round(estimate))
+}
+
+// bytes returns our sketch serialized, one byte per register
+func (h *hyperLogLog) bytes() []byte {
+	b := make([]byte, len(h.registers))
+	copy(b, h.registers)
+	return b
+}
+
+// mix64 spreads the bits of an fnv hash, whose high bits barely change between similar values such as UUIDs
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,46 @@
+package archives
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHyperLogLog(t *testing.T) {
+	sketch := newHyperLogLog()
+	assert.Equal(t, 0, sketch.count())
+
+	// small counts are exact
+	for i := 0; i < 10; i++ {
+		sketch.add(fmt.Sprintf("contact-%d", i))
+		sketch.add(fmt.Sprintf("contact-%d", i))
+	}
+	assert.Equal(t, 10, sketch.count())
+
+	// large ones within a few percent
+	for i := 0; i < 100000; i++ {
+		sketch.add(fmt.Sprintf("contact-%d", i))
+	}
+	assert.True(t, math.Abs(float64(sketch.count())-100000) < 5000, "count %d too far from 100000", sketch.count())
+
+	// merging counts values in both once
+	first, second := newHyperLogLog(), newHyperLogLog()
+	for i := 0; i < 60000; i++ {
+		first.add(fmt.Sprintf("contact-%d", i))
+	}
+	for i := 40000; i < 100000; i++ {
+		second.add(fmt.Sprintf("contact-%d", i))
+	}
+	first.merge(second)
+	assert.Equal(t, sketch.count(), first.count())
+
+	// and survive serialization
+	restored, err := hyperLogLogFromBytes(first.bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, first.count(), restored.count())
+
+	_, err = hyperLogLogFromBytes([]byte{1, 2, 3})
+	assert.EqualError(t, err, "invalid sketch, expected 4096 bytes, got 3")
+}
@@ -0,0 +1,121 @@
+package archives
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ArchiverHooks are called at points in the lifecycle of each archive so deployments can add steps of their own, such
+// as telling a billing service about new monthlies, without maintaining a fork. Embed NoopHooks to only implement the
+// hooks you need. Hooks are called synchronously, on the goroutine archiving the org, so should be quick.
+//
+// Each hook is passed the org being archived and the archive. Of the archive, its OrgID, ArchiveType, Period and
+// StartDate are always set, and from AfterUpload on so are its ID (once written), RecordCount, Size, Hash and URL.
+// These fields are stable and will keep their meaning, any others may change between releases. Hooks must not modify
+// the archive they are passed.
+//
+// An error from a hook is logged and counted in archiver_hook_errors_total. Unless the hook is listed in FatalHooks we
+// then carry on as if nothing happened, otherwise the step the hook was called around fails as if it had failed itself.
+type ArchiverHooks interface {
+	// BeforeArchiveBuild is called before a daily is built or a monthly is rolled up, failing it stops it being built
+	BeforeArchiveBuild(ctx context.Context, org Org, archive *Archive) error
+
+	// AfterUpload is called once an archive is uploaded but before it's written to the database, failing it stops it
+	// being written so it's built again next time
+	AfterUpload(ctx context.Context, org Org, archive *Archive) error
+
+	// AfterRollup is called once a monthly has been rolled up, uploaded and written, failing it leaves the monthly
+	// written but logs it as failed and leaves it out of the monthlies we return
+	AfterRollup(ctx context.Context, org Org, archive *Archive) error
+
+	// AfterDelete is called once the records of an archive have been deleted, failing it stops us deleting the records
+	// of any more of the org's archives
+	AfterDelete(ctx context.Context, org Org, archive *Archive) error
+}
+
+// NoopHooks is a set of hooks which do nothing, our default
+type NoopHooks struct{}
+
+// BeforeArchiveBuild does nothing
+func (NoopHooks) BeforeArchiveBuild(ctx context.Context, org Org, archive *Archive) error { return nil }
+
+// AfterUpload does nothing
+func (NoopHooks) AfterUpload(ctx context.Context, org Org, archive *Archive) error { return nil }
+
+// AfterRollup does nothing
+func (NoopHooks) AfterRollup(ctx context.Context, org Org, archive *Archive) error { return nil }
+
+// AfterDelete does nothing
+func (NoopHooks) AfterDelete(ctx context.Context, org Org, archive *Archive) error { return nil }
+
+// the names of our hooks, as listed in FatalHooks
+const (
+	HookBeforeArchiveBuild = "BeforeArchiveBuild"
+	HookAfterUpload        = "AfterUpload"
+	HookAfterRollup        = "AfterRollup"
+	HookAfterDelete        = "AfterDelete"
+)
+
+var hookNames = []string{HookBeforeArchiveBuild, HookAfterUpload, HookAfterRollup, HookAfterDelete}
+
+var hookErrors = newCounter("archiver_hook_errors_total", "Number of errors returned by archiver hooks.", "hook")
+
+// the hooks we call and which of them fail their step when they error, none until configured
+var hooks ArchiverHooks = NoopHooks{}
+var fatalHooks = map[string]bool{}
+
+// ConfigureHooks sets the hooks we call around the lifecycle of each archive, and which of them are fatal from the
+// passed in config. Passing nil hooks restores our default of no hooks.
+func ConfigureHooks(config *Config, h ArchiverHooks) error {
+	fatal := make(map[string]bool)
+	for _, name := range strings.Split(config.FatalHooks, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		known := false
+		for _, n := range hookNames {
+			known = known || n == name
+		}
+		if !known {
+			return fmt.Errorf("invalid fatal hook: %s, must be one of %s", name, strings.Join(hookNames, ", "))
+		}
+		fatal[name] = true
+	}
+
+	if h == nil {
+		h = NoopHooks{}
+	}
+	hooks = h
+	fatalHooks = fatal
+	return nil
+}
+
+// runHook calls the passed in hook for the passed in archive, logging any error and only returning it if the hook is fatal
+func runHook(ctx context.Context, name string, hook func(context.Context, Org, *Archive) error, org Org, archive *Archive) error {
+	err := hook(ctx, org, archive)
+	if err == nil {
+		return nil
+	}
+
+	hookErrors.add(1, name)
+	log := logrus.WithError(err).WithFields(logrus.Fields{
+		"hook":         name,
+		"org_id":       org.ID,
+		"archive_id":   archive.ID,
+		"archive_type": archive.ArchiveType,
+		"start_date":   archive.StartDate,
+		"period":       archive.Period,
+	})
+
+	if fatalHooks[name] {
+		log.Error("fatal error in archiver hook")
+		return errors.Wrapf(err, "error in %s hook", name)
+	}
+	log.Warn("error in archiver hook, continuing")
+	return nil
+}
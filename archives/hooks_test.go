@@ -0,0 +1,154 @@
+package archives
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingHooks records each call to each of our hooks, returning the error set for the hook if any
+type recordingHooks struct {
+	mutex sync.Mutex
+	calls map[string][]*Archive
+	fail  map[string]error
+}
+
+func newRecordingHooks() *recordingHooks {
+	return &recordingHooks{calls: make(map[string][]*Archive), fail: make(map[string]error)}
+}
+
+func (h *recordingHooks) record(name string, org Org, archive *Archive) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if archive.OrgID != org.ID {
+		return fmt.Errorf("archive of org %d passed with org %d", archive.OrgID, org.ID)
+	}
+	h.calls[name] = append(h.calls[name], archive)
+	return h.fail[name]
+}
+
+func (h *recordingHooks) BeforeArchiveBuild(ctx context.Context, org Org, archive *Archive) error {
+	return h.record(HookBeforeArchiveBuild, org, archive)
+}
+
+func (h *recordingHooks) AfterUpload(ctx context.Context, org Org, archive *Archive) error {
+	return h.record(HookAfterUpload, org, archive)
+}
+
+func (h *recordingHooks) AfterRollup(ctx context.Context, org Org, archive *Archive) error {
+	return h.record(HookAfterRollup, org, archive)
+}
+
+func (h *recordingHooks) AfterDelete(ctx context.Context, org Org, archive *Archive) error {
+	return h.record(HookAfterDelete, org, archive)
+}
+
+func TestConfigureHooks(t *testing.T) {
+	defer ConfigureHooks(NewConfig(), nil)
+
+	config := NewConfig()
+	config.FatalHooks = "AfterUpload, AfterBuild"
+	assert.EqualError(t, ConfigureHooks(config, newRecordingHooks()), "invalid fatal hook: AfterBuild, must be one of BeforeArchiveBuild, AfterUpload, AfterRollup, AfterDelete")
+	assert.Equal(t, NoopHooks{}, hooks)
+
+	config.FatalHooks = "AfterUpload, AfterRollup"
+	recorder := newRecordingHooks()
+	assert.NoError(t, ConfigureHooks(config, recorder))
+	assert.Equal(t, map[string]bool{HookAfterUpload: true, HookAfterRollup: true}, fatalHooks)
+
+	// errors from hooks which aren't fatal are only logged
+	org := Org{ID: 2}
+	archive := &Archive{OrgID: 2, ArchiveType: MessageType, Period: DayPeriod}
+	recorder.fail[HookBeforeArchiveBuild] = fmt.Errorf("billing is down")
+	recorder.fail[HookAfterUpload] = fmt.Errorf("billing is down")
+	assert.NoError(t, runHook(context.Background(), HookBeforeArchiveBuild, hooks.BeforeArchiveBuild, org, archive))
+	assert.EqualError(t, runHook(context.Background(), HookAfterUpload, hooks.AfterUpload, org, archive), "error in AfterUpload hook: billing is down")
+	assert.Equal(t, 1, len(recorder.calls[HookAfterUpload]))
+
+	// and our default is no hooks at all
+	assert.NoError(t, ConfigureHooks(NewConfig(), nil))
+	assert.Equal(t, NoopHooks{}, hooks)
+	assert.Equal(t, map[string]bool{}, fatalHooks)
+}
+
+func TestArchiverHooks(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+	defer ConfigureHooks(NewConfig(), nil)
+
+	config := NewConfig()
+	config.Delete = true
+	recorder := newRecordingHooks()
+	assert.NoError(t, ConfigureHooks(config, recorder))
+
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	created, deleted, err := ArchiveOrg(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 63, len(created))
+
+	// each archive we created was built and uploaded, and each of our monthlies rolled up
+	assert.Equal(t, 63, len(recorder.calls[HookBeforeArchiveBuild]))
+	assert.Equal(t, 63, len(recorder.calls[HookAfterUpload]))
+	assert.Equal(t, 2, len(recorder.calls[HookAfterRollup]))
+	for _, archive := range recorder.calls[HookAfterUpload] {
+		assert.NotEqual(t, "", archive.URL)
+		assert.NotEqual(t, "", archive.Hash)
+	}
+	for _, archive := range recorder.calls[HookAfterRollup] {
+		assert.Equal(t, MonthPeriod, archive.Period)
+		assert.NotEqual(t, 0, archive.ID)
+	}
+
+	// and we were told of each archive whose records we deleted
+	deletedIDs := make(map[int]bool)
+	for _, archive := range deleted {
+		deletedIDs[archive.ID] = true
+	}
+	assert.True(t, len(recorder.calls[HookAfterDelete]) > 0)
+	for _, archive := range recorder.calls[HookAfterDelete] {
+		assert.True(t, deletedIDs[archive.ID], "hook called for archive %d which wasn't deleted", archive.ID)
+	}
+
+	// a fatal hook fails the step it's called around
+	config.Delete = false
+	config.FatalHooks = "AfterRollup"
+	recorder = newRecordingHooks()
+	recorder.fail[HookAfterUpload] = fmt.Errorf("tagging failed")
+	recorder.fail[HookAfterRollup] = fmt.Errorf("billing is down")
+	assert.NoError(t, ConfigureHooks(config, recorder))
+
+	dailies, err := GetMissingDailyArchives(ctx, db, now, orgs[1], RunType)
+	assert.NoError(t, err)
+	assert.NoError(t, createArchives(ctx, db, config, s3Client, orgs[1], dailies))
+	assertCount(t, db, 62, `SELECT count(*) FROM archives_archive WHERE org_id = 2 AND archive_type = 'run' AND period = 'D' AND url != ''`)
+
+	monthlies, err := RollupOrgArchives(ctx, now, config, db, s3Client, orgs[1], RunType)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(monthlies))
+	assert.Equal(t, 2, len(recorder.calls[HookAfterRollup]))
+	assertCount(t, db, 2, `SELECT count(*) FROM archives_archive WHERE org_id = 2 AND archive_type = 'run' AND period = 'M'`)
+
+	// failing before we build means nothing is built
+	config.FatalHooks = "BeforeArchiveBuild"
+	recorder = newRecordingHooks()
+	recorder.fail[HookBeforeArchiveBuild] = fmt.Errorf("org is frozen")
+	assert.NoError(t, ConfigureHooks(config, recorder))
+
+	dailies, err = GetMissingDailyArchives(ctx, db, now, orgs[2], RunType)
+	assert.NoError(t, err)
+	assert.NoError(t, createArchives(ctx, db, config, s3Client, orgs[2], dailies))
+	assert.Equal(t, len(dailies), len(recorder.calls[HookBeforeArchiveBuild]))
+	assert.Equal(t, 0, len(recorder.calls[HookAfterUpload]))
+	for _, daily := range dailies {
+		assert.Equal(t, 0, daily.ID)
+	}
+}
@@ -0,0 +1,125 @@
+package archives
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// Location is where a record belongs in our archives, the daily and monthly whose windows contain it and, if they
+// exist, their archives
+type Location struct {
+	Timestamp time.Time
+
+	Daily   *Archive
+	Monthly *Archive
+
+	// DailyExists and MonthlyExists are whether the archives have been built, if not ours are only their windows
+	DailyExists   bool
+	MonthlyExists bool
+}
+
+// locationWindows returns the daily and monthly whose windows contain the passed in timestamp, our days are always UTC
+func locationWindows(org Org, archiveType ArchiveType, timestamp time.Time) (*Archive, *Archive) {
+	timestamp = timestamp.In(time.UTC)
+	day := time.Date(timestamp.Year(), timestamp.Month(), timestamp.Day(), 0, 0, 0, 0, time.UTC)
+	month := time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	daily := &Archive{Org: org, OrgID: org.ID, ArchiveType: archiveType, StartDate: day, Period: DayPeriod}
+	monthly := &Archive{Org: org, OrgID: org.ID, ArchiveType: archiveType, StartDate: month, Period: MonthPeriod}
+	return daily, monthly
+}
+
+// LocateRecord returns where a record of the passed in org and type with the passed in timestamp belongs, which for
+// runs is the time of our run partition field
+func LocateRecord(ctx context.Context, db *sqlx.DB, org Org, archiveType ArchiveType, timestamp time.Time) (*Location, error) {
+	location := &Location{Timestamp: timestamp.In(time.UTC)}
+	location.Daily, location.Monthly = locationWindows(org, archiveType, timestamp)
+
+	dailies, err := GetDailyArchivesForDateRange(ctx, db, org, archiveType, location.Daily.StartDate, location.Daily.StartDate)
+	if err != nil {
+		return nil, err
+	}
+	if len(dailies) > 0 {
+		location.Daily = dailies[0]
+		location.Daily.Org = org
+		location.DailyExists = true
+	}
+
+	monthly, err := getMonthlyArchive(ctx, db, org, archiveType, location.Monthly.StartDate)
+	if err != nil {
+		return nil, err
+	}
+	if monthly != nil {
+		location.Monthly = monthly
+		location.MonthlyExists = true
+	}
+
+	return location, nil
+}
+
+const lookupMsgTimestamp = `
+SELECT created_on FROM msgs_msg WHERE org_id = $1 AND id = $2
+`
+
+const lookupRunTimestamp = `
+SELECT fr.%s FROM flows_flowrun fr WHERE fr.org_id = $1 AND fr.id = $2
+`
+
+const lookupContactTimestamp = `
+SELECT created_on FROM contacts_contact WHERE org_id = $1 AND id = $2
+`
+
+// sessions still waiting haven't ended so don't belong in any archive yet
+const lookupSessionTimestamp = `
+SELECT ended_on FROM flows_flowsession WHERE org_id = $1 AND id = $2 AND ended_on IS NOT NULL
+`
+
+const lookupBroadcastTimestamp = `
+SELECT created_on FROM msgs_broadcast WHERE org_id = $1 AND id = $2
+`
+
+const lookupChannelEventTimestamp = `
+SELECT created_on FROM channels_channelevent WHERE org_id = $1 AND id = $2
+`
+
+// LookupRecordTimestamp returns the timestamp which decides which archives the message, run, contact, session,
+// broadcast or channel event of the passed in org with the passed in id belongs in. Records which have been deleted can
+// only be located by their timestamp.
+func LookupRecordTimestamp(ctx context.Context, db *sqlx.DB, config *Config, org Org, archiveType ArchiveType, id int64) (time.Time, error) {
+	var query string
+	switch archiveType {
+	case MessageType:
+		query = lookupMsgTimestamp
+	case RunType:
+		field, err := runPartitionField(config)
+		if err != nil {
+			return time.Time{}, err
+		}
+		query = fmt.Sprintf(lookupRunTimestamp, field)
+	case ContactType:
+		query = lookupContactTimestamp
+	case SessionType:
+		query = lookupSessionTimestamp
+	case BroadcastType:
+		query = lookupBroadcastTimestamp
+	case ChannelEventType:
+		query = lookupChannelEventTimestamp
+	default:
+		return time.Time{}, fmt.Errorf("unknown archive type: %s", archiveType)
+	}
+
+	var timestamp time.Time
+	err := db.GetContext(ctx, &timestamp, query, org.ID, id)
+	if err == sql.ErrNoRows {
+		return time.Time{}, fmt.Errorf("no %s with id: %d for org: %d, it may have been deleted", archiveType, id, org.ID)
+	}
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "error looking up %s: %d", archiveType, id)
+	}
+	return timestamp, nil
+}
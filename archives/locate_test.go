@@ -0,0 +1,118 @@
+package archives
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocationWindows(t *testing.T) {
+	org := Org{ID: 2}
+
+	tcs := []struct {
+		Timestamp  time.Time
+		DayStart   time.Time
+		DayEnd     time.Time
+		MonthStart time.Time
+		MonthEnd   time.Time
+	}{
+		{
+			time.Date(2017, 8, 12, 21, 11, 59, 0, time.UTC),
+			time.Date(2017, 8, 12, 0, 0, 0, 0, time.UTC), time.Date(2017, 8, 13, 0, 0, 0, 0, time.UTC),
+			time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC), time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			// midnight starts a new day
+			time.Date(2017, 8, 12, 0, 0, 0, 0, time.UTC),
+			time.Date(2017, 8, 12, 0, 0, 0, 0, time.UTC), time.Date(2017, 8, 13, 0, 0, 0, 0, time.UTC),
+			time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC), time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			// and the first midnight of the month a new month
+			time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC), time.Date(2017, 9, 2, 0, 0, 0, 0, time.UTC),
+			time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC), time.Date(2017, 10, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			time.Date(2017, 8, 31, 23, 59, 59, 999999000, time.UTC),
+			time.Date(2017, 8, 31, 0, 0, 0, 0, time.UTC), time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC), time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			// february and the end of the year
+			time.Date(2016, 2, 29, 12, 0, 0, 0, time.UTC),
+			time.Date(2016, 2, 29, 0, 0, 0, 0, time.UTC), time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2016, 2, 1, 0, 0, 0, 0, time.UTC), time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			time.Date(2017, 12, 31, 23, 0, 0, 0, time.UTC),
+			time.Date(2017, 12, 31, 0, 0, 0, 0, time.UTC), time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2017, 12, 1, 0, 0, 0, 0, time.UTC), time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			// our days are UTC whatever the timezone of the timestamp
+			time.Date(2017, 9, 1, 1, 0, 0, 0, time.FixedZone("", 7200)),
+			time.Date(2017, 8, 31, 0, 0, 0, 0, time.UTC), time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC), time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for _, tc := range tcs {
+		daily, monthly := locationWindows(org, MessageType, tc.Timestamp)
+		assert.Equal(t, tc.DayStart, daily.StartDate, "unexpected day start for: %s", tc.Timestamp)
+		assert.Equal(t, tc.DayEnd, daily.EndDate(), "unexpected day end for: %s", tc.Timestamp)
+		assert.Equal(t, tc.MonthStart, monthly.StartDate, "unexpected month start for: %s", tc.Timestamp)
+		assert.Equal(t, tc.MonthEnd, monthly.EndDate(), "unexpected month end for: %s", tc.Timestamp)
+	}
+}
+
+func TestLocateRecord(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+
+	config := NewConfig()
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	timestamp, err := LookupRecordTimestamp(ctx, db, config, orgs[1], MessageType, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2017, 8, 12, 21, 11, 59, 890662000, time.UTC), timestamp.In(time.UTC))
+
+	_, err = LookupRecordTimestamp(ctx, db, config, orgs[1], MessageType, 1234)
+	assert.EqualError(t, err, "no message with id: 1234 for org: 2, it may have been deleted")
+
+	// nothing is archived yet, so we only know where our message belongs
+	location, err := LocateRecord(ctx, db, orgs[1], MessageType, timestamp)
+	assert.NoError(t, err)
+	assert.False(t, location.DailyExists)
+	assert.False(t, location.MonthlyExists)
+	assert.Equal(t, time.Date(2017, 8, 12, 0, 0, 0, 0, time.UTC), location.Daily.StartDate)
+	assert.Equal(t, time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC), location.Monthly.StartDate)
+
+	_, err = CreateOrgArchives(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+	monthlies, err := RollupOrgArchives(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+
+	location, err = LocateRecord(ctx, db, orgs[1], MessageType, timestamp)
+	assert.NoError(t, err)
+	assert.True(t, location.DailyExists)
+	assert.Equal(t, time.Date(2017, 8, 12, 0, 0, 0, 0, time.UTC), location.Daily.StartDate)
+	assert.Equal(t, 3, location.Daily.RecordCount)
+	assert.NotEqual(t, "", location.Daily.URL)
+	assert.True(t, location.MonthlyExists)
+	assert.Equal(t, monthlies[0].ID, location.Monthly.ID)
+	assert.Equal(t, monthlies[0].URL, location.Monthly.URL)
+
+	// runs are located by their partition field
+	timestamp, err = LookupRecordTimestamp(ctx, db, config, orgs[1], RunType, 1)
+	assert.NoError(t, err)
+	location, err = LocateRecord(ctx, db, orgs[1], RunType, timestamp)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2017, 8, 12, 0, 0, 0, 0, time.UTC), location.Daily.StartDate)
+	assert.False(t, location.DailyExists)
+}
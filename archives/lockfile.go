@@ -0,0 +1,57 @@
+package archives
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ErrLocked is returned when another process already holds the lock file we tried to acquire
+var ErrLocked = errors.New("lock file is held by another process")
+
+// FileLock is an exclusive lock on a file, held until released or our process exits
+type FileLock struct {
+	file    *os.File
+	release sync.Once
+}
+
+// AcquireFileLock takes an exclusive lock on the file at the passed in path, creating it if need be. If another process
+// holds it we wait for them to release it when wait is set, otherwise we return ErrLocked. The file is never removed,
+// as removing it would let a process waiting on the old file and one creating a new file both hold a lock.
+func AcquireFileLock(path string, wait bool) (*FileLock, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error opening lock file: %s", path)
+	}
+
+	err = lockFile(file, wait)
+	if err != nil {
+		file.Close()
+		if err == ErrLocked {
+			return nil, err
+		}
+		return nil, errors.Wrapf(err, "error locking lock file: %s", path)
+	}
+
+	// record who holds our lock for whoever finds it held, failing to isn't a reason not to run
+	if err := file.Truncate(0); err == nil {
+		file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+
+	return &FileLock{file: file}, nil
+}
+
+// Release releases our lock, it is safe to call more than once
+func (l *FileLock) Release() error {
+	err := fmt.Errorf("lock file already released")
+	l.release.Do(func() {
+		err = unlockFile(l.file)
+		if closeErr := l.file.Close(); err == nil {
+			err = closeErr
+		}
+	})
+	return err
+}
@@ -0,0 +1,60 @@
+package archives
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lockfile")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "archiver.lock")
+
+	lock, err := AcquireFileLock(path, false)
+	assert.NoError(t, err)
+
+	// the file records who holds it
+	contents, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(os.Getpid()), strings.TrimSpace(string(contents)))
+
+	// nobody else can take it while we hold it
+	_, err = AcquireFileLock(path, false)
+	assert.Equal(t, ErrLocked, err)
+
+	// unless they wait for us to release it
+	acquired := make(chan *FileLock)
+	go func() {
+		waited, err := AcquireFileLock(path, true)
+		assert.NoError(t, err)
+		acquired <- waited
+	}()
+
+	select {
+	case <-acquired:
+		assert.Fail(t, "lock acquired while still held")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	assert.NoError(t, lock.Release())
+	assert.EqualError(t, lock.Release(), "lock file already released")
+
+	waited := <-acquired
+	assert.NoError(t, waited.Release())
+
+	// the file is left in place for the next archiver to lock
+	_, err = os.Stat(path)
+	assert.NoError(t, err)
+
+	_, err = AcquireFileLock(filepath.Join(dir, "missing", "archiver.lock"), false)
+	assert.Error(t, err)
+}
@@ -0,0 +1,33 @@
+//go:build !windows
+// +build !windows
+
+package archives
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive flock on the passed in file, blocking until we have it if wait is set
+func lockFile(file *os.File, wait bool) error {
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+
+	for {
+		err := syscall.Flock(int(file.Fd()), how)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.EWOULDBLOCK {
+			return ErrLocked
+		}
+		return err
+	}
+}
+
+// unlockFile releases our flock on the passed in file
+func unlockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,19 @@
+//go:build windows
+// +build windows
+
+package archives
+
+import (
+	"fmt"
+	"os"
+)
+
+// lockFile isn't supported on windows, where we have no flock
+func lockFile(file *os.File, wait bool) error {
+	return fmt.Errorf("lock files are not supported on windows")
+}
+
+// unlockFile isn't supported on windows, where we have no flock
+func unlockFile(file *os.File) error {
+	return fmt.Errorf("lock files are not supported on windows")
+}
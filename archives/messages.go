@@ -6,18 +6,19 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
+// messages are written in order of created_on, ties broken by id, so a rebuilt archive is always identical. Their contact
+// always has a uuid, the key to join them with runs, and a name unless the org is anon.
 const lookupMsgs = `
 SELECT rec.visibility, row_to_json(rec) FROM (
 	SELECT
 	  mm.id,
 	  broadcast_id as broadcast,
-	  row_to_json(contact) as contact,
+	  CASE WHEN oo.is_anon = False THEN row_to_json(contact) ELSE row_to_json(anon_contact) END as contact,
 	  CASE WHEN oo.is_anon = False THEN ccu.identity ELSE null END as urn,
 	  row_to_json(channel) as channel,
 	  CASE WHEN direction = 'I' THEN 'in'
@@ -59,23 +60,36 @@ SELECT rec.visibility, row_to_json(rec) FROM (
 	FROM msgs_msg mm 
 	  JOIN orgs_org oo ON mm.org_id = oo.id
 	  JOIN LATERAL (select uuid, name from contacts_contact cc where cc.id = mm.contact_id) as contact ON True
+	  LEFT JOIN LATERAL (select uuid from contacts_contact cc where oo.is_anon AND cc.id = mm.contact_id) as anon_contact ON True
 	  LEFT JOIN contacts_contacturn ccu ON mm.contact_urn_id = ccu.id
 	  LEFT JOIN LATERAL (select uuid, name from channels_channel ch where ch.id = mm.channel_id) as channel ON True
 	  LEFT JOIN LATERAL (select coalesce(jsonb_agg(label_row), '[]'::jsonb) as data from (select uuid, name from msgs_label ml INNER JOIN msgs_msg_labels mml ON ml.id = mml.label_id AND mml.msg_id = mm.id) as label_row) as labels_agg ON True
 
-	  WHERE mm.org_id = $1 AND mm.created_on >= $2 AND mm.created_on < $3
-	ORDER BY created_on ASC, id ASC) rec; 
+	  WHERE mm.org_id = $1 AND mm.created_on >= $2 AND mm.created_on < $3 AND ($4 = 0 OR mm.contact_id IN (SELECT contact_id FROM contacts_contactgroup_contacts WHERE contactgroup_id = $4)) %[1]s
+	) rec
+ORDER BY rec.created_on ASC, rec.id ASC;
+`
+
+const lookupEarliestMsg = `
+SELECT MIN(created_on) FROM msgs_msg WHERE org_id = $1 AND created_on < $2
+`
+
+// deleted messages are never written to archives so aren't counted
+const countMsgsInRange = `
+SELECT count(*) FROM msgs_msg mm WHERE mm.org_id = $1 AND mm.created_on >= $2 AND mm.created_on < $3 AND mm.visibility != 'D' %[1]s
 `
 
 // writeMessageRecords writes the messages in the archive's date range to the passed in writer
-func writeMessageRecords(ctx context.Context, db *sqlx.DB, archive *Archive, writer *bufio.Writer) (int, error) {
+func writeMessageRecords(ctx context.Context, db *sqlx.DB, config *Config, archive *Archive, writer *bufio.Writer) (int, error) {
 	var rows *sqlx.Rows
 	recordCount := 0
+	summarizer := newSummarizer(config, MessageType)
+	contacts := newContactCounter(config)
 
 	// first write our normal records
 	var record, visibility string
 
-	rows, err := db.QueryxContext(ctx, lookupMsgs, archive.Org.ID, archive.StartDate, archive.endDate())
+	rows, err := db.QueryxContext(ctx, fmt.Sprintf(lookupMsgs, extraFilterClause(config, MessageType)), archive.Org.ID, archive.StartDate, archive.EndDate(), config.ContactGroupID)
 	if err != nil {
 		return 0, errors.Wrapf(err, "error querying messages for org: %d", archive.Org.ID)
 	}
@@ -90,11 +104,30 @@ func writeMessageRecords(ctx context.Context, db *sqlx.DB, archive *Archive, wri
 		if visibility == "deleted" {
 			continue
 		}
+
+		if config.CanonicalJSON {
+			record, err = canonicalizeRecord(record)
+			if err != nil {
+				return 0, errors.Wrapf(err, "error canonicalizing message record for org: %d", archive.Org.ID)
+			}
+		}
+
 		writer.WriteString(record)
 		writer.WriteString("\n")
+		summarizer.add(record)
+		contacts.add(record)
 		recordCount++
 	}
 
+	// a dropped connection ends our iteration early, make sure we never treat that as a complete archive
+	err = rows.Err()
+	if err != nil {
+		return 0, errors.Wrapf(err, "error reading message rows for org: %d", archive.Org.ID)
+	}
+
+	archive.Summary = summarizer.summary()
+	contacts.record(archive)
+
 	logrus.WithField("record_count", recordCount).Debug("Done Writing")
 	return recordCount, nil
 }
@@ -103,7 +136,7 @@ const selectOrgMessagesInRange = `
 SELECT mm.id, mm.visibility
 FROM msgs_msg mm
 LEFT JOIN contacts_contact cc ON cc.id = mm.contact_id
-WHERE mm.org_id = $1 AND mm.created_on >= $2 AND mm.created_on < $3
+WHERE mm.org_id = $1 AND mm.created_on >= $2 AND mm.created_on < $3 %[1]s
 ORDER BY mm.created_on ASC, mm.id ASC
 `
 
@@ -132,7 +165,7 @@ WHERE id IN(?)
 // all the messages in the archive date range, and if equal or fewer than the number archived, deletes them 100 at a time
 //
 // Upon completion it updates the needs_deletion flag on the archive
-func DeleteArchivedMessages(ctx context.Context, config *Config, db *sqlx.DB, s3Client s3iface.S3API, archive *Archive) error {
+func DeleteArchivedMessages(ctx context.Context, config *Config, db *sqlx.DB, s3Client Storage, archive *Archive) error {
 	outer, cancel := context.WithTimeout(ctx, time.Hour*3)
 	defer cancel()
 
@@ -141,25 +174,52 @@ func DeleteArchivedMessages(ctx context.Context, config *Config, db *sqlx.DB, s3
 		"id":           archive.ID,
 		"org_id":       archive.OrgID,
 		"start_date":   archive.StartDate,
-		"end_date":     archive.endDate(),
+		"end_date":     archive.EndDate(),
 		"archive_type": archive.ArchiveType,
 		"total_count":  archive.RecordCount,
 	})
 	log.Info("deleting messages")
 
-	// first things first, make sure our file is present on S3
-	md5, err := GetS3FileETAG(outer, s3Client, archive.URL)
+	// first things first, make sure our file is present on S3 and matches what we archived, we never delete
+	// records that aren't backed by a valid archive
+	err := verifyArchive(outer, s3Client, archive)
+	if err != nil {
+		return errors.Wrap(err, "refusing to delete, archive not verified")
+	}
+
+	// ok, archive file looks good, in strict mode we delete exactly the messages in it, otherwise those in its period
+	if config.DeleteByArchiveContents {
+		err = deleteArchiveContents(outer, config, db, s3Client, archive, deleteMessageBatch)
+	} else {
+		err = deleteMessagesInPeriod(outer, config, db, archive, log)
+	}
 	if err != nil {
 		return err
 	}
 
-	// if our etag and archive md5 don't match, that's an error, return
-	if md5 != archive.Hash {
-		return fmt.Errorf("archive md5: %s and s3 etag: %s do not match", archive.Hash, md5)
+	outer, cancel = context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	deletedOn := time.Now()
+
+	// all went well! mark our archive as no longer needing deletion
+	_, err = db.ExecContext(outer, setArchiveDeleted, archive.ID, deletedOn)
+	if err != nil {
+		return errors.Wrap(err, "error setting archive as deleted")
 	}
+	archive.NeedsDeletion = false
+	archive.DeletedOn = &deletedOn
 
-	// ok, archive file looks good, let's build up our list of message ids, this may be big but we are int64s so shouldn't be too big
-	rows, err := db.QueryxContext(outer, selectOrgMessagesInRange, archive.OrgID, archive.StartDate, archive.endDate())
+	logrus.WithField("elapsed", time.Since(start)).Info("completed deleting messages")
+
+	return nil
+}
+
+// deleteMessagesInPeriod deletes the messages in the period of the passed in archive, if there are no more of them
+// than the archive has
+func deleteMessagesInPeriod(ctx context.Context, config *Config, db *sqlx.DB, archive *Archive, log *logrus.Entry) error {
+	// build up our list of message ids, this may be big but we are int64s so shouldn't be too big
+	rows, err := db.QueryxContext(ctx, fmt.Sprintf(selectOrgMessagesInRange, extraFilterClause(config, MessageType)), archive.OrgID, archive.StartDate, archive.EndDate())
 	if err != nil {
 		return err
 	}
@@ -190,70 +250,64 @@ func DeleteArchivedMessages(ctx context.Context, config *Config, db *sqlx.DB, s3
 		return fmt.Errorf("more messages in the database: %d than in archive: %d", visibleCount, archive.RecordCount)
 	}
 
-	// ok, delete our messages in batches, we do this in transactions as it spans a few different queries
+	// ok, delete our messages in batches
 	for _, idBatch := range chunkIDs(msgIDs, deleteTransactionSize) {
-		// no single batch should take more than a few minutes
-		ctx, cancel := context.WithTimeout(ctx, time.Minute*15)
-		defer cancel()
-
-		start := time.Now()
-
-		// start our transaction
-		tx, err := db.BeginTxx(ctx, nil)
+		err = deleteMessageBatch(ctx, db, idBatch)
 		if err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
-		// first update our delete_reason
-		err = executeInQuery(ctx, tx, setMessageDeleteReason, idBatch)
-		if err != nil {
-			return errors.Wrap(err, "error updating delete reason")
-		}
+// deleteMessageBatch deletes the passed in messages and everything attached to them, in a transaction as it spans a
+// few different queries
+func deleteMessageBatch(ctx context.Context, db *sqlx.DB, idBatch []int64) error {
+	// no single batch should take more than a few minutes
+	ctx, cancel := context.WithTimeout(ctx, time.Minute*15)
+	defer cancel()
 
-		// now delete any channel logs
-		err = executeInQuery(ctx, tx, deleteMessageLogs, idBatch)
-		if err != nil {
-			return errors.Wrap(err, "error removing channel logs")
-		}
+	start := time.Now()
 
-		// then any labels
-		err = executeInQuery(ctx, tx, deleteMessageLabels, idBatch)
-		if err != nil {
-			return errors.Wrap(err, "error removing message labels")
-		}
+	// start our transaction
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
 
-		// finally, delete our messages
-		err = executeInQuery(ctx, tx, deleteMessages, idBatch)
-		if err != nil {
-			return errors.Wrap(err, "error deleting messages")
-		}
+	// first update our delete_reason
+	err = executeInQuery(ctx, tx, setMessageDeleteReason, idBatch)
+	if err != nil {
+		return errors.Wrap(err, "error updating delete reason")
+	}
 
-		// commit our transaction
-		err = tx.Commit()
+	// now delete any channel logs
+	if tableExists("channels_channellog") {
+		err = executeInQuery(ctx, tx, deleteMessageLogs, idBatch)
 		if err != nil {
-			return errors.Wrap(err, "error committing message delete transaction")
+			return errors.Wrap(err, "error removing channel logs")
 		}
-
-		log.WithField("elapsed", time.Since(start)).WithField("count", len(idBatch)).Debug("deleted batch of messages")
-
-		cancel()
 	}
 
-	outer, cancel = context.WithTimeout(ctx, time.Minute)
-	defer cancel()
-
-	deletedOn := time.Now()
+	// then any labels
+	err = executeInQuery(ctx, tx, deleteMessageLabels, idBatch)
+	if err != nil {
+		return errors.Wrap(err, "error removing message labels")
+	}
 
-	// all went well! mark our archive as no longer needing deletion
-	_, err = db.ExecContext(outer, setArchiveDeleted, archive.ID, deletedOn)
+	// finally, delete our messages
+	err = executeInQuery(ctx, tx, deleteMessages, idBatch)
 	if err != nil {
-		return errors.Wrap(err, "error setting archive as deleted")
+		return errors.Wrap(err, "error deleting messages")
 	}
-	archive.NeedsDeletion = false
-	archive.DeletedOn = &deletedOn
 
-	logrus.WithField("elapsed", time.Since(start)).Info("completed deleting messages")
+	// commit our transaction
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "error committing message delete transaction")
+	}
 
+	logrus.WithField("elapsed", time.Since(start)).WithField("count", len(idBatch)).Debug("deleted batch of messages")
 	return nil
 }
 
@@ -272,20 +326,77 @@ ORDER BY
 LIMIT 1000000;
 `
 
-// DeleteBroadcasts deletes all broadcasts older than 90 days for the passed in org which have no active messages on them
-func DeleteBroadcasts(ctx context.Context, now time.Time, config *Config, db *sqlx.DB, org Org) error {
+const countSkippedOrgBroadcasts = `
+SELECT 
+	count(*) FILTER (WHERE created_on < $2 AND schedule_id IS NOT NULL) AS scheduled,
+	count(*) FILTER (WHERE created_on >= $2) AS too_new
+FROM 
+	msgs_broadcast
+WHERE 
+	org_id = $1
+`
+
+// the reasons a broadcast of an org isn't deleted
+const (
+	BroadcastScheduled   = "scheduled"
+	BroadcastHasMessages = "has_msgs"
+	BroadcastTooNew      = "too_new"
+)
+
+// BroadcastDeletion is how many of the broadcasts of an org we deleted, and how many we didn't by reason
+type BroadcastDeletion struct {
+	Deleted int
+	Skipped map[string]int
+}
+
+// broadcastCutoff returns the time before which the broadcasts of the passed in org can be deleted once the passed in
+// archives have had their records deleted, the end of the last of its message archives, never within the retention
+// period of the org. Returns a zero time if no message archives were deleted.
+func broadcastCutoff(now time.Time, org Org, deleted []*Archive) time.Time {
+	var cutoff time.Time
+	for _, a := range deleted {
+		if a.ArchiveType == MessageType && a.EndDate().After(cutoff) {
+			cutoff = a.EndDate()
+		}
+	}
+
+	deleteEnd := org.deleteEndDate(now)
+	if cutoff.After(deleteEnd) {
+		cutoff = deleteEnd
+	}
+	return cutoff
+}
+
+// DeleteBroadcasts deletes the broadcasts of the passed in org created before the passed in cutoff which aren't
+// scheduled and have no messages left on them. It's called once per org after its message archives have had their
+// records deleted, with a cutoff from those archives, and is safe to call again as it only ever looks at what's left.
+func DeleteBroadcasts(ctx context.Context, cutoff time.Time, config *Config, db *sqlx.DB, org Org) (*BroadcastDeletion, error) {
+	result := &BroadcastDeletion{Skipped: make(map[string]int)}
+	if !tableExists("msgs_broadcast") {
+		return result, nil
+	}
+
 	start := time.Now()
-	threshhold := now.AddDate(0, 0, -org.RetentionPeriod)
 
-	rows, err := db.QueryxContext(ctx, selectOldOrgBroadcasts, org.ID, threshhold)
+	skipped := struct {
+		Scheduled int `db:"scheduled"`
+		TooNew    int `db:"too_new"`
+	}{}
+	err := db.GetContext(ctx, &skipped, countSkippedOrgBroadcasts, org.ID, cutoff)
 	if err != nil {
-		return err
+		return nil, errors.Wrapf(err, "error counting broadcasts we can't delete for org: %d", org.ID)
+	}
+	result.Skipped[BroadcastScheduled] = skipped.Scheduled
+	result.Skipped[BroadcastTooNew] = skipped.TooNew
+
+	rows, err := db.QueryxContext(ctx, selectOldOrgBroadcasts, org.ID, cutoff)
+	if err != nil {
+		return nil, err
 	}
 	defer rows.Close()
 
-	count := 0
 	for rows.Next() {
-		if count == 0 {
+		if result.Deleted == 0 {
 			logrus.WithField("org_id", org.ID).Info("deleting broadcasts")
 		}
 
@@ -297,77 +408,88 @@ func DeleteBroadcasts(ctx context.Context, now time.Time, config *Config, db *sq
 		var broadcastID int64
 		err := rows.Scan(&broadcastID)
 		if err != nil {
-			return errors.Wrap(err, "unable to get broadcast id")
+			return nil, errors.Wrap(err, "unable to get broadcast id")
 		}
 
 		// make sure we have no active messages
 		var msgCount int64
 		err = db.Get(&msgCount, `SELECT count(*) FROM msgs_msg WHERE broadcast_id = $1`, broadcastID)
 		if err != nil {
-			return errors.Wrapf(err, "unable to select number of msgs for broadcast: %d", broadcastID)
+			return nil, errors.Wrapf(err, "unable to select number of msgs for broadcast: %d", broadcastID)
 		}
 
 		if msgCount != 0 {
 			logrus.WithField("broadcast_id", broadcastID).WithField("org_id", org.ID).WithField("msg_count", msgCount).Warn("unable to delete broadcast, has messages still")
+			result.Skipped[BroadcastHasMessages]++
 			continue
 		}
 
 		// we delete broadcasts in a transaction per broadcast
 		tx, err := db.BeginTx(ctx, nil)
 		if err != nil {
-			return errors.Wrapf(err, "error starting transaction while deleting broadcast: %d", broadcastID)
+			return nil, errors.Wrapf(err, "error starting transaction while deleting broadcast: %d", broadcastID)
 		}
 
 		// delete contacts M2M
-		_, err = tx.Exec(`DELETE from msgs_broadcast_contacts WHERE broadcast_id = $1`, broadcastID)
-		if err != nil {
-			tx.Rollback()
-			return errors.Wrapf(err, "error deleting related contacts for broadcast: %d", broadcastID)
+		if tableExists("msgs_broadcast_contacts") {
+			_, err = tx.Exec(`DELETE from msgs_broadcast_contacts WHERE broadcast_id = $1`, broadcastID)
+			if err != nil {
+				tx.Rollback()
+				return nil, errors.Wrapf(err, "error deleting related contacts for broadcast: %d", broadcastID)
+			}
 		}
 
 		// delete groups M2M
-		_, err = tx.Exec(`DELETE from msgs_broadcast_groups WHERE broadcast_id = $1`, broadcastID)
-		if err != nil {
-			tx.Rollback()
-			return errors.Wrapf(err, "error deleting related groups for broadcast: %d", broadcastID)
+		if tableExists("msgs_broadcast_groups") {
+			_, err = tx.Exec(`DELETE from msgs_broadcast_groups WHERE broadcast_id = $1`, broadcastID)
+			if err != nil {
+				tx.Rollback()
+				return nil, errors.Wrapf(err, "error deleting related groups for broadcast: %d", broadcastID)
+			}
 		}
 
 		// delete URNs M2M
-		_, err = tx.Exec(`DELETE from msgs_broadcast_urns WHERE broadcast_id = $1`, broadcastID)
-		if err != nil {
-			tx.Rollback()
-			return errors.Wrapf(err, "error deleting related urns for broadcast: %d", broadcastID)
+		if tableExists("msgs_broadcast_urns") {
+			_, err = tx.Exec(`DELETE from msgs_broadcast_urns WHERE broadcast_id = $1`, broadcastID)
+			if err != nil {
+				tx.Rollback()
+				return nil, errors.Wrapf(err, "error deleting related urns for broadcast: %d", broadcastID)
+			}
 		}
 
 		// delete counts associated with this broadcast
-		_, err = tx.Exec(`DELETE from msgs_broadcastmsgcount WHERE broadcast_id = $1`, broadcastID)
-		if err != nil {
-			tx.Rollback()
-			return errors.Wrapf(err, "error deleting counts for broadcast: %d", broadcastID)
+		if tableExists("msgs_broadcastmsgcount") {
+			_, err = tx.Exec(`DELETE from msgs_broadcastmsgcount WHERE broadcast_id = $1`, broadcastID)
+			if err != nil {
+				tx.Rollback()
+				return nil, errors.Wrapf(err, "error deleting counts for broadcast: %d", broadcastID)
+			}
 		}
 
 		// finally, delete our broadcast
 		_, err = tx.Exec(`DELETE from msgs_broadcast WHERE id = $1`, broadcastID)
 		if err != nil {
 			tx.Rollback()
-			return errors.Wrapf(err, "error deleting broadcast: %d", broadcastID)
+			return nil, errors.Wrapf(err, "error deleting broadcast: %d", broadcastID)
 		}
 
 		err = tx.Commit()
 		if err != nil {
-			return errors.Wrapf(err, "error deleting broadcast: %d", broadcastID)
+			return nil, errors.Wrapf(err, "error deleting broadcast: %d", broadcastID)
 		}
 
-		count++
+		result.Deleted++
 	}
 
-	if count > 0 {
-		logrus.WithFields(logrus.Fields{
-			"elapsed": time.Since(start),
-			"count":   count,
-			"org_id":  org.ID,
-		}).Info("completed deleting broadcasts")
-	}
-
-	return nil
+	logrus.WithFields(logrus.Fields{
+		"elapsed":           time.Since(start),
+		"org_id":            org.ID,
+		"cutoff":            cutoff,
+		"deleted":           result.Deleted,
+		"skipped_scheduled": result.Skipped[BroadcastScheduled],
+		"skipped_has_msgs":  result.Skipped[BroadcastHasMessages],
+		"skipped_too_new":   result.Skipped[BroadcastTooNew],
+	}).Info("completed deleting broadcasts")
+
+	return result, nil
 }
@@ -0,0 +1,229 @@
+package archives
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the buckets we use for histograms of durations, in seconds
+var durationBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// the buckets we use for histograms of how long archives take to build, in seconds
+var buildBuckets = []float64{1, 5, 15, 30, 60, 300, 900, 1800, 3600, 10800}
+
+// metric is a single family of metrics, all sharing a name, type and label names
+type metric struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	buckets    []float64
+
+	mutex  sync.Mutex
+	series map[string]*series
+}
+
+// series is the state of a metric for one set of label values
+type series struct {
+	labelValues []string
+	value       float64
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+// all the metrics we've defined, in the order they were defined
+var registry = struct {
+	mutex   sync.Mutex
+	metrics []*metric
+}{}
+
+func newMetric(name string, help string, kind string, buckets []float64, labelNames ...string) *metric {
+	m := &metric{name: name, help: help, kind: kind, labelNames: labelNames, buckets: buckets, series: make(map[string]*series)}
+
+	registry.mutex.Lock()
+	registry.metrics = append(registry.metrics, m)
+	registry.mutex.Unlock()
+
+	return m
+}
+
+// newCounter defines a new counter, a value which only ever goes up
+func newCounter(name string, help string, labelNames ...string) *metric {
+	return newMetric(name, help, "counter", nil, labelNames...)
+}
+
+// newGauge defines a new gauge, a value which can go up and down
+func newGauge(name string, help string, labelNames ...string) *metric {
+	return newMetric(name, help, "gauge", nil, labelNames...)
+}
+
+// newHistogram defines a new histogram, which counts observations in the passed in buckets
+func newHistogram(name string, help string, buckets []float64, labelNames ...string) *metric {
+	return newMetric(name, help, "histogram", buckets, labelNames...)
+}
+
+// get returns the series for the passed in label values, creating it if necessary, must be called with our lock held
+func (m *metric) get(labelValues []string) *series {
+	if len(labelValues) != len(m.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", m.name, len(m.labelNames), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	s, found := m.series[key]
+	if !found {
+		s = &series{labelValues: labelValues, counts: make([]uint64, len(m.buckets))}
+		m.series[key] = s
+	}
+	return s
+}
+
+// add adds the passed in delta to a counter or gauge
+func (m *metric) add(delta float64, labelValues ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.get(labelValues).value += delta
+}
+
+// set sets the value of a gauge
+func (m *metric) set(value float64, labelValues ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.get(labelValues).value = value
+}
+
+// observe records the passed in value in a histogram
+func (m *metric) observe(value float64, labelValues ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	s := m.get(labelValues)
+	for i, upper := range m.buckets {
+		if value <= upper {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+// write writes this metric in the Prometheus text format
+func (m *metric) write(w *bufio.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := m.series[k]
+
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labelNames, s.labelValues, ""), formatValue(s.value))
+			continue
+		}
+
+		for i, upper := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labelNames, s.labelValues, formatValue(upper)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labelNames, s.labelValues, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, formatLabels(m.labelNames, s.labelValues, ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, formatLabels(m.labelNames, s.labelValues, ""), s.count)
+	}
+}
+
+// formatLabels formats the passed in labels, including a le label for histogram buckets if passed in
+func formatLabels(names []string, values []string, le string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, escapeLabelValue(values[i])))
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf(`le="%s"`, le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeLabelValue(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// WriteMetrics writes all our metrics to the passed in writer in the Prometheus text format
+func WriteMetrics(w io.Writer) error {
+	registry.mutex.Lock()
+	metrics := append([]*metric(nil), registry.metrics...)
+	registry.mutex.Unlock()
+
+	writer := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(writer)
+	}
+	return writer.Flush()
+}
+
+var (
+	archivesCreated = newCounter("archiver_archives_created_total", "Number of archives created, including rollups.", "org_id", "archive_type", "period")
+	recordsArchived = newCounter("archiver_records_archived_total", "Number of records archived from the database, not counting them again when rolled up.", "org_id", "archive_type")
+	buildDuration   = newHistogram("archiver_build_duration_seconds", "Time taken to build an archive, from reading its records or dailies to writing its file.", buildBuckets)
+	archiveErrors   = newCounter("archiver_errors_total", "Number of errors creating, rolling up or deleting the records of archives.", "phase")
+)
+
+// observeCreated records the passed in archive as created in our metrics, counting its records if they were read from
+// the database rather than from its dailies
+func observeCreated(archive *Archive, fromDB bool) {
+	orgID := strconv.Itoa(archive.OrgID)
+	archivesCreated.add(1, orgID, string(archive.ArchiveType), string(archive.Period))
+	buildDuration.observe(float64(archive.BuildTime) / 1000)
+	if fromDB {
+		recordsArchived.add(float64(archive.RecordCount), orgID, string(archive.ArchiveType))
+	}
+}
+
+// MetricsHandler serves all our metrics in the Prometheus text format
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteMetrics(w)
+	})
+}
+
+// NewMetricsServer returns a server for our metrics on our metrics port at /metrics, for Prometheus to scrape
+func NewMetricsServer(config *Config) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", MetricsHandler())
+
+	return &http.Server{
+		Addr:         fmt.Sprintf(":%d", config.MetricsPort),
+		Handler:      mux,
+		ReadTimeout:  time.Second * 30,
+		WriteTimeout: time.Second * 30,
+	}
+}
@@ -0,0 +1,80 @@
+package archives
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	counter := newCounter("test_archives_total", "Number of test archives.", "org", "type")
+	gauge := newGauge("test_running", "Whether a test is running.")
+	histogram := newHistogram("test_duration_seconds", "Time taken by tests.", []float64{0.5, 1})
+
+	counter.add(2, "Org \"1\"", "message")
+	counter.add(1, "Org \"1\"", "message")
+	counter.add(1, "Org 2", "run")
+	gauge.set(1)
+	histogram.observe(0.25)
+	histogram.observe(0.75)
+	histogram.observe(5)
+
+	assert.Panics(t, func() { counter.add(1, "Org 2") })
+
+	output := &bytes.Buffer{}
+	assert.NoError(t, WriteMetrics(output))
+
+	assert.Contains(t, output.String(), `# HELP test_archives_total Number of test archives.
+# TYPE test_archives_total counter
+test_archives_total{org="Org \"1\"",type="message"} 3
+test_archives_total{org="Org 2",type="run"} 1
+# HELP test_running Whether a test is running.
+# TYPE test_running gauge
+test_running 1
+# HELP test_duration_seconds Time taken by tests.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{le="0.5"} 1
+test_duration_seconds_bucket{le="1"} 2
+test_duration_seconds_bucket{le="+Inf"} 3
+test_duration_seconds_sum 6
+test_duration_seconds_count 3
+`)
+}
+
+func TestMetricsServer(t *testing.T) {
+	config := NewConfig()
+	config.MetricsPort = 9102
+	assert.Equal(t, ":9102", NewMetricsServer(config).Addr)
+
+	observeCreated(&Archive{OrgID: 42, ArchiveType: MessageType, Period: DayPeriod, RecordCount: 12, BuildTime: 1500}, true)
+	observeCreated(&Archive{OrgID: 42, ArchiveType: MessageType, Period: MonthPeriod, RecordCount: 12, BuildTime: 500}, false)
+	archiveErrors.add(1, string(PhaseRollup))
+
+	server := httptest.NewServer(NewMetricsServer(config).Handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/metrics")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/plain; version=0.0.4", resp.Header.Get("Content-Type"))
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+
+	// rollups are counted as created but their records aren't counted again
+	assert.Contains(t, string(body), `archiver_archives_created_total{org_id="42",archive_type="message",period="D"} 1`)
+	assert.Contains(t, string(body), `archiver_archives_created_total{org_id="42",archive_type="message",period="M"} 1`)
+	assert.Contains(t, string(body), `archiver_records_archived_total{org_id="42",archive_type="message"} 12`)
+	assert.Contains(t, string(body), `archiver_build_duration_seconds_bucket{le="1"}`)
+	assert.Contains(t, string(body), `archiver_errors_total{phase="rollup"}`)
+
+	resp, err = http.Get(server.URL + "/status")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -0,0 +1,126 @@
+package archives
+
+import "github.com/sirupsen/logrus"
+
+// ArchiveOutcome is the outcome of one archive we attempted in a phase of archiving an org
+type ArchiveOutcome struct {
+	Phase   Phase
+	Archive *Archive
+
+	// Err is why the archive failed, nil if it succeeded
+	Err error
+}
+
+// PhaseOutcome is the outcome of one phase of archiving an org
+type PhaseOutcome struct {
+	Phase Phase
+
+	// the number of archives we attempted and how many of those succeeded or failed
+	Attempted int
+	Succeeded int
+	Failed    int
+
+	// Err is the fatal error which stopped the phase, if any
+	Err error
+}
+
+// ArchiveOrgResult is the outcome of archiving one type of record of an org, with every archive we attempted
+type ArchiveOrgResult struct {
+	Org         Org
+	ArchiveType ArchiveType
+
+	// the archives we created and those whose records we deleted, only those which succeeded
+	Created []*Archive
+	Deleted []*Archive
+
+	// the phases we ran, in the order we ran them, and each archive we attempted in them
+	Phases   []*PhaseOutcome
+	Archives []*ArchiveOutcome
+}
+
+func newArchiveOrgResult(org Org, archiveType ArchiveType) *ArchiveOrgResult {
+	return &ArchiveOrgResult{
+		Org:         org,
+		ArchiveType: archiveType,
+		Created:     make([]*Archive, 0),
+		Deleted:     make([]*Archive, 0),
+		Phases:      make([]*PhaseOutcome, 0, len(AllPhases)),
+		Archives:    make([]*ArchiveOutcome, 0),
+	}
+}
+
+// startPhase records that we've started the passed in phase, returning its outcome
+func (r *ArchiveOrgResult) startPhase(phase Phase) *PhaseOutcome {
+	outcome := &PhaseOutcome{Phase: phase}
+	r.Phases = append(r.Phases, outcome)
+	return outcome
+}
+
+// attempted records the outcome of the passed in archive in the passed in phase, adding it to our created or deleted
+// archives if it succeeded
+func (r *ArchiveOrgResult) attempted(phase *PhaseOutcome, archive *Archive, err error) {
+	r.Archives = append(r.Archives, &ArchiveOutcome{Phase: phase.Phase, Archive: archive, Err: err})
+	phase.Attempted++
+
+	if err != nil {
+		phase.Failed++
+		return
+	}
+	phase.Succeeded++
+
+	if phase.Phase == PhaseDelete {
+		r.Deleted = append(r.Deleted, archive)
+	} else {
+		r.Created = append(r.Created, archive)
+	}
+}
+
+// fatal records the passed in error as having stopped the passed in phase, returning it as a PhaseError
+func (r *ArchiveOrgResult) fatal(phase *PhaseOutcome, err error) error {
+	archiveErrors.add(1, string(phase.Phase))
+	phase.Err = err
+	return &PhaseError{Phase: phase.Phase, Err: err}
+}
+
+// Phase returns the outcome of the passed in phase, or nil if we didn't run it
+func (r *ArchiveOrgResult) Phase(phase Phase) *PhaseOutcome {
+	for _, p := range r.Phases {
+		if p.Phase == phase {
+			return p
+		}
+	}
+	return nil
+}
+
+// Failed returns the outcomes of the archives which failed
+func (r *ArchiveOrgResult) Failed() []*ArchiveOutcome {
+	failed := make([]*ArchiveOutcome, 0)
+	for _, o := range r.Archives {
+		if o.Err != nil {
+			failed = append(failed, o)
+		}
+	}
+	return failed
+}
+
+// Failures returns a report failure for each archive which failed
+func (r *ArchiveOrgResult) Failures() []*Failure {
+	failures := make([]*Failure, 0)
+	for _, o := range r.Failed() {
+		failures = append(failures, NewFailure(r.Org, r.ArchiveType, &PhaseError{Phase: o.Phase, Archive: o.Archive, Err: o.Err}))
+	}
+	return failures
+}
+
+// Fields returns the counts of our phases for logging
+func (r *ArchiveOrgResult) Fields() logrus.Fields {
+	fields := logrus.Fields{
+		"created": len(r.Created),
+		"deleted": len(r.Deleted),
+	}
+	for _, p := range r.Phases {
+		fields[string(p.Phase)+"_attempted"] = p.Attempted
+		fields[string(p.Phase)+"_failed"] = p.Failed
+	}
+	return fields
+}
@@ -0,0 +1,140 @@
+package archives
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// failingHooks fails building the daily and rolling up the monthly which start on the passed in dates
+type failingHooks struct {
+	NoopHooks
+	build  time.Time
+	rollup time.Time
+}
+
+func (h *failingHooks) BeforeArchiveBuild(ctx context.Context, org Org, archive *Archive) error {
+	if archive.StartDate.Equal(h.build) {
+		return fmt.Errorf("day is frozen")
+	}
+	return nil
+}
+
+func (h *failingHooks) AfterRollup(ctx context.Context, org Org, archive *Archive) error {
+	if archive.StartDate.Equal(h.rollup) {
+		return fmt.Errorf("billing is down")
+	}
+	return nil
+}
+
+func (h *failingHooks) AfterDelete(ctx context.Context, org Org, archive *Archive) error {
+	return fmt.Errorf("audit log is down")
+}
+
+func TestArchiveOrgResult(t *testing.T) {
+	org := Org{ID: 2, Name: "Org 2"}
+	result := newArchiveOrgResult(org, MessageType)
+	day := func(d int) *Archive {
+		return &Archive{OrgID: 2, ArchiveType: MessageType, Period: DayPeriod, StartDate: time.Date(2017, 8, d, 0, 0, 0, 0, time.UTC)}
+	}
+
+	create := result.startPhase(PhaseCreate)
+	result.attempted(create, day(10), nil)
+	result.attempted(create, day(11), fmt.Errorf("upload failed"))
+	result.attempted(create, day(12), nil)
+
+	del := result.startPhase(PhaseDelete)
+	result.attempted(del, day(10), nil)
+	err := result.fatal(del, fmt.Errorf("connection reset"))
+
+	assert.Equal(t, &PhaseError{Phase: PhaseDelete, Err: del.Err}, err)
+	assert.Equal(t, &PhaseOutcome{Phase: PhaseCreate, Attempted: 3, Succeeded: 2, Failed: 1}, result.Phase(PhaseCreate))
+	assert.Equal(t, 1, result.Phase(PhaseDelete).Succeeded)
+	assert.Nil(t, result.Phase(PhaseRollup))
+	assert.Equal(t, 2, len(result.Created))
+	assert.Equal(t, 1, len(result.Deleted))
+
+	failed := result.Failed()
+	assert.Equal(t, 1, len(failed))
+	assert.Equal(t, time.Date(2017, 8, 11, 0, 0, 0, 0, time.UTC), failed[0].Archive.StartDate)
+
+	failures := result.Failures()
+	assert.Equal(t, 1, len(failures))
+	assert.Equal(t, 2, failures[0].OrgID)
+	assert.Equal(t, PhaseCreate, failures[0].Phase)
+	assert.Equal(t, "D", failures[0].Period)
+	assert.Equal(t, "upload failed", failures[0].Error)
+
+	fields := result.Fields()
+	assert.Equal(t, 2, fields["created"])
+	assert.Equal(t, 1, fields["create_failed"])
+	assert.Equal(t, 1, fields["delete_attempted"])
+}
+
+func TestArchiveOrgPhasesWithResult(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+	defer ConfigureHooks(NewConfig(), nil)
+
+	config := NewConfig()
+	config.Delete = true
+	config.FatalHooks = "BeforeArchiveBuild,AfterRollup"
+	oct1 := time.Date(2017, 10, 1, 0, 0, 0, 0, time.UTC)
+	sep1 := time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC)
+	assert.NoError(t, ConfigureHooks(config, &failingHooks{build: oct1, rollup: sep1}))
+
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	// a daily which fails to build and a monthly which fails to roll up don't stop us archiving the rest
+	result, err := ArchiveOrgPhasesWithResult(ctx, now, config, db, s3Client, orgs[1], MessageType, AllPhases)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(result.Phases))
+	assert.Equal(t, &PhaseOutcome{Phase: PhaseCreate, Attempted: 61, Succeeded: 60, Failed: 1}, result.Phase(PhaseCreate))
+	assert.Equal(t, &PhaseOutcome{Phase: PhaseRollup, Attempted: 2, Succeeded: 1, Failed: 1}, result.Phase(PhaseRollup))
+	assert.Equal(t, 0, result.Phase(PhaseDelete).Failed)
+	assert.Equal(t, 61, len(result.Created))
+	assert.Equal(t, result.Phase(PhaseDelete).Succeeded, len(result.Deleted))
+
+	// each of which is in our result with why it failed
+	failed := result.Failed()
+	assert.Equal(t, 2, len(failed))
+	assert.Equal(t, PhaseCreate, failed[0].Phase)
+	assert.Equal(t, oct1, failed[0].Archive.StartDate)
+	assert.Equal(t, 0, failed[0].Archive.ID)
+	assert.EqualError(t, failed[0].Err, "error in BeforeArchiveBuild hook: day is frozen")
+	assert.Equal(t, PhaseRollup, failed[1].Phase)
+	assert.Equal(t, sep1, failed[1].Archive.StartDate)
+	assert.EqualError(t, failed[1].Err, "error in AfterRollup hook: billing is down")
+
+	output := &bytes.Buffer{}
+	assert.NoError(t, WriteMetrics(output))
+	assert.Contains(t, output.String(), `archiver_errors_total{phase="create"}`)
+
+	// and reported as failures of our run
+	failures := result.Failures()
+	assert.Equal(t, 2, len(failures))
+	assert.Equal(t, oct1, *failures[0].StartDate)
+	assert.Equal(t, "D", failures[0].Period)
+	assert.Equal(t, PhaseRollup, failures[1].Phase)
+	assert.Equal(t, "M", failures[1].Period)
+
+	// a fatal hook after deleting stops the phase, our result still has everything attempted up until then
+	config.FatalHooks = "AfterDelete"
+	assert.NoError(t, ConfigureHooks(config, &failingHooks{}))
+
+	result, err = ArchiveOrgPhasesWithResult(ctx, now, config, db, s3Client, orgs[1], RunType, AllPhases)
+	assert.EqualError(t, err, "error deleting archived records: error in AfterDelete hook: audit log is down")
+	assert.Equal(t, PhaseDelete, err.(*PhaseError).Phase)
+	assert.Equal(t, 0, len(result.Failed()))
+	assert.Equal(t, 62, result.Phase(PhaseCreate).Succeeded)
+	assert.Equal(t, 2, result.Phase(PhaseRollup).Succeeded)
+	assert.Error(t, result.Phase(PhaseDelete).Err)
+	assert.True(t, len(result.Deleted) > 0)
+}
@@ -0,0 +1,50 @@
+package archives
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+)
+
+var orgPanics = newCounter("archiver_org_panics_total", "Number of panics archiving an org which were recovered from.", "archive_type")
+
+// ArchiveOrgPhasesRecovering archives the passed in org like ArchiveOrgPhasesWithResult, but with RecoverOrgPanics set a
+// panic, such as on malformed data, is logged with the org and returned as an error so we can continue with other orgs.
+// The returned result has whatever we attempted before any panic.
+func ArchiveOrgPhasesRecovering(ctx context.Context, now time.Time, config *Config, db *sqlx.DB, s3Client Storage, org Org, archiveType ArchiveType, phases []Phase) (*ArchiveOrgResult, error) {
+	if !config.RecoverOrgPanics {
+		return ArchiveOrgPhasesWithResult(ctx, now, config, db, s3Client, org, archiveType, phases)
+	}
+
+	result := newArchiveOrgResult(org, archiveType)
+	err := recoverOrgPanic(org, archiveType, func() error {
+		var err error
+		result, err = ArchiveOrgPhasesWithResult(ctx, now, config, db, s3Client, org, archiveType, phases)
+		return err
+	})
+	return result, err
+}
+
+// recoverOrgPanic calls the passed in function, returning any panic in it as an error after logging it, along with
+// where it happened, at error level so it is reported to Sentry
+func recoverOrgPanic(org Org, archiveType ArchiveType, fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			orgPanics.add(1, string(archiveType))
+			logrus.WithFields(logrus.Fields{
+				"org_id":       org.ID,
+				"archive_type": archiveType,
+				"panic":        fmt.Sprint(r),
+				"stack":        string(debug.Stack()),
+			}).Error("panic archiving org, continuing with other orgs")
+
+			err = fmt.Errorf("panic archiving org: %d: %v", org.ID, r)
+		}
+	}()
+
+	return fn()
+}
@@ -0,0 +1,32 @@
+package archives
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecoverOrgPanic(t *testing.T) {
+	org := Org{ID: 2, Name: "Org 2"}
+
+	// errors and successes are passed through as is
+	assert.NoError(t, recoverOrgPanic(org, RunType, func() error { return nil }))
+	assert.EqualError(t, recoverOrgPanic(org, RunType, func() error { return errors.New("boom") }), "boom")
+
+	// panics become errors of the org
+	err := recoverOrgPanic(org, RunType, func() error {
+		var record map[string]interface{}
+		record["id"] = 1
+		return nil
+	})
+	assert.EqualError(t, err, "panic archiving org: 2: assignment to entry in nil map")
+
+	err = recoverOrgPanic(org, RunType, func() error { panic("malformed run") })
+	assert.EqualError(t, err, "panic archiving org: 2: malformed run")
+
+	output := &bytes.Buffer{}
+	assert.NoError(t, WriteMetrics(output))
+	assert.Contains(t, output.String(), `archiver_org_panics_total{archive_type="run"} 2`)
+}
@@ -0,0 +1,149 @@
+package archives
+
+import (
+	"context"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// partial archives live under their own prefix, without a hash in their keys so each refresh overwrites the last
+const partialArchivePrefix = "/partial"
+
+const upsertPartialArchive = `
+INSERT INTO archiver_partial_archives(org_id, archive_type, start_date, record_count, size, hash, url, built_on)
+VALUES($1, $2, $3, $4, $5, $6, $7, $8)
+ON CONFLICT (org_id, archive_type, start_date) DO UPDATE
+SET record_count = EXCLUDED.record_count, size = EXCLUDED.size, hash = EXCLUDED.hash, url = EXCLUDED.url, built_on = EXCLUDED.built_on
+`
+
+// CreatePartialArchive builds and uploads an archive of the records of the current day so far for the passed in org,
+// overwriting the one built by our last run. It is marked partial, recorded in archiver_partial_archives rather than
+// with our other archives and never has its records deleted, the daily built once the day is over replaces it.
+func CreatePartialArchive(ctx context.Context, now time.Time, config *Config, db *sqlx.DB, s3Client Storage, org Org, archiveType ArchiveType) (*Archive, error) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	archive := &Archive{Org: org, OrgID: org.ID, StartDate: today, ArchiveType: archiveType, Period: DayPeriod, Partial: true}
+
+	err := CreateArchiveFile(ctx, db, config, archive, config.TempDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "error writing partial archive file")
+	}
+
+	defer func() {
+		if !config.KeepFiles {
+			err := DeleteArchiveFile(archive)
+			if err != nil {
+				logrus.WithError(err).Error("error deleting temporary archive file")
+			}
+		}
+	}()
+
+	if config.UploadToS3 {
+		err = UploadArchive(ctx, config, s3Client, config.S3Bucket, archive)
+		if err != nil {
+			return nil, errors.Wrap(err, "error writing partial archive to s3")
+		}
+	}
+
+	// we never delete the records of a partial archive
+	archive.NeedsDeletion = false
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	_, err = db.ExecContext(ctx, upsertPartialArchive, org.ID, archiveType, today, archive.RecordCount, archive.Size, archive.Hash, archive.URL, now)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error writing partial archive for org: %d", org.ID)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"org_id":       org.ID,
+		"archive_type": archiveType,
+		"start_date":   today,
+		"record_count": archive.RecordCount,
+		"url":          archive.URL,
+	}).Debug("partial archive complete")
+
+	return archive, nil
+}
+
+const lookupFinalizedPartialArchives = `
+SELECT p.org_id, p.archive_type, p.start_date, p.record_count, p.size, p.hash, p.url
+FROM archiver_partial_archives p
+WHERE p.org_id = $1 AND p.archive_type = $2 AND EXISTS (
+	SELECT 1 FROM archives_archive a
+	WHERE a.org_id = p.org_id AND a.archive_type = p.archive_type AND (
+		(a.period = 'D' AND a.start_date = p.start_date) OR (a.period = 'M' AND a.start_date = date_trunc('month', p.start_date))
+	)
+)
+ORDER BY p.start_date
+`
+
+const deletePartialArchive = `
+DELETE FROM archiver_partial_archives WHERE org_id = $1 AND archive_type = $2 AND start_date = $3
+`
+
+// RemoveFinalizedPartialArchives removes the partial archives of the passed in org whose days now have a daily, or
+// a monthly, deleting their objects from S3 and then their rows, returning those removed
+func RemoveFinalizedPartialArchives(ctx context.Context, db *sqlx.DB, s3Client Storage, org Org, archiveType ArchiveType) ([]*Archive, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute*5)
+	defer cancel()
+
+	partials := make([]*Archive, 0)
+	err := db.SelectContext(ctx, &partials, lookupFinalizedPartialArchives, org.ID, archiveType)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error selecting finalized partial archives for org: %d and type: %s", org.ID, archiveType)
+	}
+
+	removed := make([]*Archive, 0, len(partials))
+	for _, partial := range partials {
+		partial.Org = org
+		partial.Period = DayPeriod
+		partial.Partial = true
+
+		if partial.URL != "" && s3Client != nil {
+			bucket, key, err := s3Client.SplitURL(partial.URL)
+			if err != nil {
+				return removed, errors.Wrapf(err, "invalid url for partial archive: %s", partial.URL)
+			}
+
+			err = s3Client.Delete(ctx, bucket, []string{key})[key]
+			if err != nil {
+				return removed, errors.Wrapf(err, "error deleting partial archive: %s", partial.URL)
+			}
+		}
+
+		_, err = db.ExecContext(ctx, deletePartialArchive, org.ID, archiveType, partial.StartDate)
+		if err != nil {
+			return removed, errors.Wrapf(err, "error deleting partial archive for org: %d", org.ID)
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"org_id":       org.ID,
+			"archive_type": archiveType,
+			"start_date":   partial.StartDate,
+		}).Info("removed partial archive replaced by its daily")
+
+		removed = append(removed, partial)
+	}
+
+	return removed, nil
+}
+
+// refreshPartialArchives replaces the partial archives of the passed in org which now have dailies and rebuilds the
+// one of the current day, logging rather than returning any errors
+func refreshPartialArchives(ctx context.Context, now time.Time, config *Config, db *sqlx.DB, s3Client Storage, org Org, archiveType ArchiveType) {
+	log := logrus.WithField("org_id", org.ID).WithField("archive_type", archiveType)
+
+	_, err := RemoveFinalizedPartialArchives(ctx, db, s3Client, org, archiveType)
+	if err != nil {
+		log.WithError(err).Error("error removing finalized partial archives")
+	}
+
+	_, err = CreatePartialArchive(ctx, now, config, db, s3Client, org, archiveType)
+	if err != nil {
+		log.WithError(err).Error("error creating partial archive")
+	}
+}
@@ -0,0 +1,52 @@
+package archives
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPartialArchives(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+
+	config := NewConfig()
+	config.ArchiveLagDays = 1
+	config.ArchivePartialCurrent = true
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+
+	// late on the 12th we have dailies up to yesterday and a partial archive of today so far
+	now := time.Date(2017, 8, 12, 23, 30, 0, 0, time.UTC)
+	created, _, err := ArchiveOrgPhases(ctx, now, config, db, s3Client, orgs[1], MessageType, []Phase{PhaseCreate})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(created))
+	assertCount(t, db, 0, `SELECT count(*) FROM archives_archive WHERE org_id = 2 AND start_date = '2017-08-12'`)
+	assertCount(t, db, 1, `SELECT count(*) FROM archiver_partial_archives WHERE org_id = 2 AND archive_type = 'message' AND start_date = '2017-08-12' AND record_count = 3`)
+
+	partialKey := "dl-archiver-test:/partial/2/message_D20170812.jsonl.gz"
+	assert.Contains(t, s3Client.objects, partialKey)
+
+	// refreshing overwrites the same object rather than adding another
+	partial, err := CreatePartialArchive(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.True(t, partial.Partial)
+	assert.False(t, partial.NeedsDeletion)
+	assert.Equal(t, 3, partial.RecordCount)
+	assert.Equal(t, "https://dl-archiver-test.s3.amazonaws.com/partial/2/message_D20170812.jsonl.gz", partial.URL)
+	assertCount(t, db, 1, `SELECT count(*) FROM archiver_partial_archives`)
+
+	// the next day our daily of the 12th replaces its partial archive
+	now = now.AddDate(0, 0, 1)
+	created, _, err = ArchiveOrgPhases(ctx, now, config, db, s3Client, orgs[1], MessageType, []Phase{PhaseCreate})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(created))
+	assert.Equal(t, 3, created[0].RecordCount)
+	assert.NotContains(t, s3Client.objects, partialKey)
+	assertCount(t, db, 0, `SELECT count(*) FROM archiver_partial_archives WHERE start_date = '2017-08-12'`)
+	assertCount(t, db, 1, `SELECT count(*) FROM archiver_partial_archives WHERE org_id = 2 AND start_date = '2017-08-13'`)
+	assert.Contains(t, s3Client.objects, "dl-archiver-test:/partial/2/message_D20170813.jsonl.gz")
+}
@@ -0,0 +1,90 @@
+package archives
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// AllPhases are the phases of archiving an org, in the order they are run
+var AllPhases = []Phase{PhaseCreate, PhaseRollup, PhaseDelete}
+
+// HasPhase returns whether the passed in phase is one of the passed in phases
+func HasPhase(phases []Phase, phase Phase) bool {
+	for _, p := range phases {
+		if p == phase {
+			return true
+		}
+	}
+	return false
+}
+
+// PhaseRun is a set of phases which start together at the same time each day
+type PhaseRun struct {
+	Hour   int
+	Minute int
+	Phases []Phase
+}
+
+// next returns the first time after the passed in time that this run starts
+func (r *PhaseRun) next(after time.Time) time.Time {
+	after = after.In(time.UTC)
+	next := time.Date(after.Year(), after.Month(), after.Day(), r.Hour, r.Minute, 0, 0, time.UTC)
+	if !next.After(after) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// SchedulePhases groups our phases by the time of day they start, phases without a start time of their own start at
+// our start time. Runs are returned in the order they start each day, phases starting together are run in order.
+func SchedulePhases(config *Config) ([]*PhaseRun, error) {
+	starts := map[Phase]string{
+		PhaseCreate: config.CreateStartTime,
+		PhaseRollup: config.RollupStartTime,
+		PhaseDelete: config.DeleteStartTime,
+	}
+
+	runs := make([]*PhaseRun, 0, len(AllPhases))
+	byMinute := make(map[int]*PhaseRun)
+
+	for _, phase := range AllPhases {
+		start := starts[phase]
+		if start == "" {
+			start = config.StartTime
+		}
+
+		t, err := time.Parse("15:04", start)
+		if err != nil {
+			return nil, fmt.Errorf("invalid start time for %s phase: %s, format: HH:mm", phase, start)
+		}
+
+		run, found := byMinute[t.Hour()*60+t.Minute()]
+		if !found {
+			run = &PhaseRun{Hour: t.Hour(), Minute: t.Minute()}
+			byMinute[t.Hour()*60+t.Minute()] = run
+			runs = append(runs, run)
+		}
+		run.Phases = append(run.Phases, phase)
+	}
+
+	sort.SliceStable(runs, func(i, j int) bool {
+		return runs[i].Hour*60+runs[i].Minute < runs[j].Hour*60+runs[j].Minute
+	})
+	return runs, nil
+}
+
+// NextPhaseRun returns which of the passed in runs starts first after the passed in time and when it starts
+func NextPhaseRun(runs []*PhaseRun, after time.Time) (*PhaseRun, time.Time) {
+	var next *PhaseRun
+	var nextStart time.Time
+
+	for _, run := range runs {
+		start := run.next(after)
+		if next == nil || start.Before(nextStart) {
+			next = run
+			nextStart = start
+		}
+	}
+	return next, nextStart
+}
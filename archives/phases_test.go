@@ -0,0 +1,70 @@
+package archives
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchedulePhases(t *testing.T) {
+	config := NewConfig()
+
+	// by default all our phases start together in order
+	runs, err := SchedulePhases(config)
+	assert.NoError(t, err)
+	assert.Equal(t, []*PhaseRun{{Hour: 0, Minute: 1, Phases: []Phase{PhaseCreate, PhaseRollup, PhaseDelete}}}, runs)
+
+	// phases can start at their own times, each run is made up of the phases starting together
+	config.RollupStartTime = "04:00"
+	config.DeleteStartTime = "04:00"
+	runs, err = SchedulePhases(config)
+	assert.NoError(t, err)
+	assert.Equal(t, []*PhaseRun{
+		{Hour: 0, Minute: 1, Phases: []Phase{PhaseCreate}},
+		{Hour: 4, Minute: 0, Phases: []Phase{PhaseRollup, PhaseDelete}},
+	}, runs)
+
+	// runs are ordered by when they start
+	config.CreateStartTime = "00:01"
+	config.RollupStartTime = "02:00"
+	config.DeleteStartTime = "00:00"
+	runs, err = SchedulePhases(config)
+	assert.NoError(t, err)
+	assert.Equal(t, []*PhaseRun{
+		{Hour: 0, Minute: 0, Phases: []Phase{PhaseDelete}},
+		{Hour: 0, Minute: 1, Phases: []Phase{PhaseCreate}},
+		{Hour: 2, Minute: 0, Phases: []Phase{PhaseRollup}},
+	}, runs)
+
+	config.RollupStartTime = "2am"
+	_, err = SchedulePhases(config)
+	assert.EqualError(t, err, "invalid start time for rollup phase: 2am, format: HH:mm")
+}
+
+func TestNextPhaseRun(t *testing.T) {
+	config := NewConfig()
+	config.RollupStartTime = "02:00"
+	config.DeleteStartTime = "04:00"
+	runs, err := SchedulePhases(config)
+	assert.NoError(t, err)
+
+	tcs := []struct {
+		After  time.Time
+		Phases []Phase
+		Start  time.Time
+	}{
+		{time.Date(2018, 1, 8, 0, 0, 0, 0, time.UTC), []Phase{PhaseCreate}, time.Date(2018, 1, 8, 0, 1, 0, 0, time.UTC)},
+		{time.Date(2018, 1, 8, 0, 1, 0, 0, time.UTC), []Phase{PhaseRollup}, time.Date(2018, 1, 8, 2, 0, 0, 0, time.UTC)},
+		{time.Date(2018, 1, 8, 1, 30, 0, 0, time.UTC), []Phase{PhaseRollup}, time.Date(2018, 1, 8, 2, 0, 0, 0, time.UTC)},
+		{time.Date(2018, 1, 8, 2, 0, 0, 0, time.UTC), []Phase{PhaseDelete}, time.Date(2018, 1, 8, 4, 0, 0, 0, time.UTC)},
+		{time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC), []Phase{PhaseCreate}, time.Date(2018, 1, 9, 0, 1, 0, 0, time.UTC)},
+		{time.Date(2018, 1, 8, 14, 30, 0, 0, time.FixedZone("", 3600*12)), []Phase{PhaseDelete}, time.Date(2018, 1, 8, 4, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tc := range tcs {
+		run, start := NextPhaseRun(runs, tc.After)
+		assert.Equal(t, tc.Phases, run.Phases, "unexpected phases after: %s", tc.After)
+		assert.Equal(t, tc.Start, start, "unexpected start after: %s", tc.After)
+	}
+}
@@ -0,0 +1,305 @@
+package archives
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Plan is the work a run would do for our orgs, written out so it can be reviewed before it is executed. Executing a
+// plan evaluates retention from the time it was planned, so does exactly what it lists.
+type Plan struct {
+	CreatedOn time.Time  `json:"created_on"`
+	Now       time.Time  `json:"now"`
+	Delete    bool       `json:"delete"`
+	Orgs      []*OrgPlan `json:"orgs"`
+}
+
+// OrgPlan is the work planned for an org and type. Records are only deleted for archives which already exist, those
+// of the archives we build are deleted by a later run.
+type OrgPlan struct {
+	OrgID       int               `json:"org_id"`
+	OrgName     string            `json:"org_name"`
+	ArchiveType ArchiveType       `json:"archive_type"`
+	Build       []*PlannedArchive `json:"build"`
+	Rollup      []*PlannedArchive `json:"rollup"`
+	Delete      []*PlannedArchive `json:"delete"`
+}
+
+// PlannedArchive is an archive in a plan, those which already exist have their ids
+type PlannedArchive struct {
+	ID        int           `json:"id,omitempty"`
+	Period    ArchivePeriod `json:"period"`
+	StartDate string        `json:"start_date"`
+}
+
+// key identifies our archive within the plan of an org and type
+func (p *PlannedArchive) key() string {
+	return fmt.Sprintf("%d:%s:%s", p.ID, p.Period, p.StartDate)
+}
+
+func newPlannedArchives(archives []*Archive) []*PlannedArchive {
+	planned := make([]*PlannedArchive, len(archives))
+	for i, a := range archives {
+		planned[i] = &PlannedArchive{ID: a.ID, Period: a.Period, StartDate: a.StartDate.UTC().Format("2006-01-02")}
+	}
+	return planned
+}
+
+// orgWork is everything we would do for an org and type
+type orgWork struct {
+	build   *ArchiveWork
+	rollups []*Archive
+	deletes []*Archive
+}
+
+// findOrgWork works out everything we would do for the passed in org and type as of the passed in time
+func findOrgWork(ctx context.Context, now time.Time, config *Config, db *sqlx.DB, org Org, archiveType ArchiveType) (*orgWork, error) {
+	build, err := FindArchiveWork(ctx, now, config, db, org, archiveType)
+	if err != nil {
+		return nil, err
+	}
+
+	// monthlies we backfill are built directly rather than rolled up
+	missing, err := GetMissingMonthlyArchives(ctx, db, now, org, archiveType)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting missing monthly archives")
+	}
+	rollups := make([]*Archive, 0, len(missing))
+	for _, m := range missing {
+		if _, built := build.covered[m.StartDate.UTC()]; !built {
+			rollups = append(rollups, m)
+		}
+	}
+
+	deletes := make([]*Archive, 0)
+	if config.Delete && recordsDeletable(config, archiveType) {
+		deletes, err = GetArchivesNeedingDeletion(ctx, db, org, archiveType)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error finding archives needing deletion")
+		}
+		deletes = retainedArchives(now, org, deletes)
+	}
+
+	return &orgWork{build: build, rollups: rollups, deletes: deletes}, nil
+}
+
+// plannedTypes returns the types of archive we are configured to build
+func plannedTypes(config *Config) []ArchiveType {
+	types := make([]ArchiveType, 0, 3)
+	if config.ArchiveMessages {
+		types = append(types, MessageType)
+	}
+	if config.ArchiveRuns {
+		types = append(types, RunType)
+	}
+	if config.ArchiveContacts {
+		types = append(types, ContactType)
+	}
+	if config.ArchiveSessions {
+		types = append(types, SessionType)
+	}
+	if config.ArchiveBroadcasts {
+		types = append(types, BroadcastType)
+	}
+	if config.ArchiveChannelEvents {
+		types = append(types, ChannelEventType)
+	}
+	return types
+}
+
+// BuildPlan works out which archives we would build, roll up and delete the records of for the passed in orgs as of
+// the passed in time, without doing any of it
+func BuildPlan(ctx context.Context, now time.Time, config *Config, db *sqlx.DB, orgs []Org) (*Plan, error) {
+	if config.ContactGroupID != 0 {
+		return nil, fmt.Errorf("plans can't be made when archiving a contact group")
+	}
+
+	plan := &Plan{CreatedOn: time.Now().UTC(), Now: now, Delete: config.Delete, Orgs: make([]*OrgPlan, 0, len(orgs))}
+
+	for _, org := range orgs {
+		for _, archiveType := range plannedTypes(config) {
+			org, err := CheckOrgStart(ctx, db, config, org, archiveType)
+			if err != nil {
+				return nil, errors.Wrapf(err, "error checking org start for org: %d", org.ID)
+			}
+
+			work, err := findOrgWork(ctx, now, config, db, org, archiveType)
+			if err != nil {
+				return nil, errors.Wrapf(err, "error planning org: %d and type: %s", org.ID, archiveType)
+			}
+
+			plan.Orgs = append(plan.Orgs, &OrgPlan{
+				OrgID:       org.ID,
+				OrgName:     org.Name,
+				ArchiveType: archiveType,
+				Build:       newPlannedArchives(append(work.build.Monthlies, work.build.Dailies...)),
+				Rollup:      newPlannedArchives(work.rollups),
+				Delete:      newPlannedArchives(work.deletes),
+			})
+		}
+	}
+
+	return plan, nil
+}
+
+// WritePlan writes the passed in plan as JSON to the passed in path
+func WritePlan(path string, plan *Plan) error {
+	encoded, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "error encoding plan")
+	}
+	return errors.Wrapf(ioutil.WriteFile(path, encoded, 0644), "error writing plan")
+}
+
+// ReadPlan reads a plan written by WritePlan from the passed in path
+func ReadPlan(path string) (*Plan, error) {
+	encoded, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading plan")
+	}
+
+	plan := &Plan{}
+	err = json.Unmarshal(encoded, plan)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error decoding plan")
+	}
+	return plan, nil
+}
+
+// plannedOnly returns those of the passed in archives which are in the passed in plan, and how many archives are only
+// in one or the other
+func plannedOnly(planned []*PlannedArchive, archives []*Archive) ([]*Archive, int) {
+	keys := make(map[string]bool, len(planned))
+	for _, p := range planned {
+		keys[p.key()] = true
+	}
+
+	found := make([]*Archive, 0, len(archives))
+	for i, p := range newPlannedArchives(archives) {
+		if keys[p.key()] {
+			found = append(found, archives[i])
+		}
+	}
+	return found, len(planned) + len(archives) - 2*len(found)
+}
+
+// orgExecution is the work of an org plan which still needs doing
+type orgExecution struct {
+	org         Org
+	archiveType ArchiveType
+	build       *ArchiveWork
+	rollups     []*Archive
+	deletes     map[int]bool
+}
+
+// ExecutePlan does the work listed in the passed in plan, as of the time it was planned, returning the archives
+// created and deleted. Nothing is done if the work we would now do differs from the plan by more archives than our
+// tolerance, and only work which is still needed is done.
+func ExecutePlan(ctx context.Context, config *Config, db *sqlx.DB, s3Client Storage, plan *Plan) ([]*Archive, []*Archive, error) {
+	if plan.Delete && !config.Delete {
+		return nil, nil, fmt.Errorf("plan deletes records but deletion isn't enabled")
+	}
+	if config.ContactGroupID != 0 {
+		return nil, nil, fmt.Errorf("plans can't be executed when archiving a contact group")
+	}
+
+	// our plan is what deletes records, not whether we would now
+	planned := *config
+	planned.Delete = plan.Delete
+
+	// check our whole plan before we do any of it
+	executions := make([]*orgExecution, 0, len(plan.Orgs))
+	diverged := 0
+	for _, p := range plan.Orgs {
+		org, err := GetOrg(ctx, db, config, p.OrgID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if org == nil || !org.IsActive {
+			return nil, nil, fmt.Errorf("org: %d in plan is no longer active", p.OrgID)
+		}
+
+		checked, err := CheckOrgStart(ctx, db, config, *org, p.ArchiveType)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "error checking org start for org: %d", org.ID)
+		}
+
+		work, err := findOrgWork(ctx, plan.Now, &planned, db, checked, p.ArchiveType)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "error checking plan of org: %d and type: %s", org.ID, p.ArchiveType)
+		}
+
+		execution := &orgExecution{
+			org:         checked,
+			archiveType: p.ArchiveType,
+			build:       &ArchiveWork{Monthlies: make([]*Archive, 0), Dailies: make([]*Archive, 0), covered: work.build.covered},
+			deletes:     make(map[int]bool),
+		}
+
+		builds, off := plannedOnly(p.Build, append(work.build.Monthlies, work.build.Dailies...))
+		diverged += off
+		for _, a := range builds {
+			if a.Period == MonthPeriod {
+				execution.build.Monthlies = append(execution.build.Monthlies, a)
+			} else {
+				execution.build.Dailies = append(execution.build.Dailies, a)
+			}
+		}
+
+		execution.rollups, off = plannedOnly(p.Rollup, work.rollups)
+		diverged += off
+
+		deletes, off := plannedOnly(p.Delete, work.deletes)
+		diverged += off
+		for _, a := range deletes {
+			execution.deletes[a.ID] = true
+		}
+
+		executions = append(executions, execution)
+	}
+
+	if diverged > config.PlanTolerance {
+		return nil, nil, fmt.Errorf("plan differs from the database by %d archives, more than our tolerance of %d", diverged, config.PlanTolerance)
+	}
+	if diverged > 0 {
+		logrus.WithField("diverged", diverged).WithField("tolerance", config.PlanTolerance).Warn("plan differs from the database, only executing what is still needed")
+	}
+
+	created := make([]*Archive, 0)
+	deleted := make([]*Archive, 0)
+	for _, e := range executions {
+		log := logrus.WithField("org_id", e.org.ID).WithField("archive_type", e.archiveType)
+
+		built, err := createOrgArchiveWork(ctx, config, db, s3Client, e.org, e.archiveType, e.build)
+		if err != nil {
+			return created, deleted, errors.Wrapf(err, "error creating archives for org: %d", e.org.ID)
+		}
+		created = append(created, built...)
+
+		monthlies, err := rollupArchives(ctx, plan.Now, config, db, s3Client, e.org, e.archiveType, e.rollups)
+		if err != nil {
+			return created, deleted, errors.Wrapf(err, "error rolling up archives for org: %d", e.org.ID)
+		}
+		created = append(created, monthlies...)
+
+		removed := make([]*Archive, 0)
+		if len(e.deletes) > 0 {
+			removed, _, err = deleteArchivedOrgRecords(ctx, plan.Now, config, db, s3Client, e.org, e.archiveType, e.deletes)
+			deleted = append(deleted, removed...)
+			if err != nil {
+				return created, deleted, errors.Wrapf(err, "error deleting archived records for org: %d", e.org.ID)
+			}
+		}
+
+		log.WithField("built", len(built)).WithField("rolled_up", len(monthlies)).WithField("deleted", len(removed)).Info("executed plan of org")
+	}
+
+	return created, deleted, nil
+}
@@ -0,0 +1,107 @@
+package archives
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlanArchiveWork(t *testing.T) {
+	day := func(m time.Month, d int) *Archive {
+		return &Archive{Period: DayPeriod, StartDate: time.Date(2017, m, d, 0, 0, 0, 0, time.UTC)}
+	}
+	month := func(m time.Month) *Archive {
+		return &Archive{Period: MonthPeriod, StartDate: time.Date(2017, m, 1, 0, 0, 0, 0, time.UTC)}
+	}
+
+	dailies := []*Archive{day(8, 30), day(8, 31), day(9, 1), day(9, 30), day(10, 1)}
+	work := planArchiveWork([]*Archive{month(8), month(9)}, dailies)
+	assert.Equal(t, []*Archive{month(8), month(9)}, work.Monthlies)
+	assert.Equal(t, []*Archive{day(10, 1)}, work.Dailies)
+	assert.Equal(t, []*Archive{day(9, 1), day(9, 30)}, work.covered[time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC)])
+
+	work = planArchiveWork([]*Archive{}, dailies)
+	assert.Equal(t, dailies, work.Dailies)
+
+	// archives in plans are matched by their ids, periods and dates
+	planned := []*PlannedArchive{{Period: DayPeriod, StartDate: "2017-08-31"}, {Period: DayPeriod, StartDate: "2017-08-29"}}
+	found, diverged := plannedOnly(planned, dailies)
+	assert.Equal(t, []*Archive{dailies[1]}, found)
+	assert.Equal(t, 5, diverged)
+}
+
+func TestExecutePlan(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+
+	config := NewConfig()
+	config.ArchiveRuns = false
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	plan, err := BuildPlan(ctx, now, config, db, orgs)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(plan.Orgs))
+
+	org2 := plan.Orgs[1]
+	assert.Equal(t, 2, org2.OrgID)
+	assert.Equal(t, MessageType, org2.ArchiveType)
+	assert.Equal(t, 61, len(org2.Build))
+	assert.Equal(t, &PlannedArchive{Period: DayPeriod, StartDate: "2017-08-10"}, org2.Build[0])
+	assert.Equal(t, []*PlannedArchive{{Period: MonthPeriod, StartDate: "2017-08-01"}, {Period: MonthPeriod, StartDate: "2017-09-01"}}, org2.Rollup)
+	assert.Equal(t, 0, len(org2.Delete))
+
+	// planning does no work
+	assertCount(t, db, 0, `SELECT count(*) FROM archives_archive WHERE org_id = 2 AND period = 'M'`)
+
+	dir, err := ioutil.TempDir("", "plan")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "plan.json")
+	assert.NoError(t, WritePlan(path, plan))
+	read, err := ReadPlan(path)
+	assert.NoError(t, err)
+	assert.Equal(t, plan.Now.Unix(), read.Now.Unix())
+	assert.Equal(t, plan.Orgs, read.Orgs)
+
+	// plans which delete need deletion enabled to execute
+	read.Delete = true
+	_, _, err = ExecutePlan(ctx, config, db, s3Client, read)
+	assert.EqualError(t, err, "plan deletes records but deletion isn't enabled")
+	read.Delete = false
+
+	// a plan which has diverged from the database isn't executed
+	assert.Equal(t, &PlannedArchive{Period: DayPeriod, StartDate: "2017-10-10"}, read.Orgs[1].Build[60])
+	read.Orgs[1].Build = read.Orgs[1].Build[:60]
+	_, _, err = ExecutePlan(ctx, config, db, s3Client, read)
+	assert.EqualError(t, err, "plan differs from the database by 1 archives, more than our tolerance of 0")
+	assertCount(t, db, 0, `SELECT count(*) FROM archives_archive WHERE org_id = 2 AND period = 'M'`)
+
+	// unless we tolerate it, in which case only what it lists is done
+	config.PlanTolerance = 1
+	created, deleted, err := ExecutePlan(ctx, config, db, s3Client, read)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(deleted))
+	assertCount(t, db, 0, `SELECT count(*) FROM archives_archive WHERE org_id = 2 AND archive_type = 'message' AND start_date = '2017-10-10'`)
+	assertCount(t, db, 2, `SELECT count(*) FROM archives_archive WHERE org_id = 2 AND archive_type = 'message' AND period = 'M'`)
+
+	org2Created := 0
+	for _, a := range created {
+		if a.OrgID == 2 {
+			org2Created++
+		}
+	}
+	assert.Equal(t, 62, org2Created)
+
+	// executing it again, everything it lists is already done
+	config.PlanTolerance = 0
+	_, _, err = ExecutePlan(ctx, config, db, s3Client, plan)
+	assert.Error(t, err)
+}
@@ -0,0 +1,114 @@
+package archives
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var implausibleArchives = newCounter("archiver_implausible_archives_total", "Number of archives whose compressed size per record was implausible.", "archive_type", "reason")
+
+// how we react to archives whose size is implausible for their number of records
+const (
+	PlausibilityOff  = ""
+	PlausibilityWarn = "warn"
+	PlausibilityFail = "fail"
+)
+
+// archives with fewer records than this are mostly gzip overhead so we don't check them
+const minPlausibilityRecords = 100
+
+// CheckPlausibilityMode checks that the passed in plausibility check mode is one we support
+func CheckPlausibilityMode(mode string) error {
+	switch mode {
+	case PlausibilityOff, PlausibilityWarn, PlausibilityFail:
+		return nil
+	}
+	return fmt.Errorf("invalid plausibility check: %s, must be one of warn or fail", mode)
+}
+
+// the compressed size and record count of all the dailies we've built for an org and type
+const lookupOrgArchiveTotals = `
+SELECT COALESCE(SUM(size), 0) AS size, COALESCE(SUM(record_count), 0) AS record_count
+FROM archives_archive
+WHERE org_id = $1 AND archive_type = $2 AND period = 'D' AND record_count > 0
+`
+
+// plausibilityBounds returns the bytes per record the passed in type must be between, 0 meaning unbounded. Contacts
+// vary too much with their fields and URNs to be bounded.
+func plausibilityBounds(config *Config, archiveType ArchiveType) (float64, float64) {
+	switch archiveType {
+	case MessageType:
+		return float64(config.MinMessageBytesPerRecord), float64(config.MaxMessageBytesPerRecord)
+	case RunType:
+		return float64(config.MinRunBytesPerRecord), float64(config.MaxRunBytesPerRecord)
+	}
+	return 0, 0
+}
+
+// checkPlausibility checks that the compressed size of the passed in archive is plausible for its number of records,
+// both against our configured bounds and the average of the org's previous archives, as an archive which is far too
+// small likely dropped records. Implausible archives are logged and counted, and are an error if we're set to fail.
+func checkPlausibility(ctx context.Context, db *sqlx.DB, config *Config, archive *Archive) error {
+	if config.PlausibilityCheck == PlausibilityOff || archive.RecordCount < minPlausibilityRecords {
+		return nil
+	}
+
+	bytesPerRecord := float64(archive.Size) / float64(archive.RecordCount)
+	min, max := plausibilityBounds(config, archive.ArchiveType)
+
+	reason := ""
+	average := 0.0
+	if min > 0 && bytesPerRecord < min {
+		reason = "below_min"
+	} else if max > 0 && bytesPerRecord > max {
+		reason = "above_max"
+	} else if config.PlausibilityDeviation > 1 {
+		ctx, cancel := context.WithTimeout(ctx, time.Minute)
+		defer cancel()
+
+		var totals struct {
+			Size        int64 `db:"size"`
+			RecordCount int64 `db:"record_count"`
+		}
+		err := db.GetContext(ctx, &totals, lookupOrgArchiveTotals, archive.Org.ID, archive.ArchiveType)
+		if err != nil {
+			return errors.Wrapf(err, "error looking up archive totals for org: %d", archive.Org.ID)
+		}
+
+		if totals.RecordCount >= minPlausibilityRecords {
+			average = float64(totals.Size) / float64(totals.RecordCount)
+			if bytesPerRecord < average/config.PlausibilityDeviation {
+				reason = "below_average"
+			} else if bytesPerRecord > average*config.PlausibilityDeviation {
+				reason = "above_average"
+			}
+		}
+	}
+
+	if reason == "" {
+		return nil
+	}
+
+	implausibleArchives.add(1, string(archive.ArchiveType), reason)
+	logrus.WithFields(logrus.Fields{
+		"org_id":           archive.Org.ID,
+		"archive_type":     archive.ArchiveType,
+		"start_date":       archive.StartDate,
+		"period":           archive.Period,
+		"record_count":     archive.RecordCount,
+		"size":             archive.Size,
+		"bytes_per_record": int(bytesPerRecord),
+		"org_average":      int(average),
+		"reason":           reason,
+	}).Warn("archive size is implausible for its number of records")
+
+	if config.PlausibilityCheck == PlausibilityFail {
+		return fmt.Errorf("archive size of %d bytes is implausible for %d records: %s", archive.Size, archive.RecordCount, reason)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package archives
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckPlausibility(t *testing.T) {
+	ctx := context.Background()
+	config := NewConfig()
+	config.PlausibilityDeviation = 0
+
+	archive := func(archiveType ArchiveType, recordCount int, size int64) *Archive {
+		return &Archive{Org: Org{ID: 2}, ArchiveType: archiveType, StartDate: time.Date(2017, 8, 12, 0, 0, 0, 0, time.UTC), Period: DayPeriod, RecordCount: recordCount, Size: size}
+	}
+
+	// nothing is checked by default
+	assert.NoError(t, checkPlausibility(ctx, nil, config, archive(MessageType, 120000, 30000)))
+
+	config.PlausibilityCheck = PlausibilityFail
+	assert.EqualError(t, checkPlausibility(ctx, nil, config, archive(MessageType, 120000, 30000)), "archive size of 30000 bytes is implausible for 120000 records: below_min")
+	assert.EqualError(t, checkPlausibility(ctx, nil, config, archive(MessageType, 100, 600000)), "archive size of 600000 bytes is implausible for 100 records: above_max")
+	assert.NoError(t, checkPlausibility(ctx, nil, config, archive(MessageType, 1000, 150000)))
+	assert.NoError(t, checkPlausibility(ctx, nil, config, archive(RunType, 1000, 600000)))
+
+	// small archives are mostly gzip overhead
+	assert.NoError(t, checkPlausibility(ctx, nil, config, archive(MessageType, 3, 483)))
+
+	// warning never fails
+	config.PlausibilityCheck = PlausibilityWarn
+	assert.NoError(t, checkPlausibility(ctx, nil, config, archive(MessageType, 120000, 30000)))
+
+	assert.NoError(t, CheckPlausibilityMode("warn"))
+	assert.EqualError(t, CheckPlausibilityMode("panic"), "invalid plausibility check: panic, must be one of warn or fail")
+}
+
+func TestCheckPlausibilityAverage(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+
+	config := NewConfig()
+	config.PlausibilityCheck = PlausibilityFail
+	config.MinMessageBytesPerRecord = 0
+	config.MinRunBytesPerRecord = 0
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+
+	archive := &Archive{Org: orgs[1], ArchiveType: MessageType, StartDate: time.Date(2017, 8, 12, 0, 0, 0, 0, time.UTC), Period: DayPeriod, RecordCount: 1000, Size: 10000}
+
+	// without any history there's nothing to compare to
+	assert.NoError(t, checkPlausibility(ctx, db, config, archive))
+
+	// our org's archives average 200 bytes per record
+	_, err = db.Exec(`INSERT INTO archives_archive(archive_type, created_on, start_date, period, record_count, size, hash, url, needs_deletion, build_time, org_id) VALUES
+	('message', NOW(), '2017-08-10', 'D', 1000, 150000, '', '', TRUE, 0, 2),
+	('message', NOW(), '2017-08-11', 'D', 1000, 250000, '', '', TRUE, 0, 2)`)
+	assert.NoError(t, err)
+
+	assert.EqualError(t, checkPlausibility(ctx, db, config, archive), "archive size of 10000 bytes is implausible for 1000 records: below_average")
+
+	archive.Size = 150000
+	assert.NoError(t, checkPlausibility(ctx, db, config, archive))
+
+	// runs have no history
+	archive.ArchiveType = RunType
+	archive.Size = 10000
+	assert.NoError(t, checkPlausibility(ctx, db, config, archive))
+}
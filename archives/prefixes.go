@@ -0,0 +1,82 @@
+package archives
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// MigrateKeyPrefixes copies the objects of the current archives of the passed in org and type which aren't under the
+// key prefix configured for the type to the keys we would upload them to now, pointing each archive at its copy once
+// it's verified. The old objects are left in place to be removed once the migration has been checked. Compacted empty
+// archives share their objects so are left where they are. Returns the number of archives migrated.
+func MigrateKeyPrefixes(ctx context.Context, config *Config, db *sqlx.DB, s3Client Storage, org Org, archiveType ArchiveType) (int, error) {
+	if keyPrefixes[archiveType] == "" {
+		return 0, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Hour)
+	defer cancel()
+
+	prefix := orgKeyPrefix(org, archiveType)
+	migrated := 0
+
+	err := ForEachCurrentArchive(ctx, db, org, archiveType, func(archive *Archive) error {
+		if archive.URL == "" {
+			return nil
+		}
+
+		_, current, err := s3Client.SplitURL(archive.URL)
+		if err != nil {
+			return errors.Wrapf(err, "invalid url for archive: %d", archive.ID)
+		}
+		if strings.HasPrefix(current, prefix) || strings.HasPrefix(current, emptyArchivePrefix) {
+			return nil
+		}
+
+		archive.Org = org
+		key := archiveS3Key(archive)
+		copiedURL, err := s3Client.Copy(ctx, archive.URL, key, "")
+		if err != nil {
+			return errors.Wrapf(err, "error copying archive: %d to %s", archive.ID, key)
+		}
+		copied := &Archive{ID: archive.ID, Size: archive.Size, Hash: archive.Hash, URL: copiedURL}
+
+		// make sure our copy is identical before we point at it
+		err = VerifyS3Archive(ctx, s3Client, copied)
+		if err != nil {
+			return errors.Wrapf(err, "error verifying copy of archive: %d", archive.ID)
+		}
+
+		_, err = db.ExecContext(ctx, updateArchiveURL, archive.ID, copied.URL)
+		if err != nil {
+			return errors.Wrapf(err, "error updating url of archive: %d", archive.ID)
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"archive_id": archive.ID,
+			"old_url":    archive.URL,
+			"url":        copied.URL,
+		}).Debug("migrated archive to key prefix")
+
+		migrated++
+		return nil
+	})
+
+	if migrated > 0 {
+		logrus.WithFields(logrus.Fields{
+			"org_id":       org.ID,
+			"archive_type": archiveType,
+			"migrated":     migrated,
+		}).Info("migrated archives to key prefix")
+	}
+
+	if err != nil {
+		return migrated, errors.Wrapf(err, "error migrating archives for org: %d and type: %s", org.ID, archiveType)
+	}
+	return migrated, nil
+}
@@ -0,0 +1,263 @@
+package archives
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	uploadsInProgress   = newGauge("archiver_uploads_in_progress", "Number of archives currently being uploaded.")
+	uploadRemainingSize = newGauge("archiver_upload_remaining_bytes", "Number of bytes left to upload across the archives currently being uploaded.")
+)
+
+// how often we log the progress of each upload
+var uploadProgressInterval = time.Second * 30
+
+// UploadStatus is the progress of an upload, as reported by our status endpoint
+type UploadStatus struct {
+	Key       string    `json:"key"`
+	Size      int64     `json:"size"`
+	Sent      int64     `json:"sent"`
+	Percent   float64   `json:"percent"`
+	StartedOn time.Time `json:"started_on"`
+}
+
+// uploadProgress tracks how much of an archive file has been read for uploading
+type uploadProgress struct {
+	key     string
+	size    int64
+	started time.Time
+
+	mutex    sync.Mutex
+	sent     int64
+	lastSent int64
+	lastLog  time.Time
+
+	done chan struct{}
+}
+
+// the uploads we are currently making
+var (
+	uploadsMutex sync.Mutex
+	uploads      = make(map[*uploadProgress]bool)
+)
+
+// startUploadProgress starts tracking the upload of the passed in number of bytes to the passed in key, logging its
+// progress periodically until it is finished
+func startUploadProgress(key string, size int64) *uploadProgress {
+	now := time.Now()
+	p := &uploadProgress{key: key, size: size, started: now, lastLog: now, done: make(chan struct{})}
+
+	uploadsMutex.Lock()
+	uploads[p] = true
+	uploadsMutex.Unlock()
+	recordUploadMetrics()
+
+	go func() {
+		ticker := time.NewTicker(uploadProgressInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				p.log()
+			case <-p.done:
+				return
+			}
+		}
+	}()
+
+	return p
+}
+
+// finish stops tracking our upload
+func (p *uploadProgress) finish() {
+	close(p.done)
+
+	uploadsMutex.Lock()
+	delete(uploads, p)
+	uploadsMutex.Unlock()
+	recordUploadMetrics()
+}
+
+// setSent records how many bytes of our file have been read
+func (p *uploadProgress) setSent(sent int64) {
+	p.mutex.Lock()
+	p.sent = sent
+	p.mutex.Unlock()
+}
+
+func (p *uploadProgress) status() UploadStatus {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	percent := 100.0
+	if p.size > 0 {
+		percent = float64(p.sent) / float64(p.size) * 100
+	}
+	return UploadStatus{Key: p.key, Size: p.size, Sent: p.sent, Percent: percent, StartedOn: p.started}
+}
+
+// log logs how far along our upload is and how fast it went since we last logged
+func (p *uploadProgress) log() {
+	status := p.status()
+
+	p.mutex.Lock()
+	now := time.Now()
+	rate := float64(status.Sent-p.lastSent) / now.Sub(p.lastLog).Seconds()
+	p.lastSent = status.Sent
+	p.lastLog = now
+	p.mutex.Unlock()
+
+	logrus.WithFields(logrus.Fields{
+		"key":            status.Key,
+		"size":           status.Size,
+		"sent":           status.Sent,
+		"percent":        fmt.Sprintf("%.1f", status.Percent),
+		"bytes_per_sec":  int64(rate),
+		"upload_elapsed": now.Sub(status.StartedOn),
+	}).Info("upload progress")
+
+	recordUploadMetrics()
+}
+
+// CurrentUploads returns the status of the uploads we are currently making, oldest first
+func CurrentUploads() []UploadStatus {
+	uploadsMutex.Lock()
+	defer uploadsMutex.Unlock()
+
+	statuses := make([]UploadStatus, 0, len(uploads))
+	for p := range uploads {
+		statuses = append(statuses, p.status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].StartedOn.Before(statuses[j].StartedOn) })
+	return statuses
+}
+
+func recordUploadMetrics() {
+	statuses := CurrentUploads()
+
+	remaining := int64(0)
+	for _, s := range statuses {
+		remaining += s.Size - s.Sent
+	}
+	uploadsInProgress.set(float64(len(statuses)))
+	uploadRemainingSize.set(float64(remaining))
+}
+
+// progressReader reads an archive file for uploading, recording our progress and stopping as soon as our context is
+// done rather than relying on the SDK to notice
+type progressReader struct {
+	ctx      context.Context
+	reader   io.ReadSeeker
+	progress *uploadProgress
+	offset   int64
+}
+
+func newProgressReader(ctx context.Context, reader io.ReadSeeker, progress *uploadProgress) *progressReader {
+	return &progressReader{ctx: ctx, reader: reader, progress: progress}
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	n, err := r.reader.Read(p)
+	r.offset += int64(n)
+	r.progress.setSent(r.offset)
+	return n, err
+}
+
+// Seek lets the SDK find our length and rewind us to retry, which also rewinds our progress
+func (r *progressReader) Seek(offset int64, whence int) (int64, error) {
+	position, err := r.reader.Seek(offset, whence)
+	if err != nil {
+		return position, err
+	}
+	r.offset = position
+	r.progress.setSent(position)
+	return position, nil
+}
+
+// buildProgress counts the records written to an archive we are building, logging how many every interval so that
+// archives which take a long time to build don't look stuck
+type buildProgress struct {
+	log     *logrus.Entry
+	started time.Time
+	records int64
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// startBuildProgress starts counting the records of the archive the passed in log is for, logging its progress every
+// interval, or never if interval is zero, until it is finished
+func startBuildProgress(log *logrus.Entry, interval time.Duration) *buildProgress {
+	p := &buildProgress{log: log, started: time.Now(), done: make(chan struct{}), stopped: make(chan struct{})}
+	if interval <= 0 {
+		close(p.stopped)
+		return p
+	}
+
+	go func() {
+		defer close(p.stopped)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				p.heartbeat()
+			case <-p.done:
+				return
+			}
+		}
+	}()
+
+	return p
+}
+
+// counter returns a writer which counts the records written through it to the passed in writer, records being lines
+func (p *buildProgress) counter(writer io.Writer) io.Writer {
+	return &recordCounter{writer: writer, progress: p}
+}
+
+// reset starts our count again, such as when we start writing our archive again
+func (p *buildProgress) reset() {
+	atomic.StoreInt64(&p.records, 0)
+}
+
+// finish stops logging our progress, we never log once it returns
+func (p *buildProgress) finish() {
+	close(p.done)
+	<-p.stopped
+}
+
+// heartbeat logs how many records we have written so far
+func (p *buildProgress) heartbeat() {
+	p.log.WithFields(logrus.Fields{
+		"records":       atomic.LoadInt64(&p.records),
+		"build_elapsed": time.Since(p.started),
+	}).Info("archive build progress")
+}
+
+// recordCounter counts the lines written through it, which are our records
+type recordCounter struct {
+	writer   io.Writer
+	progress *buildProgress
+}
+
+func (c *recordCounter) Write(p []byte) (int, error) {
+	n, err := c.writer.Write(p)
+	atomic.AddInt64(&c.progress.records, int64(bytes.Count(p[:n], []byte("\n"))))
+	return n, err
+}
@@ -0,0 +1,151 @@
+package archives
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// slowS3API uploads a few bytes at a time, ignoring its context like a stuck SDK would
+type slowS3API struct {
+	*mockS3API
+	midway []UploadStatus
+}
+
+func (c *slowS3API) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	body := make([]byte, 0)
+	chunk := make([]byte, 10)
+	for {
+		n, err := input.Body.Read(chunk)
+		body = append(body, chunk[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(body) == 200 {
+			c.midway = CurrentUploads()
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+	c.putObject(aws.StringValue(input.Bucket), aws.StringValue(input.Key), body)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func writeTestArchive(t *testing.T, size int) *Archive {
+	file, err := ioutil.TempFile("", "progress")
+	assert.NoError(t, err)
+	defer file.Close()
+
+	contents := []byte(strings.Repeat("x", size))
+	_, err = file.Write(contents)
+	assert.NoError(t, err)
+
+	hash := md5.Sum(contents)
+	return &Archive{ArchiveFile: file.Name(), Size: int64(size), Hash: hex.EncodeToString(hash[:])}
+}
+
+func TestUploadProgress(t *testing.T) {
+	defer func() { uploadProgressInterval = time.Second * 30 }()
+	uploadProgressInterval = time.Millisecond * 40
+	hook := test.NewGlobal()
+
+	api := &slowS3API{mockS3API: newMockS3API()}
+	s3Client := newS3Client(api, s3BucketURL)
+	archive := writeTestArchive(t, 400)
+	defer os.Remove(archive.ArchiveFile)
+
+	err := UploadToS3(context.Background(), s3Client, "dl-archiver-test", "/1/progress.jsonl.gz", archive)
+	assert.NoError(t, err)
+	assert.Equal(t, 400, len(api.objects["dl-archiver-test:/1/progress.jsonl.gz"].body))
+
+	// we could see our upload while it was being made, but not after
+	assert.Equal(t, 1, len(api.midway))
+	assert.Equal(t, "/1/progress.jsonl.gz", api.midway[0].Key)
+	assert.Equal(t, int64(400), api.midway[0].Size)
+	assert.Equal(t, int64(200), api.midway[0].Sent)
+	assert.Equal(t, 50.0, api.midway[0].Percent)
+	assert.Equal(t, 0, len(CurrentUploads()))
+
+	logged := 0
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "upload progress" {
+			assert.Equal(t, "/1/progress.jsonl.gz", entry.Data["key"])
+			logged++
+		}
+	}
+	assert.True(t, logged >= 2, "expected at least two progress logs, got %d", logged)
+}
+
+func TestUploadCancellation(t *testing.T) {
+	api := &slowS3API{mockS3API: newMockS3API()}
+	s3Client := newS3Client(api, s3BucketURL)
+	archive := writeTestArchive(t, 10000)
+	defer os.Remove(archive.ArchiveFile)
+
+	// our upload would take seconds, but we give up as soon as our deadline passes
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	start := time.Now()
+	err := UploadToS3(ctx, s3Client, "dl-archiver-test", "/1/cancelled.jsonl.gz", archive)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, 0, len(api.objects))
+	assert.Equal(t, 0, len(CurrentUploads()))
+}
+
+func TestBuildProgress(t *testing.T) {
+	hook := test.NewGlobal()
+	log := logrus.WithField("org_id", 2).WithField("archive_type", MessageType)
+
+	progress := startBuildProgress(log, time.Millisecond*20)
+	counted := &bytes.Buffer{}
+	writer := progress.counter(counted)
+
+	writer.Write([]byte("{\"id\":1}\n{\"id\":2}\n{\"id\":"))
+	writer.Write([]byte("3}\n"))
+	assert.Equal(t, "{\"id\":1}\n{\"id\":2}\n{\"id\":3}\n", counted.String())
+	time.Sleep(time.Millisecond * 50)
+
+	// starting again starts our count again
+	progress.reset()
+	writer.Write([]byte("{\"id\":1}\n"))
+	time.Sleep(time.Millisecond * 50)
+	progress.finish()
+
+	records := make([]int64, 0)
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "archive build progress" {
+			assert.Equal(t, 2, entry.Data["org_id"])
+			assert.Equal(t, MessageType, entry.Data["archive_type"])
+			records = append(records, entry.Data["records"].(int64))
+		}
+	}
+	assert.True(t, len(records) >= 2, "expected at least two progress logs, got %d", len(records))
+	assert.Equal(t, int64(3), records[0])
+	assert.Equal(t, int64(1), records[len(records)-1])
+
+	// no interval, no logs
+	hook.Reset()
+	progress = startBuildProgress(log, 0)
+	progress.counter(counted).Write([]byte("{\"id\":1}\n"))
+	time.Sleep(time.Millisecond * 30)
+	progress.finish()
+	assert.Equal(t, 0, len(hook.AllEntries()))
+}
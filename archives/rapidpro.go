@@ -0,0 +1,118 @@
+package archives
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// RapidProNotification tells RapidPro a new monthly archive of one of its orgs has landed, so it can show it right away
+// and email the org's admins itself
+type RapidProNotification struct {
+	ArchiveID   int           `json:"archive_id" db:"archive_id"`
+	OrgID       int           `json:"org_id" db:"org_id"`
+	ArchiveType ArchiveType   `json:"archive_type" db:"archive_type"`
+	Period      ArchivePeriod `json:"period" db:"period"`
+	StartDate   string        `json:"start_date" db:"start_date"`
+}
+
+const queueRapidProNotification = `
+INSERT INTO archiver_rapidpro_notifications(archive_id, org_id, queued_on, notified_on) VALUES($1, $2, NOW(), NULL)
+ON CONFLICT (archive_id) DO UPDATE SET queued_on = EXCLUDED.queued_on, notified_on = NULL
+`
+
+// QueueRapidProNotification queues a notification to RapidPro of the passed in archive if it is a monthly and we are
+// configured to notify RapidPro. Rebuilt monthlies are notified again.
+func QueueRapidProNotification(ctx context.Context, db *sqlx.DB, config *Config, archive *Archive) error {
+	if config.RapidProNotifyURL == "" || archive.Period != MonthPeriod || archive.ID == 0 {
+		return nil
+	}
+
+	_, err := db.ExecContext(ctx, queueRapidProNotification, archive.ID, archive.Org.ID)
+	if err != nil {
+		return errors.Wrapf(err, "error queuing rapidpro notification of archive: %d", archive.ID)
+	}
+	return nil
+}
+
+const selectPendingRapidProNotifications = `
+SELECT n.archive_id, n.org_id, a.archive_type, a.period, to_char(a.start_date, 'YYYY-MM-DD') AS start_date
+FROM archiver_rapidpro_notifications n JOIN archives_archive a ON a.id = n.archive_id
+WHERE n.org_id = $1 AND n.notified_on IS NULL
+ORDER BY n.archive_id
+`
+
+const markRapidProNotified = `
+UPDATE archiver_rapidpro_notifications SET notified_on = NOW() WHERE archive_id = $1
+`
+
+// NotifyRapidPro sends RapidPro the notifications queued for the passed in org, including any which failed on previous
+// runs. Failures are logged and left queued to be retried on our next run, they never affect archival.
+func NotifyRapidPro(ctx context.Context, config *Config, db *sqlx.DB, org Org) {
+	if config.RapidProNotifyURL == "" {
+		return
+	}
+
+	log := logrus.WithField("org_id", org.ID)
+
+	pending := make([]*RapidProNotification, 0)
+	err := db.SelectContext(ctx, &pending, selectPendingRapidProNotifications, org.ID)
+	if err != nil {
+		log.WithError(err).Error("error selecting pending rapidpro notifications")
+		return
+	}
+
+	for _, notification := range pending {
+		err := postRapidProNotification(ctx, config, notification)
+		if err != nil {
+			log.WithError(err).WithField("archive_id", notification.ArchiveID).Error("error notifying rapidpro of archive, will retry next run")
+			continue
+		}
+
+		_, err = db.ExecContext(ctx, markRapidProNotified, notification.ArchiveID)
+		if err != nil {
+			log.WithError(err).WithField("archive_id", notification.ArchiveID).Error("error recording rapidpro notification")
+			continue
+		}
+
+		log.WithField("archive_id", notification.ArchiveID).Info("notified rapidpro of archive")
+	}
+}
+
+// postRapidProNotification posts the passed in notification as JSON to RapidPro, authenticated by our shared token
+func postRapidProNotification(ctx context.Context, config *Config, notification *RapidProNotification) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return errors.Wrapf(err, "error encoding notification")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, config.RapidProNotifyURL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrapf(err, "invalid rapidpro notify url: %s", config.RapidProNotifyURL)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if config.RapidProNotifyToken != "" {
+		req.Header.Set("Authorization", "Token "+config.RapidProNotifyToken)
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "error calling rapidpro")
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("rapidpro returned status: %d", resp.StatusCode)
+	}
+	return nil
+}
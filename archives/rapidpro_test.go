@@ -0,0 +1,76 @@
+package archives
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotifyRapidPro(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+
+	// RapidPro is down the first time it is called
+	calls := 0
+	received := make([]*RapidProNotification, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		assert.Equal(t, "Token sesame", r.Header.Get("Authorization"))
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		notification := &RapidProNotification{}
+		json.Unmarshal(body, notification)
+		received = append(received, notification)
+	}))
+	defer server.Close()
+
+	config := NewConfig()
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	// nothing is queued unless configured
+	created, err := GetMissingDailyArchives(ctx, db, now, orgs[1], RunType)
+	assert.NoError(t, err)
+	assert.NoError(t, createArchives(ctx, db, config, s3Client, orgs[1], created))
+	assertCount(t, db, 0, `SELECT count(*) FROM archiver_rapidpro_notifications`)
+
+	// dailies aren't notified, only monthlies
+	config.RapidProNotifyURL = server.URL
+	config.RapidProNotifyToken = "sesame"
+	assert.NoError(t, QueueRapidProNotification(ctx, db, config, created[0]))
+	assertCount(t, db, 0, `SELECT count(*) FROM archiver_rapidpro_notifications`)
+
+	monthlies, err := RollupOrgArchives(ctx, now, config, db, s3Client, orgs[1], RunType)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(monthlies))
+
+	// our first notification failed and stays queued, our second succeeded
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, 1, len(received))
+	assert.Equal(t, &RapidProNotification{ArchiveID: monthlies[1].ID, OrgID: 2, ArchiveType: RunType, Period: MonthPeriod, StartDate: "2017-09-01"}, received[0])
+	assertCount(t, db, 1, `SELECT count(*) FROM archiver_rapidpro_notifications WHERE archive_id = $1 AND notified_on IS NULL`, monthlies[0].ID)
+	assertCount(t, db, 1, `SELECT count(*) FROM archiver_rapidpro_notifications WHERE archive_id = $1 AND notified_on IS NOT NULL`, monthlies[1].ID)
+
+	// the failed one is retried on our next run
+	NotifyRapidPro(ctx, config, db, orgs[1])
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, 2, len(received))
+	assert.Equal(t, monthlies[0].ID, received[1].ArchiveID)
+	assert.Equal(t, "2017-08-01", received[1].StartDate)
+	assertCount(t, db, 2, `SELECT count(*) FROM archiver_rapidpro_notifications WHERE notified_on IS NOT NULL`)
+
+	// after which there's nothing left to send
+	NotifyRapidPro(ctx, config, db, orgs[1])
+	assert.Equal(t, 3, calls)
+}
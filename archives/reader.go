@@ -0,0 +1,150 @@
+package archives
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// archiveCodec is a compression format archives may be written in, recognized by the magic bytes objects start with
+type archiveCodec struct {
+	name  string
+	magic []byte
+	open  func(io.Reader) (io.ReadCloser, error)
+}
+
+// the compression formats we can read archives in
+var archiveCodecs = []archiveCodec{
+	{name: "gzip", magic: []byte{0x1f, 0x8b}, open: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) }},
+}
+
+// ArchiveReader reads the records of an archive back from S3 one at a time, checking that the object it read has the
+// hash and size of its archive once it reaches the end
+type ArchiveReader struct {
+	archive    *Archive
+	body       io.ReadCloser
+	compressed io.Reader
+	hash       hash.Hash
+	read       *countingWriter
+	records    io.ReadCloser
+	lines      *bufio.Reader
+	line       []byte
+	count      int
+	err        error
+}
+
+// OpenArchive starts reading the records of the passed in archive from its object on S3, which must be closed. Errors
+// reading the object, such as it being in cold storage, are returned as is.
+func OpenArchive(ctx context.Context, s3Client Storage, archive *Archive) (*ArchiveReader, error) {
+	body, err := GetS3File(ctx, s3Client, archive.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &ArchiveReader{archive: archive, body: body, hash: md5.New(), read: &countingWriter{}}
+	compressed := bufio.NewReader(io.TeeReader(body, io.MultiWriter(r.hash, r.read)))
+	r.compressed = compressed
+
+	// an object with nothing in it isn't in any format we know
+	magic, _ := compressed.Peek(2)
+	for _, codec := range archiveCodecs {
+		if bytes.HasPrefix(magic, codec.magic) {
+			r.records, err = codec.open(compressed)
+			if err != nil {
+				body.Close()
+				return nil, errors.Wrapf(err, "error opening %s archive: %d", codec.name, archive.ID)
+			}
+			r.lines = bufio.NewReaderSize(r.records, 64*1024)
+			return r, nil
+		}
+	}
+
+	body.Close()
+	return nil, fmt.Errorf("archive: %d is in an unknown compression format", archive.ID)
+}
+
+// Next returns the next record of our archive, or io.EOF once we've read them all and checked our object. The final
+// record needn't end with a newline and blank lines are skipped. Once an error is returned it is always returned.
+func (r *ArchiveReader) Next() (json.RawMessage, error) {
+	for r.err == nil {
+		var line []byte
+		line, r.err = r.readLine()
+		if r.err == io.EOF {
+			r.err = r.verify()
+		}
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || isEmptyHeader(line) {
+			continue
+		}
+
+		if !json.Valid(line) {
+			r.err = fmt.Errorf("record %d of archive: %d is not valid JSON", r.count+1, r.archive.ID)
+			break
+		}
+
+		record := make(json.RawMessage, len(line))
+		copy(record, line)
+		r.count++
+		return record, nil
+	}
+	return nil, r.err
+}
+
+// readLine reads our next line, which may end at the end of our archive instead of with a newline
+func (r *ArchiveReader) readLine() ([]byte, error) {
+	r.line = r.line[:0]
+	for {
+		chunk, err := r.lines.ReadSlice('\n')
+		r.line = append(r.line, chunk...)
+		if len(r.line) > maxRecordSize {
+			return nil, fmt.Errorf("record %d of archive: %d is larger than %d bytes", r.count+1, r.archive.ID, maxRecordSize)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && err != io.EOF {
+			return nil, errors.Wrapf(err, "error reading archive: %d", r.archive.ID)
+		}
+		return r.line, err
+	}
+}
+
+// verify checks the object we read matches our archive, once we've read all our records
+func (r *ArchiveReader) verify() error {
+	// anything after our compressed records is part of our object too
+	_, err := io.Copy(ioutil.Discard, r.compressed)
+	if err != nil {
+		return errors.Wrapf(err, "error reading archive: %d", r.archive.ID)
+	}
+
+	hash := hex.EncodeToString(r.hash.Sum(nil))
+	if r.archive.Hash != "" && hash != r.archive.Hash {
+		return fmt.Errorf("archive: %d has hash: %s but its object has hash: %s", r.archive.ID, r.archive.Hash, hash)
+	}
+	if r.archive.Size != 0 && r.read.count != r.archive.Size {
+		return fmt.Errorf("archive: %d has size: %d but its object has size: %d", r.archive.ID, r.archive.Size, r.read.count)
+	}
+	return io.EOF
+}
+
+// Count returns the number of records we've read so far
+func (r *ArchiveReader) Count() int {
+	return r.count
+}
+
+// Close stops reading our archive
+func (r *ArchiveReader) Close() error {
+	r.records.Close()
+	return r.body.Close()
+}
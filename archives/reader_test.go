@@ -0,0 +1,139 @@
+package archives
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// putTestArchive gzips the passed in records into an object of our mock S3 and returns an archive of it
+func putTestArchive(s3Client *mockS3Client, key string, records string) *Archive {
+	b := &bytes.Buffer{}
+	w := gzip.NewWriter(b)
+	w.Write([]byte(records))
+	w.Close()
+
+	hash := md5.Sum(b.Bytes())
+	return &Archive{ID: 12, Size: int64(b.Len()), Hash: hex.EncodeToString(hash[:]), URL: s3Client.putObject("dl-archiver-test", key, b.Bytes())}
+}
+
+// readTestArchive reads all the records of the passed in archive, returning them and the error we stopped at
+func readTestArchive(t *testing.T, s3Client *mockS3Client, archive *Archive) ([]string, error) {
+	reader, err := OpenArchive(context.Background(), s3Client, archive)
+	assert.NoError(t, err)
+	defer reader.Close()
+
+	records := make([]string, 0)
+	for {
+		record, err := reader.Next()
+		if err != nil {
+			assert.Equal(t, len(records), reader.Count())
+			return records, err
+		}
+		records = append(records, string(record))
+	}
+}
+
+func TestOpenArchive(t *testing.T) {
+	s3Client := newMockS3Client()
+
+	// our golden archives read back exactly
+	for _, name := range []string{"messages1.jsonl", "messages2.jsonl", "runs1.jsonl", "runs2.jsonl", "runs3.jsonl"} {
+		golden, err := ioutil.ReadFile("./testdata/" + name)
+		assert.NoError(t, err)
+
+		archive := putTestArchive(s3Client, "/2/"+name+".gz", string(golden))
+		records, err := readTestArchive(t, s3Client, archive)
+		assert.Equal(t, io.EOF, err, "unexpected error reading %s", name)
+		assert.Equal(t, strings.Split(strings.TrimSpace(string(golden)), "\n"), records, "records mismatch for %s", name)
+	}
+
+	// our last record needn't end with a newline, blank lines and the header of empty archives are skipped
+	archive := putTestArchive(s3Client, "/2/nonewline.jsonl.gz", "{\"_archive\":{\"archive_type\":\"run\",\"version\":2}}\n{\"id\":1}\n\n{\"id\":2}")
+	records, err := readTestArchive(t, s3Client, archive)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, []string{`{"id":1}`, `{"id":2}`}, records)
+
+	// an empty archive has no records
+	empty, _ := EmptyArchive(NewConfig(), MessageType)
+	records, err = readTestArchive(t, s3Client, &Archive{ID: 13, URL: s3Client.putObject("dl-archiver-test", "/2/empty.jsonl.gz", empty)})
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 0, len(records))
+
+	// an object which doesn't match its archive is an error once we reach the end
+	archive = putTestArchive(s3Client, "/2/mismatched.jsonl.gz", "{\"id\":1}\n")
+	archive.Hash = "f0d79988b7772c003d04a28bd7417a62"
+	records, err = readTestArchive(t, s3Client, archive)
+	assert.EqualError(t, err, fmt.Sprintf("archive: 12 has hash: f0d79988b7772c003d04a28bd7417a62 but its object has hash: %s", strings.Trim(s3Client.objects["dl-archiver-test:/2/mismatched.jsonl.gz"].etag, `"`)))
+	assert.Equal(t, []string{`{"id":1}`}, records)
+
+	archive = putTestArchive(s3Client, "/2/truncated.jsonl.gz", "{\"id\":1}\n")
+	archive.Size++
+	_, err = readTestArchive(t, s3Client, archive)
+	assert.EqualError(t, err, fmt.Sprintf("archive: 12 has size: %d but its object has size: %d", archive.Size, archive.Size-1))
+
+	// as are records which aren't JSON or are too big, and any error is returned from then on
+	archive = putTestArchive(s3Client, "/2/invalid.jsonl.gz", "{\"id\":1}\n{\"id\":\n{\"id\":3}\n")
+	records, err = readTestArchive(t, s3Client, archive)
+	assert.EqualError(t, err, "record 2 of archive: 12 is not valid JSON")
+	assert.Equal(t, 1, len(records))
+
+	archive = putTestArchive(s3Client, "/2/huge.jsonl.gz", "{\"id\":1}\n{\"text\":\""+strings.Repeat("a", maxRecordSize)+"\"}\n")
+	records, err = readTestArchive(t, s3Client, archive)
+	assert.EqualError(t, err, fmt.Sprintf("record 2 of archive: 12 is larger than %d bytes", maxRecordSize))
+	assert.Equal(t, 1, len(records))
+
+	// objects which aren't compressed in a format we know can't be opened
+	archive = &Archive{ID: 14, URL: s3Client.putObject("dl-archiver-test", "/2/plain.jsonl", []byte("{\"id\":1}\n"))}
+	_, err = OpenArchive(context.Background(), s3Client, archive)
+	assert.EqualError(t, err, "archive: 14 is in an unknown compression format")
+
+	// nor can objects which don't exist
+	archive = &Archive{ID: 15, URL: "https://dl-archiver-test.s3.amazonaws.com/2/missing.jsonl.gz"}
+	_, err = OpenArchive(context.Background(), s3Client, archive)
+	assert.True(t, isNotFound(err))
+}
+
+func ExampleOpenArchive() {
+	s3Client := newMockS3Client()
+	archive := putTestArchive(s3Client, "/2/message_D20170812_hash.jsonl.gz", "{\"id\":1,\"text\":\"hi\"}\n{\"id\":2,\"text\":\"bye\"}\n")
+
+	reader, err := OpenArchive(context.Background(), s3Client, archive)
+	if err != nil {
+		panic(err)
+	}
+	defer reader.Close()
+
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			panic(err)
+		}
+
+		msg := struct {
+			ID   int    `json:"id"`
+			Text string `json:"text"`
+		}{}
+		json.Unmarshal(record, &msg)
+		fmt.Println(msg.ID, msg.Text)
+	}
+	fmt.Println(reader.Count(), "records")
+
+	// Output:
+	// 1 hi
+	// 2 bye
+	// 2 records
+}
@@ -0,0 +1,310 @@
+package archives
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ArchiveSchemaVersion is the version of the record format we currently write. Bump this when the format of archived
+// records changes and older archives will be progressively rebuilt by ReArchiveOrg.
+//
+//  1. the original format
+//  2. message contacts of anon orgs no longer include their name
+const ArchiveSchemaVersion = 2
+
+// ReArchiveResult is the outcome of re-archiving the outdated archives of an org
+type ReArchiveResult struct {
+	// Rebuilt are the archives which were rebuilt and are now at our current version
+	Rebuilt []*Archive
+
+	// Skipped are the archives which can't be rebuilt because their records have already been deleted
+	Skipped []*Archive
+
+	// Remaining is the number of archives left for a later run because we ran out of time
+	Remaining int
+
+	// Superseded are the URLs of the previous objects of rebuilt archives which we deleted
+	Superseded []string
+}
+
+// reArchiveFailpoint is called after each step of re-archiving, tests use it to simulate us dying between steps
+var reArchiveFailpoint = func(step string) error { return nil }
+
+const lookupOutdatedArchives = `
+SELECT a.id, a.org_id, a.start_date::timestamp with time zone as start_date, a.period, a.archive_type, a.hash, a.size, a.record_count, a.url, a.rollup_id, a.needs_deletion, COALESCE(v.version, 1) as version
+FROM archives_archive a LEFT JOIN archiver_archive_versions v ON v.archive_id = a.id
+WHERE a.org_id = $1 AND a.archive_type = $2 AND COALESCE(v.version, 1) < $3
+ORDER BY a.start_date asc, a.period desc
+`
+
+// GetOutdatedArchives returns all the archives for the passed in org and record type which were built with a record
+// format older than our current version
+func GetOutdatedArchives(ctx context.Context, db *sqlx.DB, org Org, archiveType ArchiveType) ([]*Archive, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	archives := make([]*Archive, 0, 1)
+	err := db.SelectContext(ctx, &archives, lookupOutdatedArchives, org.ID, archiveType, ArchiveSchemaVersion)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, errors.Wrapf(err, "error selecting outdated archives for org: %d and type: %s", org.ID, archiveType)
+	}
+
+	for _, a := range archives {
+		a.Org = org
+	}
+
+	return archives, nil
+}
+
+// ReArchiveOrg rebuilds the archives of the passed in org which were built with an older record format, stopping once
+// the passed in deadline has passed. Archives whose records still exist are rebuilt from the database, re-uploaded and
+// updated in place. Monthly rollups are rebuilt last, once all their dailies are current. As each rebuilt archive is
+// marked with our current version, progress carries over to the next run.
+func ReArchiveOrg(ctx context.Context, deadline time.Time, config *Config, db *sqlx.DB, s3Client Storage, org Org, archiveType ArchiveType) (*ReArchiveResult, error) {
+	if !config.UploadToS3 {
+		return nil, fmt.Errorf("re-archiving requires uploading to s3")
+	}
+
+	log := logrus.WithFields(logrus.Fields{
+		"org":          org.Name,
+		"org_id":       org.ID,
+		"archive_type": archiveType,
+	})
+
+	outdated, err := GetOutdatedArchives(ctx, db, org, archiveType)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ReArchiveResult{}
+
+	// dailies we haven't rebuilt yet, any rollups covering them must wait for a later run
+	pending := make([]*Archive, 0)
+	monthlies := make([]*Archive, 0)
+
+	for _, a := range outdated {
+		// monthlies may be rollups of our dailies so they are rebuilt last
+		if a.Period == MonthPeriod {
+			monthlies = append(monthlies, a)
+			continue
+		}
+
+		if !a.NeedsDeletion {
+			log.WithField("archive_id", a.ID).WithField("start_date", a.StartDate).Warn("skipping re-archive, records already deleted")
+			result.Skipped = append(result.Skipped, a)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			result.Remaining++
+			pending = append(pending, a)
+			continue
+		}
+
+		rebuilt, superseded, err := reArchive(ctx, db, config, s3Client, a, func(rebuilt *Archive) error {
+			return CreateArchiveFile(ctx, db, config, rebuilt, config.TempDir)
+		})
+		if err != nil {
+			log.WithError(err).WithField("archive_id", a.ID).Error("error re-archiving")
+			pending = append(pending, a)
+			continue
+		}
+		result.add(rebuilt, superseded)
+	}
+
+	for _, monthly := range monthlies {
+		if time.Now().After(deadline) {
+			result.Remaining++
+			continue
+		}
+
+		// records which haven't been deleted yet are rebuilt from the database like our dailies
+		if monthly.NeedsDeletion {
+			rebuilt, superseded, err := reArchive(ctx, db, config, s3Client, monthly, func(rebuilt *Archive) error {
+				return CreateArchiveFile(ctx, db, config, rebuilt, config.TempDir)
+			})
+			if err != nil {
+				log.WithError(err).WithField("archive_id", monthly.ID).Error("error re-archiving")
+				continue
+			}
+			result.add(rebuilt, superseded)
+			continue
+		}
+
+		// otherwise we can only rebuild it as a rollup, which requires all its dailies to be current
+		if containsDaily(result.Skipped, monthly) {
+			log.WithField("archive_id", monthly.ID).WithField("start_date", monthly.StartDate).Warn("skipping re-archive, daily records already deleted")
+			result.Skipped = append(result.Skipped, monthly)
+			continue
+		}
+		if containsDaily(pending, monthly) {
+			result.Remaining++
+			continue
+		}
+
+		rebuilt, superseded, err := reArchive(ctx, db, config, s3Client, monthly, func(rebuilt *Archive) error {
+			return BuildRollupArchive(ctx, db, config, s3Client, rebuilt, time.Now(), org, archiveType)
+		})
+		if err != nil {
+			log.WithError(err).WithField("archive_id", monthly.ID).Error("error re-archiving rollup")
+			continue
+		}
+		result.add(rebuilt, superseded)
+	}
+
+	if len(result.Rebuilt) > 0 || len(result.Skipped) > 0 || result.Remaining > 0 {
+		log.WithFields(logrus.Fields{
+			"rebuilt":    len(result.Rebuilt),
+			"skipped":    len(result.Skipped),
+			"remaining":  result.Remaining,
+			"superseded": len(result.Superseded),
+		}).Info("completed re-archive for org")
+	}
+
+	return result, nil
+}
+
+func (r *ReArchiveResult) add(rebuilt *Archive, superseded string) {
+	r.Rebuilt = append(r.Rebuilt, rebuilt)
+	if superseded != "" {
+		r.Superseded = append(r.Superseded, superseded)
+	}
+}
+
+// reArchive rebuilds the passed in archive using the passed in build function, uploads it and updates its existing
+// row. Our new object is uploaded and our row updated to point at it before the previous object is deleted, so our row
+// never points at a missing object, dying in between at worst leaves the previous object behind. If we fail to update
+// our row, our new object is deleted instead. Returns the URL of the previous object if it was deleted.
+func reArchive(ctx context.Context, db *sqlx.DB, config *Config, s3Client Storage, existing *Archive, build func(*Archive) error) (*Archive, string, error) {
+	rebuilt := &Archive{
+		ID:          existing.ID,
+		Org:         existing.Org,
+		OrgID:       existing.OrgID,
+		ArchiveType: existing.ArchiveType,
+		StartDate:   existing.StartDate,
+		Period:      existing.Period,
+		Rollup:      existing.Rollup,
+	}
+
+	err := build(rebuilt)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "error writing archive file")
+	}
+
+	defer func() {
+		if !config.KeepFiles {
+			err := DeleteArchiveFile(rebuilt)
+			if err != nil {
+				logrus.WithError(err).Error("error deleting temporary archive file")
+			}
+		}
+	}()
+
+	// a rollup can't be any newer than the dailies it was built from
+	if rebuilt.Version < ArchiveSchemaVersion {
+		return nil, "", fmt.Errorf("rebuilt archive is still outdated, version: %d", rebuilt.Version)
+	}
+
+	if rebuilt.RecordCount != existing.RecordCount {
+		logrus.WithFields(logrus.Fields{
+			"archive_id":   existing.ID,
+			"record_count": rebuilt.RecordCount,
+			"previous":     existing.RecordCount,
+		}).Warn("re-archived record count differs from previous archive")
+	}
+
+	err = UploadArchive(ctx, config, s3Client, config.S3Bucket, rebuilt)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "error writing archive to s3")
+	}
+	if err := reArchiveFailpoint("uploaded"); err != nil {
+		return nil, "", err
+	}
+
+	// re-archiving never changes whether our records still need deleting
+	rebuilt.NeedsDeletion = existing.NeedsDeletion
+
+	err = WriteArchiveToDB(ctx, db, rebuilt)
+	if err != nil {
+		removeUnwrittenObject(ctx, db, s3Client, existing, rebuilt)
+		return nil, "", errors.Wrap(err, "error writing record to db")
+	}
+	if err := reArchiveFailpoint("written"); err != nil {
+		return nil, "", err
+	}
+
+	// nothing points at our previous object anymore, unless it's shared by empty dailies
+	if existing.URL == "" || existing.URL == rebuilt.URL || strings.Contains(existing.URL, emptyArchivePrefix) {
+		return rebuilt, "", nil
+	}
+
+	err = deleteArchiveObject(ctx, s3Client, existing.URL)
+	if err != nil {
+		logrus.WithError(err).WithField("archive_id", existing.ID).WithField("url", existing.URL).Error("error deleting superseded archive object")
+		return rebuilt, "", nil
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"archive_id": existing.ID,
+		"url":        rebuilt.URL,
+		"superseded": existing.URL,
+	}).Info("deleted superseded archive object")
+
+	return rebuilt, existing.URL, nil
+}
+
+const lookupArchiveURL = `SELECT url FROM archives_archive WHERE id = $1`
+
+// removeUnwrittenObject deletes the new object of the passed in rebuilt archive after we failed to point its row at it,
+// so it isn't left behind. A failed commit may still have gone through, so we only do so if its row really doesn't
+// point at it, and never if it's the object our row already pointed at or one shared by empty dailies.
+func removeUnwrittenObject(ctx context.Context, db *sqlx.DB, s3Client Storage, existing *Archive, rebuilt *Archive) {
+	log := logrus.WithField("archive_id", existing.ID).WithField("url", rebuilt.URL)
+
+	if rebuilt.URL == "" || rebuilt.URL == existing.URL || strings.Contains(rebuilt.URL, emptyArchivePrefix) {
+		return
+	}
+
+	var current string
+	err := db.GetContext(ctx, &current, lookupArchiveURL, existing.ID)
+	if err != nil {
+		log.WithError(err).Error("error looking up archive, leaving its unwritten archive object behind")
+		return
+	}
+	if current == rebuilt.URL {
+		return
+	}
+
+	err = deleteArchiveObject(ctx, s3Client, rebuilt.URL)
+	if err != nil {
+		log.WithError(err).Error("error deleting unwritten archive object")
+		return
+	}
+	log.Info("deleted unwritten archive object")
+}
+
+// deleteArchiveObject deletes the S3 object at the passed in archive URL
+func deleteArchiveObject(ctx context.Context, s3Client Storage, archiveURL string) error {
+	bucket, key, err := s3Client.SplitURL(archiveURL)
+	if err != nil {
+		return err
+	}
+	return s3Client.Delete(ctx, bucket, []string{key})[key]
+}
+
+// containsDaily returns whether the passed in archives include a daily within the passed in monthly
+func containsDaily(archives []*Archive, monthly *Archive) bool {
+	for _, a := range archives {
+		if a.Period == DayPeriod && !a.StartDate.Before(monthly.StartDate) && a.StartDate.Before(monthly.EndDate()) {
+			return true
+		}
+	}
+	return false
+}
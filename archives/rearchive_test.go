@@ -0,0 +1,249 @@
+package archives
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReArchiveOrg(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+
+	config := NewConfig()
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+	deadline := time.Now().Add(time.Hour)
+
+	// our fixture archive has no records to rebuild from, treat it as current
+	_, err = db.Exec(`INSERT INTO archiver_archive_versions(archive_id, version) SELECT id, $1 FROM archives_archive WHERE org_id = 2`, ArchiveSchemaVersion)
+	assert.NoError(t, err)
+
+	// build our dailies and roll them up into august and september
+	created, err := CreateOrgArchives(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 61, len(created))
+
+	monthlies, err := RollupOrgArchives(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(monthlies))
+	assertCount(t, db, 64, `SELECT count(*) FROM archiver_archive_versions WHERE version = $1`, ArchiveSchemaVersion)
+
+	// everything is current, nothing to do
+	result, err := ReArchiveOrg(ctx, deadline, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(result.Rebuilt))
+	assert.Equal(t, 0, len(result.Skipped))
+
+	// pretend our format changed, with the records of one august daily and both monthlies already deleted
+	_, err = db.Exec(`UPDATE archiver_archive_versions SET version = 0 WHERE archive_id IN (SELECT id FROM archives_archive WHERE url != '')`)
+	assert.NoError(t, err)
+	_, err = db.Exec(`UPDATE archives_archive SET needs_deletion = FALSE WHERE org_id = 2 AND (start_date = '2017-08-13' OR period = 'M')`)
+	assert.NoError(t, err)
+
+	// can't re-archive without uploading
+	config.UploadToS3 = false
+	_, err = ReArchiveOrg(ctx, deadline, config, db, s3Client, orgs[1], MessageType)
+	assert.EqualError(t, err, "re-archiving requires uploading to s3")
+	config.UploadToS3 = true
+
+	// with no time left we only find what we can't rebuild
+	result, err = ReArchiveOrg(ctx, time.Now().Add(-time.Minute), config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(result.Rebuilt))
+	assert.Equal(t, 1, len(result.Skipped))
+	assert.Equal(t, 62, result.Remaining)
+
+	result, err = ReArchiveOrg(ctx, deadline, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 61, len(result.Rebuilt))
+	assert.Equal(t, 0, result.Remaining)
+
+	// august can't be rolled up again since one of its dailies can't be rebuilt
+	assert.Equal(t, 2, len(result.Skipped))
+	assert.Equal(t, time.Date(2017, 8, 13, 0, 0, 0, 0, time.UTC), result.Skipped[0].StartDate)
+	assert.Equal(t, time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC), result.Skipped[1].StartDate)
+	assert.Equal(t, MonthPeriod, result.Skipped[1].Period)
+
+	// our rebuilt dailies are identical and updated in place
+	assert.Equal(t, created[2].ID, result.Rebuilt[2].ID)
+	assert.Equal(t, 3, result.Rebuilt[2].RecordCount)
+	assert.Equal(t, "6fe9265860425cf1f9757ba3d91b1a05", result.Rebuilt[2].Hash)
+	assert.True(t, result.Rebuilt[2].NeedsDeletion)
+	assert.Equal(t, created[2].URL, result.Rebuilt[2].URL)
+	assert.Equal(t, 0, len(result.Superseded))
+
+	// with september rolled up again last
+	september := result.Rebuilt[60]
+	assert.Equal(t, monthlies[1].ID, september.ID)
+	assert.Equal(t, MonthPeriod, september.Period)
+	assert.Equal(t, 30, len(september.Dailies))
+	assert.False(t, september.NeedsDeletion)
+
+	assertCount(t, db, 62, `SELECT count(*) FROM archiver_archive_versions WHERE version = $1`, ArchiveSchemaVersion)
+	assertCount(t, db, 62, `SELECT count(*) FROM archives_archive WHERE org_id = 2 AND archive_type = 'message' AND period = 'D'`)
+	assertCount(t, db, 2, `SELECT count(*) FROM archives_archive WHERE org_id = 2 AND archive_type = 'message' AND period = 'M'`)
+}
+
+func TestReArchiveSwap(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+	defer func() { reArchiveFailpoint = func(string) error { return nil } }()
+
+	config := NewConfig()
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	created, err := CreateOrgArchives(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+
+	// pretend our 08-12 daily was built differently so its rebuilt object ends up under a new key
+	daily := created[2]
+	newURL := daily.URL
+	oldURL := s3Client.putObject("dl-archiver-test", "/2/message_D20170812_old.jsonl.gz", []byte("old"))
+	_, err = db.Exec(`UPDATE archives_archive SET url = $2 WHERE id = $1`, daily.ID, oldURL)
+	assert.NoError(t, err)
+	newKey := "dl-archiver-test:" + strings.TrimPrefix(newURL, "https://dl-archiver-test.s3.amazonaws.com")
+	delete(s3Client.objects, newKey)
+	daily.URL = oldURL
+
+	rebuild := func() (*Archive, string, error) {
+		return reArchive(ctx, db, config, s3Client, daily, func(rebuilt *Archive) error {
+			return CreateArchiveFile(ctx, db, config, rebuilt, config.TempDir)
+		})
+	}
+	failAt := func(step string) {
+		reArchiveFailpoint = func(s string) error {
+			if s == step {
+				return errors.New("crashed")
+			}
+			return nil
+		}
+	}
+
+	// dying after our upload leaves our row pointing at our old object
+	failAt("uploaded")
+	_, _, err = rebuild()
+	assert.EqualError(t, err, "crashed")
+	assertCount(t, db, 1, `SELECT count(*) FROM archives_archive WHERE id = $1 AND url = $2`, daily.ID, oldURL)
+	assert.Contains(t, s3Client.objects, "dl-archiver-test:/2/message_D20170812_old.jsonl.gz")
+	assert.Contains(t, s3Client.objects, newKey)
+
+	// failing to write our row leaves it pointing at our old object, and our new one is deleted
+	_, err = db.Exec(`ALTER TABLE archiver_archive_versions RENAME TO archiver_archive_versions_renamed`)
+	assert.NoError(t, err)
+	failAt("")
+	_, _, err = rebuild()
+	assert.Error(t, err)
+	assertCount(t, db, 1, `SELECT count(*) FROM archives_archive WHERE id = $1 AND url = $2`, daily.ID, oldURL)
+	assert.Contains(t, s3Client.objects, "dl-archiver-test:/2/message_D20170812_old.jsonl.gz")
+	assert.NotContains(t, s3Client.objects, newKey)
+	_, err = db.Exec(`ALTER TABLE archiver_archive_versions_renamed RENAME TO archiver_archive_versions`)
+	assert.NoError(t, err)
+
+	// dying after our db write leaves our row pointing at our new object, with our old one left behind
+	failAt("written")
+	_, _, err = rebuild()
+	assert.EqualError(t, err, "crashed")
+	assertCount(t, db, 1, `SELECT count(*) FROM archives_archive WHERE id = $1 AND url = $2`, daily.ID, newURL)
+	assert.Contains(t, s3Client.objects, "dl-archiver-test:/2/message_D20170812_old.jsonl.gz")
+	assert.Contains(t, s3Client.objects, newKey)
+
+	// otherwise our old object is deleted once nothing points at it
+	failAt("")
+	rebuilt, superseded, err := rebuild()
+	assert.NoError(t, err)
+	assert.Equal(t, newURL, rebuilt.URL)
+	assert.Equal(t, oldURL, superseded)
+	assertCount(t, db, 1, `SELECT count(*) FROM archives_archive WHERE id = $1 AND url = $2`, daily.ID, newURL)
+	assert.NotContains(t, s3Client.objects, "dl-archiver-test:/2/message_D20170812_old.jsonl.gz")
+	assert.Contains(t, s3Client.objects, newKey)
+
+	// shared empty objects are never deleted
+	emptyURL := s3Client.putObject("dl-archiver-test", "/empty/hash.jsonl.gz", []byte(""))
+	daily.URL = emptyURL
+	_, superseded, err = rebuild()
+	assert.NoError(t, err)
+	assert.Equal(t, "", superseded)
+	assert.Contains(t, s3Client.objects, "dl-archiver-test:/empty/hash.jsonl.gz")
+}
+
+func TestReArchiveVersionBump(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+
+	config := NewConfig()
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+	deadline := time.Now().Add(time.Hour)
+
+	// our fixture archives have no records to rebuild from, treat them as current
+	_, err = db.Exec(`INSERT INTO archiver_archive_versions(archive_id, version) SELECT id, $1 FROM archives_archive WHERE org_id = 3`, ArchiveSchemaVersion)
+	assert.NoError(t, err)
+
+	created, err := CreateOrgArchives(ctx, now, config, db, s3Client, orgs[2], MessageType)
+	assert.NoError(t, err)
+	var daily *Archive
+	for _, a := range created {
+		if a.StartDate.Equal(time.Date(2017, 8, 11, 0, 0, 0, 0, time.UTC)) {
+			daily = a
+		}
+	}
+	assert.NotNil(t, daily)
+	assert.Equal(t, 1, daily.RecordCount)
+
+	// pretend our daily of this anon org was built at version 1, when the contacts of messages were still named
+	v1 := &bytes.Buffer{}
+	writer := gzip.NewWriter(v1)
+	writer.Write([]byte(`{"id":5,"contact":{"uuid":"7051dff0-0a27-49d7-af1f-4494239139e6","name":"Joanne Stone"}}` + "\n"))
+	writer.Close()
+	v1URL := s3Client.putObject("dl-archiver-test", "/3/message_D20170811_v1.jsonl.gz", v1.Bytes())
+	currentKey := "dl-archiver-test:" + strings.TrimPrefix(daily.URL, "https://dl-archiver-test.s3.amazonaws.com")
+	delete(s3Client.objects, currentKey)
+
+	_, err = db.Exec(`UPDATE archives_archive SET url = $2 WHERE id = $1`, daily.ID, v1URL)
+	assert.NoError(t, err)
+	_, err = db.Exec(`DELETE FROM archiver_archive_versions WHERE archive_id = $1`, daily.ID)
+	assert.NoError(t, err)
+
+	outdated, err := GetOutdatedArchives(ctx, db, orgs[2], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(outdated))
+	assert.Equal(t, 1, outdated[0].Version)
+
+	// it's rebuilt at our current version under a new key, and its version 1 object deleted
+	result, err := ReArchiveOrg(ctx, deadline, config, db, s3Client, orgs[2], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(result.Rebuilt))
+	assert.Equal(t, daily.ID, result.Rebuilt[0].ID)
+	assert.Equal(t, daily.URL, result.Rebuilt[0].URL)
+	assert.Equal(t, []string{v1URL}, result.Superseded)
+	assert.NotContains(t, s3Client.objects, "dl-archiver-test:/3/message_D20170811_v1.jsonl.gz")
+	assertCount(t, db, 1, `SELECT count(*) FROM archives_archive WHERE id = $1 AND url = $2`, daily.ID, daily.URL)
+	assertCount(t, db, 1, `SELECT count(*) FROM archiver_archive_versions WHERE archive_id = $1 AND version = $2`, daily.ID, ArchiveSchemaVersion)
+
+	// without the name of its contact
+	reader, err := gzip.NewReader(bytes.NewReader(s3Client.objects[currentKey].body))
+	assert.NoError(t, err)
+	msg := make(map[string]interface{})
+	assert.NoError(t, json.NewDecoder(reader).Decode(&msg))
+	assert.Equal(t, map[string]interface{}{"uuid": "7051dff0-0a27-49d7-af1f-4494239139e6"}, msg["contact"])
+
+	// and nothing is left to do
+	result, err = ReArchiveOrg(ctx, deadline, config, db, s3Client, orgs[2], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(result.Rebuilt))
+}
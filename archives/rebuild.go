@@ -0,0 +1,288 @@
+package archives
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// RebuildResult is the outcome of rebuilding a daily and the monthly it was rolled up into
+type RebuildResult struct {
+	Daily   *Archive
+	Monthly *Archive
+
+	OldDailyHash   string
+	NewDailyHash   string
+	OldMonthlyHash string
+	NewMonthlyHash string
+
+	// DryRun is whether we only built our daily without uploading or recording anything
+	DryRun bool
+}
+
+const lookupOrgMonthlyArchive = `
+SELECT a.id, a.org_id, a.start_date::timestamp with time zone as start_date, a.period, a.archive_type, a.hash, a.size, a.record_count, a.url, a.rollup_id, a.needs_deletion, COALESCE(v.version, 1) as version
+FROM archives_archive a LEFT JOIN archiver_archive_versions v ON v.archive_id = a.id
+WHERE a.org_id = $1 AND a.archive_type = $2 AND a.period = 'M' AND a.start_date = $3
+`
+
+// getMonthlyArchive returns the monthly archive of the passed in org and type starting at the passed in date, if any
+func getMonthlyArchive(ctx context.Context, db *sqlx.DB, org Org, archiveType ArchiveType, startDate time.Time) (*Archive, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	monthly := &Archive{}
+	err := db.GetContext(ctx, monthly, lookupOrgMonthlyArchive, org.ID, archiveType, startDate)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error selecting monthly archive for org: %d and type: %s", org.ID, archiveType)
+	}
+	monthly.Org = org
+	return monthly, nil
+}
+
+// RebuildDayAndMonth rebuilds the daily archive of the passed in org and type for the passed in date from our database,
+// then rebuilds the monthly it was rolled up into, if any, from its dailies and verifies it. Both are updated in place.
+// This is what we do when a single daily turns out to be wrong. With RebuildDryRun set, the daily is only built
+// locally so its hash can be compared.
+func RebuildDayAndMonth(ctx context.Context, db *sqlx.DB, config *Config, s3Client Storage, org Org, date time.Time, archiveType ArchiveType) (*RebuildResult, error) {
+	err := checkCanRebuild(ctx, db, config)
+	if err != nil {
+		return nil, err
+	}
+
+	day := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+	month := time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	log := logrus.WithFields(logrus.Fields{
+		"org_id":       org.ID,
+		"archive_type": archiveType,
+		"date":         day.Format("2006-01-02"),
+	})
+
+	dailies, err := GetDailyArchivesForDateRange(ctx, db, org, archiveType, day, day)
+	if err != nil {
+		return nil, err
+	}
+	if len(dailies) != 1 {
+		return nil, fmt.Errorf("no daily archive for org: %d and type: %s on: %s", org.ID, archiveType, day.Format("2006-01-02"))
+	}
+	daily := dailies[0]
+	daily.Org = org
+
+	// once our records are deleted there's nothing to rebuild from
+	if !daily.NeedsDeletion {
+		return nil, fmt.Errorf("records of daily archive: %d already deleted, can't rebuild", daily.ID)
+	}
+
+	monthly, err := getMonthlyArchive(ctx, db, org, archiveType, month)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := rebuildDaily(ctx, db, config, s3Client, daily)
+	if err != nil {
+		return nil, err
+	}
+	if monthly != nil {
+		result.OldMonthlyHash = monthly.Hash
+	}
+
+	if config.RebuildDryRun {
+		log.WithFields(logrus.Fields{"old_hash": result.OldDailyHash, "new_hash": result.NewDailyHash, "record_count": result.Daily.RecordCount}).Info("dry run of daily rebuild")
+		return result, nil
+	}
+
+	if monthly == nil {
+		log.WithFields(logrus.Fields{"old_hash": result.OldDailyHash, "new_hash": result.NewDailyHash}).Info("rebuilt daily, no monthly to rebuild")
+		return result, nil
+	}
+
+	result.Monthly, err = rebuildMonthly(ctx, db, config, s3Client, org, monthly)
+	if err != nil {
+		return nil, err
+	}
+	result.NewMonthlyHash = result.Monthly.Hash
+
+	log.WithFields(logrus.Fields{
+		"old_daily_hash":   result.OldDailyHash,
+		"new_daily_hash":   result.NewDailyHash,
+		"old_monthly_hash": result.OldMonthlyHash,
+		"new_monthly_hash": result.NewMonthlyHash,
+	}).Info("rebuilt daily and monthly")
+
+	return result, nil
+}
+
+// checkCanRebuild returns an error if we can't rebuild archives with the passed in config right now
+func checkCanRebuild(ctx context.Context, db *sqlx.DB, config *Config) error {
+	if !config.UploadToS3 && !config.RebuildDryRun {
+		return fmt.Errorf("rebuilding requires uploading to s3")
+	}
+
+	// our writes are safe to race with an archiver which is running, but it may rebuild or delete what we're rebuilding
+	if !config.RebuildDryRun && !config.RebuildForce {
+		err := CheckDaemonIdle(ctx, db, time.Now())
+		if err != nil {
+			return errors.Wrap(err, "refusing to rebuild without rebuild-force")
+		}
+	}
+	return nil
+}
+
+// rebuildDaily rebuilds the passed in daily from our database in place, or with RebuildDryRun set only builds it
+// locally, returning the result without any monthly
+func rebuildDaily(ctx context.Context, db *sqlx.DB, config *Config, s3Client Storage, daily *Archive) (*RebuildResult, error) {
+	result := &RebuildResult{OldDailyHash: daily.Hash, DryRun: config.RebuildDryRun}
+
+	if config.RebuildDryRun {
+		built := &Archive{Org: daily.Org, OrgID: daily.Org.ID, ArchiveType: daily.ArchiveType, StartDate: daily.StartDate, Period: DayPeriod}
+		err := CreateArchiveFile(ctx, db, config, built, config.TempDir)
+		if err != nil {
+			return nil, errors.Wrap(err, "error writing archive file")
+		}
+		DeleteArchiveFile(built)
+
+		result.Daily = built
+		result.NewDailyHash = built.Hash
+		return result, nil
+	}
+
+	var err error
+	result.Daily, _, err = reArchive(ctx, db, config, s3Client, daily, func(rebuilt *Archive) error {
+		return CreateArchiveFile(ctx, db, config, rebuilt, config.TempDir)
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error rebuilding daily archive: %d", daily.ID)
+	}
+	result.NewDailyHash = result.Daily.Hash
+	return result, nil
+}
+
+// rebuildMonthly rebuilds the passed in monthly from its dailies in place, then verifies it is uploaded intact and
+// accounts for every record of its dailies
+func rebuildMonthly(ctx context.Context, db *sqlx.DB, config *Config, s3Client Storage, org Org, monthly *Archive) (*Archive, error) {
+	rebuilt, _, err := reArchive(ctx, db, config, s3Client, monthly, func(rebuilt *Archive) error {
+		return BuildRollupArchive(ctx, db, config, s3Client, rebuilt, time.Now(), org, monthly.ArchiveType)
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error rebuilding monthly archive: %d", monthly.ID)
+	}
+
+	err = VerifyS3Archive(ctx, s3Client, rebuilt)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error verifying monthly archive: %d", monthly.ID)
+	}
+
+	dailies, err := GetDailyArchivesForDateRange(ctx, db, org, monthly.ArchiveType, monthly.StartDate, monthly.EndDate().Add(time.Nanosecond*-1))
+	if err != nil {
+		return nil, err
+	}
+	dailyCount := 0
+	for _, d := range dailies {
+		dailyCount += d.RecordCount
+	}
+	if dailyCount != rebuilt.RecordCount {
+		return nil, fmt.Errorf("monthly archive: %d has %d records but its dailies have %d", monthly.ID, rebuilt.RecordCount, dailyCount)
+	}
+
+	return rebuilt, nil
+}
+
+const lookupUndeletedDailyArchives = `
+SELECT a.id, a.org_id, a.start_date::timestamp with time zone as start_date, a.period, a.archive_type, a.hash, a.size, a.record_count, a.url, a.rollup_id, a.needs_deletion, COALESCE(v.version, 1) as version
+FROM archives_archive a LEFT JOIN archiver_archive_versions v ON v.archive_id = a.id
+WHERE a.org_id = $1 AND a.archive_type = $2 AND a.period = 'D' AND a.start_date BETWEEN $3 AND $4 AND a.needs_deletion = TRUE
+AND NOT EXISTS (
+	SELECT 1 FROM archives_archive m WHERE m.org_id = a.org_id AND m.archive_type = a.archive_type AND m.period = 'M'
+	AND m.start_date = date_trunc('month', a.start_date)::date AND m.deleted_on IS NOT NULL
+)
+ORDER BY a.start_date asc
+`
+
+// GetUndeletedDailyArchives returns the daily archives of the passed in org and type between the passed in dates,
+// inclusive, whose records haven't been deleted, either by the daily itself or by the monthly it was rolled up into.
+// These are the only dailies which can be rebuilt from our database.
+func GetUndeletedDailyArchives(ctx context.Context, db *sqlx.DB, org Org, archiveType ArchiveType, startDate time.Time, endDate time.Time) ([]*Archive, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	dailies := make([]*Archive, 0, 1)
+	err := db.SelectContext(ctx, &dailies, lookupUndeletedDailyArchives, org.ID, archiveType, startDate, endDate)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, errors.Wrapf(err, "error selecting undeleted daily archives for org: %d and type: %s", org.ID, archiveType)
+	}
+
+	for _, d := range dailies {
+		d.Org = org
+	}
+	return dailies, nil
+}
+
+// RebuildDays rebuilds the daily archives of the passed in org and type between the passed in dates, inclusive, from
+// our database, skipping those whose records have been deleted, then rebuilds each monthly they were rolled up into
+// once. Results are in the order of the dailies, the rebuilt monthly of each month is on the result of its last daily.
+func RebuildDays(ctx context.Context, db *sqlx.DB, config *Config, s3Client Storage, org Org, startDate time.Time, endDate time.Time, archiveType ArchiveType) ([]*RebuildResult, error) {
+	if endDate.Before(startDate) {
+		return nil, fmt.Errorf("rebuild end date: %s is before start date: %s", endDate.Format("2006-01-02"), startDate.Format("2006-01-02"))
+	}
+
+	err := checkCanRebuild(ctx, db, config)
+	if err != nil {
+		return nil, err
+	}
+
+	dailies, err := GetUndeletedDailyArchives(ctx, db, org, archiveType, startDate, endDate)
+	if err != nil {
+		return nil, err
+	}
+
+	log := logrus.WithFields(logrus.Fields{
+		"org_id":       org.ID,
+		"archive_type": archiveType,
+		"start_date":   startDate.Format("2006-01-02"),
+		"end_date":     endDate.Format("2006-01-02"),
+	})
+	log.WithField("dailies", len(dailies)).Info("rebuilding days whose records haven't been deleted")
+
+	results := make([]*RebuildResult, 0, len(dailies))
+	for i, daily := range dailies {
+		result, err := rebuildDaily(ctx, db, config, s3Client, daily)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, result)
+
+		// each monthly only needs rebuilding once, after the last of its dailies
+		lastOfMonth := i == len(dailies)-1 || dailies[i+1].StartDate.Month() != daily.StartDate.Month()
+		if config.RebuildDryRun || !lastOfMonth {
+			continue
+		}
+
+		month := time.Date(daily.StartDate.Year(), daily.StartDate.Month(), 1, 0, 0, 0, 0, time.UTC)
+		monthly, err := getMonthlyArchive(ctx, db, org, archiveType, month)
+		if err != nil {
+			return results, err
+		}
+		if monthly == nil {
+			continue
+		}
+
+		result.OldMonthlyHash = monthly.Hash
+		result.Monthly, err = rebuildMonthly(ctx, db, config, s3Client, org, monthly)
+		if err != nil {
+			return results, err
+		}
+		result.NewMonthlyHash = result.Monthly.Hash
+	}
+
+	log.WithFields(logrus.Fields{"dailies": len(results), "dry_run": config.RebuildDryRun}).Info("rebuilt days")
+	return results, nil
+}
@@ -0,0 +1,144 @@
+package archives
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRebuildDayAndMonth(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+	defer func() { reArchiveFailpoint = func(string) error { return nil } }()
+
+	config := NewConfig()
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+	day := time.Date(2017, 8, 12, 0, 0, 0, 0, time.UTC)
+
+	created, err := GetMissingDailyArchives(ctx, db, now, orgs[1], RunType)
+	assert.NoError(t, err)
+	assert.NoError(t, createArchives(ctx, db, config, s3Client, orgs[1], created))
+	monthlies, err := RollupOrgArchives(ctx, now, config, db, s3Client, orgs[1], RunType)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(monthlies))
+	assert.Equal(t, 3, monthlies[0].RecordCount)
+
+	// a run arrives late, after the daily it belongs to was built and rolled up
+	_, err = db.Exec(`INSERT INTO flows_flowrun(id, uuid, responded, contact_id, flow_id, org_id, results, path, events, created_on, modified_on, exited_on, status, exit_type)
+	VALUES(9, '0f1d4b2e-8a3c-4e7b-9d6f-2c5a8b1e3f70', TRUE, 6, 1, 2, '{}', '[]', '[]', '2017-08-12 12:00:00+00', '2017-08-12 12:00:00+00', '2017-08-12 12:00:00+00', 'C', 'C')`)
+	assert.NoError(t, err)
+
+	// no daily to rebuild
+	_, err = RebuildDayAndMonth(ctx, db, config, s3Client, orgs[1], time.Date(2017, 12, 1, 0, 0, 0, 0, time.UTC), RunType)
+	assert.EqualError(t, err, "no daily archive for org: 2 and type: run on: 2017-12-01")
+
+	// a failed daily rebuild leaves our monthly alone
+	reArchiveFailpoint = func(step string) error { return errors.New("upload failed") }
+	_, err = RebuildDayAndMonth(ctx, db, config, s3Client, orgs[1], day, RunType)
+	assert.Error(t, err)
+	reArchiveFailpoint = func(string) error { return nil }
+	assertCount(t, db, 2, `SELECT record_count FROM archives_archive WHERE id = $1`, created[2].ID)
+	assertCount(t, db, 1, `SELECT count(*) FROM archives_archive WHERE id = $1 AND hash = $2`, monthlies[0].ID, monthlies[0].Hash)
+
+	// a dry run only tells us what our daily would become
+	config.RebuildDryRun = true
+	result, err := RebuildDayAndMonth(ctx, db, config, s3Client, orgs[1], day.Add(time.Hour*5), RunType)
+	assert.NoError(t, err)
+	assert.True(t, result.DryRun)
+	assert.Equal(t, created[2].Hash, result.OldDailyHash)
+	assert.NotEqual(t, created[2].Hash, result.NewDailyHash)
+	assert.Equal(t, monthlies[0].Hash, result.OldMonthlyHash)
+	assert.Equal(t, "", result.NewMonthlyHash)
+	assertCount(t, db, 2, `SELECT record_count FROM archives_archive WHERE id = $1`, created[2].ID)
+	config.RebuildDryRun = false
+
+	// we won't rebuild while an archiver is running unless forced
+	stopHeartbeat := StartHeartbeat(db)
+	defer stopHeartbeat()
+
+	_, err = RebuildDayAndMonth(ctx, db, config, s3Client, orgs[1], day, RunType)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "refusing to rebuild without rebuild-force: archiver is running, last heartbeat at")
+	assertCount(t, db, 2, `SELECT record_count FROM archives_archive WHERE id = $1`, created[2].ID)
+
+	config.RebuildForce = true
+	result, err = RebuildDayAndMonth(ctx, db, config, s3Client, orgs[1], day, RunType)
+	assert.NoError(t, err)
+	assert.Equal(t, created[2].ID, result.Daily.ID)
+	assert.Equal(t, 3, result.Daily.RecordCount)
+	assert.NotEqual(t, result.OldDailyHash, result.NewDailyHash)
+	assert.Equal(t, monthlies[0].ID, result.Monthly.ID)
+	assert.Equal(t, 4, result.Monthly.RecordCount)
+	assert.Equal(t, monthlies[0].Hash, result.OldMonthlyHash)
+	assert.NotEqual(t, result.OldMonthlyHash, result.NewMonthlyHash)
+
+	// both updated in place
+	assertCount(t, db, 1, `SELECT count(*) FROM archives_archive WHERE id = $1 AND record_count = 3 AND hash = $2`, created[2].ID, result.NewDailyHash)
+	assertCount(t, db, 1, `SELECT count(*) FROM archives_archive WHERE id = $1 AND record_count = 4 AND hash = $2`, monthlies[0].ID, result.NewMonthlyHash)
+	assertCount(t, db, 62, `SELECT count(*) FROM archives_archive WHERE org_id = 2 AND archive_type = 'run' AND period = 'D'`)
+	assertCount(t, db, 2, `SELECT count(*) FROM archives_archive WHERE org_id = 2 AND archive_type = 'run' AND period = 'M'`)
+}
+
+func TestRebuildDays(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+
+	config := NewConfig()
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	created, err := GetMissingDailyArchives(ctx, db, now, orgs[1], RunType)
+	assert.NoError(t, err)
+	assert.NoError(t, createArchives(ctx, db, config, s3Client, orgs[1], created))
+	monthlies, err := RollupOrgArchives(ctx, now, config, db, s3Client, orgs[1], RunType)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(monthlies))
+
+	// august was deleted via its monthly and a single day of september via its daily
+	_, err = db.Exec(`UPDATE archives_archive SET needs_deletion = FALSE, deleted_on = NOW() WHERE id = $1`, monthlies[0].ID)
+	assert.NoError(t, err)
+	_, err = db.Exec(`UPDATE archives_archive SET needs_deletion = FALSE, deleted_on = NOW() WHERE org_id = 2 AND archive_type = 'run' AND period = 'D' AND start_date = '2017-09-03'`)
+	assert.NoError(t, err)
+
+	start := time.Date(2017, 8, 10, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2017, 9, 5, 0, 0, 0, 0, time.UTC)
+
+	undeleted, err := GetUndeletedDailyArchives(ctx, db, orgs[1], RunType, start, end)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(undeleted))
+	assert.Equal(t, time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC), undeleted[0].StartDate.In(time.UTC))
+	assert.Equal(t, time.Date(2017, 9, 4, 0, 0, 0, 0, time.UTC), undeleted[2].StartDate.In(time.UTC))
+
+	_, err = RebuildDays(ctx, db, config, s3Client, orgs[1], end, start, RunType)
+	assert.EqualError(t, err, "rebuild end date: 2017-08-10 is before start date: 2017-09-05")
+
+	// a dry run only builds our dailies
+	config.RebuildDryRun = true
+	results, err := RebuildDays(ctx, db, config, s3Client, orgs[1], start, end, RunType)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(results))
+	assert.Nil(t, results[3].Monthly)
+	config.RebuildDryRun = false
+
+	results, err = RebuildDays(ctx, db, config, s3Client, orgs[1], start, end, RunType)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(results))
+	assert.Equal(t, undeleted[0].ID, results[0].Daily.ID)
+	assert.Nil(t, results[0].Monthly)
+
+	// september is rebuilt once, after its last daily
+	assert.Equal(t, monthlies[1].ID, results[3].Monthly.ID)
+	assert.Equal(t, monthlies[1].Hash, results[3].OldMonthlyHash)
+
+	// nothing new was created
+	assertCount(t, db, 62, `SELECT count(*) FROM archives_archive WHERE org_id = 2 AND archive_type = 'run' AND period = 'D'`)
+	assertCount(t, db, 2, `SELECT count(*) FROM archives_archive WHERE org_id = 2 AND archive_type = 'run' AND period = 'M'`)
+}
@@ -0,0 +1,132 @@
+package archives
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// the largest archive with no records there can be, an empty gzip stream written by older versions of Go
+const maxEmptyArchiveSize = 23
+
+// archives migrated from older deployments were sometimes recorded without their record counts, these are the ones we
+// didn't build ourselves, as we always record a version for those, which have no record count but have records
+const lookupUncountedArchives = `
+SELECT a.id FROM archives_archive a
+WHERE a.id = ANY($1) AND a.record_count = 0 AND a.size > $2 AND a.url != ''
+AND NOT EXISTS (SELECT 1 FROM archiver_archive_versions v WHERE v.archive_id = a.id)
+ORDER BY a.start_date, a.period DESC
+`
+
+const updateUncountedArchive = `
+UPDATE archives_archive SET record_count = $2 WHERE id = $1 AND record_count = 0
+`
+
+// the number of archives we may still reconcile the record counts of this run
+var countReconciles = struct {
+	sync.Mutex
+	remaining int
+}{}
+
+// ResetCountReconciles allows MaxCountReconciles more archives to have their record counts reconciled, called at the
+// start of each run
+func ResetCountReconciles(config *Config) {
+	countReconciles.Lock()
+	countReconciles.remaining = config.MaxCountReconciles
+	countReconciles.Unlock()
+}
+
+// takeCountReconcile returns whether we may reconcile the record count of another archive this run, using it up
+func takeCountReconcile() bool {
+	countReconciles.Lock()
+	defer countReconciles.Unlock()
+
+	if countReconciles.remaining <= 0 {
+		return false
+	}
+	countReconciles.remaining--
+	return true
+}
+
+// reconcileRecordCounts counts the records in the objects of those of the passed in archives which were recorded
+// without record counts, up to what remains of our limit for this run, and corrects their counts so that their records
+// can be deleted. Archives which can't be read keep their counts, they fail deletion as they would have anyway.
+func reconcileRecordCounts(ctx context.Context, db *sqlx.DB, s3Client Storage, archives []*Archive) ([]*Archive, error) {
+	ids := make([]int, len(archives))
+	byID := make(map[int]*Archive, len(archives))
+	for i, a := range archives {
+		ids[i] = a.ID
+		byID[a.ID] = a
+	}
+
+	uncounted := make([]int, 0)
+	err := db.SelectContext(ctx, &uncounted, lookupUncountedArchives, pq.Array(ids), maxEmptyArchiveSize)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up archives without record counts")
+	}
+
+	reconciled := make([]*Archive, 0, len(uncounted))
+	for i, id := range uncounted {
+		if !takeCountReconcile() {
+			logrus.WithField("remaining", len(uncounted)-i).Warn("reconciled as many record counts as allowed this run")
+			break
+		}
+
+		archive := byID[id]
+		log := logrus.WithFields(logrus.Fields{
+			"archive_id":   archive.ID,
+			"org_id":       archive.OrgID,
+			"archive_type": archive.ArchiveType,
+			"start_date":   archive.StartDate,
+			"period":       archive.Period,
+			"size":         archive.Size,
+		})
+
+		count, err := countArchiveObjectRecords(ctx, s3Client, archive)
+		if err != nil {
+			log.WithError(err).Error("error counting records of archive without record count")
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, time.Minute)
+		_, err = db.ExecContext(ctx, updateUncountedArchive, archive.ID, count)
+		cancel()
+		if err != nil {
+			return reconciled, errors.Wrapf(err, "error updating record count of archive: %d", archive.ID)
+		}
+
+		log.WithField("record_count", count).Warn("corrected record count of archive")
+		archive.RecordCount = count
+		reconciled = append(reconciled, archive)
+	}
+
+	return reconciled, nil
+}
+
+// countArchiveObjectRecords reads all the records of the passed in archive from S3, returning how many it has
+func countArchiveObjectRecords(ctx context.Context, s3Client Storage, archive *Archive) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Hour)
+	defer cancel()
+
+	reader, err := OpenArchive(ctx, s3Client, archive)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	for {
+		_, err := reader.Next()
+		if err == io.EOF {
+			return reader.Count(), nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
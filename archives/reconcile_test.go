@@ -0,0 +1,87 @@
+package archives
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconcileRecordCounts(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+
+	config := NewConfig()
+	config.Delete = true
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	// archives migrated from an older deployment with their records on S3 but no record counts
+	migrate := func(day string, records int) int {
+		body := &bytes.Buffer{}
+		writer := gzip.NewWriter(body)
+		for i := 0; i < records; i++ {
+			fmt.Fprintf(writer, "{\"id\":%d}\n", i+1)
+		}
+		writer.Close()
+
+		hash := md5.Sum(body.Bytes())
+		url := s3Client.putObject("dl-archiver-test", fmt.Sprintf("/2/message_D%s_%x.jsonl.gz", day, hash), body.Bytes())
+
+		var id int
+		err := db.Get(&id, `INSERT INTO archives_archive(archive_type, created_on, start_date, period, record_count, size, hash, url, needs_deletion, build_time, org_id)
+		VALUES('message', NOW(), $1, 'D', 0, $2, $3, $4, TRUE, 0, 2) RETURNING id`, day, body.Len(), hex.EncodeToString(hash[:]), url)
+		assert.NoError(t, err)
+		return id
+	}
+	aug12 := migrate("20170812", 3)
+	aug13 := migrate("20170813", 1)
+
+	// without reconciling, our counts are wrong so nothing can be deleted
+	ResetCountReconciles(config)
+	deleted, err := DeleteArchivedOrgRecords(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(deleted))
+	assertCount(t, db, 4, `SELECT count(*) FROM msgs_msg WHERE org_id = 2 AND created_on >= '2017-08-12' AND created_on < '2017-08-14' AND visibility != 'D'`)
+
+	// we only reconcile as many as we're allowed each run, the earliest first
+	config.MaxCountReconciles = 1
+	ResetCountReconciles(config)
+	deleted, err = DeleteArchivedOrgRecords(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(deleted))
+	assert.Equal(t, aug12, deleted[0].ID)
+	assert.Equal(t, 3, deleted[0].RecordCount)
+	assertCount(t, db, 1, `SELECT count(*) FROM archives_archive WHERE id = $1 AND record_count = 3 AND needs_deletion = FALSE`, aug12)
+	assertCount(t, db, 1, `SELECT count(*) FROM archives_archive WHERE id = $1 AND record_count = 0 AND needs_deletion = TRUE`, aug13)
+	assertCount(t, db, 0, `SELECT count(*) FROM msgs_msg WHERE org_id = 2 AND created_on >= '2017-08-12' AND created_on < '2017-08-13'`)
+
+	// until our next run
+	deleted, err = DeleteArchivedOrgRecords(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(deleted))
+
+	ResetCountReconciles(config)
+	deleted, err = DeleteArchivedOrgRecords(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(deleted))
+	assertCount(t, db, 1, `SELECT count(*) FROM archives_archive WHERE id = $1 AND record_count = 1 AND needs_deletion = FALSE`, aug13)
+
+	// archives we built ourselves always have their counts so are never counted again
+	ResetCountReconciles(config)
+	aug14 := migrate("20170814", 2)
+	_, err = db.Exec(`INSERT INTO archiver_archive_versions(archive_id, version) VALUES($1, 2)`, aug14)
+	assert.NoError(t, err)
+	deleted, err = DeleteArchivedOrgRecords(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(deleted))
+	assertCount(t, db, 1, `SELECT count(*) FROM archives_archive WHERE id = $1 AND record_count = 0`, aug14)
+}
@@ -0,0 +1,248 @@
+package archives
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Phase is a phase of archiving an org
+type Phase string
+
+const (
+	// PhaseCreate is when we build and upload missing archives
+	PhaseCreate = Phase("create")
+
+	// PhaseRollup is when we build monthly archives from dailies
+	PhaseRollup = Phase("rollup")
+
+	// PhaseDelete is when we delete archived records
+	PhaseDelete = Phase("delete")
+)
+
+// PhaseError is an error which occurred during a particular phase of archiving an org
+type PhaseError struct {
+	Phase   Phase
+	Archive *Archive
+	Err     error
+}
+
+func (e *PhaseError) Error() string {
+	return e.Err.Error()
+}
+
+// Failure is a single failure recorded in a run report
+type Failure struct {
+	OrgID       int         `json:"org_id,omitempty"`
+	OrgName     string      `json:"org_name,omitempty"`
+	ArchiveType ArchiveType `json:"archive_type,omitempty"`
+	StartDate   *time.Time  `json:"start_date,omitempty"`
+	Period      string      `json:"period,omitempty"`
+	Phase       Phase       `json:"phase,omitempty"`
+	Error       string      `json:"error"`
+	FailedOn    time.Time   `json:"failed_on"`
+}
+
+// NewFailure creates a new failure for the passed in org and error, pulling the phase and archive from the error if
+// it is a PhaseError
+func NewFailure(org Org, archiveType ArchiveType, err error) *Failure {
+	failure := &Failure{
+		OrgID:       org.ID,
+		OrgName:     org.Name,
+		ArchiveType: archiveType,
+		Error:       err.Error(),
+		FailedOn:    time.Now().In(time.UTC),
+	}
+
+	if pe, ok := err.(*PhaseError); ok {
+		failure.Phase = pe.Phase
+		if pe.Archive != nil {
+			startDate := pe.Archive.StartDate
+			failure.StartDate = &startDate
+			failure.Period = string(pe.Archive.Period)
+		}
+	}
+	return failure
+}
+
+// RunReport is a machine readable summary of an archiver run, written when running with ExitOnCompletion so that
+// failures can be investigated after the logs are gone
+type RunReport struct {
+	Status            string                 `json:"status"`
+	StartedOn         time.Time              `json:"started_on"`
+	FinishedOn        time.Time              `json:"finished_on"`
+	Failures          []*Failure             `json:"failures,omitempty"`
+	ConfigFingerprint string                 `json:"config_fingerprint"`
+	Config            map[string]interface{} `json:"config"`
+}
+
+const (
+	// RunFailed is the status of a run that had at least one failure
+	RunFailed = "failed"
+
+	// RunCompleted is the status of a run with no failures
+	RunCompleted = "completed"
+)
+
+// NewRunReport creates a new run report for a run that started at the passed in time
+func NewRunReport(config *Config, startedOn time.Time, failures []*Failure) *RunReport {
+	status := RunCompleted
+	if len(failures) > 0 {
+		status = RunFailed
+	}
+
+	masked := maskedConfig(config)
+	encoded, _ := json.Marshal(masked)
+	fingerprint := sha256.Sum256(encoded)
+
+	return &RunReport{
+		Status:            status,
+		StartedOn:         startedOn.In(time.UTC),
+		FinishedOn:        time.Now().In(time.UTC),
+		Failures:          failures,
+		ConfigFingerprint: hex.EncodeToString(fingerprint[:8]),
+		Config:            masked,
+	}
+}
+
+// maskedConfig returns our config as a map with any secrets masked
+func maskedConfig(config *Config) map[string]interface{} {
+	encoded, _ := json.Marshal(config)
+	masked := make(map[string]interface{})
+	json.Unmarshal(encoded, &masked)
+	return masked
+}
+
+// matches the password of a key/value connection string, quoted or not
+var dsnPasswordRegex = regexp.MustCompile(`(\bpassword\s*=\s*)('(?:[^'\\]|\\.)*'|\S+)`)
+
+// maskURLPassword masks the password portion of the passed in URL, or key/value connection string, if it has one
+func maskURLPassword(raw string) string {
+	if !strings.Contains(raw, "://") {
+		return dsnPasswordRegex.ReplaceAllString(raw, "${1}"+redactedSecret)
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return redactedSecret
+	}
+	_, hasPassword := u.User.Password()
+	query := u.Query()
+	if !hasPassword && query.Get("password") == "" {
+		return raw
+	}
+
+	if hasPassword {
+		u.User = url.UserPassword(u.User.Username(), redactedSecret)
+	}
+	if query.Get("password") != "" {
+		query.Set("password", redactedSecret)
+		u.RawQuery = query.Encode()
+	}
+	return strings.ReplaceAll(u.String(), "%2A%2A%2A%2A%2A%2A%2A%2A", redactedSecret)
+}
+
+const (
+	// the S3 prefix we write failure reports under
+	failureReportPrefix = "/failures/"
+
+	// the key of our success marker
+	successMarkerName = "last_success.json"
+)
+
+// WriteRunReport writes the passed in report to our configured report path. Failures are written to a new file named
+// by when the run started, successes overwrite our success marker. Reports are written under /failures/ in our bucket
+// if the report path is "s3", otherwise to the local directory it names. Returns where the report was written.
+func WriteRunReport(ctx context.Context, config *Config, s3Client Storage, report *RunReport) (string, error) {
+	if config.ReportPath == "" {
+		return "", fmt.Errorf("no report path configured")
+	}
+
+	encoded, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return "", errors.Wrapf(err, "error encoding run report")
+	}
+
+	name := successMarkerName
+	if report.Status == RunFailed {
+		name = fmt.Sprintf("failure_%s.json", report.StartedOn.Format("20060102T150405Z"))
+	}
+
+	if config.ReportPath == "s3" {
+		if s3Client == nil {
+			return "", fmt.Errorf("unable to write report to s3, no s3 client")
+		}
+
+		key := failureReportPrefix + name
+		reportURL, err := s3Client.PutObject(ctx, config.StorageBucket(), key, bytes.NewReader(encoded), int64(len(encoded)), "application/json", "")
+		if err != nil {
+			return "", errors.Wrapf(err, "error uploading run report")
+		}
+		return reportURL, nil
+	}
+
+	err = os.MkdirAll(config.ReportPath, 0700)
+	if err != nil {
+		return "", errors.Wrapf(err, "error creating report directory: %s", config.ReportPath)
+	}
+
+	filename := filepath.Join(config.ReportPath, name)
+	err = ioutil.WriteFile(filename, encoded, 0600)
+	if err != nil {
+		return "", errors.Wrapf(err, "error writing run report: %s", filename)
+	}
+	return filename, nil
+}
+
+// ReadLastSuccess reads the success marker written by our last successful run, returning nil if there isn't one
+func ReadLastSuccess(ctx context.Context, config *Config, s3Client Storage) (*RunReport, error) {
+	var encoded []byte
+
+	if config.ReportPath == "s3" {
+		if s3Client == nil {
+			return nil, fmt.Errorf("unable to read success marker from s3, no s3 client")
+		}
+
+		reader, err := GetS3File(ctx, s3Client, s3Client.URL(config.StorageBucket(), failureReportPrefix+successMarkerName))
+		if isNotFound(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading success marker")
+		}
+		defer reader.Close()
+
+		encoded, err = ioutil.ReadAll(reader)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading success marker")
+		}
+	} else {
+		var err error
+		encoded, err = ioutil.ReadFile(filepath.Join(config.ReportPath, successMarkerName))
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading success marker")
+		}
+	}
+
+	report := &RunReport{}
+	err := json.Unmarshal(encoded, report)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error decoding success marker")
+	}
+	return report, nil
+}
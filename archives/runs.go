@@ -3,23 +3,24 @@ package archives
 import (
 	"bufio"
 	"context"
+	"database/sql"
 	"fmt"
 	"time"
 
-	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
+// runs are written in order of our partition field, ties broken by id, so a rebuilt archive is always identical
 const lookupFlowRuns = `
-SELECT rec.exited_on, row_to_json(rec)
+SELECT rec.exited_on, rec.id, row_to_json(rec)
 FROM (
    SELECT
 	 fr.id as id,
 	 fr.uuid as uuid,
      row_to_json(flow_struct) AS flow,
-     row_to_json(contact_struct) AS contact,
+     CASE WHEN $6 THEN row_to_json(contact_fields_struct) ELSE row_to_json(contact_struct) END AS contact,
      fr.responded,
      (SELECT coalesce(jsonb_agg(path_data), '[]'::jsonb) from (
 		SELECT path_row ->> 'node_uuid' AS node, (path_row ->> 'arrived_on')::timestamptz as time
@@ -54,26 +55,112 @@ FROM (
      LEFT JOIN auth_user a ON a.id = fr.submitted_by_id
      JOIN LATERAL (SELECT uuid, name FROM flows_flow WHERE flows_flow.id = fr.flow_id) AS flow_struct ON True
      JOIN LATERAL (SELECT uuid, name FROM contacts_contact cc WHERE cc.id = fr.contact_id) AS contact_struct ON True
+     LEFT JOIN LATERAL (SELECT uuid, name, coalesce(fields, '{}'::jsonb) AS fields FROM contacts_contact cc WHERE $6 AND cc.id = fr.contact_id) AS contact_fields_struct ON True
    
-   WHERE fr.org_id = $2 AND fr.modified_on >= $3 AND fr.modified_on < $4
-   ORDER BY fr.modified_on ASC, id ASC
-) as rec;
+   WHERE fr.org_id = $2 AND fr.%[1]s >= $3 AND fr.%[1]s < $4 AND ($5 = 0 OR fr.contact_id IN (SELECT contact_id FROM contacts_contactgroup_contacts WHERE contactgroup_id = $5)) %[2]s
+) as rec
+ORDER BY rec.%[1]s ASC, rec.id ASC;
+`
+
+const (
+	// RunPartitionModifiedOn assigns runs to archives by when they were last modified
+	RunPartitionModifiedOn = "modified_on"
+
+	// RunPartitionCreatedOn assigns runs to archives by when they were created
+	RunPartitionCreatedOn = "created_on"
+)
+
+// the key in archiver_settings which records the partition field our run archives were built with
+const runPartitionSetting = "run_partition_field"
+
+// runPartitionField returns the validated run column used to assign runs to archives, this is used for writing,
+// counting and deleting runs, which must always agree with each other
+func runPartitionField(config *Config) (string, error) {
+	switch config.RunPartitionField {
+	case RunPartitionModifiedOn, RunPartitionCreatedOn:
+		return config.RunPartitionField, nil
+	case "":
+		return RunPartitionModifiedOn, nil
+	default:
+		return "", fmt.Errorf("invalid run partition field: %s, must be one of %s or %s", config.RunPartitionField, RunPartitionModifiedOn, RunPartitionCreatedOn)
+	}
+}
+
+const lookupRunArchiveExists = `
+SELECT EXISTS(SELECT 1 FROM archives_archive WHERE archive_type = 'run')
+`
+
+// CheckRunPartitionField verifies that the configured run partition field matches the one existing run archives were
+// built with. Changing it on a deployment with existing run archives could delete runs which were never archived, so
+// we refuse unless MigrateRunPartition is set.
+func CheckRunPartitionField(ctx context.Context, db *sqlx.DB, config *Config) error {
+	field, err := runPartitionField(config)
+	if err != nil {
+		return err
+	}
+
+	current, err := GetSetting(ctx, db, runPartitionSetting)
+	if err != nil {
+		return err
+	}
+
+	// nothing recorded, any existing run archives were built before this was configurable, ie, by modified_on
+	if current == "" {
+		var exists bool
+		err = db.GetContext(ctx, &exists, lookupRunArchiveExists)
+		if err != nil {
+			return errors.Wrapf(err, "error checking for existing run archives")
+		}
+		if exists {
+			current = RunPartitionModifiedOn
+		}
+	}
+
+	if current != "" && current != field {
+		if !config.MigrateRunPartition {
+			return fmt.Errorf("run archives were built using %s, refusing to switch to %s without migrate-run-partition", current, field)
+		}
+		logrus.WithField("previous", current).WithField("run_partition_field", field).Warn("migrating run partition field")
+	}
+
+	return SetSetting(ctx, db, runPartitionSetting, field)
+}
+
+const lookupEarliestRun = `
+SELECT MIN(fr.%[1]s) FROM flows_flowrun fr WHERE fr.org_id = $1 AND fr.%[1]s < $2
+`
+
+// runs which were too big to archive are left in place so are never counted
+const countRunsInRange = `
+SELECT count(*) FROM flows_flowrun fr WHERE fr.org_id = $1 AND fr.%[1]s >= $2 AND fr.%[1]s < $3
+AND NOT EXISTS (SELECT 1 FROM archiver_skipped_records s WHERE s.archive_type = 'run' AND s.record_id = fr.id) %[2]s
 `
 
 // writeRunRecords writes the runs in the archive's date range to the passed in writer
-func writeRunRecords(ctx context.Context, db *sqlx.DB, archive *Archive, writer *bufio.Writer) (int, error) {
+func writeRunRecords(ctx context.Context, db *sqlx.DB, config *Config, archive *Archive, writer *bufio.Writer) (int, error) {
+	field, err := runPartitionField(config)
+	if err != nil {
+		return 0, err
+	}
+
+	// contact fields are a snapshot from when we archive, never included for anon orgs
+	includeFields := config.IncludeContactFields && !archive.Org.IsAnon
+
 	var rows *sqlx.Rows
-	rows, err := db.QueryxContext(ctx, lookupFlowRuns, archive.Org.IsAnon, archive.Org.ID, archive.StartDate, archive.endDate())
+	rows, err = db.QueryxContext(ctx, fmt.Sprintf(lookupFlowRuns, field, extraFilterClause(config, RunType)), archive.Org.IsAnon, archive.Org.ID, archive.StartDate, archive.EndDate(), config.ContactGroupID, includeFields)
 	if err != nil {
 		return 0, errors.Wrapf(err, "error querying run records for org: %d", archive.Org.ID)
 	}
 	defer rows.Close()
 
 	recordCount := 0
+	summarizer := newSummarizer(config, RunType)
+	skipped := make([]skippedRecord, 0)
 	var record string
+	var runID int64
 	var exitedOn *time.Time
 	for rows.Next() {
-		err = rows.Scan(&exitedOn, &record)
+		err = rows.Scan(&exitedOn, &runID, &record)
 
 		// shouldn't be archiving an active run, that's an error
 		if exitedOn == nil {
@@ -84,11 +171,45 @@ func writeRunRecords(ctx context.Context, db *sqlx.DB, archive *Archive, writer
 			return 0, errors.Wrapf(err, "error scanning run record for org: %d", archive.Org.ID)
 		}
 
+		if config.FlattenRunResults {
+			record, err = flattenRunResults(record)
+			if err != nil {
+				return 0, errors.Wrapf(err, "error flattening results of run: %d", runID)
+			}
+		}
+
+		if config.CanonicalJSON {
+			record, err = canonicalizeRecord(record)
+			if err != nil {
+				return 0, errors.Wrapf(err, "error canonicalizing run: %d", runID)
+			}
+		}
+
+		// a single huge run would inflate or break our archive, we leave it in place for investigation instead
+		if config.MaxRecordBytes > 0 && len(record) > config.MaxRecordBytes {
+			skipped = append(skipped, skippedRecord{ID: runID, Size: len(record)})
+			continue
+		}
+
 		writer.WriteString(record)
 		writer.WriteString("\n")
+		summarizer.add(record)
 		recordCount++
 	}
 
+	// a dropped connection ends our iteration early, make sure we never treat that as a complete archive
+	err = rows.Err()
+	if err != nil {
+		return 0, errors.Wrapf(err, "error reading run rows for org: %d", archive.Org.ID)
+	}
+
+	err = recordSkippedRecords(ctx, db, archive, skipped)
+	if err != nil {
+		return 0, err
+	}
+
+	archive.Summary = summarizer.summary()
+
 	return recordCount, nil
 }
 
@@ -96,8 +217,9 @@ const selectOrgRunsInRange = `
 SELECT fr.id, fr.is_active
 FROM flows_flowrun fr
 LEFT JOIN contacts_contact cc ON cc.id = fr.contact_id
-WHERE fr.org_id = $1 AND fr.modified_on >= $2 AND fr.modified_on < $3
-ORDER BY fr.modified_on ASC, fr.id ASC
+WHERE fr.org_id = $1 AND fr.%[1]s >= $2 AND fr.%[1]s < $3
+AND NOT EXISTS (SELECT 1 FROM archiver_skipped_records s WHERE s.archive_type = 'run' AND s.record_id = fr.id) %[2]s
+ORDER BY fr.%[1]s ASC, fr.id ASC
 `
 
 const setRunDeleteReason = `
@@ -120,7 +242,7 @@ WHERE id IN(?)
 // all the runs in the archive date range, and if equal or fewer than the number archived, deletes them 100 at a time
 //
 // Upon completion it updates the needs_deletion flag on the archive
-func DeleteArchivedRuns(ctx context.Context, config *Config, db *sqlx.DB, s3Client s3iface.S3API, archive *Archive) error {
+func DeleteArchivedRuns(ctx context.Context, config *Config, db *sqlx.DB, s3Client Storage, archive *Archive) error {
 	outer, cancel := context.WithTimeout(ctx, time.Hour*3)
 	defer cancel()
 
@@ -129,25 +251,58 @@ func DeleteArchivedRuns(ctx context.Context, config *Config, db *sqlx.DB, s3Clie
 		"id":           archive.ID,
 		"org_id":       archive.OrgID,
 		"start_date":   archive.StartDate,
-		"end_date":     archive.endDate(),
+		"end_date":     archive.EndDate(),
 		"archive_type": archive.ArchiveType,
 		"total_count":  archive.RecordCount,
 	})
 	log.Info("deleting runs")
 
-	// first things first, make sure our file is present on S3
-	md5, err := GetS3FileETAG(outer, s3Client, archive.URL)
+	// first things first, make sure our file is present on S3 and matches what we archived, we never delete
+	// records that aren't backed by a valid archive
+	err := verifyArchive(outer, s3Client, archive)
+	if err != nil {
+		return errors.Wrap(err, "refusing to delete, archive not verified")
+	}
+
+	// ok, archive file looks good, in strict mode we delete exactly the runs in it, otherwise those in its period
+	if config.DeleteByArchiveContents {
+		err = deleteArchiveContents(outer, config, db, s3Client, archive, deleteExitedRunBatch)
+	} else {
+		err = deleteRunsInPeriod(outer, config, db, archive, log)
+	}
 	if err != nil {
 		return err
 	}
 
-	// if our etag and archive md5 don't match, that's an error, return
-	if md5 != archive.Hash {
-		return fmt.Errorf("archive md5: %s and s3 etag: %s do not match", archive.Hash, md5)
+	outer, cancel = context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	deletedOn := time.Now()
+
+	// all went well! mark our archive as no longer needing deletion
+	_, err = db.ExecContext(outer, setArchiveDeleted, archive.ID, deletedOn)
+	if err != nil {
+		return errors.Wrap(err, "error setting archive as deleted")
+	}
+	archive.NeedsDeletion = false
+	archive.DeletedOn = &deletedOn
+
+	logrus.WithField("elapsed", time.Since(start)).Info("completed deleting runs")
+
+	return nil
+}
+
+// deleteRunsInPeriod deletes the runs in the period of the passed in archive, if there are no more of them than the
+// archive has
+func deleteRunsInPeriod(ctx context.Context, config *Config, db *sqlx.DB, archive *Archive, log *logrus.Entry) error {
+	// runs must be selected using the same field they were archived by
+	field, err := runPartitionField(config)
+	if err != nil {
+		return err
 	}
 
-	// ok, archive file looks good, let's build up our list of run ids, this may be big but we are int64s so shouldn't be too big
-	rows, err := db.QueryxContext(outer, selectOrgRunsInRange, archive.OrgID, archive.StartDate, archive.endDate())
+	// build up our list of run ids, this may be big but we are int64s so shouldn't be too big
+	rows, err := db.QueryxContext(ctx, fmt.Sprintf(selectOrgRunsInRange, field, extraFilterClause(config, RunType)), archive.OrgID, archive.StartDate, archive.EndDate())
 	if err != nil {
 		return err
 	}
@@ -181,63 +336,80 @@ func DeleteArchivedRuns(ctx context.Context, config *Config, db *sqlx.DB, s3Clie
 		return fmt.Errorf("more runs in the database: %d than in archive: %d", runCount, archive.RecordCount)
 	}
 
-	// ok, delete our runs in batches, we do this in transactions as it spans a few different queries
+	// ok, delete our runs in batches
 	for _, idBatch := range chunkIDs(runIDs, deleteTransactionSize) {
-		// no single batch should take more than a few minutes
-		ctx, cancel := context.WithTimeout(ctx, time.Minute*15)
-		defer cancel()
-
-		start := time.Now()
-
-		// start our transaction
-		tx, err := db.BeginTxx(ctx, nil)
+		err = deleteRunBatch(ctx, db, idBatch)
 		if err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
-		// first update our delete_reason
-		err = executeInQuery(ctx, tx, setRunDeleteReason, idBatch)
-		if err != nil {
-			return errors.Wrap(err, "error updating delete reason")
-		}
+// deleteRunBatch deletes the passed in runs and everything attached to them, in a transaction as it spans a few
+// different queries
+func deleteRunBatch(ctx context.Context, db *sqlx.DB, idBatch []int64) error {
+	// no single batch should take more than a few minutes
+	ctx, cancel := context.WithTimeout(ctx, time.Minute*15)
+	defer cancel()
 
-		// any recent runs
-		err = executeInQuery(ctx, tx, deleteRecentRuns, idBatch)
-		if err != nil {
-			return errors.Wrap(err, "error deleting recent runs")
-		}
+	start := time.Now()
 
-		// finally, delete our runs
-		err = executeInQuery(ctx, tx, deleteRuns, idBatch)
-		if err != nil {
-			return errors.Wrap(err, "error deleting runs")
-		}
+	// start our transaction
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	// first update our delete_reason
+	err = executeInQuery(ctx, tx, setRunDeleteReason, idBatch)
+	if err != nil {
+		return errors.Wrap(err, "error updating delete reason")
+	}
 
-		// commit our transaction
-		err = tx.Commit()
+	// any recent runs
+	if tableExists("flows_flowpathrecentrun") {
+		err = executeInQuery(ctx, tx, deleteRecentRuns, idBatch)
 		if err != nil {
-			return errors.Wrap(err, "error committing run delete transaction")
+			return errors.Wrap(err, "error deleting recent runs")
 		}
+	}
 
-		log.WithField("elapsed", time.Since(start)).WithField("count", len(idBatch)).Debug("deleted batch of runs")
+	// finally, delete our runs
+	err = executeInQuery(ctx, tx, deleteRuns, idBatch)
+	if err != nil {
+		return errors.Wrap(err, "error deleting runs")
+	}
 
-		cancel()
+	// commit our transaction
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "error committing run delete transaction")
 	}
 
-	outer, cancel = context.WithTimeout(ctx, time.Minute)
-	defer cancel()
+	logrus.WithField("elapsed", time.Since(start)).WithField("count", len(idBatch)).Debug("deleted batch of runs")
+	return nil
+}
 
-	deletedOn := time.Now()
+const selectActiveRun = `
+SELECT id FROM flows_flowrun WHERE id IN(?) AND is_active = TRUE LIMIT 1
+`
 
-	// all went well! mark our archive as no longer needing deletion
-	_, err = db.ExecContext(outer, setArchiveDeleted, archive.ID, deletedOn)
+// deleteExitedRunBatch deletes the passed in runs like deleteRunBatch, but only if none of them are still active
+func deleteExitedRunBatch(ctx context.Context, db *sqlx.DB, idBatch []int64) error {
+	q, vs, err := sqlx.In(selectActiveRun, idBatch)
 	if err != nil {
-		return errors.Wrap(err, "error setting archive as deleted")
+		return err
 	}
-	archive.NeedsDeletion = false
-	archive.DeletedOn = &deletedOn
 
-	logrus.WithField("elapsed", time.Since(start)).Info("completed deleting runs")
+	var runID int64
+	err = db.GetContext(ctx, &runID, db.Rebind(q), vs...)
+	if err == nil {
+		return fmt.Errorf("run %d in archive is still active", runID)
+	}
+	if err != sql.ErrNoRows {
+		return errors.Wrap(err, "error checking for active runs")
+	}
 
-	return nil
+	return deleteRunBatch(ctx, db, idBatch)
 }
@@ -2,6 +2,7 @@ package archives
 
 import (
 	"context"
+	"crypto/md5"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
@@ -9,24 +10,58 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
-var s3BucketURL = "https://%s.s3.amazonaws.com%s"
+// the format of the URLs of objects in S3 buckets, which have their bucket as the first part of their host
+const s3BucketURL = "https://%s.s3.amazonaws.com%s"
+
+// the endpoint of S3 in the standard partition, which we resolve for our region instead if it's in another partition
+const defaultS3Endpoint = "https://s3.amazonaws.com"
+
+var readAfterWriteRetries = newCounter("archiver_s3_read_after_write_retries_total", "Number of reads of objects we just wrote retried as S3 didn't have them yet.")
+
+// how long after we write an object S3 saying it doesn't exist may only mean it hasn't caught up with our write
+const readAfterWriteWindow = time.Hour
+
+// the URLs of the objects we've written within our read after write window and when we wrote them
+var recentWrites = struct {
+	sync.Mutex
+	urls map[string]time.Time
+}{urls: make(map[string]time.Time)}
+
+// the largest archive we upload in a single request, larger ones are uploaded in parts
+const maxPutObjectSize = 5e9
+
+// S3Client is the Storage of archives in S3 or an S3 compatible service, an adapter of the parts of the S3 API we use
+type S3Client struct {
+	api       s3iface.S3API
+	bucketURL string
+}
 
 // NewS3Client creates a new s3 client from the passed in config, testing it as necessary
-func NewS3Client(config *Config) (s3iface.S3API, error) {
+func NewS3Client(config *Config) (Storage, error) {
+	endpoint, bucketURL, err := resolveS3Endpoint(config)
+	if err != nil {
+		return nil, err
+	}
+
 	s3Session, err := session.NewSession(&aws.Config{
 		Credentials:      credentials.NewStaticCredentials(config.AWSAccessKeyID, config.AWSSecretAccessKey, ""),
-		Endpoint:         aws.String(config.S3Endpoint),
+		Endpoint:         aws.String(endpoint),
 		Region:           aws.String(config.S3Region),
 		DisableSSL:       aws.Bool(config.S3DisableSSL),
 		S3ForcePathStyle: aws.Bool(config.S3ForcePathStyle),
@@ -48,7 +83,51 @@ func NewS3Client(config *Config) (s3iface.S3API, error) {
 	}
 
 	logrus.Info("s3 bucket ok")
-	return s3Client, nil
+	return newS3Client(s3Client, bucketURL), nil
+}
+
+func newS3Client(api s3iface.S3API, bucketURL string) *S3Client {
+	return &S3Client{api: api, bucketURL: bucketURL}
+}
+
+// resolveS3Endpoint checks our region is in our partition, if we configured one, and returns the endpoint we should use
+// for S3 and the format of the URLs of our objects. Our endpoint is used as configured unless it's the default and our
+// region is in a partition other than the standard one, such as GovCloud or China, when it's resolved by the SDK.
+func resolveS3Endpoint(config *Config) (string, string, error) {
+	partition, found := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), config.S3Region)
+
+	if config.S3Partition != "" {
+		known := false
+		for _, p := range endpoints.DefaultPartitions() {
+			known = known || p.ID() == config.S3Partition
+		}
+		if !known {
+			return "", "", fmt.Errorf("unknown S3 partition: %s", config.S3Partition)
+		}
+		if !found || partition.ID() != config.S3Partition {
+			return "", "", fmt.Errorf("S3 region: %s is not in S3 partition: %s", config.S3Region, config.S3Partition)
+		}
+	}
+
+	// regions we don't know may be of an S3 compatible service, and the standard partition is already our default
+	if config.S3Endpoint != defaultS3Endpoint || !found || partition.ID() == endpoints.AwsPartitionID {
+		return config.S3Endpoint, s3BucketURL, nil
+	}
+
+	resolved, err := partition.EndpointFor(s3.EndpointsID, config.S3Region, func(o *endpoints.Options) {
+		o.DisableSSL = config.S3DisableSSL
+	})
+	if err != nil {
+		return "", "", errors.Wrapf(err, "error resolving S3 endpoint for region: %s", config.S3Region)
+	}
+
+	u, err := url.Parse(resolved.URL)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "invalid S3 endpoint: %s", resolved.URL)
+	}
+
+	logrus.WithField("partition", partition.ID()).WithField("endpoint", resolved.URL).Info("resolved S3 endpoint")
+	return resolved.URL, u.Scheme + "://%s." + u.Host + "%s", nil
 }
 
 // TestS3 tests whether the passed in s3 client is properly configured and the passed in bucket is accessible
@@ -64,122 +143,548 @@ func TestS3(s3Client s3iface.S3API, bucket string) error {
 	return nil
 }
 
-// UploadToS3 writes the passed in archive
-func UploadToS3(ctx context.Context, s3Client s3iface.S3API, bucket string, path string, archive *Archive) error {
-	f, err := os.Open(archive.ArchiveFile)
-	if err != nil {
+// s3Error returns the storage error for the passed in S3 error, S3 saying a key doesn't exist in more than one way
+func s3Error(err error) error {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
 		return err
 	}
-	defer f.Close()
+	code := aerr.Code()
+	if code == s3.ErrCodeNoSuchKey || code == s3.ErrCodeNoSuchBucket {
+		code = errCodeNotFound
+	}
+	return &StorageError{Code: code, Message: aerr.Message()}
+}
+
+// URL returns the URL of the object with the passed in key in the passed in bucket
+func (c *S3Client) URL(bucket string, key string) string {
+	return fmt.Sprintf(c.bucketURL, bucket, key)
+}
+
+// SplitURL returns the bucket and key of the object at the passed in URL
+func (c *S3Client) SplitURL(fileURL string) (string, string, error) {
+	u, err := url.Parse(fileURL)
+	if err != nil {
+		return "", "", err
+	}
+	return strings.Split(u.Host, ".")[0], u.Path, nil
+}
+
+// readSeeker returns the passed in body as the io.ReadSeeker the S3 API wants, which it can't rewind to retry a
+// request if it isn't one already
+func readSeeker(body io.Reader) io.ReadSeeker {
+	if seeker, ok := body.(io.ReadSeeker); ok {
+		return seeker
+	}
+	return aws.ReadSeekCloser(body)
+}
 
-	url := fmt.Sprintf(s3BucketURL, bucket, path)
+// PutObject writes the passed in body to the passed in key, returning its URL
+func (c *S3Client) PutObject(ctx context.Context, bucket string, key string, body io.Reader, size int64, contentType string, contentEncoding string) (string, error) {
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(bucket),
+		Key:           aws.String(key),
+		Body:          readSeeker(body),
+		ContentLength: aws.Int64(size),
+		ContentType:   aws.String(contentType),
+		ACL:           aws.String(s3.BucketCannedACLPrivate),
+	}
+	if contentEncoding != "" {
+		input.ContentEncoding = aws.String(contentEncoding)
+	}
+
+	_, err := c.api.PutObjectWithContext(ctx, input)
+	if err != nil {
+		return "", s3Error(err)
+	}
+	return c.URL(bucket, key), nil
+}
 
+// GetObject returns the contents of the object at the passed in URL
+func (c *S3Client) GetObject(ctx context.Context, fileURL string) (io.ReadCloser, error) {
+	bucket, key, err := c.SplitURL(fileURL)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := c.api.GetObjectWithContext(
+		ctx,
+		&s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		},
+		withAcceptEncoding("gzip"),
+	)
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return output.Body, nil
+}
+
+// Download returns the contents of the archive at the passed in URL
+func (c *S3Client) Download(ctx context.Context, fileURL string) (io.ReadCloser, error) {
+	return c.GetObject(ctx, fileURL)
+}
+
+// Upload writes an archive to the passed in key, with its MD5 in its metadata as the ETAG of an archive uploaded in
+// parts isn't its MD5
+func (c *S3Client) Upload(ctx context.Context, bucket string, key string, body io.Reader, size int64, contentEncoding string, md5 string) (string, error) {
 	// s3 wants a base64 encoded hash instead of our hex encoded
-	hashBytes, _ := hex.DecodeString(archive.Hash)
-	md5 := base64.StdEncoding.EncodeToString(hashBytes)
+	hashBytes, err := hex.DecodeString(md5)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid md5: %s", md5)
+	}
+	encoded := base64.StdEncoding.EncodeToString(hashBytes)
 
 	// if this fits into a single part, upload that way
-	if archive.Size <= 5e9 {
-		params := &s3.PutObjectInput{
+	if size <= maxPutObjectSize {
+		_, err = c.api.PutObjectWithContext(ctx, &s3.PutObjectInput{
 			Bucket:          aws.String(bucket),
-			Body:            f,
-			Key:             aws.String(path),
+			Key:             aws.String(key),
+			Body:            readSeeker(body),
+			ContentLength:   aws.Int64(size),
 			ContentType:     aws.String("application/json"),
-			ContentEncoding: aws.String("gzip"),
+			ContentEncoding: aws.String(contentEncoding),
 			ACL:             aws.String(s3.BucketCannedACLPrivate),
-			ContentMD5:      aws.String(md5),
-			Metadata:        map[string]*string{"md5chksum": aws.String(md5)},
-		}
-		_, err = s3Client.PutObjectWithContext(ctx, params)
+			ContentMD5:      aws.String(encoded),
+			Metadata:        map[string]*string{"md5chksum": aws.String(encoded)},
+		})
 		if err != nil {
-			return err
-		}
-	} else {
-		// this file is bigger than 5 gigs, use an upload manager instead, it will take care of uploading in parts
-		uploader := s3manager.NewUploaderWithClient(
-			s3Client,
-			func(u *s3manager.Uploader) {
-				u.PartSize = 1e9 // 1 gig per part
-			},
-		)
-		params := &s3manager.UploadInput{
-			Bucket:          aws.String(bucket),
-			Key:             aws.String(path),
-			Body:            f,
-			ContentType:     aws.String("application/json"),
-			ContentEncoding: aws.String("gzip"),
-			ACL:             aws.String(s3.BucketCannedACLPrivate),
+			return "", s3Error(err)
+		}
+		return c.URL(bucket, key), nil
+	}
+
+	// this file is bigger than 5 gigs, use an upload manager instead, it will take care of uploading in parts
+	uploader := s3manager.NewUploaderWithClient(c.api, func(u *s3manager.Uploader) {
+		u.PartSize = 1e9 // 1 gig per part
+	})
+	_, err = uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(key),
+		Body:            body,
+		ContentType:     aws.String("application/json"),
+		ContentEncoding: aws.String(contentEncoding),
+		ACL:             aws.String(s3.BucketCannedACLPrivate),
+		Metadata:        map[string]*string{"md5chksum": aws.String(encoded)},
+	})
+	if err != nil {
+		return "", s3Error(err)
+	}
+	return c.URL(bucket, key), nil
+}
+
+// streamToS3 uploads everything read from the passed in reader to the passed in key, in parts as it is read
+var streamToS3 = func(ctx context.Context, s3Client s3iface.S3API, bucket string, key string, body io.Reader) error {
+	uploader := s3manager.NewUploaderWithClient(s3Client, func(u *s3manager.Uploader) {
+		u.PartSize = 64 * 1024 * 1024
+	})
+
+	_, err := uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(key),
+		Body:            body,
+		ContentType:     aws.String("application/json"),
+		ContentEncoding: aws.String("gzip"),
+		ACL:             aws.String(s3.BucketCannedACLPrivate),
+	})
+	return err
+}
+
+// UploadStream writes a gzipped archive to the passed in key in parts as it is read
+func (c *S3Client) UploadStream(ctx context.Context, bucket string, key string, body io.Reader) (string, error) {
+	err := streamToS3(ctx, c.api, bucket, key, body)
+	if err != nil {
+		return "", s3Error(err)
+	}
+	return c.URL(bucket, key), nil
+}
+
+// Stat returns the size, hash and storage class of the object at the passed in URL
+func (c *S3Client) Stat(ctx context.Context, fileURL string) (*ObjectInfo, error) {
+	bucket, key, err := c.SplitURL(fileURL)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := c.api.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+
+	// S3 leaves out the storage class of objects in the standard class
+	info := &ObjectInfo{
+		Key:          key,
+		Size:         aws.Int64Value(output.ContentLength),
+		MD5:          s3ObjectMD5(output.ETag, output.Metadata),
+		StorageClass: aws.StringValue(output.StorageClass),
+		Restored:     strings.Contains(aws.StringValue(output.Restore), `ongoing-request="false"`),
+	}
+	if info.StorageClass == "" {
+		info.StorageClass = s3.StorageClassStandard
+	}
+	return info, nil
+}
+
+// s3ObjectMD5 returns the hex encoded MD5 of an object from its ETAG, or for objects uploaded in parts whose ETAG
+// isn't their MD5, from the hash we stored in their metadata, an empty string if they don't have one
+func s3ObjectMD5(etag *string, metadata map[string]*string) string {
+	md5 := strings.Trim(aws.StringValue(etag), `"`)
+	if !strings.Contains(md5, "-") {
+		return md5
+	}
+
+	for k, v := range metadata {
+		if strings.EqualFold(k, "md5chksum") {
+			hashBytes, err := base64.StdEncoding.DecodeString(aws.StringValue(v))
+			if err != nil {
+				return ""
+			}
+			return hex.EncodeToString(hashBytes)
 		}
+	}
+	return ""
+}
+
+// Copy copies the object at the passed in URL to the passed in key of the same bucket, replacing its md5 metadata if
+// we have a hash for it
+func (c *S3Client) Copy(ctx context.Context, fileURL string, key string, md5 string) (string, error) {
+	bucket, source, err := c.SplitURL(fileURL)
+	if err != nil {
+		return "", err
+	}
 
-		_, err = uploader.UploadWithContext(ctx, params)
+	input := &s3.CopyObjectInput{
+		Bucket:     aws.String(bucket),
+		CopySource: aws.String(bucket + source),
+		Key:        aws.String(key),
+		ACL:        aws.String(s3.BucketCannedACLPrivate),
+	}
+	if md5 != "" {
+		hashBytes, err := hex.DecodeString(md5)
 		if err != nil {
-			return err
+			return "", errors.Wrapf(err, "invalid md5: %s", md5)
 		}
+		input.ContentType = aws.String("application/json")
+		input.ContentEncoding = aws.String("gzip")
+		input.MetadataDirective = aws.String(s3.MetadataDirectiveReplace)
+		input.Metadata = map[string]*string{"md5chksum": aws.String(base64.StdEncoding.EncodeToString(hashBytes))}
 	}
 
-	archive.URL = url
+	_, err = c.api.CopyObjectWithContext(ctx, input)
+	if err != nil {
+		return "", s3Error(err)
+	}
+	return c.URL(bucket, key), nil
+}
+
+// List returns the objects in the passed in bucket whose keys have the passed in prefix
+func (c *S3Client) List(ctx context.Context, bucket string, prefix string) ([]*ObjectInfo, error) {
+	objects := make([]*ObjectInfo, 0)
+	err := c.api.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, object := range page.Contents {
+			objects = append(objects, &ObjectInfo{
+				Key:          aws.StringValue(object.Key),
+				Size:         aws.Int64Value(object.Size),
+				MD5:          s3ObjectMD5(object.ETag, nil),
+				StorageClass: aws.StringValue(object.StorageClass),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return objects, nil
+}
+
+// Restore requests a temporary copy of the object at the passed in URL be restored from cold storage, which is fine
+// if it's already being restored
+func (c *S3Client) Restore(ctx context.Context, fileURL string, days int) error {
+	bucket, key, err := c.SplitURL(fileURL)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.api.RestoreObjectWithContext(ctx, &s3.RestoreObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		RestoreRequest: &s3.RestoreRequest{
+			Days:                 aws.Int64(int64(days)),
+			GlacierJobParameters: &s3.GlacierJobParameters{Tier: aws.String(s3.TierStandard)},
+		},
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "RestoreAlreadyInProgress" {
+		return nil
+	}
+	if err != nil {
+		return s3Error(err)
+	}
 	return nil
 }
 
+// SignURL returns a presigned URL of the object at the passed in URL
+func (c *S3Client) SignURL(fileURL string, expires time.Duration) (string, error) {
+	bucket, key, err := c.SplitURL(fileURL)
+	if err != nil {
+		return "", err
+	}
+
+	req, _ := c.api.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	return req.Presign(expires)
+}
+
+// the most keys S3 deletes in a single request
+const maxDeleteObjectsKeys = 1000
+
+// how many times, and how long after the first time, keys S3 failed to delete for transient reasons are retried
+var (
+	deleteObjectsRetries = 3
+	deleteObjectsBackoff = time.Second
+)
+
+// the codes of the errors deleting a key which may succeed if retried
+var transientDeleteErrors = map[string]bool{
+	"InternalError":      true,
+	"ServiceUnavailable": true,
+	errCodeSlowDown:      true,
+}
+
+// Delete deletes the objects with the passed in keys from the passed in bucket, up to 1000 at a time, and returns the
+// result for each key, nil if it was deleted, which includes keys which didn't exist. Keys which fail for transient
+// reasons, or whose whole request failed, are retried with backoff, while others fail straight away.
+func (c *S3Client) Delete(ctx context.Context, bucket string, keys []string) map[string]error {
+	results := make(map[string]error, len(keys))
+	for start := 0; start < len(keys); start += maxDeleteObjectsKeys {
+		end := start + maxDeleteObjectsKeys
+		if end > len(keys) {
+			end = len(keys)
+		}
+		c.deleteBatch(ctx, bucket, keys[start:end], results)
+	}
+	return results
+}
+
+// deleteBatch deletes a single request's worth of keys, retrying those which fail transiently, and records the result
+// of each in the passed in results
+func (c *S3Client) deleteBatch(ctx context.Context, bucket string, keys []string, results map[string]error) {
+	pending := keys
+	backoff := deleteObjectsBackoff
+
+	for retry := 0; ; retry++ {
+		objects := make([]*s3.ObjectIdentifier, 0, len(pending))
+		for _, key := range pending {
+			objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+
+		output, err := c.api.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+
+		retryable := make([]string, 0)
+		if err != nil {
+			// the whole request failed, every key is worth retrying
+			for _, key := range pending {
+				results[key] = s3Error(err)
+			}
+			retryable = pending
+		} else {
+			for _, key := range pending {
+				results[key] = nil
+			}
+
+			// in quiet mode only the keys which failed are listed
+			for _, e := range output.Errors {
+				key := aws.StringValue(e.Key)
+				results[key] = &StorageError{Code: aws.StringValue(e.Code), Message: aws.StringValue(e.Message)}
+				if transientDeleteErrors[aws.StringValue(e.Code)] {
+					retryable = append(retryable, key)
+				}
+			}
+		}
+
+		if len(retryable) == 0 || retry >= deleteObjectsRetries || ctx.Err() != nil {
+			return
+		}
+
+		logrus.WithField("bucket", bucket).WithField("keys", len(retryable)).WithField("retry", retry+1).Warn("error deleting objects, retrying")
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff *= 2
+		pending = retryable
+	}
+}
+
 func withAcceptEncoding(e string) request.Option {
 	return func(r *request.Request) {
 		r.HTTPRequest.Header.Add("Accept-Encoding", e)
 	}
 }
 
-// GetS3FileETAG returns the ETAG hash for the passed in file
-func GetS3FileETAG(ctx context.Context, s3Client s3iface.S3API, fileURL string) (string, error) {
-	u, err := url.Parse(fileURL)
+// UploadToS3 writes the passed in archive
+func UploadToS3(ctx context.Context, s3Client Storage, bucket string, path string, archive *Archive) error {
+	f, err := os.Open(archive.ArchiveFile)
 	if err != nil {
-		return "", err
+		return err
 	}
+	defer f.Close()
 
-	bucket := strings.Split(u.Host, ".")[0]
-	path := u.Path
+	// we read our file ourselves so we can report progress and stop promptly when our context is done
+	progress := startUploadProgress(path, archive.Size)
+	defer progress.finish()
+	body := limitReader(ctx, newProgressReader(ctx, f, progress), uploadLimiter)
 
-	output, err := s3Client.HeadObjectWithContext(
-		ctx,
-		&s3.HeadObjectInput{
-			Bucket: aws.String(bucket),
-			Key:    aws.String(path),
-		},
-	)
+	url, err := s3Client.Upload(ctx, bucket, path, body, archive.Size, "gzip", archive.Hash)
+	if err != nil {
+		return err
+	}
+
+	archive.URL = url
+	markWritten(url)
+	recordActivity(ActivityUploaded, archive)
+	return nil
+}
+
+// markWritten records that we just wrote the object at the passed in URL, forgetting those written before our window
+func markWritten(fileURL string) {
+	now := time.Now()
 
+	recentWrites.Lock()
+	defer recentWrites.Unlock()
+
+	for u, written := range recentWrites.urls {
+		if now.Sub(written) > readAfterWriteWindow {
+			delete(recentWrites.urls, u)
+		}
+	}
+	recentWrites.urls[fileURL] = now
+}
+
+func writtenRecently(fileURL string) bool {
+	recentWrites.Lock()
+	defer recentWrites.Unlock()
+
+	written, found := recentWrites.urls[fileURL]
+	return found && time.Since(written) <= readAfterWriteWindow
+}
+
+// GetS3FileETAG returns the ETAG hash for the passed in file
+func GetS3FileETAG(ctx context.Context, s3Client Storage, fileURL string) (string, error) {
+	info, err := s3Client.Stat(ctx, fileURL)
 	if err != nil {
 		return "", err
 	}
 
-	if output.ETag == nil {
+	if info.MD5 == "" {
 		return "", fmt.Errorf("no ETAG for object")
 	}
-
-	// etag is quoted, remove them
-	etag := strings.Trim(*output.ETag, `"`)
-	return etag, nil
+	return info.MD5, nil
 }
 
-// GetS3File return an io.ReadCloser for the passed in bucket and path
-func GetS3File(ctx context.Context, s3Client s3iface.S3API, fileURL string) (io.ReadCloser, error) {
-	u, err := url.Parse(fileURL)
+// VerifyS3Archive checks that the object backing the passed in archive exists and that its size and hash match what
+// we recorded for the archive, returning an error if the object is missing or doesn't match
+func VerifyS3Archive(ctx context.Context, s3Client Storage, archive *Archive) error {
+	if s3Client == nil {
+		return fmt.Errorf("no s3 client, unable to verify archive: %d", archive.ID)
+	}
+	if archive.URL == "" {
+		return fmt.Errorf("archive: %d has no URL, it was never uploaded", archive.ID)
+	}
+
+	info, err := s3Client.Stat(ctx, archive.URL)
 	if err != nil {
-		return nil, err
+		if isNotFound(err) {
+			return fmt.Errorf("archive object missing from s3: %s", archive.URL)
+		}
+		return err
 	}
 
-	bucket := strings.Split(u.Host, ".")[0]
-	path := u.Path
+	archive.StorageClass = info.StorageClass
 
-	output, err := s3Client.GetObjectWithContext(
-		ctx,
-		&s3.GetObjectInput{
-			Bucket: aws.String(bucket),
-			Key:    aws.String(path),
-		},
-		withAcceptEncoding("gzip"),
-	)
+	if info.Size != archive.Size {
+		return fmt.Errorf("archive size: %d and s3 size: %d do not match", archive.Size, info.Size)
+	}
+
+	// objects uploaded in parts before we stored their hash with them have to be downloaded to be checked
+	if info.MD5 == "" {
+		hash, err := hashS3Object(ctx, s3Client, archive.URL)
+		if err != nil {
+			return errors.Wrapf(err, "error hashing archive object: %s", archive.URL)
+		}
+		if hash != archive.Hash {
+			return fmt.Errorf("archive md5: %s and s3 object md5: %s do not match", archive.Hash, hash)
+		}
+		return nil
+	}
+	if info.MD5 != archive.Hash {
+		return fmt.Errorf("archive md5: %s and s3 etag: %s do not match", archive.Hash, info.MD5)
+	}
+
+	return nil
+}
+
+// hashS3Object downloads the object at the passed in URL and returns its hex encoded MD5
+func hashS3Object(ctx context.Context, s3Client Storage, fileURL string) (string, error) {
+	body, err := GetS3File(ctx, s3Client, fileURL)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	hash := md5.New()
+	_, err = io.Copy(hash, body)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
 
+// GetS3File return an io.ReadCloser for the passed in bucket and path
+func GetS3File(ctx context.Context, s3Client StorageClient, fileURL string) (io.ReadCloser, error) {
+	body, err := s3Client.GetObject(ctx, fileURL)
 	if err != nil {
 		return nil, err
 	}
 
-	return output.Body, nil
+	return &limitedReadCloser{limitReader(ctx, body, downloadLimiter), body}, nil
+}
+
+// getWrittenS3File downloads an archive we may have just written, such as the dailies of a rollup. S3 compatible
+// stores which are only eventually consistent can say these don't exist for a short while, so if we wrote the object
+// recently we retry a few times, backing off between each, before giving up.
+func getWrittenS3File(ctx context.Context, conf *Config, s3Client Storage, fileURL string) (io.ReadCloser, error) {
+	backoff := time.Millisecond * time.Duration(conf.ReadAfterWriteBackoffMS)
+
+	for retry := 1; ; retry++ {
+		reader, err := s3Client.Download(ctx, fileURL)
+		if err == nil {
+			return &limitedReadCloser{limitReader(ctx, reader, downloadLimiter), reader}, nil
+		}
+		if retry > conf.ReadAfterWriteRetries || !isNotFound(err) || !writtenRecently(fileURL) {
+			return nil, err
+		}
+
+		logrus.WithField("url", fileURL).WithField("retry", retry).WithField("backoff", backoff).Warn("object we just wrote not found on S3, retrying")
+		readAfterWriteRetries.add(1)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, err
+		}
+		backoff *= 2
+	}
 }
@@ -0,0 +1,535 @@
+package archives
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockS3Object struct {
+	body     []byte
+	etag     string
+	metadata map[string]*string
+
+	contentType     string
+	contentEncoding string
+
+	// objects in cold storage can't be read until restored
+	storageClass string
+	restore      string
+}
+
+// mockS3API is a minimal in memory S3 used to test our S3 interactions without AWS credentials
+type mockS3API struct {
+	s3iface.S3API
+
+	mutex   sync.Mutex
+	objects map[string]*mockS3Object
+	heads   int
+
+	// the number of gets whose bodies hang until their context is done
+	stalls int
+
+	// the number of gets which say their object doesn't exist yet, as an eventually consistent store might
+	notFounds int
+
+	// the keys of the objects restores have been requested of
+	restores []string
+
+	// the error codes each batch delete of a key fails with, in turn, before succeeding, and how many batch deletes
+	// there have been and how many of them fail outright
+	deleteFailures map[string][]string
+	deleteRequests int
+	deleteErrors   int
+}
+
+// stalledReader is a body which never returns anything until its context is done
+type stalledReader struct {
+	ctx context.Context
+}
+
+func (r *stalledReader) Read(p []byte) (int, error) {
+	<-r.ctx.Done()
+	return 0, r.ctx.Err()
+}
+
+func newMockS3API() *mockS3API {
+	return &mockS3API{objects: make(map[string]*mockS3Object)}
+}
+
+// mockS3Client is our S3 storage over our mock of the S3 API, which tests can also reach into
+type mockS3Client struct {
+	*S3Client
+	*mockS3API
+}
+
+func newMockS3Client() *mockS3Client {
+	api := newMockS3API()
+	return &mockS3Client{S3Client: newS3Client(api, s3BucketURL), mockS3API: api}
+}
+
+func (c *mockS3API) objectKey(bucket *string, key *string) string {
+	return aws.StringValue(bucket) + ":" + aws.StringValue(key)
+}
+
+// putObject adds an object with the passed in body, returning its URL
+func (c *mockS3API) putObject(bucket string, key string, body []byte) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	hash := md5.Sum(body)
+	c.objects[bucket+":"+key] = &mockS3Object{body: body, etag: `"` + hex.EncodeToString(hash[:]) + `"`}
+	return "https://" + bucket + ".s3.amazonaws.com" + key
+}
+
+func (c *mockS3API) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	body, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	c.putObject(aws.StringValue(input.Bucket), aws.StringValue(input.Key), body)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	obj := c.objects[c.objectKey(input.Bucket, input.Key)]
+	obj.metadata = input.Metadata
+	obj.contentType = aws.StringValue(input.ContentType)
+	obj.contentEncoding = aws.StringValue(input.ContentEncoding)
+	return &s3.PutObjectOutput{ETag: aws.String(obj.etag)}, nil
+}
+
+func (c *mockS3API) ListObjectsV2PagesWithContext(ctx aws.Context, input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool, opts ...request.Option) error {
+	c.mutex.Lock()
+	prefix := c.objectKey(input.Bucket, input.Prefix)
+	page := &s3.ListObjectsV2Output{Contents: make([]*s3.Object, 0)}
+	for key, obj := range c.objects {
+		if strings.HasPrefix(key, prefix) {
+			page.Contents = append(page.Contents, &s3.Object{Key: aws.String(key[strings.Index(key, ":")+1:]), Size: aws.Int64(int64(len(obj.body))), ETag: aws.String(obj.etag)})
+		}
+	}
+	c.mutex.Unlock()
+
+	sort.Slice(page.Contents, func(i, j int) bool { return *page.Contents[i].Key < *page.Contents[j].Key })
+	fn(page, true)
+	return nil
+}
+
+func (c *mockS3API) HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.heads++
+	obj, found := c.objects[c.objectKey(input.Bucket, input.Key)]
+	if !found {
+		return nil, awserr.New("NotFound", "Not Found", nil)
+	}
+	output := &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(obj.body))),
+		ETag:          aws.String(obj.etag),
+		Metadata:      obj.metadata,
+	}
+	if obj.storageClass != "" {
+		output.StorageClass = aws.String(obj.storageClass)
+	}
+	if obj.restore != "" {
+		output.Restore = aws.String(obj.restore)
+	}
+	return output, nil
+}
+
+func (c *mockS3API) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	obj, found := c.objects[c.objectKey(input.Bucket, input.Key)]
+	if !found || c.notFounds > 0 {
+		if found {
+			c.notFounds--
+		}
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	if coldStorageClasses[obj.storageClass] && obj.restore != `ongoing-request="false"` {
+		return nil, awserr.New("InvalidObjectState", "The operation is not valid for the object's storage class", nil)
+	}
+
+	var body io.Reader = bytes.NewReader(obj.body)
+	if c.stalls > 0 {
+		c.stalls--
+		body = &stalledReader{ctx: ctx}
+	}
+
+	return &s3.GetObjectOutput{
+		Body:          ioutil.NopCloser(body),
+		ContentLength: aws.Int64(int64(len(obj.body))),
+		ETag:          aws.String(obj.etag),
+	}, nil
+}
+
+func (c *mockS3API) CopyObjectWithContext(ctx aws.Context, input *s3.CopyObjectInput, opts ...request.Option) (*s3.CopyObjectOutput, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// our copy source is the bucket followed by the key
+	source := aws.StringValue(input.CopySource)
+	slash := strings.Index(source, "/")
+	obj, found := c.objects[source[:slash]+":"+source[slash:]]
+	if !found {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+
+	copied := *obj
+	if aws.StringValue(input.MetadataDirective) == s3.MetadataDirectiveReplace {
+		copied.metadata = input.Metadata
+	}
+	c.objects[c.objectKey(input.Bucket, input.Key)] = &copied
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (c *mockS3API) RestoreObjectWithContext(ctx aws.Context, input *s3.RestoreObjectInput, opts ...request.Option) (*s3.RestoreObjectOutput, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	obj, found := c.objects[c.objectKey(input.Bucket, input.Key)]
+	if !found {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	if obj.restore != "" {
+		return nil, awserr.New("RestoreAlreadyInProgress", "Object restore is already in progress", nil)
+	}
+	obj.restore = `ongoing-request="true"`
+	c.restores = append(c.restores, aws.StringValue(input.Key))
+	return &s3.RestoreObjectOutput{}, nil
+}
+
+// setStorageClass moves the object at the passed in URL to the passed in storage class
+func (c *mockS3API) setStorageClass(fileURL string, storageClass string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	u, _ := url.Parse(fileURL)
+	obj := c.objects[strings.Split(u.Host, ".")[0]+":"+u.Path]
+	obj.storageClass = storageClass
+	obj.restore = ""
+}
+
+func (c *mockS3API) DeleteObjectWithContext(ctx aws.Context, input *s3.DeleteObjectInput, opts ...request.Option) (*s3.DeleteObjectOutput, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.objects, c.objectKey(input.Bucket, input.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (c *mockS3API) DeleteObjectsWithContext(ctx aws.Context, input *s3.DeleteObjectsInput, opts ...request.Option) (*s3.DeleteObjectsOutput, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.deleteRequests++
+	if c.deleteErrors > 0 {
+		c.deleteErrors--
+		return nil, awserr.New("InternalError", "we encountered an internal error", nil)
+	}
+	if len(input.Delete.Objects) > maxDeleteObjectsKeys {
+		return nil, awserr.New("MalformedXML", "too many keys", nil)
+	}
+
+	output := &s3.DeleteObjectsOutput{}
+	for _, obj := range input.Delete.Objects {
+		key := aws.StringValue(obj.Key)
+		if failures := c.deleteFailures[key]; len(failures) > 0 {
+			c.deleteFailures[key] = failures[1:]
+			output.Errors = append(output.Errors, &s3.Error{Key: obj.Key, Code: aws.String(failures[0]), Message: aws.String(failures[0])})
+			continue
+		}
+
+		delete(c.objects, c.objectKey(input.Bucket, obj.Key))
+		if !aws.BoolValue(input.Delete.Quiet) {
+			output.Deleted = append(output.Deleted, &s3.DeletedObject{Key: obj.Key})
+		}
+	}
+	return output, nil
+}
+
+func base64MD5(body []byte) string {
+	hash := md5.Sum(body)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func TestVerifyS3Archive(t *testing.T) {
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+
+	body := []byte("archive contents")
+	hash := md5.Sum(body)
+	archive := &Archive{
+		ID:   1,
+		Size: int64(len(body)),
+		Hash: hex.EncodeToString(hash[:]),
+		URL:  s3Client.putObject("test-bucket", "/1/message_D20170812_hash.jsonl.gz", body),
+	}
+
+	// valid object
+	assert.NoError(t, VerifyS3Archive(ctx, s3Client, archive))
+
+	// no client or no URL, can't verify
+	assert.Error(t, VerifyS3Archive(ctx, nil, archive))
+	assert.Error(t, VerifyS3Archive(ctx, s3Client, &Archive{ID: 2}))
+
+	// wrong hash
+	mismatched := *archive
+	mismatched.Hash = "f0d79988b7772c003d04a28bd7417a62"
+	assert.EqualError(t, VerifyS3Archive(ctx, s3Client, &mismatched), "archive md5: f0d79988b7772c003d04a28bd7417a62 and s3 etag: "+archive.Hash+" do not match")
+
+	// wrong size
+	mismatched = *archive
+	mismatched.Size = 23
+	assert.Error(t, VerifyS3Archive(ctx, s3Client, &mismatched))
+
+	// missing object
+	missing := *archive
+	missing.URL = "https://test-bucket.s3.amazonaws.com/1/missing.jsonl.gz"
+	assert.EqualError(t, VerifyS3Archive(ctx, s3Client, &missing), "archive object missing from s3: https://test-bucket.s3.amazonaws.com/1/missing.jsonl.gz")
+
+	// multipart uploads without our md5 metadata are downloaded and hashed
+	obj := s3Client.objects["test-bucket:/1/message_D20170812_hash.jsonl.gz"]
+	obj.etag = `"d41d8cd98f00b204e9800998ecf8427e-2"`
+	assert.NoError(t, VerifyS3Archive(ctx, s3Client, archive))
+
+	mismatched = *archive
+	mismatched.Hash = "f0d79988b7772c003d04a28bd7417a62"
+	assert.EqualError(t, VerifyS3Archive(ctx, s3Client, &mismatched), "archive md5: f0d79988b7772c003d04a28bd7417a62 and s3 object md5: "+archive.Hash+" do not match")
+
+	// and those with it are verified using it
+	obj.metadata = map[string]*string{"Md5chksum": aws.String("xWKMGBWzSFNRkDE2BNZgvg==")}
+	assert.Error(t, VerifyS3Archive(ctx, s3Client, archive))
+
+	obj.metadata = map[string]*string{"Md5chksum": aws.String(base64MD5(body))}
+	assert.NoError(t, VerifyS3Archive(ctx, s3Client, archive))
+}
+
+func TestAppendDaily(t *testing.T) {
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+	config := NewConfig()
+	config.RollupDownloadTimeoutSec = 1
+
+	compressed := &bytes.Buffer{}
+	gzWriter := gzip.NewWriter(compressed)
+	gzWriter.Write([]byte("{\"id\":1}\n"))
+	gzWriter.Close()
+
+	hash := md5.Sum(compressed.Bytes())
+	daily := &Archive{
+		ID:          1,
+		RecordCount: 1,
+		Size:        int64(compressed.Len()),
+		Hash:        hex.EncodeToString(hash[:]),
+		URL:         s3Client.putObject("test-bucket", "/1/message_D20170812_hash.jsonl.gz", compressed.Bytes()),
+	}
+
+	// our first download hangs, times out and is retried
+	s3Client.stalls = 1
+	output := &bytes.Buffer{}
+	start := time.Now()
+	assert.NoError(t, appendDaily(ctx, config, s3Client, daily, output))
+	assert.Equal(t, "{\"id\":1}\n", output.String())
+	assert.True(t, time.Since(start) < time.Second*3)
+
+	// but only once
+	s3Client.stalls = 2
+	output.Reset()
+	err := appendDaily(ctx, config, s3Client, daily, output)
+	assert.Error(t, err)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+	assert.Equal(t, "", output.String())
+
+	// bad hashes fail too
+	daily.Hash = "f0d79988b7772c003d04a28bd7417a62"
+	err = appendDaily(ctx, config, s3Client, daily, output)
+	assert.EqualError(t, err, "daily hash mismatch. expected: f0d79988b7772c003d04a28bd7417a62, got "+hex.EncodeToString(hash[:]))
+}
+
+func TestGetWrittenS3File(t *testing.T) {
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+	config := NewConfig()
+	config.ReadAfterWriteRetries = 2
+	config.ReadAfterWriteBackoffMS = 1
+
+	written := s3Client.putObject("test-bucket", "/1/message_D20170812_written.jsonl.gz", []byte("written"))
+	older := s3Client.putObject("test-bucket", "/1/message_D20170811_older.jsonl.gz", []byte("older"))
+	markWritten(written)
+
+	// objects we just wrote are retried until S3 has them
+	s3Client.notFounds = 2
+	reader, err := getWrittenS3File(ctx, config, s3Client, written)
+	assert.NoError(t, err)
+	body, _ := ioutil.ReadAll(reader)
+	assert.Equal(t, "written", string(body))
+	assert.Equal(t, 0, s3Client.notFounds)
+
+	// but only as many times as configured
+	s3Client.notFounds = 3
+	_, err = getWrittenS3File(ctx, config, s3Client, written)
+	assert.True(t, isNotFound(err))
+	assert.Equal(t, 0, s3Client.notFounds)
+
+	// or not at all
+	config.ReadAfterWriteRetries = 0
+	s3Client.notFounds = 1
+	_, err = getWrittenS3File(ctx, config, s3Client, written)
+	assert.True(t, isNotFound(err))
+
+	// objects we didn't just write really are missing
+	config.ReadAfterWriteRetries = 2
+	s3Client.notFounds = 1
+	_, err = getWrittenS3File(ctx, config, s3Client, older)
+	assert.True(t, isNotFound(err))
+	assert.Equal(t, 0, s3Client.notFounds)
+
+	_, err = getWrittenS3File(ctx, config, s3Client, "https://test-bucket.s3.amazonaws.com/1/missing.jsonl.gz")
+	assert.True(t, isNotFound(err))
+
+	// forgotten once our window is over
+	recentWrites.Lock()
+	recentWrites.urls[written] = time.Now().Add(-readAfterWriteWindow - time.Minute)
+	recentWrites.Unlock()
+	assert.False(t, writtenRecently(written))
+
+	markWritten(older)
+	recentWrites.Lock()
+	_, found := recentWrites.urls[written]
+	recentWrites.Unlock()
+	assert.False(t, found)
+}
+
+func TestDeleteS3Objects(t *testing.T) {
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+
+	defer func(backoff time.Duration) { deleteObjectsBackoff = backoff }(deleteObjectsBackoff)
+	deleteObjectsBackoff = time.Millisecond
+
+	keys := make([]string, 0, 1500)
+	for i := 0; i < 1500; i++ {
+		key := fmt.Sprintf("/1/message_D201708%02d_%d.jsonl.gz", i%28+1, i)
+		s3Client.putObject("test-bucket", key, []byte("archive"))
+		keys = append(keys, key)
+	}
+
+	// one key is transiently failing, another we can't delete at all
+	s3Client.deleteFailures = map[string][]string{
+		keys[3]:    {"InternalError", "SlowDown"},
+		keys[1200]: {"AccessDenied"},
+	}
+
+	results := s3Client.Delete(ctx, "test-bucket", keys)
+	assert.Equal(t, 1500, len(results))
+
+	// split into two requests, the first retried twice for our transient failure, the second once to find the access
+	// denied isn't transient
+	assert.Equal(t, 4, s3Client.deleteRequests)
+
+	assert.NoError(t, results[keys[0]])
+	assert.NoError(t, results[keys[3]])
+	assert.NoError(t, results[keys[1499]])
+	assert.Error(t, results[keys[1200]])
+	assert.Equal(t, "AccessDenied", results[keys[1200]].(*StorageError).Code)
+
+	// only the object we were denied is left
+	assert.Equal(t, 1, len(s3Client.objects))
+	assert.Contains(t, s3Client.objects, "test-bucket:"+keys[1200])
+
+	// keys which don't exist are deleted without error
+	results = s3Client.Delete(ctx, "test-bucket", keys[:2])
+	assert.NoError(t, results[keys[0]])
+	assert.NoError(t, results[keys[1]])
+
+	// a failing request is retried as a whole, until we run out of retries
+	s3Client.deleteRequests = 0
+	s3Client.deleteErrors = 1
+	results = s3Client.Delete(ctx, "test-bucket", keys[1200:1201])
+	assert.NoError(t, results[keys[1200]])
+	assert.Equal(t, 2, s3Client.deleteRequests)
+	assert.Equal(t, 0, len(s3Client.objects))
+
+	s3Client.deleteRequests = 0
+	s3Client.deleteErrors = 10
+	results = s3Client.Delete(ctx, "test-bucket", keys[:1])
+	assert.Error(t, results[keys[0]])
+	assert.Equal(t, deleteObjectsRetries+1, s3Client.deleteRequests)
+}
+
+func TestResolveS3Endpoint(t *testing.T) {
+	config := NewConfig()
+
+	// the standard partition uses our endpoint as is
+	endpoint, bucketURL, err := resolveS3Endpoint(config)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://s3.amazonaws.com", endpoint)
+	assert.Equal(t, "https://%s.s3.amazonaws.com%s", bucketURL)
+
+	config.S3Partition = "aws"
+	_, _, err = resolveS3Endpoint(config)
+	assert.NoError(t, err)
+
+	// other partitions are resolved for our region
+	config.S3Region = "cn-north-1"
+	config.S3Partition = "aws-cn"
+	endpoint, bucketURL, err = resolveS3Endpoint(config)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://s3.cn-north-1.amazonaws.com.cn", endpoint)
+	assert.Equal(t, "https://test.s3.cn-north-1.amazonaws.com.cn/1/message_D20170812_hash.jsonl.gz", fmt.Sprintf(bucketURL, "test", "/1/message_D20170812_hash.jsonl.gz"))
+
+	// even without our partition configured
+	config.S3Region = "us-gov-west-1"
+	config.S3Partition = ""
+	endpoint, _, err = resolveS3Endpoint(config)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://s3.us-gov-west-1.amazonaws.com", endpoint)
+
+	// unless we've configured our own endpoint
+	config.S3Endpoint = "https://s3.internal.example.com"
+	endpoint, _, err = resolveS3Endpoint(config)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://s3.internal.example.com", endpoint)
+
+	// regions we don't know are fine as long as we aren't checking their partition
+	config.S3Region = "minio"
+	_, _, err = resolveS3Endpoint(config)
+	assert.NoError(t, err)
+
+	config.S3Partition = "aws"
+	_, _, err = resolveS3Endpoint(config)
+	assert.EqualError(t, err, "S3 region: minio is not in S3 partition: aws")
+
+	// regions must be in our partition
+	config.S3Region = "us-east-1"
+	config.S3Partition = "aws-us-gov"
+	_, _, err = resolveS3Endpoint(config)
+	assert.EqualError(t, err, "S3 region: us-east-1 is not in S3 partition: aws-us-gov")
+
+	config.S3Partition = "aws-mars"
+	_, _, err = resolveS3Endpoint(config)
+	assert.EqualError(t, err, "unknown S3 partition: aws-mars")
+}
@@ -0,0 +1,134 @@
+package archives
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// the strategies we can archive orgs in each night
+const (
+	ScheduleByID       = "id"
+	ScheduleSmallFirst = "small-first"
+)
+
+// the number of days before our retention period whose dailies we average to estimate an org's records per day
+const estimateWindowDays = 30
+
+// OrgEstimate is a cheap estimate of how much work archiving an org will be, the number of days it's missing archives
+// for multiplied by the average number of records it recently archived per day
+type OrgEstimate struct {
+	Org           Org
+	MissingDays   int
+	RecordsPerDay float64
+
+	// whether we have any dailies to estimate from, orgs without are usually being backfilled
+	Known bool
+}
+
+// Work returns the estimated number of records we'll archive for our org, infinite if unknown
+func (e *OrgEstimate) Work() float64 {
+	if !e.Known {
+		return math.Inf(1)
+	}
+	return float64(e.MissingDays) * e.RecordsPerDay
+}
+
+// both types are counted together, a day with both a message and run daily counting once
+const lookupOrgEstimates = `
+SELECT org_id, MAX(start_date)::timestamp with time zone AS last_start,
+	COUNT(DISTINCT start_date) FILTER (WHERE start_date >= $1) AS recent_days,
+	COALESCE(SUM(record_count) FILTER (WHERE start_date >= $1), 0) AS recent_records
+FROM archives_archive
+WHERE period = 'D'
+GROUP BY org_id
+`
+
+// EstimateOrgWork estimates the work of archiving each of the passed in orgs using only our existing archives
+func EstimateOrgWork(ctx context.Context, db *sqlx.DB, now time.Time, orgs []Org) ([]*OrgEstimate, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	estimates := make([]*OrgEstimate, len(orgs))
+	byOrg := make(map[int]*OrgEstimate, len(orgs))
+	for i, org := range orgs {
+		estimates[i] = &OrgEstimate{Org: org}
+		byOrg[org.ID] = estimates[i]
+	}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	windowStart := today.AddDate(0, 0, -estimateWindowDays)
+	if len(orgs) > 0 {
+		windowStart = orgs[0].archiveEndDate(now).AddDate(0, 0, -estimateWindowDays)
+	}
+
+	rows, err := db.QueryxContext(ctx, lookupOrgEstimates, windowStart)
+	if err != nil {
+		return nil, errors.Wrap(err, "error estimating org work")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var orgID, recentDays int
+		var lastStart time.Time
+		var recentRecords int64
+
+		err = rows.Scan(&orgID, &lastStart, &recentDays, &recentRecords)
+		if err != nil {
+			return nil, errors.Wrap(err, "error scanning org estimate")
+		}
+
+		estimate, found := byOrg[orgID]
+		if !found {
+			continue
+		}
+
+		endDate := estimate.Org.archiveEndDate(now)
+		missing := int(endDate.Sub(lastStart.In(time.UTC).AddDate(0, 0, 1)).Hours() / 24)
+		if missing < 0 {
+			missing = 0
+		}
+
+		estimate.Known = true
+		estimate.MissingDays = missing
+		if recentDays > 0 {
+			estimate.RecordsPerDay = float64(recentRecords) / float64(recentDays)
+		}
+	}
+
+	return estimates, rows.Err()
+}
+
+// ScheduleOrgs returns the orgs of the passed in estimates in the order we should archive them. Archiving by id keeps
+// them in id order, archiving small orgs first puts those with work below our threshold ahead of the heavy ones,
+// both in id order.
+func ScheduleOrgs(estimates []*OrgEstimate, strategy string, threshold int) ([]Org, error) {
+	orgs := make([]Org, 0, len(estimates))
+
+	switch strategy {
+	case ScheduleByID:
+		for _, e := range estimates {
+			orgs = append(orgs, e.Org)
+		}
+
+	case ScheduleSmallFirst:
+		heavy := make([]Org, 0)
+		for _, e := range estimates {
+			if e.Work() < float64(threshold) {
+				orgs = append(orgs, e.Org)
+			} else {
+				heavy = append(heavy, e.Org)
+			}
+		}
+		orgs = append(orgs, heavy...)
+
+	default:
+		return nil, fmt.Errorf("unknown org schedule: %s", strategy)
+	}
+
+	return orgs, nil
+}
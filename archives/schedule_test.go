@@ -0,0 +1,74 @@
+package archives
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduleOrgs(t *testing.T) {
+	estimates := []*OrgEstimate{
+		{Org: Org{ID: 1}, MissingDays: 1, RecordsPerDay: 500000, Known: true},
+		{Org: Org{ID: 2}, MissingDays: 1, RecordsPerDay: 20, Known: true},
+		{Org: Org{ID: 3}},
+		{Org: Org{ID: 4}, MissingDays: 30, RecordsPerDay: 1000, Known: true},
+		{Org: Org{ID: 5}, MissingDays: 0, RecordsPerDay: 0, Known: true},
+		{Org: Org{ID: 6}, MissingDays: 3, RecordsPerDay: 40000, Known: true},
+	}
+
+	orgIDs := func(orgs []Org) []int {
+		ids := make([]int, len(orgs))
+		for i, o := range orgs {
+			ids[i] = o.ID
+		}
+		return ids
+	}
+
+	orgs, err := ScheduleOrgs(estimates, ScheduleByID, 100000)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 3, 4, 5, 6}, orgIDs(orgs))
+
+	// orgs we know nothing about are heavy, they're usually being backfilled
+	orgs, err = ScheduleOrgs(estimates, ScheduleSmallFirst, 100000)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{2, 4, 5, 1, 3, 6}, orgIDs(orgs))
+
+	orgs, err = ScheduleOrgs(estimates, ScheduleSmallFirst, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{5, 1, 2, 3, 4, 6}, orgIDs(orgs))
+
+	_, err = ScheduleOrgs(estimates, "largest-first", 100000)
+	assert.EqualError(t, err, "unknown org schedule: largest-first")
+}
+
+func TestEstimateOrgWork(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	config := NewConfig()
+
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	// give org 3 some records on its most recent daily
+	_, err = db.Exec(`UPDATE archives_archive SET record_count = 58 WHERE org_id = 3 AND start_date = '2017-09-10'`)
+	assert.NoError(t, err)
+
+	estimates, err := EstimateOrgWork(ctx, db, now, orgs)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(estimates))
+
+	// org 1 has never been archived
+	assert.False(t, estimates[0].Known)
+
+	assert.True(t, estimates[1].Known)
+	assert.Equal(t, 1, estimates[1].MissingDays)
+	assert.Equal(t, 0.0, estimates[1].Work())
+
+	assert.True(t, estimates[2].Known)
+	assert.Equal(t, 29, estimates[2].MissingDays)
+	assert.Equal(t, 58.0, estimates[2].RecordsPerDay)
+	assert.Equal(t, 29.0*58, estimates[2].Work())
+}
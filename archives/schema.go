@@ -0,0 +1,114 @@
+package archives
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// MissingTablesFail refuses to start when the tables of an archive type we archive are missing
+	MissingTablesFail = "fail"
+
+	// MissingTablesDisable stops archiving the types whose tables are missing, warning once when we start
+	MissingTablesDisable = "disable"
+)
+
+// the tables each archive type is built and deleted from, without any of these a type can't be archived at all
+var archiveTypeTables = map[ArchiveType][]string{
+	MessageType:      {"msgs_msg", "msgs_msg_labels", "msgs_label", "contacts_contact", "contacts_contacturn", "channels_channel"},
+	RunType:          {"flows_flowrun", "flows_flow", "contacts_contact"},
+	ContactType:      {"contacts_contact", "contacts_contacturn", "contacts_contactgroup", "contacts_contactgroup_contacts"},
+	SessionType:      {"flows_flowsession", "contacts_contact"},
+	BroadcastType:    {"msgs_broadcast", "msgs_broadcast_contacts", "msgs_broadcast_groups", "msgs_broadcast_urns", "msgs_msg", "contacts_contact", "contacts_contactgroup", "contacts_contacturn"},
+	ChannelEventType: {"channels_channelevent", "channels_channel", "contacts_contact", "contacts_contacturn"},
+}
+
+// the tables we only delete from alongside records, installs without them simply have nothing there to delete
+var optionalTables = []string{
+	"channels_channellog", "flows_flowpathrecentrun", "msgs_broadcast", "msgs_broadcast_contacts", "msgs_broadcast_groups",
+	"msgs_broadcast_urns", "msgs_broadcastmsgcount",
+}
+
+// the optional tables our database doesn't have, set when we check our schema on startup
+var missingTables = map[string]bool{}
+
+// tableExists returns whether the passed in optional table exists in our database
+func tableExists(table string) bool {
+	return !missingTables[table]
+}
+
+const selectTables = `
+SELECT table_name FROM information_schema.tables WHERE table_schema = ANY(current_schemas(false))
+`
+
+// CheckSchema looks for the tables we archive and delete from in our database, as installs without some apps don't
+// have them. When the tables of an archive type we archive are missing, depending on MissingTables, we either refuse
+// to start or stop archiving that type, rather than failing for every org each night. Missing optional tables are
+// skipped when deleting.
+func CheckSchema(ctx context.Context, db *sqlx.DB, config *Config) error {
+	if config.MissingTables != MissingTablesFail && config.MissingTables != MissingTablesDisable {
+		return fmt.Errorf("invalid missing tables: %s, must be one of %s or %s", config.MissingTables, MissingTablesFail, MissingTablesDisable)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	tables := make([]string, 0)
+	err := db.SelectContext(ctx, &tables, selectTables)
+	if err != nil {
+		return errors.Wrapf(err, "error selecting tables")
+	}
+	existing := make(map[string]bool, len(tables))
+	for _, t := range tables {
+		existing[t] = true
+	}
+
+	archived := map[ArchiveType]*bool{MessageType: &config.ArchiveMessages, RunType: &config.ArchiveRuns, ContactType: &config.ArchiveContacts, SessionType: &config.ArchiveSessions, BroadcastType: &config.ArchiveBroadcasts, ChannelEventType: &config.ArchiveChannelEvents}
+	for _, archiveType := range ArchiveTypes {
+		if !*archived[archiveType] {
+			continue
+		}
+
+		missing := missingFrom(existing, archiveTypeTables[archiveType])
+		if len(missing) == 0 {
+			continue
+		}
+
+		if config.MissingTables == MissingTablesFail {
+			return fmt.Errorf("%s archives need tables missing from our database: %s, set archive-%ss to false if this install doesn't have them", archiveType, strings.Join(missing, ", "), archiveType)
+		}
+
+		logrus.WithField("archive_type", archiveType).WithField("missing", missing).Warn("tables missing from our database, not archiving type")
+		*archived[archiveType] = false
+	}
+
+	missing := missingFrom(existing, optionalTables)
+	missingTables = make(map[string]bool, len(missing))
+	for _, t := range missing {
+		missingTables[t] = true
+	}
+	if len(missing) > 0 {
+		logrus.WithField("missing", missing).Warn("optional tables missing from our database, not deleting from them")
+	}
+
+	return nil
+}
+
+// missingFrom returns which of the passed in tables aren't in the passed in existing tables, sorted
+func missingFrom(existing map[string]bool, tables []string) []string {
+	missing := make([]string, 0)
+	for _, t := range tables {
+		if !existing[t] {
+			missing = append(missing, t)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
@@ -0,0 +1,57 @@
+package archives
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckSchema(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	defer func() { missingTables = map[string]bool{} }()
+
+	// our full schema has everything
+	config := NewConfig()
+	assert.NoError(t, CheckSchema(ctx, db, config))
+	assert.True(t, config.ArchiveMessages)
+	assert.True(t, config.ArchiveRuns)
+	assert.True(t, tableExists("channels_channellog"))
+
+	// an install without flows or channel logs
+	_, err := db.Exec(`DROP TABLE flows_flowpathrecentrun; DROP TABLE flows_flowrun CASCADE; DROP TABLE channels_channellog;`)
+	assert.NoError(t, err)
+
+	assert.EqualError(t, CheckSchema(ctx, db, config), "run archives need tables missing from our database: flows_flowrun, set archive-runs to false if this install doesn't have them")
+
+	// fine if we're not archiving runs
+	config.ArchiveRuns = false
+	assert.NoError(t, CheckSchema(ctx, db, config))
+	assert.False(t, tableExists("channels_channellog"))
+	assert.False(t, tableExists("flows_flowpathrecentrun"))
+	assert.True(t, tableExists("msgs_broadcast"))
+
+	// or we can stop archiving them ourselves
+	config.ArchiveRuns = true
+	config.MissingTables = MissingTablesDisable
+	assert.NoError(t, CheckSchema(ctx, db, config))
+	assert.True(t, config.ArchiveMessages)
+	assert.False(t, config.ArchiveRuns)
+
+	// messages are still archived and deleted without their channel logs
+	config.Delete = true
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	created, deleted, err := ArchiveOrg(ctx, now, config, db, newMockS3Client(), orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 63, len(created))
+	assert.Equal(t, 63, len(deleted))
+	assertCount(t, db, 0, `SELECT count(*) FROM msgs_msg WHERE org_id = 2 AND created_on < '2017-10-01'`)
+
+	config.MissingTables = "ignore"
+	assert.EqualError(t, CheckSchema(ctx, db, config), "invalid missing tables: ignore, must be one of fail or disable")
+}
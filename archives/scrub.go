@@ -0,0 +1,275 @@
+package archives
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ScrubResult is the outcome of scrubbing one archive
+type ScrubResult struct {
+	// Archive is the scrubbed archive, or the existing one if nothing was changed
+	Archive *Archive
+
+	// Records is the number of records in the archive and Modified how many of them the redaction changed
+	Records  int
+	Modified int
+
+	// Superseded is the URL of the unscrubbed object we deleted, if any
+	Superseded string
+}
+
+const lookupArchiveContacts = `
+SELECT contact_count, sketch FROM archiver_archive_contacts WHERE archive_id = $1
+`
+
+// ScrubOrgArchives applies our current redaction policy for anon orgs to the existing archives of the passed in org
+// which cover records in [startDate, endDate), for orgs which became anon after they were archived. Each archive is
+// read back from S3 and those with records that change are rewritten, re-uploaded and swapped in for their previous
+// object, which is then deleted. Monthlies are scrubbed the same way rather than rolled up again, so they are scrubbed
+// even when their dailies are in cold storage, which also scrubs any of their days outside our range.
+//
+// We refuse to scrub while records the archives cover are still in our database, as rebuilding them from there is
+// better. With dryRun set we only report how many records of each archive we would change.
+func ScrubOrgArchives(ctx context.Context, config *Config, db *sqlx.DB, s3Client Storage, org Org, archiveType ArchiveType, startDate time.Time, endDate time.Time, dryRun bool) ([]*ScrubResult, error) {
+	if !org.IsAnon {
+		return nil, fmt.Errorf("org: %d isn't anon, there is nothing to scrub from its archives", org.ID)
+	}
+	if !dryRun && !config.UploadToS3 {
+		return nil, fmt.Errorf("scrubbing requires uploading to s3")
+	}
+
+	archives, err := getArchivesOverlapping(ctx, db, org, archiveType, startDate, endDate)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range archives {
+		a.Org = org
+
+		if a.NeedsDeletion {
+			return nil, fmt.Errorf("records of archive: %d haven't been deleted, rebuild it from the database instead", a.ID)
+		}
+		count, err := countArchiveRecords(ctx, db, config, a)
+		if err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			return nil, fmt.Errorf("%d records of archive: %d are still in the database, rebuild it from there instead", count, a.ID)
+		}
+	}
+
+	// getArchivesOverlapping orders monthlies before their dailies, we want them after
+	sorted := make([]*Archive, 0, len(archives))
+	for _, period := range []ArchivePeriod{DayPeriod, MonthPeriod} {
+		for _, a := range archives {
+			if a.Period == period {
+				sorted = append(sorted, a)
+			}
+		}
+	}
+
+	results := make([]*ScrubResult, 0, len(sorted))
+	for _, a := range sorted {
+		log := logrus.WithFields(logrus.Fields{
+			"archive_id": a.ID,
+			"org_id":     org.ID,
+			"start_date": a.StartDate,
+			"period":     a.Period,
+			"dry_run":    dryRun,
+		})
+
+		result, err := scrubArchive(ctx, config, db, s3Client, a, dryRun)
+		if err != nil {
+			return results, errors.Wrapf(err, "error scrubbing archive: %d", a.ID)
+		}
+		results = append(results, result)
+
+		log.WithFields(logrus.Fields{
+			"records":  result.Records,
+			"modified": result.Modified,
+		}).Info("scrubbed archive")
+	}
+
+	return results, nil
+}
+
+// scrubArchive scrubs the passed in archive, first reading it through to count the records we'd change so that
+// archives without any are left alone
+func scrubArchive(ctx context.Context, config *Config, db *sqlx.DB, s3Client Storage, existing *Archive, dryRun bool) (*ScrubResult, error) {
+	result := &ScrubResult{Archive: existing}
+	if existing.RecordCount == 0 {
+		return result, nil
+	}
+
+	var err error
+	result.Records, result.Modified, err = scrubRecords(ctx, s3Client, existing, ioutil.Discard)
+	if err != nil {
+		return nil, err
+	}
+	if dryRun || result.Modified == 0 {
+		return result, nil
+	}
+
+	// our contacts are the same once scrubbed, so we keep any count of them we have
+	var contacts struct {
+		Count  int    `db:"contact_count"`
+		Sketch []byte `db:"sketch"`
+	}
+	err = db.GetContext(ctx, &contacts, lookupArchiveContacts, existing.ID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, errors.Wrapf(err, "error looking up contacts of archive")
+	}
+	counted := err == nil
+
+	rebuilt, superseded, err := reArchive(ctx, db, config, s3Client, existing, func(rebuilt *Archive) error {
+		if counted {
+			rebuilt.ContactCount = &contacts.Count
+			rebuilt.ContactSketch = contacts.Sketch
+		}
+		return writeScrubbedFile(ctx, config, s3Client, existing, rebuilt)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result.Archive = rebuilt
+	result.Superseded = superseded
+	return result, nil
+}
+
+// writeScrubbedFile writes the scrubbed records of the passed in existing archive to a new archive file for rebuilt
+func writeScrubbedFile(ctx context.Context, config *Config, s3Client Storage, existing *Archive, rebuilt *Archive) error {
+	start := time.Now()
+
+	filename := fmt.Sprintf("%s_%d_%s%d%02d%02d_scrubbed_", existing.ArchiveType, existing.Org.ID, existing.Period, existing.StartDate.Year(), existing.StartDate.Month(), existing.StartDate.Day())
+	file, err := ioutil.TempFile(config.TempDir, filename)
+	if err != nil {
+		return errors.Wrapf(err, "error creating temp file: %s", filename)
+	}
+	defer file.Close()
+
+	hash := md5.New()
+	gzWriter := gzip.NewWriter(io.MultiWriter(file, hash))
+	writer := bufio.NewWriter(gzWriter)
+
+	records, _, err := scrubRecords(ctx, s3Client, existing, writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = gzWriter.Close()
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		os.Remove(file.Name())
+		return errors.Wrapf(err, "error statting file: %s", file.Name())
+	}
+
+	rebuilt.ArchiveFile = file.Name()
+	rebuilt.Hash = hex.EncodeToString(hash.Sum(nil))
+	rebuilt.Size = stat.Size()
+	rebuilt.RecordCount = records
+	rebuilt.BuildTime = int(time.Since(start) / time.Millisecond)
+
+	// our redaction is what the current format does for anon orgs
+	rebuilt.Version = ArchiveSchemaVersion
+	return nil
+}
+
+// scrubRecords reads the records of the passed in archive, writing each to the passed in writer with our redaction
+// applied, returning how many records there were and how many of them were changed. Records which don't change are
+// written exactly as they were.
+func scrubRecords(ctx context.Context, s3Client Storage, archive *Archive, writer io.Writer) (int, int, error) {
+	reader, err := OpenArchive(ctx, s3Client, archive)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "error downloading archive: %s", archive.URL)
+	}
+	defer reader.Close()
+
+	modified := 0
+	for {
+		raw, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "error reading archive")
+		}
+
+		scrubbed, changed, err := scrubRecord(archive.ArchiveType, raw)
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "error scrubbing record %d", reader.Count())
+		}
+		if changed {
+			modified++
+		}
+
+		_, err = writer.Write(append(scrubbed, '\n'))
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "error writing scrubbed record")
+		}
+	}
+
+	return reader.Count(), modified, nil
+}
+
+// scrubRecord applies our redaction for anon orgs to the passed in record, returning it and whether it changed
+func scrubRecord(archiveType ArchiveType, raw json.RawMessage) ([]byte, bool, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+
+	record := make(map[string]interface{})
+	err := decoder.Decode(&record)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "error decoding record")
+	}
+
+	before, err := encodeRecord(record)
+	if err != nil {
+		return nil, false, err
+	}
+
+	maskRecord(archiveType, record)
+
+	after, err := encodeRecord(record)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if bytes.Equal(before, after) {
+		return raw, false, nil
+	}
+	return after, true, nil
+}
+
+// encodeRecord encodes the passed in record as we write records, with its keys sorted and without escaping HTML
+func encodeRecord(record map[string]interface{}) ([]byte, error) {
+	encoded := &bytes.Buffer{}
+	encoder := json.NewEncoder(encoded)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(record)
+	if err != nil {
+		return nil, errors.Wrap(err, "error encoding record")
+	}
+	return bytes.TrimSuffix(encoded.Bytes(), []byte("\n")), nil
+}
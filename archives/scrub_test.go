@@ -0,0 +1,127 @@
+package archives
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScrubRecord(t *testing.T) {
+	// a message archived before its org became anon has its urn and contact name removed
+	raw := json.RawMessage(`{"id":1,"contact":{"uuid":"3e814add-e614-41f7-8b5d-a07f670a698f","name":"Ajodinabiff Dane"},"urn":"tel:+12067797777","text":"<b>hi</b>","created_on":"2017-08-12T21:11:59.890662+00:00"}`)
+	scrubbed, changed, err := scrubRecord(MessageType, raw)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, `{"contact":{"uuid":"3e814add-e614-41f7-8b5d-a07f670a698f"},"created_on":"2017-08-12T21:11:59.890662+00:00","id":1,"text":"<b>hi</b>","urn":null}`, string(scrubbed))
+
+	// one archived since is left exactly as it was
+	raw = json.RawMessage(`{"id":2,"contact":{"uuid":"3e814add-e614-41f7-8b5d-a07f670a698f"},"urn":null,"text":"hi"}`)
+	scrubbed, changed, err = scrubRecord(MessageType, raw)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, string(raw), string(scrubbed))
+
+	// as are runs without events or contact fields
+	raw = json.RawMessage(`{"id":3,"contact":{"uuid":"3e814add-e614-41f7-8b5d-a07f670a698f","name":"Ajodinabiff Dane"},"events":[],"values":{"age":{"value":12.50}}}`)
+	scrubbed, changed, err = scrubRecord(RunType, raw)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, string(raw), string(scrubbed))
+
+	_, _, err = scrubRecord(MessageType, json.RawMessage(`[1, 2]`))
+	assert.Error(t, err)
+}
+
+func TestScrubOrgArchives(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+
+	config := NewConfig()
+	config.Delete = true
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	// archive the messages of org 2 and delete them
+	_, _, err = ArchiveOrg(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+
+	// only anon orgs have anything to scrub
+	start := time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC)
+	_, err = ScrubOrgArchives(ctx, config, db, s3Client, orgs[1], MessageType, start, end, true)
+	assert.EqualError(t, err, "org: 2 isn't anon, there is nothing to scrub from its archives")
+
+	// which org 2 now is
+	_, err = db.Exec(`UPDATE orgs_org SET is_anon = TRUE WHERE id = 2`)
+	assert.NoError(t, err)
+	org, err := GetOrg(ctx, db, config, 2)
+	assert.NoError(t, err)
+
+	// our dailies of august come first, then their monthly
+	objects := len(s3Client.objects)
+	results, err := ScrubOrgArchives(ctx, config, db, s3Client, *org, MessageType, start, end, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 23, len(results))
+	assert.Equal(t, time.Date(2017, 8, 12, 0, 0, 0, 0, time.UTC), results[2].Archive.StartDate)
+	assert.Equal(t, 3, results[2].Records)
+	assert.Equal(t, 3, results[2].Modified)
+	assert.Equal(t, 1, results[3].Modified)
+	assert.Equal(t, 0, results[4].Records)
+	assert.Equal(t, MonthPeriod, results[22].Archive.Period)
+	assert.Equal(t, 4, results[22].Modified)
+
+	// a dry run changes nothing
+	assert.Equal(t, objects, len(s3Client.objects))
+	assertCount(t, db, 0, `SELECT count(*) FROM archives_archive WHERE id = $1 AND hash != $2`, results[2].Archive.ID, results[2].Archive.Hash)
+	previous := results[2].Archive.URL
+
+	results, err = ScrubOrgArchives(ctx, config, db, s3Client, *org, MessageType, start, end, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 23, len(results))
+	assert.Equal(t, 3, results[2].Modified)
+	assert.Equal(t, previous, results[2].Superseded)
+
+	// our scrubbed dailies and monthly replaced their previous objects
+	for _, i := range []int{2, 3, 22} {
+		scrubbed := results[i].Archive
+		assert.NotEqual(t, "", results[i].Superseded)
+		assertCount(t, db, 1, `SELECT count(*) FROM archives_archive WHERE id = $1 AND hash = $2 AND url = $3 AND record_count = $4 AND needs_deletion = FALSE`, scrubbed.ID, scrubbed.Hash, scrubbed.URL, scrubbed.RecordCount)
+
+		reader, err := OpenArchive(ctx, s3Client, scrubbed)
+		assert.NoError(t, err)
+		for {
+			raw, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			assert.NoError(t, err)
+
+			record := make(map[string]interface{})
+			assert.NoError(t, json.Unmarshal(raw, &record))
+			assert.Nil(t, record["urn"])
+			assert.NotContains(t, record["contact"], "name")
+		}
+		assert.Equal(t, scrubbed.RecordCount, reader.Count())
+		reader.Close()
+	}
+	assert.Equal(t, objects, len(s3Client.objects))
+
+	// scrubbing again has nothing left to change
+	results, err = ScrubOrgArchives(ctx, config, db, s3Client, *org, MessageType, start, end, false)
+	assert.NoError(t, err)
+	for _, result := range results {
+		assert.Equal(t, 0, result.Modified)
+		assert.Equal(t, "", result.Superseded)
+	}
+
+	// our october daily with a bad url still has its records, those should be rebuilt instead
+	_, err = ScrubOrgArchives(ctx, config, db, s3Client, *org, MessageType, time.Date(2017, 10, 1, 0, 0, 0, 0, time.UTC), time.Date(2017, 11, 1, 0, 0, 0, 0, time.UTC), true)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "haven't been deleted, rebuild it from the database instead")
+}
@@ -0,0 +1,144 @@
+package archives
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// SecretsProviderSecretsManager resolves secret references as the names or ARNs of AWS Secrets Manager secrets
+	SecretsProviderSecretsManager = "aws-secretsmanager"
+
+	// SecretsProviderSSM resolves secret references as the names of AWS Systems Manager parameters, decrypting them
+	SecretsProviderSSM = "aws-ssm"
+)
+
+// SecretsClient looks up the value of a secret by its reference
+type SecretsClient interface {
+	GetSecret(ctx context.Context, ref string) (string, error)
+}
+
+// NewSecretsClient returns a client for the secrets provider of the passed in config, or nil if we don't have one.
+// Credentials come from the default AWS chain, such as the role of our instance, as ours may be among our secrets.
+func NewSecretsClient(config *Config) (SecretsClient, error) {
+	if config.SecretsProvider == "" {
+		return nil, nil
+	}
+	if config.SecretsProvider != SecretsProviderSecretsManager && config.SecretsProvider != SecretsProviderSSM {
+		return nil, fmt.Errorf("invalid secrets provider: %s, must be one of %s or %s", config.SecretsProvider, SecretsProviderSecretsManager, SecretsProviderSSM)
+	}
+
+	region := config.SecretsRegion
+	if region == "" {
+		region = config.S3Region
+	}
+	awsSession, err := session.NewSession(&aws.Config{Region: aws.String(region)})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating %s session", config.SecretsProvider)
+	}
+
+	if config.SecretsProvider == SecretsProviderSSM {
+		return &ssmSecrets{client: ssm.New(awsSession)}, nil
+	}
+	return &secretsManagerSecrets{client: secretsmanager.New(awsSession)}, nil
+}
+
+// secretsManagerSecrets looks up secrets in AWS Secrets Manager
+type secretsManagerSecrets struct {
+	client *secretsmanager.SecretsManager
+}
+
+func (s *secretsManagerSecrets) GetSecret(ctx context.Context, ref string) (string, error) {
+	output, err := s.client.GetSecretValueWithContext(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(ref)})
+	if err != nil {
+		return "", err
+	}
+	if output.SecretString == nil {
+		return "", fmt.Errorf("secret has a binary value, only string values are supported")
+	}
+	return *output.SecretString, nil
+}
+
+// ssmSecrets looks up secrets in AWS Systems Manager parameters
+type ssmSecrets struct {
+	client *ssm.SSM
+}
+
+func (s *ssmSecrets) GetSecret(ctx context.Context, ref string) (string, error) {
+	output, err := s.client.GetParameterWithContext(ctx, &ssm.GetParameterInput{Name: aws.String(ref), WithDecryption: aws.Bool(true)})
+	if err != nil {
+		return "", err
+	}
+	if output.Parameter == nil || output.Parameter.Value == nil {
+		return "", fmt.Errorf("parameter has no value")
+	}
+	return *output.Parameter.Value, nil
+}
+
+// secretField is a field of our config which can be resolved from a secret
+type secretField struct {
+	name  string
+	ref   string
+	value *string
+}
+
+// secretFields returns the fields of the passed in config which can be resolved from secrets
+func secretFields(config *Config) []secretField {
+	return []secretField{
+		{"DB", config.DBSecretRef, &config.DB},
+		{"SentryDSN", config.SentryDSNSecretRef, &config.SentryDSN},
+		{"AWSSecretAccessKey", config.AWSSecretAccessKeySecretRef, &config.AWSSecretAccessKey},
+		{"NotificationSMTPServer", config.NotificationSMTPServerSecretRef, &config.NotificationSMTPServer},
+		{"AdminToken", config.AdminTokenSecretRef, &config.AdminToken},
+		{"RapidProNotifyToken", config.RapidProNotifyTokenSecretRef, &config.RapidProNotifyToken},
+	}
+}
+
+// ResolveSecrets replaces each field of the passed in config which has a secret reference with the value of that
+// secret. Errors name the field and reference but never the value, and values are never logged.
+func ResolveSecrets(ctx context.Context, config *Config, client SecretsClient) error {
+	for _, field := range secretFields(config) {
+		if err := resolveSecret(ctx, config, client, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RefreshDBSecret resolves our database URL from its secret again, if it has one, so that we pick up rotated
+// credentials when we reconnect
+func RefreshDBSecret(ctx context.Context, config *Config, client SecretsClient) error {
+	return resolveSecret(ctx, config, client, secretFields(config)[0])
+}
+
+func resolveSecret(ctx context.Context, config *Config, client SecretsClient, field secretField) error {
+	if field.ref == "" {
+		return nil
+	}
+	if client == nil {
+		return fmt.Errorf("%s has secret reference: %s but no secrets provider is configured", field.name, field.ref)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+
+	value, err := client.GetSecret(ctx, field.ref)
+	if err != nil {
+		return errors.Wrapf(err, "error resolving %s from %s secret: %s, check it exists and we're allowed to read it", field.name, config.SecretsProvider, field.ref)
+	}
+	if value == "" {
+		return fmt.Errorf("error resolving %s from %s secret: %s, its value is empty", field.name, config.SecretsProvider, field.ref)
+	}
+
+	*field.value = value
+	logrus.WithField("field", field.name).WithField("secret", field.ref).Debug("resolved secret")
+	return nil
+}
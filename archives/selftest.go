@@ -0,0 +1,278 @@
+package archives
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// the schema our self test runs in, its tables shadow the ones we use so that no real data is ever touched
+const selfTestSchema = "archiver_selftest"
+
+// the id of our synthetic org, which can never be a real org so our S3 keys never collide with real archives
+const selfTestOrgID = -1
+
+// the tables we shadow for our self test, any which don't exist in our database are left out
+var selfTestTables = []string{
+	"orgs_org", "auth_user", "channels_channel", "channels_channellog", "contacts_contact", "contacts_contacturn",
+	"contacts_contactgroup_contacts", "flows_flow", "flows_flowrun", "flows_flowpathrecentrun", "msgs_label",
+	"msgs_msg", "msgs_msg_labels", "msgs_broadcast", "msgs_broadcast_contacts", "msgs_broadcast_groups",
+	"msgs_broadcast_urns", "msgs_broadcastmsgcount", "archives_archive",
+}
+
+// our shadow tables only need the columns we insert to be set
+const dropSelfTestNotNulls = `
+DO $$
+DECLARE col record;
+BEGIN
+	FOR col IN SELECT table_name, column_name FROM information_schema.columns WHERE table_schema = 'archiver_selftest' AND is_nullable = 'NO' AND column_name != 'id' LOOP
+		EXECUTE format('ALTER TABLE archiver_selftest.%I ALTER COLUMN %I DROP NOT NULL', col.table_name, col.column_name);
+	END LOOP;
+END $$;
+`
+
+// SelfTestResult is the outcome of a self test, with the archives of each type it created and deleted
+type SelfTestResult struct {
+	Created map[ArchiveType][]*Archive
+	Deleted map[ArchiveType][]*Archive
+	Elapsed time.Duration
+}
+
+// RunSelfTest archives a synthetic org end to end against our database and S3, building, uploading, rolling up,
+// verifying and deleting its archives, to validate our config and permissions without touching real orgs. The org
+// lives in its own schema which is dropped afterwards, along with every object we uploaded.
+func RunSelfTest(ctx context.Context, now time.Time, config *Config, s3Client Storage) (*SelfTestResult, error) {
+	if !config.UploadToS3 {
+		return nil, fmt.Errorf("self test requires uploading to s3")
+	}
+	start := time.Now()
+
+	adminDB, err := OpenDB(config.DB)
+	if err != nil {
+		return nil, err
+	}
+	defer adminDB.Close()
+
+	err = CheckSettingsTables(ctx, adminDB)
+	if err != nil {
+		return nil, err
+	}
+
+	err = createSelfTestSchema(ctx, adminDB)
+	defer dropSelfTestSchema(adminDB)
+	if err != nil {
+		return nil, err
+	}
+
+	dsn, err := selfTestDSN(config.DB)
+	if err != nil {
+		return nil, err
+	}
+	db, err := OpenDB(dsn)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	defer deleteSelfTestObjects(db, s3Client)
+
+	// our org has a complete month of dailies before our retention period, so they get rolled up
+	testConfig := *config
+	testConfig.Delete = true
+	testConfig.ArchiveLagDays = 0
+	testConfig.KeepFiles = false
+	testConfig.ContactGroupID = 0
+	testConfig.DailyGranularityDays = 62
+	testConfig.VerifyRollupCounts = true
+	testConfig.CompactEmptyArchives = false
+	testConfig.OrgNotifications = false
+
+	cutoff := now.AddDate(0, 0, -config.RetentionPeriod)
+	orgStart := time.Date(cutoff.Year(), cutoff.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, -1, 0)
+
+	err = populateSelfTestOrg(ctx, db, orgStart)
+	if err != nil {
+		return nil, err
+	}
+
+	org, err := GetOrg(ctx, db, &testConfig, selfTestOrgID)
+	if err != nil || org == nil {
+		return nil, errors.Wrap(err, "error looking up self test org")
+	}
+
+	result := &SelfTestResult{Created: make(map[ArchiveType][]*Archive), Deleted: make(map[ArchiveType][]*Archive)}
+	for _, archiveType := range []ArchiveType{MessageType, RunType} {
+		created, deleted, err := ArchiveOrg(ctx, now, &testConfig, db, s3Client, *org, archiveType)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error archiving %s records", archiveType)
+		}
+		result.Created[archiveType] = created
+		result.Deleted[archiveType] = deleted
+
+		err = checkSelfTestArchives(ctx, db, archiveType, created, deleted)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result.Elapsed = time.Since(start)
+	return result, nil
+}
+
+// checkSelfTestArchives checks that our record was archived in a daily and its monthly, and then deleted
+func checkSelfTestArchives(ctx context.Context, db *sqlx.DB, archiveType ArchiveType, created []*Archive, deleted []*Archive) error {
+	var monthly *Archive
+	for _, a := range created {
+		if a.ID == 0 {
+			return fmt.Errorf("failed to create %s archive for: %s", archiveType, a.StartDate.Format("2006-01-02"))
+		}
+		if a.Period == MonthPeriod {
+			monthly = a
+		}
+	}
+	if monthly == nil || monthly.RecordCount != 1 || len(monthly.Dailies) == 0 {
+		return fmt.Errorf("%s records weren't rolled up into a monthly archive", archiveType)
+	}
+	if len(deleted) == 0 {
+		return fmt.Errorf("no %s records were deleted", archiveType)
+	}
+
+	var pending int
+	err := db.GetContext(ctx, &pending, `SELECT count(*) FROM archives_archive WHERE org_id = $1 AND archive_type = $2 AND needs_deletion = TRUE`, selfTestOrgID, archiveType)
+	if err != nil {
+		return errors.Wrapf(err, "error counting %s archives needing deletion", archiveType)
+	}
+	if pending != 0 {
+		return fmt.Errorf("%d %s archives still need deletion", pending, archiveType)
+	}
+
+	table := "msgs_msg"
+	if archiveType == RunType {
+		table = "flows_flowrun"
+	}
+
+	var remaining int
+	err = db.GetContext(ctx, &remaining, fmt.Sprintf(`SELECT count(*) FROM %s WHERE org_id = $1`, table), selfTestOrgID)
+	if err != nil {
+		return errors.Wrapf(err, "error counting remaining %s records", archiveType)
+	}
+	if remaining != 0 {
+		return fmt.Errorf("%d %s records remain after deletion", remaining, archiveType)
+	}
+	return nil
+}
+
+// selfTestDSN returns the passed in connection string with its search path limited to our self test schema
+func selfTestDSN(dsn string) (string, error) {
+	if strings.Contains(dsn, "://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return "", errors.Wrap(err, "invalid db connection string")
+		}
+		query := u.Query()
+		query.Set("search_path", selfTestSchema)
+		u.RawQuery = query.Encode()
+		return u.String(), nil
+	}
+	return dsn + " search_path=" + selfTestSchema, nil
+}
+
+func createSelfTestSchema(ctx context.Context, db *sqlx.DB) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`DROP SCHEMA IF EXISTS %[1]s CASCADE; CREATE SCHEMA %[1]s`, selfTestSchema))
+	if err != nil {
+		return errors.Wrap(err, "error creating self test schema")
+	}
+
+	for _, table := range selfTestTables {
+		var exists bool
+		err := db.GetContext(ctx, &exists, `SELECT to_regclass('public.' || $1) IS NOT NULL`, table)
+		if err != nil {
+			return errors.Wrapf(err, "error checking for table: %s", table)
+		}
+		if !exists {
+			continue
+		}
+
+		_, err = db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE %[1]s.%[2]s (LIKE public.%[2]s INCLUDING DEFAULTS)`, selfTestSchema, table))
+		if err != nil {
+			return errors.Wrapf(err, "error creating self test table: %s", table)
+		}
+	}
+
+	_, err = db.ExecContext(ctx, dropSelfTestNotNulls)
+	if err != nil {
+		return errors.Wrap(err, "error relaxing self test tables")
+	}
+
+	// our own tables are copied whole, as we rely on their keys
+	for _, table := range settingsTables {
+		_, err = db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE %[1]s.%[2]s (LIKE public.%[2]s INCLUDING ALL)`, selfTestSchema, table))
+		if err != nil {
+			return errors.Wrapf(err, "error creating self test table: %s", table)
+		}
+	}
+	return nil
+}
+
+func dropSelfTestSchema(db *sqlx.DB) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`DROP SCHEMA IF EXISTS %s CASCADE`, selfTestSchema))
+	if err != nil {
+		logrus.WithError(err).Error("error dropping self test schema")
+	}
+}
+
+// deleteSelfTestObjects deletes every object uploaded for our self test org
+func deleteSelfTestObjects(db *sqlx.DB, s3Client Storage) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+	defer cancel()
+
+	urls := make([]string, 0)
+	err := db.SelectContext(ctx, &urls, `SELECT url FROM archives_archive WHERE org_id = $1 AND url != ''`, selfTestOrgID)
+	if err != nil {
+		logrus.WithError(err).Error("error looking up self test archives")
+		return
+	}
+
+	for _, u := range urls {
+		err := deleteArchiveObject(ctx, s3Client, u)
+		if err != nil {
+			logrus.WithError(err).WithField("url", u).Error("error deleting self test archive")
+		}
+	}
+}
+
+// populateSelfTestOrg creates our synthetic org with a single message and run on its second day
+func populateSelfTestOrg(ctx context.Context, db *sqlx.DB, orgStart time.Time) error {
+	recordTime := orgStart.AddDate(0, 0, 1).Add(time.Hour * 12)
+
+	inserts := []struct {
+		query string
+		args  []interface{}
+	}{
+		{`INSERT INTO orgs_org(id, name, is_active, is_anon, created_on) VALUES($1, 'Archiver Self Test', TRUE, FALSE, $2)`, []interface{}{selfTestOrgID, orgStart}},
+		{`INSERT INTO channels_channel(id, uuid, name, org_id) VALUES(1, 'd6e2b9a4-7f3c-4c1e-9a5b-3e8f2d1c0b7a', 'Self Test Channel', $1)`, []interface{}{selfTestOrgID}},
+		{`INSERT INTO contacts_contact(id, uuid, name, org_id, is_active, created_on, modified_on) VALUES(1, '8b4f1e2d-3c5a-4d6e-8f7a-1b2c3d4e5f60', 'Self Test Contact', $1, TRUE, $2, $2)`, []interface{}{selfTestOrgID, orgStart}},
+		{`INSERT INTO contacts_contacturn(id, contact_id, scheme, org_id, priority, path, identity, channel_id) VALUES(1, 1, 'tel', $1, 50, '+12065550100', 'tel:+12065550100', 1)`, []interface{}{selfTestOrgID}},
+		{`INSERT INTO flows_flow(id, uuid, name) VALUES(1, '4a7c9e1f-2b3d-4e5f-a6b7-c8d9e0f1a2b3', 'Self Test Flow')`, nil},
+		{`INSERT INTO msgs_msg(id, uuid, text, created_on, sent_on, modified_on, direction, status, visibility, msg_type, contact_id, contact_urn_id, channel_id, org_id)
+		  VALUES(1, 'f1e2d3c4-b5a6-4978-8a9b-0c1d2e3f4a5b', 'self test', $2, $2, $2, 'I', 'H', 'V', 'I', 1, 1, 1, $1)`, []interface{}{selfTestOrgID, recordTime}},
+		{`INSERT INTO flows_flowrun(id, uuid, responded, contact_id, flow_id, org_id, results, path, events, is_active, created_on, modified_on, exited_on, status, exit_type)
+		  VALUES(1, '0c9b8a7f-6e5d-4c3b-9a2f-1e0d9c8b7a6f', TRUE, 1, 1, $1, '{}', '[]', '[]', FALSE, $2, $2, $2, 'C', 'C')`, []interface{}{selfTestOrgID, recordTime}},
+	}
+
+	for _, insert := range inserts {
+		_, err := db.ExecContext(ctx, insert.query, insert.args...)
+		if err != nil {
+			return errors.Wrap(err, "error creating self test org")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+package archives
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// sessions are archived by the day they ended, so sessions still waiting are left until they end, and are written in
+// order of ended_on, ties broken by id. Their contact always has a uuid and a name unless the org is anon.
+const lookupSessions = `
+SELECT rec.id, row_to_json(rec) FROM (
+	SELECT
+	  fs.id,
+	  fs.uuid,
+	  CASE WHEN $1 THEN row_to_json(anon_contact) ELSE row_to_json(contact) END as contact,
+	  CASE WHEN fs.status = 'C' THEN 'completed'
+		WHEN fs.status = 'I' THEN 'interrupted'
+		WHEN fs.status = 'X' THEN 'expired'
+		WHEN fs.status = 'F' THEN 'failed'
+		ELSE NULL
+	  END as status,
+	  fs.created_on,
+	  fs.ended_on,
+	  fs.output::jsonb as output
+	FROM flows_flowsession fs
+	  JOIN LATERAL (SELECT uuid, name FROM contacts_contact cc WHERE cc.id = fs.contact_id) AS contact ON True
+	  JOIN LATERAL (SELECT uuid FROM contacts_contact cc WHERE cc.id = fs.contact_id) AS anon_contact ON True
+	WHERE fs.org_id = $2 AND fs.ended_on >= $3 AND fs.ended_on < $4 AND ($5 = 0 OR fs.contact_id IN (SELECT contact_id FROM contacts_contactgroup_contacts WHERE contactgroup_id = $5))
+	) rec
+ORDER BY rec.ended_on ASC, rec.id ASC;
+`
+
+const lookupEarliestSession = `
+SELECT MIN(ended_on) FROM flows_flowsession WHERE org_id = $1 AND ended_on < $2
+`
+
+const countSessionsInRange = `
+SELECT count(*) FROM flows_flowsession fs WHERE fs.org_id = $1 AND fs.ended_on >= $2 AND fs.ended_on < $3
+`
+
+// writeSessionRecords writes the sessions which ended in the archive's date range to the passed in writer
+func writeSessionRecords(ctx context.Context, db *sqlx.DB, config *Config, archive *Archive, writer *bufio.Writer) (int, error) {
+	rows, err := db.QueryxContext(ctx, lookupSessions, archive.Org.IsAnon, archive.Org.ID, archive.StartDate, archive.EndDate(), config.ContactGroupID)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error querying sessions for org: %d", archive.Org.ID)
+	}
+	defer rows.Close()
+
+	recordCount := 0
+	var record string
+	var sessionID int64
+	for rows.Next() {
+		err = rows.Scan(&sessionID, &record)
+		if err != nil {
+			return 0, errors.Wrapf(err, "error scanning session row for org: %d", archive.Org.ID)
+		}
+
+		// the output of a session has the URNs of its contact wherever it refers to them
+		if archive.Org.IsAnon {
+			redacted, _, err := scrubRecord(SessionType, json.RawMessage(record))
+			if err != nil {
+				return 0, errors.Wrapf(err, "error redacting session: %d", sessionID)
+			}
+			record = string(redacted)
+		}
+
+		if config.CanonicalJSON {
+			record, err = canonicalizeRecord(record)
+			if err != nil {
+				return 0, errors.Wrapf(err, "error canonicalizing session: %d", sessionID)
+			}
+		}
+
+		writer.WriteString(record)
+		writer.WriteString("\n")
+		recordCount++
+	}
+
+	// a dropped connection ends our iteration early, make sure we never treat that as a complete archive
+	err = rows.Err()
+	if err != nil {
+		return 0, errors.Wrapf(err, "error reading session rows for org: %d", archive.Org.ID)
+	}
+
+	logrus.WithField("record_count", recordCount).Debug("Done Writing")
+	return recordCount, nil
+}
+
+// redactSession removes every URN and contact name from the passed in decoded session, as we do for the messages of
+// anon orgs
+func redactSession(value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			switch key {
+			case "urn":
+				v[key] = nil
+			case "urns":
+				delete(v, key)
+			case "contact":
+				if contact, ok := child.(map[string]interface{}); ok {
+					delete(contact, "name")
+				}
+				redactSession(child)
+			default:
+				redactSession(child)
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			redactSession(child)
+		}
+	}
+}
+
+const selectOrgSessionsInRange = `
+SELECT fs.id, fs.status
+FROM flows_flowsession fs
+WHERE fs.org_id = $1 AND fs.ended_on >= $2 AND fs.ended_on < $3
+ORDER BY fs.ended_on ASC, fs.id ASC
+`
+
+const unlinkSessionRuns = `
+UPDATE flows_flowrun
+SET session_id = NULL
+WHERE session_id IN(?)
+`
+
+const deleteSessions = `
+DELETE FROM flows_flowsession
+WHERE id IN(?)
+`
+
+// DeleteArchivedSessions takes the passed in archive, verifies the S3 file is still present (and correct), then
+// selects all the sessions in the archive date range, and if equal or fewer than the number archived, deletes them
+//
+// Upon completion it updates the needs_deletion flag on the archive
+func DeleteArchivedSessions(ctx context.Context, config *Config, db *sqlx.DB, s3Client Storage, archive *Archive) error {
+	outer, cancel := context.WithTimeout(ctx, time.Hour*3)
+	defer cancel()
+
+	start := time.Now()
+	log := logrus.WithFields(logrus.Fields{
+		"id":           archive.ID,
+		"org_id":       archive.OrgID,
+		"start_date":   archive.StartDate,
+		"end_date":     archive.EndDate(),
+		"archive_type": archive.ArchiveType,
+		"total_count":  archive.RecordCount,
+	})
+	log.Info("deleting sessions")
+
+	// first things first, make sure our file is present on S3 and matches what we archived, we never delete
+	// records that aren't backed by a valid archive
+	err := verifyArchive(outer, s3Client, archive)
+	if err != nil {
+		return errors.Wrap(err, "refusing to delete, archive not verified")
+	}
+
+	// ok, archive file looks good, in strict mode we delete exactly the sessions in it, otherwise those in its period
+	if config.DeleteByArchiveContents {
+		err = deleteArchiveContents(outer, config, db, s3Client, archive, deleteSessionBatch)
+	} else {
+		err = deleteSessionsInPeriod(outer, db, archive, log)
+	}
+	if err != nil {
+		return err
+	}
+
+	outer, cancel = context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	deletedOn := time.Now()
+
+	// all went well! mark our archive as no longer needing deletion
+	_, err = db.ExecContext(outer, setArchiveDeleted, archive.ID, deletedOn)
+	if err != nil {
+		return errors.Wrap(err, "error setting archive as deleted")
+	}
+	archive.NeedsDeletion = false
+	archive.DeletedOn = &deletedOn
+
+	logrus.WithField("elapsed", time.Since(start)).Info("completed deleting sessions")
+
+	return nil
+}
+
+// deleteSessionsInPeriod deletes the sessions in the period of the passed in archive, if there are no more of them than
+// the archive has
+func deleteSessionsInPeriod(ctx context.Context, db *sqlx.DB, archive *Archive, log *logrus.Entry) error {
+	rows, err := db.QueryxContext(ctx, selectOrgSessionsInRange, archive.OrgID, archive.StartDate, archive.EndDate())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var sessionID int64
+	var status string
+	sessionIDs := make([]int64, 0, archive.RecordCount)
+	for rows.Next() {
+		err = rows.Scan(&sessionID, &status)
+		if err != nil {
+			return err
+		}
+
+		// a session which ended can't be waiting, if this one is something has gone wrong
+		if status == "W" {
+			return fmt.Errorf("session %d in archive is still waiting", sessionID)
+		}
+		sessionIDs = append(sessionIDs, sessionID)
+	}
+	rows.Close()
+
+	log.WithField("session_count", len(sessionIDs)).Debug("found sessions")
+
+	// verify we don't see more sessions than there are in our archive (fewer is ok)
+	if len(sessionIDs) > archive.RecordCount {
+		return fmt.Errorf("more sessions in the database: %d than in archive: %d", len(sessionIDs), archive.RecordCount)
+	}
+
+	// ok, delete our sessions in batches
+	for _, idBatch := range chunkIDs(sessionIDs, deleteTransactionSize) {
+		err = deleteSessionBatch(ctx, db, idBatch)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteSessionBatch deletes the passed in sessions, first unlinking any runs of them which haven't been deleted yet
+// as those are archived and deleted on their own
+func deleteSessionBatch(ctx context.Context, db *sqlx.DB, idBatch []int64) error {
+	// no single batch should take more than a few minutes
+	ctx, cancel := context.WithTimeout(ctx, time.Minute*15)
+	defer cancel()
+
+	start := time.Now()
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = executeInQuery(ctx, tx, unlinkSessionRuns, idBatch)
+	if err != nil {
+		return errors.Wrap(err, "error unlinking session runs")
+	}
+
+	err = executeInQuery(ctx, tx, deleteSessions, idBatch)
+	if err != nil {
+		return errors.Wrap(err, "error deleting sessions")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "error committing session delete transaction")
+	}
+
+	logrus.WithField("elapsed", time.Since(start)).WithField("count", len(idBatch)).Debug("deleted batch of sessions")
+	return nil
+}
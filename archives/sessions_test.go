@@ -0,0 +1,103 @@
+package archives
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchiveSessions(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+
+	config := NewConfig()
+	config.ArchiveSessions = true
+	config.Delete = true
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	readSessions := func(archive *Archive) []map[string]interface{} {
+		err := CreateArchiveFile(ctx, db, config, archive, "/tmp")
+		assert.NoError(t, err)
+		defer DeleteArchiveFile(archive)
+
+		file, err := os.Open(archive.ArchiveFile)
+		assert.NoError(t, err)
+		defer file.Close()
+		reader, err := gzip.NewReader(file)
+		assert.NoError(t, err)
+
+		sessions := make([]map[string]interface{}, 0)
+		decoder := json.NewDecoder(reader)
+		for decoder.More() {
+			session := make(map[string]interface{})
+			assert.NoError(t, decoder.Decode(&session))
+			delete(session, "created_on")
+			delete(session, "ended_on")
+			sessions = append(sessions, session)
+		}
+		assert.Equal(t, len(sessions), archive.RecordCount)
+		return sessions
+	}
+
+	// sessions are archived by the day they ended, those still waiting are left out
+	aug12 := time.Date(2017, 8, 12, 0, 0, 0, 0, time.UTC)
+	sessions := readSessions(&Archive{Org: orgs[1], OrgID: orgs[1].ID, ArchiveType: SessionType, Period: DayPeriod, StartDate: aug12})
+	assert.Equal(t, []map[string]interface{}{{
+		"id":      float64(1),
+		"uuid":    "9a4b2c1e-6f3d-4e8a-b7c5-2d1e0f9a8b7c",
+		"contact": map[string]interface{}{"uuid": "3e814add-e614-41f7-8b5d-a07f670a698f", "name": "Ajodinabiff Dane"},
+		"status":  "completed",
+		"output": map[string]interface{}{
+			"contact": map[string]interface{}{"uuid": "3e814add-e614-41f7-8b5d-a07f670a698f", "name": "Ajodinabiff Dane", "urns": []interface{}{"tel:+12067797777"}},
+			"runs": []interface{}{map[string]interface{}{"events": []interface{}{
+				map[string]interface{}{"type": "msg_created", "msg": map[string]interface{}{"urn": "tel:+12067797777", "text": "hola"}},
+			}}},
+		},
+	}}, sessions)
+
+	aug13 := time.Date(2017, 8, 13, 0, 0, 0, 0, time.UTC)
+	sessions = readSessions(&Archive{Org: orgs[1], OrgID: orgs[1].ID, ArchiveType: SessionType, Period: DayPeriod, StartDate: aug13})
+	assert.Equal(t, 1, len(sessions))
+	assert.Equal(t, "expired", sessions[0]["status"])
+	assert.Nil(t, sessions[0]["output"])
+
+	// anon orgs never have names or URNs written, wherever they are in the output
+	sessions = readSessions(&Archive{Org: orgs[2], OrgID: orgs[2].ID, ArchiveType: SessionType, Period: DayPeriod, StartDate: aug12})
+	assert.Equal(t, 1, len(sessions))
+	assert.Equal(t, map[string]interface{}{"uuid": "7051dff0-0a27-49d7-af1f-4494239139e6"}, sessions[0]["contact"])
+	assert.Equal(t, map[string]interface{}{
+		"contact": map[string]interface{}{"uuid": "7051dff0-0a27-49d7-af1f-4494239139e6"},
+		"runs": []interface{}{map[string]interface{}{"events": []interface{}{
+			map[string]interface{}{"type": "msg_created", "msg": map[string]interface{}{"urn": nil, "text": "hi"}},
+		}}},
+	}, sessions[0]["output"])
+
+	tasks, err := GetMissingDailyArchives(ctx, db, now, orgs[1], SessionType)
+	assert.NoError(t, err)
+	assert.Equal(t, 62, len(tasks))
+
+	// once archived, the sessions which ended are deleted, and their runs unlinked from them
+	result, err := ArchiveOrgPhasesWithResult(ctx, now, config, db, s3Client, orgs[1], SessionType, AllPhases)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(result.Failed()))
+	assertCount(t, db, 0, `SELECT count(*) FROM flows_flowsession WHERE id IN (1, 2)`)
+	assertCount(t, db, 2, `SELECT count(*) FROM flows_flowsession WHERE id IN (3, 4)`)
+	assertCount(t, db, 1, `SELECT count(*) FROM flows_flowrun WHERE id = 1 AND session_id IS NULL`)
+}
+
+func TestRedactSession(t *testing.T) {
+	raw := `{"id":1,"contact":{"uuid":"3e814add","name":"Dane"},"output":{"contact":{"name":"Dane","urns":["tel:+1"]},"runs":[{"events":[{"msg":{"urn":"tel:+1","text":"<3"}}]}]}}`
+
+	redacted, changed, err := scrubRecord(SessionType, json.RawMessage(raw))
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, `{"contact":{"uuid":"3e814add"},"id":1,"output":{"contact":{},"runs":[{"events":[{"msg":{"text":"<3","urn":null}}]}]}}`, string(redacted))
+}
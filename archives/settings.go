@@ -0,0 +1,124 @@
+package archives
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// the tables the archiver keeps its own state in, we never create these ourselves, they are created by the migrations
+// in migrations/ which must be applied to our database before we run
+var settingsTables = []string{
+	"archiver_settings", "archiver_archive_versions", "archiver_group_exports", "archiver_skipped_records",
+	"archiver_archive_contacts", "archiver_rapidpro_notifications", "archiver_partial_archives",
+	"archiver_archive_verifications", "archiver_archive_renditions",
+}
+
+// CheckSettingsTables returns an error if any of our settings tables don't exist, which happens when our migrations
+// haven't been applied to our database
+func CheckSettingsTables(ctx context.Context, db *sqlx.DB) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	tables := make([]string, 0)
+	err := db.SelectContext(ctx, &tables, selectTables)
+	if err != nil {
+		return errors.Wrapf(err, "error selecting tables")
+	}
+	existing := make(map[string]bool, len(tables))
+	for _, t := range tables {
+		existing[t] = true
+	}
+
+	missing := missingFrom(existing, settingsTables)
+	if len(missing) > 0 {
+		return errors.Errorf("archiver tables missing from our database: %s, apply the migrations in migrations/ to create them", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+const selectSetting = `
+SELECT value FROM archiver_settings WHERE key = $1
+`
+
+// GetSetting returns the stored value for the passed in key, or an empty string if it has never been set
+func GetSetting(ctx context.Context, db *sqlx.DB, key string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	var value string
+	err := db.GetContext(ctx, &value, selectSetting, key)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "error reading setting: %s", key)
+	}
+	return value, nil
+}
+
+const upsertSetting = `
+INSERT INTO archiver_settings(key, value) VALUES($1, $2)
+ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value
+`
+
+// SetSetting stores the passed in value for the passed in key
+func SetSetting(ctx context.Context, db *sqlx.DB, key string, value string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, upsertSetting, key, value)
+	if err != nil {
+		return errors.Wrapf(err, "error writing setting: %s", key)
+	}
+	return nil
+}
+
+// the setting which pauses archiving while it is false, letting ops stop archiving without restarting us
+const enabledSetting = "enabled"
+
+// IsArchivingEnabled returns whether archiving is enabled, which it is unless our enabled setting is false
+func IsArchivingEnabled(ctx context.Context, db *sqlx.DB) (bool, error) {
+	value, err := GetSetting(ctx, db, enabledSetting)
+	if err != nil {
+		return false, err
+	}
+	return !strings.EqualFold(strings.TrimSpace(value), "false"), nil
+}
+
+// WaitUntilEnabled blocks while archiving is paused, checking again every poll interval. Errors reading our setting
+// are logged and treated as enabled, a broken kill switch shouldn't stop archiving.
+func WaitUntilEnabled(ctx context.Context, db *sqlx.DB, pollInterval time.Duration) error {
+	var pausedOn time.Time
+
+	for {
+		enabled, err := IsArchivingEnabled(ctx, db)
+		if err != nil {
+			logrus.WithError(err).Error("error checking whether archiving is enabled, continuing")
+			enabled = true
+		}
+
+		if enabled {
+			if !pausedOn.IsZero() {
+				logrus.WithField("paused_for", time.Since(pausedOn)).Info("archiving enabled, resuming")
+			}
+			return nil
+		}
+
+		if pausedOn.IsZero() {
+			pausedOn = time.Now()
+			logrus.Warn("archiving disabled, pausing until enabled")
+		}
+
+		select {
+		case <-time.After(pollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
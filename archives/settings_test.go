@@ -0,0 +1,39 @@
+package archives
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWaitUntilEnabled(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+
+	// enabled until told otherwise
+	enabled, err := IsArchivingEnabled(ctx, db)
+	assert.NoError(t, err)
+	assert.True(t, enabled)
+	assert.NoError(t, WaitUntilEnabled(ctx, db, time.Millisecond*10))
+
+	assert.NoError(t, SetSetting(ctx, db, enabledSetting, "FALSE"))
+	enabled, err = IsArchivingEnabled(ctx, db)
+	assert.NoError(t, err)
+	assert.False(t, enabled)
+
+	// we stay paused until our context is done
+	timeout, cancel := context.WithTimeout(ctx, time.Millisecond*50)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, WaitUntilEnabled(timeout, db, time.Millisecond*10))
+
+	// or until we're enabled again
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		SetSetting(ctx, db, enabledSetting, "true")
+	}()
+	start := time.Now()
+	assert.NoError(t, WaitUntilEnabled(ctx, db, time.Millisecond*10))
+	assert.True(t, time.Since(start) >= time.Millisecond*50)
+}
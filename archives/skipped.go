@@ -0,0 +1,53 @@
+package archives
+
+import (
+	"context"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var skippedRecords = newCounter("archiver_skipped_records_total", "Number of records too big to archive which were left in place.", "archive_type")
+
+// skippedRecord is a record we didn't archive because its serialized size was over our limit
+type skippedRecord struct {
+	ID   int64
+	Size int
+}
+
+const insertSkippedRecord = `
+INSERT INTO archiver_skipped_records(archive_type, record_id, org_id, size, skipped_on) VALUES($1, $2, $3, $4, NOW())
+ON CONFLICT (archive_type, record_id) DO UPDATE SET size = EXCLUDED.size
+`
+
+// recordSkippedRecords reports the records of the passed in archive which were too big to archive, recording them so
+// that they are never deleted or counted as missing from the archive
+func recordSkippedRecords(ctx context.Context, db *sqlx.DB, archive *Archive, skipped []skippedRecord) error {
+	if len(skipped) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	for _, r := range skipped {
+		_, err := db.ExecContext(ctx, insertSkippedRecord, archive.ArchiveType, r.ID, archive.Org.ID, r.Size)
+		if err != nil {
+			return errors.Wrapf(err, "error recording skipped %s: %d", archive.ArchiveType, r.ID)
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"org_id":       archive.Org.ID,
+			"archive_type": archive.ArchiveType,
+			"start_date":   archive.StartDate,
+			"period":       archive.Period,
+			"record_id":    r.ID,
+			"size":         r.Size,
+		}).Warn("skipped record too big to archive")
+
+		skippedRecords.add(1, string(archive.ArchiveType))
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package archives
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSkipOversizedRuns(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+
+	config := NewConfig()
+	config.MaxRecordBytes = 1000
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+
+	// one of the two runs on this day has a huge events blob
+	_, err = db.Exec(`UPDATE flows_flowrun SET events = jsonb_build_array(repeat('x', 5000)) WHERE id = 2`)
+	assert.NoError(t, err)
+
+	archive := &Archive{Org: orgs[1], OrgID: orgs[1].ID, ArchiveType: RunType, Period: DayPeriod, StartDate: time.Date(2017, 8, 12, 0, 0, 0, 0, time.UTC)}
+	err = CreateArchiveFile(ctx, db, config, archive, "/tmp")
+	assert.NoError(t, err)
+	defer DeleteArchiveFile(archive)
+
+	assert.Equal(t, 1, archive.RecordCount)
+	assertCount(t, db, 1, `SELECT count(*) FROM archiver_skipped_records WHERE archive_type = 'run' AND record_id = 2 AND org_id = 2 AND size > 5000`)
+
+	// rebuilding doesn't record it twice
+	DeleteArchiveFile(archive)
+	err = CreateArchiveFile(ctx, db, config, archive, "/tmp")
+	assert.NoError(t, err)
+	assertCount(t, db, 1, `SELECT count(*) FROM archiver_skipped_records`)
+
+	// it's never counted as missing from our archive or deleted with it
+	count, err := countArchiveRecords(ctx, db, config, archive)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	assert.NoError(t, UploadArchive(ctx, config, s3Client, config.S3Bucket, archive))
+	assert.NoError(t, WriteArchiveToDB(ctx, db, archive))
+	assert.NoError(t, DeleteArchivedRuns(ctx, config, db, s3Client, archive))
+
+	assertCount(t, db, 0, `SELECT count(*) FROM flows_flowrun WHERE id = 1`)
+	assertCount(t, db, 1, `SELECT count(*) FROM flows_flowrun WHERE id = 2`)
+}
@@ -0,0 +1,125 @@
+package archives
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// the storage backends we can write archives to
+const (
+	StorageS3    = "s3"
+	StorageGCS   = "gcs"
+	StorageAzure = "azure"
+)
+
+// StorageClient is what we need of a storage backend to write an object and read it back, such as our run reports
+// and checksum manifests
+type StorageClient interface {
+	// PutObject writes the passed in body of size bytes to the passed in key of the passed in bucket, returning the URL
+	// of the object
+	PutObject(ctx context.Context, bucket, key string, body io.Reader, size int64, contentType, contentEncoding string) (string, error)
+
+	// GetObject returns the contents of the object at the passed in URL, exactly as they were written
+	GetObject(ctx context.Context, url string) (io.ReadCloser, error)
+}
+
+// Storage is a backend we store archives in. Every backend writes archives under the same keys and returns the same
+// errors, so everything which reads and writes archives works the same against any of them. Keys start with a slash,
+// as they always have on S3.
+type Storage interface {
+	StorageClient
+
+	// URL returns the URL of the object with the passed in key in the passed in bucket
+	URL(bucket, key string) string
+
+	// SplitURL returns the bucket and key of the object at the passed in URL
+	SplitURL(url string) (string, string, error)
+
+	// Upload writes an archive of size bytes whose contents have the passed in hex encoded MD5, which the backend checks
+	// the body against and keeps so the archive can be verified, however it was uploaded
+	Upload(ctx context.Context, bucket, key string, body io.Reader, size int64, contentEncoding, md5 string) (string, error)
+
+	// UploadStream writes an archive whose size and hash we don't know until we've written it
+	UploadStream(ctx context.Context, bucket, key string, body io.Reader) (string, error)
+
+	// Download returns the contents of the archive at the passed in URL, as they were uploaded
+	Download(ctx context.Context, url string) (io.ReadCloser, error)
+
+	// Delete deletes the objects with the passed in keys from the passed in bucket, returning the result for each key,
+	// nil if it was deleted or didn't exist
+	Delete(ctx context.Context, bucket string, keys []string) map[string]error
+
+	// Stat returns the size, hash and storage class of the object at the passed in URL
+	Stat(ctx context.Context, url string) (*ObjectInfo, error)
+
+	// Copy copies the object at the passed in URL to the passed in key of the same bucket, with the passed in hex
+	// encoded MD5 if we have one, returning the URL of the copy
+	Copy(ctx context.Context, url, key, md5 string) (string, error)
+
+	// List returns the objects in the passed in bucket whose keys have the passed in prefix
+	List(ctx context.Context, bucket, prefix string) ([]*ObjectInfo, error)
+
+	// Restore requests the object at the passed in URL be restored from cold storage for the passed in days
+	Restore(ctx context.Context, url string, days int) error
+
+	// SignURL returns a URL the object at the passed in URL can be downloaded from without credentials until it expires
+	SignURL(url string, expires time.Duration) (string, error)
+}
+
+// ObjectInfo is what we know about a stored object without reading it
+type ObjectInfo struct {
+	Key  string
+	Size int64
+
+	// the hex encoded MD5 of the object, empty if the backend doesn't know it
+	MD5 string
+
+	// the S3 storage class of the object, and whether it is in cold storage but has been restored
+	StorageClass string
+	Restored     bool
+}
+
+// the error storage returns when an object or bucket doesn't exist
+const errCodeNotFound = "NotFound"
+
+// StorageError is an error returned by a storage backend, with the code S3 uses for it so we handle the errors of
+// every backend the same way
+type StorageError struct {
+	Code    string
+	Message string
+}
+
+func (e *StorageError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// storageErrorCode returns the code of the passed in storage error, or an empty string if it isn't one
+func storageErrorCode(err error) string {
+	if serr, ok := errors.Cause(err).(*StorageError); ok {
+		return serr.Code
+	}
+	return ""
+}
+
+// isNotFound returns whether the passed in error is our storage telling us an object doesn't exist
+func isNotFound(err error) bool {
+	return err != nil && storageErrorCode(err) == errCodeNotFound
+}
+
+// NewStorage creates the client of our configured storage backend
+func NewStorage(config *Config) (Storage, error) {
+	switch config.StorageType {
+	case StorageS3:
+		return NewS3Client(config)
+	case StorageGCS:
+		return NewGCSClient(config)
+	case StorageAzure:
+		return NewAzureBlobClient(config)
+	default:
+		return nil, fmt.Errorf("unknown storage type: %s", config.StorageType)
+	}
+}
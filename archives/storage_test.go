@@ -0,0 +1,48 @@
+package archives
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewStorage(t *testing.T) {
+	config := NewConfig()
+	config.StorageType = "ftp"
+	_, err := NewStorage(config)
+	assert.EqualError(t, err, "unknown storage type: ftp")
+
+	// our bucket is that of our storage type
+	config.StorageType = StorageGCS
+	config.GCSBucket = "gcs-archives"
+	assert.Equal(t, "gcs-archives", config.StorageBucket())
+
+	config.StorageType = StorageAzure
+	config.AzureContainerName = "azure-archives"
+	assert.Equal(t, "azure-archives", config.StorageBucket())
+
+	// backends which can't stream uploads refuse to start rather than failing on our first upload
+	config.StreamUploads = true
+	for _, backend := range []string{StorageGCS, StorageAzure} {
+		config.StorageType = backend
+		_, err = NewStorage(config)
+		assert.Error(t, err, "expected error for %s", backend)
+		assert.Contains(t, err.Error(), "streamed uploads aren't supported")
+	}
+}
+
+func TestStorageErrors(t *testing.T) {
+	notFound := &StorageError{Code: errCodeNotFound, Message: "no such key"}
+	assert.EqualError(t, notFound, "NotFound: no such key")
+
+	// we see through errors wrapped with more context
+	assert.True(t, isNotFound(notFound))
+	assert.True(t, isNotFound(errors.Wrapf(notFound, "error reading archive")))
+	assert.False(t, isNotFound(nil))
+	assert.False(t, isNotFound(fmt.Errorf("NotFound")))
+
+	assert.Equal(t, errCodeSlowDown, storageErrorCode(errors.Wrap(&StorageError{Code: errCodeSlowDown}, "error uploading")))
+	assert.Equal(t, "", storageErrorCode(fmt.Errorf("connection reset")))
+}
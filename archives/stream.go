@@ -0,0 +1,156 @@
+package archives
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	count int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.count += int64(len(p))
+	return len(p), nil
+}
+
+// StreamArchive builds the passed in archive from our database, compressing it straight into an upload to S3 so that
+// compression and upload overlap. Our key includes our hash which we only know at the end, so we upload to a
+// temporary key which is then copied to our real key.
+func StreamArchive(ctx context.Context, db *sqlx.DB, config *Config, s3Client Storage, archive *Archive) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Hour*3)
+	defer cancel()
+
+	start := time.Now()
+
+	log := logrus.WithFields(logrus.Fields{
+		"org_id":       archive.Org.ID,
+		"archive_type": archive.ArchiveType,
+		"start_date":   archive.StartDate,
+		"end_date":     archive.EndDate(),
+		"period":       archive.Period,
+	})
+
+	tempKey := fmt.Sprintf("/%d/%s_%s%d%02d%02d_%d.jsonl.gz.part", archive.Org.ID, archive.ArchiveType, archive.Period, archive.StartDate.Year(), archive.StartDate.Month(), archive.StartDate.Day(), start.UnixNano())
+
+	// log our progress periodically in case we take a long time
+	progress := startBuildProgress(log, time.Duration(config.HeartbeatInterval)*time.Second)
+	defer progress.finish()
+
+	// if our connection is dropped midway we start again with a new upload
+	var md5Hash hash.Hash
+	var counter *countingWriter
+	recordCount := 0
+
+	err := withConnectionRetry(ctx, db, func() error {
+		md5Hash = md5.New()
+		counter = &countingWriter{}
+		progress.reset()
+
+		reader, writer := io.Pipe()
+		uploaded := make(chan error, 1)
+		go func() {
+			_, err := s3Client.UploadStream(ctx, config.StorageBucket(), tempKey, limitReader(ctx, reader, uploadLimiter))
+
+			// if our upload fails, make sure our writes fail too instead of blocking
+			reader.CloseWithError(err)
+			uploaded <- err
+		}()
+
+		gzWriter := gzip.NewWriter(io.MultiWriter(writer, md5Hash, counter))
+		timed := &timedWriter{writer: gzWriter}
+		bufWriter := bufio.NewWriter(progress.counter(timed))
+		writeStart := time.Now()
+
+		var err error
+		recordCount, err = writeArchiveRecords(ctx, db, config, archive, bufWriter)
+		if err == nil {
+			err = writeEmptyHeader(config, archive, ArchiveSchemaVersion, recordCount, bufWriter)
+		}
+		extracted := time.Now()
+		if err == nil {
+			err = bufWriter.Flush()
+		}
+		if err == nil {
+			err = gzWriter.Close()
+		}
+
+		archive.Timings.Extraction = extracted.Sub(writeStart) - timed.elapsed
+		archive.Timings.Compression = time.Since(writeStart) - archive.Timings.Extraction
+
+		// closing our writer with a nil error ends our upload, anything else aborts it
+		writer.CloseWithError(err)
+		uploadErr := <-uploaded
+
+		// a failed upload fails our writes with the same error, otherwise our write error caused any upload error
+		if uploadErr != nil && (err == nil || err == uploadErr || err == io.ErrClosedPipe) {
+			return errors.Wrapf(uploadErr, "error uploading archive")
+		}
+		if err != nil {
+			return errors.Wrapf(err, "error writing archive")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	archive.Hash = hex.EncodeToString(md5Hash.Sum(nil))
+	archive.Size = counter.count
+	archive.RecordCount = recordCount
+	archive.BuildTime = int(time.Since(start) / time.Millisecond)
+	archive.Version = ArchiveSchemaVersion
+	archive.ContactGroupID = config.ContactGroupID
+
+	tempURL := s3Client.URL(config.StorageBucket(), tempKey)
+	defer deleteS3Object(ctx, s3Client, config.StorageBucket(), tempKey)
+
+	// a single copy is limited to 5 gigs, the same as the archives we allow
+	if archive.Size > 5e9 {
+		return fmt.Errorf("archive too large, must be smaller than 5 gigs, build dailies if possible")
+	}
+
+	// copy to our real key, adding the md5 which verifies it
+	copyStart := time.Now()
+	key := archiveS3Key(archive)
+	archive.URL, err = s3Client.Copy(ctx, tempURL, key, archive.Hash)
+	if err != nil {
+		return errors.Wrapf(err, "error copying archive to: %s", key)
+	}
+
+	archive.NeedsDeletion = recordsDeletable(config, archive.ArchiveType)
+	markWritten(archive.URL)
+	archive.Timings.Upload = time.Since(copyStart)
+	recordActivity(ActivityUploaded, archive)
+
+	log.WithFields(logrus.Fields{
+		"record_count": recordCount,
+		"url":          archive.URL,
+		"file_size":    archive.Size,
+		"file_hash":    archive.Hash,
+		"elapsed":      time.Since(start),
+	}).Debug("completed streaming archive")
+
+	logArchiveSummary(log, archive)
+	return nil
+}
+
+// deleteS3Object deletes the passed in key, logging any error
+func deleteS3Object(ctx context.Context, s3Client Storage, bucket string, key string) {
+	err := s3Client.Delete(ctx, bucket, []string{key})[key]
+	if err != nil {
+		logrus.WithError(err).WithField("key", key).Error("error deleting temporary s3 object")
+	}
+}
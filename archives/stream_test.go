@@ -0,0 +1,68 @@
+package archives
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamArchive(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+
+	// upload our streams to our mock, which doesn't support multipart uploads
+	defer func(original func(context.Context, s3iface.S3API, string, string, io.Reader) error) {
+		streamToS3 = original
+	}(streamToS3)
+	streamToS3 = func(ctx context.Context, s3Client s3iface.S3API, bucket string, key string, body io.Reader) error {
+		contents, err := ioutil.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		s3Client.(*mockS3API).putObject(bucket, key, contents)
+		return nil
+	}
+
+	config := NewConfig()
+	config.StreamUploads = true
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	tasks, err := GetMissingDailyArchives(ctx, db, now, orgs[1], MessageType)
+	assert.NoError(t, err)
+	task := tasks[2]
+
+	err = createArchive(ctx, db, config, s3Client, task)
+	assert.NoError(t, err)
+
+	// identical to the same archive built on disk
+	assert.Equal(t, 3, task.RecordCount)
+	assert.Equal(t, int64(483), task.Size)
+	assert.Equal(t, "6fe9265860425cf1f9757ba3d91b1a05", task.Hash)
+	assert.Equal(t, "", task.ArchiveFile)
+	assert.NotZero(t, task.ID)
+
+	// uploaded to our usual key, with our temporary upload removed
+	assert.Equal(t, "https://dl-archiver-test.s3.amazonaws.com/2/message_D20170812_6fe9265860425cf1f9757ba3d91b1a05.jsonl.gz", task.URL)
+	assert.Equal(t, 1, len(s3Client.objects))
+	assert.NoError(t, VerifyS3Archive(ctx, s3Client, task))
+
+	// a failed upload fails our archive
+	streamToS3 = func(ctx context.Context, s3Client s3iface.S3API, bucket string, key string, body io.Reader) error {
+		return fmt.Errorf("upload failed")
+	}
+
+	task = tasks[3]
+	err = StreamArchive(ctx, db, config, s3Client, task)
+	assert.EqualError(t, err, "error uploading archive: upload failed")
+	assert.Equal(t, "", task.URL)
+	assert.Equal(t, 1, len(s3Client.objects))
+}
@@ -0,0 +1,156 @@
+package archives
+
+import (
+	"encoding/json"
+)
+
+// the most channels we count messages of in a summary, messages of any others are counted as other
+const summaryMaxChannels = 50
+
+// the key the messages of the channels we don't list are counted under
+const summaryOtherChannels = "other"
+
+// the most distinct contacts or flows we count exactly, beyond that we estimate them with a fixed size sketch
+const summaryExactDistinct = 1000
+
+// ArchiveSummary is a lightweight summary of what an archive contains, useful for support without needing to
+// download the archive itself. Contacts and flows are estimated in archives with many of them, and only the busiest
+// channels are listed, the messages of any others counted as other.
+type ArchiveSummary struct {
+	Contacts int            `json:"contacts"`
+	Flows    int            `json:"flows,omitempty"`
+	Channels map[string]int `json:"channels,omitempty"`
+}
+
+// the subset of a record we need to summarize it
+type summaryRecord struct {
+	Contact *struct {
+		UUID string `json:"uuid"`
+	} `json:"contact"`
+	Flow *struct {
+		UUID string `json:"uuid"`
+	} `json:"flow"`
+	Channel *struct {
+		UUID string `json:"uuid"`
+	} `json:"channel"`
+}
+
+// summarizer aggregates an ArchiveSummary from the records written to an archive
+type summarizer struct {
+	archiveType ArchiveType
+	contacts    distinctCounter
+	flows       distinctCounter
+	channels    map[string]int
+	other       int
+}
+
+// newSummarizer returns a summarizer if summaries are enabled, nil otherwise
+func newSummarizer(config *Config, archiveType ArchiveType) *summarizer {
+	if !config.ComputeSummary {
+		return nil
+	}
+	return &summarizer{
+		archiveType: archiveType,
+		channels:    make(map[string]int),
+	}
+}
+
+// add adds the passed in JSON record to our summary, it is safe to call on a nil summarizer
+func (s *summarizer) add(record string) {
+	if s == nil {
+		return
+	}
+
+	parsed := &summaryRecord{}
+	if err := json.Unmarshal([]byte(record), parsed); err != nil {
+		return
+	}
+
+	if parsed.Contact != nil {
+		s.contacts.add(parsed.Contact.UUID)
+	}
+	if parsed.Flow != nil {
+		s.flows.add(parsed.Flow.UUID)
+	}
+	if s.archiveType == MessageType {
+		if parsed.Channel != nil {
+			s.addChannel(parsed.Channel.UUID)
+		} else {
+			s.addChannel("none")
+		}
+	}
+}
+
+// addChannel counts a message of the passed in channel. Once we're counting as many channels as we list, a new channel
+// takes the place of the one with the fewest messages, whose messages are counted as other from then on, so the
+// channels we list are the busiest and the counts of those which took the place of another may be short.
+func (s *summarizer) addChannel(channel string) {
+	if _, counted := s.channels[channel]; counted || len(s.channels) < summaryMaxChannels {
+		s.channels[channel]++
+		return
+	}
+
+	fewest := ""
+	for c, count := range s.channels {
+		if fewest == "" || count < s.channels[fewest] || (count == s.channels[fewest] && c < fewest) {
+			fewest = c
+		}
+	}
+	s.other += s.channels[fewest]
+	delete(s.channels, fewest)
+	s.channels[channel] = 1
+}
+
+// summary returns the summary of all records added, nil if we are a nil summarizer
+func (s *summarizer) summary() *ArchiveSummary {
+	if s == nil {
+		return nil
+	}
+
+	summary := &ArchiveSummary{
+		Contacts: s.contacts.count(),
+		Flows:    s.flows.count(),
+	}
+	if len(s.channels) > 0 {
+		summary.Channels = s.channels
+		if s.other > 0 {
+			summary.Channels[summaryOtherChannels] = s.other
+		}
+	}
+	return summary
+}
+
+// distinctCounter counts distinct values, exactly until it has seen summaryExactDistinct of them, then estimating
+// them with a sketch, so it never grows beyond a fixed size however many there are
+type distinctCounter struct {
+	exact  map[string]bool
+	sketch *hyperLogLog
+}
+
+func (c *distinctCounter) add(value string) {
+	if c.sketch != nil {
+		c.sketch.add(value)
+		return
+	}
+
+	if c.exact == nil {
+		c.exact = make(map[string]bool)
+	}
+	c.exact[value] = true
+
+	// too many to count exactly, switch to our sketch
+	if len(c.exact) > summaryExactDistinct {
+		c.sketch = newHyperLogLog()
+		for v := range c.exact {
+			c.sketch.add(v)
+		}
+		c.exact = nil
+	}
+}
+
+func (c *distinctCounter) count() int {
+	if c.sketch != nil {
+		return c.sketch.count()
+	}
+	return len(c.exact)
+}
@@ -0,0 +1,204 @@
+package archives
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	uploadConcurrency = newGauge("archiver_s3_upload_concurrency", "The number of archives we currently allow to be uploaded to S3 at once, 0 if unlimited.")
+	slowDowns         = newCounter("archiver_s3_slow_downs_total", "Number of SlowDown responses from S3 to our uploads.")
+)
+
+// the error S3 returns when we are making requests faster than it wants
+const errCodeSlowDown = "SlowDown"
+
+// isSlowDown returns whether the passed in error is our storage asking us to slow down
+func isSlowDown(err error) bool {
+	return storageErrorCode(err) == errCodeSlowDown
+}
+
+// uploadThrottle limits how many uploads are in flight at once, shared by all uploads so that together they respect
+// our limit. When S3 repeatedly asks us to slow down we halve our limit, then ramp it back up one upload at a time
+// after each quiet period without being asked again.
+type uploadThrottle struct {
+	mutex    sync.Mutex
+	released chan struct{}
+
+	max       int
+	limit     int
+	inFlight  int
+	threshold int
+	quiet     time.Duration
+	retries   int
+	backoff   time.Duration
+
+	// the SlowDowns since we last lowered our limit, and when our limit last changed or we were last slowed down
+	slowDowns int
+	last      time.Time
+}
+
+func newUploadThrottle() *uploadThrottle {
+	return &uploadThrottle{released: make(chan struct{})}
+}
+
+// our throttle for uploads, unlimited until configured
+var uploadThrottler = newUploadThrottle()
+
+// ConfigureUploadThrottle sets the limit of our upload throttle and how it reacts to S3 from the passed in config
+func ConfigureUploadThrottle(config *Config) {
+	uploadThrottler.configure(
+		config.MaxConcurrentUploads, config.SlowDownThreshold, time.Duration(config.SlowDownQuietSecs)*time.Second,
+		config.SlowDownRetries, time.Duration(config.SlowDownBackoffMS)*time.Millisecond,
+	)
+}
+
+// configure sets the most uploads we allow at once, 0 for unlimited, how we react to S3 asking us to slow down and
+// resets any slowing down
+func (t *uploadThrottle) configure(max int, threshold int, quiet time.Duration, retries int, backoff time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.max = max
+	t.limit = max
+	t.threshold = threshold
+	t.quiet = quiet
+	t.retries = retries
+	t.backoff = backoff
+	t.slowDowns = 0
+	t.last = time.Now()
+	uploadConcurrency.set(float64(t.limit))
+	t.wake()
+}
+
+// acquire blocks until another upload may start or our context is done, a successful acquire must be released
+func (t *uploadThrottle) acquire(ctx context.Context) error {
+	for {
+		t.mutex.Lock()
+		t.rampUp()
+		if t.max <= 0 || t.inFlight < t.limit {
+			t.inFlight++
+			t.mutex.Unlock()
+			return nil
+		}
+		released := t.released
+		quiet := t.quiet
+		t.mutex.Unlock()
+
+		// our limit may also ramp up while we wait, so check again once a quiet period has passed
+		var rampedUp <-chan time.Time
+		var timer *time.Timer
+		if quiet > 0 {
+			timer = time.NewTimer(quiet)
+			rampedUp = timer.C
+		}
+
+		var err error
+		select {
+		case <-released:
+		case <-rampedUp:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// release ends an upload started by acquire, letting any waiting uploads start
+func (t *uploadThrottle) release() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.inFlight--
+	t.wake()
+}
+
+// do runs the passed in upload once we may start another, retrying it when S3 asks us to slow down, backing off
+// between each retry
+func (t *uploadThrottle) do(ctx context.Context, upload func() error) error {
+	t.mutex.Lock()
+	retries, backoff := t.retries, t.backoff
+	t.mutex.Unlock()
+
+	for retry := 1; ; retry++ {
+		err := t.acquire(ctx)
+		if err != nil {
+			return err
+		}
+		err = upload()
+		t.release()
+
+		if !isSlowDown(err) {
+			return err
+		}
+		t.slowDown()
+		if retry > retries {
+			return err
+		}
+
+		logrus.WithField("retry", retry).WithField("backoff", backoff).Warn("S3 asked us to slow down, retrying upload")
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// slowDown records that S3 asked us to slow down, halving our limit once it has asked threshold times
+func (t *uploadThrottle) slowDown() {
+	slowDowns.add(1)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.slowDowns++
+	t.last = time.Now()
+	if t.max <= 0 || t.slowDowns < t.threshold || t.limit <= 1 {
+		return
+	}
+
+	t.limit = t.limit / 2
+	t.slowDowns = 0
+	uploadConcurrency.set(float64(t.limit))
+	logrus.WithField("limit", t.limit).Warn("S3 asked us to slow down, lowering concurrent uploads")
+}
+
+// rampUp allows one more upload for each quiet period since we last changed our limit, must be called with our lock
+// held
+func (t *uploadThrottle) rampUp() {
+	if t.limit >= t.max || t.quiet <= 0 {
+		return
+	}
+
+	periods := int(time.Since(t.last) / t.quiet)
+	if periods == 0 {
+		return
+	}
+
+	t.limit += periods
+	if t.limit > t.max {
+		t.limit = t.max
+	}
+	t.slowDowns = 0
+	t.last = time.Now()
+	uploadConcurrency.set(float64(t.limit))
+	logrus.WithField("limit", t.limit).Info("S3 has stopped asking us to slow down, raising concurrent uploads")
+	t.wake()
+}
+
+// wake wakes all uploads waiting to start so they check our limit again, must be called with our lock held
+func (t *uploadThrottle) wake() {
+	close(t.released)
+	t.released = make(chan struct{})
+}
@@ -0,0 +1,84 @@
+package archives
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadThrottle(t *testing.T) {
+	ctx := context.Background()
+	slowDown := &StorageError{Code: errCodeSlowDown, Message: "Please reduce your request rate."}
+
+	throttle := newUploadThrottle()
+	throttle.configure(4, 2, time.Hour, 1, time.Millisecond)
+
+	// uploads which S3 accepts or fail for other reasons aren't retried
+	calls := 0
+	err := throttle.do(ctx, func() error { calls++; return nil })
+	assert.NoError(t, err)
+	assert.Equal(t, 1, calls)
+
+	calls = 0
+	err = throttle.do(ctx, func() error { calls++; return errors.New("boom") })
+	assert.EqualError(t, err, "boom")
+	assert.Equal(t, 1, calls)
+
+	// an upload S3 asks to slow down is retried
+	calls = 0
+	err = throttle.do(ctx, func() error {
+		calls++
+		if calls == 1 {
+			return slowDown
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, 4, throttle.limit)
+
+	// and given up on after our retries, by which point we've been asked often enough to halve our limit
+	calls = 0
+	err = throttle.do(ctx, func() error { calls++; return slowDown })
+	assert.True(t, isSlowDown(err))
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, 2, throttle.limit)
+	assert.Equal(t, 0, throttle.inFlight)
+
+	// once at our limit, uploads wait for one to be released
+	assert.NoError(t, throttle.acquire(ctx))
+	assert.NoError(t, throttle.acquire(ctx))
+
+	cancelled, cancel := context.WithTimeout(ctx, time.Millisecond*10)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, throttle.acquire(cancelled))
+
+	acquired := make(chan error)
+	go func() { acquired <- throttle.acquire(ctx) }()
+	throttle.release()
+	assert.NoError(t, <-acquired)
+	assert.Equal(t, 2, throttle.inFlight)
+
+	// our limit ramps back up by one for each quiet period
+	throttle.mutex.Lock()
+	throttle.last = time.Now().Add(-time.Hour)
+	throttle.mutex.Unlock()
+	assert.NoError(t, throttle.acquire(ctx))
+	assert.Equal(t, 3, throttle.limit)
+
+	throttle.mutex.Lock()
+	throttle.last = time.Now().Add(-time.Hour * 5)
+	throttle.mutex.Unlock()
+	assert.NoError(t, throttle.acquire(ctx))
+	assert.Equal(t, 4, throttle.limit)
+	assert.Equal(t, 4, throttle.inFlight)
+
+	// an unlimited throttle never waits
+	throttle.configure(0, 2, time.Hour, 1, time.Millisecond)
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, throttle.acquire(ctx))
+	}
+}
@@ -0,0 +1,213 @@
+package archives
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// the storage classes whose objects can't be read until they are restored, such as dailies transitioned by a lifecycle
+var coldStorageClasses = map[string]bool{
+	"GLACIER":      true,
+	"DEEP_ARCHIVE": true,
+}
+
+// the error S3 returns when reading an object which is in cold storage
+const errCodeInvalidObjectState = "InvalidObjectState"
+
+// isCold returns whether the passed in error is our storage refusing to read an object in cold storage
+func isCold(err error) bool {
+	return storageErrorCode(err) == errCodeInvalidObjectState
+}
+
+// HeadStorageClass looks up the storage class of the object of the passed in archive, setting it on the archive, and
+// returns whether the object is in cold storage and not restored, ie, whether reading it would fail
+func HeadStorageClass(ctx context.Context, s3Client Storage, archive *Archive) (bool, error) {
+	info, err := s3Client.Stat(ctx, archive.URL)
+	if err != nil {
+		return false, err
+	}
+
+	archive.StorageClass = info.StorageClass
+	return coldStorageClasses[archive.StorageClass] && !info.Restored, nil
+}
+
+// findColdDailies returns which of the passed in dailies with records are in cold storage. Dailies we wrote recently
+// can't have been transitioned yet, and a daily we fail to look up is assumed readable, downloading it will fail with
+// the real error if not.
+func findColdDailies(ctx context.Context, s3Client Storage, dailies []*Archive) map[*Archive]bool {
+	cold := make(map[*Archive]bool)
+	for _, daily := range dailies {
+		if daily.RecordCount == 0 || writtenRecently(daily.URL) {
+			continue
+		}
+
+		isCold, err := HeadStorageClass(ctx, s3Client, daily)
+		if err != nil {
+			logrus.WithError(err).WithField("archive_id", daily.ID).Warn("error looking up storage class of daily")
+			continue
+		}
+		if isCold {
+			cold[daily] = true
+		}
+	}
+	return cold
+}
+
+// coldRollupSource returns a reader of the current monthly of the passed in rollup, which the records of cold dailies
+// already deleted from our database are taken from instead. If there is no readable monthly, we request the restore
+// of these dailies if configured to and return an error, the rollup can be retried once they are restored.
+func coldRollupSource(ctx context.Context, db *sqlx.DB, conf *Config, s3Client Storage, monthlyArchive *Archive, deleted []*Archive) (*monthlyDays, *Archive, error) {
+	previous, err := getMonthlyArchive(ctx, db, monthlyArchive.Org, monthlyArchive.ArchiveType, monthlyArchive.StartDate)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if previous != nil && previous.URL != "" {
+		isCold, err := HeadStorageClass(ctx, s3Client, previous)
+		if err == nil && !isCold {
+			days, err := newMonthlyDays(ctx, conf, s3Client, previous)
+			if err != nil {
+				return nil, nil, err
+			}
+			return days, previous, nil
+		}
+	}
+
+	if !conf.RestoreColdDailies {
+		return nil, nil, fmt.Errorf("%d deleted dailies are in cold storage without a readable monthly, set restore-cold-dailies to restore them", len(deleted))
+	}
+
+	for _, daily := range deleted {
+		err := s3Client.Restore(ctx, daily.URL, conf.RestoreDays)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "error requesting restore of daily: %d", daily.ID)
+		}
+	}
+	return nil, nil, fmt.Errorf("requested restore of %d dailies in cold storage, rollup can be retried once they are restored", len(deleted))
+}
+
+// appendColdDaily appends the records of the passed in daily in cold storage to the passed in writer, from our
+// database if they are still there or otherwise from the passed in monthly, making sure we found all of them
+func appendColdDaily(ctx context.Context, db *sqlx.DB, conf *Config, org Org, daily *Archive, previous *monthlyDays, writer *bufio.Writer) error {
+	var count int
+	var err error
+
+	if daily.NeedsDeletion {
+		day := &Archive{Org: org, OrgID: org.ID, ArchiveType: daily.ArchiveType, StartDate: daily.StartDate, Period: DayPeriod}
+		count, err = writeArchiveRecords(ctx, db, conf, day, writer)
+	} else {
+		count, err = previous.copyDay(daily.StartDate, writer)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error reading records of cold daily: %d", daily.ID)
+	}
+
+	if count != daily.RecordCount {
+		return fmt.Errorf("cold daily: %d has %d records but we found %d", daily.ID, daily.RecordCount, count)
+	}
+	return nil
+}
+
+// monthlyDays reads the records of a monthly a day at a time, records are in the order of their dailies so we only
+// ever read forward
+type monthlyDays struct {
+	body    io.ReadCloser
+	gzip    *gzip.Reader
+	scanner *bufio.Scanner
+	field   string
+
+	// the line we've read but not yet copied or skipped and the day it belongs to
+	line []byte
+	day  time.Time
+}
+
+func newMonthlyDays(ctx context.Context, conf *Config, s3Client Storage, monthly *Archive) (*monthlyDays, error) {
+	field := "created_on"
+	if monthly.ArchiveType == RunType {
+		var err error
+		field, err = runPartitionField(conf)
+		if err != nil {
+			return nil, err
+		}
+	} else if monthly.ArchiveType == SessionType {
+		field = "ended_on"
+	}
+
+	body, err := GetS3File(ctx, s3Client, monthly.URL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading S3 URL: %s", monthly.URL)
+	}
+
+	gzipReader, err := gzip.NewReader(body)
+	if err != nil {
+		body.Close()
+		return nil, errors.Wrapf(err, "error creating gzip reader")
+	}
+
+	scanner := bufio.NewScanner(gzipReader)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordSize)
+
+	return &monthlyDays{body: body, gzip: gzipReader, scanner: scanner, field: field}, nil
+}
+
+// copyDay copies the records of the passed in day to the passed in writer, skipping those of any days before it, and
+// returns how many it copied
+func (m *monthlyDays) copyDay(day time.Time, writer io.Writer) (int, error) {
+	copied := 0
+	for {
+		if m.line == nil {
+			if !m.scanner.Scan() {
+				return copied, errors.Wrapf(m.scanner.Err(), "error reading monthly")
+			}
+
+			m.line = append([]byte(nil), m.scanner.Bytes()...)
+			recordDay, err := m.recordDay(m.line)
+			if err != nil {
+				return copied, err
+			}
+			m.day = recordDay
+		}
+
+		if m.day.After(day) {
+			return copied, nil
+		}
+		if m.day.Equal(day) {
+			writer.Write(m.line)
+			writer.Write([]byte("\n"))
+			copied++
+		}
+		m.line = nil
+	}
+}
+
+// recordDay returns the UTC day of the passed in record, which is that of its created_on, or partition field for runs
+func (m *monthlyDays) recordDay(record []byte) (time.Time, error) {
+	fields := make(map[string]json.RawMessage)
+	err := json.Unmarshal(record, &fields)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "error decoding monthly record")
+	}
+
+	var timestamp time.Time
+	err = json.Unmarshal(fields[m.field], &timestamp)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "error decoding %s of monthly record", m.field)
+	}
+
+	timestamp = timestamp.In(time.UTC)
+	return time.Date(timestamp.Year(), timestamp.Month(), timestamp.Day(), 0, 0, 0, 0, time.UTC), nil
+}
+
+func (m *monthlyDays) Close() error {
+	m.gzip.Close()
+	return m.body.Close()
+}
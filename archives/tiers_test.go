@@ -0,0 +1,176 @@
+package archives
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeadStorageClass(t *testing.T) {
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+	config := NewConfig()
+
+	archive := &Archive{ID: 1, URL: s3Client.putObject("test-bucket", "/1/message_D20170812_hash.jsonl.gz", []byte("archive"))}
+
+	cold, err := HeadStorageClass(ctx, s3Client, archive)
+	assert.NoError(t, err)
+	assert.False(t, cold)
+	assert.Equal(t, "STANDARD", archive.StorageClass)
+
+	s3Client.setStorageClass(archive.URL, "GLACIER")
+	cold, err = HeadStorageClass(ctx, s3Client, archive)
+	assert.NoError(t, err)
+	assert.True(t, cold)
+	assert.Equal(t, "GLACIER", archive.StorageClass)
+
+	// cold objects can't be previewed
+	_, err = PreviewArchive(ctx, s3Client, archive, false, 10)
+	assert.EqualError(t, err, "archive: 1 is in cold storage and must be restored to preview")
+
+	// requesting a restore more than once is fine
+	assert.NoError(t, s3Client.Restore(ctx, archive.URL, config.RestoreDays))
+	assert.NoError(t, s3Client.Restore(ctx, archive.URL, config.RestoreDays))
+	assert.Equal(t, []string{"/1/message_D20170812_hash.jsonl.gz"}, s3Client.restores)
+
+	// but the object stays cold until its restore is done
+	cold, _ = HeadStorageClass(ctx, s3Client, archive)
+	assert.True(t, cold)
+
+	s3Client.objects["test-bucket:/1/message_D20170812_hash.jsonl.gz"].restore = `ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"`
+	cold, _ = HeadStorageClass(ctx, s3Client, archive)
+	assert.False(t, cold)
+	assert.Equal(t, "GLACIER", archive.StorageClass)
+
+	// and we don't treat instantly readable classes as cold
+	s3Client.setStorageClass(archive.URL, "STANDARD_IA")
+	cold, _ = HeadStorageClass(ctx, s3Client, archive)
+	assert.False(t, cold)
+}
+
+func TestMonthlyDays(t *testing.T) {
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+	config := NewConfig()
+
+	records := []string{
+		`{"id":1,"created_on":"2017-08-01T10:00:00.000000+00:00"}`,
+		`{"id":2,"created_on":"2017-08-01T23:59:59.999999+00:00"}`,
+		`{"id":3,"created_on":"2017-08-03T01:00:00.000000+02:00"}`,
+		`{"id":4,"created_on":"2017-08-03T12:00:00.000000+00:00"}`,
+		`{"id":5,"created_on":"2017-08-04T12:00:00.000000+00:00"}`,
+	}
+	compressed := &bytes.Buffer{}
+	gzWriter := gzip.NewWriter(compressed)
+	for _, r := range records {
+		gzWriter.Write([]byte(r + "\n"))
+	}
+	gzWriter.Close()
+
+	monthly := &Archive{ID: 1, ArchiveType: MessageType, URL: s3Client.putObject("test-bucket", "/1/message_M20170801_hash.jsonl.gz", compressed.Bytes())}
+	days, err := newMonthlyDays(ctx, config, s3Client, monthly)
+	assert.NoError(t, err)
+	defer days.Close()
+
+	day := func(d int) time.Time { return time.Date(2017, 8, d, 0, 0, 0, 0, time.UTC) }
+	output := &bytes.Buffer{}
+
+	count, err := days.copyDay(day(1), output)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, records[0]+"\n"+records[1]+"\n", output.String())
+
+	// days are in UTC, our third record was on the 2nd
+	output.Reset()
+	count, err = days.copyDay(day(3), output)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, records[3]+"\n", output.String())
+
+	// days we skip over are left out
+	output.Reset()
+	count, err = days.copyDay(day(5), output)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+	assert.Equal(t, "", output.String())
+}
+
+func TestRollupColdDailies(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+
+	config := NewConfig()
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	_, _, err = ArchiveOrg(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+
+	aug := time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC)
+	monthly, err := getMonthlyArchive(ctx, db, orgs[1], MessageType, aug)
+	assert.NoError(t, err)
+	dailies, err := GetDailyArchivesForDateRange(ctx, db, orgs[1], MessageType, aug.AddDate(0, 0, 11), aug.AddDate(0, 0, 11))
+	assert.NoError(t, err)
+	daily := dailies[0]
+	assert.Equal(t, 3, daily.RecordCount)
+
+	// these were written a while ago as far as we're concerned
+	recentWrites.Lock()
+	recentWrites.urls = make(map[string]time.Time)
+	recentWrites.Unlock()
+
+	rollup := func() (*Archive, error) {
+		rebuilt := &Archive{Org: orgs[1], OrgID: orgs[1].ID, ArchiveType: MessageType, StartDate: aug, Period: MonthPeriod}
+		err := BuildRollupArchive(ctx, db, config, s3Client, rebuilt, now, orgs[1], MessageType)
+		if rebuilt.ArchiveFile != "" {
+			os.Remove(rebuilt.ArchiveFile)
+		}
+		return rebuilt, err
+	}
+
+	// a cold daily whose records we still have is read from our database
+	s3Client.setStorageClass(daily.URL, "GLACIER")
+	rebuilt, err := rollup()
+	assert.NoError(t, err)
+	assert.Equal(t, monthly.Hash, rebuilt.Hash)
+	assert.Equal(t, monthly.RecordCount, rebuilt.RecordCount)
+
+	// once they're deleted, from our monthly
+	_, err = db.Exec(`UPDATE archives_archive SET needs_deletion = FALSE, deleted_on = NOW() WHERE id = $1`, daily.ID)
+	assert.NoError(t, err)
+
+	rebuilt, err = rollup()
+	assert.NoError(t, err)
+	assert.Equal(t, monthly.Hash, rebuilt.Hash)
+
+	// without a readable monthly we can only fail
+	s3Client.setStorageClass(monthly.URL, "DEEP_ARCHIVE")
+	_, err = rollup()
+	assert.EqualError(t, err, "1 deleted dailies are in cold storage without a readable monthly, set restore-cold-dailies to restore them")
+	assert.Equal(t, 0, len(s3Client.restores))
+
+	// or request a restore of the daily if configured to
+	config.RestoreColdDailies = true
+	_, err = rollup()
+	assert.EqualError(t, err, "requested restore of 1 dailies in cold storage, rollup can be retried once they are restored")
+	dailyURL, _ := url.Parse(daily.URL)
+	assert.Equal(t, []string{dailyURL.Path}, s3Client.restores)
+
+	// which is downloaded as usual once restored
+	for _, obj := range s3Client.objects {
+		if obj.restore != "" {
+			obj.restore = `ongoing-request="false"`
+		}
+	}
+	rebuilt, err = rollup()
+	assert.NoError(t, err)
+	assert.Equal(t, monthly.Hash, rebuilt.Hash)
+}
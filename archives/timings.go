@@ -0,0 +1,58 @@
+package archives
+
+import (
+	"io"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var phaseDuration = newHistogram("archiver_archive_phase_duration_seconds", "Time taken by each phase of building an archive.", durationBuckets, "phase")
+
+// ArchiveTimings breaks down the time taken to build an archive by phase, BuildTime only covers extraction and
+// compression together
+type ArchiveTimings struct {
+	// reading our records from the database, or our dailies from S3 for rollups
+	Extraction time.Duration
+
+	// compressing and writing our records, when streaming this includes waiting on our upload
+	Compression time.Duration
+
+	// uploading our file to S3, when streaming only copying our upload to its real key
+	Upload time.Duration
+
+	// writing our archive to the database
+	DBWrite time.Duration
+}
+
+// fields returns our timings as log fields
+func (t *ArchiveTimings) fields() logrus.Fields {
+	return logrus.Fields{
+		"extraction":  t.Extraction,
+		"compression": t.Compression,
+		"upload":      t.Upload,
+		"db_write":    t.DBWrite,
+	}
+}
+
+// observe records our timings in our metrics
+func (t *ArchiveTimings) observe() {
+	phaseDuration.observe(t.Extraction.Seconds(), "extraction")
+	phaseDuration.observe(t.Compression.Seconds(), "compression")
+	phaseDuration.observe(t.Upload.Seconds(), "upload")
+	phaseDuration.observe(t.DBWrite.Seconds(), "db_write")
+}
+
+// timedWriter keeps track of the time spent writing to the writer it wraps, which lets us split the time spent
+// writing records between reading them and compressing them
+type timedWriter struct {
+	writer  io.Writer
+	elapsed time.Duration
+}
+
+func (w *timedWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := w.writer.Write(p)
+	w.elapsed += time.Since(start)
+	return n, err
+}
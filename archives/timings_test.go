@@ -0,0 +1,43 @@
+package archives
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type slowWriter struct{}
+
+func (w slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(time.Millisecond * 10)
+	return len(p), nil
+}
+
+func TestArchiveTimings(t *testing.T) {
+	timed := &timedWriter{writer: slowWriter{}}
+	n, err := timed.Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, 5, n)
+	timed.Write([]byte("world"))
+	assert.True(t, timed.elapsed >= time.Millisecond*20)
+
+	timed = &timedWriter{writer: ioutil.Discard}
+	timed.Write([]byte("hello"))
+	assert.True(t, timed.elapsed < time.Millisecond*10)
+
+	timings := &ArchiveTimings{Extraction: time.Second * 3, Compression: time.Second, Upload: time.Millisecond * 500, DBWrite: time.Millisecond * 5}
+	assert.Equal(t, time.Second*3, timings.fields()["extraction"])
+	assert.Equal(t, time.Millisecond*5, timings.fields()["db_write"])
+
+	timings.observe()
+
+	output := &bytes.Buffer{}
+	assert.NoError(t, WriteMetrics(output))
+	assert.Contains(t, output.String(), "# TYPE archiver_archive_phase_duration_seconds histogram\n")
+	for _, phase := range []string{"extraction", "compression", "upload", "db_write"} {
+		assert.Contains(t, output.String(), `archiver_archive_phase_duration_seconds_count{phase="`+phase+`"}`)
+	}
+}
@@ -0,0 +1,192 @@
+package archives
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// the number of days of dailies we average the volume of each org over
+	trendWindowDays = 30
+
+	// the number of days ahead we project that volume over
+	trendHorizonDays = 90
+)
+
+var (
+	orgRecordsPerDay  = newGauge("archiver_org_records_per_day", "Average records archived per day over the last 30 days of dailies of an org.", "org_id", "archive_type")
+	orgBytesPerDay    = newGauge("archiver_org_bytes_per_day", "Average archive bytes per day over the last 30 days of dailies of an org.", "org_id", "archive_type")
+	orgBytesPerRecord = newGauge("archiver_org_bytes_per_record", "Compressed archive bytes per record over the last 30 days of dailies of an org.", "org_id", "archive_type")
+	orgProjectedBytes = newGauge("archiver_org_projected_bytes", "Archive bytes an org is projected to add over the next 90 days.", "org_id", "archive_type")
+)
+
+// VolumeTrend is the recent daily volume of the archives of one type of an org, and the volume that projects to
+type VolumeTrend struct {
+	OrgID       int
+	ArchiveType ArchiveType
+
+	// the number of dailies we averaged over, fewer than our window for orgs without that much history
+	Days int
+
+	RecordsPerDay  float64
+	BytesPerDay    float64
+	BytesPerRecord float64
+
+	// bytes per record over the window before, 0 if it had no records, for spotting changes to how we compress
+	PrevBytesPerRecord float64
+
+	ProjectedRecords int64
+	ProjectedBytes   int64
+}
+
+// volumeDaily is a daily included in our volume trends
+type volumeDaily struct {
+	OrgID       int         `db:"org_id"`
+	ArchiveType ArchiveType `db:"archive_type"`
+	StartDate   time.Time   `db:"start_date"`
+	RecordCount int         `db:"record_count"`
+	Size        int64       `db:"size"`
+	LastDay     time.Time   `db:"last_day"`
+}
+
+// the dailies of the last two windows of each org and type, ending at its latest daily as dailies trail the retention
+// period, taking the latest of any duplicates of a day
+const lookupVolumeDailies = `
+WITH latest AS (
+	SELECT org_id, archive_type, MAX(start_date) AS last_day
+	FROM archives_archive
+	WHERE period = 'D'
+	GROUP BY org_id, archive_type
+)
+SELECT DISTINCT ON (a.org_id, a.archive_type, a.start_date) a.org_id, a.archive_type, a.start_date, a.record_count, a.size, l.last_day
+FROM archives_archive a JOIN latest l ON l.org_id = a.org_id AND l.archive_type = a.archive_type
+WHERE a.period = 'D' AND a.start_date > l.last_day - $1::integer
+ORDER BY a.org_id, a.archive_type, a.start_date, a.id DESC
+`
+
+// GetVolumeTrends calculates the recent daily volume of the archives of each org and type which has dailies, and
+// projects it over the coming days
+func GetVolumeTrends(ctx context.Context, db *sqlx.DB) ([]*VolumeTrend, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute*5)
+	defer cancel()
+
+	dailies := make([]*volumeDaily, 0)
+	err := db.SelectContext(ctx, &dailies, lookupVolumeDailies, trendWindowDays*2)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error selecting dailies for volume trends")
+	}
+
+	return computeVolumeTrends(dailies), nil
+}
+
+// computeVolumeTrends aggregates the passed in dailies, ordered by org and type, into a trend for each org and type
+func computeVolumeTrends(dailies []*volumeDaily) []*VolumeTrend {
+	trends := make([]*VolumeTrend, 0)
+
+	var trend *VolumeTrend
+	var records, bytes, prevRecords, prevBytes int64
+
+	finish := func() {
+		if trend == nil {
+			return
+		}
+		if trend.Days > 0 {
+			trend.RecordsPerDay = float64(records) / float64(trend.Days)
+			trend.BytesPerDay = float64(bytes) / float64(trend.Days)
+			trend.ProjectedRecords = int64(math.Round(trend.RecordsPerDay * trendHorizonDays))
+			trend.ProjectedBytes = int64(math.Round(trend.BytesPerDay * trendHorizonDays))
+		}
+		if records > 0 {
+			trend.BytesPerRecord = float64(bytes) / float64(records)
+		}
+		if prevRecords > 0 {
+			trend.PrevBytesPerRecord = float64(prevBytes) / float64(prevRecords)
+		}
+		trends = append(trends, trend)
+	}
+
+	for _, daily := range dailies {
+		if trend == nil || trend.OrgID != daily.OrgID || trend.ArchiveType != daily.ArchiveType {
+			finish()
+			trend = &VolumeTrend{OrgID: daily.OrgID, ArchiveType: daily.ArchiveType}
+			records, bytes, prevRecords, prevBytes = 0, 0, 0, 0
+		}
+
+		// dailies in our window are those of the last 30 days up to and including the latest
+		if daily.StartDate.After(daily.LastDay.AddDate(0, 0, -trendWindowDays)) {
+			trend.Days++
+			records += int64(daily.RecordCount)
+			bytes += daily.Size
+		} else {
+			prevRecords += int64(daily.RecordCount)
+			prevBytes += daily.Size
+		}
+	}
+	finish()
+
+	return trends
+}
+
+// RecordVolumeTrends logs the passed in volume trends and records them in our metrics
+func RecordVolumeTrends(trends []*VolumeTrend) {
+	for _, t := range trends {
+		orgID := strconv.Itoa(t.OrgID)
+		orgRecordsPerDay.set(t.RecordsPerDay, orgID, string(t.ArchiveType))
+		orgBytesPerDay.set(t.BytesPerDay, orgID, string(t.ArchiveType))
+		orgBytesPerRecord.set(t.BytesPerRecord, orgID, string(t.ArchiveType))
+		orgProjectedBytes.set(float64(t.ProjectedBytes), orgID, string(t.ArchiveType))
+
+		logrus.WithFields(logrus.Fields{
+			"org_id":                t.OrgID,
+			"archive_type":          t.ArchiveType,
+			"days":                  t.Days,
+			"records_per_day":       t.RecordsPerDay,
+			"bytes_per_day":         t.BytesPerDay,
+			"bytes_per_record":      t.BytesPerRecord,
+			"prev_bytes_per_record": t.PrevBytesPerRecord,
+			"projected_records":     t.ProjectedRecords,
+			"projected_bytes":       t.ProjectedBytes,
+		}).Info("archive volume trend")
+	}
+}
+
+// WriteVolumeTrendsReport writes the passed in volume trends to the passed in path as CSV
+func WriteVolumeTrendsReport(path string, trends []*VolumeTrend) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return errors.Wrapf(err, "error creating volume trends report")
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	writer.Write([]string{"org_id", "archive_type", "days", "records_per_day", "bytes_per_day", "bytes_per_record", "prev_bytes_per_record", "projected_records", "projected_bytes"})
+	for _, t := range trends {
+		writer.Write([]string{
+			strconv.Itoa(t.OrgID),
+			string(t.ArchiveType),
+			strconv.Itoa(t.Days),
+			fmt.Sprintf("%.2f", t.RecordsPerDay),
+			fmt.Sprintf("%.2f", t.BytesPerDay),
+			fmt.Sprintf("%.2f", t.BytesPerRecord),
+			fmt.Sprintf("%.2f", t.PrevBytesPerRecord),
+			strconv.FormatInt(t.ProjectedRecords, 10),
+			strconv.FormatInt(t.ProjectedBytes, 10),
+		})
+	}
+	writer.Flush()
+
+	err = writer.Error()
+	if err != nil {
+		return errors.Wrapf(err, "error writing volume trends report")
+	}
+	return file.Close()
+}
@@ -0,0 +1,108 @@
+package archives
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComputeVolumeTrends(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2017, 10, d, 0, 0, 0, 0, time.UTC) }
+	last := day(31)
+
+	// org 2 has 30 days of 100 records in our window, and a day before it which compressed better
+	dailies := []*volumeDaily{{OrgID: 2, ArchiveType: MessageType, StartDate: day(1), RecordCount: 1000, Size: 50000, LastDay: last}}
+	for d := 2; d <= 31; d++ {
+		dailies = append(dailies, &volumeDaily{OrgID: 2, ArchiveType: MessageType, StartDate: day(d), RecordCount: 100, Size: 8000, LastDay: last})
+	}
+
+	// its runs only have two days of history, one of them empty
+	dailies = append(dailies,
+		&volumeDaily{OrgID: 2, ArchiveType: RunType, StartDate: day(30), RecordCount: 0, Size: 0, LastDay: last},
+		&volumeDaily{OrgID: 2, ArchiveType: RunType, StartDate: day(31), RecordCount: 30, Size: 6000, LastDay: last},
+		&volumeDaily{OrgID: 3, ArchiveType: MessageType, StartDate: day(10), RecordCount: 0, Size: 0, LastDay: day(10)},
+	)
+
+	trends := computeVolumeTrends(dailies)
+	assert.Equal(t, 3, len(trends))
+
+	assert.Equal(t, &VolumeTrend{
+		OrgID: 2, ArchiveType: MessageType, Days: 30,
+		RecordsPerDay: 100, BytesPerDay: 8000, BytesPerRecord: 80, PrevBytesPerRecord: 50,
+		ProjectedRecords: 9000, ProjectedBytes: 720000,
+	}, trends[0])
+
+	assert.Equal(t, &VolumeTrend{
+		OrgID: 2, ArchiveType: RunType, Days: 2,
+		RecordsPerDay: 15, BytesPerDay: 3000, BytesPerRecord: 200, PrevBytesPerRecord: 0,
+		ProjectedRecords: 1350, ProjectedBytes: 270000,
+	}, trends[1])
+
+	// orgs without records have nothing to project
+	assert.Equal(t, &VolumeTrend{OrgID: 3, ArchiveType: MessageType, Days: 1}, trends[2])
+
+	assert.Equal(t, 0, len(computeVolumeTrends(nil)))
+
+	dir, err := ioutil.TempDir("", "trends")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "trends.csv")
+	assert.NoError(t, WriteVolumeTrendsReport(path, trends[:2]))
+
+	contents, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "org_id,archive_type,days,records_per_day,bytes_per_day,bytes_per_record,prev_bytes_per_record,projected_records,projected_bytes\n"+
+		"2,message,30,100.00,8000.00,80.00,50.00,9000,720000\n"+
+		"2,run,2,15.00,3000.00,200.00,0.00,1350,270000\n", string(contents))
+
+	RecordVolumeTrends(trends)
+	output := &bytes.Buffer{}
+	assert.NoError(t, WriteMetrics(output))
+	assert.Contains(t, output.String(), `archiver_org_bytes_per_record{org_id="2",archive_type="message"} 80`)
+	assert.Contains(t, output.String(), `archiver_org_projected_bytes{org_id="2",archive_type="run"} 270000`)
+}
+
+func TestGetVolumeTrends(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+
+	// org 3 has message dailies for Aug 10 and Sep 10 and a monthly which isn't counted, org 2 one for Oct 8
+	_, err := db.Exec(`UPDATE archives_archive SET record_count = 100, size = 10000 WHERE org_id = 3 AND start_date = '2017-08-10'`)
+	assert.NoError(t, err)
+	_, err = db.Exec(`UPDATE archives_archive SET record_count = 200, size = 30000 WHERE org_id = 3 AND start_date = '2017-09-10'`)
+	assert.NoError(t, err)
+	_, err = db.Exec(`UPDATE archives_archive SET record_count = 5000, size = 5000000 WHERE org_id = 3 AND period = 'M'`)
+	assert.NoError(t, err)
+	_, err = db.Exec(`UPDATE archives_archive SET record_count = 50, size = 5000 WHERE org_id = 2`)
+	assert.NoError(t, err)
+
+	// we add Oct 9 for org 2 twice, only the latest of which counts
+	_, err = db.Exec(`INSERT INTO archives_archive(archive_type, created_on, start_date, period, record_count, size, hash, url, needs_deletion, build_time, org_id) VALUES
+		('message', NOW(), '2017-10-09', 'D', 999, 1, '', '', TRUE, 0, 2),
+		('message', NOW(), '2017-10-09', 'D', 150, 10000, '', '', TRUE, 0, 2)`)
+	assert.NoError(t, err)
+
+	trends, err := GetVolumeTrends(ctx, db)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(trends))
+
+	assert.Equal(t, &VolumeTrend{
+		OrgID: 2, ArchiveType: MessageType, Days: 2,
+		RecordsPerDay: 100, BytesPerDay: 7500, BytesPerRecord: 75, PrevBytesPerRecord: 0,
+		ProjectedRecords: 9000, ProjectedBytes: 675000,
+	}, trends[0])
+
+	// Aug 10 is more than 30 days before Sep 10 so is only compared against
+	assert.Equal(t, &VolumeTrend{
+		OrgID: 3, ArchiveType: MessageType, Days: 1,
+		RecordsPerDay: 200, BytesPerDay: 30000, BytesPerRecord: 150, PrevBytesPerRecord: 100,
+		ProjectedRecords: 18000, ProjectedBytes: 2700000,
+	}, trends[1])
+}
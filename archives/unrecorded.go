@@ -0,0 +1,74 @@
+package archives
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var orphanedObjects = newCounter("archiver_orphaned_objects_total", "Number of objects found for the days of dailies we built which weren't the same as them.", "archive_type")
+
+// archiveKeyPrefix returns the prefix shared by the keys of every build of the passed in archive, whatever its hash
+func archiveKeyPrefix(archive *Archive) string {
+	return strings.TrimSuffix(archiveS3Key(archive), archive.Hash+".jsonl.gz")
+}
+
+// findUploadedArchive looks for an object uploaded for the passed in archive by an earlier build which was never
+// recorded, such as when we crashed between uploading it and writing it to the database. Our archives are built the
+// same way from the same records, and their keys include their hash, so an object at the key of the archive we just
+// built is that archive and can be recorded instead of uploaded again. Any other objects for the same period aren't,
+// and are reported as orphans on the archive. Returns whether our archive was found, setting its URL if so.
+func findUploadedArchive(ctx context.Context, config *Config, s3Client Storage, archive *Archive) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	prefix := archiveKeyPrefix(archive)
+	key := archiveS3Key(archive)
+	found := false
+	archive.Orphans = nil
+
+	objects, err := s3Client.List(ctx, config.StorageBucket(), prefix)
+	if err != nil {
+		return false, errors.Wrapf(err, "error listing objects with prefix: %s", prefix)
+	}
+	for _, object := range objects {
+		if object.Key == key && object.Size == archive.Size {
+			found = true
+			continue
+		}
+		archive.Orphans = append(archive.Orphans, s3Client.URL(config.StorageBucket(), object.Key))
+	}
+
+	log := logrus.WithFields(logrus.Fields{
+		"org_id":       archive.Org.ID,
+		"archive_type": archive.ArchiveType,
+		"start_date":   archive.StartDate,
+		"period":       archive.Period,
+	})
+
+	// objects we never recorded which aren't what we just built are left for someone to look at, not removed
+	for _, orphan := range archive.Orphans {
+		orphanedObjects.add(1, string(archive.ArchiveType))
+		log.WithField("url", orphan).Warn("found unrecorded object for archive which doesn't match it")
+	}
+
+	if !found {
+		return false, nil
+	}
+
+	// make sure what's there really is our archive before we point at it
+	uploaded := &Archive{ID: archive.ID, Size: archive.Size, Hash: archive.Hash, URL: s3Client.URL(config.StorageBucket(), key)}
+	err = VerifyS3Archive(ctx, s3Client, uploaded)
+	if err != nil {
+		log.WithError(err).Warn("unrecorded object at key of archive failed verification, uploading it again")
+		return false, nil
+	}
+
+	archive.URL = uploaded.URL
+	archive.NeedsDeletion = recordsDeletable(config, archive.ArchiveType)
+	log.WithField("url", archive.URL).Info("found unrecorded upload of archive, recording it instead of uploading it again")
+	return true, nil
+}
@@ -0,0 +1,84 @@
+package archives
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindUploadedArchive(t *testing.T) {
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+	config := NewConfig()
+
+	body := []byte("the archive we just built")
+	hash := md5.Sum(body)
+	archive := &Archive{Org: Org{ID: 2}, OrgID: 2, ArchiveType: MessageType, Period: DayPeriod, StartDate: time.Date(2017, 8, 12, 0, 0, 0, 0, time.UTC), Hash: hex.EncodeToString(hash[:]), Size: int64(len(body))}
+	assert.Equal(t, "/2/message_D20170812_", archiveKeyPrefix(archive))
+
+	// nothing uploaded yet
+	found, err := findUploadedArchive(ctx, config, s3Client, archive)
+	assert.NoError(t, err)
+	assert.False(t, found)
+	assert.Equal(t, 0, len(archive.Orphans))
+
+	// an object for the day which isn't ours is reported, as are those of other days or types
+	orphan := s3Client.putObject("dl-archiver-test", "/2/message_D20170812_0cc175b9c0f1b6a831c399e269772661.jsonl.gz", []byte("an older build"))
+	s3Client.putObject("dl-archiver-test", "/2/message_D20170813_0cc175b9c0f1b6a831c399e269772661.jsonl.gz", []byte("the next day"))
+	s3Client.putObject("dl-archiver-test", "/2/run_D20170812_0cc175b9c0f1b6a831c399e269772661.jsonl.gz", []byte("our runs"))
+
+	found, err = findUploadedArchive(ctx, config, s3Client, archive)
+	assert.NoError(t, err)
+	assert.False(t, found)
+	assert.Equal(t, []string{orphan}, archive.Orphans)
+	assert.Equal(t, "", archive.URL)
+
+	// one at our key which isn't what we built is uploaded again
+	s3Client.putObject("dl-archiver-test", archiveS3Key(archive), []byte("the archive we just xxxxx"))
+	found, err = findUploadedArchive(ctx, config, s3Client, archive)
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	// but once it is, it's recorded as it is
+	uploaded := s3Client.putObject("dl-archiver-test", archiveS3Key(archive), body)
+	found, err = findUploadedArchive(ctx, config, s3Client, archive)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, uploaded, archive.URL)
+	assert.True(t, archive.NeedsDeletion)
+	assert.Equal(t, []string{orphan}, archive.Orphans)
+}
+
+func TestProbeUnrecordedDailies(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+
+	config := NewConfig()
+	config.ProbeUnrecordedDailies = true
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	dailies, err := GetMissingDailyArchives(ctx, db, now, orgs[1], RunType)
+	assert.NoError(t, err)
+	assert.NoError(t, createArchives(ctx, db, config, s3Client, orgs[1], dailies[:3]))
+	uploads := len(s3Client.objects)
+	urls := []string{dailies[0].URL, dailies[1].URL, dailies[2].URL}
+
+	// we crash after uploading but before recording our dailies
+	_, err = db.Exec(`DELETE FROM archives_archive WHERE org_id = 2 AND archive_type = 'run'`)
+	assert.NoError(t, err)
+
+	// so building them again records what we'd uploaded rather than duplicating it
+	dailies, err = GetMissingDailyArchives(ctx, db, now, orgs[1], RunType)
+	assert.NoError(t, err)
+	assert.NoError(t, createArchives(ctx, db, config, s3Client, orgs[1], dailies[:3]))
+	assert.Equal(t, uploads, len(s3Client.objects))
+	assert.Equal(t, urls, []string{dailies[0].URL, dailies[1].URL, dailies[2].URL})
+	assertCount(t, db, 3, `SELECT count(*) FROM archives_archive WHERE org_id = 2 AND archive_type = 'run' AND url != ''`)
+}
@@ -0,0 +1,223 @@
+package archives
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	verifyDuration  = newHistogram("archiver_s3_verify_duration_seconds", "Time taken to verify an archive object on S3.", durationBuckets, "result")
+	verifyCacheHits = newCounter("archiver_s3_verify_cache_hits_total", "Number of archive verifications answered by archives already verified.")
+)
+
+// verifyKey identifies an archive object we've verified, along with the size we expected it to be
+type verifyKey struct {
+	url  string
+	size int64
+}
+
+// the archive objects we've verified, these live for the lifetime of our process
+var verified = struct {
+	sync.Mutex
+	keys map[verifyKey]bool
+}{keys: make(map[verifyKey]bool)}
+
+func archiveVerifyKey(archive *Archive) verifyKey {
+	return verifyKey{url: archive.URL, size: archive.Size}
+}
+
+// markVerified records that the object of the passed in archive has been verified, such as by downloading it
+func markVerified(archive *Archive) {
+	verified.Lock()
+	verified.keys[archiveVerifyKey(archive)] = true
+	verified.Unlock()
+}
+
+func isVerified(archive *Archive) bool {
+	verified.Lock()
+	defer verified.Unlock()
+	return verified.keys[archiveVerifyKey(archive)]
+}
+
+// verifyArchive verifies the object of the passed in archive on S3 unless we've already verified it. Only successes
+// are remembered, so a failure is always checked again.
+func verifyArchive(ctx context.Context, s3Client Storage, archive *Archive) error {
+	if archive.URL != "" && isVerified(archive) {
+		verifyCacheHits.add(1)
+		return nil
+	}
+
+	start := time.Now()
+	err := VerifyS3Archive(ctx, s3Client, archive)
+
+	result := "ok"
+	if err != nil {
+		result = "failed"
+	}
+	verifyDuration.observe(time.Since(start).Seconds(), result)
+
+	if err != nil {
+		return err
+	}
+
+	markVerified(archive)
+	return nil
+}
+
+// VerifyS3Archives verifies the objects of all the passed in archives on S3, with up to VerifyConcurrency
+// verifications in flight at once, returning the errors of any archives which failed
+func VerifyS3Archives(ctx context.Context, config *Config, s3Client Storage, archives []*Archive) map[*Archive]error {
+	return verifyConcurrently(config, archives, func(archive *Archive) error {
+		return verifyArchive(ctx, s3Client, archive)
+	})
+}
+
+// verifyConcurrently calls the passed in verify for all the passed in archives, with up to VerifyConcurrency calls in
+// flight at once, returning the errors of any archives which failed
+func verifyConcurrently(config *Config, archives []*Archive, verify func(*Archive) error) map[*Archive]error {
+	concurrency := config.VerifyConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	failures := make(map[*Archive]error)
+	mutex := sync.Mutex{}
+	sem := make(chan struct{}, concurrency)
+	wg := sync.WaitGroup{}
+
+	for _, a := range archives {
+		sem <- struct{}{}
+		wg.Add(1)
+
+		go func(archive *Archive) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			err := verify(archive)
+			if err != nil {
+				mutex.Lock()
+				failures[archive] = err
+				mutex.Unlock()
+			}
+		}(a)
+	}
+	wg.Wait()
+
+	return failures
+}
+
+// describeFailures returns the passed in verification failures as a map of archive ids to errors, for logging
+func describeFailures(failures map[*Archive]error) map[string]string {
+	described := make(map[string]string, len(failures))
+	for a, err := range failures {
+		described[fmt.Sprintf("%d", a.ID)] = err.Error()
+	}
+	return described
+}
+
+const upsertArchiveVerification = `
+INSERT INTO archiver_archive_verifications(archive_id, verification_count, last_verified_on)
+VALUES($1, 1, $2)
+ON CONFLICT (archive_id) DO UPDATE
+SET verification_count = archiver_archive_verifications.verification_count + 1, last_verified_on = EXCLUDED.last_verified_on
+WHERE archiver_archive_verifications.last_verified_on < EXCLUDED.last_verified_on
+`
+
+const deleteArchiveVerifications = `
+DELETE FROM archiver_archive_verifications WHERE archive_id = $1
+`
+
+const lookupArchiveVerifications = `
+SELECT archive_id, verification_count FROM archiver_archive_verifications WHERE archive_id = ANY($1)
+`
+
+// VerifyArchives verifies the objects of the archives of the passed in org whose records we could delete, counting a
+// verification for each archive which passes, at most one a day. Each is checked on S3 even if we've verified it
+// before, so that every verification counted is of the object as it is that day. Returns the archives which passed.
+func VerifyArchives(ctx context.Context, now time.Time, config *Config, db *sqlx.DB, s3Client Storage, org Org, archiveType ArchiveType) ([]*Archive, error) {
+	archives, err := GetArchivesNeedingDeletion(ctx, db, org, archiveType)
+	if err != nil {
+		return nil, err
+	}
+	archives = retainedArchives(now, org, archives)
+
+	failures := verifyConcurrently(config, archives, func(archive *Archive) error {
+		err := VerifyS3Archive(ctx, s3Client, archive)
+		if err == nil {
+			markVerified(archive)
+		}
+		return err
+	})
+	if len(failures) > 0 {
+		logrus.WithFields(logrus.Fields{
+			"org_id":       org.ID,
+			"archive_type": archiveType,
+			"failed":       len(failures),
+			"archives":     len(archives),
+			"errors":       describeFailures(failures),
+		}).Error("archives failed verification, not counting their verifications")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute*5)
+	defer cancel()
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	verified := make([]*Archive, 0, len(archives))
+	for _, a := range archives {
+		if failures[a] != nil {
+			continue
+		}
+
+		_, err = db.ExecContext(ctx, upsertArchiveVerification, a.ID, today)
+		if err != nil {
+			return verified, errors.Wrapf(err, "error recording verification of archive: %d", a.ID)
+		}
+		verified = append(verified, a)
+	}
+
+	return verified, nil
+}
+
+// sufficientlyVerifiedArchives returns which of the passed in archives have been verified on at least
+// MinVerificationsBeforeDelete days, all of them if we don't require any
+func sufficientlyVerifiedArchives(ctx context.Context, db *sqlx.DB, config *Config, archives []*Archive) ([]*Archive, error) {
+	if config.MinVerificationsBeforeDelete <= 0 || len(archives) == 0 {
+		return archives, nil
+	}
+
+	ids := make([]int, len(archives))
+	for i, a := range archives {
+		ids[i] = a.ID
+	}
+
+	rows := make([]struct {
+		ArchiveID int `db:"archive_id"`
+		Count     int `db:"verification_count"`
+	}, 0, len(ids))
+	err := db.SelectContext(ctx, &rows, lookupArchiveVerifications, pq.Array(ids))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up archive verifications")
+	}
+
+	counts := make(map[int]int, len(rows))
+	for _, r := range rows {
+		counts[r.ArchiveID] = r.Count
+	}
+
+	verified := make([]*Archive, 0, len(archives))
+	for _, a := range archives {
+		if counts[a.ID] >= config.MinVerificationsBeforeDelete {
+			verified = append(verified, a)
+		}
+	}
+	return verified, nil
+}
@@ -0,0 +1,123 @@
+package archives
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyS3Archives(t *testing.T) {
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+	config := NewConfig()
+	config.VerifyConcurrency = 3
+
+	archives := make([]*Archive, 0)
+	for i := 1; i <= 10; i++ {
+		body := []byte(fmt.Sprintf("archive contents %d", i))
+		hash := md5.Sum(body)
+		archives = append(archives, &Archive{
+			ID:   i,
+			Size: int64(len(body)),
+			Hash: hex.EncodeToString(hash[:]),
+			URL:  s3Client.putObject("verify-bucket", fmt.Sprintf("/1/message_D201708%02d_hash.jsonl.gz", i), body),
+		})
+	}
+
+	// one archive is missing and another has the wrong size
+	missing := *archives[3]
+	missing.URL = "https://verify-bucket.s3.amazonaws.com/1/missing.jsonl.gz"
+	archives[3] = &missing
+	archives[6].Size = 3
+
+	failures := VerifyS3Archives(ctx, config, s3Client, archives)
+	assert.Equal(t, 2, len(failures))
+	assert.EqualError(t, failures[archives[3]], "archive object missing from s3: https://verify-bucket.s3.amazonaws.com/1/missing.jsonl.gz")
+	assert.Error(t, failures[archives[6]])
+	assert.Equal(t, 10, s3Client.heads)
+	assert.Equal(t, map[string]string{"4": failures[archives[3]].Error(), "7": failures[archives[6]].Error()}, describeFailures(failures))
+
+	// verifying again only checks the failures
+	failures = VerifyS3Archives(ctx, config, s3Client, archives)
+	assert.Equal(t, 2, len(failures))
+	assert.Equal(t, 12, s3Client.heads)
+
+	// as does verifying a single archive before deleting it
+	assert.NoError(t, verifyArchive(ctx, s3Client, archives[0]))
+	assert.Error(t, verifyArchive(ctx, s3Client, archives[6]))
+	assert.Equal(t, 13, s3Client.heads)
+
+	// a different expected size isn't the same verification
+	resized := *archives[0]
+	resized.Size = 5
+	assert.Error(t, verifyArchive(ctx, s3Client, &resized))
+	assert.Equal(t, 14, s3Client.heads)
+
+	// archives we've downloaded don't need checking at all
+	body := []byte("rolled up")
+	hash := md5.Sum(body)
+	daily := &Archive{ID: 11, Size: int64(len(body)), Hash: hex.EncodeToString(hash[:]), URL: s3Client.putObject("verify-bucket", "/1/message_D20170901_hash.jsonl.gz", body)}
+	markVerified(daily)
+	assert.NoError(t, verifyArchive(ctx, s3Client, daily))
+	assert.Equal(t, 14, s3Client.heads)
+}
+
+func TestMinVerificationsBeforeDelete(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	s3Client := newMockS3Client()
+
+	config := NewConfig()
+	config.Delete = true
+	config.MinVerificationsBeforeDelete = 2
+	orgs, err := GetActiveOrgs(ctx, db, config)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	created, err := CreateOrgArchives(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 61, len(created))
+
+	// nothing has been verified yet so nothing can be deleted
+	deleted, err := DeleteArchivedOrgRecords(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(deleted))
+
+	// the daily without a URL never passes
+	verified, err := VerifyArchives(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 61, len(verified))
+	assertCount(t, db, 61, `SELECT count(*) FROM archiver_archive_verifications WHERE verification_count = 1`)
+
+	// verifying again the same day doesn't count
+	heads := s3Client.heads
+	verified, err = VerifyArchives(ctx, now.Add(time.Hour), config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 61, len(verified))
+	assert.Equal(t, heads+61, s3Client.heads)
+	assertCount(t, db, 61, `SELECT count(*) FROM archiver_archive_verifications WHERE verification_count = 1`)
+
+	deleted, err = DeleteArchivedOrgRecords(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(deleted))
+
+	// verifying the next day does
+	now = now.AddDate(0, 0, 1)
+	verified, err = VerifyArchives(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 61, len(verified))
+	assertCount(t, db, 61, `SELECT count(*) FROM archiver_archive_verifications WHERE verification_count = 2`)
+
+	deleted, err = DeleteArchivedOrgRecords(ctx, now, config, db, s3Client, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, 61, len(deleted))
+
+	// rebuilding an archive means verifying its new object all over again
+	assert.NoError(t, WriteArchiveToDB(ctx, db, created[0]))
+	assertCount(t, db, 0, `SELECT count(*) FROM archiver_archive_verifications WHERE archive_id = $1`, created[0].ID)
+}
@@ -2,11 +2,12 @@ package main
 
 import (
 	"context"
+	"net/http"
 	"os"
-	"strings"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/evalphobia/logrus_sentry"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
@@ -24,6 +25,22 @@ func main() {
 		logrus.Fatal("cannot delete archives and also not upload to s3")
 	}
 
+	if config.ContactGroupID != 0 && config.Delete {
+		logrus.Fatal("cannot delete records when archiving a contact group")
+	}
+
+	if config.ArchivePartialCurrent && config.ArchiveLagDays == 0 {
+		logrus.Fatal("cannot archive the current day without an archive lag to replace it with its daily")
+	}
+
+	if err := archives.CheckDeletionConsistency(config.DeletionConsistency); err != nil {
+		logrus.WithError(err).Fatal("invalid deletion consistency")
+	}
+
+	if err := archives.CheckPlausibilityMode(config.PlausibilityCheck); err != nil {
+		logrus.WithError(err).Fatal("invalid plausibility check")
+	}
+
 	// configure our logger
 	logrus.SetOutput(os.Stdout)
 	logrus.SetFormatter(&logrus.TextFormatter{})
@@ -34,6 +51,16 @@ func main() {
 	}
 	logrus.SetLevel(level)
 
+	// secrets such as our database URL may be kept in a secrets store rather than our environment
+	secrets, err := archives.NewSecretsClient(config)
+	if err != nil {
+		logrus.WithError(err).Fatal("invalid secrets provider")
+	}
+	err = archives.ResolveSecrets(context.Background(), config, secrets)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to resolve secrets")
+	}
+
 	// if we have a DSN entry, try to initialize it
 	if config.SentryDSN != "" {
 		hook, err := logrus_sentry.NewSentryHook(config.SentryDSN, []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel})
@@ -42,115 +69,681 @@ func main() {
 		hook.StacktraceConfiguration.Skip = 4
 		hook.StacktraceConfiguration.Context = 5
 		if err != nil {
-			logrus.Fatalf("invalid sentry DSN: '%s': %s", config.SentryDSN, err)
+			logrus.Fatalf("invalid sentry DSN: %s", err)
 		}
 		logrus.StandardLogger().Hooks.Add(hook)
 	}
 
-	// our settings shouldn't contain a timezone, nothing will work right with this not being a constant UTC
-	if strings.Contains(config.DB, "TimeZone") {
-		logrus.WithField("db", config.DB).Fatalf("invalid db connection string, do not specify a timezone, archiver always uses UTC")
+	// on bare metal, a lock file keeps cron from starting another archiver while we are still running
+	if config.LockFile != "" {
+		lock, err := archives.AcquireFileLock(config.LockFile, config.LockFileWait)
+		if err == archives.ErrLocked {
+			logrus.WithField("lock_file", config.LockFile).Warn("another archiver holds our lock file, exiting")
+			os.Exit(0)
+		}
+		if err != nil {
+			logrus.WithError(err).Fatal("unable to acquire lock file")
+		}
+		releaseOnExit(lock)
+		defer lock.Release()
 	}
 
-	// force our DB connection to be in UTC
-	if strings.Contains(config.DB, "?") {
-		config.DB += "&TimeZone=UTC"
-	} else {
-		config.DB += "?TimeZone=UTC"
+	// our config redacts its secrets so is safe to log
+	logrus.WithField("config", config).Debug("loaded config")
+
+	// our connections are always in UTC, nothing will work right with this not being a constant UTC
+	db, err := archives.OpenDB(config.DB)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to open database")
+	}
+	db.SetMaxOpenConns(maxOpenConns(config))
+
+	// limit how much of our bandwidth we use talking to S3
+	archives.ConfigureBandwidth(config)
+	archives.ConfigureUploadThrottle(config)
+
+	// refuse to start with a key layout we don't know rather than uploading archives somewhere unexpected
+	err = archives.ConfigureKeyLayout(config)
+	if err != nil {
+		logrus.WithError(err).Fatal("invalid key layout")
+	}
+
+	// builds which add steps of their own pass their hooks here, we have none
+	err = archives.ConfigureHooks(config, archives.NoopHooks{})
+	if err != nil {
+		logrus.WithError(err).Fatal("invalid hooks")
+	}
+
+	// installs without some apps don't have all the tables we archive, find out before we try every org
+	err = archives.CheckSchema(context.Background(), db, config)
+	if err != nil {
+		logrus.WithError(err).Fatal("missing tables")
 	}
 
-	db, err := sqlx.Open("postgres", config.DB)
+	// we never create our own tables, they must have been created by our migrations
+	err = archives.CheckSettingsTables(context.Background(), db)
 	if err != nil {
-		logrus.Fatal(err)
+		logrus.WithError(err).Fatal("missing archiver tables")
 	}
-	db.SetMaxOpenConns(2)
 
-	var s3Client s3iface.S3API
+	// a dry run is a one off which only reads our database, we exit once we've reported what we would do
+	if config.DryRun {
+		logrus.Exit(dryRun(config, db))
+	}
+
+	var s3Client archives.Storage
 	if config.UploadToS3 {
-		s3Client, err = archives.NewS3Client(config)
+		s3Client, err = archives.NewStorage(config)
+		if err != nil {
+			logrus.WithError(err).Fatal("unable to initialize storage client")
+		}
+	}
+
+	// make sure our run archives are consistently partitioned
+	if config.ArchiveRuns {
+		err = archives.CheckRunPartitionField(context.Background(), db, config)
 		if err != nil {
-			logrus.WithError(err).Fatal("unable to initialize s3 client")
+			logrus.WithError(err).Fatal("invalid run partition field")
 		}
 	}
 
+	// extra filters change which records we archive and delete, refuse to start with one that doesn't work
+	err = archives.CheckExtraFilters(context.Background(), db, config)
+	if err != nil {
+		logrus.WithError(err).Fatal("invalid extra filter")
+	}
+
+	// our retention window is evaluated from our time, but days against database timestamps, refuse to start if too far apart
+	_, err = archives.CheckClockSkew(context.Background(), db, config)
+	if err != nil {
+		logrus.WithError(err).Fatal("clock skew with database")
+	}
+
 	// ensure that we can actually write to the temp directory
 	err = archives.EnsureTempArchiveDirectory(config.TempDir)
 	if err != nil {
 		logrus.WithError(err).Fatal("cannot write to temp directory")
 	}
 
-	for {
-		start := time.Now().In(time.UTC)
+	// rebuilding a single day is a one off, we exit once done
+	if config.RebuildOrgID != 0 {
+		logrus.Exit(rebuildDayAndMonth(config, db, s3Client))
+	}
 
-		// convert the starttime to time.Time
-		layout := "15:04"
-		hour, err := time.Parse(layout, config.StartTime)
-		if err != nil {
-			logrus.WithError(err).Fatal("invalid start time supplied, format: HH:mm")
-		}
+	// scrubbing the archives of an org is a one off, we exit once done
+	if config.ScrubOrgID != 0 {
+		logrus.Exit(scrubArchives(config, db, s3Client))
+	}
 
-		// get our active orgs
-		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
-		orgs, err := archives.GetActiveOrgs(ctx, db, config)
-		cancel()
+	// a backfill is a one off, we exit once done or out of time and the next continues where we stopped
+	if config.Backfill {
+		logrus.Exit(runBackfill(config, db, s3Client))
+	}
 
-		if err != nil {
-			logrus.WithError(err).Error("error getting active orgs")
-			time.Sleep(time.Minute * 5)
+	// locating a record is a one off, we exit once done
+	if config.LocateOrgID != 0 {
+		logrus.Exit(locateRecord(config, db, s3Client))
+	}
+
+	// a self test is a one off, we exit once done
+	if config.SelfTest {
+		logrus.Exit(runSelfTest(config, s3Client))
+	}
+
+	// resolving duplicate dailies is a one off, we exit once done
+	if config.ResolveDuplicates {
+		logrus.Exit(resolveDuplicates(config, db, s3Client))
+	}
+
+	// migrating archives to the key prefixes of their types is a one off, we exit once done
+	if config.MigrateKeyPrefixes {
+		logrus.Exit(migrateKeyPrefixes(config, db, s3Client))
+	}
+
+	// planning and executing a plan are one offs, we exit once done
+	if config.Plan != "" {
+		logrus.Exit(writePlan(config, db))
+	}
+	if config.ExecutePlan != "" {
+		logrus.Exit(executePlan(config, db, s3Client))
+	}
 
-			// after this, reopen db connection to prevent using the same in case of connection problem that we have faced sometimes with broken pipe error
-			db, err = sqlx.Open("postgres", config.DB)
+	// serve our admin endpoints if configured
+	if config.AdminAddress != "" && config.AdminToken != "" {
+		server := archives.NewAdminServer(config, db, s3Client)
+		go func() {
+			err := server.ListenAndServe()
 			if err != nil {
-				logrus.Fatal(err)
+				logrus.WithError(err).Error("error serving admin endpoints")
 			}
-			db.SetMaxOpenConns(2)
+		}()
+	}
 
-			continue
-		}
+	// serve our metrics for Prometheus to scrape if configured
+	var metricsServer *http.Server
+	if config.MetricsPort != 0 {
+		metricsServer = archives.NewMetricsServer(config)
+		go func() {
+			err := metricsServer.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				logrus.WithError(err).Error("error serving metrics")
+			}
+		}()
+	}
+
+	// if we write success markers, check that our last success is recent, otherwise we've probably missed schedules
+	if config.ExitOnCompletion && config.WriteSuccessMarker && config.ReportPath != "" {
+		checkLastSuccess(config, s3Client)
+	}
 
-		// for each org, do our export
-		for _, org := range orgs {
-			// no single org should take more than 12 hours
-			ctx, cancel := context.WithTimeout(context.Background(), time.Hour*12)
-			log := logrus.WithField("org", org.Name).WithField("org_id", org.ID)
-
-			if config.ArchiveMessages {
-				_, _, err = archives.ArchiveOrg(ctx, time.Now(), config, db, s3Client, org, archives.MessageType)
-				if err != nil {
-					log.WithError(err).WithField("archive_type", archives.MessageType).Error("error archiving org messages")
-				}
+	// each phase starts at its own time of day, which is our start time unless configured otherwise
+	schedule, err := archives.SchedulePhases(config)
+	if err != nil {
+		logrus.WithError(err).Fatal("invalid start time supplied")
+	}
+
+	deps := &archives.CycleDeps{
+		DB:       db,
+		S3Client: s3Client,
+		ReopenDB: func() (*sqlx.DB, error) {
+			// our credentials may have been rotated since we last connected
+			err := archives.RefreshDBSecret(context.Background(), config, secrets)
+			if err != nil {
+				return nil, err
 			}
-			if config.ArchiveRuns {
-				_, _, err = archives.ArchiveOrg(ctx, time.Now(), config, db, s3Client, org, archives.RunType)
-				if err != nil {
-					log.WithError(err).WithField("archive_type", archives.RunType).Error("error archiving org runs")
-				}
+			reopened, err := archives.OpenDB(config.DB)
+			if err != nil {
+				return nil, err
 			}
+			reopened.SetMaxOpenConns(maxOpenConns(config))
+			return reopened, nil
+		},
+	}
+
+	exitCode := archives.RunCycles(context.Background(), config, deps, schedule)
 
-			cancel()
+	// we only get here when exiting on completion, let any scrape in progress finish first
+	if metricsServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		err := metricsServer.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			logrus.WithError(err).Error("error shutting down metrics server")
 		}
+	}
+
+	if exitCode != 0 {
+		logrus.Exit(exitCode)
+	}
+}
+
+// releaseOnExit releases the passed in lock whenever we exit, whether through logrus, as all our exits with a code
+// are, or because we were signalled to stop
+func releaseOnExit(lock *archives.FileLock) {
+	logrus.RegisterExitHandler(func() { lock.Release() })
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logrus.WithField("signal", sig).Info("signalled to stop, releasing lock file")
+		logrus.Exit(1)
+	}()
+}
 
-		// ok, we did all our work for our orgs, quit if so configured or sleep until the next day
-		if config.ExitOnCompletion {
-			break
+// maxOpenConns returns the number of database connections we need, one more than the archives we build at once
+func maxOpenConns(config *archives.Config) int {
+	building := 1
+	if config.BackfillConcurrency > 1 {
+		building = config.BackfillConcurrency
+	}
+	if config.Backfill && config.BackfillOrgConcurrency > 1 {
+		building *= config.BackfillOrgConcurrency
+	}
+	return building + 1
+}
+
+// rebuildDayAndMonth rebuilds the configured daily and its monthly, returning our exit code
+func rebuildDayAndMonth(config *archives.Config, db *sqlx.DB, s3Client archives.Storage) int {
+	date, err := archives.ParseDayInput(config.RebuildDate)
+	if err != nil {
+		logrus.WithError(err).Error("invalid rebuild date")
+		return 1
+	}
+
+	archiveType := archives.ArchiveType(config.RebuildType)
+	if !archives.ValidArchiveType(config.RebuildType) {
+		logrus.WithField("type", config.RebuildType).Error("invalid rebuild type, must be message, run, contact, session, broadcast or channel_event")
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour*12)
+	defer cancel()
+
+	org, err := archives.GetOrg(ctx, db, config, config.RebuildOrgID)
+	if err != nil || org == nil {
+		logrus.WithError(err).WithField("org_id", config.RebuildOrgID).Error("unable to find org to rebuild")
+		return 1
+	}
+
+	if config.RebuildEndDate != "" {
+		return rebuildDays(ctx, config, db, s3Client, *org, date, archiveType)
+	}
+
+	logrus.WithField("org_id", org.ID).WithField("start", date.Start).WithField("end", date.End).Info("rebuilding day and month")
+	result, err := archives.RebuildDayAndMonth(ctx, db, config, s3Client, *org, date.Start, archiveType)
+	if err != nil {
+		logrus.WithError(err).WithField("org_id", org.ID).Error("error rebuilding day and month")
+		return 1
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"org_id":           org.ID,
+		"dry_run":          result.DryRun,
+		"old_daily_hash":   result.OldDailyHash,
+		"new_daily_hash":   result.NewDailyHash,
+		"old_monthly_hash": result.OldMonthlyHash,
+		"new_monthly_hash": result.NewMonthlyHash,
+	}).Info("rebuild complete")
+	return 0
+}
+
+// rebuildDays rebuilds the configured range of days whose records haven't been deleted and their monthlies, returning
+// our exit code
+func rebuildDays(ctx context.Context, config *archives.Config, db *sqlx.DB, s3Client archives.Storage, org archives.Org, startDate archives.DateInput, archiveType archives.ArchiveType) int {
+	endDate, err := archives.ParseDayInput(config.RebuildEndDate)
+	if err != nil {
+		logrus.WithError(err).Error("invalid rebuild end date")
+		return 1
+	}
+	if endDate.Start.Before(startDate.Start) {
+		logrus.WithField("rebuild_date", startDate).WithField("rebuild_end_date", endDate).Error("invalid rebuild end date, before rebuild date")
+		return 1
+	}
+
+	logrus.WithField("org_id", org.ID).WithField("start", startDate.Start).WithField("end", endDate.End).Info("rebuilding days")
+	results, err := archives.RebuildDays(ctx, db, config, s3Client, org, startDate.Start, endDate.Start, archiveType)
+	for _, result := range results {
+		logrus.WithFields(logrus.Fields{
+			"org_id":           org.ID,
+			"date":             result.Daily.StartDate.Format("2006-01-02"),
+			"dry_run":          result.DryRun,
+			"old_daily_hash":   result.OldDailyHash,
+			"new_daily_hash":   result.NewDailyHash,
+			"old_monthly_hash": result.OldMonthlyHash,
+			"new_monthly_hash": result.NewMonthlyHash,
+		}).Info("rebuilt day")
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("org_id", org.ID).Error("error rebuilding days")
+		return 1
+	}
+
+	logrus.WithField("org_id", org.ID).WithField("days", len(results)).Info("rebuild complete")
+	return 0
+}
+
+// scrubArchives applies our redaction for anon orgs to the configured archives of an org, returning our exit code
+func scrubArchives(config *archives.Config, db *sqlx.DB, s3Client archives.Storage) int {
+	startDate, err := archives.ParseDayInput(config.ScrubStartDate)
+	if err != nil {
+		logrus.WithError(err).Error("invalid scrub start date")
+		return 1
+	}
+	endDate, err := archives.ParseDayInput(config.ScrubEndDate)
+	if err != nil {
+		logrus.WithError(err).Error("invalid scrub end date")
+		return 1
+	}
+	if endDate.Start.Before(startDate.Start) {
+		logrus.WithField("scrub_start_date", startDate).WithField("scrub_end_date", endDate).Error("invalid scrub end date, before scrub start date")
+		return 1
+	}
+
+	archiveType := archives.ArchiveType(config.ScrubType)
+	if !archives.ValidArchiveType(config.ScrubType) {
+		logrus.WithField("type", config.ScrubType).Error("invalid scrub type, must be message, run, contact, session, broadcast or channel_event")
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour*12)
+	defer cancel()
+
+	org, err := archives.GetOrg(ctx, db, config, config.ScrubOrgID)
+	if err != nil || org == nil {
+		logrus.WithError(err).WithField("org_id", config.ScrubOrgID).Error("unable to find org to scrub")
+		return 1
+	}
+
+	logrus.WithField("org_id", org.ID).WithField("start", startDate.Start).WithField("end", endDate.End).WithField("dry_run", config.ScrubDryRun).Info("scrubbing archives")
+	results, err := archives.ScrubOrgArchives(ctx, config, db, s3Client, *org, archiveType, startDate.Start, endDate.End, config.ScrubDryRun)
+
+	scrubbed, modified := 0, 0
+	for _, result := range results {
+		if result.Modified > 0 {
+			scrubbed++
+			modified += result.Modified
 		}
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("org_id", org.ID).WithField("scrubbed", scrubbed).Error("error scrubbing archives")
+		return 1
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"org_id":   org.ID,
+		"dry_run":  config.ScrubDryRun,
+		"archives": len(results),
+		"scrubbed": scrubbed,
+		"modified": modified,
+	}).Info("scrub complete")
+	return 0
+}
 
-		// build up our next start
-		now := time.Now().In(time.UTC)
-		nextDay := time.Date(now.Year(), now.Month(), now.Day(), hour.Hour(), hour.Minute(), 0, 0, time.UTC)
+// runBackfill builds the missing archives of our active orgs within our backfill limits, returning our exit code
+func runBackfill(config *archives.Config, db *sqlx.DB, s3Client archives.Storage) int {
+	ctx := context.Background()
+
+	orgs, err := archives.GetActiveOrgs(ctx, db, config)
+	if err != nil {
+		logrus.WithError(err).Error("error getting active orgs")
+		return 1
+	}
+
+	logrus.WithField("orgs", len(orgs)).WithField("progress", config.BackfillProgress).Info("starting backfill")
+	report, err := archives.RunBackfill(ctx, config, db, s3Client, orgs)
+	if err != nil {
+		logrus.WithError(err).Error("error backfilling")
+		return 1
+	}
+
+	for _, remaining := range report.Remaining {
+		logrus.WithFields(logrus.Fields{
+			"org_id":       remaining.OrgID,
+			"archive_type": remaining.ArchiveType,
+			"last_month":   remaining.LastMonth,
+			"remaining":    remaining.Remaining,
+			"failed":       remaining.Failed,
+		}).Info("backfill work remaining")
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"elapsed":            report.Elapsed,
+		"stopped":            report.Stopped,
+		"built":              report.Built,
+		"failed":             report.Failed,
+		"records":            report.Records,
+		"done":               report.Done,
+		"remaining_orgs":     len(report.Remaining),
+		"remaining_archives": report.RemainingArchives,
+	}).Info("backfill complete")
+
+	if report.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// locateRecord reports which archives the record we are configured to locate belongs in, returning our exit code
+func locateRecord(config *archives.Config, db *sqlx.DB, s3Client archives.Storage) int {
+	archiveType := archives.ArchiveType(config.LocateType)
+	if !archives.ValidArchiveType(config.LocateType) {
+		logrus.WithField("type", config.LocateType).Error("invalid locate type, must be message, run, contact, session, broadcast or channel_event")
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+	defer cancel()
+
+	org, err := archives.GetOrg(ctx, db, config, config.LocateOrgID)
+	if err != nil || org == nil {
+		logrus.WithError(err).WithField("org_id", config.LocateOrgID).Error("unable to find org to locate record of")
+		return 1
+	}
+
+	var timestamp time.Time
+	if config.LocateID != 0 {
+		timestamp, err = archives.LookupRecordTimestamp(ctx, db, config, *org, archiveType, config.LocateID)
+	} else {
+		timestamp, err = time.Parse(time.RFC3339Nano, config.LocateTime)
+		if err != nil {
+			var day archives.DateInput
+			day, err = archives.ParseDayInput(config.LocateTime)
+			timestamp = day.Start
+		}
+	}
+	if err != nil {
+		logrus.WithError(err).Error("unable to find timestamp of record to locate, format: RFC3339 or YYYY-MM-DD")
+		return 1
+	}
+
+	location, err := archives.LocateRecord(ctx, db, *org, archiveType, timestamp)
+	if err != nil {
+		logrus.WithError(err).WithField("org_id", org.ID).Error("error locating record")
+		return 1
+	}
+
+	logArchive := func(archive *archives.Archive, exists bool) {
+		// dailies may have been transitioned to cold storage, in which case they need restoring before they can be read
+		if exists && archive.URL != "" && s3Client != nil {
+			_, err := archives.HeadStorageClass(ctx, s3Client, archive)
+			if err != nil {
+				logrus.WithError(err).WithField("archive_id", archive.ID).Warn("error looking up storage class of archive")
+			}
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"org_id":        org.ID,
+			"archive_type":  archiveType,
+			"timestamp":     location.Timestamp,
+			"period":        archive.Period,
+			"start_date":    archive.StartDate,
+			"end_date":      archive.EndDate(),
+			"exists":        exists,
+			"archive_id":    archive.ID,
+			"url":           archive.URL,
+			"storage_class": archive.StorageClass,
+		}).Info("record belongs in archive")
+	}
+	logArchive(location.Daily, location.DailyExists)
+	logArchive(location.Monthly, location.MonthlyExists)
+	return 0
+}
+
+// runSelfTest archives a synthetic org end to end, returning the code we should exit with
+func runSelfTest(config *archives.Config, s3Client archives.Storage) int {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+
+	result, err := archives.RunSelfTest(ctx, time.Now(), config, s3Client)
+	if err != nil {
+		logrus.WithError(err).Error("self test failed")
+		return 1
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"messages_created": len(result.Created[archives.MessageType]),
+		"messages_deleted": len(result.Deleted[archives.MessageType]),
+		"runs_created":     len(result.Created[archives.RunType]),
+		"runs_deleted":     len(result.Deleted[archives.RunType]),
+		"elapsed":          result.Elapsed,
+	}).Info("self test passed")
+	return 0
+}
+
+// resolveDuplicates reports the archive we keep of each day with duplicate dailies, removing the others if configured
+// to, returning our exit code
+func resolveDuplicates(config *archives.Config, db *sqlx.DB, s3Client archives.Storage) int {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+
+	dryRun := !config.ResolveDuplicatesApply
+	duplicates, err := archives.ResolveDuplicateDailies(ctx, db, s3Client, dryRun)
+
+	unresolved := 0
+	for _, duplicate := range duplicates {
+		if duplicate.Unresolved != "" {
+			logrus.WithField("reason", duplicate.Unresolved).Error("unable to resolve duplicate dailies")
+			unresolved++
+			continue
+		}
 
-		// if this time is before our actual start, add a day
-		if nextDay.Before(start) {
-			nextDay = nextDay.AddDate(0, 0, 1)
+		removed := make([]int, 0, len(duplicate.Remove))
+		for _, daily := range duplicate.Remove {
+			removed = append(removed, daily.ID)
 		}
+		logrus.WithFields(logrus.Fields{
+			"org_id":       duplicate.Keep.OrgID,
+			"archive_type": duplicate.Keep.ArchiveType,
+			"start_date":   duplicate.Keep.StartDate.Format("2006-01-02"),
+			"kept":         duplicate.Keep.ID,
+			"removed":      removed,
+			"dry_run":      dryRun,
+		}).Info("resolved duplicate dailies")
+	}
+	if err != nil {
+		logrus.WithError(err).Error("error resolving duplicate dailies")
+		return 1
+	}
+
+	logrus.WithField("days", len(duplicates)).WithField("unresolved", unresolved).WithField("dry_run", dryRun).Info("resolving duplicates complete")
+	if unresolved > 0 {
+		return 1
+	}
+	return 0
+}
 
-		napTime := nextDay.Sub(time.Now().In(time.UTC))
+// migrateKeyPrefixes copies the archives of our active orgs to the key prefixes of their types, returning our exit code
+func migrateKeyPrefixes(config *archives.Config, db *sqlx.DB, s3Client archives.Storage) int {
+	ctx := context.Background()
 
-		if napTime > time.Duration(0) {
-			logrus.WithField("time", napTime).WithField("next_start", nextDay).Info("Sleeping until next UTC day")
-			time.Sleep(napTime)
-		} else {
-			logrus.WithField("next_start", nextDay).Info("Rebuilding immediately without sleep")
+	orgs, err := archives.GetActiveOrgs(ctx, db, config)
+	if err != nil {
+		logrus.WithError(err).Error("error getting active orgs")
+		return 1
+	}
+
+	migrated, failed := 0, 0
+	for _, org := range orgs {
+		for _, archiveType := range archives.ArchiveTypes {
+			count, err := archives.MigrateKeyPrefixes(ctx, config, db, s3Client, org, archiveType)
+			migrated += count
+			if err != nil {
+				logrus.WithError(err).WithField("org_id", org.ID).WithField("archive_type", archiveType).Error("error migrating archives to key prefix")
+				failed++
+			}
 		}
 	}
+
+	logrus.WithField("orgs", len(orgs)).WithField("migrated", migrated).WithField("failed", failed).Info("migrating key prefixes complete")
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// writePlan writes a plan of the work we would do for our active orgs, returning our exit code
+func writePlan(config *archives.Config, db *sqlx.DB) int {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+
+	orgs, err := archives.GetActiveOrgs(ctx, db, config)
+	if err != nil {
+		logrus.WithError(err).Error("error getting active orgs")
+		return 1
+	}
+
+	now, err := archives.Now(ctx, db, config)
+	if err != nil {
+		logrus.WithError(err).Error("error getting current time")
+		return 1
+	}
+
+	plan, err := archives.BuildPlan(ctx, now, config, db, orgs)
+	if err != nil {
+		logrus.WithError(err).Error("error building plan")
+		return 1
+	}
+
+	err = archives.WritePlan(config.Plan, plan)
+	if err != nil {
+		logrus.WithError(err).Error("error writing plan")
+		return 1
+	}
+
+	logrus.WithField("path", config.Plan).WithField("orgs", len(orgs)).WithField("now", now).Info("wrote plan")
+	return 0
+}
+
+// dryRun logs the work we would do for our active orgs without doing any of it, returning our exit code
+func dryRun(config *archives.Config, db *sqlx.DB) int {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+
+	orgs, err := archives.GetActiveOrgs(ctx, db, config)
+	if err != nil {
+		logrus.WithError(err).Error("error getting active orgs")
+		return 1
+	}
+
+	now, err := archives.Now(ctx, db, config)
+	if err != nil {
+		logrus.WithError(err).Error("error getting current time")
+		return 1
+	}
+
+	err = archives.DryRun(ctx, now, config, db, orgs)
+	if err != nil {
+		logrus.WithError(err).Error("error during dry run")
+		return 1
+	}
+
+	logrus.WithField("orgs", len(orgs)).WithField("now", now).Info("dry run complete")
+	return 0
+}
+
+// executePlan executes the plan we are configured to, returning our exit code
+func executePlan(config *archives.Config, db *sqlx.DB, s3Client archives.Storage) int {
+	plan, err := archives.ReadPlan(config.ExecutePlan)
+	if err != nil {
+		logrus.WithError(err).Error("error reading plan")
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour*12*time.Duration(len(plan.Orgs)+1))
+	defer cancel()
+
+	created, deleted, err := archives.ExecutePlan(ctx, config, db, s3Client, plan)
+	logrus.WithFields(logrus.Fields{
+		"path":    config.ExecutePlan,
+		"created": len(created),
+		"deleted": len(deleted),
+	}).Info("executed plan")
+	if err != nil {
+		logrus.WithError(err).Error("error executing plan")
+		return 1
+	}
+	return 0
+}
+
+// checkLastSuccess warns if the success marker left by our previous run is missing or too old
+func checkLastSuccess(config *archives.Config, s3Client archives.Storage) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	last, err := archives.ReadLastSuccess(ctx, config, s3Client)
+	if err != nil {
+		logrus.WithError(err).Error("error reading previous success marker")
+		return
+	}
+
+	if last == nil {
+		logrus.Warn("no previous success marker found")
+		return
+	}
+
+	age := time.Since(last.FinishedOn)
+	if age > time.Hour*time.Duration(config.SuccessMaxAge) {
+		logrus.WithField("last_success", last.FinishedOn).WithField("age", age).Error("previous successful run is too old, schedules may have been missed")
+	}
 }
@@ -0,0 +1,6 @@
+-- archiver_settings holds state which must persist across runs, such as the run partition field and whether archiving
+-- is enabled
+CREATE TABLE IF NOT EXISTS archiver_settings (
+	key varchar(64) PRIMARY KEY,
+	value text NOT NULL
+);
@@ -0,0 +1,6 @@
+-- archiver_archive_versions holds the record format version of each archive, archives without a row predate it and are
+-- version 1
+CREATE TABLE IF NOT EXISTS archiver_archive_versions (
+	archive_id integer PRIMARY KEY,
+	version integer NOT NULL
+);
@@ -0,0 +1,14 @@
+-- archiver_group_exports holds the exports of the records of a contact group already uploaded
+CREATE TABLE IF NOT EXISTS archiver_group_exports (
+	contact_group_id integer NOT NULL,
+	org_id integer NOT NULL,
+	archive_type varchar(16) NOT NULL,
+	start_date date NOT NULL,
+	period varchar(1) NOT NULL,
+	record_count integer NOT NULL,
+	size bigint NOT NULL,
+	hash text NOT NULL,
+	url varchar(200) NOT NULL,
+	exported_on timestamp with time zone NOT NULL,
+	PRIMARY KEY (contact_group_id, org_id, archive_type, start_date, period)
+);
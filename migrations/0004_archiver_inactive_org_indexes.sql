@@ -0,0 +1,4 @@
+-- indexes letting us find orgs without recent messages or runs when inactive-days is set, only needed if archiving
+-- inactive orgs, created concurrently so must be applied outside of a transaction
+CREATE INDEX CONCURRENTLY IF NOT EXISTS archiver_msgs_msg_org_created_on ON msgs_msg(org_id, created_on);
+CREATE INDEX CONCURRENTLY IF NOT EXISTS archiver_flows_flowrun_org_created_on ON flows_flowrun(org_id, created_on);
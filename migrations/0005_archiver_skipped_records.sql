@@ -0,0 +1,9 @@
+-- archiver_skipped_records holds the records too big to archive, which are left in place
+CREATE TABLE IF NOT EXISTS archiver_skipped_records (
+	archive_type varchar(16) NOT NULL,
+	record_id bigint NOT NULL,
+	org_id integer NOT NULL,
+	size bigint NOT NULL,
+	skipped_on timestamp with time zone NOT NULL,
+	PRIMARY KEY (archive_type, record_id)
+);
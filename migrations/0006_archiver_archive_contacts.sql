@@ -0,0 +1,7 @@
+-- archiver_archive_contacts holds the distinct contacts of message archives, exact for archives built from the
+-- database and estimated from their dailies for rollups
+CREATE TABLE IF NOT EXISTS archiver_archive_contacts (
+	archive_id integer PRIMARY KEY,
+	contact_count integer NOT NULL,
+	sketch bytea NOT NULL
+);
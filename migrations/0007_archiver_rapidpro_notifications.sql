@@ -0,0 +1,7 @@
+-- archiver_rapidpro_notifications holds the new monthlies RapidPro is told about, those not yet notified being retried
+CREATE TABLE IF NOT EXISTS archiver_rapidpro_notifications (
+	archive_id integer PRIMARY KEY,
+	org_id integer NOT NULL,
+	queued_on timestamp with time zone NOT NULL,
+	notified_on timestamp with time zone NULL
+);
@@ -0,0 +1,12 @@
+-- archiver_partial_archives holds the archives of the current day so far, until their dailies replace them
+CREATE TABLE IF NOT EXISTS archiver_partial_archives (
+	org_id integer NOT NULL,
+	archive_type varchar(16) NOT NULL,
+	start_date date NOT NULL,
+	record_count integer NOT NULL,
+	size bigint NOT NULL,
+	hash text NOT NULL,
+	url varchar(200) NOT NULL,
+	built_on timestamp with time zone NOT NULL,
+	PRIMARY KEY (org_id, archive_type, start_date)
+);
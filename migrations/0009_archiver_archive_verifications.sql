@@ -0,0 +1,6 @@
+-- archiver_archive_verifications holds on how many days the objects of archives needing deletion were verified
+CREATE TABLE IF NOT EXISTS archiver_archive_verifications (
+	archive_id integer PRIMARY KEY,
+	verification_count integer NOT NULL,
+	last_verified_on date NOT NULL
+);
@@ -0,0 +1,9 @@
+-- archiver_archive_renditions holds the copies of archives in other formats published alongside them
+CREATE TABLE IF NOT EXISTS archiver_archive_renditions (
+	archive_id integer NOT NULL,
+	format varchar(16) NOT NULL,
+	size bigint NOT NULL,
+	hash text NOT NULL,
+	url varchar(200) NOT NULL,
+	PRIMARY KEY (archive_id, format)
+);
@@ -6,7 +6,8 @@ CREATE TABLE orgs_org (
     name character varying(255) NOT NULL,
     is_anon boolean NOT NULL,
     is_active boolean NOT NULL,
-    created_on timestamp with time zone NOT NULL
+    created_on timestamp with time zone NOT NULL,
+    config text NULL
 );
 
 DROP TABLE IF EXISTS channels_channel CASCADE;
@@ -52,7 +53,8 @@ DROP TABLE IF EXISTS contacts_contactgroup CASCADE;
 CREATE TABLE contacts_contactgroup (
     id serial primary key,
     uuid character varying(36) NOT NULL,
-    name character varying(128) NOT NULL
+    name character varying(128) NOT NULL,
+    org_id integer NOT NULL references orgs_org(id) on delete cascade
 );
 
 DROP TABLE IF EXISTS contacts_contactgroup_contacts CASCADE;
@@ -161,6 +163,18 @@ CREATE TABLE auth_user (
 DROP TABLE IF EXISTS api_webhookevent CASCADE;
 DROP TABLE IF EXISTS flows_flowpathrecentrun CASCADE;
 DROP TABLE IF EXISTS flows_actionlog CASCADE;
+DROP TABLE IF EXISTS flows_flowsession CASCADE;
+CREATE TABLE flows_flowsession (
+    id serial primary key,
+    uuid character varying(36) NOT NULL UNIQUE,
+    org_id integer NOT NULL references orgs_org(id),
+    contact_id integer NOT NULL references contacts_contact(id),
+    status varchar(1) NOT NULL,
+    output text NULL,
+    created_on timestamp with time zone NOT NULL,
+    ended_on timestamp with time zone NULL
+);
+
 DROP TABLE IF EXISTS flows_flowrun CASCADE;
 CREATE TABLE flows_flowrun (
     id serial primary key,
@@ -174,6 +188,7 @@ CREATE TABLE flows_flowrun (
     path text NOT NULL,
     events jsonb NOT NULL,
     parent_id integer NULL references flows_flowrun(id),
+    session_id integer NULL references flows_flowsession(id),
     created_on timestamp with time zone NOT NULL,
     modified_on timestamp with time zone NOT NULL,
     exited_on timestamp with time zone NULL,
@@ -183,6 +198,29 @@ CREATE TABLE flows_flowrun (
     delete_reason char(1) NULL
 );
 
+DROP TABLE IF EXISTS channels_channelevent CASCADE;
+CREATE TABLE channels_channelevent (
+    id serial primary key,
+    event_type varchar(16) NOT NULL,
+    extra text NULL,
+    occurred_on timestamp with time zone NOT NULL,
+    created_on timestamp with time zone NOT NULL,
+    channel_id integer NOT NULL references channels_channel(id),
+    contact_id integer NOT NULL references contacts_contact(id),
+    contact_urn_id integer NULL references contacts_contacturn(id),
+    org_id integer NOT NULL references orgs_org(id)
+);
+
+DROP TABLE IF EXISTS tickets_ticket CASCADE;
+CREATE TABLE tickets_ticket (
+    id serial primary key,
+    uuid character varying(36) NOT NULL,
+    status character(1) NOT NULL,
+    opened_on timestamp with time zone NOT NULL,
+    contact_id integer NOT NULL references contacts_contact(id),
+    org_id integer NOT NULL references orgs_org(id)
+);
+
 DROP TABLE IF EXISTS archives_archive CASCADE;
 CREATE TABLE archives_archive (
     id serial primary key,
@@ -201,6 +239,88 @@ CREATE TABLE archives_archive (
     rollup_id integer NULL
 );
 
+DROP TABLE IF EXISTS archiver_settings CASCADE;
+CREATE TABLE archiver_settings (
+    key varchar(64) PRIMARY KEY,
+    value text NOT NULL
+);
+
+DROP TABLE IF EXISTS archiver_archive_versions CASCADE;
+CREATE TABLE archiver_archive_versions (
+    archive_id integer PRIMARY KEY,
+    version integer NOT NULL
+);
+
+DROP TABLE IF EXISTS archiver_group_exports CASCADE;
+CREATE TABLE archiver_group_exports (
+    contact_group_id integer NOT NULL,
+    org_id integer NOT NULL,
+    archive_type varchar(16) NOT NULL,
+    start_date date NOT NULL,
+    period varchar(1) NOT NULL,
+    record_count integer NOT NULL,
+    size bigint NOT NULL,
+    hash text NOT NULL,
+    url varchar(200) NOT NULL,
+    exported_on timestamp with time zone NOT NULL,
+    PRIMARY KEY (contact_group_id, org_id, archive_type, start_date, period)
+);
+
+DROP TABLE IF EXISTS archiver_skipped_records CASCADE;
+CREATE TABLE archiver_skipped_records (
+    archive_type varchar(16) NOT NULL,
+    record_id bigint NOT NULL,
+    org_id integer NOT NULL,
+    size bigint NOT NULL,
+    skipped_on timestamp with time zone NOT NULL,
+    PRIMARY KEY (archive_type, record_id)
+);
+
+DROP TABLE IF EXISTS archiver_archive_contacts CASCADE;
+CREATE TABLE archiver_archive_contacts (
+    archive_id integer PRIMARY KEY,
+    contact_count integer NOT NULL,
+    sketch bytea NOT NULL
+);
+
+DROP TABLE IF EXISTS archiver_rapidpro_notifications CASCADE;
+CREATE TABLE archiver_rapidpro_notifications (
+    archive_id integer PRIMARY KEY,
+    org_id integer NOT NULL,
+    queued_on timestamp with time zone NOT NULL,
+    notified_on timestamp with time zone NULL
+);
+
+DROP TABLE IF EXISTS archiver_partial_archives CASCADE;
+CREATE TABLE archiver_partial_archives (
+    org_id integer NOT NULL,
+    archive_type varchar(16) NOT NULL,
+    start_date date NOT NULL,
+    record_count integer NOT NULL,
+    size bigint NOT NULL,
+    hash text NOT NULL,
+    url varchar(200) NOT NULL,
+    built_on timestamp with time zone NOT NULL,
+    PRIMARY KEY (org_id, archive_type, start_date)
+);
+
+DROP TABLE IF EXISTS archiver_archive_verifications CASCADE;
+CREATE TABLE archiver_archive_verifications (
+    archive_id integer PRIMARY KEY,
+    verification_count integer NOT NULL,
+    last_verified_on date NOT NULL
+);
+
+DROP TABLE IF EXISTS archiver_archive_renditions CASCADE;
+CREATE TABLE archiver_archive_renditions (
+    archive_id integer NOT NULL,
+    format varchar(16) NOT NULL,
+    size bigint NOT NULL,
+    hash text NOT NULL,
+    url varchar(200) NOT NULL,
+    PRIMARY KEY (archive_id, format)
+);
+
 CREATE TABLE channels_channellog (
     id serial primary key,
     msg_id integer NOT NULL references msgs_msg(id)
@@ -251,11 +371,11 @@ INSERT INTO contacts_contacturn(id, contact_id, scheme, org_id, priority, path,
 (10, 9, 'facebook', 2, 90, 1000001, 'funguy', 'facebook:1000001'),
 (11, 10, 'twitterid', 2, 90, 1000001, 'fungal', 'twitterid:1000001');
 
-INSERT INTO contacts_contactgroup(id, uuid, name) VALUES
-(1, '4ea0f313-2f62-4e57-bdf0-232b5191dd57', 'Group 1'),
-(2, '4c016340-468d-4675-a974-15cb7a45a5ab', 'Group 2'),
-(3, 'e61b5bf7-8ddf-4e05-b0a8-4c46a6b68cff', 'Group 3'),
-(4, '529bac39-550a-4d6f-817c-1833f3449007', 'Group 4');
+INSERT INTO contacts_contactgroup(id, uuid, name, org_id) VALUES
+(1, '4ea0f313-2f62-4e57-bdf0-232b5191dd57', 'Group 1', 1),
+(2, '4c016340-468d-4675-a974-15cb7a45a5ab', 'Group 2', 2),
+(3, 'e61b5bf7-8ddf-4e05-b0a8-4c46a6b68cff', 'Group 3', 3),
+(4, '529bac39-550a-4d6f-817c-1833f3449007', 'Group 4', 1);
 
 INSERT INTO contacts_contactgroup_contacts(id, contact_id, contactgroup_id) VALUES
 (1, 1, 1),
@@ -268,6 +388,16 @@ INSERT INTO msgs_broadcast(id, text, created_on, purged, org_id, schedule_id) VA
 (3, 'base=>"not purged"'::hstore, '2017-08-12 19:11:59.890662+02:00', FALSE, 2, NULL),
 (4, 'base=>"new"'::hstore, '2019-08-12 19:11:59.890662+02:00', FALSE, 2, NULL);
 
+INSERT INTO msgs_broadcast_contacts(id, broadcast_id, contact_id) VALUES
+(1, 2, 6),
+(2, 2, 8);
+
+INSERT INTO msgs_broadcast_groups(id, broadcast_id, group_id) VALUES
+(1, 2, 2);
+
+INSERT INTO msgs_broadcast_urns(id, broadcast_id, contacturn_id) VALUES
+(1, 2, 7);
+
 INSERT INTO msgs_msg(id, broadcast_id, uuid, text, created_on, sent_on, modified_on, direction, status, visibility, msg_type, attachments, channel_id, contact_id, contact_urn_id, org_id, msg_count, error_count, next_attempt) VALUES
 (1, NULL, '2f969340-704a-4aa2-a1bd-2f832a21d257', 'message 1', '2017-08-12 21:11:59.890662+00', '2017-08-12 21:11:59.890662+00', '2017-08-12 21:11:59.890662+00', 'I', 'H', 'V', 'I', NULL, 2, 6, 7, 2, 1, 0, '2017-08-12 21:11:59.890662+00'),
 (2, NULL, 'abe87ac1-015c-4803-be29-1e89509fe682', 'message 2', '2017-08-12 21:11:59.890662+00', '2017-08-12 21:11:59.890662+00', '2017-08-12 21:11:59.890662+00', 'I', 'H', 'D', 'I', NULL, 2, 6, 7, 2, 1, 0, '2017-08-12 21:11:59.890662+00'),
@@ -276,7 +406,8 @@ INSERT INTO msgs_msg(id, broadcast_id, uuid, text, created_on, sent_on, modified
 (5, NULL, 'f557972e-2eb5-42fa-9b87-902116d18787', 'message 5', '2017-08-11 21:11:59.890662+02:00', '2017-08-11 21:11:59.890662+02:00', '2017-08-11 21:11:59.890662+02:00', 'I', 'H', 'V', 'I', NULL, 3, 7, 8, 3, 1, 0, '2017-08-11 21:11:59.890662+02:00'),
 (6, 2, '579d148c-0ab1-4afb-832f-afb1fe0e19b7', 'message 6', '2017-10-08 21:11:59.890662+00', '2017-10-08 21:11:59.890662+00', '2017-10-08 21:11:59.890662+00', 'I', 'H', 'V', 'I', NULL, 2, 6, 7, 2, 1, 0, '2017-10-08 21:11:59.890662+00'),
 (7, NULL, '7aeca469-2593-444e-afe4-4702317534c9', 'message 7', '2018-01-02 21:11:59.890662+00', '2018-01-02 21:11:59.890662+00', '2018-01-02 21:11:59.890662+00', 'I', 'H', 'V', 'I', NULL, 2, 6, 7, 2, 1, 0, '2018-01-02 21:11:59.890662+00'),
-(9, NULL, 'e14ab466-0d3b-436d-a0f7-5851fd7d9b7d', 'message 9', '2017-08-12 21:11:59.890662+00', '2017-08-12 21:11:59.890662+00', '2017-08-12 21:11:59.890662+00', 'O', 'S', 'V', 'F', NULL, NULL, 6, NULL, 2, 1, 0, '2017-08-12 21:11:59.890662+00');
+(9, NULL, 'e14ab466-0d3b-436d-a0f7-5851fd7d9b7d', 'message 9', '2017-08-12 21:11:59.890662+00', '2017-08-12 21:11:59.890662+00', '2017-08-12 21:11:59.890662+00', 'O', 'S', 'V', 'F', NULL, NULL, 6, NULL, 2, 1, 0, '2017-08-12 21:11:59.890662+00'),
+(10, NULL, '0b5c3d8e-9a41-4f4e-8c1b-2a7e6d9f3b51', 'imported message', '2017-09-15 10:00:00.000000+00', '2017-09-15 10:00:00.000000+00', '2017-09-15 10:00:00.000000+00', 'I', 'H', 'V', 'I', NULL, NULL, 1, 1, 1, 1, 0, '2017-09-15 10:00:00.000000+00');
 
 INSERT INTO msgs_label(id, uuid, name) VALUES
 (1, '1d9e3188-b74b-4ae0-a166-0de31aedb34a', 'Label 1'),
@@ -324,11 +455,28 @@ INSERT INTO flows_flowrun(id, uuid, responded, contact_id, flow_id, org_id, resu
 '[{"msg": {"urn": "tel:+12076661212", "text": "hi hi", "uuid": "543d2c4b-ff0b-4b87-a9a4-b2d6745cf470", "channel": {"name": "1223", "uuid": "d6597e08-8285-428c-8e7e-97c68adfa073"}}, "type": "msg_created", "step_uuid": "3a5014dd-7b14-4b7a-be52-0419c09340a6", "created_on": "2018-10-12T15:06:47.357682+00:00"}]',
 '2017-10-10 21:11:59.890662+02:00','2017-10-10 21:11:59.890662+02:00','2017-10-10 21:11:59.890662+02:00', 'C', 'C', NULL),
 (5, 'abed67d2-06b8-4749-8bb9-ecda037b673b', TRUE, 7, 2, 3, '{}', '[]', '[]', '2017-10-10 21:11:59.890663+02:00','2017-10-10 21:11:59.890662+02:00','2017-10-10 21:11:59.890662+02:00', 'C', 'C', NULL),
-(6, '6262eefe-a6e9-4201-9b76-a7f25e3b7f29', TRUE, 7, 2, 3, '{}', '[]', '[]', '2017-12-12 21:11:59.890662+02:00','2017-12-12 21:11:59.890662+02:00','2017-12-12 21:11:59.890662+02:00', 'C', 'C', NULL);
+(6, '6262eefe-a6e9-4201-9b76-a7f25e3b7f29', TRUE, 7, 2, 3, '{}', '[]', '[]', '2017-12-12 21:11:59.890662+02:00','2017-12-12 21:11:59.890662+02:00','2017-12-12 21:11:59.890662+02:00', 'C', 'C', NULL),
+(7, 'c4b5d1f8-27e4-4b63-8d8a-7ab2d4e1c7a3', TRUE, 6, 1, 2, '{}', '[]', '[]', '2017-08-13 10:00:00.000000+00','2017-08-14 10:00:00.000000+00','2017-08-14 10:00:00.000000+00', 'C', 'C', NULL),
+(8, '5e2f7a9c-3d16-4b8e-a0c4-7f1d9e6b2a38', TRUE, 1, 3, 1, '{}', '[]', '[]', '2017-09-20 10:00:00.000000+00','2017-09-20 10:00:00.000000+00','2017-09-20 10:00:00.000000+00', 'C', 'C', NULL);
 
 INSERT INTO flows_flowpathrecentrun(id, run_id) VALUES 
 (1, 3);
 
+INSERT INTO flows_flowsession(id, uuid, org_id, contact_id, status, output, created_on, ended_on) VALUES
+(1, '9a4b2c1e-6f3d-4e8a-b7c5-2d1e0f9a8b7c', 2, 6, 'C', '{"contact": {"uuid": "3e814add-e614-41f7-8b5d-a07f670a698f", "name": "Ajodinabiff Dane", "urns": ["tel:+12067797777"]}, "runs": [{"events": [{"type": "msg_created", "msg": {"urn": "tel:+12067797777", "text": "hola"}}]}]}', '2017-08-12 19:00:00.000000+00', '2017-08-12 19:11:59.890662+00'),
+(2, '3c7e5a9d-1b2f-4d6e-8a0c-4f5b6e7d8c9a', 2, 8, 'X', NULL, '2017-08-11 08:00:00.000000+00', '2017-08-13 08:00:00.000000+00'),
+(3, 'e1d2c3b4-a596-4878-9a0b-1c2d3e4f5a6b', 2, 10, 'W', '{}', '2017-08-12 20:00:00.000000+00', NULL),
+(4, '5f6e7d8c-9b0a-4c1d-8e2f-3a4b5c6d7e8f', 2, 9, 'I', '{}', '2017-12-12 10:00:00.000000+00', '2017-12-12 10:05:00.000000+00'),
+(5, 'b8a7c6d5-e4f3-4a2b-9c1d-0e9f8a7b6c5d', 3, 7, 'C', '{"contact": {"uuid": "7051dff0-0a27-49d7-af1f-4494239139e6", "name": "Joanne Stone", "urns": ["tel:+12067798888"]}, "runs": [{"events": [{"type": "msg_created", "msg": {"urn": "tel:+12067798888", "text": "hi"}}]}]}', '2017-08-12 09:00:00.000000+00', '2017-08-12 09:30:00.000000+00');
+
+UPDATE flows_flowrun SET session_id = 1 WHERE id = 1;
+
+INSERT INTO channels_channelevent(id, event_type, extra, occurred_on, created_on, channel_id, contact_id, contact_urn_id, org_id) VALUES
+(1, 'mo_miss', NULL, '2017-08-12 10:00:00.000000+00', '2017-08-12 10:00:01.000000+00', 2, 6, 7, 2),
+(2, 'referral', '{"referrer_id": "ad-1", "source": "ADS"}', '2017-08-12 12:00:00.000000+00', '2017-08-12 12:00:01.000000+00', 2, 8, 9, 2),
+(3, 'mt_call', '{"duration": 15}', '2017-12-12 10:00:00.000000+00', '2017-12-12 10:00:01.000000+00', 2, 6, 7, 2),
+(4, 'mo_call', NULL, '2017-08-12 09:00:00.000000+00', '2017-08-12 09:00:01.000000+00', 3, 7, 8, 3);
+
 -- update run #5 to have a path longer than 500 steps
 UPDATE flows_flowrun SET path = s.path FROM (
     SELECT json_agg(CONCAT('{"uuid": "babf4fc8-e12c-4bb9-a9dd-61178a118b5a", "node_uuid": "accbc6e2-b0df-46cd-9a76-bff0fdf4d753", "arrived_on": "2017-10-12T15:07:24.', LPAD(gs.val::text, 6, '0'), '+02:00", "exit_uuid": "8249e2dc-c893-4200-b6d2-398d07a459bc"}')::jsonb) as path FROM generate_series(1, 1000) as gs(val)
@@ -0,0 +1,374 @@
+// Package testgen populates a test database with a large, realistic org so that the performance of archiving and
+// deleting can be measured. Generation is deterministic for a given spec, so when run against a freshly loaded
+// testdb.sql the resulting archives always have the same hashes.
+package testgen
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// Spec describes the org to generate
+type Spec struct {
+	OrgID          int
+	StartDate      time.Time
+	Days           int
+	MessagesPerDay int
+	RunsPerDay     int
+	Contacts       int
+	PathLength     int
+	Seed           int64
+}
+
+// DefaultSpec returns a spec for an org with a month of moderately busy history
+func DefaultSpec() *Spec {
+	return &Spec{
+		OrgID:          100,
+		StartDate:      time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC),
+		Days:           30,
+		MessagesPerDay: 1000,
+		RunsPerDay:     500,
+		Contacts:       200,
+		PathLength:     50,
+		Seed:           1,
+	}
+}
+
+// Result is what was generated for an org
+type Result struct {
+	Messages int
+	Runs     int
+	Elapsed  time.Duration
+}
+
+// the tables we insert into without ids, the fixtures insert explicit ids without advancing their sequences
+var serialTables = []string{
+	"channels_channel", "contacts_contact", "contacts_contacturn", "msgs_label", "msgs_msg", "msgs_msg_labels",
+	"msgs_broadcast", "flows_flow", "flows_flowrun",
+}
+
+var advanceSequence = `
+SELECT setval(pg_get_serial_sequence('%[1]s', 'id'), GREATEST((SELECT MAX(id) FROM %[1]s), 1))
+`
+
+// generator holds our state while generating an org
+type generator struct {
+	spec *Spec
+	rng  *rand.Rand
+	tx   *sqlx.Tx
+
+	channelID  int
+	contactIDs []int
+	urnIDs     []int
+	labelIDs   []int
+	broadcasts []int
+	flowIDs    []int
+}
+
+// Populate generates the org described by the passed in spec, failing if it already exists
+func Populate(ctx context.Context, db *sqlx.DB, spec *Spec) (*Result, error) {
+	start := time.Now()
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error starting transaction")
+	}
+	defer tx.Rollback()
+
+	g := &generator{spec: spec, rng: rand.New(rand.NewSource(spec.Seed)), tx: tx}
+
+	for _, table := range serialTables {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf(advanceSequence, table))
+		if err != nil {
+			return nil, errors.Wrapf(err, "error advancing sequence of: %s", table)
+		}
+	}
+
+	err = g.createOrg(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{}
+	for d := 0; d < spec.Days; d++ {
+		day := spec.StartDate.AddDate(0, 0, d)
+
+		err = g.createMessages(ctx, day)
+		if err != nil {
+			return nil, err
+		}
+		err = g.createRuns(ctx, day)
+		if err != nil {
+			return nil, err
+		}
+
+		result.Messages += spec.MessagesPerDay
+		result.Runs += spec.RunsPerDay
+	}
+
+	err = g.labelMessages(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, errors.Wrapf(err, "error committing generated org")
+	}
+
+	result.Elapsed = time.Since(start)
+	return result, nil
+}
+
+// uuid returns a new random, but deterministic, v4 UUID
+func (g *generator) uuid() string {
+	return fmt.Sprintf("%08x-%04x-4%03x-%04x-%012x", g.rng.Uint32(), g.rng.Intn(1<<16), g.rng.Intn(1<<12), 0x8000|g.rng.Intn(1<<14), g.rng.Int63n(1<<48))
+}
+
+// insertReturningID runs the passed in insert, returning the id of the new row
+func (g *generator) insertReturningID(ctx context.Context, query string, args ...interface{}) (int, error) {
+	var id int
+	err := g.tx.GetContext(ctx, &id, query+" RETURNING id", args...)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error inserting generated row")
+	}
+	return id, nil
+}
+
+func (g *generator) createOrg(ctx context.Context) error {
+	spec := g.spec
+
+	_, err := g.tx.ExecContext(ctx, `INSERT INTO orgs_org(id, name, is_active, is_anon, created_on) VALUES($1, $2, TRUE, FALSE, $3)`,
+		spec.OrgID, fmt.Sprintf("Generated Org %d", spec.OrgID), spec.StartDate)
+	if err != nil {
+		return errors.Wrapf(err, "error creating org: %d", spec.OrgID)
+	}
+
+	g.channelID, err = g.insertReturningID(ctx, `INSERT INTO channels_channel(uuid, name, org_id) VALUES($1, $2, $3)`, g.uuid(), "Generated Channel", spec.OrgID)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < spec.Contacts; i++ {
+		fields := fmt.Sprintf(`{"%s": {"text": "%d"}}`, g.uuid(), g.rng.Intn(100))
+		contactID, err := g.insertReturningID(ctx, `
+		INSERT INTO contacts_contact(is_active, created_by_id, created_on, modified_by_id, modified_on, org_id, is_blocked, name, language, uuid, is_stopped, fields)
+		VALUES(TRUE, -1, $1, -1, $1, $2, FALSE, $3, 'eng', $4, FALSE, $5)`,
+			spec.StartDate, spec.OrgID, fmt.Sprintf("Contact %d", i), g.uuid(), fields)
+		if err != nil {
+			return err
+		}
+
+		phone := fmt.Sprintf("+1%010d", g.rng.Int63n(1e10))
+		urnID, err := g.insertReturningID(ctx, `
+		INSERT INTO contacts_contacturn(contact_id, scheme, org_id, priority, path, channel_id, identity)
+		VALUES($1, 'tel', $2, 50, $3, $4, $5)`,
+			contactID, spec.OrgID, phone, g.channelID, "tel:"+phone)
+		if err != nil {
+			return err
+		}
+
+		g.contactIDs = append(g.contactIDs, contactID)
+		g.urnIDs = append(g.urnIDs, urnID)
+	}
+
+	for i := 0; i < 5; i++ {
+		labelID, err := g.insertReturningID(ctx, `INSERT INTO msgs_label(uuid, name) VALUES($1, $2)`, g.uuid(), fmt.Sprintf("Label %d", i))
+		if err != nil {
+			return err
+		}
+		g.labelIDs = append(g.labelIDs, labelID)
+	}
+
+	for i := 0; i < 3; i++ {
+		flowID, err := g.insertReturningID(ctx, `INSERT INTO flows_flow(uuid, name) VALUES($1, $2)`, g.uuid(), fmt.Sprintf("Flow %d", i))
+		if err != nil {
+			return err
+		}
+		g.flowIDs = append(g.flowIDs, flowID)
+	}
+
+	for i := 0; i < 10; i++ {
+		broadcastID, err := g.insertReturningID(ctx, `INSERT INTO msgs_broadcast(text, purged, created_on, org_id) VALUES(hstore('eng', $1), FALSE, $2, $3)`,
+			fmt.Sprintf("Broadcast %d", i), spec.StartDate, spec.OrgID)
+		if err != nil {
+			return err
+		}
+		g.broadcasts = append(g.broadcasts, broadcastID)
+	}
+
+	return nil
+}
+
+// createMessages creates a day of messages, mostly conversations of incoming messages and their replies with some
+// broadcasts, attachments and deleted messages mixed in
+func (g *generator) createMessages(ctx context.Context, day time.Time) error {
+	stmt, err := g.tx.PrepareContext(ctx, pq.CopyIn("msgs_msg",
+		"uuid", "text", "high_priority", "created_on", "modified_on", "sent_on", "queued_on", "direction", "status", "visibility",
+		"msg_type", "msg_count", "error_count", "next_attempt", "external_id", "attachments", "channel_id", "contact_id",
+		"contact_urn_id", "org_id", "broadcast_id", "metadata",
+	))
+	if err != nil {
+		return errors.Wrapf(err, "error preparing message copy")
+	}
+	defer stmt.Close()
+
+	for i := 0; i < g.spec.MessagesPerDay; i++ {
+		c := g.rng.Intn(len(g.contactIDs))
+		createdOn := day.Add(time.Duration(g.rng.Int63n(int64(time.Hour * 24))))
+
+		direction, status, msgType := "I", "H", "I"
+		var broadcastID sql.NullInt64
+		var sentOn *time.Time
+
+		// every other message is a reply, some of which are broadcasts
+		if i%2 == 1 {
+			direction, status, msgType = "O", "D", "F"
+			sentOn = &createdOn
+			if g.rng.Intn(10) == 0 {
+				broadcastID = sql.NullInt64{Int64: int64(g.broadcasts[g.rng.Intn(len(g.broadcasts))]), Valid: true}
+			}
+		}
+
+		visibility := "V"
+		switch g.rng.Intn(20) {
+		case 0:
+			visibility = "A"
+		case 1:
+			visibility = "D"
+		}
+
+		var attachments pq.StringArray
+		if g.rng.Intn(10) == 0 {
+			attachments = pq.StringArray{fmt.Sprintf("image/jpeg:https://example.com/attachments/%s.jpg", g.uuid())}
+		}
+
+		_, err = stmt.ExecContext(ctx,
+			g.uuid(), randomText(g.rng, 20+g.rng.Intn(140)), false, createdOn, createdOn, sentOn, createdOn, direction, status, visibility,
+			msgType, 1, 0, createdOn, fmt.Sprintf("ext%d", g.rng.Int63()), attachments, g.channelID, g.contactIDs[c],
+			g.urnIDs[c], g.spec.OrgID, broadcastID, "{}",
+		)
+		if err != nil {
+			return errors.Wrapf(err, "error copying message")
+		}
+	}
+
+	_, err = stmt.ExecContext(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "error flushing message copy")
+	}
+	return nil
+}
+
+// createRuns creates a day of runs, each with a long path and results
+func (g *generator) createRuns(ctx context.Context, day time.Time) error {
+	stmt, err := g.tx.PrepareContext(ctx, pq.CopyIn("flows_flowrun",
+		"uuid", "responded", "contact_id", "flow_id", "org_id", "results", "path", "events", "created_on", "modified_on",
+		"exited_on", "status", "exit_type",
+	))
+	if err != nil {
+		return errors.Wrapf(err, "error preparing run copy")
+	}
+	defer stmt.Close()
+
+	for i := 0; i < g.spec.RunsPerDay; i++ {
+		createdOn := day.Add(time.Duration(g.rng.Int63n(int64(time.Hour * 23))))
+		exitedOn := createdOn.Add(time.Duration(g.rng.Int63n(int64(time.Hour))))
+
+		path := make([]map[string]string, g.spec.PathLength)
+		for s := range path {
+			path[s] = map[string]string{
+				"uuid":       g.uuid(),
+				"node_uuid":  g.uuid(),
+				"arrived_on": createdOn.Add(time.Second * time.Duration(s)).Format(time.RFC3339Nano),
+				"exit_uuid":  g.uuid(),
+			}
+		}
+
+		results := make(map[string]map[string]string)
+		for r := 0; r < 1+g.spec.PathLength/10; r++ {
+			results[fmt.Sprintf("result_%d", r)] = map[string]string{
+				"name":       fmt.Sprintf("Result %d", r),
+				"node_uuid":  g.uuid(),
+				"value":      randomText(g.rng, 10),
+				"category":   "Other",
+				"input":      randomText(g.rng, 30),
+				"created_on": exitedOn.Format(time.RFC3339Nano),
+			}
+		}
+
+		pathJSON, _ := json.Marshal(path)
+		resultsJSON, _ := json.Marshal(results)
+
+		_, err = stmt.ExecContext(ctx,
+			g.uuid(), g.rng.Intn(2) == 0, g.contactIDs[g.rng.Intn(len(g.contactIDs))], g.flowIDs[g.rng.Intn(len(g.flowIDs))], g.spec.OrgID,
+			string(resultsJSON), string(pathJSON), "[]", createdOn, exitedOn, exitedOn, "C", "C",
+		)
+		if err != nil {
+			return errors.Wrapf(err, "error copying run")
+		}
+	}
+
+	_, err = stmt.ExecContext(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "error flushing run copy")
+	}
+	return nil
+}
+
+// labelMessages labels every fifth incoming message of our org
+func (g *generator) labelMessages(ctx context.Context) error {
+	for i, labelID := range g.labelIDs {
+		_, err := g.tx.ExecContext(ctx, `
+		INSERT INTO msgs_msg_labels(msg_id, label_id)
+		SELECT id, $1 FROM msgs_msg WHERE org_id = $2 AND direction = 'I' AND id % 25 = $3`,
+			labelID, g.spec.OrgID, i*5)
+		if err != nil {
+			return errors.Wrapf(err, "error labelling messages")
+		}
+	}
+	return nil
+}
+
+// PopulateArchives adds a daily archive for each of the passed in number of days from the passed in date, and a monthly
+// for each complete month, for the passed in org and type, so that looking up the archives of an org with years of
+// history can be measured. The archives aren't backed by any objects or records.
+func PopulateArchives(ctx context.Context, db *sqlx.DB, orgID int, archiveType string, startDate time.Time, days int) (int, error) {
+	endDate := startDate.AddDate(0, 0, days-1)
+
+	result, err := db.ExecContext(ctx, `
+	INSERT INTO archives_archive(archive_type, created_on, start_date, period, record_count, size, hash, url, needs_deletion, build_time, org_id)
+	SELECT $1, NOW(), d::date, 'D', 10, 100, md5(d::text), '', FALSE, 0, $2 FROM GENERATE_SERIES($3::date, $4::date, '1 day') d
+	UNION ALL
+	SELECT $1, NOW(), m::date, 'M', 300, 3000, md5(m::text), '', FALSE, 0, $2 FROM GENERATE_SERIES(date_trunc('month', $3::date), $4::date, '1 month') m
+	WHERE m >= $3::date AND m + '1 month'::interval <= $4::date + 1`,
+		archiveType, orgID, startDate, endDate)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error inserting generated archives")
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrapf(err, "error counting generated archives")
+	}
+	return int(inserted), nil
+}
+
+var words = []string{"hello", "yes", "no", "thanks", "please", "help", "stop", "water", "clinic", "today", "tomorrow", "agree", "maybe"}
+
+// randomText returns roughly the passed in number of characters of random words
+func randomText(rng *rand.Rand, length int) string {
+	text := words[rng.Intn(len(words))]
+	for len(text) < length {
+		text += " " + words[rng.Intn(len(words))]
+	}
+	return text
+}